@@ -0,0 +1,75 @@
+// Command remote-write-stub is a minimal Prometheus remote-write receiver for
+// local testing. It prints every received sample in exposition-like format.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+
+	"github.com/kart-io/k8s-agent/agent-manager/internal/remotewrite"
+)
+
+func main() {
+	addr := flag.String("addr", ":9201", "Listen address")
+	path := flag.String("path", "/api/v1/write", "Write endpoint path")
+	status := flag.Int("status", http.StatusNoContent, "Status code returned for write requests")
+	flag.Parse()
+
+	http.HandleFunc(*path, func(w http.ResponseWriter, r *http.Request) {
+		if *status/100 != 2 {
+			http.Error(w, http.StatusText(*status), *status)
+			return
+		}
+
+		compressed, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to decompress: %v", err), http.StatusBadRequest)
+			return
+		}
+		series, err := remotewrite.DecodeWriteRequest(data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		for _, ts := range series {
+			name, labels := formatLabels(ts.Labels)
+			for _, sample := range ts.Samples {
+				fmt.Fprintf(os.Stdout, "%s{%s} %g %s\n", name, labels, sample.Value,
+					time.UnixMilli(sample.Timestamp).UTC().Format(time.RFC3339))
+			}
+		}
+
+		w.WriteHeader(*status)
+	})
+
+	log.Printf("Remote-write stub listening on %s%s", *addr, *path)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
+
+// formatLabels splits out the metric name and renders the remaining labels
+func formatLabels(labels []remotewrite.Label) (string, string) {
+	var name string
+	pairs := make([]string, 0, len(labels))
+	for _, label := range labels {
+		if label.Name == "__name__" {
+			name = label.Value
+			continue
+		}
+		pairs = append(pairs, fmt.Sprintf("%s=%q", label.Name, label.Value))
+	}
+	return name, strings.Join(pairs, ",")
+}
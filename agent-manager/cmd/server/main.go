@@ -6,17 +6,23 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"gopkg.in/yaml.v3"
 
+	"github.com/kart-io/k8s-agent/protocol"
+
 	"github.com/kart-io/k8s-agent/agent-manager/internal/agent"
 	"github.com/kart-io/k8s-agent/agent-manager/internal/api"
 	"github.com/kart-io/k8s-agent/agent-manager/internal/command"
 	"github.com/kart-io/k8s-agent/agent-manager/internal/event"
+	"github.com/kart-io/k8s-agent/agent-manager/internal/metrics"
 	"github.com/kart-io/k8s-agent/agent-manager/internal/nats"
+	"github.com/kart-io/k8s-agent/agent-manager/internal/remotewrite"
 	"github.com/kart-io/k8s-agent/agent-manager/internal/storage"
 	"github.com/kart-io/k8s-agent/agent-manager/pkg/types"
 )
@@ -88,9 +94,44 @@ func run(config *types.Config, logger *zap.Logger) error {
 	logger.Info("Initializing event processor")
 	eventProcessor := event.NewProcessor(pgStore, redisStore, nil, logger)
 
+	// Initialize metrics processor
+	logger.Info("Initializing metrics processor")
+	metricsProcessor := metrics.NewProcessor(config.TimeSeries, pgStore, logger)
+	if err := metricsProcessor.Start(ctx); err != nil {
+		return fmt.Errorf("failed to start metrics processor: %w", err)
+	}
+	defer metricsProcessor.Stop()
+
+	// Forward metrics to Prometheus remote write if configured
+	if config.RemoteWrite.Enabled {
+		logger.Info("Initializing remote-write exporter")
+		exporter := remotewrite.NewExporter(config.RemoteWrite, logger)
+		if err := exporter.Start(ctx); err != nil {
+			return fmt.Errorf("failed to start remote-write exporter: %w", err)
+		}
+		defer exporter.Stop()
+		metricsProcessor.SetExporter(exporter)
+	}
+
 	// Initialize NATS server
 	logger.Info("Initializing NATS server")
-	natsServer := nats.NewServer(config.NATS, registry, eventProcessor, logger)
+	natsServer := nats.NewServer(config.NATS, registry, eventProcessor, metricsProcessor, logger)
+
+	// Initialize command dispatcher before subscribing so results have a handler
+	logger.Info("Initializing command dispatcher")
+	dispatcher := command.NewDispatcher(pgStore, redisStore, registry, natsServer, logger)
+	natsServer.SetResultHandler(dispatcher)
+
+	// Sign commands so that agents can verify they come from agent-manager
+	if config.CommandSigning.Enabled {
+		signer, err := newCommandSigner(config.CommandSigning)
+		if err != nil {
+			return err
+		}
+		natsServer.SetCommandSigner(signer)
+		logger.Info("Command signing enabled", zap.String("key_id", config.CommandSigning.KeyID))
+	}
+
 	if err := natsServer.Start(ctx); err != nil {
 		return fmt.Errorf("failed to start NATS server: %w", err)
 	}
@@ -99,16 +140,13 @@ func run(config *types.Config, logger *zap.Logger) error {
 	// Update event processor with NATS connection
 	// eventProcessor.SetNATS(natsServer.GetConnection())
 
-	// Initialize command dispatcher
-	logger.Info("Initializing command dispatcher")
-	dispatcher := command.NewDispatcher(pgStore, redisStore, registry, natsServer, logger)
-
 	// Initialize API server
 	logger.Info("Initializing API server")
 	apiServer := api.NewServer(
 		config.Server,
 		registry,
 		eventProcessor,
+		metricsProcessor,
 		dispatcher,
 		pgStore,
 		redisStore,
@@ -146,6 +184,32 @@ func run(config *types.Config, logger *zap.Logger) error {
 	return nil
 }
 
+// newCommandSigner loads the key commands are signed with
+func newCommandSigner(config types.CommandSigningConfig) (*protocol.CommandSigner, error) {
+	encoded := config.PrivateKey
+	if config.PrivateKeyFile != "" {
+		data, err := os.ReadFile(config.PrivateKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read command signing key: %w", err)
+		}
+		encoded = strings.TrimSpace(string(data))
+	}
+
+	key, err := protocol.ParsePrivateKey(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid command signing key: %w", err)
+	}
+	if config.KeyID == "" {
+		return nil, fmt.Errorf("command_signing.key_id is required")
+	}
+
+	ttl := config.TTL
+	if ttl <= 0 {
+		ttl = 5 * time.Minute
+	}
+	return protocol.NewCommandSigner(config.KeyID, key, ttl), nil
+}
+
 func loadConfig(path string) (*types.Config, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
@@ -193,6 +257,21 @@ func applyEnvOverrides(config *types.Config) {
 	if natsURL := os.Getenv("NATS_URL"); natsURL != "" {
 		config.NATS.URL = natsURL
 	}
+
+	// Command signing overrides
+	if signingKey := os.Getenv("COMMAND_SIGNING_KEY"); signingKey != "" {
+		config.CommandSigning.PrivateKey = signingKey
+		config.CommandSigning.Enabled = true
+	}
+	if signingKeyID := os.Getenv("COMMAND_SIGNING_KEY_ID"); signingKeyID != "" {
+		config.CommandSigning.KeyID = signingKeyID
+	}
+
+	// Remote write overrides
+	if remoteWriteURL := os.Getenv("REMOTE_WRITE_URL"); remoteWriteURL != "" {
+		config.RemoteWrite.URL = remoteWriteURL
+		config.RemoteWrite.Enabled = true
+	}
 }
 
 func initLogger(config types.LoggingConfig) (*zap.Logger, error) {
@@ -225,4 +304,4 @@ func initLogger(config types.LoggingConfig) (*zap.Logger, error) {
 	}
 
 	return zapConfig.Build()
-}
\ No newline at end of file
+}
@@ -3,9 +3,11 @@ package agent
 import (
 	"context"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"go.uber.org/zap"
 
 	"github.com/kart-io/k8s-agent/agent-manager/internal/storage"
@@ -14,13 +16,13 @@ import (
 
 // Registry manages agent lifecycle and state
 type Registry struct {
-	store       *storage.PostgresStore
-	cache       *storage.RedisStore
-	logger      *zap.Logger
-	mu          sync.RWMutex
-	agents      map[string]*types.Agent // In-memory cache
-	stopCh      chan struct{}
-	wg          sync.WaitGroup
+	store  *storage.PostgresStore
+	cache  *storage.RedisStore
+	logger *zap.Logger
+	mu     sync.RWMutex
+	agents map[string]*types.Agent // In-memory cache
+	stopCh chan struct{}
+	wg     sync.WaitGroup
 
 	// Configuration
 	heartbeatTimeout time.Duration
@@ -94,6 +96,9 @@ func (r *Registry) RegisterAgent(ctx context.Context, agent *types.Agent) error
 			zap.String("cluster_id", agent.ClusterID))
 	} else {
 		// New agent
+		if agent.ID == "" {
+			agent.ID = uuid.New().String()
+		}
 		agent.RegisteredAt = time.Now()
 		agent.UpdatedAt = time.Now()
 
@@ -152,33 +157,159 @@ func (r *Registry) UnregisterAgent(ctx context.Context, agentID string) error {
 	return nil
 }
 
-// UpdateHeartbeat updates agent heartbeat timestamp
-func (r *Registry) UpdateHeartbeat(ctx context.Context, agentID string) error {
+// UpdateHeartbeat records a heartbeat and the health it reports. The agent is
+// looked up by ID, or by cluster ID when the agent has not been assigned one yet.
+func (r *Registry) UpdateHeartbeat(ctx context.Context, agentID, clusterID string, health *types.AgentHealth) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	agent, err := r.findAgentLocked(ctx, agentID, clusterID)
+	if err != nil {
+		return err
+	}
+
 	// Update in database
-	if err := r.store.UpdateAgentHeartbeat(ctx, agentID); err != nil {
+	if err := r.store.UpdateAgentHeartbeat(ctx, agent.ID, health); err != nil {
 		return fmt.Errorf("failed to update heartbeat: %w", err)
 	}
 
+	if health != nil && health.Status != r.healthStatus(agent) {
+		r.logHealthChange(agent, health)
+	}
+
 	// Update in memory
-	if agent, ok := r.agents[agentID]; ok {
-		agent.LastHeartbeat = time.Now()
-		agent.Status = types.AgentStatusOnline
-		if agent.ConnectionInfo != nil {
-			agent.ConnectionInfo.LastSeen = time.Now()
-		}
+	agent.LastHeartbeat = time.Now()
+	agent.Status = types.AgentStatusOnline
+	agent.Health = health
+	if agent.ConnectionInfo != nil {
+		agent.ConnectionInfo.LastSeen = time.Now()
 	}
 
 	// Extend TTL in Redis
-	r.cache.SetAgentOnline(ctx, agentID, 2*time.Minute)
+	r.cache.SetAgentOnline(ctx, agent.ID, 2*time.Minute)
 
 	r.heartbeatCount++
 
 	return nil
 }
 
+// findAgentLocked resolves the agent a heartbeat belongs to; r.mu must be held
+func (r *Registry) findAgentLocked(ctx context.Context, agentID, clusterID string) (*types.Agent, error) {
+	if agent, ok := r.agents[agentID]; ok && agentID != "" {
+		return agent, nil
+	}
+
+	for _, agent := range r.agents {
+		if clusterID != "" && agent.ClusterID == clusterID {
+			return agent, nil
+		}
+	}
+
+	var agent *types.Agent
+	var err error
+	switch {
+	case agentID != "":
+		agent, err = r.store.GetAgent(ctx, agentID)
+	case clusterID != "":
+		agent, err = r.store.GetAgentByClusterID(ctx, clusterID)
+	default:
+		return nil, fmt.Errorf("heartbeat carries neither agent ID nor cluster ID")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unknown agent %q for cluster %q: %w", agentID, clusterID, err)
+	}
+
+	r.agents[agent.ID] = agent
+	return agent, nil
+}
+
+// healthStatus returns the last reported health status of an agent
+func (r *Registry) healthStatus(agent *types.Agent) string {
+	if agent.Health == nil {
+		return types.AgentHealthHealthy
+	}
+	return agent.Health.Status
+}
+
+// logHealthChange logs transitions between healthy and degraded
+func (r *Registry) logHealthChange(agent *types.Agent, health *types.AgentHealth) {
+	if health.Status == types.AgentHealthHealthy {
+		r.logger.Info("Agent recovered",
+			zap.String("agent_id", agent.ID),
+			zap.String("cluster_id", agent.ClusterID))
+		return
+	}
+
+	r.logger.Warn("Agent degraded",
+		zap.String("agent_id", agent.ID),
+		zap.String("cluster_id", agent.ClusterID),
+		zap.Strings("reasons", healthReasons(health)))
+}
+
+// DegradedReasons explains why an agent is not fully healthy, empty if it is
+func (r *Registry) DegradedReasons(agent *types.Agent) []string {
+	var reasons []string
+
+	if agent.Status != types.AgentStatusOnline {
+		reasons = append(reasons, fmt.Sprintf("agent is %s", agent.Status))
+	}
+
+	if since := time.Since(agent.LastHeartbeat); since > r.heartbeatTimeout {
+		reasons = append(reasons, fmt.Sprintf("no heartbeat for %s", since.Round(time.Second)))
+	}
+
+	if agent.Health != nil {
+		reasons = append(reasons, healthReasons(agent.Health)...)
+	}
+
+	return reasons
+}
+
+// healthReasons lists the problems reported in an agent heartbeat
+func healthReasons(health *types.AgentHealth) []string {
+	var reasons []string
+
+	names := make([]string, 0, len(health.Components))
+	for name := range health.Components {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		component := health.Components[name]
+		if component.Healthy {
+			continue
+		}
+
+		reason := fmt.Sprintf("%s unhealthy", name)
+		if component.Synced != nil && !*component.Synced {
+			reason = fmt.Sprintf("%s informer not synced", name)
+		}
+		if component.LastError != "" {
+			reason = fmt.Sprintf("%s: %s", reason, component.LastError)
+		}
+		reasons = append(reasons, reason)
+	}
+
+	if health.SpoolDepth > 0 {
+		reasons = append(reasons, fmt.Sprintf("%d messages spooled awaiting delivery", health.SpoolDepth))
+	}
+
+	kinds := make([]string, 0, len(health.Dropped))
+	for kind := range health.Dropped {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	for _, kind := range kinds {
+		if dropped := health.Dropped[kind]; dropped > 0 {
+			reasons = append(reasons, fmt.Sprintf("%d %s messages dropped", dropped, kind))
+		}
+	}
+
+	return reasons
+}
+
 // GetAgent retrieves agent by ID
 func (r *Registry) GetAgent(ctx context.Context, agentID string) (*types.Agent, error) {
 	r.mu.RLock()
@@ -398,11 +529,11 @@ func (r *Registry) GetStatistics() map[string]interface{} {
 	}
 
 	return map[string]interface{}{
-		"total_agents":        len(r.agents),
-		"online_agents":       onlineCount,
-		"offline_agents":      offlineCount,
-		"registration_count":  r.registrationCount,
-		"heartbeat_count":     r.heartbeatCount,
-		"heartbeat_timeout":   r.heartbeatTimeout.String(),
-	}
-}
\ No newline at end of file
+		"total_agents":       len(r.agents),
+		"online_agents":      onlineCount,
+		"offline_agents":     offlineCount,
+		"registration_count": r.registrationCount,
+		"heartbeat_count":    r.heartbeatCount,
+		"heartbeat_timeout":  r.heartbeatTimeout.String(),
+	}
+}
@@ -0,0 +1,326 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/kart-io/k8s-agent/agent-manager/internal/command"
+	"github.com/kart-io/k8s-agent/agent-manager/pkg/types"
+)
+
+// Following the output of a command
+var (
+	outputGracePeriod = 5 * time.Second  // how long chunks trailing the result are awaited
+	outputKeepAlive   = 15 * time.Second // interval of comments keeping idle streams open
+)
+
+// handleGetCommandOutput returns the stored output chunks of a command, and
+// the output they reassemble to
+func (s *Server) handleGetCommandOutput(c *gin.Context) {
+	commandID := c.Param("id")
+
+	if _, err := s.dispatcher.GetCommand(c.Request.Context(), commandID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "command not found"})
+		return
+	}
+
+	afterSeq, err := parseSeqParam(c.Query("after"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	chunks, err := s.dispatcher.ListCommandOutput(c.Request.Context(), commandID, afterSeq)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var output strings.Builder
+	for _, chunk := range chunks {
+		output.WriteString(chunk.Data)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"command_id": commandID,
+		"chunks":     chunks,
+		"count":      len(chunks),
+		"output":     output.String(),
+	})
+}
+
+// handleStreamCommandOutput follows the output of a command as server-sent
+// events: an output event per chunk, with the chunk sequence number as event
+// ID, then a result event once the command has finished. Clients reconnecting
+// with Last-Event-ID resume after the last chunk they received.
+func (s *Server) handleStreamCommandOutput(c *gin.Context) {
+	ctx := c.Request.Context()
+	commandID := c.Param("id")
+
+	if _, err := s.dispatcher.GetCommand(ctx, commandID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "command not found"})
+		return
+	}
+
+	after := c.GetHeader("Last-Event-ID")
+	if after == "" {
+		after = c.Query("after")
+	}
+	afterSeq, err := parseSeqParam(after)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Streams outlive the write timeout of ordinary requests
+	if err := http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{}); err != nil {
+		s.logger.Debug("Failed to clear write deadline", zap.Error(err))
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	stream := &outputStream{
+		writer:     c.Writer,
+		dispatcher: s.dispatcher,
+		commandID:  commandID,
+		lastSeq:    afterSeq,
+		ahead:      make(map[int64]*types.CommandOutputChunk),
+	}
+	if err := stream.run(ctx); err != nil && ctx.Err() == nil {
+		s.logger.Warn("Command output stream ended",
+			zap.String("command_id", commandID),
+			zap.Error(err))
+	}
+}
+
+// outputStream writes the output of one command to a follower, in sequence
+// order. Chunks arriving ahead of a missing one are held back until it
+// arrives, or until the command has finished and its grace period elapsed.
+type outputStream struct {
+	writer     gin.ResponseWriter
+	dispatcher *command.Dispatcher
+	commandID  string
+	lastSeq    int64
+	ahead      map[int64]*types.CommandOutputChunk
+}
+
+// run streams the output until the command has finished or ctx is done
+func (o *outputStream) run(ctx context.Context) error {
+	// Follow before replaying, so that no chunk falls between the two
+	updates, stop := o.dispatcher.FollowCommandOutput(o.commandID)
+	defer func() { stop() }()
+
+	finished, err := o.catchUp(ctx)
+	if err != nil {
+		return err
+	}
+
+	keepAlive := time.NewTicker(outputKeepAlive)
+	defer keepAlive.Stop()
+
+	var grace <-chan time.Time
+	for {
+		if finished {
+			result, _ := o.dispatcher.GetCommandResult(ctx, o.commandID)
+			// Chunks travel apart from the result and may still be on their way
+			if result == nil || o.lastSeq >= result.OutputChunks {
+				return o.sendResult(ctx, result)
+			}
+			if grace == nil {
+				grace = time.After(outputGracePeriod)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case <-grace:
+			if _, err := o.catchUp(ctx); err != nil {
+				return err
+			}
+			// Chunks still missing are not coming anymore
+			if err := o.skipGaps(); err != nil {
+				return err
+			}
+			result, _ := o.dispatcher.GetCommandResult(ctx, o.commandID)
+			return o.sendResult(ctx, result)
+
+		case <-keepAlive.C:
+			if err := o.write(": keep-alive\n\n"); err != nil {
+				return err
+			}
+
+		case update, ok := <-updates:
+			if !ok {
+				// Dropped for falling behind: follow again and resume from storage
+				stop()
+				updates, stop = o.dispatcher.FollowCommandOutput(o.commandID)
+				if finished, err = o.catchUp(ctx); err != nil {
+					return err
+				}
+				continue
+			}
+			if update.Done {
+				finished = true
+				continue
+			}
+			if update.Chunk.Seq > o.lastSeq+1 {
+				if _, err := o.catchUp(ctx); err != nil {
+					return err
+				}
+			}
+			if err := o.deliver(update.Chunk); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// catchUp sends the stored chunks the follower has not received yet, and
+// reports whether the command had finished before they were read
+func (o *outputStream) catchUp(ctx context.Context) (bool, error) {
+	cmd, err := o.dispatcher.GetCommand(ctx, o.commandID)
+	if err != nil {
+		return false, fmt.Errorf("failed to get command: %w", err)
+	}
+
+	chunks, err := o.dispatcher.ListCommandOutput(ctx, o.commandID, o.lastSeq)
+	if err != nil {
+		return false, fmt.Errorf("failed to list command output: %w", err)
+	}
+	for _, chunk := range chunks {
+		if err := o.deliver(chunk); err != nil {
+			return false, err
+		}
+	}
+
+	return commandFinished(cmd.Status), nil
+}
+
+// deliver sends a chunk unless it was already sent, holding it back while
+// chunks before it are missing, and then the held back chunks that follow it
+func (o *outputStream) deliver(chunk *types.CommandOutputChunk) error {
+	if chunk.Seq <= o.lastSeq {
+		return nil
+	}
+	if chunk.Seq > o.lastSeq+1 {
+		o.ahead[chunk.Seq] = chunk
+		return nil
+	}
+
+	if err := o.sendChunk(chunk); err != nil {
+		return err
+	}
+	for {
+		next, ok := o.ahead[o.lastSeq+1]
+		if !ok {
+			return nil
+		}
+		delete(o.ahead, next.Seq)
+		if err := o.sendChunk(next); err != nil {
+			return err
+		}
+	}
+}
+
+// skipGaps sends the held back chunks in order, skipping the missing ones
+func (o *outputStream) skipGaps() error {
+	seqs := make([]int64, 0, len(o.ahead))
+	for seq := range o.ahead {
+		seqs = append(seqs, seq)
+	}
+	slices.Sort(seqs)
+
+	for _, seq := range seqs {
+		chunk := o.ahead[seq]
+		delete(o.ahead, seq)
+		if err := o.sendChunk(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendChunk sends a chunk as an output event
+func (o *outputStream) sendChunk(chunk *types.CommandOutputChunk) error {
+	data, err := json.Marshal(chunk)
+	if err != nil {
+		return fmt.Errorf("failed to encode output chunk: %w", err)
+	}
+	if err := o.write(fmt.Sprintf("id: %d\nevent: output\ndata: %s\n\n", chunk.Seq, data)); err != nil {
+		return err
+	}
+
+	o.lastSeq = chunk.Seq
+	return nil
+}
+
+// sendResult sends the final result event; result is nil for commands that
+// finished without one, such as those that timed out
+func (o *outputStream) sendResult(ctx context.Context, result *types.CommandResult) error {
+	cmd, err := o.dispatcher.GetCommand(ctx, o.commandID)
+	if err != nil {
+		return fmt.Errorf("failed to get command: %w", err)
+	}
+
+	final := gin.H{
+		"command_id": o.commandID,
+		"status":     cmd.Status,
+	}
+	if result != nil {
+		final["exit_code"] = result.ExitCode
+		final["output_chunks"] = result.OutputChunks
+		final["error"] = result.Error
+	}
+
+	data, err := json.Marshal(final)
+	if err != nil {
+		return fmt.Errorf("failed to encode result: %w", err)
+	}
+	return o.write(fmt.Sprintf("event: result\ndata: %s\n\n", data))
+}
+
+// write sends an event and flushes it to the follower
+func (o *outputStream) write(event string) error {
+	if _, err := o.writer.WriteString(event); err != nil {
+		return err
+	}
+	o.writer.Flush()
+	return nil
+}
+
+// commandFinished reports whether a command has reached an outcome
+func commandFinished(status types.CommandStatus) bool {
+	switch status {
+	case types.CommandStatusPending, types.CommandStatusSent, types.CommandStatusExecuting:
+		return false
+	default:
+		return true
+	}
+}
+
+// parseSeqParam parses the sequence number output is resumed after
+func parseSeqParam(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	seq, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seq < 0 {
+		return 0, fmt.Errorf("invalid sequence number %q", value)
+	}
+	return seq, nil
+}
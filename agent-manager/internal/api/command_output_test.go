@@ -0,0 +1,410 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/kart-io/k8s-agent/agent-manager/internal/command"
+	"github.com/kart-io/k8s-agent/agent-manager/pkg/types"
+)
+
+// commandStore is a command.Store keeping commands, results and output in memory
+type commandStore struct {
+	mu       sync.Mutex
+	commands map[string]*types.Command
+	results  map[string]*types.CommandResult
+	chunks   map[string]map[int64]*types.CommandOutputChunk
+}
+
+func newCommandStore() *commandStore {
+	return &commandStore{
+		commands: make(map[string]*types.Command),
+		results:  make(map[string]*types.CommandResult),
+		chunks:   make(map[string]map[int64]*types.CommandOutputChunk),
+	}
+}
+
+func (s *commandStore) SaveCommand(ctx context.Context, cmd *types.Command) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := *cmd
+	s.commands[cmd.ID] = &stored
+	return nil
+}
+
+func (s *commandStore) GetCommand(ctx context.Context, id string) (*types.Command, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cmd, ok := s.commands[id]
+	if !ok {
+		return nil, errors.New("record not found")
+	}
+	stored := *cmd
+	return &stored, nil
+}
+
+func (s *commandStore) UpdateCommandStatus(ctx context.Context, id string, status types.CommandStatus) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cmd, ok := s.commands[id]; ok {
+		cmd.Status = status
+	}
+	return nil
+}
+
+func (s *commandStore) TransitionCommandStatus(ctx context.Context, id string, from []types.CommandStatus, to types.CommandStatus) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cmd, ok := s.commands[id]
+	if !ok || !slices.Contains(from, cmd.Status) {
+		return false, nil
+	}
+	cmd.Status = to
+	return true, nil
+}
+
+func (s *commandStore) FinishCommand(ctx context.Context, result *types.CommandResult, from []types.CommandStatus, to types.CommandStatus) (bool, error) {
+	updated, err := s.TransitionCommandStatus(ctx, result.CommandID, from, to)
+	if updated {
+		s.mu.Lock()
+		s.results[result.CommandID] = result
+		s.mu.Unlock()
+	}
+	return updated, err
+}
+
+func (s *commandStore) GetCommandResult(ctx context.Context, commandID string) (*types.CommandResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result, ok := s.results[commandID]
+	if !ok {
+		return nil, errors.New("record not found")
+	}
+	return result, nil
+}
+
+func (s *commandStore) SaveCommandOutput(ctx context.Context, chunk *types.CommandOutputChunk) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.chunks[chunk.CommandID] == nil {
+		s.chunks[chunk.CommandID] = make(map[int64]*types.CommandOutputChunk)
+	}
+	if _, ok := s.chunks[chunk.CommandID][chunk.Seq]; !ok {
+		s.chunks[chunk.CommandID][chunk.Seq] = chunk
+	}
+	return nil
+}
+
+func (s *commandStore) ListCommandOutput(ctx context.Context, commandID string, afterSeq int64) ([]*types.CommandOutputChunk, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var chunks []*types.CommandOutputChunk
+	for seq, chunk := range s.chunks[commandID] {
+		if seq > afterSeq {
+			chunks = append(chunks, chunk)
+		}
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].Seq < chunks[j].Seq })
+	return chunks, nil
+}
+
+// nopPublisher is a command.Publisher for commands that are never sent
+type nopPublisher struct{}
+
+func (nopPublisher) PublishCommand(clusterID string, cmd *types.Command) error { return nil }
+
+func (nopPublisher) PublishCancel(clusterID, commandID, reason string) error { return nil }
+
+// sseEvent is an event read from a server-sent event stream
+type sseEvent struct {
+	id    string
+	event string
+	data  string
+}
+
+func (e sseEvent) String() string {
+	if e.event == "output" {
+		var chunk types.CommandOutputChunk
+		json.Unmarshal([]byte(e.data), &chunk)
+		return fmt.Sprintf("%s:%s", e.id, chunk.Data)
+	}
+	var result struct {
+		Status string `json:"status"`
+	}
+	json.Unmarshal([]byte(e.data), &result)
+	return "result:" + result.Status
+}
+
+// readEvents reads the events of a stream until it closes
+func readEvents(resp *http.Response) <-chan sseEvent {
+	events := make(chan sseEvent)
+	go func() {
+		defer close(events)
+		defer resp.Body.Close()
+
+		var event sseEvent
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				if event.event != "" {
+					events <- event
+				}
+				event = sseEvent{}
+			case strings.HasPrefix(line, "id: "):
+				event.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				event.event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				event.data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+	}()
+	return events
+}
+
+// outputTest is a command followed over the output stream endpoint
+type outputTest struct {
+	t          *testing.T
+	dispatcher *command.Dispatcher
+	server     *httptest.Server
+}
+
+func newOutputTest(t *testing.T, status types.CommandStatus) *outputTest {
+	store := newCommandStore()
+	store.SaveCommand(context.Background(), &types.Command{ID: "cmd-1", ClusterID: "prod-1", Status: status})
+
+	logger := zap.NewNop()
+	dispatcher := command.NewDispatcher(store, nil, nil, nopPublisher{}, logger)
+	s := NewServer(types.ServerConfig{}, nil, nil, nil, dispatcher, nil, nil, logger)
+	s.setupRoutes()
+
+	server := httptest.NewServer(s.router)
+	t.Cleanup(server.Close)
+
+	return &outputTest{t: t, dispatcher: dispatcher, server: server}
+}
+
+// output reports a chunk as the agent does
+func (o *outputTest) output(seq int64) {
+	chunk := &types.CommandOutputChunk{CommandID: "cmd-1", ClusterID: "prod-1", Seq: seq, Stream: "stdout", Data: fmt.Sprintf("line %d", seq)}
+	if err := o.dispatcher.HandleCommandOutput(context.Background(), chunk); err != nil {
+		o.t.Fatalf("HandleCommandOutput failed: %v", err)
+	}
+}
+
+// result reports the result of the command after chunks output chunks
+func (o *outputTest) result(chunks int64) {
+	exitCode := 0
+	result := &types.CommandResult{ID: "result-1", CommandID: "cmd-1", ClusterID: "prod-1", Status: "success", ExitCode: &exitCode, OutputChunks: chunks}
+	if err := o.dispatcher.HandleCommandResult(context.Background(), result); err != nil {
+		o.t.Fatalf("HandleCommandResult failed: %v", err)
+	}
+}
+
+// follow opens the output stream, resuming after lastEventID if set
+func (o *outputTest) follow(lastEventID string) <-chan sseEvent {
+	ctx, cancel := context.WithCancel(context.Background())
+	o.t.Cleanup(cancel)
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, o.server.URL+"/api/v1/commands/cmd-1/output/stream", nil)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		o.t.Fatalf("failed to open stream: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		o.t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	return readEvents(resp)
+}
+
+// next returns the next event of a stream
+func (o *outputTest) next(events <-chan sseEvent) string {
+	select {
+	case event, ok := <-events:
+		if !ok {
+			return "closed"
+		}
+		return event.String()
+	case <-time.After(5 * time.Second):
+		o.t.Fatal("timed out waiting for an event")
+		return ""
+	}
+}
+
+// rest returns the remaining events of a stream, which must close
+func (o *outputTest) rest(events <-chan sseEvent) []string {
+	var rest []string
+	for {
+		event := o.next(events)
+		if event == "closed" {
+			return rest
+		}
+		rest = append(rest, event)
+	}
+}
+
+// settle gives the stream time to handle the updates sent so far, so that
+// they are not all read from storage at once
+func settle() {
+	time.Sleep(20 * time.Millisecond)
+}
+
+func TestStreamCommandOutput(t *testing.T) {
+	defer func(grace time.Duration) { outputGracePeriod = grace }(outputGracePeriod)
+	outputGracePeriod = 50 * time.Millisecond
+
+	tests := []struct {
+		name string
+		run  func(o *outputTest) []string
+		want []string
+	}{
+		{
+			name: "finished command",
+			run: func(o *outputTest) []string {
+				o.output(2)
+				o.output(1)
+				o.output(3)
+				o.result(3)
+				return o.rest(o.follow(""))
+			},
+			want: []string{"1:line 1", "2:line 2", "3:line 3", "result:completed"},
+		},
+		{
+			name: "resumed after the last event",
+			run: func(o *outputTest) []string {
+				o.output(1)
+				o.output(2)
+				o.output(3)
+				o.result(3)
+				return o.rest(o.follow("2"))
+			},
+			want: []string{"3:line 3", "result:completed"},
+		},
+		{
+			name: "live chunks out of order and redelivered",
+			run: func(o *outputTest) []string {
+				o.output(1)
+				events := o.follow("")
+				first := o.next(events)
+
+				o.output(3)
+				settle()
+				o.output(1)
+				o.output(2)
+				settle()
+				o.output(3)
+				o.output(4)
+				o.output(2)
+				o.result(4)
+				return append([]string{first}, o.rest(events)...)
+			},
+			want: []string{"1:line 1", "2:line 2", "3:line 3", "4:line 4", "result:completed"},
+		},
+		{
+			name: "chunks trailing the result",
+			run: func(o *outputTest) []string {
+				o.output(1)
+				events := o.follow("")
+				first := o.next(events)
+
+				o.result(3)
+				settle()
+				o.output(3)
+				settle()
+				o.output(2)
+				return append([]string{first}, o.rest(events)...)
+			},
+			want: []string{"1:line 1", "2:line 2", "3:line 3", "result:completed"},
+		},
+		{
+			name: "gap never filled",
+			run: func(o *outputTest) []string {
+				o.output(1)
+				events := o.follow("")
+				first := o.next(events)
+
+				o.output(3)
+				o.result(3)
+				return append([]string{first}, o.rest(events)...)
+			},
+			want: []string{"1:line 1", "3:line 3", "result:completed"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newOutputTest(t, types.CommandStatusExecuting)
+			if got := tt.run(o); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("events = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamCommandOutputWithoutResult(t *testing.T) {
+	o := newOutputTest(t, types.CommandStatusTimeout)
+	o.output(1)
+
+	if got, want := o.rest(o.follow("")), []string{"1:line 1", "result:timeout"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+}
+
+func TestGetCommandOutput(t *testing.T) {
+	o := newOutputTest(t, types.CommandStatusExecuting)
+	o.output(2)
+	o.output(1)
+	o.output(2)
+	o.output(3)
+
+	tests := []struct {
+		query  string
+		status int
+		want   string
+	}{
+		{"", http.StatusOK, "line 1line 2line 3"},
+		{"?after=1", http.StatusOK, "line 2line 3"},
+		{"?after=3", http.StatusOK, ""},
+		{"?after=-1", http.StatusBadRequest, ""},
+		{"?after=two", http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			resp, err := http.Get(o.server.URL + "/api/v1/commands/cmd-1/output" + tt.query)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			var body struct {
+				Output string `json:"output"`
+			}
+			json.NewDecoder(resp.Body).Decode(&body)
+			if body.Output != tt.want {
+				t.Errorf("output = %q, want %q", body.Output, tt.want)
+			}
+		})
+	}
+}
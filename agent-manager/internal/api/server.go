@@ -2,8 +2,11 @@ package api
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -13,6 +16,7 @@ import (
 	"github.com/kart-io/k8s-agent/agent-manager/internal/agent"
 	"github.com/kart-io/k8s-agent/agent-manager/internal/command"
 	"github.com/kart-io/k8s-agent/agent-manager/internal/event"
+	"github.com/kart-io/k8s-agent/agent-manager/internal/metrics"
 	"github.com/kart-io/k8s-agent/agent-manager/internal/storage"
 	"github.com/kart-io/k8s-agent/agent-manager/pkg/types"
 )
@@ -25,11 +29,12 @@ type Server struct {
 	logger     *zap.Logger
 
 	// Components
-	registry       *agent.Registry
-	eventProcessor *event.Processor
-	dispatcher     *command.Dispatcher
-	store          *storage.PostgresStore
-	cache          *storage.RedisStore
+	registry         *agent.Registry
+	eventProcessor   *event.Processor
+	metricsProcessor *metrics.Processor
+	dispatcher       *command.Dispatcher
+	store            *storage.PostgresStore
+	cache            *storage.RedisStore
 
 	// State
 	startTime time.Time
@@ -40,6 +45,7 @@ func NewServer(
 	config types.ServerConfig,
 	registry *agent.Registry,
 	eventProcessor *event.Processor,
+	metricsProcessor *metrics.Processor,
 	dispatcher *command.Dispatcher,
 	store *storage.PostgresStore,
 	cache *storage.RedisStore,
@@ -53,15 +59,16 @@ func NewServer(
 	}
 
 	return &Server{
-		config:         config,
-		router:         gin.New(),
-		logger:         logger.With(zap.String("component", "api-server")),
-		registry:       registry,
-		eventProcessor: eventProcessor,
-		dispatcher:     dispatcher,
-		store:          store,
-		cache:          cache,
-		startTime:      time.Now(),
+		config:           config,
+		router:           gin.New(),
+		logger:           logger.With(zap.String("component", "api-server")),
+		registry:         registry,
+		eventProcessor:   eventProcessor,
+		metricsProcessor: metricsProcessor,
+		dispatcher:       dispatcher,
+		store:            store,
+		cache:            cache,
+		startTime:        time.Now(),
 	}
 }
 
@@ -156,6 +163,8 @@ func (s *Server) setupRoutes() {
 			clusters.PUT("/:id", s.handleUpdateCluster)
 			clusters.DELETE("/:id", s.handleDeleteCluster)
 			clusters.GET("/:id/health", s.handleClusterHealth)
+			clusters.GET("/:id/metrics", s.handleClusterMetrics)
+			clusters.GET("/:id/metrics/latest", s.handleLatestClusterMetrics)
 		}
 
 		// Event management
@@ -172,6 +181,9 @@ func (s *Server) setupRoutes() {
 			commands.POST("", s.handleSendCommand)
 			commands.GET("/:id", s.handleGetCommand)
 			commands.GET("/:id/result", s.handleGetCommandResult)
+			commands.POST("/:id/cancel", s.handleCancelCommand)
+			commands.GET("/:id/output", s.handleGetCommandOutput)
+			commands.GET("/:id/output/stream", s.handleStreamCommandOutput)
 			commands.GET("", s.handleListPendingCommands)
 		}
 	}
@@ -222,12 +234,14 @@ func (s *Server) handleStatus(c *gin.Context) {
 		ActiveAgents:     onlineAgents,
 		TotalClusters:    len(totalClusters),
 		EventsProcessed:  s.eventProcessor.GetStatistics()["events_processed"].(int64),
+		MetricsProcessed: s.metricsProcessor.GetStatistics()["metrics_processed"].(int64),
 		CommandsIssued:   s.dispatcher.GetStatistics()["commands_issued"].(int64),
 		Timestamp:        time.Now(),
 		Components: map[string]interface{}{
-			"registry":        s.registry.GetStatistics(),
-			"event_processor": s.eventProcessor.GetStatistics(),
-			"dispatcher":      s.dispatcher.GetStatistics(),
+			"registry":          s.registry.GetStatistics(),
+			"event_processor":   s.eventProcessor.GetStatistics(),
+			"metrics_processor": s.metricsProcessor.GetStatistics(),
+			"dispatcher":        s.dispatcher.GetStatistics(),
 		},
 	}
 
@@ -363,16 +377,78 @@ func (s *Server) handleClusterHealth(c *gin.Context) {
 		return
 	}
 
+	reasons := s.registry.DegradedReasons(agent)
+	if reasons == nil {
+		reasons = []string{}
+	}
+
+	healthStatus := types.AgentHealthHealthy
+	if agent.Health != nil {
+		healthStatus = agent.Health.Status
+	}
+	if agent.Status != types.AgentStatusOnline {
+		healthStatus = string(agent.Status)
+	}
+
 	health := gin.H{
-		"cluster_id": clusterID,
-		"agent_status": agent.Status,
+		"cluster_id":     clusterID,
+		"agent_status":   agent.Status,
 		"last_heartbeat": agent.LastHeartbeat,
-		"healthy": agent.Status == types.AgentStatusOnline,
+		"healthy":        agent.Status == types.AgentStatusOnline && healthStatus == types.AgentHealthHealthy,
+		"health_status":  healthStatus,
+		"reasons":        reasons,
+		"agent_health":   agent.Health,
 	}
 
 	c.JSON(http.StatusOK, health)
 }
 
+// Metrics handlers
+
+func (s *Server) handleClusterMetrics(c *gin.Context) {
+	query := metrics.Query{
+		ClusterID:  c.Param("id"),
+		Node:       c.Query("node"),
+		Namespace:  c.Query("namespace"),
+		Resolution: c.Query("resolution"),
+	}
+	if names := c.Query("name"); names != "" {
+		query.Names = strings.Split(names, ",")
+	}
+
+	var err error
+	if query.Start, err = parseTimeParam(c.Query("start")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid start: %v", err)})
+		return
+	}
+	if query.End, err = parseTimeParam(c.Query("end")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid end: %v", err)})
+		return
+	}
+
+	result, err := s.metricsProcessor.Query(c.Request.Context(), query)
+	if errors.Is(err, metrics.ErrInvalidQuery) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+func (s *Server) handleLatestClusterMetrics(c *gin.Context) {
+	snapshot, err := s.metricsProcessor.Latest(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no metrics for cluster"})
+		return
+	}
+
+	c.JSON(http.StatusOK, snapshot)
+}
+
 // Event handlers
 
 func (s *Server) handleListEvents(c *gin.Context) {
@@ -440,6 +516,10 @@ func (s *Server) handleSendCommand(c *gin.Context) {
 	}
 
 	if err := s.dispatcher.DispatchCommand(c.Request.Context(), &cmd); err != nil {
+		if errors.Is(err, command.ErrInvalidCommand) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -471,6 +551,39 @@ func (s *Server) handleGetCommandResult(c *gin.Context) {
 	c.JSON(http.StatusOK, result)
 }
 
+// handleCancelCommand asks the agent to cancel a command, which reports it
+// cancelled once it has been dropped or killed
+func (s *Server) handleCancelCommand(c *gin.Context) {
+	commandID := c.Param("id")
+
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := s.dispatcher.GetCommand(c.Request.Context(), commandID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "command not found"})
+		return
+	}
+
+	if err := s.dispatcher.CancelCommand(c.Request.Context(), commandID, req.Reason); err != nil {
+		if errors.Is(err, command.ErrCommandFinished) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"command_id": commandID,
+		"message":    "cancel requested",
+	})
+}
+
 func (s *Server) handleListPendingCommands(c *gin.Context) {
 	commands := s.dispatcher.GetPendingCommands()
 
@@ -530,6 +643,17 @@ func (s *Server) requestIDMiddleware() gin.HandlerFunc {
 
 // Helper functions
 
+// parseTimeParam parses an RFC 3339 time or a duration relative to now, such as "-6h"
+func parseTimeParam(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(d), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
 func ptrAgentStatus(status types.AgentStatus) *types.AgentStatus {
 	return &status
-}
\ No newline at end of file
+}
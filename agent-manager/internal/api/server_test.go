@@ -0,0 +1,102 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/kart-io/k8s-agent/agent-manager/internal/metrics"
+	"github.com/kart-io/k8s-agent/agent-manager/pkg/types"
+)
+
+func TestParseTimeParam(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration // offset from now; ignored for absolute times
+		wantAbs time.Time
+		wantErr bool
+	}{
+		{value: ""},
+		{value: "-6h", want: -6 * time.Hour},
+		{value: "30m", want: 30 * time.Minute},
+		{value: "2024-03-01T12:00:00Z", wantAbs: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)},
+		{value: "2024-03-01T14:00:00+02:00", wantAbs: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)},
+		{value: "2024-03-01", wantErr: true},
+		{value: "yesterday", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			before := time.Now()
+			got, err := parseTimeParam(tt.value)
+			after := time.Now()
+
+			switch {
+			case tt.wantErr:
+				if err == nil {
+					t.Errorf("parseTimeParam(%q) = %v, want an error", tt.value, got)
+				}
+			case err != nil:
+				t.Errorf("parseTimeParam(%q) failed: %v", tt.value, err)
+			case tt.value == "":
+				if !got.IsZero() {
+					t.Errorf("parseTimeParam(%q) = %v, want the zero time", tt.value, got)
+				}
+			case !tt.wantAbs.IsZero():
+				if !got.Equal(tt.wantAbs) {
+					t.Errorf("parseTimeParam(%q) = %v, want %v", tt.value, got, tt.wantAbs)
+				}
+			default:
+				if got.Before(before.Add(tt.want)) || got.After(after.Add(tt.want)) {
+					t.Errorf("parseTimeParam(%q) = %v, want now%+v", tt.value, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestClusterMetricsRejectsInvalidQueries(t *testing.T) {
+	logger := zap.NewNop()
+	processor := metrics.NewProcessor(types.TimeSeriesConfig{}, nil, logger)
+	s := NewServer(types.ServerConfig{}, nil, nil, processor, nil, nil, nil, logger)
+	s.setupRoutes()
+
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{"invalid start", "start=yesterday", "invalid start"},
+		{"invalid end", "end=2024-03-01", "invalid end"},
+		{"start after end", "start=-1h&end=-2h", "start must be before end"},
+		{"unknown resolution", "resolution=hourly", "resolution must be"},
+		{"resolution under a second", "resolution=100ms", "resolution must be"},
+		{"too many points", "start=-720h&resolution=1m", "more than 1000 points"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/clusters/prod-1/metrics?"+tt.query, nil)
+			s.router.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want 400: %s", rec.Code, rec.Body)
+			}
+			var body struct {
+				Error string `json:"error"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			if !strings.Contains(body.Error, tt.want) {
+				t.Errorf("error = %q, want it to contain %q", body.Error, tt.want)
+			}
+		})
+	}
+}
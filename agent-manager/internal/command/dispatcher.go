@@ -2,45 +2,83 @@ package command
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	"go.uber.org/zap"
 
+	"github.com/kart-io/k8s-agent/protocol"
+
 	"github.com/kart-io/k8s-agent/agent-manager/internal/agent"
-	"github.com/kart-io/k8s-agent/agent-manager/internal/nats"
 	"github.com/kart-io/k8s-agent/agent-manager/internal/storage"
 	"github.com/kart-io/k8s-agent/agent-manager/pkg/types"
 )
 
+// ErrInvalidCommand is returned for commands agents would refuse to run
+var ErrInvalidCommand = errors.New("command validation failed")
+
+// ErrCommandFinished is returned when cancelling a command that has already
+// reached an outcome
+var ErrCommandFinished = errors.New("command already finished")
+
+// activeStatuses are the command states that have not reached an outcome yet
+var activeStatuses = []types.CommandStatus{
+	types.CommandStatusPending,
+	types.CommandStatusSent,
+	types.CommandStatusExecuting,
+}
+
+// Store persists commands, their results and their output
+type Store interface {
+	SaveCommand(ctx context.Context, cmd *types.Command) error
+	GetCommand(ctx context.Context, id string) (*types.Command, error)
+	UpdateCommandStatus(ctx context.Context, id string, status types.CommandStatus) error
+	TransitionCommandStatus(ctx context.Context, id string, from []types.CommandStatus, to types.CommandStatus) (bool, error)
+	FinishCommand(ctx context.Context, result *types.CommandResult, from []types.CommandStatus, to types.CommandStatus) (bool, error)
+	GetCommandResult(ctx context.Context, commandID string) (*types.CommandResult, error)
+	SaveCommandOutput(ctx context.Context, chunk *types.CommandOutputChunk) error
+	ListCommandOutput(ctx context.Context, commandID string, afterSeq int64) ([]*types.CommandOutputChunk, error)
+}
+
+// Publisher sends commands and cancel requests to agents
+type Publisher interface {
+	PublishCommand(clusterID string, cmd *types.Command) error
+	PublishCancel(clusterID, commandID, reason string) error
+}
+
 // Dispatcher handles command dispatch and tracking
 type Dispatcher struct {
-	store    *storage.PostgresStore
+	store    Store
 	cache    *storage.RedisStore
 	registry *agent.Registry
-	nats     *nats.Server
+	nats     Publisher
+	output   *outputHub
 	logger   *zap.Logger
 
 	// Command tracking
-	mu               sync.RWMutex
-	pendingCommands  map[string]*types.Command
-	commandTimeouts  map[string]*time.Timer
+	mu              sync.RWMutex
+	pendingCommands map[string]*types.Command
+	commandTimeouts map[string]*time.Timer
 
 	// Metrics
-	commandsIssued   int64
+	commandsIssued    int64
 	commandsCompleted int64
-	commandsFailed   int64
-	commandsTimeout  int64
+	commandsFailed    int64
+	commandsTimeout   int64
+	commandsRejected  int64
+	commandsCancelled int64
 }
 
 // NewDispatcher creates a new command dispatcher
 func NewDispatcher(
-	store *storage.PostgresStore,
+	store Store,
 	cache *storage.RedisStore,
 	registry *agent.Registry,
-	natsServer *nats.Server,
+	natsServer Publisher,
 	logger *zap.Logger,
 ) *Dispatcher {
 	return &Dispatcher{
@@ -48,6 +86,7 @@ func NewDispatcher(
 		cache:           cache,
 		registry:        registry,
 		nats:            natsServer,
+		output:          newOutputHub(),
 		logger:          logger.With(zap.String("component", "command-dispatcher")),
 		pendingCommands: make(map[string]*types.Command),
 		commandTimeouts: make(map[string]*time.Timer),
@@ -57,8 +96,9 @@ func NewDispatcher(
 // DispatchCommand dispatches a command to an agent
 func (d *Dispatcher) DispatchCommand(ctx context.Context, cmd *types.Command) error {
 	// Validate command
+	foldNamespace(cmd)
 	if err := d.validateCommand(cmd); err != nil {
-		return fmt.Errorf("command validation failed: %w", err)
+		return err
 	}
 
 	// Generate command ID if not present
@@ -103,8 +143,8 @@ func (d *Dispatcher) DispatchCommand(ctx context.Context, cmd *types.Command) er
 		return fmt.Errorf("failed to publish command: %w", err)
 	}
 
-	// Update status to sent
-	if err := d.updateCommandStatus(ctx, cmd.ID, types.CommandStatusSent); err != nil {
+	// Update status to sent, unless the agent already acknowledged or answered
+	if _, err := d.transitionCommandStatus(ctx, cmd.ID, []types.CommandStatus{types.CommandStatusPending}, types.CommandStatusSent); err != nil {
 		d.logger.Warn("Failed to update command status", zap.Error(err))
 	}
 
@@ -124,30 +164,60 @@ func (d *Dispatcher) DispatchCommand(ctx context.Context, cmd *types.Command) er
 	return nil
 }
 
+// HandleCommandAck marks a command as executing once the agent has picked it up
+func (d *Dispatcher) HandleCommandAck(ctx context.Context, commandID string) error {
+	updated, err := d.transitionCommandStatus(ctx, commandID,
+		[]types.CommandStatus{types.CommandStatusPending, types.CommandStatusSent},
+		types.CommandStatusExecuting)
+	if err != nil {
+		return fmt.Errorf("failed to update command status: %w", err)
+	}
+
+	if !updated {
+		d.logger.Debug("Ignoring ack for command that is no longer waiting",
+			zap.String("command_id", commandID))
+		return nil
+	}
+
+	d.logger.Debug("Command executing", zap.String("command_id", commandID))
+	return nil
+}
+
 // HandleCommandResult handles a command execution result
 func (d *Dispatcher) HandleCommandResult(ctx context.Context, result *types.CommandResult) error {
-	// Save result to database
-	if err := d.store.SaveCommandResult(ctx, result); err != nil {
+	// Finish the command with the result; redelivered or late results, such
+	// as the rejection of a replayed command, leave the command and its
+	// result unchanged
+	status := commandStatusFromResult(result.Status)
+	updated, err := d.finishCommand(ctx, result, status)
+	if err != nil {
 		return fmt.Errorf("failed to save command result: %w", err)
 	}
 
-	// Update command status
-	var status types.CommandStatus
-	if result.Status == "success" {
-		status = types.CommandStatusCompleted
-		d.mu.Lock()
-		d.commandsCompleted++
-		d.mu.Unlock()
-	} else {
-		status = types.CommandStatusFailed
-		d.mu.Lock()
-		d.commandsFailed++
-		d.mu.Unlock()
+	// Followers of the output wait for this result
+	d.finishOutput(result.CommandID)
+
+	if !updated {
+		d.logger.Info("Command already finished, result kept as late result",
+			zap.String("command_id", result.CommandID),
+			zap.String("status", result.Status))
+		return nil
 	}
 
-	if err := d.updateCommandStatus(ctx, result.CommandID, status); err != nil {
-		d.logger.Warn("Failed to update command status", zap.Error(err))
+	d.mu.Lock()
+	switch status {
+	case types.CommandStatusCompleted:
+		d.commandsCompleted++
+	case types.CommandStatusTimeout:
+		d.commandsTimeout++
+	case types.CommandStatusRejected:
+		d.commandsRejected++
+	case types.CommandStatusCancelled:
+		d.commandsCancelled++
+	default:
+		d.commandsFailed++
 	}
+	d.mu.Unlock()
 
 	// Cancel timeout timer
 	d.cancelCommandTimeout(result.CommandID)
@@ -165,6 +235,31 @@ func (d *Dispatcher) HandleCommandResult(ctx context.Context, result *types.Comm
 	return nil
 }
 
+// CancelCommand asks the agent running a command to cancel it. The agent
+// drops the command if it waits for a worker, or kills it if it runs, and
+// reports a result of status cancelled, which finishes the command.
+func (d *Dispatcher) CancelCommand(ctx context.Context, commandID, reason string) error {
+	cmd, err := d.store.GetCommand(ctx, commandID)
+	if err != nil {
+		return fmt.Errorf("failed to get command: %w", err)
+	}
+
+	if !slices.Contains(activeStatuses, cmd.Status) {
+		return fmt.Errorf("%w: status is %s", ErrCommandFinished, cmd.Status)
+	}
+
+	if err := d.nats.PublishCancel(cmd.ClusterID, commandID, reason); err != nil {
+		return fmt.Errorf("failed to publish cancel: %w", err)
+	}
+
+	d.logger.Info("Command cancel requested",
+		zap.String("command_id", commandID),
+		zap.String("cluster_id", cmd.ClusterID),
+		zap.String("reason", reason))
+
+	return nil
+}
+
 // GetCommand retrieves a command by ID
 func (d *Dispatcher) GetCommand(ctx context.Context, commandID string) (*types.Command, error) {
 	return d.store.GetCommand(ctx, commandID)
@@ -175,40 +270,67 @@ func (d *Dispatcher) GetCommandResult(ctx context.Context, commandID string) (*t
 	return d.store.GetCommandResult(ctx, commandID)
 }
 
-// validateCommand validates command before dispatch
+// commandStatusFromResult maps the status reported by an agent to a command status
+func commandStatusFromResult(status string) types.CommandStatus {
+	switch status {
+	case protocol.CommandStatusSuccess:
+		return types.CommandStatusCompleted
+	case protocol.CommandStatusTimeout:
+		return types.CommandStatusTimeout
+	case protocol.CommandStatusRejected:
+		return types.CommandStatusRejected
+	case protocol.CommandStatusCancelled:
+		return types.CommandStatusCancelled
+	default:
+		return types.CommandStatusFailed
+	}
+}
+
+// validateCommand validates command before dispatch, checking its tool,
+// action, arguments and params against the schemas agents enforce
 func (d *Dispatcher) validateCommand(cmd *types.Command) error {
 	if cmd.ClusterID == "" {
-		return fmt.Errorf("cluster_id is required")
+		return fmt.Errorf("%w: cluster_id is required", ErrInvalidCommand)
 	}
 
 	if cmd.Type == "" {
-		return fmt.Errorf("command type is required")
+		return fmt.Errorf("%w: command type is required", ErrInvalidCommand)
 	}
 
 	if cmd.Tool == "" {
-		return fmt.Errorf("tool is required")
+		return fmt.Errorf("%w: tool is required", ErrInvalidCommand)
 	}
 
-	if cmd.Action == "" {
-		return fmt.Errorf("action is required")
+	if err := protocol.ValidateCommandType(cmd.Type, cmd.Tool); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidCommand, err)
 	}
 
-	// Validate tool whitelist
-	allowedTools := map[string]bool{
-		"kubectl": true,
-		"ps":      true,
-		"df":      true,
-		"netstat": true,
-		"curl":    true,
-		"ping":    true,
-		"top":     true,
+	if err := protocol.ValidateCommand(cmd.Tool, cmd.Action, cmd.Args, cmd.Params, cmd.Env); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidCommand, err)
 	}
 
-	if !allowedTools[cmd.Tool] {
-		return fmt.Errorf("tool '%s' is not allowed", cmd.Tool)
+	return nil
+}
+
+// foldNamespace passes the namespace of a kubectl or namespaced remediation
+// command as its namespace param, unless the params select one
+func foldNamespace(cmd *types.Command) {
+	if cmd.Namespace == "" {
+		return
+	}
+	if cmd.Tool != "kubectl" && (cmd.Tool != protocol.RemediationTool || protocol.RemediationClusterScoped(cmd.Action)) {
+		return
+	}
+	if cmd.Params[protocol.CommandParamNamespace] != "" || cmd.Params[protocol.CommandParamAllNamespaces] != "" {
+		return
 	}
 
-	return nil
+	params := make(map[string]string, len(cmd.Params)+1)
+	for k, v := range cmd.Params {
+		params[k] = v
+	}
+	params[protocol.CommandParamNamespace] = cmd.Namespace
+	cmd.Params = params
 }
 
 // updateCommandStatus updates command status in database
@@ -216,6 +338,41 @@ func (d *Dispatcher) updateCommandStatus(ctx context.Context, commandID string,
 	return d.store.UpdateCommandStatus(ctx, commandID, status)
 }
 
+// finishCommand finishes an active command with its result, keeping the
+// tracked copy in sync
+func (d *Dispatcher) finishCommand(ctx context.Context, result *types.CommandResult, status types.CommandStatus) (bool, error) {
+	updated, err := d.store.FinishCommand(ctx, result, activeStatuses, status)
+	if err != nil || !updated {
+		return updated, err
+	}
+
+	d.trackStatus(result.CommandID, status)
+	return true, nil
+}
+
+// transitionCommandStatus moves a command to status if it is in one of from,
+// keeping the tracked copy in sync
+func (d *Dispatcher) transitionCommandStatus(ctx context.Context, commandID string, from []types.CommandStatus, status types.CommandStatus) (bool, error) {
+	updated, err := d.store.TransitionCommandStatus(ctx, commandID, from, status)
+	if err != nil || !updated {
+		return updated, err
+	}
+
+	d.trackStatus(commandID, status)
+	return true, nil
+}
+
+// trackStatus updates the status of the tracked copy of a command
+func (d *Dispatcher) trackStatus(commandID string, status types.CommandStatus) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if cmd, ok := d.pendingCommands[commandID]; ok {
+		cmd.Status = status
+		cmd.UpdatedAt = time.Now()
+	}
+}
+
 // setupCommandTimeout sets up timeout for command
 func (d *Dispatcher) setupCommandTimeout(cmd *types.Command) {
 	timer := time.AfterFunc(cmd.Timeout, func() {
@@ -244,8 +401,24 @@ func (d *Dispatcher) handleCommandTimeout(commandID string) {
 
 	d.logger.Warn("Command timeout", zap.String("command_id", commandID))
 
-	// Update status
-	if err := d.updateCommandStatus(ctx, commandID, types.CommandStatusTimeout); err != nil {
+	var clusterID string
+	d.mu.RLock()
+	if cmd, ok := d.pendingCommands[commandID]; ok {
+		clusterID = cmd.ClusterID
+	}
+	d.mu.RUnlock()
+
+	// Finish the command with a timeout result unless a result arrived in the
+	// meantime, so that the result the agent may still send is a late one
+	updated, err := d.finishCommand(ctx, &types.CommandResult{
+		ID:        uuid.New().String(),
+		CommandID: commandID,
+		ClusterID: clusterID,
+		Status:    string(types.CommandStatusTimeout),
+		Error:     "timed out in agent-manager",
+		Timestamp: time.Now(),
+	}, types.CommandStatusTimeout)
+	if err != nil {
 		d.logger.Error("Failed to update timeout status",
 			zap.String("command_id", commandID),
 			zap.Error(err))
@@ -254,8 +427,25 @@ func (d *Dispatcher) handleCommandTimeout(commandID string) {
 	// Remove from pending
 	d.mu.Lock()
 	delete(d.pendingCommands, commandID)
-	d.commandsTimeout++
+	delete(d.commandTimeouts, commandID)
+	if updated {
+		d.commandsTimeout++
+	}
 	d.mu.Unlock()
+
+	if !updated {
+		return
+	}
+	d.finishOutput(commandID)
+
+	// The agent may still hold the command, queued or running
+	if cmd, err := d.store.GetCommand(ctx, commandID); err == nil {
+		if err := d.nats.PublishCancel(cmd.ClusterID, commandID, "timed out in agent-manager"); err != nil {
+			d.logger.Warn("Failed to cancel timed out command",
+				zap.String("command_id", commandID),
+				zap.Error(err))
+		}
+	}
 }
 
 // GetPendingCommands returns all pending commands
@@ -281,6 +471,8 @@ func (d *Dispatcher) GetStatistics() map[string]interface{} {
 		"commands_completed": d.commandsCompleted,
 		"commands_failed":    d.commandsFailed,
 		"commands_timeout":   d.commandsTimeout,
+		"commands_rejected":  d.commandsRejected,
+		"commands_cancelled": d.commandsCancelled,
 		"pending_commands":   len(d.pendingCommands),
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,437 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/kart-io/k8s-agent/protocol"
+
+	"github.com/kart-io/k8s-agent/agent-manager/pkg/types"
+)
+
+var errNotFound = errors.New("record not found")
+
+// memoryStore is a Store keeping commands, results and output in memory, with
+// the conditional updates of the PostgreSQL store
+type memoryStore struct {
+	mu       sync.Mutex
+	commands map[string]*types.Command
+	results  map[string]*types.CommandResult
+	late     []types.LateCommandResult
+	chunks   map[string]map[int64]*types.CommandOutputChunk
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		commands: make(map[string]*types.Command),
+		results:  make(map[string]*types.CommandResult),
+		chunks:   make(map[string]map[int64]*types.CommandOutputChunk),
+	}
+}
+
+func (s *memoryStore) SaveCommand(ctx context.Context, cmd *types.Command) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := *cmd
+	s.commands[cmd.ID] = &stored
+	return nil
+}
+
+func (s *memoryStore) GetCommand(ctx context.Context, id string) (*types.Command, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cmd, ok := s.commands[id]
+	if !ok {
+		return nil, errNotFound
+	}
+	stored := *cmd
+	return &stored, nil
+}
+
+func (s *memoryStore) UpdateCommandStatus(ctx context.Context, id string, status types.CommandStatus) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cmd, ok := s.commands[id]; ok {
+		cmd.Status = status
+	}
+	return nil
+}
+
+func (s *memoryStore) TransitionCommandStatus(ctx context.Context, id string, from []types.CommandStatus, to types.CommandStatus) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cmd, ok := s.commands[id]
+	if !ok || !slices.Contains(from, cmd.Status) {
+		return false, nil
+	}
+	cmd.Status = to
+	return true, nil
+}
+
+func (s *memoryStore) FinishCommand(ctx context.Context, result *types.CommandResult, from []types.CommandStatus, to types.CommandStatus) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cmd, ok := s.commands[result.CommandID]
+	if !ok || !slices.Contains(from, cmd.Status) {
+		s.late = append(s.late, types.LateCommandResult{CommandResult: *result, ReceivedAt: time.Now()})
+		return false, nil
+	}
+	cmd.Status = to
+	stored := *result
+	s.results[result.CommandID] = &stored
+	return true, nil
+}
+
+func (s *memoryStore) GetCommandResult(ctx context.Context, commandID string) (*types.CommandResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result, ok := s.results[commandID]
+	if !ok {
+		return nil, errNotFound
+	}
+	stored := *result
+	return &stored, nil
+}
+
+func (s *memoryStore) SaveCommandOutput(ctx context.Context, chunk *types.CommandOutputChunk) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.chunks[chunk.CommandID] == nil {
+		s.chunks[chunk.CommandID] = make(map[int64]*types.CommandOutputChunk)
+	}
+	if _, ok := s.chunks[chunk.CommandID][chunk.Seq]; !ok {
+		s.chunks[chunk.CommandID][chunk.Seq] = chunk
+	}
+	return nil
+}
+
+func (s *memoryStore) ListCommandOutput(ctx context.Context, commandID string, afterSeq int64) ([]*types.CommandOutputChunk, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var chunks []*types.CommandOutputChunk
+	for seq, chunk := range s.chunks[commandID] {
+		if seq > afterSeq {
+			chunks = append(chunks, chunk)
+		}
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].Seq < chunks[j].Seq })
+	return chunks, nil
+}
+
+func (s *memoryStore) status(id string) types.CommandStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.commands[id].Status
+}
+
+func (s *memoryStore) lateResults() []types.LateCommandResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.late)
+}
+
+// recordingPublisher is a Publisher recording the cancel requests sent to agents
+type recordingPublisher struct {
+	mu      sync.Mutex
+	cancels []string
+}
+
+func (p *recordingPublisher) PublishCommand(clusterID string, cmd *types.Command) error {
+	return nil
+}
+
+func (p *recordingPublisher) PublishCancel(clusterID, commandID, reason string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cancels = append(p.cancels, commandID)
+	return nil
+}
+
+func (p *recordingPublisher) sent() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Clone(p.cancels)
+}
+
+// newTrackedCommand creates a dispatcher tracking a sent command, as
+// DispatchCommand leaves it
+func newTrackedCommand(t *testing.T) (*Dispatcher, *memoryStore, *recordingPublisher, *types.Command) {
+	store := newMemoryStore()
+	publisher := &recordingPublisher{}
+	d := NewDispatcher(store, nil, nil, publisher, zap.NewNop())
+
+	cmd := &types.Command{ID: "cmd-1", ClusterID: "prod-1", Status: types.CommandStatusSent, Timeout: time.Minute}
+	if err := store.SaveCommand(context.Background(), cmd); err != nil {
+		t.Fatalf("SaveCommand failed: %v", err)
+	}
+	d.pendingCommands[cmd.ID] = cmd
+	d.setupCommandTimeout(cmd)
+	t.Cleanup(func() { d.cancelCommandTimeout(cmd.ID) })
+
+	return d, store, publisher, cmd
+}
+
+func resultOf(status string) *types.CommandResult {
+	return &types.CommandResult{
+		ID:        "result-" + status,
+		CommandID: "cmd-1",
+		ClusterID: "prod-1",
+		Status:    status,
+		Timestamp: time.Now(),
+	}
+}
+
+func TestCommandLifecycle(t *testing.T) {
+	tests := []struct {
+		name       string
+		events     []string // "ack", "timeout" or the status of a result
+		wantStatus types.CommandStatus
+		wantResult string   // status of the stored result
+		wantLate   []string // statuses of the results kept as late results
+		wantCancel bool
+		wantStats  map[string]int64
+	}{
+		{
+			name:       "ack then result",
+			events:     []string{"ack", protocol.CommandStatusSuccess},
+			wantStatus: types.CommandStatusCompleted,
+			wantResult: protocol.CommandStatusSuccess,
+			wantStats:  map[string]int64{"commands_completed": 1},
+		},
+		{
+			name:       "ack after result",
+			events:     []string{protocol.CommandStatusFailed, "ack"},
+			wantStatus: types.CommandStatusFailed,
+			wantResult: protocol.CommandStatusFailed,
+			wantStats:  map[string]int64{"commands_failed": 1},
+		},
+		{
+			name:       "redelivered ack",
+			events:     []string{"ack", "ack"},
+			wantStatus: types.CommandStatusExecuting,
+			wantStats:  map[string]int64{},
+		},
+		{
+			name:       "second result",
+			events:     []string{"ack", protocol.CommandStatusRejected, protocol.CommandStatusSuccess},
+			wantStatus: types.CommandStatusRejected,
+			wantResult: protocol.CommandStatusRejected,
+			wantLate:   []string{protocol.CommandStatusSuccess},
+			wantStats:  map[string]int64{"commands_rejected": 1},
+		},
+		{
+			name:       "result after timeout",
+			events:     []string{"ack", "timeout", protocol.CommandStatusSuccess},
+			wantStatus: types.CommandStatusTimeout,
+			wantResult: string(types.CommandStatusTimeout),
+			wantLate:   []string{protocol.CommandStatusSuccess},
+			wantCancel: true,
+			wantStats:  map[string]int64{"commands_timeout": 1},
+		},
+		{
+			name:       "ack after timeout",
+			events:     []string{"timeout", "ack"},
+			wantStatus: types.CommandStatusTimeout,
+			wantResult: string(types.CommandStatusTimeout),
+			wantCancel: true,
+			wantStats:  map[string]int64{"commands_timeout": 1},
+		},
+		{
+			name:       "timeout after result",
+			events:     []string{protocol.CommandStatusSuccess, "timeout"},
+			wantStatus: types.CommandStatusCompleted,
+			wantResult: protocol.CommandStatusSuccess,
+			wantLate:   []string{string(types.CommandStatusTimeout)},
+			wantStats:  map[string]int64{"commands_completed": 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, store, publisher, cmd := newTrackedCommand(t)
+			ctx := context.Background()
+
+			for _, event := range tt.events {
+				var err error
+				switch event {
+				case "ack":
+					err = d.HandleCommandAck(ctx, cmd.ID)
+				case "timeout":
+					d.handleCommandTimeout(cmd.ID)
+				default:
+					err = d.HandleCommandResult(ctx, resultOf(event))
+				}
+				if err != nil {
+					t.Fatalf("%s failed: %v", event, err)
+				}
+			}
+
+			if got := store.status(cmd.ID); got != tt.wantStatus {
+				t.Errorf("status = %s, want %s", got, tt.wantStatus)
+			}
+
+			result, err := store.GetCommandResult(ctx, cmd.ID)
+			switch {
+			case tt.wantResult == "" && err == nil:
+				t.Errorf("stored result %s, want none", result.Status)
+			case tt.wantResult != "" && err != nil:
+				t.Errorf("no stored result, want %s", tt.wantResult)
+			case tt.wantResult != "" && result.Status != tt.wantResult:
+				t.Errorf("stored result = %s, want %s", result.Status, tt.wantResult)
+			}
+
+			var late []string
+			for _, r := range store.lateResults() {
+				late = append(late, r.Status)
+			}
+			if fmt.Sprint(late) != fmt.Sprint(tt.wantLate) {
+				t.Errorf("late results = %v, want %v", late, tt.wantLate)
+			}
+
+			if cancelled := len(publisher.sent()) > 0; cancelled != tt.wantCancel {
+				t.Errorf("cancel sent = %v, want %v", cancelled, tt.wantCancel)
+			}
+
+			stats := d.GetStatistics()
+			for _, counter := range []string{"commands_completed", "commands_failed", "commands_timeout", "commands_rejected", "commands_cancelled"} {
+				if stats[counter] != tt.wantStats[counter] {
+					t.Errorf("%s = %v, want %d", counter, stats[counter], tt.wantStats[counter])
+				}
+			}
+
+			// Only commands without an outcome stay tracked
+			finished := !slices.Contains(activeStatuses, tt.wantStatus)
+			if pending := stats["pending_commands"].(int); (pending == 0) != finished {
+				t.Errorf("pending commands = %d with status %s", pending, tt.wantStatus)
+			}
+			if pending := d.GetPendingCommands(); !finished && pending[0].Status != tt.wantStatus {
+				t.Errorf("tracked status = %s, want %s", pending[0].Status, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestCommandTimeoutRacingResult(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		d, store, publisher, cmd := newTrackedCommand(t)
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			d.handleCommandTimeout(cmd.ID)
+		}()
+		go func() {
+			defer wg.Done()
+			if err := d.HandleCommandResult(context.Background(), resultOf(protocol.CommandStatusSuccess)); err != nil {
+				t.Errorf("HandleCommandResult failed: %v", err)
+			}
+		}()
+		wg.Wait()
+
+		// Exactly one of them finishes the command, the other is kept as late result
+		stats := d.GetStatistics()
+		status := store.status(cmd.ID)
+		late := store.lateResults()
+		switch status {
+		case types.CommandStatusCompleted:
+			if stats["commands_completed"] != int64(1) || stats["commands_timeout"] != int64(0) || len(publisher.sent()) != 0 {
+				t.Fatalf("completed command: stats %v, cancels %v", stats, publisher.sent())
+			}
+		case types.CommandStatusTimeout:
+			if stats["commands_completed"] != int64(0) || stats["commands_timeout"] != int64(1) || len(publisher.sent()) != 1 {
+				t.Fatalf("timed out command: stats %v, cancels %v", stats, publisher.sent())
+			}
+		default:
+			t.Fatalf("status = %s, want completed or timeout", status)
+		}
+		if len(late) != 1 {
+			t.Fatalf("%d late results, want 1", len(late))
+		}
+		if stats["pending_commands"] != 0 {
+			t.Fatalf("pending commands = %v, want 0", stats["pending_commands"])
+		}
+	}
+}
+
+func TestCommandStatusFromResult(t *testing.T) {
+	tests := []struct {
+		status string
+		want   types.CommandStatus
+	}{
+		{protocol.CommandStatusSuccess, types.CommandStatusCompleted},
+		{protocol.CommandStatusFailed, types.CommandStatusFailed},
+		{protocol.CommandStatusTimeout, types.CommandStatusTimeout},
+		{protocol.CommandStatusRejected, types.CommandStatusRejected},
+		{protocol.CommandStatusCancelled, types.CommandStatusCancelled},
+		{"exploded", types.CommandStatusFailed},
+		{"", types.CommandStatusFailed},
+	}
+
+	for _, tt := range tests {
+		if got := commandStatusFromResult(tt.status); got != tt.want {
+			t.Errorf("commandStatusFromResult(%q) = %s, want %s", tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestCancelCommand(t *testing.T) {
+	d, store, publisher, cmd := newTrackedCommand(t)
+	ctx := context.Background()
+
+	if err := d.CancelCommand(ctx, cmd.ID, "operator request"); err != nil {
+		t.Fatalf("CancelCommand failed: %v", err)
+	}
+	if got := publisher.sent(); fmt.Sprint(got) != "[cmd-1]" {
+		t.Errorf("cancels = %v, want [cmd-1]", got)
+	}
+
+	// The agent's cancelled result finishes the command
+	if err := d.HandleCommandResult(ctx, resultOf(protocol.CommandStatusCancelled)); err != nil {
+		t.Fatalf("HandleCommandResult failed: %v", err)
+	}
+	if got := store.status(cmd.ID); got != types.CommandStatusCancelled {
+		t.Errorf("status = %s, want cancelled", got)
+	}
+
+	if err := d.CancelCommand(ctx, cmd.ID, "again"); !errors.Is(err, ErrCommandFinished) {
+		t.Errorf("error = %v, want ErrCommandFinished", err)
+	}
+}
+
+func TestDispatchCommandValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		cmd  types.Command
+		want string
+	}{
+		{"missing cluster", types.Command{Type: "diagnostic", Tool: "kubectl", Action: "get"}, "cluster_id is required"},
+		{"remediation tool as diagnostic", types.Command{ClusterID: "prod-1", Type: "diagnostic", Tool: protocol.RemediationTool, Action: "cordon"}, "cannot run remediation actions"},
+		{"unknown param", types.Command{ClusterID: "prod-1", Type: "diagnostic", Tool: "kubectl", Action: "get", Params: map[string]string{"resource": "pods", "output": "yaml"}}, `param "output" is not allowed`},
+		{"env", types.Command{ClusterID: "prod-1", Type: "diagnostic", Tool: "kubectl", Action: "get", Params: map[string]string{"resource": "pods"}, Env: map[string]string{"KUBECONFIG": "/tmp/kubeconfig"}}, "env is not allowed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMemoryStore()
+			d := NewDispatcher(store, nil, nil, &recordingPublisher{}, zap.NewNop())
+
+			err := d.DispatchCommand(context.Background(), &tt.cmd)
+			if !errors.Is(err, ErrInvalidCommand) || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want ErrInvalidCommand: %s", err, tt.want)
+			}
+			if len(store.commands) != 0 {
+				t.Errorf("invalid command was stored")
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/kart-io/k8s-agent/agent-manager/pkg/types"
+)
+
+// followerBuffer is the number of updates a follower may fall behind before
+// it is dropped
+const followerBuffer = 256
+
+// ErrOutputForeignCluster is returned for output chunks reported by another
+// cluster than the one the command was sent to
+var ErrOutputForeignCluster = errors.New("output reported by another cluster")
+
+// OutputUpdate is sent to the followers of a command for each chunk of its
+// output, and once with Done set when the command has finished
+type OutputUpdate struct {
+	Chunk *types.CommandOutputChunk
+	Done  bool
+}
+
+// outputHub fans the output of running commands out to their followers
+type outputHub struct {
+	mu        sync.Mutex
+	followers map[string]map[chan OutputUpdate]struct{}
+}
+
+func newOutputHub() *outputHub {
+	return &outputHub{followers: make(map[string]map[chan OutputUpdate]struct{})}
+}
+
+// follow registers a follower of a command, returning its updates and the
+// function that unregisters it. The channel is closed when the follower is
+// unregistered or falls behind.
+func (h *outputHub) follow(commandID string) (<-chan OutputUpdate, func()) {
+	ch := make(chan OutputUpdate, followerBuffer)
+
+	h.mu.Lock()
+	if h.followers[commandID] == nil {
+		h.followers[commandID] = make(map[chan OutputUpdate]struct{})
+	}
+	h.followers[commandID][ch] = struct{}{}
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.remove(commandID, ch)
+	}
+}
+
+// publish sends an update to the followers of a command
+func (h *outputHub) publish(commandID string, update OutputUpdate) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.followers[commandID] {
+		select {
+		case ch <- update:
+		default:
+			// A slow follower resumes from the stored chunks
+			h.remove(commandID, ch)
+		}
+	}
+}
+
+// remove unregisters a follower; the caller holds h.mu
+func (h *outputHub) remove(commandID string, ch chan OutputUpdate) {
+	followers, ok := h.followers[commandID]
+	if !ok {
+		return
+	}
+	if _, ok := followers[ch]; !ok {
+		return
+	}
+	delete(followers, ch)
+	close(ch)
+	if len(followers) == 0 {
+		delete(h.followers, commandID)
+	}
+}
+
+// HandleCommandOutput stores a chunk of command output and passes it to the
+// followers of the command
+func (d *Dispatcher) HandleCommandOutput(ctx context.Context, chunk *types.CommandOutputChunk) error {
+	clusterID, err := d.commandCluster(ctx, chunk.CommandID)
+	if err != nil {
+		return fmt.Errorf("failed to look up command: %w", err)
+	}
+	if clusterID != chunk.ClusterID {
+		return fmt.Errorf("%w: command %s belongs to %s, not %s",
+			ErrOutputForeignCluster, chunk.CommandID, clusterID, chunk.ClusterID)
+	}
+
+	if err := d.store.SaveCommandOutput(ctx, chunk); err != nil {
+		return fmt.Errorf("failed to save command output: %w", err)
+	}
+
+	d.output.publish(chunk.CommandID, OutputUpdate{Chunk: chunk})
+	return nil
+}
+
+// FollowCommandOutput returns the output chunks of a command as they arrive,
+// and the function to call when no longer following. The channel is closed
+// early when the caller falls behind, which then resumes from ListCommandOutput.
+func (d *Dispatcher) FollowCommandOutput(commandID string) (<-chan OutputUpdate, func()) {
+	return d.output.follow(commandID)
+}
+
+// ListCommandOutput returns the stored output chunks of a command numbered
+// after afterSeq
+func (d *Dispatcher) ListCommandOutput(ctx context.Context, commandID string, afterSeq int64) ([]*types.CommandOutputChunk, error) {
+	return d.store.ListCommandOutput(ctx, commandID, afterSeq)
+}
+
+// commandCluster returns the cluster a command was sent to
+func (d *Dispatcher) commandCluster(ctx context.Context, commandID string) (string, error) {
+	d.mu.RLock()
+	cmd, ok := d.pendingCommands[commandID]
+	d.mu.RUnlock()
+	if ok {
+		return cmd.ClusterID, nil
+	}
+
+	// Chunks may trail the result of a command that is no longer tracked
+	stored, err := d.store.GetCommand(ctx, commandID)
+	if err != nil {
+		return "", err
+	}
+	return stored.ClusterID, nil
+}
+
+// finishOutput tells the followers of a command that it has finished
+func (d *Dispatcher) finishOutput(commandID string) {
+	d.output.publish(commandID, OutputUpdate{Done: true})
+}
@@ -39,6 +39,12 @@ type EventFilter interface {
 	ShouldProcess(event *types.Event) bool
 }
 
+// ResettableFilter is implemented by filters that remember events they let through,
+// so that a failed event can be processed again when it is redelivered
+type ResettableFilter interface {
+	Reset(event *types.Event)
+}
+
 // EventEnricher enriches events with additional context
 type EventEnricher interface {
 	Enrich(ctx context.Context, event *types.Event) error
@@ -108,6 +114,7 @@ func (p *Processor) ProcessEvent(ctx context.Context, event *types.Event) error
 		p.mu.Lock()
 		p.eventsFailed++
 		p.mu.Unlock()
+		p.resetFilters(event)
 		return fmt.Errorf("failed to save event: %w", err)
 	}
 
@@ -139,6 +146,15 @@ func (p *Processor) ProcessEvent(ctx context.Context, event *types.Event) error
 	return nil
 }
 
+// resetFilters lets a redelivered copy of a failed event pass the filters again
+func (p *Processor) resetFilters(event *types.Event) {
+	for _, filter := range p.filters {
+		if resettable, ok := filter.(ResettableFilter); ok {
+			resettable.Reset(event)
+		}
+	}
+}
+
 // isCriticalEvent checks if event requires immediate attention
 func (p *Processor) isCriticalEvent(event *types.Event) bool {
 	criticalReasons := map[string]bool{
@@ -214,7 +230,7 @@ type DuplicateFilter struct {
 
 func (f *DuplicateFilter) ShouldProcess(event *types.Event) bool {
 	ctx := context.Background()
-	key := fmt.Sprintf("event:seen:%s:%s:%s", event.ClusterID, event.Reason, event.Labels["name"])
+	key := f.key(event)
 
 	// Try to set key (returns false if already exists)
 	existed, err := f.cache.AcquireLock(ctx, key, f.ttl)
@@ -227,6 +243,18 @@ func (f *DuplicateFilter) ShouldProcess(event *types.Event) bool {
 	return existed
 }
 
+// Reset forgets the event so that its redelivery is not treated as a duplicate
+func (f *DuplicateFilter) Reset(event *types.Event) {
+	f.cache.ReleaseLock(context.Background(), f.key(event))
+}
+
+// key identifies a report of an event. Agents compress repeats of an event
+// into summaries carrying the same ID, so the occurrence total tells a new
+// summary from a redelivered one.
+func (f *DuplicateFilter) key(event *types.Event) string {
+	return fmt.Sprintf("event:seen:%s:%s:%v", event.ClusterID, event.ID, event.RawData["total_occurrences"])
+}
+
 // ClusterEnricher enriches events with cluster information
 type ClusterEnricher struct {
 	store *storage.PostgresStore
@@ -0,0 +1,292 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/kart-io/k8s-agent/agent-manager/internal/storage"
+	"github.com/kart-io/k8s-agent/agent-manager/pkg/types"
+)
+
+// Exporter forwards metric samples to an external time-series system
+type Exporter interface {
+	Export(clusterID string, timestamp time.Time, samples []types.MetricSample)
+	GetStatistics() map[string]interface{}
+}
+
+// Processor stores agent metrics as time series and maintains their
+// downsampled rollups and retention
+type Processor struct {
+	config   types.TimeSeriesConfig
+	store    *storage.PostgresStore
+	exporter Exporter
+	logger   *zap.Logger
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+
+	// Raw point IDs already rolled up. The previous range is rolled up once
+	// more so that points committed out of ID order are not missed.
+	downsampledID uint64
+	previousID    uint64
+
+	// Metrics
+	mu               sync.RWMutex
+	metricsProcessed int64
+	metricsFailed    int64
+	pointsStored     int64
+	downsampleRuns   int64
+	downsampleErrors int64
+	lastDownsample   time.Time
+	pointsExpired    int64
+	snapshotsExpired int64
+	lastRetention    time.Time
+}
+
+// NewProcessor creates a new metrics processor
+func NewProcessor(config types.TimeSeriesConfig, store *storage.PostgresStore, logger *zap.Logger) *Processor {
+	applyTimeSeriesDefaults(&config)
+
+	return &Processor{
+		config: config,
+		store:  store,
+		logger: logger.With(zap.String("component", "metrics-processor")),
+		stopCh: make(chan struct{}),
+	}
+}
+
+// SetExporter sets an exporter that receives the samples of every stored snapshot.
+// It must be called before metrics are processed.
+func (p *Processor) SetExporter(exporter Exporter) {
+	p.exporter = exporter
+}
+
+// Start starts the downsampling and retention loop
+func (p *Processor) Start(ctx context.Context) error {
+	p.logger.Info("Starting metrics processor",
+		zap.Duration("raw_retention", p.config.RawRetention),
+		zap.Int("rollups", len(p.config.Rollups)))
+
+	p.wg.Add(1)
+	go p.maintenanceLoop()
+
+	return nil
+}
+
+// Stop stops the metrics processor
+func (p *Processor) Stop() error {
+	p.logger.Info("Stopping metrics processor")
+	close(p.stopCh)
+	p.wg.Wait()
+	return nil
+}
+
+// ProcessMetrics stores a metrics snapshot and its raw time-series points
+func (p *Processor) ProcessMetrics(ctx context.Context, metrics *types.Metrics) error {
+	samples := Samples(metrics)
+
+	points := make([]*types.MetricPoint, 0, len(samples))
+	for _, sample := range samples {
+		points = append(points, &types.MetricPoint{
+			ClusterID: metrics.ClusterID,
+			Name:      sample.Name,
+			Node:      sample.Node,
+			Namespace: sample.Namespace,
+			Timestamp: metrics.Timestamp,
+			Value:     sample.Value,
+			Min:       sample.Value,
+			Max:       sample.Value,
+			Count:     1,
+		})
+	}
+
+	if err := p.store.SaveMetrics(ctx, metrics, points); err != nil {
+		p.mu.Lock()
+		p.metricsFailed++
+		p.mu.Unlock()
+		return fmt.Errorf("failed to save metrics: %w", err)
+	}
+
+	p.mu.Lock()
+	p.metricsProcessed++
+	p.pointsStored += int64(len(points))
+	p.mu.Unlock()
+
+	if p.exporter != nil {
+		p.exporter.Export(metrics.ClusterID, metrics.Timestamp, samples)
+	}
+
+	p.logger.Debug("Metrics processed",
+		zap.String("cluster_id", metrics.ClusterID),
+		zap.Int("points", len(points)))
+
+	return nil
+}
+
+// Latest returns the most recent metrics snapshot of a cluster
+func (p *Processor) Latest(ctx context.Context, clusterID string) (*types.Metrics, error) {
+	return p.store.GetLatestMetrics(ctx, clusterID)
+}
+
+// maintenanceLoop periodically downsamples new raw points and applies retention
+func (p *Processor) maintenanceLoop() {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.config.DownsampleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stopCh:
+			return
+		case <-ticker.C:
+			ctx := context.Background()
+			p.downsample(ctx)
+			p.applyRetention(ctx)
+		}
+	}
+}
+
+// downsample rolls the raw points stored since the last run up into every configured resolution
+func (p *Processor) downsample(ctx context.Context) {
+	uptoID, err := p.store.MaxMetricPointID(ctx, 0)
+	if err != nil {
+		p.recordDownsampleError(err)
+		return
+	}
+	if uptoID <= p.downsampledID && p.previousID == p.downsampledID {
+		return
+	}
+
+	for _, rollup := range p.config.Rollups {
+		buckets, err := p.store.DownsampleMetricPoints(ctx, rollup.Resolution, p.previousID, uptoID)
+		if err != nil {
+			p.recordDownsampleError(fmt.Errorf("failed to downsample to %s: %w", rollup.Resolution, err))
+			return
+		}
+
+		p.logger.Debug("Metric points downsampled",
+			zap.Duration("resolution", rollup.Resolution),
+			zap.Int64("buckets", buckets))
+	}
+
+	p.previousID = p.downsampledID
+	p.downsampledID = uptoID
+
+	p.mu.Lock()
+	p.downsampleRuns++
+	p.lastDownsample = time.Now()
+	p.mu.Unlock()
+}
+
+// recordDownsampleError logs and counts a failed downsampling run
+func (p *Processor) recordDownsampleError(err error) {
+	p.logger.Error("Failed to downsample metrics", zap.Error(err))
+
+	p.mu.Lock()
+	p.downsampleErrors++
+	p.mu.Unlock()
+}
+
+// applyRetention deletes points and snapshots that are older than their retention
+func (p *Processor) applyRetention(ctx context.Context) {
+	now := time.Now()
+
+	var deleted int64
+	retentions := append([]types.RollupConfig{{Resolution: 0, Retention: p.config.RawRetention}}, p.config.Rollups...)
+	for _, tier := range retentions {
+		n, err := p.store.DeleteMetricPointsBefore(ctx, tier.Resolution, now.Add(-tier.Retention))
+		if err != nil {
+			p.logger.Error("Failed to delete expired metric points",
+				zap.Duration("resolution", tier.Resolution),
+				zap.Error(err))
+			continue
+		}
+		deleted += n
+	}
+
+	snapshots, err := p.store.DeleteMetricsBefore(ctx, now.Add(-p.config.SnapshotRetention))
+	if err != nil {
+		p.logger.Error("Failed to delete expired metrics snapshots", zap.Error(err))
+	}
+
+	p.mu.Lock()
+	p.pointsExpired += deleted
+	p.snapshotsExpired += snapshots
+	p.lastRetention = now
+	p.mu.Unlock()
+
+	if deleted > 0 || snapshots > 0 {
+		p.logger.Info("Expired metrics deleted",
+			zap.Int64("points", deleted),
+			zap.Int64("snapshots", snapshots))
+	}
+}
+
+// GetStatistics returns processor statistics
+func (p *Processor) GetStatistics() map[string]interface{} {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	stats := map[string]interface{}{
+		"metrics_processed": p.metricsProcessed,
+		"metrics_failed":    p.metricsFailed,
+		"points_stored":     p.pointsStored,
+		"downsample_runs":   p.downsampleRuns,
+		"downsample_errors": p.downsampleErrors,
+		"last_downsample":   p.lastDownsample,
+		"points_expired":    p.pointsExpired,
+		"snapshots_expired": p.snapshotsExpired,
+		"last_retention":    p.lastRetention,
+	}
+	if p.exporter != nil {
+		stats["exporter"] = p.exporter.GetStatistics()
+	}
+
+	return stats
+}
+
+// applyTimeSeriesDefaults fills unset time-series settings with sane defaults
+func applyTimeSeriesDefaults(config *types.TimeSeriesConfig) {
+	if config.SnapshotRetention <= 0 {
+		config.SnapshotRetention = 24 * time.Hour
+	}
+	if config.RawRetention <= 0 {
+		config.RawRetention = 24 * time.Hour
+	}
+	if config.DownsampleInterval <= 0 {
+		config.DownsampleInterval = 5 * time.Minute
+	}
+	if config.MaxPoints <= 0 {
+		config.MaxPoints = 1000
+	}
+	if config.Rollups == nil {
+		config.Rollups = []types.RollupConfig{
+			{Resolution: 5 * time.Minute, Retention: 7 * 24 * time.Hour},
+			{Resolution: time.Hour, Retention: 90 * 24 * time.Hour},
+		}
+	}
+
+	// Rollups are rebuilt from raw points, so whole-second resolutions are
+	// required and raw points must outlive the coarsest bucket
+	rollups := make([]types.RollupConfig, 0, len(config.Rollups))
+	for _, rollup := range config.Rollups {
+		if rollup.Resolution < time.Second || rollup.Resolution%time.Second != 0 || rollup.Retention <= 0 {
+			continue
+		}
+		rollups = append(rollups, rollup)
+	}
+	sort.Slice(rollups, func(i, j int) bool {
+		return rollups[i].Resolution < rollups[j].Resolution
+	})
+	config.Rollups = rollups
+
+	if n := len(rollups); n > 0 && config.RawRetention < 2*rollups[n-1].Resolution {
+		config.RawRetention = 2 * rollups[n-1].Resolution
+	}
+}
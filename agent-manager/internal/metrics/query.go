@@ -0,0 +1,191 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/kart-io/k8s-agent/agent-manager/internal/storage"
+	"github.com/kart-io/k8s-agent/agent-manager/pkg/types"
+)
+
+// Resolutions accepted by Query besides explicit durations
+const (
+	ResolutionAuto = "auto"
+	ResolutionRaw  = "raw"
+)
+
+// rawInterval is the expected spacing of raw points, the agent's default metrics interval
+const rawInterval = time.Minute
+
+// ErrInvalidQuery is returned for queries that cannot be answered as requested
+var ErrInvalidQuery = errors.New("invalid metrics query")
+
+// Query selects the time series returned by Processor.Query
+type Query struct {
+	ClusterID  string
+	Names      []string
+	Node       string
+	Namespace  string
+	Start      time.Time
+	End        time.Time
+	Resolution string // ResolutionAuto, ResolutionRaw or a duration such as "5m"
+}
+
+// QueryResult is the answer to a metrics query
+type QueryResult struct {
+	ClusterID  string               `json:"cluster_id"`
+	Start      time.Time            `json:"start"`
+	End        time.Time            `json:"end"`
+	Resolution string               `json:"resolution"`
+	Source     string               `json:"source"`
+	Series     []types.MetricSeries `json:"series"`
+}
+
+// tier is a stored resolution and how far back it reaches
+type tier struct {
+	resolution time.Duration
+	retention  time.Duration
+}
+
+// Query returns the series of a cluster over a time range. Points are read from the
+// coarsest stored resolution that fits the requested one and averaged into buckets.
+func (p *Processor) Query(ctx context.Context, q Query) (*QueryResult, error) {
+	if q.End.IsZero() {
+		q.End = time.Now()
+	}
+	if q.Start.IsZero() {
+		q.Start = q.End.Add(-time.Hour)
+	}
+	if !q.Start.Before(q.End) {
+		return nil, fmt.Errorf("%w: start must be before end", ErrInvalidQuery)
+	}
+	if q.Resolution == "" {
+		q.Resolution = ResolutionAuto
+	}
+
+	source, step, err := p.selectResolution(q, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	points, err := p.store.QueryMetricPoints(ctx, storage.MetricFilter{
+		ClusterID:  q.ClusterID,
+		Names:      q.Names,
+		Node:       q.Node,
+		Namespace:  q.Namespace,
+		StartTime:  q.Start,
+		EndTime:    q.End,
+		Resolution: source.resolution,
+		Step:       step,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query metric points: %w", err)
+	}
+
+	return &QueryResult{
+		ClusterID:  q.ClusterID,
+		Start:      q.Start,
+		End:        q.End,
+		Resolution: resolutionName(step),
+		Source:     resolutionName(source.resolution),
+		Series:     groupSeries(points),
+	}, nil
+}
+
+// tiers returns the stored resolutions from finest to coarsest
+func (p *Processor) tiers() []tier {
+	tiers := []tier{{resolution: 0, retention: p.config.RawRetention}}
+	for _, rollup := range p.config.Rollups {
+		tiers = append(tiers, tier{resolution: rollup.Resolution, retention: rollup.Retention})
+	}
+	return tiers
+}
+
+// selectResolution picks the stored resolution to read and the bucket width to return
+func (p *Processor) selectResolution(q Query, now time.Time) (tier, time.Duration, error) {
+	tiers := p.tiers()
+	span := q.End.Sub(q.Start)
+	maxPoints := time.Duration(p.config.MaxPoints)
+
+	switch q.Resolution {
+	case ResolutionRaw:
+		return tiers[0], 0, nil
+
+	case ResolutionAuto:
+		// The finest resolution that still reaches back to start and stays under max points
+		for _, t := range tiers {
+			width := t.resolution
+			if width == 0 {
+				width = rawInterval
+			}
+			if !q.Start.Before(now.Add(-t.retention)) && span/width <= maxPoints {
+				return t, t.resolution, nil
+			}
+		}
+
+		// Otherwise widen the coarsest buckets until the range fits
+		coarsest := tiers[len(tiers)-1]
+		width := coarsest.resolution
+		if width == 0 {
+			width = rawInterval
+		}
+		buckets := (span + width*maxPoints - 1) / (width * maxPoints)
+		return coarsest, width * buckets, nil
+	}
+
+	step, err := time.ParseDuration(q.Resolution)
+	if err != nil || step < time.Second {
+		return tier{}, 0, fmt.Errorf("%w: resolution must be %q, %q or a duration of at least 1s",
+			ErrInvalidQuery, ResolutionAuto, ResolutionRaw)
+	}
+	if span/step > maxPoints {
+		return tier{}, 0, fmt.Errorf("%w: resolution %s returns more than %d points for the requested range",
+			ErrInvalidQuery, step, p.config.MaxPoints)
+	}
+
+	// The coarsest stored resolution whose buckets divide the requested ones
+	source := tiers[0]
+	for _, t := range tiers[1:] {
+		if t.resolution <= step && step%t.resolution == 0 {
+			source = t
+		}
+	}
+	return source, step, nil
+}
+
+// groupSeries splits points ordered by series and time into series
+func groupSeries(points []*types.MetricPoint) []types.MetricSeries {
+	series := make([]types.MetricSeries, 0)
+
+	for _, point := range points {
+		n := len(series)
+		if n == 0 || series[n-1].Name != point.Name || series[n-1].Node != point.Node || series[n-1].Namespace != point.Namespace {
+			series = append(series, types.MetricSeries{
+				Name:      point.Name,
+				Node:      point.Node,
+				Namespace: point.Namespace,
+			})
+			n++
+		}
+
+		series[n-1].Points = append(series[n-1].Points, types.MetricValue{
+			Timestamp: point.Timestamp,
+			Value:     point.Value,
+			Min:       point.Min,
+			Max:       point.Max,
+			Count:     point.Count,
+		})
+	}
+
+	return series
+}
+
+// resolutionName renders a resolution for API responses
+func resolutionName(resolution time.Duration) string {
+	if resolution == 0 {
+		return ResolutionRaw
+	}
+	return resolution.String()
+}
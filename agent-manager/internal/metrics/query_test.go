@@ -0,0 +1,144 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/kart-io/k8s-agent/agent-manager/pkg/types"
+)
+
+func TestSelectResolution(t *testing.T) {
+	// Default tiers: raw for 24h, 5m for 7d and 1h for 90d, at most 1000 points
+	p := NewProcessor(types.TimeSeriesConfig{}, nil, zap.NewNop())
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+
+	tests := []struct {
+		name       string
+		resolution string
+		span       time.Duration
+		wantSource time.Duration
+		wantStep   time.Duration
+		wantErr    bool
+	}{
+		{"raw", ResolutionRaw, 30 * day, 0, 0, false},
+		{"auto within raw retention", ResolutionAuto, time.Hour, 0, 0, false},
+		{"auto over max raw points", ResolutionAuto, 20 * time.Hour, 5 * time.Minute, 5 * time.Minute, false},
+		{"auto beyond raw retention", ResolutionAuto, 2 * day, 5 * time.Minute, 5 * time.Minute, false},
+		{"auto beyond 5m retention", ResolutionAuto, 30 * day, time.Hour, time.Hour, false},
+		{"auto beyond all retention", ResolutionAuto, 200 * day, time.Hour, 5 * time.Hour, false},
+		{"step between tiers", "15m", day, 5 * time.Minute, 15 * time.Minute, false},
+		{"step of a tier", "1h", 7 * day, time.Hour, time.Hour, false},
+		{"step above coarsest tier", "2h", 30 * day, time.Hour, 2 * time.Hour, false},
+		{"step not divisible by a tier", "90s", time.Hour, 0, 90 * time.Second, false},
+		{"too many points", "1m", 30 * day, 0, 0, true},
+		{"step under a second", "500ms", time.Minute, 0, 0, true},
+		{"unknown resolution", "hourly", time.Hour, 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := Query{Start: now.Add(-tt.span), End: now, Resolution: tt.resolution}
+
+			source, step, err := p.selectResolution(q, now)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidQuery) {
+					t.Fatalf("error = %v, want ErrInvalidQuery", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("selectResolution failed: %v", err)
+			}
+			if source.resolution != tt.wantSource || step != tt.wantStep {
+				t.Errorf("source, step = %v, %v, want %v, %v", source.resolution, step, tt.wantSource, tt.wantStep)
+			}
+		})
+	}
+}
+
+func TestQueryRejectsInvalidRange(t *testing.T) {
+	p := NewProcessor(types.TimeSeriesConfig{}, nil, zap.NewNop())
+	now := time.Now()
+
+	tests := []struct {
+		name string
+		q    Query
+	}{
+		{"start after end", Query{Start: now, End: now.Add(-time.Hour)}},
+		{"empty range", Query{Start: now, End: now}},
+		{"invalid resolution", Query{Resolution: "0s"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := p.Query(context.Background(), tt.q); !errors.Is(err, ErrInvalidQuery) {
+				t.Errorf("error = %v, want ErrInvalidQuery", err)
+			}
+		})
+	}
+}
+
+func TestApplyTimeSeriesDefaults(t *testing.T) {
+	config := types.TimeSeriesConfig{
+		RawRetention: time.Hour,
+		Rollups: []types.RollupConfig{
+			{Resolution: time.Hour, Retention: 30 * 24 * time.Hour},
+			{Resolution: 1500 * time.Millisecond, Retention: time.Hour},
+			{Resolution: 10 * time.Minute, Retention: 0},
+			{Resolution: 5 * time.Minute, Retention: 7 * 24 * time.Hour},
+		},
+	}
+	applyTimeSeriesDefaults(&config)
+
+	want := []types.RollupConfig{
+		{Resolution: 5 * time.Minute, Retention: 7 * 24 * time.Hour},
+		{Resolution: time.Hour, Retention: 30 * 24 * time.Hour},
+	}
+	if !reflect.DeepEqual(config.Rollups, want) {
+		t.Errorf("rollups = %v, want %v", config.Rollups, want)
+	}
+	if config.RawRetention != 2*time.Hour {
+		t.Errorf("raw retention = %v, want 2h to cover the coarsest bucket", config.RawRetention)
+	}
+}
+
+func TestGroupSeries(t *testing.T) {
+	t0 := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	t1 := t0.Add(5 * time.Minute)
+	point := func(name, node string, ts time.Time, value float64) *types.MetricPoint {
+		return &types.MetricPoint{Name: name, Node: node, Timestamp: ts, Value: value, Min: value, Max: value, Count: 1}
+	}
+
+	series := groupSeries([]*types.MetricPoint{
+		point("node_cpu", "node-1", t0, 1),
+		point("node_cpu", "node-1", t1, 2),
+		point("node_cpu", "node-2", t0, 3),
+		point("pods_total", "", t0, 4),
+	})
+
+	want := []types.MetricSeries{
+		{Name: "node_cpu", Node: "node-1", Points: []types.MetricValue{
+			{Timestamp: t0, Value: 1, Min: 1, Max: 1, Count: 1},
+			{Timestamp: t1, Value: 2, Min: 2, Max: 2, Count: 1},
+		}},
+		{Name: "node_cpu", Node: "node-2", Points: []types.MetricValue{
+			{Timestamp: t0, Value: 3, Min: 3, Max: 3, Count: 1},
+		}},
+		{Name: "pods_total", Points: []types.MetricValue{
+			{Timestamp: t0, Value: 4, Min: 4, Max: 4, Count: 1},
+		}},
+	}
+	if !reflect.DeepEqual(series, want) {
+		t.Errorf("series = %+v, want %+v", series, want)
+	}
+
+	if series := groupSeries(nil); series == nil || len(series) != 0 {
+		t.Errorf("groupSeries(nil) = %#v, want an empty slice", series)
+	}
+}
@@ -0,0 +1,129 @@
+package metrics
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/kart-io/k8s-agent/agent-manager/pkg/types"
+)
+
+// Samples extracts the numeric time series carried by a metrics snapshot.
+// Cluster-wide values have no labels, node and namespace values carry the
+// object name as a label.
+func Samples(m *types.Metrics) []types.MetricSample {
+	var samples []types.MetricSample
+
+	add := func(name, node, namespace string, v interface{}) {
+		if value, ok := toFloat(v); ok {
+			samples = append(samples, types.MetricSample{
+				Name:      name,
+				Node:      node,
+				Namespace: namespace,
+				Value:     value,
+			})
+		}
+	}
+
+	// Cluster node summary
+	if nodes, ok := m.ClusterMetrics["nodes"].(map[string]interface{}); ok {
+		add("nodes_total", "", "", nodes["total"])
+		add("nodes_ready", "", "", nodes["ready"])
+		add("nodes_not_ready", "", "", nodes["not_ready"])
+		add("nodes_schedulable", "", "", nodes["schedulable"])
+
+		if capacity, ok := nodes["capacity"].(map[string]interface{}); ok {
+			for _, key := range sortedKeys(capacity) {
+				add("capacity_"+key, "", "", capacity[key])
+			}
+		}
+	}
+
+	// Cluster pod summary
+	if pods, ok := m.ClusterMetrics["pods"].(map[string]interface{}); ok {
+		add("pods_total", "", "", pods["total"])
+		add("pod_restarts_total", "", "", pods["total_restarts"])
+
+		if phases, ok := pods["by_phase"].(map[string]interface{}); ok {
+			for _, phase := range sortedKeys(phases) {
+				add("pods_"+strings.ToLower(phase), "", "", phases[phase])
+			}
+		}
+		if namespaces, ok := pods["by_namespace"].(map[string]interface{}); ok {
+			for _, ns := range sortedKeys(namespaces) {
+				add("pods", "", ns, namespaces[ns])
+			}
+		}
+	}
+
+	// Cluster resource usage reported by metrics-server
+	if usage, ok := m.ClusterMetrics["usage"].(map[string]interface{}); ok {
+		for _, key := range sortedKeys(usage) {
+			add(key, "", "", usage[key])
+		}
+	}
+
+	// Per-node state and resource usage
+	for _, node := range m.NodeMetrics {
+		name, _ := node["name"].(string)
+		if name == "" {
+			continue
+		}
+		add("node_ready", name, "", node["ready"])
+		add("node_schedulable", name, "", node["schedulable"])
+
+		if usage, ok := node["usage"].(map[string]interface{}); ok {
+			for _, key := range sortedKeys(usage) {
+				add("node_"+key, name, "", usage[key])
+			}
+		}
+	}
+
+	// Per-namespace object counts and resource usage
+	for _, ns := range m.NamespaceMetrics {
+		name, _ := ns["name"].(string)
+		if name == "" {
+			continue
+		}
+		if resources, ok := ns["resources"].(map[string]interface{}); ok {
+			for _, key := range sortedKeys(resources) {
+				add("namespace_"+key, "", name, resources[key])
+			}
+		}
+		if usage, ok := ns["usage"].(map[string]interface{}); ok {
+			for _, key := range sortedKeys(usage) {
+				add("namespace_"+key, "", name, usage[key])
+			}
+		}
+	}
+
+	return samples
+}
+
+// toFloat converts a decoded JSON value to a sample value; booleans map to 0 and 1
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case bool:
+		if n {
+			return 1, true
+		}
+		return 0, true
+	default:
+		return 0, false
+	}
+}
+
+// sortedKeys returns the keys of m in sorted order
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,326 @@
+package nats
+
+import (
+	"sort"
+	"time"
+
+	"github.com/kart-io/k8s-agent/protocol"
+
+	"github.com/kart-io/k8s-agent/agent-manager/pkg/types"
+)
+
+// agentFromRegistration builds the registry model from a registration payload
+func agentFromRegistration(reg *protocol.Registration, protocolVersion int) *types.Agent {
+	return &types.Agent{
+		ClusterID:    reg.ClusterID,
+		Version:      reg.Version,
+		Capabilities: reg.Capabilities,
+		Metadata: map[string]interface{}{
+			"protocol_version": protocolVersion,
+			"start_time":       reg.StartTime,
+		},
+	}
+}
+
+// agentHealthFromHeartbeat converts the health reported in a heartbeat into the registry model
+func agentHealthFromHeartbeat(hb *protocol.Heartbeat) *types.AgentHealth {
+	reportedAt := hb.Timestamp
+	if reportedAt.IsZero() {
+		reportedAt = time.Now()
+	}
+
+	status := hb.Status
+	if status == "" {
+		status = types.AgentHealthHealthy
+	}
+
+	health := &types.AgentHealth{
+		Status:        status,
+		ReportedAt:    reportedAt,
+		UptimeSeconds: hb.Metrics.UptimeSeconds,
+		QueueSizes: map[string]int{
+			"event":   hb.Metrics.EventQueueSize,
+			"metrics": hb.Metrics.MetricsQueueSize,
+			"command": hb.Metrics.CommandQueueSize,
+			"result":  hb.Metrics.ResultQueueSize,
+		},
+		Dropped: map[string]int64{
+			"event":   hb.Metrics.EventsDropped,
+			"metrics": hb.Metrics.MetricsDropped,
+			"command": hb.Metrics.CommandsDropped,
+			"result":  hb.Metrics.ResultsDropped,
+		},
+		SpoolDepth: hb.Metrics.SpoolDepth,
+		SpoolBytes: hb.Metrics.SpoolBytes,
+		Reconnects: hb.Metrics.Reconnects,
+		Components: make(map[string]types.ComponentHealth, len(hb.Components)),
+	}
+
+	for name, c := range hb.Components {
+		health.Components[name] = types.ComponentHealth{
+			Healthy:       c.Healthy,
+			Synced:        c.Synced,
+			LastError:     c.LastError,
+			LastErrorTime: c.LastErrorTime,
+			ErrorCount:    c.ErrorCount,
+		}
+	}
+
+	if hb.Commands != nil {
+		health.Commands = &types.AgentCommands{
+			Workers:   hb.Commands.Workers,
+			Running:   agentCommandStates(hb.Commands.Running),
+			Queued:    agentCommandStates(hb.Commands.Queued),
+			Cancelled: hb.Commands.Cancelled,
+		}
+	}
+
+	return health
+}
+
+// agentCommandStates converts the commands listed in a heartbeat
+func agentCommandStates(states []protocol.CommandState) []types.AgentCommandState {
+	commands := make([]types.AgentCommandState, 0, len(states))
+	for _, s := range states {
+		commands = append(commands, types.AgentCommandState{
+			CommandID: s.CommandID,
+			Tool:      s.Tool,
+			Action:    s.Action,
+			Priority:  s.Priority,
+			Since:     s.Since,
+		})
+	}
+	return commands
+}
+
+// eventFromProtocol converts a wire event into the storage model
+func eventFromProtocol(e *protocol.Event) *types.Event {
+	return &types.Event{
+		ID:        e.ID,
+		ClusterID: e.ClusterID,
+		Timestamp: e.Timestamp,
+		Type:      e.Type,
+		Source:    e.Source,
+		Severity:  e.Severity,
+		Reason:    e.Reason,
+		Message:   e.Message,
+		Namespace: e.Namespace,
+		Labels:    e.Labels,
+		RawData:   e.RawData,
+	}
+}
+
+// metricsFromProtocol decodes the sections of a wire metrics snapshot into the storage model
+func metricsFromProtocol(id string, m *protocol.Metrics) *types.Metrics {
+	timestamp := m.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+
+	// Cluster-wide values: version information plus the node and pod summaries
+	cluster := make(map[string]interface{})
+	if info, ok := m.Data["cluster"].(map[string]interface{}); ok {
+		for k, v := range info {
+			cluster[k] = v
+		}
+	}
+	for _, key := range []string{"nodes", "pods", "capabilities"} {
+		if v, ok := m.Data[key]; ok {
+			cluster[key] = v
+		}
+	}
+
+	// Resource usage from metrics-server is merged into the matching sections
+	usage, _ := m.Data["usage"].(map[string]interface{})
+	if v, ok := usage["cluster"]; ok {
+		cluster["usage"] = v
+	}
+
+	nodes := metricsEntries(m.Data["node_details"])
+	mergeUsage(nodes, usage["nodes"])
+
+	namespaces := metricsEntries(m.Data["namespaces"])
+	mergeUsage(namespaces, usage["namespaces"])
+
+	pods := metricsEntries(m.Data["pod_details"])
+	if len(pods) == 0 {
+		pods = metricsEntries(usage["pods"])
+	}
+
+	// Container stats scraped from kubelets are merged into the pods, and the
+	// scrape status of the sampled nodes kept with the cluster values
+	if kubelet, ok := m.Data["kubelet"].(map[string]interface{}); ok {
+		pods = mergeKubeletStats(pods, kubelet["pods"])
+		status := make(map[string]interface{}, len(kubelet))
+		for k, v := range kubelet {
+			if k != "pods" {
+				status[k] = v
+			}
+		}
+		cluster["kubelet"] = status
+	}
+
+	return &types.Metrics{
+		ID:               id,
+		ClusterID:        m.ClusterID,
+		Timestamp:        timestamp,
+		ClusterMetrics:   cluster,
+		NodeMetrics:      nodes,
+		PodMetrics:       pods,
+		NamespaceMetrics: namespaces,
+	}
+}
+
+// mergeUsage sets the "usage" of each entry to its value in a usage section keyed by name
+func mergeUsage(entries []map[string]interface{}, section interface{}) {
+	usage, ok := section.(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	for _, entry := range entries {
+		name, _ := entry["name"].(string)
+		if v, ok := usage[name]; ok {
+			entry["usage"] = v
+		}
+	}
+}
+
+// mergeKubeletStats sets the "kubelet" stats of each pod from a section keyed
+// by namespace/name, adding the pods that have no entry yet
+func mergeKubeletStats(pods []map[string]interface{}, section interface{}) []map[string]interface{} {
+	stats, ok := section.(map[string]interface{})
+	if !ok || len(stats) == 0 {
+		return pods
+	}
+
+	byName := make(map[string]map[string]interface{}, len(pods))
+	for _, entry := range pods {
+		name, _ := entry["name"].(string)
+		byName[name] = entry
+	}
+
+	added := false
+	for name, v := range stats {
+		if entry, ok := byName[name]; ok {
+			entry["kubelet"] = v
+			continue
+		}
+		pods = append(pods, map[string]interface{}{"name": name, "kubelet": v})
+		added = true
+	}
+
+	if added {
+		sort.SliceStable(pods, func(i, j int) bool {
+			ni, _ := pods[i]["name"].(string)
+			nj, _ := pods[j]["name"].(string)
+			return ni < nj
+		})
+	}
+	return pods
+}
+
+// metricsEntries flattens a metrics section into a list of objects. Sections keyed
+// by object name get that key as their "name", and the result is sorted by name.
+// Entries are copied, since the snapshot cache keeps the sections they come from.
+func metricsEntries(section interface{}) []map[string]interface{} {
+	var entries []map[string]interface{}
+
+	switch v := section.(type) {
+	case map[string]interface{}:
+		for name, item := range v {
+			entry, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			entry = copyEntry(entry)
+			if _, ok := entry["name"]; !ok {
+				entry["name"] = name
+			}
+			entries = append(entries, entry)
+		}
+	case []interface{}:
+		for _, item := range v {
+			if entry, ok := item.(map[string]interface{}); ok {
+				entries = append(entries, copyEntry(entry))
+			}
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		ni, _ := entries[i]["name"].(string)
+		nj, _ := entries[j]["name"].(string)
+		return ni < nj
+	})
+
+	return entries
+}
+
+// copyEntry returns a shallow copy of a metrics entry
+func copyEntry(entry map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(entry)+1)
+	for k, v := range entry {
+		copied[k] = v
+	}
+	return copied
+}
+
+// commandResultFromProtocol converts a wire command result into the storage model
+func commandResultFromProtocol(id string, r *protocol.CommandResult) *types.CommandResult {
+	timestamp := r.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+
+	return &types.CommandResult{
+		ID:              id,
+		CommandID:       r.CommandID,
+		ClusterID:       r.ClusterID,
+		Status:          r.Status,
+		ExitCode:        r.ExitCode,
+		Output:          r.Output,
+		Error:           r.Error,
+		ExecutionTime:   r.Duration,
+		Timestamp:       timestamp,
+		Stdout:          r.Stdout,
+		Stderr:          r.Stderr,
+		StdoutBytes:     r.StdoutBytes,
+		StderrBytes:     r.StderrBytes,
+		StdoutTruncated: r.StdoutTruncated,
+		StderrTruncated: r.StderrTruncated,
+		OutputChunks:    r.OutputChunks,
+		Data:            r.Data,
+	}
+}
+
+// commandOutputFromProtocol converts a chunk of command output received from an agent
+func commandOutputFromProtocol(o *protocol.CommandOutput) *types.CommandOutputChunk {
+	timestamp := o.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+
+	return &types.CommandOutputChunk{
+		CommandID: o.CommandID,
+		Seq:       o.Seq,
+		ClusterID: o.ClusterID,
+		Stream:    o.Stream,
+		Data:      o.Data,
+		Timestamp: timestamp,
+	}
+}
+
+// commandToProtocol converts a stored command into its wire representation
+func commandToProtocol(cmd *types.Command) *protocol.Command {
+	return &protocol.Command{
+		ID:        cmd.ID,
+		Type:      cmd.Type,
+		Tool:      cmd.Tool,
+		Action:    cmd.Action,
+		Args:      cmd.Args,
+		Params:    cmd.Params,
+		Timeout:   cmd.Timeout,
+		CreatedAt: cmd.CreatedAt,
+		Priority:  cmd.Priority,
+	}
+}
@@ -0,0 +1,66 @@
+package nats
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/kart-io/k8s-agent/protocol"
+)
+
+func TestCommandResultFromProtocol(t *testing.T) {
+	tests := []struct {
+		name     string
+		payload  string
+		wantTime time.Duration
+		wantExit string
+	}{
+		{
+			name:     "process result",
+			payload:  `{"command_id":"cmd-1","cluster_id":"prod-1","status":"failed","duration":1500000000,"exit_code":2,"output_chunks":3,"timestamp":"2024-03-01T12:00:00Z"}`,
+			wantTime: 1500 * time.Millisecond,
+			wantExit: "2",
+		},
+		{
+			name:     "command that did not run",
+			payload:  `{"command_id":"cmd-1","cluster_id":"prod-1","status":"rejected","timestamp":"2024-03-01T12:00:00Z"}`,
+			wantExit: "none",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var payload protocol.CommandResult
+			if err := json.Unmarshal([]byte(tt.payload), &payload); err != nil {
+				t.Fatalf("failed to decode payload: %v", err)
+			}
+
+			result := commandResultFromProtocol("msg-1", &payload)
+
+			if result.ID != "msg-1" || result.CommandID != "cmd-1" || result.ClusterID != "prod-1" || result.Status != payload.Status {
+				t.Errorf("result = %+v", result)
+			}
+			if result.ExecutionTime != tt.wantTime {
+				t.Errorf("execution time = %v, want %v", result.ExecutionTime, tt.wantTime)
+			}
+			exit := "none"
+			if result.ExitCode != nil {
+				exit = fmt.Sprint(*result.ExitCode)
+			}
+			if exit != tt.wantExit {
+				t.Errorf("exit code = %s, want %s", exit, tt.wantExit)
+			}
+			if !result.Timestamp.Equal(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)) {
+				t.Errorf("timestamp = %v", result.Timestamp)
+			}
+		})
+	}
+
+	// Results without a timestamp are stamped on receipt
+	before := time.Now()
+	result := commandResultFromProtocol("msg-2", &protocol.CommandResult{CommandID: "cmd-2"})
+	if result.Timestamp.Before(before) {
+		t.Errorf("timestamp = %v, want the time of receipt", result.Timestamp)
+	}
+}
@@ -0,0 +1,237 @@
+package nats
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+
+	"github.com/kart-io/k8s-agent/protocol"
+
+	"github.com/kart-io/k8s-agent/agent-manager/pkg/types"
+)
+
+// Header keys attached to dead-lettered messages
+const (
+	headerOriginalSubject = "Aetherius-Original-Subject"
+	headerFailureReason   = "Aetherius-Failure-Reason"
+	headerDeliveryCount   = "Aetherius-Delivery-Count"
+)
+
+// errMalformedMessage marks messages that can never be processed and must not be redelivered
+var errMalformedMessage = errors.New("malformed message")
+
+// messageHandler processes a single agent message
+type messageHandler func(msg *nats.Msg) error
+
+// malformed wraps a decode error so durable consumers dead-letter it immediately
+func malformed(err error) error {
+	return fmt.Errorf("%w: %v", errMalformedMessage, err)
+}
+
+// applyJetStreamDefaults fills unset JetStream settings with sane defaults
+func applyJetStreamDefaults(config *types.JetStreamConfig) {
+	if config.Replicas <= 0 {
+		config.Replicas = 1
+	}
+	if config.MaxAge <= 0 {
+		config.MaxAge = 24 * time.Hour
+	}
+	if config.AckWait <= 0 {
+		config.AckWait = 30 * time.Second
+	}
+	if config.MaxDeliver <= 0 {
+		config.MaxDeliver = 5
+	}
+	if config.MaxAckPending <= 0 {
+		config.MaxAckPending = 1000
+	}
+	if config.DeadLetterMaxAge <= 0 {
+		config.DeadLetterMaxAge = 7 * 24 * time.Hour
+	}
+	if config.DurablePrefix == "" {
+		config.DurablePrefix = senderName
+	}
+}
+
+// setupJetStream creates the JetStream context and ensures all streams exist
+func (s *Server) setupJetStream() error {
+	js, err := s.conn.JetStream()
+	if err != nil {
+		return fmt.Errorf("failed to create JetStream context: %w", err)
+	}
+	s.js = js
+
+	for _, kind := range []string{protocol.KindEvent, protocol.KindMetrics, protocol.KindResult} {
+		stream, _ := protocol.StreamForKind(kind)
+		if err := s.ensureStream(&nats.StreamConfig{
+			Name:       stream,
+			Subjects:   []string{protocol.WildcardSubject(kind)},
+			Retention:  nats.LimitsPolicy,
+			Storage:    nats.FileStorage,
+			Replicas:   s.config.JetStream.Replicas,
+			MaxAge:     s.config.JetStream.MaxAge,
+			MaxBytes:   s.maxBytes(),
+			Duplicates: 2 * time.Minute,
+		}); err != nil {
+			return err
+		}
+	}
+
+	return s.ensureStream(&nats.StreamConfig{
+		Name:      protocol.StreamDeadLetter,
+		Subjects:  []string{protocol.DeadLetterWildcard()},
+		Retention: nats.LimitsPolicy,
+		Storage:   nats.FileStorage,
+		Replicas:  s.config.JetStream.Replicas,
+		MaxAge:    s.config.JetStream.DeadLetterMaxAge,
+	})
+}
+
+// ensureStream creates the stream or updates it to match the given config
+func (s *Server) ensureStream(cfg *nats.StreamConfig) error {
+	_, err := s.js.StreamInfo(cfg.Name)
+	switch {
+	case errors.Is(err, nats.ErrStreamNotFound):
+		if _, err := s.js.AddStream(cfg); err != nil {
+			return fmt.Errorf("failed to create stream %s: %w", cfg.Name, err)
+		}
+		s.logger.Info("JetStream stream created",
+			zap.String("stream", cfg.Name),
+			zap.Strings("subjects", cfg.Subjects))
+	case err != nil:
+		return fmt.Errorf("failed to get stream %s: %w", cfg.Name, err)
+	default:
+		if _, err := s.js.UpdateStream(cfg); err != nil {
+			return fmt.Errorf("failed to update stream %s: %w", cfg.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// maxBytes returns the per-stream size limit, -1 meaning unlimited
+func (s *Server) maxBytes() int64 {
+	if s.config.JetStream.MaxBytes <= 0 {
+		return -1
+	}
+	return s.config.JetStream.MaxBytes
+}
+
+// subscribeDurable creates a durable, explicitly acknowledged consumer for the given kind.
+// A queue group is used so that several agent-manager replicas share the consumer.
+func (s *Server) subscribeDurable(kind string, handler messageHandler) (*nats.Subscription, error) {
+	stream, ok := protocol.StreamForKind(kind)
+	if !ok {
+		return nil, fmt.Errorf("no stream defined for %s messages", kind)
+	}
+
+	durable := fmt.Sprintf("%s-%s", s.config.JetStream.DurablePrefix, kind)
+
+	return s.js.QueueSubscribe(protocol.WildcardSubject(kind), durable, func(msg *nats.Msg) {
+		s.handleDurableMessage(kind, msg, handler)
+	},
+		nats.BindStream(stream),
+		nats.ManualAck(),
+		nats.AckExplicit(),
+		nats.DeliverAll(),
+		nats.AckWait(s.config.JetStream.AckWait),
+		nats.MaxDeliver(s.config.JetStream.MaxDeliver),
+		nats.MaxAckPending(s.config.JetStream.MaxAckPending),
+	)
+}
+
+// handleDurableMessage runs handler and acknowledges, redelivers or dead-letters the message
+func (s *Server) handleDurableMessage(kind string, msg *nats.Msg, handler messageHandler) {
+	err := handler(msg)
+	if err == nil {
+		if ackErr := msg.Ack(); ackErr != nil {
+			s.logger.Warn("Failed to ack message",
+				zap.String("subject", msg.Subject),
+				zap.Error(ackErr))
+			return
+		}
+		s.messagesAcked.Add(1)
+		return
+	}
+
+	var delivered uint64 = 1
+	if meta, metaErr := msg.Metadata(); metaErr == nil {
+		delivered = meta.NumDelivered
+	}
+
+	if errors.Is(err, errMalformedMessage) || delivered >= uint64(s.config.JetStream.MaxDeliver) {
+		if dlqErr := s.deadLetter(kind, msg, err, delivered); dlqErr != nil {
+			// Keep the message in the stream until it can be dead-lettered
+			s.logger.Error("Failed to dead-letter message, scheduling redelivery",
+				zap.String("subject", msg.Subject),
+				zap.Uint64("delivered", delivered),
+				zap.Error(dlqErr))
+			if nakErr := msg.NakWithDelay(redeliveryDelay(delivered)); nakErr != nil {
+				s.logger.Warn("Failed to nak message",
+					zap.String("subject", msg.Subject),
+					zap.Error(nakErr))
+			}
+			s.messagesRedelivered.Add(1)
+			return
+		}
+		if termErr := msg.Term(); termErr != nil {
+			s.logger.Warn("Failed to terminate message",
+				zap.String("subject", msg.Subject),
+				zap.Error(termErr))
+		}
+		return
+	}
+
+	s.logger.Warn("Message processing failed, scheduling redelivery",
+		zap.String("subject", msg.Subject),
+		zap.Uint64("delivered", delivered),
+		zap.Int("max_deliver", s.config.JetStream.MaxDeliver),
+		zap.Error(err))
+
+	if nakErr := msg.NakWithDelay(redeliveryDelay(delivered)); nakErr != nil {
+		s.logger.Warn("Failed to nak message",
+			zap.String("subject", msg.Subject),
+			zap.Error(nakErr))
+	}
+	s.messagesRedelivered.Add(1)
+}
+
+// deadLetter republishes a message that cannot be processed to the dead-letter stream
+func (s *Server) deadLetter(kind string, msg *nats.Msg, reason error, delivered uint64) error {
+	clusterID, _, err := protocol.ParseSubject(msg.Subject)
+	if err != nil {
+		clusterID = "unknown"
+	}
+
+	dlq := nats.NewMsg(protocol.DeadLetterSubject(clusterID, kind))
+	dlq.Data = msg.Data
+	dlq.Header.Set(headerOriginalSubject, msg.Subject)
+	dlq.Header.Set(headerFailureReason, reason.Error())
+	dlq.Header.Set(headerDeliveryCount, strconv.FormatUint(delivered, 10))
+
+	if _, err := s.js.PublishMsg(dlq); err != nil {
+		s.errorCount.Add(1)
+		return fmt.Errorf("failed to publish to %s: %w", dlq.Subject, err)
+	}
+
+	s.messagesDeadLettered.Add(1)
+	s.logger.Error("Message moved to dead-letter subject",
+		zap.String("subject", msg.Subject),
+		zap.String("dead_letter_subject", dlq.Subject),
+		zap.Uint64("delivered", delivered),
+		zap.Error(reason))
+	return nil
+}
+
+// redeliveryDelay backs off linearly with the number of deliveries, capped at one minute
+func redeliveryDelay(delivered uint64) time.Duration {
+	delay := time.Duration(delivered) * 5 * time.Second
+	if delay > time.Minute {
+		return time.Minute
+	}
+	return delay
+}
@@ -2,28 +2,55 @@ package nats
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nats-io/nats.go"
 	"go.uber.org/zap"
 
+	"github.com/kart-io/k8s-agent/protocol"
+
 	"github.com/kart-io/k8s-agent/agent-manager/internal/agent"
 	"github.com/kart-io/k8s-agent/agent-manager/internal/event"
+	"github.com/kart-io/k8s-agent/agent-manager/internal/metrics"
 	"github.com/kart-io/k8s-agent/agent-manager/pkg/types"
 )
 
+// senderName identifies agent-manager as envelope sender and NATS client
+const senderName = "agent-manager"
+
+// errNoResultHandler is returned for results received before a handler is set,
+// so durable consumers redeliver them later
+var errNoResultHandler = errors.New("no command result handler registered")
+
+// ResultHandler receives the command lifecycle messages reported by agents
+type ResultHandler interface {
+	// HandleCommandAck is called when an agent starts executing a command
+	HandleCommandAck(ctx context.Context, commandID string) error
+	// HandleCommandResult is called with the outcome of a command
+	HandleCommandResult(ctx context.Context, result *types.CommandResult) error
+	// HandleCommandOutput is called with each chunk of output streamed by a
+	// running command
+	HandleCommandOutput(ctx context.Context, chunk *types.CommandOutputChunk) error
+}
+
 // Server manages NATS server connection and subscriptions
 type Server struct {
-	conn          *nats.Conn
-	logger        *zap.Logger
-	config        types.NATSConfig
+	conn   *nats.Conn
+	js     nats.JetStreamContext
+	logger *zap.Logger
+	config types.NATSConfig
 
 	// Components
-	registry      *agent.Registry
-	eventProcessor *event.Processor
+	registry         *agent.Registry
+	eventProcessor   *event.Processor
+	metricsProcessor *metrics.Processor
+	resultHandler    ResultHandler
+	signer           *protocol.CommandSigner
+	snapshots        *snapshotCache
 
 	// Subscriptions
 	subscriptions []*nats.Subscription
@@ -31,10 +58,13 @@ type Server struct {
 	stopCh        chan struct{}
 	wg            sync.WaitGroup
 
-	// Metrics
-	messagesReceived int64
-	messagesSent     int64
-	errorCount       int64
+	// Metrics, updated by the subscription and JetStream handlers
+	messagesReceived     atomic.Int64
+	messagesSent         atomic.Int64
+	errorCount           atomic.Int64
+	messagesAcked        atomic.Int64
+	messagesRedelivered  atomic.Int64
+	messagesDeadLettered atomic.Int64
 }
 
 // NewServer creates a new NATS server instance
@@ -42,17 +72,33 @@ func NewServer(
 	config types.NATSConfig,
 	registry *agent.Registry,
 	eventProcessor *event.Processor,
+	metricsProcessor *metrics.Processor,
 	logger *zap.Logger,
 ) *Server {
+	applyJetStreamDefaults(&config.JetStream)
+
 	return &Server{
-		config:         config,
-		registry:       registry,
-		eventProcessor: eventProcessor,
-		logger:         logger.With(zap.String("component", "nats-server")),
-		stopCh:         make(chan struct{}),
+		config:           config,
+		registry:         registry,
+		eventProcessor:   eventProcessor,
+		metricsProcessor: metricsProcessor,
+		snapshots:        newSnapshotCache(),
+		logger:           logger.With(zap.String("component", "nats-server")),
+		stopCh:           make(chan struct{}),
 	}
 }
 
+// SetResultHandler sets the handler for command acknowledgements and results.
+// It must be called before Start.
+func (s *Server) SetResultHandler(handler ResultHandler) {
+	s.resultHandler = handler
+}
+
+// SetCommandSigner signs the commands published from now on
+func (s *Server) SetCommandSigner(signer *protocol.CommandSigner) {
+	s.signer = signer
+}
+
 // Start starts the NATS server and subscriptions
 func (s *Server) Start(ctx context.Context) error {
 	s.logger.Info("Starting NATS server", zap.String("url", s.config.URL))
@@ -62,6 +108,13 @@ func (s *Server) Start(ctx context.Context) error {
 		return fmt.Errorf("failed to connect to NATS: %w", err)
 	}
 
+	// Setup JetStream streams for durable delivery
+	if s.config.EnableJetStream {
+		if err := s.setupJetStream(); err != nil {
+			return fmt.Errorf("failed to setup JetStream: %w", err)
+		}
+	}
+
 	// Setup subscriptions
 	if err := s.setupSubscriptions(); err != nil {
 		return fmt.Errorf("failed to setup subscriptions: %w", err)
@@ -106,7 +159,7 @@ func (s *Server) Stop() error {
 // connect establishes connection to NATS server
 func (s *Server) connect() error {
 	opts := []nats.Option{
-		nats.Name("agent-manager"),
+		nats.Name(senderName),
 		nats.MaxReconnects(s.config.MaxReconnect),
 		nats.ReconnectWait(s.config.ReconnectWait),
 		nats.PingInterval(s.config.PingInterval),
@@ -154,12 +207,17 @@ func (s *Server) setupSubscriptions() error {
 		return fmt.Errorf("failed to subscribe to results: %w", err)
 	}
 
+	// Subscribe to streamed command output
+	if err := s.subscribeOutput(); err != nil {
+		return fmt.Errorf("failed to subscribe to command output: %w", err)
+	}
+
 	return nil
 }
 
 // subscribeRegister subscribes to agent registration messages
 func (s *Server) subscribeRegister() error {
-	subject := "aetherius.agent.*.register"
+	subject := protocol.WildcardSubject(protocol.KindRegister)
 
 	sub, err := s.conn.Subscribe(subject, func(msg *nats.Msg) {
 		s.handleRegister(msg)
@@ -179,7 +237,7 @@ func (s *Server) subscribeRegister() error {
 
 // subscribeHeartbeat subscribes to agent heartbeat messages
 func (s *Server) subscribeHeartbeat() error {
-	subject := "aetherius.agent.*.heartbeat"
+	subject := protocol.WildcardSubject(protocol.KindHeartbeat)
 
 	sub, err := s.conn.Subscribe(subject, func(msg *nats.Msg) {
 		s.handleHeartbeat(msg)
@@ -199,30 +257,27 @@ func (s *Server) subscribeHeartbeat() error {
 
 // subscribeEvents subscribes to agent event messages
 func (s *Server) subscribeEvents() error {
-	subject := "aetherius.agent.*.event"
-
-	sub, err := s.conn.Subscribe(subject, func(msg *nats.Msg) {
-		s.handleEvent(msg)
-	})
-	if err != nil {
-		return err
-	}
-
-	s.mu.Lock()
-	s.subscriptions = append(s.subscriptions, sub)
-	s.mu.Unlock()
-
-	s.logger.Info("Subscribed to agent events", zap.String("subject", subject))
-
-	return nil
+	return s.subscribeAgentMessages(protocol.KindEvent, s.handleEvent, "agent events")
 }
 
 // subscribeMetrics subscribes to agent metrics messages
 func (s *Server) subscribeMetrics() error {
-	subject := "aetherius.agent.*.metrics"
+	return s.subscribeAgentMessages(protocol.KindMetrics, s.handleMetrics, "agent metrics")
+}
+
+// subscribeResults subscribes to command result messages
+func (s *Server) subscribeResults() error {
+	return s.subscribeAgentMessages(protocol.KindResult, s.handleResult, "command results")
+}
+
+// subscribeOutput subscribes to the output chunks of running commands. Chunks
+// are published on core NATS only: the result keeps the output of a command
+// whose chunks were lost.
+func (s *Server) subscribeOutput() error {
+	subject := protocol.CommandOutputWildcard()
 
 	sub, err := s.conn.Subscribe(subject, func(msg *nats.Msg) {
-		s.handleMetrics(msg)
+		s.handleOutput(msg)
 	})
 	if err != nil {
 		return err
@@ -232,18 +287,26 @@ func (s *Server) subscribeMetrics() error {
 	s.subscriptions = append(s.subscriptions, sub)
 	s.mu.Unlock()
 
-	s.logger.Info("Subscribed to agent metrics", zap.String("subject", subject))
+	s.logger.Info("Subscribed to command output", zap.String("subject", subject))
 
 	return nil
 }
 
-// subscribeResults subscribes to command result messages
-func (s *Server) subscribeResults() error {
-	subject := "aetherius.agent.*.result"
-
-	sub, err := s.conn.Subscribe(subject, func(msg *nats.Msg) {
-		s.handleResult(msg)
-	})
+// subscribeAgentMessages subscribes to agent → manager messages of the given kind,
+// through a durable JetStream consumer when enabled and core NATS otherwise
+func (s *Server) subscribeAgentMessages(kind string, handler messageHandler, description string) error {
+	subject := protocol.WildcardSubject(kind)
+
+	var sub *nats.Subscription
+	var err error
+	if s.config.EnableJetStream {
+		sub, err = s.subscribeDurable(kind, handler)
+	} else {
+		sub, err = s.conn.Subscribe(subject, func(msg *nats.Msg) {
+			// Handlers log their own failures; core NATS offers no redelivery
+			_ = handler(msg)
+		})
+	}
 	if err != nil {
 		return err
 	}
@@ -252,173 +315,353 @@ func (s *Server) subscribeResults() error {
 	s.subscriptions = append(s.subscriptions, sub)
 	s.mu.Unlock()
 
-	s.logger.Info("Subscribed to command results", zap.String("subject", subject))
+	s.logger.Info("Subscribed to "+description,
+		zap.String("subject", subject),
+		zap.Bool("durable", s.config.EnableJetStream))
 
 	return nil
 }
 
 // Message handlers
 
-// handleRegister handles agent registration messages
+// handleRegister handles agent registration messages and negotiates the protocol version
 func (s *Server) handleRegister(msg *nats.Msg) {
-	s.messagesReceived++
+	s.messagesReceived.Add(1)
 
-	var agentInfo types.Agent
-	if err := json.Unmarshal(msg.Data, &agentInfo); err != nil {
+	env, err := protocol.Unmarshal(msg.Data)
+	if err != nil {
+		s.logger.Error("Failed to decode register message", zap.Error(err))
+		s.errorCount.Add(1)
+		return
+	}
+
+	var registration protocol.Registration
+	if err := env.DecodePayload(protocol.MessageTypeRegister, &registration); err != nil {
 		s.logger.Error("Failed to unmarshal register message", zap.Error(err))
-		s.errorCount++
+		s.errorCount.Add(1)
+		return
+	}
+
+	negotiated, err := protocol.Negotiate(registration.ProtocolVersion)
+	if err != nil {
+		s.logger.Warn("Rejecting agent with incompatible protocol version",
+			zap.String("cluster_id", registration.ClusterID),
+			zap.String("agent_version", registration.Version),
+			zap.Int("protocol_version", registration.ProtocolVersion),
+			zap.Error(err))
+		s.errorCount.Add(1)
+		s.sendRegisterAck(msg, registration.ClusterID, protocol.RegistrationAck{
+			Accepted:        false,
+			ProtocolVersion: protocol.Version,
+			Reason:          err.Error(),
+		})
 		return
 	}
 
+	agentInfo := agentFromRegistration(&registration, negotiated)
+
 	ctx := context.Background()
-	if err := s.registry.RegisterAgent(ctx, &agentInfo); err != nil {
+	if err := s.registry.RegisterAgent(ctx, agentInfo); err != nil {
 		s.logger.Error("Failed to register agent",
 			zap.String("cluster_id", agentInfo.ClusterID),
 			zap.Error(err))
-		s.errorCount++
+		s.errorCount.Add(1)
+		s.sendRegisterAck(msg, registration.ClusterID, protocol.RegistrationAck{
+			Accepted:        false,
+			ProtocolVersion: negotiated,
+			Reason:          "registration failed: " + err.Error(),
+		})
 		return
 	}
 
 	s.logger.Info("Agent registered successfully",
 		zap.String("agent_id", agentInfo.ID),
-		zap.String("cluster_id", agentInfo.ClusterID))
+		zap.String("cluster_id", agentInfo.ClusterID),
+		zap.Int("protocol_version", negotiated))
 
 	// Send acknowledgment
-	ack := map[string]interface{}{
-		"status":  "registered",
-		"agent_id": agentInfo.ID,
-	}
-	s.sendResponse(msg, ack)
+	s.sendRegisterAck(msg, registration.ClusterID, protocol.RegistrationAck{
+		Accepted:        true,
+		AgentID:         agentInfo.ID,
+		ProtocolVersion: negotiated,
+	})
 }
 
 // handleHeartbeat handles agent heartbeat messages
 func (s *Server) handleHeartbeat(msg *nats.Msg) {
-	s.messagesReceived++
+	s.messagesReceived.Add(1)
 
-	var heartbeat struct {
-		AgentID   string    `json:"agent_id"`
-		ClusterID string    `json:"cluster_id"`
-		Timestamp time.Time `json:"timestamp"`
+	env, err := protocol.Decode(msg.Data)
+	if err != nil {
+		s.logger.Error("Failed to decode heartbeat message", zap.Error(err))
+		s.errorCount.Add(1)
+		return
 	}
 
-	if err := json.Unmarshal(msg.Data, &heartbeat); err != nil {
+	var heartbeat protocol.Heartbeat
+	if err := env.DecodePayload(protocol.MessageTypeHeartbeat, &heartbeat); err != nil {
 		s.logger.Error("Failed to unmarshal heartbeat message", zap.Error(err))
-		s.errorCount++
+		s.errorCount.Add(1)
 		return
 	}
 
+	if heartbeat.ClusterID == "" {
+		heartbeat.ClusterID = env.ClusterID
+	}
+
 	ctx := context.Background()
-	if err := s.registry.UpdateHeartbeat(ctx, heartbeat.AgentID); err != nil {
+	health := agentHealthFromHeartbeat(&heartbeat)
+	if err := s.registry.UpdateHeartbeat(ctx, heartbeat.AgentID, heartbeat.ClusterID, health); err != nil {
 		s.logger.Warn("Failed to update heartbeat",
 			zap.String("agent_id", heartbeat.AgentID),
+			zap.String("cluster_id", heartbeat.ClusterID),
 			zap.Error(err))
-		s.errorCount++
+		s.errorCount.Add(1)
 		return
 	}
 
 	s.logger.Debug("Heartbeat received",
 		zap.String("agent_id", heartbeat.AgentID),
-		zap.String("cluster_id", heartbeat.ClusterID))
+		zap.String("cluster_id", heartbeat.ClusterID),
+		zap.String("status", health.Status))
 }
 
 // handleEvent handles agent event messages
-func (s *Server) handleEvent(msg *nats.Msg) {
-	s.messagesReceived++
+func (s *Server) handleEvent(msg *nats.Msg) error {
+	s.messagesReceived.Add(1)
+
+	env, err := protocol.Decode(msg.Data)
+	if err != nil {
+		s.logger.Error("Failed to decode event message", zap.Error(err))
+		s.errorCount.Add(1)
+		return malformed(err)
+	}
 
-	var event types.Event
-	if err := json.Unmarshal(msg.Data, &event); err != nil {
+	var payload protocol.Event
+	if err := env.DecodePayload(protocol.MessageTypeEvent, &payload); err != nil {
 		s.logger.Error("Failed to unmarshal event message", zap.Error(err))
-		s.errorCount++
-		return
+		s.errorCount.Add(1)
+		return malformed(err)
 	}
 
+	event := eventFromProtocol(&payload)
+
 	ctx := context.Background()
-	if err := s.eventProcessor.ProcessEvent(ctx, &event); err != nil {
+	if err := s.eventProcessor.ProcessEvent(ctx, event); err != nil {
 		s.logger.Error("Failed to process event",
 			zap.String("event_id", event.ID),
 			zap.String("cluster_id", event.ClusterID),
 			zap.Error(err))
-		s.errorCount++
-		return
+		s.errorCount.Add(1)
+		return err
 	}
 
 	s.logger.Debug("Event processed",
 		zap.String("event_id", event.ID),
 		zap.String("cluster_id", event.ClusterID),
 		zap.String("severity", event.Severity))
+
+	return nil
 }
 
 // handleMetrics handles agent metrics messages
-func (s *Server) handleMetrics(msg *nats.Msg) {
-	s.messagesReceived++
+func (s *Server) handleMetrics(msg *nats.Msg) error {
+	s.messagesReceived.Add(1)
+
+	env, err := protocol.Decode(msg.Data)
+	if err != nil {
+		s.logger.Error("Failed to decode metrics message", zap.Error(err))
+		s.errorCount.Add(1)
+		return malformed(err)
+	}
 
-	var metrics types.Metrics
-	if err := json.Unmarshal(msg.Data, &metrics); err != nil {
+	var payload protocol.Metrics
+	if err := env.DecodePayload(protocol.MessageTypeMetrics, &payload); err != nil {
 		s.logger.Error("Failed to unmarshal metrics message", zap.Error(err))
-		s.errorCount++
-		return
+		s.errorCount.Add(1)
+		return malformed(err)
+	}
+	if payload.ClusterID == "" {
+		payload.ClusterID = env.ClusterID
+	}
+
+	// Deltas are merged into the previous snapshot of the cluster, so that
+	// every stored snapshot holds all nodes and namespaces
+	data, merged := s.snapshots.apply(&payload)
+	if !merged {
+		s.logger.Debug("Metrics delta without a previous snapshot, stored as received",
+			zap.String("cluster_id", payload.ClusterID))
+	}
+	payload.Data = data
+
+	// The envelope message ID keeps the stored snapshot idempotent across redeliveries
+	snapshot := metricsFromProtocol(env.MessageID, &payload)
+
+	ctx := context.Background()
+	if err := s.metricsProcessor.ProcessMetrics(ctx, snapshot); err != nil {
+		s.logger.Error("Failed to process metrics",
+			zap.String("cluster_id", snapshot.ClusterID),
+			zap.Error(err))
+		s.errorCount.Add(1)
+		return err
 	}
 
-	// TODO: Process metrics (store in Prometheus/VictoriaMetrics)
-	s.logger.Debug("Metrics received",
-		zap.String("cluster_id", metrics.ClusterID))
+	s.logger.Debug("Metrics processed",
+		zap.String("cluster_id", snapshot.ClusterID))
+
+	return nil
 }
 
 // handleResult handles command result messages
-func (s *Server) handleResult(msg *nats.Msg) {
-	s.messagesReceived++
+func (s *Server) handleResult(msg *nats.Msg) error {
+	s.messagesReceived.Add(1)
+
+	env, err := protocol.Decode(msg.Data)
+	if err != nil {
+		s.logger.Error("Failed to decode result message", zap.Error(err))
+		s.errorCount.Add(1)
+		return malformed(err)
+	}
+
+	if s.resultHandler == nil {
+		s.errorCount.Add(1)
+		return errNoResultHandler
+	}
+
+	ctx := context.Background()
+
+	// Acknowledgements share the result subject to stay ordered with results
+	if env.Type == protocol.MessageTypeCommandAck {
+		var ack protocol.CommandAck
+		if err := env.DecodePayload(protocol.MessageTypeCommandAck, &ack); err != nil {
+			s.logger.Error("Failed to unmarshal command ack", zap.Error(err))
+			s.errorCount.Add(1)
+			return malformed(err)
+		}
+
+		s.logger.Debug("Command ack received",
+			zap.String("command_id", ack.CommandID),
+			zap.String("cluster_id", ack.ClusterID),
+			zap.String("status", ack.Status))
+
+		if err := s.resultHandler.HandleCommandAck(ctx, ack.CommandID); err != nil {
+			s.errorCount.Add(1)
+			return fmt.Errorf("failed to handle command ack: %w", err)
+		}
+		return nil
+	}
 
-	var result types.CommandResult
-	if err := json.Unmarshal(msg.Data, &result); err != nil {
+	var payload protocol.CommandResult
+	if err := env.DecodePayload(protocol.MessageTypeResult, &payload); err != nil {
 		s.logger.Error("Failed to unmarshal result message", zap.Error(err))
-		s.errorCount++
-		return
+		s.errorCount.Add(1)
+		return malformed(err)
 	}
 
-	// TODO: Process command result
+	// The envelope message ID keeps the stored result idempotent across redeliveries
+	result := commandResultFromProtocol(env.MessageID, &payload)
+
 	s.logger.Info("Command result received",
 		zap.String("command_id", result.CommandID),
 		zap.String("cluster_id", result.ClusterID),
 		zap.String("status", result.Status))
+
+	if err := s.resultHandler.HandleCommandResult(ctx, result); err != nil {
+		s.errorCount.Add(1)
+		return fmt.Errorf("failed to handle command result: %w", err)
+	}
+
+	return nil
+}
+
+// handleOutput handles a chunk of command output
+func (s *Server) handleOutput(msg *nats.Msg) {
+	s.messagesReceived.Add(1)
+
+	env, err := protocol.Decode(msg.Data)
+	if err != nil {
+		s.logger.Error("Failed to decode output message", zap.Error(err))
+		s.errorCount.Add(1)
+		return
+	}
+
+	var payload protocol.CommandOutput
+	if err := env.DecodePayload(protocol.MessageTypeOutput, &payload); err != nil {
+		s.logger.Error("Failed to unmarshal output message", zap.Error(err))
+		s.errorCount.Add(1)
+		return
+	}
+
+	if s.resultHandler == nil {
+		s.errorCount.Add(1)
+		return
+	}
+
+	chunk := commandOutputFromProtocol(&payload)
+	if err := s.resultHandler.HandleCommandOutput(context.Background(), chunk); err != nil {
+		s.logger.Error("Failed to handle command output",
+			zap.String("command_id", chunk.CommandID),
+			zap.Int64("seq", chunk.Seq),
+			zap.Error(err))
+		s.errorCount.Add(1)
+	}
 }
 
 // PublishCommand publishes a command to an agent
 func (s *Server) PublishCommand(clusterID string, cmd *types.Command) error {
-	subject := fmt.Sprintf("aetherius.agent.%s.command", clusterID)
+	return s.publishCommand(clusterID, commandToProtocol(cmd))
+}
 
-	data, err := json.Marshal(cmd)
+// PublishCancel asks the agent of a cluster to cancel a command, dropping it
+// if it waits and killing it if it runs
+func (s *Server) PublishCancel(clusterID, commandID, reason string) error {
+	return s.publishCommand(clusterID, protocol.NewCancelCommand(commandID, reason))
+}
+
+// publishCommand signs, when configured, and publishes a wire command
+func (s *Server) publishCommand(clusterID string, wire *protocol.Command) error {
+	subject := protocol.CommandSubject(clusterID)
+
+	if s.signer != nil {
+		if err := s.signer.Sign(wire, clusterID); err != nil {
+			return fmt.Errorf("failed to sign command: %w", err)
+		}
+	}
+
+	data, err := protocol.Encode(protocol.MessageTypeCommand, senderName, clusterID, wire)
 	if err != nil {
-		return fmt.Errorf("failed to marshal command: %w", err)
+		return fmt.Errorf("failed to encode command: %w", err)
 	}
 
 	if err := s.conn.Publish(subject, data); err != nil {
-		s.errorCount++
+		s.errorCount.Add(1)
 		return fmt.Errorf("failed to publish command: %w", err)
 	}
 
-	s.messagesSent++
+	s.messagesSent.Add(1)
 	s.logger.Info("Command published",
-		zap.String("command_id", cmd.ID),
+		zap.String("command_id", wire.ID),
+		zap.String("type", wire.Type),
 		zap.String("cluster_id", clusterID),
 		zap.String("subject", subject))
 
 	return nil
 }
 
-// sendResponse sends a response message
-func (s *Server) sendResponse(msg *nats.Msg, response interface{}) {
-	data, err := json.Marshal(response)
+// sendRegisterAck replies to a registration request with an enveloped acknowledgment
+func (s *Server) sendRegisterAck(msg *nats.Msg, clusterID string, ack protocol.RegistrationAck) {
+	data, err := protocol.Encode(protocol.MessageTypeRegisterAck, senderName, clusterID, ack)
 	if err != nil {
-		s.logger.Error("Failed to marshal response", zap.Error(err))
+		s.logger.Error("Failed to encode register ack", zap.Error(err))
 		return
 	}
 
 	if err := msg.Respond(data); err != nil {
-		s.logger.Error("Failed to send response", zap.Error(err))
+		s.logger.Error("Failed to send register ack", zap.Error(err))
 		return
 	}
 
-	s.messagesSent++
+	s.messagesSent.Add(1)
 }
 
 // Connection event handlers
@@ -438,7 +681,7 @@ func (s *Server) handleError(conn *nats.Conn, sub *nats.Subscription, err error)
 	s.logger.Error("NATS error",
 		zap.Error(err),
 		zap.String("subject", sub.Subject))
-	s.errorCount++
+	s.errorCount.Add(1)
 }
 
 // connectionMonitor monitors connection health
@@ -471,12 +714,16 @@ func (s *Server) GetStatistics() map[string]interface{} {
 	}
 
 	return map[string]interface{}{
-		"connected":          connected,
-		"connected_url":      connectedURL,
-		"messages_received":  s.messagesReceived,
-		"messages_sent":      s.messagesSent,
-		"error_count":        s.errorCount,
-		"subscription_count": len(s.subscriptions),
+		"connected":              connected,
+		"connected_url":          connectedURL,
+		"messages_received":      s.messagesReceived.Load(),
+		"messages_sent":          s.messagesSent.Load(),
+		"error_count":            s.errorCount.Load(),
+		"subscription_count":     len(s.subscriptions),
+		"jetstream_enabled":      s.config.EnableJetStream,
+		"messages_acked":         s.messagesAcked.Load(),
+		"messages_redelivered":   s.messagesRedelivered.Load(),
+		"messages_dead_lettered": s.messagesDeadLettered.Load(),
 	}
 }
 
@@ -489,4 +736,4 @@ func (s *Server) Health() error {
 		return fmt.Errorf("connection lost")
 	}
 	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,73 @@
+package nats
+
+import (
+	"sync"
+
+	"github.com/kart-io/k8s-agent/protocol"
+)
+
+// deltaSections are the sections of a metrics delta keyed by name, whose
+// entries replace or remove those of the previous snapshot
+var deltaSections = []string{"node_details", "namespaces"}
+
+// fullSnapshotSections are only sent with full snapshots and carried over
+// into the deltas that follow
+var fullSnapshotSections = []string{"cluster"}
+
+// snapshotCache holds the last metrics snapshot of each cluster, so that
+// deltas can be merged into complete snapshots before they are stored
+type snapshotCache struct {
+	mu        sync.Mutex
+	snapshots map[string]map[string]interface{}
+}
+
+// newSnapshotCache creates an empty snapshot cache
+func newSnapshotCache() *snapshotCache {
+	return &snapshotCache{snapshots: make(map[string]map[string]interface{})}
+}
+
+// apply returns the complete snapshot data of m and keeps it as the latest
+// of its cluster. A delta is merged into the previous snapshot; without one,
+// as after a restart, the delta is kept as it is until the next full
+// snapshot, and merged reports false.
+func (c *snapshotCache) apply(m *protocol.Metrics) (data map[string]interface{}, merged bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	previous, ok := c.snapshots[m.ClusterID]
+	if !m.IsDelta() || !ok {
+		c.snapshots[m.ClusterID] = m.Data
+		return m.Data, !m.IsDelta()
+	}
+
+	data = make(map[string]interface{}, len(m.Data))
+	for key, value := range m.Data {
+		data[key] = value
+	}
+	for _, key := range fullSnapshotSections {
+		if _, ok := data[key]; !ok && previous[key] != nil {
+			data[key] = previous[key]
+		}
+	}
+
+	for _, key := range deltaSections {
+		entries := make(map[string]interface{})
+		if base, ok := previous[key].(map[string]interface{}); ok {
+			for name, entry := range base {
+				entries[name] = entry
+			}
+		}
+		if changed, ok := m.Data[key].(map[string]interface{}); ok {
+			for name, entry := range changed {
+				entries[name] = entry
+			}
+		}
+		for _, name := range m.Removed[key] {
+			delete(entries, name)
+		}
+		data[key] = entries
+	}
+
+	c.snapshots[m.ClusterID] = data
+	return data, true
+}
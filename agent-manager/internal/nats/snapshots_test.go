@@ -0,0 +1,138 @@
+package nats
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/kart-io/k8s-agent/protocol"
+)
+
+func TestSnapshotCacheApply(t *testing.T) {
+	full := &protocol.Metrics{
+		ClusterID: "prod-1",
+		Snapshot:  protocol.MetricsSnapshotFull,
+		Data: map[string]interface{}{
+			"cluster": map[string]interface{}{"nodes": 2},
+			"node_details": map[string]interface{}{
+				"node-1": map[string]interface{}{"ready": true},
+				"node-2": map[string]interface{}{"ready": true},
+			},
+			"namespaces": map[string]interface{}{
+				"shop": map[string]interface{}{"pods": 3},
+			},
+		},
+	}
+	delta := &protocol.Metrics{
+		ClusterID: "prod-1",
+		Snapshot:  protocol.MetricsSnapshotDelta,
+		Removed:   map[string][]string{"node_details": {"node-2"}},
+		Data: map[string]interface{}{
+			"node_details": map[string]interface{}{
+				"node-1": map[string]interface{}{"ready": false},
+			},
+			"namespaces": map[string]interface{}{
+				"billing": map[string]interface{}{"pods": 1},
+			},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		reports    []*protocol.Metrics
+		want       map[string]interface{}
+		wantMerged bool
+	}{
+		{
+			name:       "full snapshot",
+			reports:    []*protocol.Metrics{full},
+			want:       full.Data,
+			wantMerged: true,
+		},
+		{
+			name:       "delta without a previous snapshot",
+			reports:    []*protocol.Metrics{delta},
+			want:       delta.Data,
+			wantMerged: false,
+		},
+		{
+			name:    "delta merged into the previous snapshot",
+			reports: []*protocol.Metrics{full, delta},
+			want: map[string]interface{}{
+				"cluster": map[string]interface{}{"nodes": 2},
+				"node_details": map[string]interface{}{
+					"node-1": map[string]interface{}{"ready": false},
+				},
+				"namespaces": map[string]interface{}{
+					"shop":    map[string]interface{}{"pods": 3},
+					"billing": map[string]interface{}{"pods": 1},
+				},
+			},
+			wantMerged: true,
+		},
+		{
+			name: "deltas build on the merged snapshot",
+			reports: []*protocol.Metrics{full, delta, {
+				ClusterID: "prod-1",
+				Snapshot:  protocol.MetricsSnapshotDelta,
+				Removed:   map[string][]string{"namespaces": {"shop"}},
+				Data:      map[string]interface{}{},
+			}},
+			want: map[string]interface{}{
+				"cluster": map[string]interface{}{"nodes": 2},
+				"node_details": map[string]interface{}{
+					"node-1": map[string]interface{}{"ready": false},
+				},
+				"namespaces": map[string]interface{}{
+					"billing": map[string]interface{}{"pods": 1},
+				},
+			},
+			wantMerged: true,
+		},
+		{
+			name: "full snapshot replaces the merged one",
+			reports: []*protocol.Metrics{full, delta, {
+				ClusterID: "prod-1",
+				Data:      map[string]interface{}{"cluster": map[string]interface{}{"nodes": 1}},
+			}},
+			want:       map[string]interface{}{"cluster": map[string]interface{}{"nodes": 1}},
+			wantMerged: true,
+		},
+		{
+			name: "clusters are merged separately",
+			reports: []*protocol.Metrics{full, {
+				ClusterID: "prod-2",
+				Snapshot:  protocol.MetricsSnapshotDelta,
+				Data:      map[string]interface{}{"namespaces": map[string]interface{}{}},
+			}},
+			want:       map[string]interface{}{"namespaces": map[string]interface{}{}},
+			wantMerged: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := newSnapshotCache()
+
+			var data map[string]interface{}
+			var merged bool
+			for _, m := range tt.reports {
+				data, merged = cache.apply(m)
+			}
+
+			if merged != tt.wantMerged {
+				t.Errorf("merged = %v, want %v", merged, tt.wantMerged)
+			}
+			if !reflect.DeepEqual(data, tt.want) {
+				t.Errorf("data = %v, want %v", data, tt.want)
+			}
+		})
+	}
+
+	// Merging must not modify the reports it was built from
+	cache := newSnapshotCache()
+	cache.apply(full)
+	cache.apply(delta)
+	if len(full.Data["node_details"].(map[string]interface{})) != 2 {
+		t.Errorf("full snapshot was modified: %v", full.Data)
+	}
+}
@@ -0,0 +1,335 @@
+package remotewrite
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"go.uber.org/zap"
+
+	"github.com/kart-io/k8s-agent/agent-manager/pkg/types"
+)
+
+// invalidNameChars matches characters not allowed in Prometheus metric names
+var invalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+
+// errNonRecoverable marks remote-write failures that retrying cannot fix
+var errNonRecoverable = errors.New("non-recoverable remote write error")
+
+// Exporter pushes agent metrics to a Prometheus remote-write endpoint. Series
+// are queued by Export, batched and sent with retries by a background worker.
+type Exporter struct {
+	config types.RemoteWriteConfig
+	client *http.Client
+	logger *zap.Logger
+
+	queue  chan TimeSeries
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+
+	// Metrics
+	mu             sync.RWMutex
+	samplesQueued  int64
+	samplesSent    int64
+	samplesDropped int64
+	batchesSent    int64
+	batchesFailed  int64
+	retries        int64
+	lastError      string
+	lastSuccess    time.Time
+}
+
+// NewExporter creates a new remote-write exporter
+func NewExporter(config types.RemoteWriteConfig, logger *zap.Logger) *Exporter {
+	applyRemoteWriteDefaults(&config)
+
+	return &Exporter{
+		config: config,
+		client: &http.Client{Timeout: config.Timeout},
+		logger: logger.With(zap.String("component", "remote-write")),
+		queue:  make(chan TimeSeries, config.QueueSize),
+		stopCh: make(chan struct{}),
+	}
+}
+
+// Start starts the batching worker
+func (e *Exporter) Start(ctx context.Context) error {
+	if e.config.URL == "" {
+		return fmt.Errorf("remote write url is required")
+	}
+
+	e.logger.Info("Starting remote-write exporter",
+		zap.String("url", e.config.URL),
+		zap.Int("batch_size", e.config.BatchSize),
+		zap.Duration("flush_interval", e.config.FlushInterval))
+
+	e.wg.Add(1)
+	go e.run()
+
+	return nil
+}
+
+// Stop stops the worker after sending the queued series once more
+func (e *Exporter) Stop() error {
+	e.logger.Info("Stopping remote-write exporter")
+	close(e.stopCh)
+	e.wg.Wait()
+	return nil
+}
+
+// Export queues the samples of a cluster metrics snapshot. It never blocks;
+// samples are dropped when the queue is full.
+func (e *Exporter) Export(clusterID string, timestamp time.Time, samples []types.MetricSample) {
+	ts := timestamp.UnixMilli()
+
+	var dropped int64
+	for _, sample := range samples {
+		series := TimeSeries{
+			Labels:  e.labels(clusterID, sample),
+			Samples: []Sample{{Value: sample.Value, Timestamp: ts}},
+		}
+
+		select {
+		case e.queue <- series:
+		default:
+			dropped++
+		}
+	}
+
+	e.mu.Lock()
+	e.samplesQueued += int64(len(samples)) - dropped
+	e.samplesDropped += dropped
+	e.mu.Unlock()
+
+	if dropped > 0 {
+		e.logger.Warn("Remote-write queue full, dropping samples",
+			zap.String("cluster_id", clusterID),
+			zap.Int64("dropped", dropped))
+	}
+}
+
+// labels builds the sorted label set of a sample. Like Prometheus external
+// labels, they only fill in names the sample does not set itself.
+func (e *Exporter) labels(clusterID string, sample types.MetricSample) []Label {
+	labels := []Label{
+		{Name: "__name__", Value: invalidNameChars.ReplaceAllString(e.config.MetricPrefix+sample.Name, "_")},
+		{Name: "cluster_id", Value: clusterID},
+	}
+	if sample.Node != "" {
+		labels = append(labels, Label{Name: "node", Value: sample.Node})
+	}
+	if sample.Namespace != "" {
+		labels = append(labels, Label{Name: "namespace", Value: sample.Namespace})
+	}
+	for name, value := range e.config.ExternalLabels {
+		if !hasLabel(labels, name) {
+			labels = append(labels, Label{Name: name, Value: value})
+		}
+	}
+
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].Name < labels[j].Name
+	})
+
+	return labels
+}
+
+// hasLabel reports whether labels contains a label with the given name
+func hasLabel(labels []Label, name string) bool {
+	for _, label := range labels {
+		if label.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// run batches queued series and sends them when a batch is full or the flush interval elapses
+func (e *Exporter) run() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(e.config.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]TimeSeries, 0, e.config.BatchSize)
+	flush := func(retries int) {
+		if len(batch) == 0 {
+			return
+		}
+		e.send(batch, retries)
+		batch = make([]TimeSeries, 0, e.config.BatchSize)
+	}
+
+	for {
+		select {
+		case <-e.stopCh:
+			// Send what is left without retrying so shutdown stays bounded
+			for {
+				select {
+				case series := <-e.queue:
+					batch = append(batch, series)
+					if len(batch) >= e.config.BatchSize {
+						flush(0)
+					}
+				default:
+					flush(0)
+					return
+				}
+			}
+
+		case series := <-e.queue:
+			batch = append(batch, series)
+			if len(batch) >= e.config.BatchSize {
+				flush(e.config.MaxRetries)
+			}
+
+		case <-ticker.C:
+			flush(e.config.MaxRetries)
+		}
+	}
+}
+
+// send posts a batch, retrying recoverable failures with exponential backoff
+func (e *Exporter) send(batch []TimeSeries, retries int) {
+	body := snappy.Encode(nil, EncodeWriteRequest(batch))
+	backoff := e.config.MinBackoff
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = e.post(body); err == nil {
+			e.mu.Lock()
+			e.samplesSent += int64(len(batch))
+			e.batchesSent++
+			e.lastSuccess = time.Now()
+			e.mu.Unlock()
+			return
+		}
+
+		if errors.Is(err, errNonRecoverable) || attempt >= retries {
+			break
+		}
+
+		e.logger.Debug("Remote write failed, retrying",
+			zap.Int("attempt", attempt+1),
+			zap.Duration("backoff", backoff),
+			zap.Error(err))
+
+		e.mu.Lock()
+		e.retries++
+		e.mu.Unlock()
+
+		select {
+		case <-time.After(backoff):
+		case <-e.stopCh:
+			retries = attempt + 1
+		}
+
+		backoff *= 2
+		if backoff > e.config.MaxBackoff {
+			backoff = e.config.MaxBackoff
+		}
+	}
+
+	e.mu.Lock()
+	e.samplesDropped += int64(len(batch))
+	e.batchesFailed++
+	e.lastError = err.Error()
+	e.mu.Unlock()
+
+	e.logger.Error("Failed to send remote-write batch",
+		zap.Int("series", len(batch)),
+		zap.Error(err))
+}
+
+// post sends one snappy-compressed write request
+func (e *Exporter) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, e.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errNonRecoverable, err)
+	}
+
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	req.Header.Set("User-Agent", "aetherius-agent-manager")
+	for name, value := range e.config.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send write request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("remote write returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+
+	// Server errors and throttling are retried, other client errors are not
+	if resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests {
+		return err
+	}
+	return fmt.Errorf("%w: %v", errNonRecoverable, err)
+}
+
+// GetStatistics returns exporter statistics
+func (e *Exporter) GetStatistics() map[string]interface{} {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return map[string]interface{}{
+		"samples_queued":  e.samplesQueued,
+		"samples_sent":    e.samplesSent,
+		"samples_dropped": e.samplesDropped,
+		"batches_sent":    e.batchesSent,
+		"batches_failed":  e.batchesFailed,
+		"retries":         e.retries,
+		"queue_length":    len(e.queue),
+		"last_error":      e.lastError,
+		"last_success":    e.lastSuccess,
+	}
+}
+
+// applyRemoteWriteDefaults fills unset remote-write settings with sane defaults
+func applyRemoteWriteDefaults(config *types.RemoteWriteConfig) {
+	if config.Timeout <= 0 {
+		config.Timeout = 30 * time.Second
+	}
+	if config.MetricPrefix == "" {
+		config.MetricPrefix = "aetherius_"
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = 10000
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 500
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = 5 * time.Second
+	}
+	if config.MaxRetries <= 0 {
+		config.MaxRetries = 5
+	}
+	if config.MinBackoff <= 0 {
+		config.MinBackoff = 500 * time.Millisecond
+	}
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = 30 * time.Second
+	}
+	if config.MaxBackoff < config.MinBackoff {
+		config.MaxBackoff = config.MinBackoff
+	}
+}
@@ -0,0 +1,234 @@
+package remotewrite
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"go.uber.org/zap"
+
+	"github.com/kart-io/k8s-agent/agent-manager/pkg/types"
+)
+
+// receiver is a remote-write endpoint that records decoded write requests and
+// answers with the queued status codes, then 204
+type receiver struct {
+	t        *testing.T
+	mu       sync.Mutex
+	statuses []int
+	requests [][]TimeSeries
+	attempts int
+}
+
+func newReceiver(t *testing.T, statuses ...int) (*receiver, *httptest.Server) {
+	r := &receiver{t: t, statuses: statuses}
+	server := httptest.NewServer(http.HandlerFunc(r.serve))
+	t.Cleanup(server.Close)
+	return r, server
+}
+
+func (r *receiver) serve(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.attempts++
+	if len(r.statuses) > 0 {
+		status := r.statuses[0]
+		r.statuses = r.statuses[1:]
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	if got := req.Header.Get("Content-Encoding"); got != "snappy" {
+		r.t.Errorf("Content-Encoding = %q, want snappy", got)
+	}
+	compressed, err := io.ReadAll(req.Body)
+	if err != nil {
+		r.t.Errorf("failed to read body: %v", err)
+		return
+	}
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		r.t.Errorf("failed to decompress: %v", err)
+		return
+	}
+	series, err := DecodeWriteRequest(data)
+	if err != nil {
+		r.t.Errorf("failed to decode write request: %v", err)
+		return
+	}
+	r.requests = append(r.requests, series)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (r *receiver) received() ([][]TimeSeries, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.requests, r.attempts
+}
+
+func newTestExporter(t *testing.T, config types.RemoteWriteConfig) *Exporter {
+	if config.FlushInterval == 0 {
+		config.FlushInterval = time.Hour
+	}
+	config.MinBackoff = time.Millisecond
+	config.MaxBackoff = 5 * time.Millisecond
+
+	e := NewExporter(config, zap.NewNop())
+	if err := e.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	return e
+}
+
+// waitForBatches waits until the exporter has sent or given up on n batches
+func waitForBatches(t *testing.T, e *Exporter, n int64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		stats := e.GetStatistics()
+		if stats["batches_sent"].(int64)+stats["batches_failed"].(int64) >= n {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d batches: %v", n, e.GetStatistics())
+}
+
+func TestExporterWriteRequest(t *testing.T) {
+	r, server := newReceiver(t)
+	e := newTestExporter(t, types.RemoteWriteConfig{
+		URL: server.URL,
+		ExternalLabels: map[string]string{
+			"region":     "eu-1",
+			"cluster_id": "override",
+			"__name__":   "override",
+			"node":       "unknown",
+		},
+	})
+
+	at := time.UnixMilli(1700000000123)
+	e.Export("prod-1", at, []types.MetricSample{
+		{Name: "node_cpu_usage", Node: "node-1", Value: 0.5},
+		{Name: "pod.restarts", Namespace: "shop", Value: 3},
+		{Name: "cluster_nodes", Value: 4},
+	})
+	e.Stop()
+
+	requests, _ := r.received()
+	want := [][]TimeSeries{{
+		{
+			Labels: []Label{
+				{Name: "__name__", Value: "aetherius_node_cpu_usage"},
+				{Name: "cluster_id", Value: "prod-1"},
+				{Name: "node", Value: "node-1"},
+				{Name: "region", Value: "eu-1"},
+			},
+			Samples: []Sample{{Value: 0.5, Timestamp: 1700000000123}},
+		},
+		{
+			Labels: []Label{
+				{Name: "__name__", Value: "aetherius_pod_restarts"},
+				{Name: "cluster_id", Value: "prod-1"},
+				{Name: "namespace", Value: "shop"},
+				{Name: "node", Value: "unknown"},
+				{Name: "region", Value: "eu-1"},
+			},
+			Samples: []Sample{{Value: 3, Timestamp: 1700000000123}},
+		},
+		{
+			Labels: []Label{
+				{Name: "__name__", Value: "aetherius_cluster_nodes"},
+				{Name: "cluster_id", Value: "prod-1"},
+				{Name: "node", Value: "unknown"},
+				{Name: "region", Value: "eu-1"},
+			},
+			Samples: []Sample{{Value: 4, Timestamp: 1700000000123}},
+		},
+	}}
+	if !reflect.DeepEqual(requests, want) {
+		t.Errorf("received %+v, want %+v", requests, want)
+	}
+}
+
+func TestExporterRetries(t *testing.T) {
+	tests := []struct {
+		name        string
+		statuses    []int
+		wantAtt     int
+		wantSent    int64
+		wantFailed  int64
+		wantRetries int64
+	}{
+		{"server errors are retried", []int{http.StatusServiceUnavailable, http.StatusInternalServerError}, 3, 1, 0, 2},
+		{"throttling is retried", []int{http.StatusTooManyRequests}, 2, 1, 0, 1},
+		{"client errors are dropped", []int{http.StatusBadRequest}, 1, 0, 1, 0},
+		{"retries are bounded", []int{503, 503, 503, 503}, 3, 0, 1, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, server := newReceiver(t, tt.statuses...)
+			e := newTestExporter(t, types.RemoteWriteConfig{URL: server.URL, BatchSize: 1, MaxRetries: 2})
+
+			e.Export("prod-1", time.Now(), []types.MetricSample{{Name: "cluster_nodes", Value: 4}})
+			waitForBatches(t, e, 1)
+			e.Stop()
+
+			requests, attempts := r.received()
+			if attempts != tt.wantAtt {
+				t.Errorf("attempts = %d, want %d", attempts, tt.wantAtt)
+			}
+			if int64(len(requests)) != tt.wantSent {
+				t.Errorf("received %d requests, want %d", len(requests), tt.wantSent)
+			}
+			stats := e.GetStatistics()
+			if stats["batches_sent"] != tt.wantSent || stats["batches_failed"] != tt.wantFailed || stats["retries"] != tt.wantRetries {
+				t.Errorf("stats = %v, want %d sent, %d failed, %d retries", stats, tt.wantSent, tt.wantFailed, tt.wantRetries)
+			}
+			if tt.wantFailed > 0 && stats["samples_dropped"] != int64(1) {
+				t.Errorf("samples_dropped = %v, want 1", stats["samples_dropped"])
+			}
+		})
+	}
+}
+
+func TestExporterBatching(t *testing.T) {
+	r, server := newReceiver(t)
+	e := newTestExporter(t, types.RemoteWriteConfig{URL: server.URL, BatchSize: 2})
+
+	samples := []types.MetricSample{
+		{Name: "m0", Value: 0},
+		{Name: "m1", Value: 1},
+		{Name: "m2", Value: 2},
+		{Name: "m3", Value: 3},
+		{Name: "m4", Value: 4},
+	}
+	e.Export("prod-1", time.Now(), samples)
+	waitForBatches(t, e, 2)
+	e.Stop()
+
+	requests, _ := r.received()
+	var sizes []int
+	var values []float64
+	for _, series := range requests {
+		sizes = append(sizes, len(series))
+		for _, ts := range series {
+			values = append(values, ts.Samples[0].Value)
+		}
+	}
+	if want := []int{2, 2, 1}; !reflect.DeepEqual(sizes, want) {
+		t.Errorf("batch sizes = %v, want %v", sizes, want)
+	}
+	if want := []float64{0, 1, 2, 3, 4}; !reflect.DeepEqual(values, want) {
+		t.Errorf("values = %v, want %v", values, want)
+	}
+	if stats := e.GetStatistics(); stats["samples_sent"] != int64(5) || stats["batches_sent"] != int64(3) {
+		t.Errorf("stats = %v, want 5 samples in 3 batches", stats)
+	}
+}
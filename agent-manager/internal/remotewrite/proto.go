@@ -0,0 +1,173 @@
+package remotewrite
+
+import (
+	"fmt"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// TimeSeries is a labelled series of a remote-write request. Labels must be
+// sorted by name and include the metric name as __name__.
+type TimeSeries struct {
+	Labels  []Label
+	Samples []Sample
+}
+
+// Label is a name/value pair identifying a series
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample is a single value with a timestamp in milliseconds since the epoch
+type Sample struct {
+	Value     float64
+	Timestamp int64
+}
+
+// Field numbers of the prometheus.WriteRequest protobuf messages
+const (
+	fieldWriteRequestTimeseries = 1
+	fieldTimeSeriesLabels       = 1
+	fieldTimeSeriesSamples      = 2
+	fieldLabelName              = 1
+	fieldLabelValue             = 2
+	fieldSampleValue            = 1
+	fieldSampleTimestamp        = 2
+)
+
+// EncodeWriteRequest encodes series as an uncompressed prometheus.WriteRequest
+func EncodeWriteRequest(series []TimeSeries) []byte {
+	var buf []byte
+	for _, ts := range series {
+		buf = protowire.AppendTag(buf, fieldWriteRequestTimeseries, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, encodeTimeSeries(ts))
+	}
+	return buf
+}
+
+// encodeTimeSeries encodes a prometheus.TimeSeries message
+func encodeTimeSeries(ts TimeSeries) []byte {
+	var buf []byte
+	for _, label := range ts.Labels {
+		var l []byte
+		l = protowire.AppendTag(l, fieldLabelName, protowire.BytesType)
+		l = protowire.AppendString(l, label.Name)
+		l = protowire.AppendTag(l, fieldLabelValue, protowire.BytesType)
+		l = protowire.AppendString(l, label.Value)
+
+		buf = protowire.AppendTag(buf, fieldTimeSeriesLabels, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, l)
+	}
+	for _, sample := range ts.Samples {
+		var s []byte
+		s = protowire.AppendTag(s, fieldSampleValue, protowire.Fixed64Type)
+		s = protowire.AppendFixed64(s, math.Float64bits(sample.Value))
+		s = protowire.AppendTag(s, fieldSampleTimestamp, protowire.VarintType)
+		s = protowire.AppendVarint(s, uint64(sample.Timestamp))
+
+		buf = protowire.AppendTag(buf, fieldTimeSeriesSamples, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, s)
+	}
+	return buf
+}
+
+// DecodeWriteRequest decodes an uncompressed prometheus.WriteRequest, ignoring
+// fields other than series labels and samples
+func DecodeWriteRequest(data []byte) ([]TimeSeries, error) {
+	var series []TimeSeries
+	err := consumeMessage(data, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		if num != fieldWriteRequestTimeseries || typ != protowire.BytesType {
+			return nil
+		}
+		ts, err := decodeTimeSeries(value)
+		if err != nil {
+			return err
+		}
+		series = append(series, ts)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode write request: %w", err)
+	}
+	return series, nil
+}
+
+// decodeTimeSeries decodes a prometheus.TimeSeries message
+func decodeTimeSeries(data []byte) (TimeSeries, error) {
+	var ts TimeSeries
+	err := consumeMessage(data, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case fieldTimeSeriesLabels:
+			var label Label
+			err := consumeMessage(value, func(num protowire.Number, typ protowire.Type, value []byte) error {
+				switch {
+				case num == fieldLabelName && typ == protowire.BytesType:
+					label.Name = string(value)
+				case num == fieldLabelValue && typ == protowire.BytesType:
+					label.Value = string(value)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			ts.Labels = append(ts.Labels, label)
+		case fieldTimeSeriesSamples:
+			var sample Sample
+			err := consumeMessage(value, func(num protowire.Number, typ protowire.Type, value []byte) error {
+				switch {
+				case num == fieldSampleValue && typ == protowire.Fixed64Type:
+					bits, _ := protowire.ConsumeFixed64(value)
+					sample.Value = math.Float64frombits(bits)
+				case num == fieldSampleTimestamp && typ == protowire.VarintType:
+					v, _ := protowire.ConsumeVarint(value)
+					sample.Timestamp = int64(v)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			ts.Samples = append(ts.Samples, sample)
+		}
+		return nil
+	})
+	return ts, err
+}
+
+// consumeMessage calls fn with the raw value of every field in a protobuf message
+func consumeMessage(data []byte, fn func(num protowire.Number, typ protowire.Type, value []byte) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		var value []byte
+		if typ == protowire.BytesType {
+			v, m := protowire.ConsumeBytes(data)
+			if m < 0 {
+				return protowire.ParseError(m)
+			}
+			value, n = v, m
+		} else {
+			n = protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			value = data[:n]
+		}
+		data = data[n:]
+
+		if err := fn(num, typ, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -8,6 +8,7 @@ import (
 	"go.uber.org/zap"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"gorm.io/gorm/logger"
 
 	"github.com/kart-io/k8s-agent/agent-manager/pkg/types"
@@ -80,8 +81,11 @@ func (s *PostgresStore) migrate() error {
 		&types.Agent{},
 		&types.Event{},
 		&types.Metrics{},
+		&types.MetricPoint{},
 		&types.Command{},
 		&types.CommandResult{},
+		&types.LateCommandResult{},
+		&types.CommandOutputChunk{},
 		&types.Cluster{},
 		&types.AlertRule{},
 		&types.Alert{},
@@ -138,11 +142,15 @@ func (s *PostgresStore) UpdateAgentStatus(ctx context.Context, id string, status
 		}).Error
 }
 
-// UpdateAgentHeartbeat updates agent heartbeat timestamp
-func (s *PostgresStore) UpdateAgentHeartbeat(ctx context.Context, id string) error {
-	return s.db.WithContext(ctx).Model(&types.Agent{}).
-		Where("id = ?", id).
-		Update("last_heartbeat", time.Now()).Error
+// UpdateAgentHeartbeat updates agent heartbeat timestamp, marks it online and stores its reported health
+func (s *PostgresStore) UpdateAgentHeartbeat(ctx context.Context, id string, health *types.AgentHealth) error {
+	return s.db.WithContext(ctx).Model(&types.Agent{ID: id}).
+		Select("last_heartbeat", "status", "health").
+		Updates(&types.Agent{
+			LastHeartbeat: time.Now(),
+			Status:        types.AgentStatusOnline,
+			Health:        health,
+		}).Error
 }
 
 // DeleteAgent deletes an agent
@@ -152,9 +160,13 @@ func (s *PostgresStore) DeleteAgent(ctx context.Context, id string) error {
 
 // Event operations
 
-// SaveEvent saves an event to the database
+// SaveEvent saves an event to the database. Agents report every occurrence
+// of a Kubernetes event under the same ID, so a later report replaces the
+// stored one.
 func (s *PostgresStore) SaveEvent(ctx context.Context, event *types.Event) error {
-	return s.db.WithContext(ctx).Create(event).Error
+	return s.db.WithContext(ctx).
+		Clauses(clause.OnConflict{UpdateAll: true}).
+		Create(event).Error
 }
 
 // GetEvent retrieves an event by ID
@@ -204,6 +216,156 @@ type EventFilter struct {
 	Limit     int
 }
 
+// Metrics operations
+
+// SaveMetrics saves a metrics snapshot together with its raw points. Snapshots and
+// points that were already stored are skipped, so redelivered messages are harmless.
+func (s *PostgresStore) SaveMetrics(ctx context.Context, metrics *types.Metrics, points []*types.MetricPoint) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(metrics).Error; err != nil {
+			return fmt.Errorf("failed to save metrics snapshot: %w", err)
+		}
+		if len(points) == 0 {
+			return nil
+		}
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(points, 500).Error; err != nil {
+			return fmt.Errorf("failed to save metric points: %w", err)
+		}
+		return nil
+	})
+}
+
+// GetLatestMetrics retrieves the most recent metrics snapshot of a cluster
+func (s *PostgresStore) GetLatestMetrics(ctx context.Context, clusterID string) (*types.Metrics, error) {
+	var metrics types.Metrics
+	if err := s.db.WithContext(ctx).
+		Where("cluster_id = ?", clusterID).
+		Order("timestamp DESC").
+		First(&metrics).Error; err != nil {
+		return nil, err
+	}
+	return &metrics, nil
+}
+
+// QueryMetricPoints lists the points of one stored resolution, optionally averaged
+// into buckets of filter.Step, ordered by series and time
+func (s *PostgresStore) QueryMetricPoints(ctx context.Context, filter MetricFilter) ([]*types.MetricPoint, error) {
+	query := s.db.WithContext(ctx).Model(&types.MetricPoint{}).
+		Where("cluster_id = ? AND resolution = ?", filter.ClusterID, filter.Resolution).
+		Where("timestamp >= ? AND timestamp < ?", filter.StartTime, filter.EndTime)
+
+	if len(filter.Names) > 0 {
+		query = query.Where("name IN ?", filter.Names)
+	}
+	if filter.Node != "" {
+		query = query.Where("node = ?", filter.Node)
+	}
+	if filter.Namespace != "" {
+		query = query.Where("namespace = ?", filter.Namespace)
+	}
+
+	var points []*types.MetricPoint
+	if filter.Step <= filter.Resolution {
+		if err := query.Order("name, node, namespace, timestamp").Find(&points).Error; err != nil {
+			return nil, err
+		}
+		return points, nil
+	}
+
+	step := filter.Step.Seconds()
+	err := query.
+		Select(`name, node, namespace,
+			to_timestamp(floor(extract(epoch from timestamp) / ?) * ?) AS timestamp,
+			SUM(value * sample_count) / SUM(sample_count) AS value,
+			MIN(min_value) AS min_value,
+			MAX(max_value) AS max_value,
+			SUM(sample_count) AS sample_count`, step, step).
+		Group("name, node, namespace, 4").
+		Order("name, node, namespace, 4").
+		Scan(&points).Error
+	if err != nil {
+		return nil, err
+	}
+	return points, nil
+}
+
+// MaxMetricPointID returns the highest point ID stored at a resolution, or 0 if there are none
+func (s *PostgresStore) MaxMetricPointID(ctx context.Context, resolution time.Duration) (uint64, error) {
+	var id *uint64
+	if err := s.db.WithContext(ctx).Model(&types.MetricPoint{}).
+		Where("resolution = ?", resolution).
+		Select("MAX(id)").
+		Scan(&id).Error; err != nil {
+		return 0, err
+	}
+	if id == nil {
+		return 0, nil
+	}
+	return *id, nil
+}
+
+// DownsampleMetricPoints recomputes the rollup buckets at resolution that contain raw
+// points with IDs in (afterID, uptoID], returning the number of buckets written
+func (s *PostgresStore) DownsampleMetricPoints(ctx context.Context, resolution time.Duration, afterID, uptoID uint64) (int64, error) {
+	result := s.db.WithContext(ctx).Exec(`
+		INSERT INTO metric_points
+			(cluster_id, name, node, namespace, resolution, timestamp, value, min_value, max_value, sample_count)
+		SELECT p.cluster_id, p.name, p.node, p.namespace, @resolution, b.bucket,
+			SUM(p.value * p.sample_count) / SUM(p.sample_count),
+			MIN(p.min_value), MAX(p.max_value), SUM(p.sample_count)
+		FROM metric_points p
+		JOIN (
+			SELECT DISTINCT cluster_id,
+				to_timestamp(floor(extract(epoch from timestamp) / @step) * @step) AS bucket
+			FROM metric_points
+			WHERE resolution = 0 AND id > @after AND id <= @upto
+		) b ON p.cluster_id = b.cluster_id
+			AND p.timestamp >= b.bucket
+			AND p.timestamp < b.bucket + make_interval(secs => @step)
+		WHERE p.resolution = 0
+		GROUP BY p.cluster_id, p.name, p.node, p.namespace, b.bucket
+		ON CONFLICT (cluster_id, name, node, namespace, resolution, timestamp) DO UPDATE SET
+			value = EXCLUDED.value,
+			min_value = EXCLUDED.min_value,
+			max_value = EXCLUDED.max_value,
+			sample_count = EXCLUDED.sample_count`,
+		map[string]interface{}{
+			"resolution": int64(resolution),
+			"step":       resolution.Seconds(),
+			"after":      afterID,
+			"upto":       uptoID,
+		})
+	return result.RowsAffected, result.Error
+}
+
+// DeleteMetricPointsBefore deletes the points of a resolution older than before
+func (s *PostgresStore) DeleteMetricPointsBefore(ctx context.Context, resolution time.Duration, before time.Time) (int64, error) {
+	result := s.db.WithContext(ctx).
+		Where("resolution = ? AND timestamp < ?", resolution, before).
+		Delete(&types.MetricPoint{})
+	return result.RowsAffected, result.Error
+}
+
+// DeleteMetricsBefore deletes metrics snapshots older than before
+func (s *PostgresStore) DeleteMetricsBefore(ctx context.Context, before time.Time) (int64, error) {
+	result := s.db.WithContext(ctx).
+		Where("timestamp < ?", before).
+		Delete(&types.Metrics{})
+	return result.RowsAffected, result.Error
+}
+
+// MetricFilter defines filters for metric point queries
+type MetricFilter struct {
+	ClusterID  string
+	Names      []string
+	Node       string
+	Namespace  string
+	StartTime  time.Time
+	EndTime    time.Time
+	Resolution time.Duration // stored resolution to read, 0 for raw points
+	Step       time.Duration // bucket width to average into, ignored unless coarser than Resolution
+}
+
 // Command operations
 
 // SaveCommand saves a command to the database
@@ -230,20 +392,79 @@ func (s *PostgresStore) UpdateCommandStatus(ctx context.Context, id string, stat
 		}).Error
 }
 
-// SaveCommandResult saves a command result
-func (s *PostgresStore) SaveCommandResult(ctx context.Context, result *types.CommandResult) error {
-	return s.db.WithContext(ctx).Create(result).Error
+// TransitionCommandStatus sets the command status only if it is currently one of from,
+// reporting whether the command was updated
+func (s *PostgresStore) TransitionCommandStatus(ctx context.Context, id string, from []types.CommandStatus, to types.CommandStatus) (bool, error) {
+	result := s.db.WithContext(ctx).Model(&types.Command{}).
+		Where("id = ? AND status IN ?", id, from).
+		Updates(map[string]interface{}{
+			"status":     to,
+			"updated_at": time.Now(),
+		})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// FinishCommand moves a command in one of from to status and saves its
+// result, in one transaction, reporting whether it did. The results of
+// commands no longer in from are saved as late results instead, leaving the
+// result of the command as it was.
+func (s *PostgresStore) FinishCommand(ctx context.Context, result *types.CommandResult, from []types.CommandStatus, to types.CommandStatus) (bool, error) {
+	finished := false
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		update := tx.Model(&types.Command{}).
+			Where("id = ? AND status IN ?", result.CommandID, from).
+			Updates(map[string]interface{}{
+				"status":     to,
+				"updated_at": time.Now(),
+			})
+		if update.Error != nil {
+			return update.Error
+		}
+
+		if update.RowsAffected == 0 {
+			return tx.Save(&types.LateCommandResult{CommandResult: *result, ReceivedAt: time.Now()}).Error
+		}
+		finished = true
+		return tx.Save(result).Error
+	})
+	if err != nil {
+		return false, err
+	}
+	return finished, nil
 }
 
-// GetCommandResult retrieves a command result
+// GetCommandResult retrieves a command result. Commands have a single result;
+// of the copies older versions may have stored, the first received is returned.
 func (s *PostgresStore) GetCommandResult(ctx context.Context, commandID string) (*types.CommandResult, error) {
 	var result types.CommandResult
-	if err := s.db.WithContext(ctx).First(&result, "command_id = ?", commandID).Error; err != nil {
+	if err := s.db.WithContext(ctx).Order("timestamp, id").First(&result, "command_id = ?", commandID).Error; err != nil {
 		return nil, err
 	}
 	return &result, nil
 }
 
+// SaveCommandOutput saves a chunk of command output, keeping the first copy
+// of a chunk received twice
+func (s *PostgresStore) SaveCommandOutput(ctx context.Context, chunk *types.CommandOutputChunk) error {
+	return s.db.WithContext(ctx).
+		Clauses(clause.OnConflict{DoNothing: true}).
+		Create(chunk).Error
+}
+
+// ListCommandOutput returns the output chunks of a command numbered after
+// afterSeq, in order
+func (s *PostgresStore) ListCommandOutput(ctx context.Context, commandID string, afterSeq int64) ([]*types.CommandOutputChunk, error) {
+	var chunks []*types.CommandOutputChunk
+	err := s.db.WithContext(ctx).
+		Where("command_id = ? AND seq > ?", commandID, afterSeq).
+		Order("seq").
+		Find(&chunks).Error
+	return chunks, err
+}
+
 // Cluster operations
 
 // SaveCluster saves a cluster to the database
@@ -300,4 +521,4 @@ func (s *PostgresStore) Health(ctx context.Context) error {
 		return err
 	}
 	return sqlDB.PingContext(ctx)
-}
\ No newline at end of file
+}
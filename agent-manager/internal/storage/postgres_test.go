@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"github.com/kart-io/k8s-agent/agent-manager/pkg/types"
+)
+
+// newTestPostgresStore connects to the database named by AGENT_MANAGER_TEST_POSTGRES_DSN.
+// Every test writes to its own cluster ID, which is deleted afterwards.
+func newTestPostgresStore(t *testing.T) (*PostgresStore, string) {
+	dsn := os.Getenv("AGENT_MANAGER_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("AGENT_MANAGER_TEST_POSTGRES_DSN is not set")
+	}
+
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("failed to connect to database: %v", err)
+	}
+	store := &PostgresStore{db: db, logger: zap.NewNop()}
+	if err := store.migrate(); err != nil {
+		t.Fatalf("failed to migrate database: %v", err)
+	}
+
+	clusterID := fmt.Sprintf("test-%d", time.Now().UnixNano())
+	t.Cleanup(func() {
+		for _, model := range []interface{}{&types.MetricPoint{}, &types.Command{}, &types.CommandResult{}, &types.LateCommandResult{}} {
+			db.Where("cluster_id = ?", clusterID).Delete(model)
+		}
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return store, clusterID
+}
+
+// savePoints stores raw points and returns the highest raw point ID
+func savePoints(t *testing.T, store *PostgresStore, points ...*types.MetricPoint) uint64 {
+	if err := store.db.Create(points).Error; err != nil {
+		t.Fatalf("failed to save points: %v", err)
+	}
+	id, err := store.MaxMetricPointID(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("MaxMetricPointID failed: %v", err)
+	}
+	return id
+}
+
+func TestMetricPointBuckets(t *testing.T) {
+	store, clusterID := newTestPostgresStore(t)
+	ctx := context.Background()
+	t0 := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	raw := func(offset time.Duration, node string, value float64) *types.MetricPoint {
+		return &types.MetricPoint{
+			ClusterID: clusterID,
+			Name:      "node_cpu",
+			Node:      node,
+			Timestamp: t0.Add(offset),
+			Value:     value,
+			Min:       value,
+			Max:       value,
+			Count:     1,
+		}
+	}
+	query := func(resolution, step time.Duration) []*types.MetricPoint {
+		points, err := store.QueryMetricPoints(ctx, MetricFilter{
+			ClusterID:  clusterID,
+			Names:      []string{"node_cpu"},
+			Node:       "node-1",
+			StartTime:  t0,
+			EndTime:    t0.Add(time.Hour),
+			Resolution: resolution,
+			Step:       step,
+		})
+		if err != nil {
+			t.Fatalf("QueryMetricPoints failed: %v", err)
+		}
+		return points
+	}
+	check := func(what string, points []*types.MetricPoint, want []types.MetricPoint) {
+		t.Helper()
+		if len(points) != len(want) {
+			t.Fatalf("%s: got %d points, want %d", what, len(points), len(want))
+		}
+		for i, p := range points {
+			w := want[i]
+			if !p.Timestamp.Equal(w.Timestamp) || p.Value != w.Value || p.Min != w.Min || p.Max != w.Max || p.Count != w.Count {
+				t.Errorf("%s: point %d = %v %v [%v, %v] x%d, want %v %v [%v, %v] x%d", what, i,
+					p.Timestamp.UTC(), p.Value, p.Min, p.Max, p.Count,
+					w.Timestamp, w.Value, w.Min, w.Max, w.Count)
+			}
+		}
+	}
+
+	upto := savePoints(t, store,
+		raw(0, "node-1", 1),
+		raw(time.Minute, "node-1", 2),
+		raw(4*time.Minute, "node-1", 3),
+		raw(5*time.Minute, "node-1", 10),
+		raw(0, "node-2", 100),
+	)
+
+	buckets, err := store.DownsampleMetricPoints(ctx, 5*time.Minute, 0, upto)
+	if err != nil {
+		t.Fatalf("DownsampleMetricPoints failed: %v", err)
+	}
+	if buckets != 3 {
+		t.Errorf("wrote %d buckets, want 3", buckets)
+	}
+	check("5m rollup", query(5*time.Minute, 5*time.Minute), []types.MetricPoint{
+		{Timestamp: t0, Value: 2, Min: 1, Max: 3, Count: 3},
+		{Timestamp: t0.Add(5 * time.Minute), Value: 10, Min: 10, Max: 10, Count: 1},
+	})
+
+	// A late point only recomputes the bucket it falls into
+	previous := upto
+	upto = savePoints(t, store, raw(2*time.Minute, "node-1", 6))
+	if buckets, err = store.DownsampleMetricPoints(ctx, 5*time.Minute, previous, upto); err != nil {
+		t.Fatalf("DownsampleMetricPoints failed: %v", err)
+	}
+	if buckets != 2 {
+		t.Errorf("wrote %d buckets, want 2 (both series of the cluster share the bucket)", buckets)
+	}
+	check("5m rollup after a late point", query(5*time.Minute, 5*time.Minute), []types.MetricPoint{
+		{Timestamp: t0, Value: 3, Min: 1, Max: 6, Count: 4},
+		{Timestamp: t0.Add(5 * time.Minute), Value: 10, Min: 10, Max: 10, Count: 1},
+	})
+
+	// Raw points in time order, and averaged into wider buckets from either tier
+	check("raw", query(0, 0), []types.MetricPoint{
+		{Timestamp: t0, Value: 1, Min: 1, Max: 1, Count: 1},
+		{Timestamp: t0.Add(time.Minute), Value: 2, Min: 2, Max: 2, Count: 1},
+		{Timestamp: t0.Add(2 * time.Minute), Value: 6, Min: 6, Max: 6, Count: 1},
+		{Timestamp: t0.Add(4 * time.Minute), Value: 3, Min: 3, Max: 3, Count: 1},
+		{Timestamp: t0.Add(5 * time.Minute), Value: 10, Min: 10, Max: 10, Count: 1},
+	})
+	want := []types.MetricPoint{{Timestamp: t0, Value: 4.4, Min: 1, Max: 10, Count: 5}}
+	check("raw in 10m buckets", query(0, 10*time.Minute), want)
+	check("5m rollup in 10m buckets", query(5*time.Minute, 10*time.Minute), want)
+}
+
+func TestFinishCommandKeepsLateResults(t *testing.T) {
+	store, clusterID := newTestPostgresStore(t)
+	ctx := context.Background()
+	active := []types.CommandStatus{types.CommandStatusPending, types.CommandStatusSent, types.CommandStatusExecuting}
+
+	cmd := &types.Command{ID: clusterID + "-cmd", ClusterID: clusterID, Status: types.CommandStatusExecuting}
+	if err := store.SaveCommand(ctx, cmd); err != nil {
+		t.Fatalf("SaveCommand failed: %v", err)
+	}
+	result := func(id, status string) *types.CommandResult {
+		return &types.CommandResult{ID: clusterID + "-" + id, CommandID: cmd.ID, ClusterID: clusterID, Status: status, Timestamp: time.Now()}
+	}
+
+	finished, err := store.FinishCommand(ctx, result("timeout", "timeout"), active, types.CommandStatusTimeout)
+	if err != nil || !finished {
+		t.Fatalf("FinishCommand = %v, %v, want the command finished", finished, err)
+	}
+	finished, err = store.FinishCommand(ctx, result("success", "success"), active, types.CommandStatusCompleted)
+	if err != nil || finished {
+		t.Fatalf("FinishCommand = %v, %v, want a late result", finished, err)
+	}
+
+	stored, err := store.GetCommand(ctx, cmd.ID)
+	if err != nil {
+		t.Fatalf("GetCommand failed: %v", err)
+	}
+	if stored.Status != types.CommandStatusTimeout {
+		t.Errorf("status = %s, want timeout", stored.Status)
+	}
+	if got, err := store.GetCommandResult(ctx, cmd.ID); err != nil || got.Status != "timeout" {
+		t.Errorf("result = %v, %v, want the timeout result", got, err)
+	}
+
+	var late []types.LateCommandResult
+	if err := store.db.Where("command_id = ?", cmd.ID).Find(&late).Error; err != nil {
+		t.Fatalf("failed to list late results: %v", err)
+	}
+	if len(late) != 1 || late[0].Status != "success" {
+		t.Errorf("late results = %+v, want the success result", late)
+	}
+}
@@ -1,6 +1,7 @@
 package types
 
 import (
+	"encoding/json"
 	"time"
 )
 
@@ -17,6 +18,7 @@ type Agent struct {
 	Metadata        map[string]interface{} `json:"metadata" gorm:"type:jsonb"`
 	Capabilities    []string               `json:"capabilities" gorm:"type:jsonb"`
 	ConnectionInfo  *ConnectionInfo        `json:"connection_info" gorm:"type:jsonb"`
+	Health          *AgentHealth           `json:"health,omitempty" gorm:"serializer:json;type:jsonb"`
 }
 
 // AgentStatus represents the status of an agent
@@ -37,6 +39,53 @@ type ConnectionInfo struct {
 	ReconnectCount int      `json:"reconnect_count"`
 }
 
+// AgentHealth is the latest health report received in an agent heartbeat
+type AgentHealth struct {
+	Status        string                     `json:"status"` // healthy, degraded
+	ReportedAt    time.Time                  `json:"reported_at"`
+	UptimeSeconds int                        `json:"uptime_seconds"`
+	QueueSizes    map[string]int             `json:"queue_sizes"`
+	Dropped       map[string]int64           `json:"dropped"`
+	SpoolDepth    int64                      `json:"spool_depth"`
+	SpoolBytes    int64                      `json:"spool_bytes"`
+	Reconnects    int64                      `json:"reconnects"`
+	Components    map[string]ComponentHealth `json:"components"`
+	Commands      *AgentCommands             `json:"commands,omitempty"`
+}
+
+// AgentCommands describes the commands an agent is running and those waiting
+// for one of its workers, in the order they will run
+type AgentCommands struct {
+	Workers   int                 `json:"workers"`
+	Running   []AgentCommandState `json:"running"`
+	Queued    []AgentCommandState `json:"queued"`
+	Cancelled int64               `json:"cancelled"`
+}
+
+// AgentCommandState is a command waiting or running on an agent
+type AgentCommandState struct {
+	CommandID string    `json:"command_id"`
+	Tool      string    `json:"tool"`
+	Action    string    `json:"action,omitempty"`
+	Priority  int       `json:"priority"`
+	Since     time.Time `json:"since"`
+}
+
+// Agent health status values
+const (
+	AgentHealthHealthy  = "healthy"
+	AgentHealthDegraded = "degraded"
+)
+
+// ComponentHealth describes the state of a single agent component
+type ComponentHealth struct {
+	Healthy       bool       `json:"healthy"`
+	Synced        *bool      `json:"synced,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorTime *time.Time `json:"last_error_time,omitempty"`
+	ErrorCount    int64      `json:"error_count"`
+}
+
 // Event represents a Kubernetes event
 type Event struct {
 	ID        string                 `json:"id" gorm:"primaryKey"`
@@ -58,10 +107,51 @@ type Metrics struct {
 	ID               string                 `json:"id" gorm:"primaryKey"`
 	ClusterID        string                 `json:"cluster_id" gorm:"index;not null"`
 	Timestamp        time.Time              `json:"timestamp" gorm:"index"`
-	ClusterMetrics   map[string]interface{} `json:"cluster_metrics" gorm:"type:jsonb"`
-	NodeMetrics      []map[string]interface{} `json:"node_metrics" gorm:"type:jsonb"`
-	PodMetrics       []map[string]interface{} `json:"pod_metrics" gorm:"type:jsonb"`
-	NamespaceMetrics []map[string]interface{} `json:"namespace_metrics" gorm:"type:jsonb"`
+	ClusterMetrics   map[string]interface{} `json:"cluster_metrics" gorm:"serializer:json;type:jsonb"`
+	NodeMetrics      []map[string]interface{} `json:"node_metrics" gorm:"serializer:json;type:jsonb"`
+	PodMetrics       []map[string]interface{} `json:"pod_metrics" gorm:"serializer:json;type:jsonb"`
+	NamespaceMetrics []map[string]interface{} `json:"namespace_metrics" gorm:"serializer:json;type:jsonb"`
+}
+
+// MetricSample is a single numeric value extracted from a metrics snapshot
+type MetricSample struct {
+	Name      string  `json:"name"`
+	Node      string  `json:"node,omitempty"`
+	Namespace string  `json:"namespace,omitempty"`
+	Value     float64 `json:"value"`
+}
+
+// MetricPoint is a stored time-series value. Raw points have a zero resolution;
+// downsampled points aggregate all raw samples in [Timestamp, Timestamp+Resolution).
+type MetricPoint struct {
+	ID         uint64        `json:"-" gorm:"primaryKey;autoIncrement"`
+	ClusterID  string        `json:"cluster_id" gorm:"uniqueIndex:idx_metric_points_series;not null"`
+	Name       string        `json:"name" gorm:"uniqueIndex:idx_metric_points_series;not null"`
+	Node       string        `json:"node,omitempty" gorm:"uniqueIndex:idx_metric_points_series;not null;default:''"`
+	Namespace  string        `json:"namespace,omitempty" gorm:"uniqueIndex:idx_metric_points_series;not null;default:''"`
+	Resolution time.Duration `json:"resolution" gorm:"uniqueIndex:idx_metric_points_series;index:idx_metric_points_retention,priority:1;not null"`
+	Timestamp  time.Time     `json:"timestamp" gorm:"uniqueIndex:idx_metric_points_series;index:idx_metric_points_retention,priority:2;not null"`
+	Value      float64       `json:"value"`
+	Min        float64       `json:"min" gorm:"column:min_value"`
+	Max        float64       `json:"max" gorm:"column:max_value"`
+	Count      int64         `json:"count" gorm:"column:sample_count"`
+}
+
+// MetricSeries is a queried time series for one metric name and label set
+type MetricSeries struct {
+	Name      string        `json:"name"`
+	Node      string        `json:"node,omitempty"`
+	Namespace string        `json:"namespace,omitempty"`
+	Points    []MetricValue `json:"points"`
+}
+
+// MetricValue is a single point of a queried time series
+type MetricValue struct {
+	Timestamp time.Time `json:"timestamp"`
+	Value     float64   `json:"value"`
+	Min       float64   `json:"min"`
+	Max       float64   `json:"max"`
+	Count     int64     `json:"count"`
 }
 
 // Command represents a command to be executed
@@ -72,8 +162,11 @@ type Command struct {
 	Tool          string                 `json:"tool"`
 	Action        string                 `json:"action"`
 	Args          []string               `json:"args" gorm:"type:jsonb"`
+	Params        map[string]string      `json:"params,omitempty" gorm:"serializer:json;type:jsonb"`
+	Env           map[string]string      `json:"env,omitempty" gorm:"-"` // never sent; commands setting it are refused
 	Namespace     string                 `json:"namespace"`
 	Timeout       time.Duration          `json:"timeout"`
+	Priority      int                    `json:"priority"` // higher runs first among the commands waiting on the agent
 	IssuedBy      string                 `json:"issued_by"`
 	CorrelationID string                 `json:"correlation_id" gorm:"index"`
 	Status        CommandStatus          `json:"status" gorm:"index"`
@@ -92,6 +185,8 @@ const (
 	CommandStatusCompleted CommandStatus = "completed"
 	CommandStatusFailed    CommandStatus = "failed"
 	CommandStatusTimeout   CommandStatus = "timeout"
+	CommandStatusRejected  CommandStatus = "rejected"  // refused by the agent, whose signature check failed
+	CommandStatusCancelled CommandStatus = "cancelled" // cancelled on request or by timeout while waiting or running
 )
 
 // CommandResult represents the result of a command execution
@@ -100,11 +195,50 @@ type CommandResult struct {
 	CommandID     string        `json:"command_id" gorm:"index;not null"`
 	ClusterID     string        `json:"cluster_id" gorm:"index"`
 	Status        string        `json:"status"`
-	ExitCode      int           `json:"exit_code"`
+	ExitCode      *int          `json:"exit_code"` // null when no process exited
 	Output        string        `json:"output" gorm:"type:text"`
 	Error         string        `json:"error" gorm:"type:text"`
 	ExecutionTime time.Duration `json:"execution_time"`
 	Timestamp     time.Time     `json:"timestamp" gorm:"index"`
+
+	// Stdout and Stderr are kept apart from Output, which interleaves them,
+	// with the number of bytes written to each and whether the agent
+	// truncated them
+	Stdout          string `json:"stdout" gorm:"type:text"`
+	Stderr          string `json:"stderr" gorm:"type:text"`
+	StdoutBytes     int64  `json:"stdout_bytes"`
+	StderrBytes     int64  `json:"stderr_bytes"`
+	StdoutTruncated bool   `json:"stdout_truncated"`
+	StderrTruncated bool   `json:"stderr_truncated"`
+
+	// OutputChunks is the number of output chunks the agent streamed while
+	// the command ran, stored as CommandOutputChunk
+	OutputChunks int64 `json:"output_chunks,omitempty"`
+
+	// Data is the structured output of kubectl commands, which agents answer
+	// through the Kubernetes API, or the protocol.KubeAPIStatus of those the
+	// API failed
+	Data json.RawMessage `json:"data,omitempty" gorm:"serializer:json;type:jsonb"`
+}
+
+// LateCommandResult is a result received once its command had finished, such
+// as the rejection of a replayed command or the result of a command that
+// timed out in agent-manager. It is kept for auditing and never replaces the
+// result of the command.
+type LateCommandResult struct {
+	CommandResult `gorm:"embedded"`
+	ReceivedAt    time.Time `json:"received_at"`
+}
+
+// CommandOutputChunk is a numbered piece of the output of a command, streamed
+// by the agent while it runs
+type CommandOutputChunk struct {
+	CommandID string    `json:"command_id" gorm:"primaryKey"`
+	Seq       int64     `json:"seq" gorm:"primaryKey;autoIncrement:false"`
+	ClusterID string    `json:"cluster_id" gorm:"index"`
+	Stream    string    `json:"stream"` // stdout or stderr
+	Data      string    `json:"data" gorm:"type:text"`
+	Timestamp time.Time `json:"timestamp"`
 }
 
 // Cluster represents a managed Kubernetes cluster
@@ -226,6 +360,10 @@ type Config struct {
 	Redis    RedisConfig    `yaml:"redis"`
 	Logging  LoggingConfig  `yaml:"logging"`
 	Metrics  MetricsConfig  `yaml:"metrics"`
+
+	TimeSeries     TimeSeriesConfig     `yaml:"timeseries"`
+	RemoteWrite    RemoteWriteConfig    `yaml:"remote_write"`
+	CommandSigning CommandSigningConfig `yaml:"command_signing"`
 }
 
 // ServerConfig represents server configuration
@@ -239,13 +377,26 @@ type ServerConfig struct {
 
 // NATSConfig represents NATS configuration
 type NATSConfig struct {
-	URL             string        `yaml:"url"`
-	ClusterID       string        `yaml:"cluster_id"`
-	MaxReconnect    int           `yaml:"max_reconnect"`
-	ReconnectWait   time.Duration `yaml:"reconnect_wait"`
-	PingInterval    time.Duration `yaml:"ping_interval"`
-	MaxPingsOut     int           `yaml:"max_pings_out"`
-	EnableJetStream bool          `yaml:"enable_jetstream"`
+	URL             string          `yaml:"url"`
+	ClusterID       string          `yaml:"cluster_id"`
+	MaxReconnect    int             `yaml:"max_reconnect"`
+	ReconnectWait   time.Duration   `yaml:"reconnect_wait"`
+	PingInterval    time.Duration   `yaml:"ping_interval"`
+	MaxPingsOut     int             `yaml:"max_pings_out"`
+	EnableJetStream bool            `yaml:"enable_jetstream"`
+	JetStream       JetStreamConfig `yaml:"jetstream"`
+}
+
+// JetStreamConfig represents durable delivery settings for agent traffic
+type JetStreamConfig struct {
+	Replicas         int           `yaml:"replicas"`
+	MaxAge           time.Duration `yaml:"max_age"`
+	MaxBytes         int64         `yaml:"max_bytes"`
+	AckWait          time.Duration `yaml:"ack_wait"`
+	MaxDeliver       int           `yaml:"max_deliver"`
+	MaxAckPending    int           `yaml:"max_ack_pending"`
+	DeadLetterMaxAge time.Duration `yaml:"dead_letter_max_age"`
+	DurablePrefix    string        `yaml:"durable_prefix"`
 }
 
 // DatabaseConfig represents database configuration
@@ -285,4 +436,44 @@ type MetricsConfig struct {
 	Enabled bool   `yaml:"enabled"`
 	Path    string `yaml:"path"`
 	Port    int    `yaml:"port"`
-}
\ No newline at end of file
+}
+
+// TimeSeriesConfig represents storage, retention and downsampling of agent metrics
+type TimeSeriesConfig struct {
+	SnapshotRetention  time.Duration  `yaml:"snapshot_retention"`
+	RawRetention       time.Duration  `yaml:"raw_retention"`
+	Rollups            []RollupConfig `yaml:"rollups"`
+	DownsampleInterval time.Duration  `yaml:"downsample_interval"`
+	MaxPoints          int            `yaml:"max_points"`
+}
+
+// RemoteWriteConfig represents forwarding of agent metrics to a Prometheus remote-write endpoint
+type RemoteWriteConfig struct {
+	Enabled        bool              `yaml:"enabled"`
+	URL            string            `yaml:"url"`
+	Timeout        time.Duration     `yaml:"timeout"`
+	Headers        map[string]string `yaml:"headers"`
+	ExternalLabels map[string]string `yaml:"external_labels"`
+	MetricPrefix   string            `yaml:"metric_prefix"`
+	QueueSize      int               `yaml:"queue_size"`
+	BatchSize      int               `yaml:"batch_size"`
+	FlushInterval  time.Duration     `yaml:"flush_interval"`
+	MaxRetries     int               `yaml:"max_retries"`
+	MinBackoff     time.Duration     `yaml:"min_backoff"`
+	MaxBackoff     time.Duration     `yaml:"max_backoff"`
+}
+
+// CommandSigningConfig represents the Ed25519 key commands are signed with
+type CommandSigningConfig struct {
+	Enabled        bool          `yaml:"enabled"`
+	KeyID          string        `yaml:"key_id"`           // identifies the key to agents
+	PrivateKey     string        `yaml:"private_key"`      // base64 key or seed
+	PrivateKeyFile string        `yaml:"private_key_file"` // file holding the base64 key, instead of private_key
+	TTL            time.Duration `yaml:"ttl"`              // how long a signed command stays valid
+}
+
+// RollupConfig represents a downsampled resolution and how long it is kept
+type RollupConfig struct {
+	Resolution time.Duration `yaml:"resolution"`
+	Retention  time.Duration `yaml:"retention"`
+}
@@ -2,35 +2,54 @@ package agent
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
+	metricsclient "k8s.io/metrics/pkg/client/clientset/versioned"
 
+	"github.com/kart-io/k8s-agent/protocol"
+
+	"github.com/kart/k8s-agent/collect-agent/internal/remediation"
+	"github.com/kart/k8s-agent/collect-agent/internal/spool"
 	"github.com/kart/k8s-agent/collect-agent/internal/types"
 	"github.com/kart/k8s-agent/collect-agent/internal/utils"
 )
 
-// Agent represents the main collect agent that coordinates all components
+// Agent coordinates the components collecting from and executing commands in
+// one cluster. The agents of a process share the NATS connection.
 type Agent struct {
-	config     *types.AgentConfig
-	clusterID  string
-	clientset  kubernetes.Interface
-	logger     *zap.Logger
+	config        *types.AgentConfig
+	clusterID     string
+	clientset     kubernetes.Interface
+	dynamicClient dynamic.Interface
+	metricsClient metricsclient.Interface
+	kubeletClient kubeletClient
+	kubeSource    string
+	logger        *zap.Logger
+
+	// informers are shared by the state watcher and metrics collector
+	informers *sharedInformers
 
 	// Components
 	eventWatcher         *EventWatcher
+	stateWatcher         *StateWatcher
 	metricsCollector     *MetricsCollector
 	commandExecutor      *CommandExecutor
+	commandVerifier      *commandVerifier
+	commandPool          *commandPool
 	communicationManager *CommunicationManager
+	spool                *spool.Spool
 
 	// Channels for inter-component communication
 	eventChan   chan *types.Event
 	metricsChan chan *types.Metrics
-	commandChan chan *types.Command
 	resultChan  chan *types.CommandResult
 
 	// Control
@@ -39,22 +58,33 @@ type Agent struct {
 	running bool
 	mu      sync.RWMutex
 
+	// commandsMu is read-held by the command handler, which NATS runs
+	// outside wg; Stop takes it to refuse commands before it stops the pool
+	// and closes the channels the handler writes to
+	commandsMu      sync.RWMutex
+	commandsStopped bool
+
 	// Metrics
-	startTime time.Time
+	startTime       time.Time
+	commandsDropped atomic.Int64
+	resultsDropped  atomic.Int64
+	metrics         *agentMetrics
 }
 
-// New creates a new Agent instance
-func New(config *types.AgentConfig, logger *zap.Logger) (*Agent, error) {
-	// Create Kubernetes clientset
-	kubeConfig, err := rest.InClusterConfig()
+// New creates the agent of the cluster described by config.ClusterID and
+// config.Kubernetes, communicating over conn
+func New(config *types.AgentConfig, conn *Connection, logger *zap.Logger) (*Agent, error) {
+	// Create Kubernetes clients
+	clients, err := newKubeClient(config)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create in-cluster config: %w", err)
+		return nil, err
 	}
+	clientset := clients.clientset
 
-	clientset, err := kubernetes.NewForConfig(kubeConfig)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create kubernetes clientset: %w", err)
-	}
+	logger.Info("Kubernetes client configured",
+		zap.String("source", clients.source),
+		zap.String("kubeconfig", config.Kubernetes.Kubeconfig),
+		zap.String("context", config.Kubernetes.Context))
 
 	// Detect cluster ID if not provided
 	clusterID := config.ClusterID
@@ -68,22 +98,46 @@ func New(config *types.AgentConfig, logger *zap.Logger) (*Agent, error) {
 	}
 
 	agent := &Agent{
-		config:    config,
-		clusterID: clusterID,
-		clientset: clientset,
-		logger:    logger.With(zap.String("cluster_id", clusterID)),
+		config:        config,
+		clusterID:     clusterID,
+		clientset:     clientset,
+		dynamicClient: clients.dynamic,
+		metricsClient: clients.metrics,
+		kubeletClient: clients.kubelet,
+		kubeSource:    clients.source,
+		logger:        logger.With(zap.String("cluster_id", clusterID)),
 
 		eventChan:   make(chan *types.Event, config.BufferSize),
 		metricsChan: make(chan *types.Metrics, 100),
-		commandChan: make(chan *types.Command, 100),
 		resultChan:  make(chan *types.CommandResult, 100),
 
 		stopCh:    make(chan struct{}),
 		startTime: time.Now(),
+		metrics:   newAgentMetrics(),
+	}
+
+	// Open the on-disk spool used while the central endpoint is unreachable.
+	// Clusters of a multi-cluster agent spool to their own subdirectory.
+	if config.Spool.Enabled {
+		spoolDir := config.Spool.Dir
+		if len(config.Clusters) > 0 {
+			spoolDir = filepath.Join(spoolDir, clusterID)
+		}
+
+		agent.spool, err = spool.Open(spool.Options{
+			Dir:             spoolDir,
+			MaxSegmentBytes: config.Spool.MaxSegmentBytes,
+			MaxTotalBytes:   config.Spool.MaxTotalBytes,
+			MaxAge:          config.Spool.MaxAge,
+			Sync:            config.Spool.Sync,
+		}, agent.logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open spool: %w", err)
+		}
 	}
 
 	// Initialize components
-	if err := agent.initializeComponents(); err != nil {
+	if err := agent.initializeComponents(conn); err != nil {
 		return nil, fmt.Errorf("failed to initialize components: %w", err)
 	}
 
@@ -91,35 +145,92 @@ func New(config *types.AgentConfig, logger *zap.Logger) (*Agent, error) {
 }
 
 // initializeComponents initializes all agent components
-func (a *Agent) initializeComponents() error {
+func (a *Agent) initializeComponents(conn *Connection) error {
 	// Initialize event watcher
 	if a.config.EnableEvents {
 		a.eventWatcher = NewEventWatcher(a.clientset, a.clusterID, a.eventChan, a.logger)
+		a.eventWatcher.metrics = a.metrics
+		a.eventWatcher.SetAPI(a.config.EventWatch.API)
+		if a.config.EventWatch.StateDir != "" {
+			a.eventWatcher.SetStateFile(eventStateFile(a.config.EventWatch.StateDir, a.clusterID))
+		}
+		a.eventWatcher.SetDeduplication(a.config.EventDedup.Window, a.config.EventDedup.MaxEntries)
+	}
+
+	if a.config.StateWatch.Enabled || a.config.EnableMetrics {
+		a.informers = newSharedInformers(a.clientset)
+	}
+
+	// Initialize state watcher
+	if a.config.StateWatch.Enabled {
+		a.stateWatcher = NewStateWatcher(a.informers, a.clusterID, a.eventChan, a.config.StateWatch.PendingThreshold, a.logger)
+		a.stateWatcher.metrics = a.metrics
 	}
 
 	// Initialize metrics collector
 	if a.config.EnableMetrics {
-		a.metricsCollector = NewMetricsCollector(a.clientset, a.clusterID, a.metricsChan, a.logger)
+		a.metricsCollector = NewMetricsCollector(a.clientset, a.informers, a.clusterID, a.metricsChan, a.logger)
+		a.metricsCollector.metrics = a.metrics
+		a.metricsCollector.SetFullSnapshotInterval(a.config.FullSnapshotEvery)
+		a.metricsCollector.SetMetricsClient(a.metricsClient)
+		if a.config.KubeletStats.Enabled {
+			a.metricsCollector.SetKubeletStats(a.kubeletClient, a.config.KubeletStats)
+		}
 	}
 
 	// Initialize command executor
 	a.commandExecutor = NewCommandExecutor(a.clientset, a.clusterID, a.logger)
+	a.commandExecutor.metrics = a.metrics
+	a.commandExecutor.SetDynamicClient(a.dynamicClient)
+	a.commandExecutor.SetMetricsClient(a.metricsClient)
+	if a.config.Remediation.Enabled {
+		// The policy is read again for each command; check it once up front
+		if _, err := remediation.Load(a.config.Remediation.PolicyFile); err != nil {
+			return fmt.Errorf("failed to enable remediation: %w", err)
+		}
+		a.commandExecutor.SetRemediationPolicy(a.config.Remediation.PolicyFile)
+	}
+	a.commandPool = newCommandPool(a.clusterID, a.config.CommandPool, a.runCommand, a.queueResult, a.logger)
+
+	// Verify command signatures if configured
+	if a.config.CommandSigning.Enabled {
+		verifier, err := newCommandVerifier(a.clusterID, a.config.CommandSigning)
+		if err != nil {
+			return fmt.Errorf("failed to create command verifier: %w", err)
+		}
+		a.commandVerifier = verifier
+	}
 
 	// Initialize communication manager
 	a.communicationManager = NewCommunicationManager(
 		a.config,
 		a.clusterID,
+		conn,
 		a.eventChan,
 		a.metricsChan,
 		a.resultChan,
 		a.handleCommand,
+		a.spool,
 		a.logger,
 	)
+	a.communicationManager.SetStatusProvider(a.GetStatus)
+	a.commandExecutor.SetOutputPublisher(a.communicationManager.PublishCommandOutput)
+	a.communicationManager.metrics = a.metrics
+
+	// Spill events to the spool instead of dropping them when the queue is full
+	if a.spool != nil {
+		if a.eventWatcher != nil {
+			a.eventWatcher.SetOverflowHandler(a.communicationManager.SpoolEvent)
+		}
+		if a.stateWatcher != nil {
+			a.stateWatcher.SetOverflowHandler(a.communicationManager.SpoolEvent)
+		}
+	}
 
 	return nil
 }
 
-// Start starts the agent and all its components
+// Start starts the agent and all its components and returns once they are running
 func (a *Agent) Start(ctx context.Context) error {
 	a.mu.Lock()
 	if a.running {
@@ -147,6 +258,18 @@ func (a *Agent) Start(ctx context.Context) error {
 		}
 	}
 
+	// Start state watcher
+	if a.stateWatcher != nil {
+		if err := a.stateWatcher.Start(ctx); err != nil {
+			return fmt.Errorf("failed to start state watcher: %w", err)
+		}
+	}
+
+	// Start the informers once the components have registered their handlers
+	if a.informers != nil {
+		a.informers.Start(a.stopCh)
+	}
+
 	// Start metrics collector
 	if a.metricsCollector != nil {
 		a.wg.Add(1)
@@ -156,36 +279,56 @@ func (a *Agent) Start(ctx context.Context) error {
 		}()
 	}
 
-	// Start command processor
-	a.wg.Add(1)
-	go a.processCommands(ctx)
+	// Keep events flowing through the fake cluster in dev mode
+	if a.kubeSource == kubeSourceDev {
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+			runDevEvents(ctx, a.clientset, devEventPeriod, a.stopCh, a.logger)
+		}()
+	}
 
 	a.logger.Info("Collect agent started successfully")
-
-	// Wait for context cancellation
-	<-ctx.Done()
-	return a.Stop()
+	return nil
 }
 
 // Stop stops the agent and all its components
 func (a *Agent) Stop() error {
 	a.mu.Lock()
-	defer a.mu.Unlock()
-
 	if !a.running {
+		a.mu.Unlock()
 		return nil
 	}
+	a.running = false
+	a.mu.Unlock()
 
+	// Components are stopped without holding a.mu because the heartbeat
+	// handler reads the agent status while shutting down
 	a.logger.Info("Stopping collect agent")
 
 	// Signal all goroutines to stop
 	close(a.stopCh)
 
+	// Wait for the commands being handled and refuse the next ones
+	a.commandsMu.Lock()
+	a.commandsStopped = true
+	a.commandsMu.Unlock()
+
+	// Cancel the queued and running commands; the communication manager
+	// publishes their results as it stops
+	if a.commandPool != nil {
+		a.commandPool.close()
+	}
+
 	// Stop components
 	if a.eventWatcher != nil {
 		a.eventWatcher.Stop()
 	}
 
+	if a.stateWatcher != nil {
+		a.stateWatcher.Stop()
+	}
+
 	if a.metricsCollector != nil {
 		a.metricsCollector.Stop()
 	}
@@ -194,94 +337,209 @@ func (a *Agent) Stop() error {
 		a.communicationManager.Stop()
 	}
 
+	if a.informers != nil {
+		a.informers.Shutdown()
+	}
+
+	if a.spool != nil {
+		if err := a.spool.Close(); err != nil {
+			a.logger.Error("Failed to close spool", zap.Error(err))
+		}
+	}
+
 	// Wait for all goroutines to finish
 	a.wg.Wait()
 
 	// Close channels
 	close(a.eventChan)
 	close(a.metricsChan)
-	close(a.commandChan)
 	close(a.resultChan)
 
-	a.running = false
 	a.logger.Info("Collect agent stopped")
 
 	return nil
 }
 
-// handleCommand handles incoming commands from the communication manager
+// handleCommand handles incoming commands from the communication manager.
+// Commands failing signature verification are rejected before they are queued,
+// and cancel commands are applied to the pool rather than queued. Commands
+// coming in while the agent stops are dropped; agent-manager times them out.
 func (a *Agent) handleCommand(cmd *types.Command) {
-	select {
-	case a.commandChan <- cmd:
-		a.logger.Debug("Command queued for processing", zap.String("command_id", cmd.ID))
+	a.commandsMu.RLock()
+	defer a.commandsMu.RUnlock()
+	if a.commandsStopped {
+		a.logger.Debug("Agent stopping, dropping command", zap.String("command_id", cmd.ID))
+		return
+	}
+
+	if a.commandVerifier != nil {
+		if err := a.commandVerifier.verify(cmd); err != nil {
+			a.rejectCommand(cmd, err)
+			return
+		}
+	}
+
+	if cmd.Type == protocol.CommandTypeCancel {
+		a.cancelCommand(cmd)
+		return
+	}
+
+	err := a.commandPool.submit(cmd)
+	switch {
+	case err == nil:
+		a.logger.Debug("Command queued for processing",
+			zap.String("command_id", cmd.ID),
+			zap.Int("priority", cmd.Priority))
+	case errors.Is(err, errCommandDuplicate):
+		// Redelivered while the first delivery is pending; it reports the result
+		a.logger.Debug("Ignoring duplicate command", zap.String("command_id", cmd.ID))
 	default:
-		a.logger.Warn("Command channel full, dropping command", zap.String("command_id", cmd.ID))
+		a.commandsDropped.Add(1)
+		a.logger.Warn("Command refused", zap.String("command_id", cmd.ID), zap.Error(err))
+		a.queueResult(&types.CommandResult{
+			CommandID: cmd.ID,
+			ClusterID: a.clusterID,
+			Status:    protocol.CommandStatusFailed,
+			Error:     fmt.Sprintf("Command refused: %v", err),
+			Timestamp: time.Now(),
+		})
 	}
 }
 
-// processCommands processes commands from the command channel
-func (a *Agent) processCommands(ctx context.Context) {
-	defer a.wg.Done()
+// cancelCommand cancels the command named by a cancel command, whether it
+// waits or runs
+func (a *Agent) cancelCommand(cmd *types.Command) {
+	target := cmd.Params[protocol.CommandParamCommandID]
+	reason := cmd.Params[protocol.CommandParamReason]
+	if reason == "" {
+		reason = "cancelled by agent-manager"
+	}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-a.stopCh:
-			return
-		case cmd := <-a.commandChan:
-			if cmd == nil {
-				continue
-			}
-
-			a.logger.Info("Processing command",
-				zap.String("command_id", cmd.ID),
-				zap.String("tool", cmd.Tool),
-				zap.String("action", cmd.Action))
-
-			// Execute command
-			result := a.commandExecutor.Execute(ctx, *cmd)
-
-			// Send result back
-			select {
-			case a.resultChan <- result:
-				a.logger.Debug("Command result queued", zap.String("command_id", cmd.ID))
-			default:
-				a.logger.Warn("Result channel full, dropping result", zap.String("command_id", cmd.ID))
-			}
-		}
+	if !a.commandPool.cancel(target, reason) {
+		a.logger.Info("Command to cancel is not queued or running",
+			zap.String("command_id", target))
+	}
+}
+
+// runCommand acknowledges and executes a command on a worker of the pool
+func (a *Agent) runCommand(ctx context.Context, cmd *types.Command) *types.CommandResult {
+	a.logger.Info("Processing command",
+		zap.String("command_id", cmd.ID),
+		zap.String("tool", cmd.Tool),
+		zap.String("action", cmd.Action))
+
+	// Acknowledge before executing so agent-manager can mark it executing
+	if err := a.communicationManager.PublishCommandAck(cmd.ID); err != nil {
+		a.logger.Warn("Failed to acknowledge command",
+			zap.String("command_id", cmd.ID),
+			zap.Error(err))
+	}
+
+	return a.commandExecutor.Execute(ctx, *cmd)
+}
+
+// queueResult queues a command result for publishing, dropping it when the
+// result channel is full
+func (a *Agent) queueResult(result *types.CommandResult) {
+	select {
+	case a.resultChan <- result:
+		a.logger.Debug("Command result queued", zap.String("command_id", result.CommandID))
+	default:
+		a.resultsDropped.Add(1)
+		a.logger.Warn("Result channel full, dropping result", zap.String("command_id", result.CommandID))
 	}
 }
 
 // GetStatus returns the current status of the agent
 func (a *Agent) GetStatus() AgentStatus {
 	a.mu.RLock()
-	defer a.mu.RUnlock()
-
-	return AgentStatus{
-		ClusterID:         a.clusterID,
-		Running:           a.running,
-		StartTime:         a.startTime,
+	running := a.running
+	a.mu.RUnlock()
+
+	status := AgentStatus{
+		ClusterID:        a.clusterID,
+		KubeSource:       a.kubeSource,
+		Running:          running,
+		StartTime:        a.startTime,
 		Uptime:           time.Since(a.startTime),
 		EventQueueSize:   len(a.eventChan),
 		MetricsQueueSize: len(a.metricsChan),
-		CommandQueueSize: len(a.commandChan),
 		ResultQueueSize:  len(a.resultChan),
-		Connected:        a.communicationManager != nil && a.communicationManager.IsConnected(),
+		CommandsDropped:  a.commandsDropped.Load(),
+		ResultsDropped:   a.resultsDropped.Load(),
+		Components:       make(map[string]types.ComponentHealth),
+	}
+
+	if a.eventWatcher != nil {
+		status.EventsDropped = a.eventWatcher.Dropped()
+		status.Components[componentEventWatcher] = a.eventWatcher.Health()
+	}
+
+	if a.stateWatcher != nil {
+		status.EventsDropped += a.stateWatcher.Dropped()
+		status.Components[componentStateWatcher] = a.stateWatcher.Health()
+	}
+
+	if a.metricsCollector != nil {
+		status.MetricsDropped = a.metricsCollector.Dropped()
+		status.Components[componentMetricsCollector] = a.metricsCollector.Health()
+		status.Capabilities = a.metricsCollector.Capabilities()
+	}
+
+	if a.commandExecutor != nil {
+		status.Components[componentCommandExecutor] = a.commandExecutor.Health()
+	}
+
+	if a.commandPool != nil {
+		commands := a.commandPool.state()
+		status.CommandQueueSize = len(commands.Queued)
+		status.CommandsRunning = len(commands.Running)
+		status.Commands = &commands
+	}
+
+	if a.communicationManager != nil {
+		status.Connected = a.communicationManager.IsConnected()
+		status.Reconnects = a.communicationManager.Reconnects()
+		status.Components[componentCommunication] = a.communicationManager.Health()
+		if stats, ok := a.communicationManager.SpoolStats(); ok {
+			status.Spool = &stats
+		}
+	}
+
+	status.Status = types.HeartbeatStatusHealthy
+	for _, component := range status.Components {
+		if !component.Healthy {
+			status.Status = types.HeartbeatStatusDegraded
+			break
+		}
 	}
+
+	return status
 }
 
 // AgentStatus represents the current status of the agent
 type AgentStatus struct {
-	ClusterID         string        `json:"cluster_id"`
-	Running           bool          `json:"running"`
-	StartTime         time.Time     `json:"start_time"`
-	Uptime           time.Duration `json:"uptime"`
-	EventQueueSize   int           `json:"event_queue_size"`
-	MetricsQueueSize int           `json:"metrics_queue_size"`
-	CommandQueueSize int           `json:"command_queue_size"`
-	ResultQueueSize  int           `json:"result_queue_size"`
-	Connected        bool          `json:"connected"`
+	ClusterID        string                           `json:"cluster_id"`
+	KubeSource       string                           `json:"kube_source"`
+	Status           string                           `json:"status"` // healthy, degraded
+	Running          bool                             `json:"running"`
+	StartTime        time.Time                        `json:"start_time"`
+	Uptime           time.Duration                    `json:"uptime"`
+	EventQueueSize   int                              `json:"event_queue_size"`
+	MetricsQueueSize int                              `json:"metrics_queue_size"`
+	CommandQueueSize int                              `json:"command_queue_size"`
+	CommandsRunning  int                              `json:"commands_running"`
+	ResultQueueSize  int                              `json:"result_queue_size"`
+	EventsDropped    int64                            `json:"events_dropped"`
+	MetricsDropped   int64                            `json:"metrics_dropped"`
+	CommandsDropped  int64                            `json:"commands_dropped"`
+	ResultsDropped   int64                            `json:"results_dropped"`
+	Connected        bool                             `json:"connected"`
+	Reconnects       int64                            `json:"reconnects"`
+	Spool            *spool.Stats                     `json:"spool,omitempty"`
+	Capabilities     map[string]bool                  `json:"capabilities,omitempty"`
+	Commands         *types.CommandPoolState          `json:"commands,omitempty"`
+	Components       map[string]types.ComponentHealth `json:"components"`
 }
 
 // IsHealthy returns true if the agent is healthy
@@ -293,4 +551,4 @@ func (a *Agent) IsHealthy() bool {
 // IsReady returns true if the agent is ready to serve
 func (a *Agent) IsReady() bool {
 	return a.IsHealthy()
-}
\ No newline at end of file
+}
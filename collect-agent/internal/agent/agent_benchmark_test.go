@@ -2,12 +2,14 @@ package agent
 
 import (
 	"context"
+	"fmt"
 	"testing"
 	"time"
 
 	"go.uber.org/zap"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes/fake"
 
 	"github.com/kart/k8s-agent/collect-agent/internal/types"
@@ -45,33 +47,71 @@ func BenchmarkEventProcessing(b *testing.B) {
 	}
 }
 
-// BenchmarkMetricsCollection benchmarks metrics collection performance
-func BenchmarkMetricsCollection(b *testing.B) {
-	logger, _ := zap.NewDevelopment()
-
-	// Create fake nodes
-	nodes := make([]corev1.Node, 10)
+// benchmarkCluster returns a fake cluster of 10 nodes and 20 namespaces,
+// each holding 5 pods, a service, a configmap and a secret
+func benchmarkCluster() *fake.Clientset {
+	var objects []runtime.Object
 	for i := 0; i < 10; i++ {
-		nodes[i] = corev1.Node{
-			ObjectMeta: metav1.ObjectMeta{
-				Name: "node-" + string(rune(i)),
-			},
-			Status: corev1.NodeStatus{
-				Conditions: []corev1.NodeCondition{
-					{Type: corev1.NodeReady, Status: corev1.ConditionTrue},
-				},
-			},
+		objects = append(objects, devNode(fmt.Sprintf("node-%d", i), true, false))
+	}
+	for i := 0; i < 20; i++ {
+		namespace := fmt.Sprintf("ns-%d", i)
+		meta := metav1.ObjectMeta{Name: "app", Namespace: namespace}
+		objects = append(objects,
+			devNamespaceObject(namespace, namespace+"-uid"),
+			&corev1.Service{ObjectMeta: meta},
+			&corev1.ConfigMap{ObjectMeta: meta},
+			&corev1.Secret{ObjectMeta: meta},
+		)
+		for j := 0; j < 5; j++ {
+			pod := devPod(fmt.Sprintf("app-%d", j), fmt.Sprintf("node-%d", j), corev1.PodRunning, 0, "")
+			pod.Namespace = namespace
+			objects = append(objects, pod)
 		}
 	}
+	return fake.NewClientset(objects...)
+}
 
-	clientset := fake.NewSimpleClientset()
-	metricsChan := make(chan *types.Metrics, 100)
-	collector := NewMetricsCollector(clientset, "test-cluster", metricsChan, logger)
+// BenchmarkMetricsCollection benchmarks metrics collection from the informer
+// caches against listing the cluster on every collection, reporting the API
+// calls made per collection
+func BenchmarkMetricsCollection(b *testing.B) {
+	b.Run("informers", func(b *testing.B) {
+		clientset := benchmarkCluster()
+		collector, metricsChan := newTestMetricsCollector(b, clientset)
+		collector.SetFullSnapshotInterval(10 * time.Minute)
+		clientset.ClearActions()
 
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		collector.collectAndSendMetrics()
-	}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			collector.collectAndSendMetrics()
+			<-metricsChan
+		}
+		b.ReportMetric(float64(len(clientset.Actions()))/float64(b.N), "api_calls/op")
+	})
+
+	// The calls of a collector reading the API server directly: the version,
+	// the nodes, pods and namespaces, and the objects of each namespace
+	b.Run("list_per_collection", func(b *testing.B) {
+		clientset := benchmarkCluster()
+		ctx := context.Background()
+		clientset.ClearActions()
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			_, _ = clientset.Discovery().ServerVersion()
+			_, _ = clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+			_, _ = clientset.CoreV1().Pods(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+			namespaces, _ := clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+			for _, namespace := range namespaces.Items {
+				_, _ = clientset.CoreV1().Pods(namespace.Name).List(ctx, metav1.ListOptions{})
+				_, _ = clientset.CoreV1().Services(namespace.Name).List(ctx, metav1.ListOptions{})
+				_, _ = clientset.CoreV1().ConfigMaps(namespace.Name).List(ctx, metav1.ListOptions{})
+				_, _ = clientset.CoreV1().Secrets(namespace.Name).List(ctx, metav1.ListOptions{})
+			}
+		}
+		b.ReportMetric(float64(len(clientset.Actions()))/float64(b.N), "api_calls/op")
+	})
 }
 
 // BenchmarkCommandValidation benchmarks command validation performance
@@ -142,7 +182,6 @@ func BenchmarkAgentStatus(b *testing.B) {
 		clusterID:   config.ClusterID,
 		eventChan:   make(chan *types.Event, config.BufferSize),
 		metricsChan: make(chan *types.Metrics, 100),
-		commandChan: make(chan *types.Command, 100),
 		resultChan:  make(chan *types.CommandResult, 100),
 		stopCh:      make(chan struct{}),
 		running:     true,
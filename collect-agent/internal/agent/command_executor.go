@@ -2,56 +2,72 @@ package agent
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os/exec"
-	"strings"
 	"sync"
 	"time"
 
 	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/restmapper"
+	metricsclient "k8s.io/metrics/pkg/client/clientset/versioned"
+
+	"github.com/kart-io/k8s-agent/protocol"
 
 	"github.com/kart/k8s-agent/collect-agent/internal/types"
 )
 
+// maxCommandOutput is the largest command output returned, in bytes
+const maxCommandOutput = 1024 * 1024
+
 // CommandExecutor executes commands received from the central control plane
-// It implements safety measures to ensure only read-only operations are performed
+// It implements safety measures to ensure only read-only operations are performed.
+// kubectl commands are run through the Kubernetes API rather than a binary.
 type CommandExecutor struct {
 	clientset kubernetes.Interface
 	clusterID string
 	logger    *zap.Logger
 	mu        sync.RWMutex
 
-	// allowedTools defines which tools can be executed
+	// dynamic reads the objects of any resource, resolved by mapper from the
+	// cached API discovery of discovery; metricsClient serves kubectl top
+	dynamic       dynamic.Interface
+	metricsClient metricsclient.Interface
+	discovery     *restmapper.DeferredDiscoveryRESTMapper
+	mapper        meta.RESTMapper
+
+	// outputPublisher streams command output chunks, when set
+	outputPublisher func(*types.CommandOutput)
+
+	// allowedTools defines which tools can be executed, by action, from
+	// the command schemas shared with the agent-manager
 	allowedTools map[string][]string
+
+	// remediationPolicy is the policy file allowing remediation commands;
+	// they are refused when it is empty
+	remediationPolicy string
+
+	// health tracks failures to run a tool at all, not commands exiting non-zero
+	health  componentHealth
+	metrics *agentMetrics
 }
 
 // NewCommandExecutor creates a new command executor with safety restrictions
 func NewCommandExecutor(clientset kubernetes.Interface, clusterID string, logger *zap.Logger) *CommandExecutor {
+	cached := memory.NewMemCacheClient(clientset.Discovery())
+	discovery := restmapper.NewDeferredDiscoveryRESTMapper(cached)
+
 	return &CommandExecutor{
-		clientset: clientset,
-		clusterID: clusterID,
-		logger:    logger.With(zap.String("component", "command-executor")),
-		allowedTools: map[string][]string{
-			// kubectl read-only operations
-			"kubectl": {
-				"get", "describe", "logs", "top", "explain",
-				"version", "cluster-info", "api-resources", "api-versions",
-			},
-			// System information commands
-			"ps": {"aux", "-ef"},
-			"df": {"-h"},
-			"free": {"-h"},
-			"uptime": {},
-			"uname": {"-a"},
-			"whoami": {},
-			// Network diagnostics
-			"ping": {"-c", "3"},
-			"nslookup": {},
-			"dig": {},
-			"curl": {"-I", "-s", "--connect-timeout", "5"},
-			"wget": {"--spider", "-T", "5"},
-		},
+		clientset:    clientset,
+		clusterID:    clusterID,
+		logger:       logger.With(zap.String("component", "command-executor")),
+		discovery:    discovery,
+		mapper:       restmapper.NewShortcutExpander(discovery, cached, nil),
+		allowedTools: protocol.CommandTools(),
 	}
 }
 
@@ -62,7 +78,7 @@ func (ce *CommandExecutor) Execute(ctx context.Context, cmd types.Command) *type
 	result := &types.CommandResult{
 		CommandID: cmd.ID,
 		ClusterID: ce.clusterID,
-		Status:    "success",
+		Status:    protocol.CommandStatusSuccess,
 		Timestamp: startTime,
 	}
 
@@ -74,12 +90,13 @@ func (ce *CommandExecutor) Execute(ctx context.Context, cmd types.Command) *type
 
 	// Validate command safety
 	if err := ce.validateCommand(cmd); err != nil {
-		result.Status = "failed"
+		result.Status = protocol.CommandStatusFailed
 		result.Error = fmt.Sprintf("Command validation failed: %v", err)
 		result.Duration = time.Since(startTime)
 		ce.logger.Warn("Command validation failed",
 			zap.String("command_id", cmd.ID),
 			zap.Error(err))
+		ce.metrics.observeCommand(ce.toolLabel(cmd.Tool), result.Status, result.Duration)
 		return result
 	}
 
@@ -89,12 +106,22 @@ func (ce *CommandExecutor) Execute(ctx context.Context, cmd types.Command) *type
 		ce.executeDiagnosticCommand(ctx, cmd, result)
 	case "info":
 		ce.executeInfoCommand(ctx, cmd, result)
+	case protocol.CommandTypeRemediation:
+		ce.executeRemediation(ctx, cmd, result)
 	default:
-		result.Status = "failed"
+		result.Status = protocol.CommandStatusFailed
 		result.Error = fmt.Sprintf("Unknown command type: %s", cmd.Type)
 	}
 
+	// A cancelled command reports the cancellation rather than how it ended
+	if cause := context.Cause(ctx); errors.Is(cause, errCommandCancelled) {
+		result.Status = protocol.CommandStatusCancelled
+		result.Error = cause.Error()
+		result.ExitCode = nil
+	}
+
 	result.Duration = time.Since(startTime)
+	ce.metrics.observeCommand(ce.toolLabel(cmd.Tool), result.Status, result.Duration)
 
 	ce.logger.Info("Command execution completed",
 		zap.String("command_id", cmd.ID),
@@ -104,107 +131,29 @@ func (ce *CommandExecutor) Execute(ctx context.Context, cmd types.Command) *type
 	return result
 }
 
-// validateCommand ensures the command is safe to execute
-func (ce *CommandExecutor) validateCommand(cmd types.Command) error {
-	// Check if tool is allowed
-	allowedActions, toolExists := ce.allowedTools[cmd.Tool]
-	if !toolExists {
-		return fmt.Errorf("tool '%s' is not allowed", cmd.Tool)
-	}
-
-	// For kubectl, perform additional validation
-	if cmd.Tool == "kubectl" {
-		return ce.validateKubectlCommand(cmd, allowedActions)
-	}
-
-	// For other tools, check if action is allowed
-	if len(allowedActions) > 0 {
-		actionAllowed := false
-		for _, allowedAction := range allowedActions {
-			if cmd.Action == allowedAction {
-				actionAllowed = true
-				break
-			}
-		}
-		if !actionAllowed {
-			return fmt.Errorf("action '%s' is not allowed for tool '%s'", cmd.Action, cmd.Tool)
-		}
+// toolLabel returns the metrics label for a tool, folding tools outside the allow list together
+func (ce *CommandExecutor) toolLabel(tool string) string {
+	if _, ok := ce.allowedTools[tool]; ok || tool == protocol.RemediationTool {
+		return tool
 	}
-
-	// Check for dangerous patterns in arguments
-	if err := ce.checkArgumentSafety(cmd.Args); err != nil {
-		return err
-	}
-
-	return nil
+	return commandToolOther
 }
 
-// validateKubectlCommand performs specific validation for kubectl commands
-func (ce *CommandExecutor) validateKubectlCommand(cmd types.Command, allowedActions []string) error {
-	// Check if the action is allowed
-	actionAllowed := false
-	for _, allowedAction := range allowedActions {
-		if cmd.Action == allowedAction {
-			actionAllowed = true
-			break
-		}
-	}
-	if !actionAllowed {
-		return fmt.Errorf("kubectl action '%s' is not allowed", cmd.Action)
-	}
-
-	// Additional safety checks for specific kubectl commands
-	switch cmd.Action {
-	case "logs":
-		// Logs command is safe but we might want to limit output
-		for i, arg := range cmd.Args {
-			if arg == "--follow" || arg == "-f" {
-				return fmt.Errorf("following logs is not allowed for safety reasons")
-			}
-			// Limit tail lines
-			if arg == "--tail" && i+1 < len(cmd.Args) {
-				// This is acceptable for diagnostic purposes
-				continue
-			}
-		}
-	case "get", "describe":
-		// These are read-only operations, generally safe
-		// But we can add specific restrictions if needed
-		break
-	case "top":
-		// Resource usage commands are safe
-		break
+// validateCommand checks the command against the schema of its tool and
+// action, which lists the flags, arguments and params it accepts and the
+// values each takes
+func (ce *CommandExecutor) validateCommand(cmd types.Command) error {
+	if err := protocol.ValidateCommandType(cmd.Type, cmd.Tool); err != nil {
+		return err
 	}
-
-	return nil
-}
-
-// checkArgumentSafety checks if command arguments contain dangerous patterns
-func (ce *CommandExecutor) checkArgumentSafety(args []string) error {
-	dangerousPatterns := []string{
-		"rm ", "delete", "destroy", "kill", "terminate",
-		"sudo", "su", "chmod", "chown",
-		"mount", "umount", "mkfs", "dd",
-		"iptables", "ip route", "ifconfig",
-		"systemctl", "service", "init.d",
-		"crontab", "at ",
-		"curl -X POST", "curl -X PUT", "curl -X DELETE",
-		"wget -O", "wget --post",
-		"ssh", "scp", "rsync",
-		"docker run", "docker exec",
-		"&&", "||", ";", "|", ">", ">>", "<",
-		"$(", "`", "${",
+	if err := protocol.ValidateCommand(cmd.Tool, cmd.Action, cmd.Args, cmd.Params, cmd.Env); err != nil {
+		return err
 	}
 
-	argString := strings.Join(args, " ")
-	argStringLower := strings.ToLower(argString)
-
-	for _, pattern := range dangerousPatterns {
-		if strings.Contains(argStringLower, strings.ToLower(pattern)) {
-			return fmt.Errorf("dangerous pattern detected in arguments: '%s'", pattern)
-		}
+	if cmd.Tool == kubeTool {
+		_, err := parseKubeQuery(cmd.Action, cmd.Params)
+		return err
 	}
-
 	return nil
 }
 
@@ -219,55 +168,95 @@ func (ce *CommandExecutor) executeDiagnosticCommand(ctx context.Context, cmd typ
 	execCtx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
+	if cmd.Tool == kubeTool {
+		ce.executeKubeCommand(execCtx, cmd, result)
+		return
+	}
+
 	// Build command
 	var execCmd *exec.Cmd
-	if cmd.Tool == "kubectl" {
-		// For kubectl, we need to build the full command
+	if cmd.Action != "" {
 		args := append([]string{cmd.Action}, cmd.Args...)
-		execCmd = exec.CommandContext(execCtx, "kubectl", args...)
+		execCmd = exec.CommandContext(execCtx, cmd.Tool, args...)
 	} else {
-		// For other tools
-		if cmd.Action != "" {
-			args := append([]string{cmd.Action}, cmd.Args...)
-			execCmd = exec.CommandContext(execCtx, cmd.Tool, args...)
-		} else {
-			execCmd = exec.CommandContext(execCtx, cmd.Tool, cmd.Args...)
-		}
+		execCmd = exec.CommandContext(execCtx, cmd.Tool, cmd.Args...)
 	}
 
-	// Set environment variables if provided
-	if len(cmd.Env) > 0 {
-		env := execCmd.Environ()
-		for key, value := range cmd.Env {
-			env = append(env, fmt.Sprintf("%s=%s", key, value))
-		}
-		execCmd.Env = env
+	// Execute command, streaming its output while it runs
+	streamer := newOutputStreamer(cmd.ID, ce.outputPublisherFor(cmd))
+	execCmd.Stdout = streamer.writer(protocol.OutputStreamStdout)
+	execCmd.Stderr = streamer.writer(protocol.OutputStreamStderr)
+	err := execCmd.Run()
+	streamer.close(result)
+	if state := execCmd.ProcessState; state != nil && state.ExitCode() >= 0 {
+		exitCode := state.ExitCode()
+		result.ExitCode = &exitCode
 	}
 
-	// Execute command
-	output, err := execCmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) && execCtx.Err() == nil {
+		ce.health.recordError(fmt.Errorf("failed to run %s: %w", cmd.Tool, err))
+	} else {
+		ce.health.recordSuccess()
+	}
 
 	if err != nil {
 		if execCtx.Err() == context.DeadlineExceeded {
-			result.Status = "timeout"
+			result.Status = protocol.CommandStatusTimeout
 			result.Error = "Command execution timed out"
 		} else {
-			result.Status = "failed"
+			result.Status = protocol.CommandStatusFailed
 			result.Error = err.Error()
 		}
 	}
+}
 
-	result.Output = string(output)
+// outputPublisherFor returns the publisher of the output chunks of a command,
+// or nil when they are not streamed
+func (ce *CommandExecutor) outputPublisherFor(cmd types.Command) func(*types.CommandOutput) {
+	ce.mu.RLock()
+	defer ce.mu.RUnlock()
 
-	// Limit output size to prevent excessive memory usage
-	maxOutputSize := 1024 * 1024 // 1MB
-	if len(result.Output) > maxOutputSize {
-		result.Output = result.Output[:maxOutputSize] + "\n... (output truncated)"
+	if ce.outputPublisher == nil || !protocol.IsSubjectToken(cmd.ID) {
+		return nil
 	}
+	return ce.outputPublisher
 }
 
 // executeInfoCommand executes information gathering commands
 func (ce *CommandExecutor) executeInfoCommand(ctx context.Context, cmd types.Command, result *types.CommandResult) {
 	// Info commands are similar to diagnostic commands but might have different handling
 	ce.executeDiagnosticCommand(ctx, cmd, result)
-}
\ No newline at end of file
+}
+
+// SetOutputPublisher streams the output of commands through publish as they
+// run, in addition to the output kept in their result
+func (ce *CommandExecutor) SetOutputPublisher(publish func(*types.CommandOutput)) {
+	ce.mu.Lock()
+	defer ce.mu.Unlock()
+	ce.outputPublisher = publish
+}
+
+// SetDynamicClient sets the client reading objects for kubectl get and describe
+func (ce *CommandExecutor) SetDynamicClient(client dynamic.Interface) {
+	ce.dynamic = client
+}
+
+// SetMetricsClient sets the metrics.k8s.io client serving kubectl top
+func (ce *CommandExecutor) SetMetricsClient(client metricsclient.Interface) {
+	ce.metricsClient = client
+}
+
+// SetRemediationPolicy enables remediation commands, as far as the policy
+// file allows them. The file is read for each command, so that changes to it
+// apply without restarting the agent.
+func (ce *CommandExecutor) SetRemediationPolicy(file string) {
+	ce.mu.Lock()
+	defer ce.mu.Unlock()
+	ce.remediationPolicy = file
+}
+
+// Health returns the command executor health
+func (ce *CommandExecutor) Health() types.ComponentHealth {
+	return ce.health.snapshot()
+}
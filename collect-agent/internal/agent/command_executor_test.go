@@ -2,6 +2,7 @@ package agent
 
 import (
 	"context"
+	"strings"
 	"testing"
 	"time"
 
@@ -45,7 +46,7 @@ func TestValidateCommand_AllowedTool(t *testing.T) {
 		ID:     "cmd-1",
 		Tool:   "kubectl",
 		Action: "get",
-		Args:   []string{"pods"},
+		Params: map[string]string{"resource": "pods"},
 	}
 
 	err := executor.validateCommand(cmd)
@@ -90,46 +91,64 @@ func TestValidateCommand_DisallowedAction(t *testing.T) {
 	}
 }
 
-func TestCheckArgumentSafety_Safe(t *testing.T) {
+func TestValidateCommand_SafeArguments(t *testing.T) {
 	clientset := fake.NewSimpleClientset()
 	logger := zap.NewNop()
 	executor := NewCommandExecutor(clientset, "test-cluster", logger)
 
-	safeArgs := []string{"pods", "-n", "default", "--output", "json"}
+	// Values that merely contain words such as kill or su are not commands
+	safeTests := []struct {
+		name   string
+		tool   string
+		action string
+		args   []string
+		params map[string]string
+	}{
+		{"ping", "ping", "", []string{"-c", "3", "10.0.0.1"}, nil},
+		{"host named killer", "nslookup", "", []string{"killer.internal"}, nil},
+		{"curl health check", "curl", "", []string{"-s", "--connect-timeout", "5", "http://summary.demo:8080/healthz"}, nil},
+		{"pod named su", "kubectl", "logs", nil, map[string]string{"name": "su-exporter-0", "namespace": "delete-me"}},
+	}
 
-	err := executor.checkArgumentSafety(safeArgs)
-	if err != nil {
-		t.Errorf("checkArgumentSafety failed for safe arguments: %v", err)
+	for _, tt := range safeTests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := types.Command{Tool: tt.tool, Action: tt.action, Args: tt.args, Params: tt.params}
+			if err := executor.validateCommand(cmd); err != nil {
+				t.Errorf("validateCommand failed for safe command: %v", err)
+			}
+		})
 	}
 }
 
-func TestCheckArgumentSafety_DangerousPatterns(t *testing.T) {
+func TestValidateCommand_DangerousArguments(t *testing.T) {
 	clientset := fake.NewSimpleClientset()
 	logger := zap.NewNop()
 	executor := NewCommandExecutor(clientset, "test-cluster", logger)
 
 	dangerousTests := []struct {
-		name string
-		args []string
+		name    string
+		tool    string
+		args    []string
+		wantErr string
 	}{
-		{"shell command injection", []string{"pods", "&&", "rm", "-rf", "/"}},
-		{"pipe operator", []string{"pods", "|", "grep", "test"}},
-		{"output redirection", []string{"pods", ">", "/tmp/output"}},
-		{"sudo command", []string{"sudo", "kubectl", "get", "pods"}},
-		{"delete command", []string{"delete", "pods", "test"}},
+		{"shell command injection", "ping", []string{"-c", "3", "example.com", "&&", "reboot"}, "arguments must be 1, got 3"},
+		{"pipe operator", "nslookup", []string{"example.com|grep"}, `argument 1 ("example.com|grep") must be a host name or IP address`},
+		{"output file", "curl", []string{"-o", "/tmp/output", "http://example.com"}, `flag "-o" is not allowed`},
+		{"post request", "curl", []string{"-X", "POST", "http://example.com"}, `flag "-X" is not allowed`},
+		{"command substitution", "dig", []string{"$(whoami).example.com"}, `must be a host name or IP address`},
 	}
 
 	for _, tt := range dangerousTests {
 		t.Run(tt.name, func(t *testing.T) {
-			err := executor.checkArgumentSafety(tt.args)
-			if err == nil {
-				t.Errorf("checkArgumentSafety should fail for: %v", tt.args)
+			err := executor.validateCommand(types.Command{Tool: tt.tool, Args: tt.args})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validateCommand() error = %v, want %q", err, tt.wantErr)
 			}
 		})
 	}
 }
 
-func TestValidateKubectlCommand_LogsWithFollow(t *testing.T) {
+func TestValidateCommand_KubectlArguments(t *testing.T) {
 	clientset := fake.NewSimpleClientset()
 	logger := zap.NewNop()
 	executor := NewCommandExecutor(clientset, "test-cluster", logger)
@@ -139,11 +158,12 @@ func TestValidateKubectlCommand_LogsWithFollow(t *testing.T) {
 		Tool:   "kubectl",
 		Action: "logs",
 		Args:   []string{"pod/test-pod", "--follow"},
+		Params: map[string]string{"name": "test-pod"},
 	}
 
-	err := executor.validateKubectlCommand(cmd, []string{"logs"})
+	err := executor.validateCommand(cmd)
 	if err == nil {
-		t.Error("validateKubectlCommand should fail for logs --follow")
+		t.Error("validateCommand should fail for logs --follow")
 	}
 }
 
@@ -209,6 +229,29 @@ func TestExecute_ValidationFailure(t *testing.T) {
 	}
 }
 
+func TestExecute_EnvRejected(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	logger := zap.NewNop()
+	executor := NewCommandExecutor(clientset, "test-cluster", logger)
+
+	cmd := types.Command{
+		ID:      "cmd-1",
+		Type:    "diagnostic",
+		Tool:    "uptime",
+		Env:     map[string]string{"LD_PRELOAD": "/tmp/hook.so"},
+		Timeout: 5 * time.Second,
+	}
+
+	result := executor.Execute(context.Background(), cmd)
+
+	if result.Status != "failed" {
+		t.Errorf("result.Status = %v, want %v", result.Status, "failed")
+	}
+	if !strings.Contains(result.Error, "env is not allowed") {
+		t.Errorf("result.Error = %q, want it to reject the env", result.Error)
+	}
+}
+
 func TestExecute_UnknownCommandType(t *testing.T) {
 	clientset := fake.NewSimpleClientset()
 	logger := zap.NewNop()
@@ -0,0 +1,343 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/kart-io/k8s-agent/protocol"
+
+	"github.com/kart/k8s-agent/collect-agent/internal/types"
+)
+
+// Chunking of streamed command output
+const (
+	outputChunkSize     = 16 * 1024              // largest chunk published
+	outputFlushInterval = 250 * time.Millisecond // longest a partial chunk waits
+	maxStreamedOutput   = 64 * 1024 * 1024       // output streamed per command, the rest is dropped
+)
+
+// capturedStream is output kept for the result of a command: its first
+// maxCommandOutput bytes and the number of bytes written
+type capturedStream struct {
+	text      strings.Builder
+	bytes     int64
+	truncated bool
+}
+
+// write keeps as much of data as fits
+func (c *capturedStream) write(data []byte) {
+	c.bytes += int64(len(data))
+	if c.truncated {
+		return
+	}
+	if room := maxCommandOutput - c.text.Len(); len(data) > room {
+		c.text.Write(data[:completeRunes(data[:room])])
+		c.truncated = true
+		return
+	}
+	c.text.Write(data)
+}
+
+// outputStreamer splits the output of a command into numbered chunks,
+// published while the command runs, and keeps the output of each stream and
+// both interleaved for the result. Pending output belongs to one stream at a
+// time, so the chunks in order hold the output as it was read.
+type outputStreamer struct {
+	commandID string
+	publish   func(*types.CommandOutput)
+
+	mu       sync.Mutex
+	stream   string
+	pending  []byte
+	seq      int64
+	streamed int64
+	output   capturedStream
+	stdout   capturedStream
+	stderr   capturedStream
+
+	stopCh chan struct{}
+	done   chan struct{}
+}
+
+// newOutputStreamer creates a streamer of the output of a command, which
+// publishes nothing when publish is nil
+func newOutputStreamer(commandID string, publish func(*types.CommandOutput)) *outputStreamer {
+	s := &outputStreamer{
+		commandID: commandID,
+		publish:   publish,
+		stopCh:    make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	// Publish partial chunks of slow commands, such as ping, as they come
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(outputFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stopCh:
+				return
+			case <-ticker.C:
+				s.mu.Lock()
+				s.flush(false)
+				s.mu.Unlock()
+			}
+		}
+	}()
+	return s
+}
+
+// writer returns the writer of one stream of the command
+func (s *outputStreamer) writer(stream string) *streamWriter {
+	return &streamWriter{streamer: s, stream: stream}
+}
+
+// streamWriter writes one stream of a command to its streamer
+type streamWriter struct {
+	streamer *outputStreamer
+	stream   string
+}
+
+// Write adds p to the output of the stream
+func (w *streamWriter) Write(p []byte) (int, error) {
+	w.streamer.write(w.stream, p)
+	return len(p), nil
+}
+
+// write adds data read from a stream, publishing the full chunks it completes
+func (s *outputStreamer) write(stream string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.output.write(data)
+	if stream == protocol.OutputStreamStderr {
+		s.stderr.write(data)
+	} else {
+		s.stdout.write(data)
+	}
+
+	if s.publish == nil {
+		return
+	}
+	if stream != s.stream {
+		s.flush(true)
+		s.stream = stream
+	}
+	s.pending = append(s.pending, data...)
+	for len(s.pending) >= outputChunkSize {
+		s.publishChunk(outputChunkSize)
+	}
+}
+
+// flush publishes the pending output; unless final, a rune split across
+// writes is held back until it is complete
+func (s *outputStreamer) flush(final bool) {
+	if !final {
+		if n := completeRunes(s.pending); n > 0 {
+			s.publishChunk(n)
+		}
+		return
+	}
+	for len(s.pending) > 0 {
+		s.publishChunk(len(s.pending))
+	}
+}
+
+// publishChunk publishes the first n bytes of the pending output, cut before
+// any rune they would split
+func (s *outputStreamer) publishChunk(n int) {
+	if cut := completeRunes(s.pending[:n]); cut > 0 {
+		n = cut
+	}
+	data := string(s.pending[:n])
+	s.pending = s.pending[n:]
+
+	if s.streamed+int64(len(data)) > maxStreamedOutput {
+		return
+	}
+	s.streamed += int64(len(data))
+	s.seq++
+	s.publish(&types.CommandOutput{
+		CommandID: s.commandID,
+		Seq:       s.seq,
+		Stream:    s.stream,
+		Data:      data,
+		Timestamp: time.Now(),
+	})
+}
+
+// close publishes the remaining output and sets the output of result: the
+// streams interleaved, each stream with its size and whether it was
+// truncated, and the number of chunks published
+func (s *outputStreamer) close(result *types.CommandResult) {
+	close(s.stopCh)
+	<-s.done
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.publish != nil {
+		s.flush(true)
+	}
+
+	// The interleaved output and the streams share maxCommandOutput bytes,
+	// half of them for the interleaved output
+	stdoutLimit, stderrLimit := splitBudget(maxCommandOutput/2, s.stdout.text.Len(), s.stderr.text.Len())
+
+	var truncated bool
+	result.Output, truncated = truncateText(s.output.text.String(), maxCommandOutput/2)
+	if s.output.truncated || truncated {
+		result.Output += outputTruncatedNote
+	}
+	result.Stdout, truncated = truncateText(s.stdout.text.String(), stdoutLimit)
+	result.StdoutBytes = s.stdout.bytes
+	result.StdoutTruncated = s.stdout.truncated || truncated
+	result.Stderr, truncated = truncateText(s.stderr.text.String(), stderrLimit)
+	result.StderrBytes = s.stderr.bytes
+	result.StderrTruncated = s.stderr.truncated || truncated
+	result.OutputChunks = s.seq
+}
+
+// outputTruncatedNote ends the interleaved output of a result when truncated
+const outputTruncatedNote = "\n... (output truncated)"
+
+// splitBudget splits budget bytes between two streams of sizes a and b, the
+// share one does not need going to the other
+func splitBudget(budget, a, b int) (int, int) {
+	half := budget / 2
+	switch {
+	case a <= half:
+		return a, budget - a
+	case b <= half:
+		return budget - b, b
+	default:
+		return half, budget - half
+	}
+}
+
+// truncateText returns at most limit bytes of s, cut before any rune they
+// would split, and whether it cut s
+func truncateText(s string, limit int) (string, bool) {
+	if len(s) <= limit {
+		return s, false
+	}
+	return s[:completeRunes([]byte(s[:limit]))], true
+}
+
+// cutEncoded cuts the end of s to save about over bytes once JSON encoded,
+// where escaped characters take more room than they do in s
+func cutEncoded(s string, over int) string {
+	encoded, _ := json.Marshal(s)
+	cut := (over*len(s) + len(encoded) - 1) / len(encoded)
+	text, _ := truncateText(s, max(len(s)-cut, 0))
+	return text
+}
+
+// fitResult shrinks the output of a result until its encoded size, as given
+// by size, is at most limit bytes: the largest of the interleaved output and
+// the streams is cut first, and the structured output is dropped once they
+// are empty. The report of a remediation is never dropped, as undoing the
+// change needs its target and rollback; its snapshot is cut down to the
+// identity of the object before anything else.
+func fitResult(result *types.CommandResult, limit int, size func(*types.CommandResult) (int, error)) error {
+	report, isReport := remediationReport(result.Data)
+	trimmed := !isReport || report.Snapshot == nil
+
+	for {
+		n, err := size(result)
+		if err != nil {
+			return err
+		}
+		over := n - limit
+		if over <= 0 {
+			return nil
+		}
+
+		output := strings.TrimSuffix(result.Output, outputTruncatedNote)
+		switch {
+		case !trimmed:
+			report.Snapshot = snapshotIdentity(report.Snapshot)
+			encoded, err := json.Marshal(report)
+			if err != nil {
+				return fmt.Errorf("failed to encode remediation report: %w", err)
+			}
+			result.Data = encoded
+			trimmed = true
+		case len(output) > 0 && len(output) >= len(result.Stdout) && len(output) >= len(result.Stderr):
+			result.Output = cutEncoded(output, over) + outputTruncatedNote
+		case len(result.Stdout) > 0 && len(result.Stdout) >= len(result.Stderr):
+			result.Stdout = cutEncoded(result.Stdout, over)
+			result.StdoutTruncated = true
+		case len(result.Stderr) > 0:
+			result.Stderr = cutEncoded(result.Stderr, over)
+			result.StderrTruncated = true
+		case len(result.Data) > 0 && !isReport:
+			result.Data = nil
+			result.Output += "\n... (structured output omitted, too large)"
+		default:
+			return fmt.Errorf("result of %d bytes exceeds %d bytes without its output", n, limit)
+		}
+	}
+}
+
+// remediationReport decodes the structured output of a result as the report
+// of a remediation, reporting false for other structured output
+func remediationReport(data json.RawMessage) (*protocol.RemediationReport, bool) {
+	if len(data) == 0 {
+		return nil, false
+	}
+	var report protocol.RemediationReport
+	if err := json.Unmarshal(data, &report); err != nil || report.Action == "" || report.Target.Kind == "" {
+		return nil, false
+	}
+	return &report, true
+}
+
+// snapshotIdentity keeps of an object snapshot the fields identifying the
+// object, such as the UID that tells a deleted pod from its replacement
+func snapshotIdentity(snapshot map[string]interface{}) map[string]interface{} {
+	identity := make(map[string]interface{})
+	for _, key := range []string{"apiVersion", "kind"} {
+		if value, ok := snapshot[key]; ok {
+			identity[key] = value
+		}
+	}
+	if metadata, ok := snapshot["metadata"].(map[string]interface{}); ok {
+		kept := make(map[string]interface{})
+		for _, key := range []string{"name", "namespace", "uid", "resourceVersion"} {
+			if value, ok := metadata[key]; ok {
+				kept[key] = value
+			}
+		}
+		identity["metadata"] = kept
+	}
+	return identity
+}
+
+// completeRunes returns the length of the longest prefix of b that does not
+// end with an incomplete UTF-8 sequence
+func completeRunes(b []byte) int {
+	// A rune is at most utf8.UTFMax bytes, so only the tail needs checking
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if utf8.FullRune(b[i:]) {
+				return len(b)
+			}
+			return i
+		}
+	}
+	return len(b)
+}
+
+// streamText streams output produced at once on one stream, such as the
+// rendering of a kubectl command, and sets it as the output of result
+func streamText(commandID, stream, text string, publish func(*types.CommandOutput), result *types.CommandResult) {
+	s := newOutputStreamer(commandID, publish)
+	s.write(stream, []byte(text))
+	s.close(result)
+}
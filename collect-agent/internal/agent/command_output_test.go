@@ -0,0 +1,262 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/kart-io/k8s-agent/protocol"
+
+	"github.com/kart/k8s-agent/collect-agent/internal/types"
+)
+
+// outputRecorder collects the chunks published for a command
+type outputRecorder struct {
+	mu     sync.Mutex
+	chunks []*types.CommandOutput
+}
+
+func (r *outputRecorder) publish(output *types.CommandOutput) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.chunks = append(r.chunks, output)
+}
+
+// reassemble returns the output of each stream, checking the sequence numbers
+func (r *outputRecorder) reassemble(t *testing.T) map[string]string {
+	t.Helper()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	streams := make(map[string]string)
+	for i, chunk := range r.chunks {
+		if chunk.Seq != int64(i+1) {
+			t.Fatalf("chunk %d has seq %d, want %d", i, chunk.Seq, i+1)
+		}
+		streams[chunk.Stream] += chunk.Data
+	}
+	return streams
+}
+
+func TestOutputStreamer(t *testing.T) {
+	recorder := &outputRecorder{}
+	s := newOutputStreamer("cmd-1", recorder.publish)
+
+	stdout := s.writer(protocol.OutputStreamStdout)
+	stderr := s.writer(protocol.OutputStreamStderr)
+	big := strings.Repeat("a", outputChunkSize+10)
+	stdout.Write([]byte(big))
+	stderr.Write([]byte("warning\n"))
+	// A rune split across writes must not be split across chunks
+	stdout.Write([]byte("é")[:1])
+	stdout.Write([]byte("é")[1:])
+
+	var result types.CommandResult
+	s.close(&result)
+	if result.OutputChunks != int64(len(recorder.chunks)) {
+		t.Errorf("result.OutputChunks = %d, %d were published", result.OutputChunks, len(recorder.chunks))
+	}
+	if want := big + "warning\né"; result.Output != want {
+		t.Errorf("output has %d bytes, want %d", len(result.Output), len(want))
+	}
+	if result.Stdout != big+"é" || result.StdoutBytes != int64(len(big)+2) {
+		t.Errorf("stdout has %d bytes, counted %d, want %d", len(result.Stdout), result.StdoutBytes, len(big)+2)
+	}
+	if result.Stderr != "warning\n" || result.StderrBytes != 8 || result.StderrTruncated {
+		t.Errorf("stderr = %q, %d bytes, truncated %v, want %q", result.Stderr, result.StderrBytes, result.StderrTruncated, "warning\n")
+	}
+
+	streams := recorder.reassemble(t)
+	if streams[protocol.OutputStreamStdout] != big+"é" {
+		t.Errorf("stdout has %d bytes, want %d", len(streams[protocol.OutputStreamStdout]), len(big)+2)
+	}
+	if streams[protocol.OutputStreamStderr] != "warning\n" {
+		t.Errorf("stderr = %q, want %q", streams[protocol.OutputStreamStderr], "warning\n")
+	}
+	for _, chunk := range recorder.chunks {
+		if len(chunk.Data) > outputChunkSize {
+			t.Errorf("chunk %d has %d bytes, more than %d", chunk.Seq, len(chunk.Data), outputChunkSize)
+		}
+		if !utf8.ValidString(chunk.Data) {
+			t.Errorf("chunk %d splits a rune: %q", chunk.Seq, chunk.Data)
+		}
+	}
+}
+
+func TestOutputStreamer_Truncated(t *testing.T) {
+	recorder := &outputRecorder{}
+	// A rune across the limit is dropped whole
+	text := strings.Repeat("x", maxCommandOutput-1) + "é"
+	var result types.CommandResult
+	streamText("cmd-1", protocol.OutputStreamStdout, text, recorder.publish, &result)
+
+	if !strings.HasSuffix(result.Output, "(output truncated)") {
+		t.Error("output beyond maxCommandOutput was not marked truncated")
+	}
+	// The interleaved output and stdout share maxCommandOutput
+	if !result.StdoutTruncated || len(result.Stdout) != maxCommandOutput/2 || result.StdoutBytes != int64(len(text)) {
+		t.Errorf("stdout kept %d bytes, counted %d, truncated %v, want %d, %d, true",
+			len(result.Stdout), result.StdoutBytes, result.StdoutTruncated, maxCommandOutput/2, len(text))
+	}
+	if len(result.Output)+len(result.Stdout)+len(result.Stderr) > maxCommandOutput+len(outputTruncatedNote) {
+		t.Errorf("result carries %d bytes of output, more than %d", len(result.Output)+len(result.Stdout)+len(result.Stderr), maxCommandOutput)
+	}
+	if got := recorder.reassemble(t)[protocol.OutputStreamStdout]; got != text {
+		t.Errorf("streamed %d bytes, want all %d", len(got), len(text))
+	}
+	if result.OutputChunks != int64(len(recorder.chunks)) {
+		t.Errorf("result.OutputChunks = %d, %d were published", result.OutputChunks, len(recorder.chunks))
+	}
+
+	// Without a publisher the output is only kept for the result
+	result = types.CommandResult{}
+	streamText("cmd-1", protocol.OutputStreamStderr, "No resources found\n", nil, &result)
+	if result.Stderr != "No resources found\n" || result.Stdout != "" || result.OutputChunks != 0 {
+		t.Errorf("result = %q / %q, %d chunks, want the output on stderr and no chunks",
+			result.Stdout, result.Stderr, result.OutputChunks)
+	}
+}
+
+func TestSplitBudget(t *testing.T) {
+	tests := []struct {
+		a, b         int
+		wantA, wantB int
+	}{
+		{10, 10, 10, 90},
+		{300, 20, 80, 20},
+		{300, 300, 50, 50},
+	}
+	for _, tt := range tests {
+		if a, b := splitBudget(100, tt.a, tt.b); a != tt.wantA || b != tt.wantB {
+			t.Errorf("splitBudget(100, %d, %d) = %d, %d, want %d, %d", tt.a, tt.b, a, b, tt.wantA, tt.wantB)
+		}
+	}
+}
+
+func TestFitResult(t *testing.T) {
+	size := func(result *types.CommandResult) (int, error) {
+		return len(result.Output) + len(result.Stdout) + len(result.Stderr) + len(result.Data), nil
+	}
+
+	result := &types.CommandResult{
+		Output: strings.Repeat("o", 600),
+		Stdout: strings.Repeat("s", 500),
+		Stderr: strings.Repeat("e", 100),
+	}
+	if err := fitResult(result, 1000, size); err != nil {
+		t.Fatalf("fitResult failed: %v", err)
+	}
+	if n, _ := size(result); n > 1000 {
+		t.Errorf("result has %d bytes, want at most 1000", n)
+	}
+	if result.Stderr != strings.Repeat("e", 100) || result.StderrTruncated {
+		t.Error("stderr was cut before the larger fields")
+	}
+	if !strings.HasSuffix(result.Output, outputTruncatedNote) {
+		t.Error("cut output was not marked truncated")
+	}
+
+	// Structured output goes once the text is gone
+	result = &types.CommandResult{Output: "x", Data: []byte(`"` + strings.Repeat("d", 2000) + `"`)}
+	if err := fitResult(result, 1000, size); err != nil {
+		t.Fatalf("fitResult failed: %v", err)
+	}
+	if result.Data != nil {
+		t.Error("structured output over the limit was kept")
+	}
+
+	// Remediation reports lose their snapshot before the output, and are kept
+	report := func() json.RawMessage {
+		data, _ := json.Marshal(&protocol.RemediationReport{
+			Action:  protocol.RemediationDeletePod,
+			Target:  protocol.RemediationTarget{Kind: "Pod", Namespace: "shop", Name: "web-1"},
+			Changed: true,
+			Snapshot: map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "Pod",
+				"metadata":   map[string]interface{}{"name": "web-1", "namespace": "shop", "uid": "uid-1", "annotations": map[string]interface{}{"note": strings.Repeat("a", 2000)}},
+				"spec":       map[string]interface{}{"nodeName": strings.Repeat("n", 2000)},
+			},
+			Rollback: &protocol.RemediationRollback{Action: protocol.RemediationScale, Params: map[string]string{"replicas": "3"}},
+		})
+		return data
+	}
+	decode := func(data json.RawMessage) *protocol.RemediationReport {
+		var decoded protocol.RemediationReport
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("failed to decode report: %v", err)
+		}
+		return &decoded
+	}
+
+	result = &types.CommandResult{Output: strings.Repeat("o", 300), Data: report()}
+	if err := fitResult(result, 1000, size); err != nil {
+		t.Fatalf("fitResult failed: %v", err)
+	}
+	if result.Output != strings.Repeat("o", 300) {
+		t.Error("output was cut before the snapshot")
+	}
+	trimmed := decode(result.Data)
+	wantSnapshot := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Pod",
+		"metadata":   map[string]interface{}{"name": "web-1", "namespace": "shop", "uid": "uid-1"},
+	}
+	if !reflect.DeepEqual(trimmed.Snapshot, wantSnapshot) {
+		t.Errorf("snapshot = %v, want %v", trimmed.Snapshot, wantSnapshot)
+	}
+	if trimmed.Target.Name != "web-1" || trimmed.Rollback == nil || trimmed.Rollback.Params["replicas"] != "3" {
+		t.Errorf("report lost its target or rollback: %+v", trimmed)
+	}
+
+	result = &types.CommandResult{Output: strings.Repeat("o", 2000), Data: report()}
+	if err := fitResult(result, len(result.Data)/4, size); err != nil {
+		t.Fatalf("fitResult failed: %v", err)
+	}
+	if trimmed := decode(result.Data); trimmed.Rollback == nil || !strings.HasSuffix(result.Output, outputTruncatedNote) {
+		t.Errorf("output = %d bytes, report = %+v, want the output cut and the report kept", len(result.Output), trimmed)
+	}
+
+	result = &types.CommandResult{Output: "x", Data: report()}
+	if err := fitResult(result, 100, size); err == nil || result.Data == nil {
+		t.Error("remediation report was dropped instead of failing")
+	}
+}
+
+func TestExecute_StreamsOutput(t *testing.T) {
+	executor := NewCommandExecutor(fake.NewSimpleClientset(), "test-cluster", zap.NewNop())
+	recorder := &outputRecorder{}
+	executor.SetOutputPublisher(recorder.publish)
+
+	cmd := types.Command{ID: "cmd-1", Type: "diagnostic", Tool: "uname", Action: "-a", Timeout: 5 * time.Second}
+	result := executor.Execute(context.Background(), cmd)
+	if result.Status != protocol.CommandStatusSuccess {
+		t.Skipf("uname is unavailable: %v", result.Error)
+	}
+
+	if result.ExitCode == nil || *result.ExitCode != 0 {
+		t.Errorf("result.ExitCode = %v, want 0", result.ExitCode)
+	}
+	if result.OutputChunks == 0 || result.OutputChunks != int64(len(recorder.chunks)) {
+		t.Errorf("result.OutputChunks = %d, %d chunks were published", result.OutputChunks, len(recorder.chunks))
+	}
+	if got := recorder.reassemble(t)[protocol.OutputStreamStdout]; got != result.Stdout || got != result.Output {
+		t.Errorf("streamed stdout %q, want the result output %q", got, result.Stdout)
+	}
+
+	// Commands whose ID cannot be a subject token are not streamed
+	recorder.chunks = nil
+	cmd.ID = "cmd.2"
+	result = executor.Execute(context.Background(), cmd)
+	if result.OutputChunks != 0 || len(recorder.chunks) != 0 {
+		t.Errorf("streamed %d chunks of a command with ID %q", len(recorder.chunks), cmd.ID)
+	}
+}
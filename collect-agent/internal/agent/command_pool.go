@@ -0,0 +1,282 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/kart-io/k8s-agent/protocol"
+
+	"github.com/kart/k8s-agent/collect-agent/internal/types"
+)
+
+// Errors of the command pool
+var (
+	errCommandQueueFull   = errors.New("command queue is full")
+	errCommandDuplicate   = errors.New("command is already queued or running")
+	errCommandPoolStopped = errors.New("agent is stopping")
+	errCommandCancelled   = errors.New("command cancelled")
+)
+
+// pooledCommand is a command waiting for a worker or running on one
+type pooledCommand struct {
+	cmd   *types.Command
+	since time.Time // when it was queued, then when it started
+
+	// cancel interrupts the command once it runs
+	cancel context.CancelCauseFunc
+}
+
+// commandPool runs commands on a bounded number of workers. Waiting commands
+// start by priority, then in the order received, skipping those whose tool has
+// reached its limit so that a slow tool does not hold up the others.
+type commandPool struct {
+	clusterID  string
+	workers    int
+	queueSize  int
+	toolLimits map[string]int
+
+	// run executes a command and report sends its result, or that of a
+	// command cancelled before it ran
+	run    func(ctx context.Context, cmd *types.Command) *types.CommandResult
+	report func(*types.CommandResult)
+	logger *zap.Logger
+
+	ctx  context.Context
+	stop context.CancelCauseFunc
+	wg   sync.WaitGroup
+
+	mu      sync.Mutex
+	queue   []*pooledCommand // in the order they will start
+	running map[string]*pooledCommand
+	perTool map[string]int
+	stopped bool
+
+	cancelled atomic.Int64
+}
+
+// newCommandPool creates a pool sized by config, running commands with run and
+// reporting results through report
+func newCommandPool(
+	clusterID string,
+	config types.CommandPoolConfig,
+	run func(ctx context.Context, cmd *types.Command) *types.CommandResult,
+	report func(*types.CommandResult),
+	logger *zap.Logger,
+) *commandPool {
+	defaults := types.DefaultConfig().CommandPool
+	if config.Workers <= 0 {
+		config.Workers = defaults.Workers
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = defaults.QueueSize
+	}
+	if config.ToolLimits == nil {
+		config.ToolLimits = defaults.ToolLimits
+	}
+
+	ctx, stop := context.WithCancelCause(context.Background())
+	return &commandPool{
+		clusterID:  clusterID,
+		workers:    config.Workers,
+		queueSize:  config.QueueSize,
+		toolLimits: config.ToolLimits,
+		run:        run,
+		report:     report,
+		logger:     logger.With(zap.String("component", "command-pool")),
+		ctx:        ctx,
+		stop:       stop,
+		running:    make(map[string]*pooledCommand),
+		perTool:    make(map[string]int),
+	}
+}
+
+// submit queues a command, starting it at once if a worker is free
+func (p *commandPool) submit(cmd *types.Command) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.stopped {
+		return errCommandPoolStopped
+	}
+	if _, ok := p.running[cmd.ID]; ok || p.queuedIndex(cmd.ID) >= 0 {
+		return errCommandDuplicate
+	}
+	if len(p.queue) >= p.queueSize {
+		return errCommandQueueFull
+	}
+
+	// After the commands of the same or a higher priority, which came first
+	entry := &pooledCommand{cmd: cmd, since: time.Now()}
+	i := sort.Search(len(p.queue), func(i int) bool {
+		return p.queue[i].cmd.Priority < cmd.Priority
+	})
+	p.queue = append(p.queue, nil)
+	copy(p.queue[i+1:], p.queue[i:])
+	p.queue[i] = entry
+
+	p.schedule()
+	return nil
+}
+
+// cancel cancels a command: a waiting command is dropped and reported
+// cancelled, and a running one is interrupted. It reports whether the command
+// was found.
+func (p *commandPool) cancel(commandID, reason string) bool {
+	cause := fmt.Errorf("%w: %s", errCommandCancelled, reason)
+
+	p.mu.Lock()
+	if entry, ok := p.running[commandID]; ok {
+		entry.cancel(cause)
+		p.mu.Unlock()
+		p.logger.Info("Cancelling running command",
+			zap.String("command_id", commandID),
+			zap.String("reason", reason))
+		return true
+	}
+
+	i := p.queuedIndex(commandID)
+	if i < 0 {
+		p.mu.Unlock()
+		return false
+	}
+	p.queue = append(p.queue[:i], p.queue[i+1:]...)
+	p.mu.Unlock()
+
+	p.logger.Info("Cancelled queued command",
+		zap.String("command_id", commandID),
+		zap.String("reason", reason))
+	p.reportCancelled(commandID, cause)
+	return true
+}
+
+// schedule starts the waiting commands that have a worker and are within the
+// limit of their tool. p.mu must be held.
+func (p *commandPool) schedule() {
+	for i := 0; i < len(p.queue) && len(p.running) < p.workers; {
+		entry := p.queue[i]
+		if p.perTool[entry.cmd.Tool] >= p.toolLimit(entry.cmd.Tool) {
+			i++
+			continue
+		}
+		p.queue = append(p.queue[:i], p.queue[i+1:]...)
+		p.start(entry)
+	}
+}
+
+// start runs a command on a new worker. p.mu must be held.
+func (p *commandPool) start(entry *pooledCommand) {
+	ctx, cancel := context.WithCancelCause(p.ctx)
+	entry.cancel = cancel
+	entry.since = time.Now()
+	p.running[entry.cmd.ID] = entry
+	p.perTool[entry.cmd.Tool]++
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer cancel(nil)
+
+		result := p.run(ctx, entry.cmd)
+		if result != nil {
+			if result.Status == protocol.CommandStatusCancelled {
+				p.cancelled.Add(1)
+			}
+			p.report(result)
+		}
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		delete(p.running, entry.cmd.ID)
+		p.perTool[entry.cmd.Tool]--
+		if !p.stopped {
+			p.schedule()
+		}
+	}()
+}
+
+// toolLimit returns how many commands of a tool may run at once
+func (p *commandPool) toolLimit(tool string) int {
+	if limit, ok := p.toolLimits[tool]; ok && limit < p.workers {
+		return limit
+	}
+	return p.workers
+}
+
+// queuedIndex returns the position of a waiting command, or -1. p.mu must be held.
+func (p *commandPool) queuedIndex(commandID string) int {
+	for i, entry := range p.queue {
+		if entry.cmd.ID == commandID {
+			return i
+		}
+	}
+	return -1
+}
+
+// state returns the running commands, oldest first, and the waiting ones in
+// the order they will start
+func (p *commandPool) state() types.CommandPoolState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	state := types.CommandPoolState{
+		Workers:   p.workers,
+		Cancelled: p.cancelled.Load(),
+	}
+	for _, entry := range p.running {
+		state.Running = append(state.Running, entry.commandState())
+	}
+	sort.Slice(state.Running, func(i, j int) bool {
+		return state.Running[i].Since.Before(state.Running[j].Since)
+	})
+	for _, entry := range p.queue {
+		state.Queued = append(state.Queued, entry.commandState())
+	}
+	return state
+}
+
+// commandState describes a pooled command
+func (e *pooledCommand) commandState() types.CommandState {
+	return types.CommandState{
+		CommandID: e.cmd.ID,
+		Tool:      e.cmd.Tool,
+		Action:    e.cmd.Action,
+		Priority:  e.cmd.Priority,
+		Since:     e.since,
+	}
+}
+
+// close refuses new commands, cancels the waiting and running ones and waits
+// for the workers to return
+func (p *commandPool) close() {
+	p.mu.Lock()
+	p.stopped = true
+	queued := p.queue
+	p.queue = nil
+	p.mu.Unlock()
+
+	cause := fmt.Errorf("%w: %v", errCommandCancelled, errCommandPoolStopped)
+	p.stop(cause)
+	for _, entry := range queued {
+		p.reportCancelled(entry.cmd.ID, cause)
+	}
+	p.wg.Wait()
+}
+
+// reportCancelled reports a command cancelled before it ran
+func (p *commandPool) reportCancelled(commandID string, cause error) {
+	p.cancelled.Add(1)
+	p.report(&types.CommandResult{
+		CommandID: commandID,
+		ClusterID: p.clusterID,
+		Status:    protocol.CommandStatusCancelled,
+		Error:     cause.Error(),
+		Timestamp: time.Now(),
+	})
+}
@@ -0,0 +1,301 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/kart-io/k8s-agent/protocol"
+
+	"github.com/kart/k8s-agent/collect-agent/internal/types"
+)
+
+// poolRunner runs pooled commands until they are released or cancelled
+type poolRunner struct {
+	started chan string
+	results chan *types.CommandResult
+
+	mu      sync.Mutex
+	release map[string]chan struct{}
+}
+
+func newPoolRunner() *poolRunner {
+	return &poolRunner{
+		started: make(chan string, 10),
+		results: make(chan *types.CommandResult, 10),
+		release: make(map[string]chan struct{}),
+	}
+}
+
+func (r *poolRunner) releaseCh(commandID string) chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.release[commandID]; !ok {
+		r.release[commandID] = make(chan struct{})
+	}
+	return r.release[commandID]
+}
+
+func (r *poolRunner) run(ctx context.Context, cmd *types.Command) *types.CommandResult {
+	r.started <- cmd.ID
+	result := &types.CommandResult{CommandID: cmd.ID, Status: protocol.CommandStatusSuccess}
+	select {
+	case <-r.releaseCh(cmd.ID):
+	case <-ctx.Done():
+		result.Status = protocol.CommandStatusFailed
+		if cause := context.Cause(ctx); errors.Is(cause, errCommandCancelled) {
+			result.Status = protocol.CommandStatusCancelled
+			result.Error = cause.Error()
+		}
+	}
+	return result
+}
+
+func (r *poolRunner) report(result *types.CommandResult) {
+	r.results <- result
+}
+
+// expectStarted checks the commands started next, in any order, and that no
+// other starts
+func (r *poolRunner) expectStarted(t *testing.T, ids ...string) {
+	t.Helper()
+	var started []string
+	for range ids {
+		select {
+		case id := <-r.started:
+			started = append(started, id)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("started %v, want %v", started, ids)
+		}
+	}
+	sort.Strings(started)
+	if want := slices.Sorted(slices.Values(ids)); !slices.Equal(started, want) {
+		t.Fatalf("started %v, want %v", started, want)
+	}
+	select {
+	case got := <-r.started:
+		t.Fatalf("started %s, want no other command", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// expectResult waits for the next reported result
+func (r *poolRunner) expectResult(t *testing.T, commandID, status string) *types.CommandResult {
+	t.Helper()
+	select {
+	case result := <-r.results:
+		if result.CommandID != commandID || result.Status != status {
+			t.Fatalf("result = %s %s, want %s %s", result.CommandID, result.Status, commandID, status)
+		}
+		return result
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no result for %s", commandID)
+		return nil
+	}
+}
+
+func poolCommand(id, tool string, priority int) *types.Command {
+	return &types.Command{ID: id, Type: "diagnostic", Tool: tool, Priority: priority}
+}
+
+func TestCommandPool_PriorityAndToolLimits(t *testing.T) {
+	runner := newPoolRunner()
+	pool := newCommandPool("test-cluster", types.CommandPoolConfig{
+		Workers:    2,
+		QueueSize:  10,
+		ToolLimits: map[string]int{"kubectl": 1},
+	}, runner.run, runner.report, zap.NewNop())
+	defer pool.close()
+
+	for _, cmd := range []*types.Command{
+		poolCommand("logs-1", "kubectl", 0),
+		poolCommand("logs-2", "kubectl", 0),
+		poolCommand("uptime-1", "uptime", 0),
+		poolCommand("uptime-2", "uptime", 5),
+	} {
+		if err := pool.submit(cmd); err != nil {
+			t.Fatalf("submit(%s) failed: %v", cmd.ID, err)
+		}
+	}
+
+	// The second kubectl command waits for the first despite a free worker
+	runner.expectStarted(t, "logs-1", "uptime-1")
+	state := pool.state()
+	if len(state.Running) != 2 || len(state.Queued) != 2 ||
+		state.Queued[0].CommandID != "uptime-2" || state.Queued[1].CommandID != "logs-2" {
+		t.Fatalf("state = %+v, want 2 running and uptime-2 queued before logs-2", state)
+	}
+
+	// A freed worker goes to the higher priority
+	close(runner.releaseCh("uptime-1"))
+	runner.expectResult(t, "uptime-1", protocol.CommandStatusSuccess)
+	runner.expectStarted(t, "uptime-2")
+
+	close(runner.releaseCh("logs-1"))
+	runner.expectResult(t, "logs-1", protocol.CommandStatusSuccess)
+	runner.expectStarted(t, "logs-2")
+
+	close(runner.releaseCh("uptime-2"))
+	runner.expectResult(t, "uptime-2", protocol.CommandStatusSuccess)
+	close(runner.releaseCh("logs-2"))
+	runner.expectResult(t, "logs-2", protocol.CommandStatusSuccess)
+}
+
+func TestCommandPool_Cancel(t *testing.T) {
+	runner := newPoolRunner()
+	pool := newCommandPool("test-cluster", types.CommandPoolConfig{Workers: 1},
+		runner.run, runner.report, zap.NewNop())
+	defer pool.close()
+
+	pool.submit(poolCommand("cmd-1", "uptime", 0))
+	pool.submit(poolCommand("cmd-2", "uptime", 0))
+	runner.expectStarted(t, "cmd-1")
+
+	// A queued command is reported cancelled without running
+	if !pool.cancel("cmd-2", "not needed") {
+		t.Fatal("cancel(cmd-2) = false, want true")
+	}
+	result := runner.expectResult(t, "cmd-2", protocol.CommandStatusCancelled)
+	if result.ClusterID != "test-cluster" || result.Error != "command cancelled: not needed" {
+		t.Errorf("result = %s %q, want the cluster and reason", result.ClusterID, result.Error)
+	}
+
+	// A running command is interrupted with the reason as cause
+	if !pool.cancel("cmd-1", "taking too long") {
+		t.Fatal("cancel(cmd-1) = false, want true")
+	}
+	result = runner.expectResult(t, "cmd-1", protocol.CommandStatusCancelled)
+	if !strings.HasSuffix(result.Error, "taking too long") {
+		t.Errorf("error = %q, want the reason", result.Error)
+	}
+	runner.expectStarted(t)
+
+	if pool.cancel("cmd-3", "unknown") {
+		t.Error("cancel of an unknown command = true, want false")
+	}
+	if state := pool.state(); state.Cancelled != 2 || len(state.Running)+len(state.Queued) != 0 {
+		t.Errorf("state = %+v, want 2 cancelled and none left", state)
+	}
+}
+
+func TestCommandPool_Refused(t *testing.T) {
+	runner := newPoolRunner()
+	pool := newCommandPool("test-cluster", types.CommandPoolConfig{Workers: 1, QueueSize: 1},
+		runner.run, runner.report, zap.NewNop())
+
+	if err := pool.submit(poolCommand("cmd-1", "uptime", 0)); err != nil {
+		t.Fatalf("submit failed: %v", err)
+	}
+	runner.expectStarted(t, "cmd-1")
+	if err := pool.submit(poolCommand("cmd-2", "uptime", 0)); err != nil {
+		t.Fatalf("submit failed: %v", err)
+	}
+
+	tests := []struct {
+		id   string
+		want error
+	}{
+		{"cmd-3", errCommandQueueFull},
+		{"cmd-1", errCommandDuplicate},
+		{"cmd-2", errCommandDuplicate},
+	}
+	for _, tt := range tests {
+		if err := pool.submit(poolCommand(tt.id, "uptime", 0)); !errors.Is(err, tt.want) {
+			t.Errorf("submit(%s) error = %v, want %v", tt.id, err, tt.want)
+		}
+	}
+
+	// Closing cancels the queued and running commands
+	pool.close()
+	statuses := map[string]string{}
+	for range 2 {
+		result := <-runner.results
+		statuses[result.CommandID] = result.Status
+	}
+	for _, id := range []string{"cmd-1", "cmd-2"} {
+		if statuses[id] != protocol.CommandStatusCancelled {
+			t.Errorf("status of %s = %q, want cancelled", id, statuses[id])
+		}
+	}
+	if err := pool.submit(poolCommand("cmd-4", "uptime", 0)); !errors.Is(err, errCommandPoolStopped) {
+		t.Errorf("submit after close error = %v, want %v", err, errCommandPoolStopped)
+	}
+}
+
+func TestExecute_Cancelled(t *testing.T) {
+	executor := NewCommandExecutor(fake.NewSimpleClientset(), "test-cluster", zap.NewNop())
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(fmt.Errorf("%w: stop", errCommandCancelled))
+
+	result := executor.Execute(ctx, types.Command{ID: "cmd-1", Type: "diagnostic", Tool: "uptime"})
+	if result.Status != protocol.CommandStatusCancelled || result.Error != "command cancelled: stop" || result.ExitCode != nil {
+		t.Errorf("result = %s %q exit %v, want cancelled with the reason", result.Status, result.Error, result.ExitCode)
+	}
+}
+
+func TestHandleCommandMessages(t *testing.T) {
+	agent := &Agent{
+		clusterID:   "test-cluster",
+		logger:      zap.NewNop(),
+		eventChan:   make(chan *types.Event, 10),
+		metricsChan: make(chan *types.Metrics, 10),
+		resultChan:  make(chan *types.CommandResult, 10),
+		stopCh:      make(chan struct{}),
+		running:     true,
+	}
+	// Commands hold their worker until the pool closes
+	agent.commandPool = newCommandPool("test-cluster", types.CommandPoolConfig{Workers: 1},
+		func(ctx context.Context, cmd *types.Command) *types.CommandResult {
+			<-ctx.Done()
+			return &types.CommandResult{CommandID: cmd.ID, Status: protocol.CommandStatusCancelled}
+		}, agent.queueResult, zap.NewNop())
+	cm := &CommunicationManager{clusterID: "test-cluster", logger: zap.NewNop(), commandHandler: agent.handleCommand}
+
+	deliver := func(cmd *types.Command) {
+		data, err := protocol.Encode(protocol.MessageTypeCommand, "agent-manager", "test-cluster", cmd)
+		if err != nil {
+			t.Fatalf("Encode failed: %v", err)
+		}
+		cm.handleCommandMessage(&nats.Msg{Data: data})
+	}
+	cancel := &types.Command{
+		ID:     "cancel-1",
+		Type:   protocol.CommandTypeCancel,
+		Params: map[string]string{protocol.CommandParamCommandID: "cmd-3"},
+	}
+
+	// The cancel finds the command delivered just before it, and the
+	// commands of equal priority queue in the order delivered
+	for _, cmd := range []*types.Command{poolCommand("cmd-1", "uptime", 0), poolCommand("cmd-2", "uptime", 0), poolCommand("cmd-3", "uptime", 0), cancel} {
+		deliver(cmd)
+	}
+	if result := <-agent.resultChan; result.CommandID != "cmd-3" || result.Status != protocol.CommandStatusCancelled {
+		t.Errorf("result = %s %s, want cmd-3 cancelled", result.CommandID, result.Status)
+	}
+	state := agent.commandPool.state()
+	if len(state.Queued) != 1 || state.Queued[0].CommandID != "cmd-2" {
+		t.Errorf("queued = %+v, want cmd-2", state.Queued)
+	}
+
+	// Commands delivered once the agent stopped are dropped, rather than
+	// reported on the closed result channel
+	if err := agent.Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+	deliver(poolCommand("cmd-4", "uptime", 0))
+	for result := range agent.resultChan {
+		if result.CommandID == "cmd-4" {
+			t.Errorf("result of cmd-4 = %s, want none", result.Status)
+		}
+	}
+}
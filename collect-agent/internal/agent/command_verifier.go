@@ -0,0 +1,175 @@
+package agent
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/kart-io/k8s-agent/protocol"
+
+	"github.com/kart/k8s-agent/collect-agent/internal/rules"
+	"github.com/kart/k8s-agent/collect-agent/internal/types"
+)
+
+// Audit events of commands refused by the verifier
+const (
+	commandAuditEventType   = "command_rejected"
+	commandAuditEventSource = "command-verifier"
+)
+
+// errCommandLifetime refuses signatures valid for longer than the agent
+// remembers nonces
+var errCommandLifetime = errors.New("command is valid for too long")
+
+// commandVerifier checks the signatures of commands against the public keys
+// of agent-manager, and remembers their nonces until they expire so that a
+// signed command cannot be replayed. Nonces seen before the agent started
+// are unknown, so commands issued before then are refused as well.
+type commandVerifier struct {
+	clusterID string
+	keys      map[string]ed25519.PublicKey
+	config    types.CommandSigningConfig
+	startedAt time.Time
+	now       func() time.Time
+
+	mu     sync.Mutex
+	nonces map[string]time.Time // until when each nonce is remembered
+}
+
+// newCommandVerifier creates a verifier of the commands bound for clusterID
+func newCommandVerifier(clusterID string, config types.CommandSigningConfig) (*commandVerifier, error) {
+	keys := make(map[string]ed25519.PublicKey, len(config.PublicKeys))
+	for keyID, encoded := range config.PublicKeys {
+		key, err := protocol.ParsePublicKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse public key %q: %w", keyID, err)
+		}
+		keys[keyID] = key
+	}
+
+	return &commandVerifier{
+		clusterID: clusterID,
+		keys:      keys,
+		config:    config,
+		startedAt: time.Now(),
+		now:       time.Now,
+		nonces:    make(map[string]time.Time),
+	}, nil
+}
+
+// verify returns why a command must not run, or nil when it may
+func (v *commandVerifier) verify(cmd *types.Command) error {
+	if cmd.Signature == nil && v.config.AllowUnsigned {
+		return nil
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	now := v.now()
+	for nonce, until := range v.nonces {
+		if now.After(until) {
+			delete(v.nonces, nonce)
+		}
+	}
+
+	skew := v.config.MaxClockSkew
+	if err := protocol.VerifyCommandSignature(cmd, v.clusterID, v.keys, now, skew); err != nil {
+		return err
+	}
+
+	sig := cmd.Signature
+	if lifetime := sig.ExpiresAt.Sub(sig.IssuedAt); lifetime > v.config.MaxLifetime {
+		return fmt.Errorf("%w: %v, more than %v", errCommandLifetime, lifetime, v.config.MaxLifetime)
+	}
+	if sig.IssuedAt.Before(v.startedAt.Add(-skew)) {
+		return fmt.Errorf("%w: issued before the agent started", protocol.ErrCommandReplayed)
+	}
+
+	if _, ok := v.nonces[sig.Nonce]; ok {
+		return fmt.Errorf("%w: nonce %s", protocol.ErrCommandReplayed, sig.Nonce)
+	}
+	v.nonces[sig.Nonce] = sig.ExpiresAt.Add(skew)
+	return nil
+}
+
+// commandRejectionReason returns the event reason of a verification error
+func commandRejectionReason(err error) string {
+	switch {
+	case errors.Is(err, protocol.ErrCommandUnsigned):
+		return "UnsignedCommand"
+	case errors.Is(err, protocol.ErrCommandUnknownKey):
+		return "UnknownSigningKey"
+	case errors.Is(err, protocol.ErrCommandExpired), errors.Is(err, protocol.ErrCommandNotYetValid), errors.Is(err, errCommandLifetime):
+		return "CommandOutsideValidity"
+	case errors.Is(err, protocol.ErrCommandReplayed):
+		return "ReplayedCommand"
+	default:
+		return "InvalidSignature"
+	}
+}
+
+// rejectCommand reports a command refused by the verifier, with a result of
+// status rejected and an audit event
+func (a *Agent) rejectCommand(cmd *types.Command, err error) {
+	a.metrics.observeCommand(a.commandExecutor.toolLabel(cmd.Tool), protocol.CommandStatusRejected, 0)
+	a.logger.Warn("Command rejected",
+		zap.String("command_id", cmd.ID),
+		zap.String("tool", cmd.Tool),
+		zap.String("action", cmd.Action),
+		zap.Error(err))
+
+	now := time.Now()
+	result := &types.CommandResult{
+		CommandID: cmd.ID,
+		ClusterID: a.clusterID,
+		Status:    protocol.CommandStatusRejected,
+		Error:     fmt.Sprintf("Command verification failed: %v", err),
+		Timestamp: now,
+	}
+	a.queueResult(result)
+
+	labels := map[string]string{
+		"command_id": cmd.ID,
+		"tool":       cmd.Tool,
+		"action":     cmd.Action,
+	}
+	rawData := map[string]interface{}{
+		"error":  err.Error(),
+		"args":   cmd.Args,
+		"params": cmd.Params,
+	}
+	if sig := cmd.Signature; sig != nil {
+		labels["key_id"] = sig.KeyID
+		rawData["nonce"] = sig.Nonce
+		rawData["issued_at"] = sig.IssuedAt
+		rawData["expires_at"] = sig.ExpiresAt
+	}
+
+	event := &types.Event{
+		ID:         protocol.NewMessageID(),
+		ClusterID:  a.clusterID,
+		Type:       commandAuditEventType,
+		Source:     commandAuditEventSource,
+		Severity:   rules.SeverityHigh,
+		Reason:     commandRejectionReason(err),
+		Message:    fmt.Sprintf("Refused %s command %s: %v", cmd.Tool, cmd.ID, err),
+		Timestamp:  now,
+		ReportedAt: now,
+		Labels:     labels,
+		RawData:    rawData,
+	}
+	select {
+	case a.eventChan <- event:
+	default:
+		if a.communicationManager == nil || !a.communicationManager.SpoolEvent(event) {
+			a.metrics.eventDropped(eventDropQueueFull)
+			a.logger.Warn("Event channel full, dropping command audit event",
+				zap.String("command_id", cmd.ID))
+		}
+	}
+}
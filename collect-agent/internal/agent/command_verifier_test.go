@@ -0,0 +1,155 @@
+package agent
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/kart-io/k8s-agent/protocol"
+
+	"github.com/kart/k8s-agent/collect-agent/internal/types"
+)
+
+// newTestSigner returns a signer and the verifier config accepting its key
+func newTestSigner(t *testing.T, ttl time.Duration) (*protocol.CommandSigner, types.CommandSigningConfig) {
+	t.Helper()
+
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	config := types.DefaultConfig().CommandSigning
+	config.Enabled = true
+	config.PublicKeys = map[string]string{"manager-1": base64.StdEncoding.EncodeToString(public)}
+	return protocol.NewCommandSigner("manager-1", private, ttl), config
+}
+
+// signedCommand returns a command signed for clusterID
+func signedCommand(t *testing.T, signer *protocol.CommandSigner, clusterID string) *types.Command {
+	t.Helper()
+
+	cmd := &types.Command{ID: "cmd-1", Type: "diagnostic", Tool: "uptime", CreatedAt: time.Now()}
+	if err := signer.Sign(cmd, clusterID); err != nil {
+		t.Fatalf("Sign failed: %v", err)
+	}
+	return cmd
+}
+
+func TestCommandVerifier(t *testing.T) {
+	signer, config := newTestSigner(t, 5*time.Minute)
+	verifier, err := newCommandVerifier("test-cluster", config)
+	if err != nil {
+		t.Fatalf("newCommandVerifier failed: %v", err)
+	}
+
+	cmd := signedCommand(t, signer, "test-cluster")
+	if err := verifier.verify(cmd); err != nil {
+		t.Fatalf("verify() error = %v, want nil", err)
+	}
+	if err := verifier.verify(cmd); !errors.Is(err, protocol.ErrCommandReplayed) {
+		t.Errorf("verify() of a replay error = %v, want %v", err, protocol.ErrCommandReplayed)
+	}
+
+	// Nonces are forgotten once their command has expired
+	verifier.now = func() time.Time { return time.Now().Add(time.Hour) }
+	if err := verifier.verify(signedCommand(t, signer, "test-cluster")); !errors.Is(err, protocol.ErrCommandExpired) {
+		t.Errorf("verify() of an expired command error = %v, want %v", err, protocol.ErrCommandExpired)
+	}
+	if len(verifier.nonces) != 0 {
+		t.Errorf("nonces = %v, want the expired nonce forgotten", verifier.nonces)
+	}
+	verifier.now = time.Now
+
+	tests := []struct {
+		name    string
+		cmd     func() *types.Command
+		wantErr error
+	}{
+		{"unsigned", func() *types.Command { return &types.Command{ID: "cmd-2", Tool: "uptime"} }, protocol.ErrCommandUnsigned},
+		{"unknown key", func() *types.Command {
+			otherSigner, _ := newTestSigner(t, time.Minute)
+			cmd := signedCommand(t, otherSigner, "test-cluster")
+			cmd.Signature.KeyID = "manager-2"
+			return cmd
+		}, protocol.ErrCommandUnknownKey},
+		{"other cluster", func() *types.Command { return signedCommand(t, signer, "other-cluster") }, protocol.ErrCommandBadSignature},
+		{"issued before start", func() *types.Command {
+			cmd := signedCommand(t, signer, "test-cluster")
+			verifier.startedAt = time.Now().Add(time.Minute)
+			return cmd
+		}, protocol.ErrCommandReplayed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() { verifier.startedAt = time.Now().Add(-time.Minute) }()
+			if err := verifier.verify(tt.cmd()); !errors.Is(err, tt.wantErr) {
+				t.Errorf("verify() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	longSigner, longConfig := newTestSigner(t, time.Hour)
+	verifier, _ = newCommandVerifier("test-cluster", longConfig)
+	if err := verifier.verify(signedCommand(t, longSigner, "test-cluster")); !errors.Is(err, errCommandLifetime) {
+		t.Errorf("verify() of a long-lived command error = %v, want %v", err, errCommandLifetime)
+	}
+
+	config.AllowUnsigned = true
+	verifier, _ = newCommandVerifier("test-cluster", config)
+	if err := verifier.verify(&types.Command{ID: "cmd-3", Tool: "uptime"}); err != nil {
+		t.Errorf("verify() of an allowed unsigned command error = %v, want nil", err)
+	}
+}
+
+func TestHandleCommandRejected(t *testing.T) {
+	signer, config := newTestSigner(t, 5*time.Minute)
+	verifier, err := newCommandVerifier("test-cluster", config)
+	if err != nil {
+		t.Fatalf("newCommandVerifier failed: %v", err)
+	}
+
+	agent := &Agent{
+		clusterID:       "test-cluster",
+		logger:          zap.NewNop(),
+		commandExecutor: NewCommandExecutor(fake.NewSimpleClientset(), "test-cluster", zap.NewNop()),
+		commandVerifier: verifier,
+		eventChan:       make(chan *types.Event, 1),
+		resultChan:      make(chan *types.CommandResult, 1),
+	}
+	// Commands hold their worker until the pool closes
+	agent.commandPool = newCommandPool("test-cluster", types.CommandPoolConfig{},
+		func(ctx context.Context, cmd *types.Command) *types.CommandResult {
+			<-ctx.Done()
+			return nil
+		}, agent.queueResult, zap.NewNop())
+	defer agent.commandPool.close()
+
+	cmd := signedCommand(t, signer, "test-cluster")
+	cmd.Tool = "whoami"
+	agent.handleCommand(cmd)
+
+	if state := agent.commandPool.state(); len(state.Running)+len(state.Queued) != 0 {
+		t.Error("a tampered command was queued")
+	}
+	result := <-agent.resultChan
+	if result.Status != protocol.CommandStatusRejected || !strings.Contains(result.Error, "signature is invalid") {
+		t.Errorf("result = %v: %v, want rejected for its signature", result.Status, result.Error)
+	}
+	event := <-agent.eventChan
+	if event.Type != commandAuditEventType || event.Reason != "InvalidSignature" || event.Labels["key_id"] != "manager-1" {
+		t.Errorf("audit event = %v %v %v, want an InvalidSignature rejection", event.Type, event.Reason, event.Labels)
+	}
+
+	agent.handleCommand(signedCommand(t, signer, "test-cluster"))
+	if state := agent.commandPool.state(); len(state.Running) != 1 {
+		t.Error("a signed command was not queued")
+	}
+}
@@ -2,7 +2,7 @@ package agent
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
@@ -10,24 +10,77 @@ import (
 	"github.com/nats-io/nats.go"
 	"go.uber.org/zap"
 
+	"github.com/kart-io/k8s-agent/protocol"
+
+	"github.com/kart/k8s-agent/collect-agent/internal/spool"
 	"github.com/kart/k8s-agent/collect-agent/internal/types"
 )
 
-// CommunicationManager handles all NATS communication for the agent
+const (
+	// registerTimeout bounds how long the agent waits for a registration reply
+	registerTimeout = 10 * time.Second
+
+	// spoolDrainInterval is how often the spool is drained while connected
+	spoolDrainInterval = 5 * time.Second
+
+	// defaultMaxPayload is the max_payload of NATS servers by default
+	defaultMaxPayload = 1024 * 1024
+
+	// resultPayloadMargin leaves room in a message for the headers, such as
+	// Nats-Msg-Id, besides the encoded result
+	resultPayloadMargin = 4 * 1024
+)
+
+// ErrRegistrationRejected is returned when agent-manager refuses the registration
+var ErrRegistrationRejected = errors.New("registration rejected by agent-manager")
+
+// errNotConnected is returned when publishing without a NATS connection
+var errNotConnected = errors.New("not connected to NATS")
+
+// transientPublishErrors are the publish errors a later retry can get past
+var transientPublishErrors = []error{
+	errNotConnected,
+	nats.ErrTimeout,
+	context.DeadlineExceeded,
+	nats.ErrConnectionClosed,
+	nats.ErrConnectionDraining,
+	nats.ErrConnectionReconnecting,
+	nats.ErrDisconnected,
+	nats.ErrInvalidConnection,
+	nats.ErrNoServers,
+}
+
+// CommunicationManager handles the NATS communication of one cluster over the
+// connection shared by all clusters of the agent
 type CommunicationManager struct {
-	config      *types.AgentConfig
-	clusterID   string
-	natsConn    *nats.Conn
-	logger      *zap.Logger
-	mu          sync.RWMutex
-	connected   bool
-	stopCh      chan struct{}
-	wg          sync.WaitGroup
+	config     *types.AgentConfig
+	clusterID  string
+	conn       *Connection
+	commandSub *nats.Subscription
+	logger     *zap.Logger
+	mu         sync.RWMutex
+	started    bool
+	stopCh     chan struct{}
+	wg         sync.WaitGroup
+
+	// agentID is assigned by agent-manager when registration is accepted
+	agentID   string
+	agentIDMu sync.RWMutex
+
+	// spool buffers outgoing messages on disk while NATS is unreachable, nil when disabled
+	spool   *spool.Spool
+	drainCh chan struct{}
+
+	// statusProvider supplies the agent status reported in heartbeats
+	statusProvider func() AgentStatus
+
+	health  componentHealth
+	metrics *agentMetrics
 
 	// Channels for different message types
-	eventChan   <-chan *types.Event
-	metricsChan <-chan *types.Metrics
-	resultChan  <-chan *types.CommandResult
+	eventChan      <-chan *types.Event
+	metricsChan    <-chan *types.Metrics
+	resultChan     <-chan *types.CommandResult
 	commandHandler func(*types.Command)
 }
 
@@ -35,32 +88,47 @@ type CommunicationManager struct {
 func NewCommunicationManager(
 	config *types.AgentConfig,
 	clusterID string,
+	conn *Connection,
 	eventChan <-chan *types.Event,
 	metricsChan <-chan *types.Metrics,
 	resultChan <-chan *types.CommandResult,
 	commandHandler func(*types.Command),
+	outbox *spool.Spool,
 	logger *zap.Logger,
 ) *CommunicationManager {
 	return &CommunicationManager{
 		config:         config,
 		clusterID:      clusterID,
+		conn:           conn,
 		eventChan:      eventChan,
 		metricsChan:    metricsChan,
 		resultChan:     resultChan,
 		commandHandler: commandHandler,
+		spool:          outbox,
+		drainCh:        make(chan struct{}, 1),
 		logger:         logger.With(zap.String("component", "communication")),
 		stopCh:         make(chan struct{}),
 	}
 }
 
-// Start initializes the NATS connection and starts message handling
+// Start registers the cluster and starts message handling. The shared
+// connection must already be connected.
 func (cm *CommunicationManager) Start(ctx context.Context) error {
-	if err := cm.connect(); err != nil {
-		return fmt.Errorf("failed to connect to NATS: %w", err)
+	if !cm.conn.IsConnected() {
+		return errNotConnected
 	}
 
+	cm.mu.Lock()
+	cm.started = true
+	cm.mu.Unlock()
+	cm.conn.addListener(cm)
+
 	if err := cm.register(); err != nil {
-		return fmt.Errorf("failed to register agent: %w", err)
+		if errors.Is(err, ErrRegistrationRejected) {
+			return err
+		}
+		// agent-manager may be restarting; registration is retried on reconnect
+		cm.logger.Warn("Agent registration not acknowledged", zap.Error(err))
 	}
 
 	// Start message handlers
@@ -70,6 +138,11 @@ func (cm *CommunicationManager) Start(ctx context.Context) error {
 	go cm.handleResults(ctx)
 	go cm.handleHeartbeat(ctx)
 
+	if cm.spool != nil {
+		cm.wg.Add(1)
+		go cm.drainSpool(ctx)
+	}
+
 	// Subscribe to commands
 	if err := cm.subscribeToCommands(); err != nil {
 		return fmt.Errorf("failed to subscribe to commands: %w", err)
@@ -82,130 +155,162 @@ func (cm *CommunicationManager) Start(ctx context.Context) error {
 	return nil
 }
 
-// Stop stops the communication manager and closes connections
+// SetStatusProvider sets the function supplying the agent status sent in heartbeats
+func (cm *CommunicationManager) SetStatusProvider(provider func() AgentStatus) {
+	cm.statusProvider = provider
+}
+
+// Stop stops the message handlers and command subscription. The shared
+// connection is left open for the other clusters.
 func (cm *CommunicationManager) Stop() error {
 	cm.mu.Lock()
-	defer cm.mu.Unlock()
-
-	if !cm.connected {
+	if !cm.started {
+		cm.mu.Unlock()
 		return nil
 	}
+	cm.started = false
+	cm.mu.Unlock()
 
 	cm.logger.Info("Stopping communication manager")
+	cm.conn.removeListener(cm)
 
+	// Handlers may read the connection state, so wait without holding cm.mu
 	close(cm.stopCh)
 	cm.wg.Wait()
 
-	if cm.natsConn != nil {
-		cm.natsConn.Close()
+	// Publish the events queued while stopping, such as pending event summaries,
+	// and the results of the commands cancelled by it
+	cm.flushEvents()
+	cm.flushResults()
+
+	if cm.commandSub != nil {
+		if err := cm.commandSub.Unsubscribe(); err != nil && !errors.Is(err, nats.ErrConnectionClosed) {
+			cm.logger.Warn("Failed to unsubscribe from commands", zap.Error(err))
+		}
 	}
 
-	cm.connected = false
 	cm.logger.Info("Communication manager stopped")
 	return nil
 }
 
-// connect establishes connection to NATS server
-func (cm *CommunicationManager) connect() error {
-	cm.logger.Info("Connecting to NATS", zap.String("endpoint", cm.config.CentralEndpoint))
-
-	opts := []nats.Option{
-		nats.Name(fmt.Sprintf("agent-%s", cm.clusterID)),
-		nats.ReconnectWait(cm.config.ReconnectDelay),
-		nats.MaxReconnects(cm.config.MaxRetries),
-		nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
-			cm.logger.Warn("Disconnected from NATS",
-				zap.String("cluster_id", cm.clusterID),
-				zap.Error(err))
-		}),
-		nats.ReconnectHandler(func(nc *nats.Conn) {
-			cm.logger.Info("Reconnected to NATS",
-				zap.String("cluster_id", cm.clusterID),
-				zap.String("url", nc.ConnectedUrl()))
-		}),
-		nats.ClosedHandler(func(nc *nats.Conn) {
-			cm.logger.Warn("NATS connection closed",
-				zap.String("cluster_id", cm.clusterID))
-		}),
-		nats.ErrorHandler(func(nc *nats.Conn, sub *nats.Subscription, err error) {
-			cm.logger.Error("NATS error",
-				zap.String("cluster_id", cm.clusterID),
-				zap.String("subject", sub.Subject),
-				zap.Error(err))
-		}),
-	}
-
-	nc, err := nats.Connect(cm.config.CentralEndpoint, opts...)
-	if err != nil {
-		return fmt.Errorf("failed to connect to NATS: %w", err)
-	}
-
-	cm.natsConn = nc
-	cm.connected = true
-	cm.logger.Info("Connected to NATS", zap.String("url", nc.ConnectedUrl()))
+// onDisconnect records the loss of the shared connection
+func (cm *CommunicationManager) onDisconnect(err error) {
+	cm.health.recordError(err)
+}
 
-	return nil
+// onReconnect registers again and drains the spool after the shared connection is restored
+func (cm *CommunicationManager) onReconnect() {
+	if err := cm.register(); err != nil {
+		cm.logger.Error("Failed to re-register agent", zap.Error(err))
+	}
+	cm.triggerDrain()
 }
 
-// register sends agent registration information to central
+// register sends agent registration information to central and waits for
+// agent-manager to accept the announced protocol version
 func (cm *CommunicationManager) register() error {
 	agentInfo := types.AgentInfo{
-		ClusterID:   cm.clusterID,
-		Version:     "v1.0.0", // This should come from version package
-		StartTime:   time.Now(),
-		Capabilities: []string{"event_watch", "metrics_collect", "command_execute"},
+		ClusterID:       cm.clusterID,
+		Version:         "v1.0.0", // This should come from version package
+		ProtocolVersion: protocol.Version,
+		StartTime:       time.Now(),
+		Capabilities:    []string{"event_watch", "metrics_collect", "command_execute"},
 	}
 
-	data, err := json.Marshal(agentInfo)
+	data, err := protocol.Encode(protocol.MessageTypeRegister, cm.sender(), cm.clusterID, agentInfo)
 	if err != nil {
-		return fmt.Errorf("failed to marshal agent info: %w", err)
+		return fmt.Errorf("failed to encode register message: %w", err)
+	}
+
+	nc, _ := cm.conn.conn()
+	if nc == nil {
+		return errNotConnected
 	}
 
-	subject := fmt.Sprintf("agent.register.%s", cm.clusterID)
-	if err := cm.natsConn.Publish(subject, data); err != nil {
-		return fmt.Errorf("failed to publish register message: %w", err)
+	subject := protocol.RegisterSubject(cm.clusterID)
+	reply, err := nc.Request(subject, data, registerTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to send register request: %w", err)
+	}
+
+	env, err := protocol.Unmarshal(reply.Data)
+	if err != nil {
+		return fmt.Errorf("failed to decode register reply: %w", err)
 	}
 
-	cm.logger.Info("Agent registered", zap.String("cluster_id", cm.clusterID))
+	var ack protocol.RegistrationAck
+	if err := env.DecodePayload(protocol.MessageTypeRegisterAck, &ack); err != nil {
+		return fmt.Errorf("failed to decode register reply: %w", err)
+	}
+
+	if !ack.Accepted {
+		return fmt.Errorf("%w: %s (agent protocol version %d)",
+			ErrRegistrationRejected, ack.Reason, protocol.Version)
+	}
+
+	cm.agentIDMu.Lock()
+	cm.agentID = ack.AgentID
+	cm.agentIDMu.Unlock()
+
+	cm.logger.Info("Agent registered",
+		zap.String("cluster_id", cm.clusterID),
+		zap.String("agent_id", ack.AgentID),
+		zap.Int("protocol_version", ack.ProtocolVersion))
 	return nil
 }
 
 // subscribeToCommands subscribes to command messages from central
 func (cm *CommunicationManager) subscribeToCommands() error {
-	subject := fmt.Sprintf("agent.command.%s", cm.clusterID)
+	subject := protocol.CommandSubject(cm.clusterID)
 
-	_, err := cm.natsConn.Subscribe(subject, func(msg *nats.Msg) {
-		var cmd types.Command
-		if err := json.Unmarshal(msg.Data, &cmd); err != nil {
-			cm.logger.Error("Failed to unmarshal command", zap.Error(err))
-			return
-		}
-
-		cm.logger.Info("Received command",
-			zap.String("cluster_id", cm.clusterID),
-			zap.String("command_id", cmd.ID),
-			zap.String("tool", cmd.Tool),
-			zap.String("action", cmd.Action))
-
-		// Handle command asynchronously
-		if cm.commandHandler != nil {
-			go cm.commandHandler(&cmd)
-		}
-	})
+	nc, _ := cm.conn.conn()
+	if nc == nil {
+		return errNotConnected
+	}
 
+	sub, err := nc.Subscribe(subject, cm.handleCommandMessage)
 	if err != nil {
 		return fmt.Errorf("failed to subscribe to commands: %w", err)
 	}
+	cm.commandSub = sub
 
 	cm.logger.Info("Subscribed to commands", zap.String("subject", subject))
 	return nil
 }
 
+// handleCommandMessage decodes a command and passes it to the command
+// handler. Commands are handled one at a time in the order received, so that
+// those of equal priority queue in that order and cancels follow the
+// commands they name; the handler only queues commands and does not block.
+func (cm *CommunicationManager) handleCommandMessage(msg *nats.Msg) {
+	env, err := protocol.Decode(msg.Data)
+	if err != nil {
+		cm.logger.Error("Failed to decode command envelope", zap.Error(err))
+		return
+	}
+
+	var cmd types.Command
+	if err := env.DecodePayload(protocol.MessageTypeCommand, &cmd); err != nil {
+		cm.logger.Error("Failed to unmarshal command", zap.Error(err))
+		return
+	}
+
+	cm.logger.Info("Received command",
+		zap.String("cluster_id", cm.clusterID),
+		zap.String("command_id", cmd.ID),
+		zap.String("tool", cmd.Tool),
+		zap.String("action", cmd.Action))
+
+	if cm.commandHandler != nil {
+		cm.commandHandler(&cmd)
+	}
+}
+
 // handleEvents handles event publishing
 func (cm *CommunicationManager) handleEvents(ctx context.Context) {
 	defer cm.wg.Done()
 
-	subject := fmt.Sprintf("agent.event.%s", cm.clusterID)
+	subject := protocol.EventSubject(cm.clusterID)
 
 	for {
 		select {
@@ -227,11 +332,53 @@ func (cm *CommunicationManager) handleEvents(ctx context.Context) {
 	}
 }
 
+// flushEvents publishes the events left in the event channel
+func (cm *CommunicationManager) flushEvents() {
+	subject := protocol.EventSubject(cm.clusterID)
+
+	for {
+		select {
+		case event := <-cm.eventChan:
+			if event == nil {
+				continue
+			}
+			if err := cm.publishEvent(subject, event); err != nil {
+				cm.logger.Error("Failed to publish event",
+					zap.Error(err),
+					zap.String("event_id", event.ID))
+			}
+		default:
+			return
+		}
+	}
+}
+
+// flushResults publishes the command results still queued
+func (cm *CommunicationManager) flushResults() {
+	subject := protocol.ResultSubject(cm.clusterID)
+
+	for {
+		select {
+		case result := <-cm.resultChan:
+			if result == nil {
+				continue
+			}
+			if err := cm.publishResult(subject, result); err != nil {
+				cm.logger.Error("Failed to publish result",
+					zap.Error(err),
+					zap.String("command_id", result.CommandID))
+			}
+		default:
+			return
+		}
+	}
+}
+
 // handleMetrics handles metrics publishing
 func (cm *CommunicationManager) handleMetrics(ctx context.Context) {
 	defer cm.wg.Done()
 
-	subject := fmt.Sprintf("agent.metrics.%s", cm.clusterID)
+	subject := protocol.MetricsSubject(cm.clusterID)
 
 	for {
 		select {
@@ -255,7 +402,7 @@ func (cm *CommunicationManager) handleMetrics(ctx context.Context) {
 func (cm *CommunicationManager) handleResults(ctx context.Context) {
 	defer cm.wg.Done()
 
-	subject := fmt.Sprintf("agent.result.%s", cm.clusterID)
+	subject := protocol.ResultSubject(cm.clusterID)
 
 	for {
 		select {
@@ -284,7 +431,7 @@ func (cm *CommunicationManager) handleHeartbeat(ctx context.Context) {
 	ticker := time.NewTicker(cm.config.HeartbeatInterval)
 	defer ticker.Stop()
 
-	subject := fmt.Sprintf("agent.heartbeat.%s", cm.clusterID)
+	subject := protocol.HeartbeatSubject(cm.clusterID)
 
 	// Send initial heartbeat
 	cm.sendHeartbeat(subject)
@@ -306,12 +453,7 @@ func (cm *CommunicationManager) publishEvent(subject string, event *types.Event)
 	event.ClusterID = cm.clusterID
 	event.ReportedAt = time.Now()
 
-	data, err := json.Marshal(event)
-	if err != nil {
-		return fmt.Errorf("failed to marshal event: %w", err)
-	}
-
-	if err := cm.natsConn.Publish(subject, data); err != nil {
+	if err := cm.publishDurable(subject, protocol.MessageTypeEvent, event, eventPriority(event)); err != nil {
 		return fmt.Errorf("failed to publish event: %w", err)
 	}
 
@@ -327,12 +469,7 @@ func (cm *CommunicationManager) publishMetrics(subject string, metrics *types.Me
 	metrics.ClusterID = cm.clusterID
 	metrics.Timestamp = time.Now()
 
-	data, err := json.Marshal(metrics)
-	if err != nil {
-		return fmt.Errorf("failed to marshal metrics: %w", err)
-	}
-
-	if err := cm.natsConn.Publish(subject, data); err != nil {
+	if err := cm.publishDurable(subject, protocol.MessageTypeMetrics, metrics, spool.PriorityLow); err != nil {
 		return fmt.Errorf("failed to publish metrics: %w", err)
 	}
 
@@ -344,12 +481,12 @@ func (cm *CommunicationManager) publishMetrics(subject string, metrics *types.Me
 func (cm *CommunicationManager) publishResult(subject string, result *types.CommandResult) error {
 	result.ClusterID = cm.clusterID
 
-	data, err := json.Marshal(result)
-	if err != nil {
-		return fmt.Errorf("failed to marshal result: %w", err)
+	// Results too large for NATS could never be delivered
+	if err := fitResult(result, cm.maxPayload()-resultPayloadMargin, cm.encodedResultSize); err != nil {
+		return fmt.Errorf("failed to publish result: %w", err)
 	}
 
-	if err := cm.natsConn.Publish(subject, data); err != nil {
+	if err := cm.publishDurable(subject, protocol.MessageTypeResult, result, spool.PriorityCritical); err != nil {
 		return fmt.Errorf("failed to publish result: %w", err)
 	}
 
@@ -361,39 +498,375 @@ func (cm *CommunicationManager) publishResult(subject string, result *types.Comm
 	return nil
 }
 
-// sendHeartbeat sends a heartbeat message
-func (cm *CommunicationManager) sendHeartbeat(subject string) {
-	// Get queue sizes (these would be passed from the main agent)
-	// For now, we'll use placeholder values
-	heartbeat := types.Heartbeat{
+// encodedResultSize returns the size of the envelope carrying a result
+func (cm *CommunicationManager) encodedResultSize(result *types.CommandResult) (int, error) {
+	env, err := protocol.NewEnvelope(protocol.MessageTypeResult, cm.sender(), cm.clusterID, result)
+	if err != nil {
+		return 0, err
+	}
+	data, err := env.Marshal()
+	if err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// maxPayload returns the largest message the NATS server accepts, or the
+// server default while disconnected
+func (cm *CommunicationManager) maxPayload() int {
+	if nc, _ := cm.conn.conn(); nc != nil && nc.MaxPayload() > 0 {
+		return int(nc.MaxPayload())
+	}
+	return defaultMaxPayload
+}
+
+// PublishCommandAck tells agent-manager that a command has started executing
+func (cm *CommunicationManager) PublishCommandAck(commandID string) error {
+	ack := types.CommandAck{
+		CommandID: commandID,
 		ClusterID: cm.clusterID,
+		Status:    protocol.CommandStatusExecuting,
 		Timestamp: time.Now(),
-		Status:    "healthy",
-		Metrics: types.HeartbeatMetrics{
-			EventQueueSize:   0, // This should be actual queue size
-			MetricsQueueSize: 0, // This should be actual queue size
-			CommandQueueSize: 0, // This should be actual queue size
-			UptimeSeconds:    int(time.Since(time.Now()).Seconds()), // This should be actual uptime
-		},
 	}
 
-	data, err := json.Marshal(heartbeat)
+	subject := protocol.ResultSubject(cm.clusterID)
+	if err := cm.publishDurable(subject, protocol.MessageTypeCommandAck, ack, spool.PriorityCritical); err != nil {
+		return fmt.Errorf("failed to publish command ack: %w", err)
+	}
+
+	cm.logger.Debug("Command ack published",
+		zap.String("command_id", commandID),
+		zap.String("subject", subject))
+
+	return nil
+}
+
+// PublishCommandOutput publishes a chunk of the output of a running command.
+// Chunks are neither spooled nor sent through JetStream: while NATS is
+// unreachable they are lost, and the output kept in the result remains.
+func (cm *CommunicationManager) PublishCommandOutput(output *types.CommandOutput) {
+	output.ClusterID = cm.clusterID
+
+	data, err := protocol.Encode(protocol.MessageTypeOutput, cm.sender(), cm.clusterID, output)
 	if err != nil {
-		cm.logger.Error("Failed to marshal heartbeat", zap.Error(err))
+		cm.logger.Error("Failed to encode command output", zap.Error(err))
+		return
+	}
+
+	nc, _ := cm.conn.conn()
+	if nc == nil {
 		return
 	}
 
-	if err := cm.natsConn.Publish(subject, data); err != nil {
+	subject := protocol.CommandOutputSubject(cm.clusterID, output.CommandID)
+	if err := nc.Publish(subject, data); err != nil {
+		cm.logger.Debug("Failed to publish command output",
+			zap.String("command_id", output.CommandID),
+			zap.Int64("seq", output.Seq),
+			zap.Error(err))
+	}
+}
+
+// publishDurable publishes a payload that must not be lost. While disconnected,
+// or while older messages are still spooled, the message is appended to the
+// spool instead and published later by drainSpool.
+func (cm *CommunicationManager) publishDurable(subject string, msgType protocol.MessageType, payload interface{}, priority spool.Priority) error {
+	env, err := protocol.NewEnvelope(msgType, cm.sender(), cm.clusterID, payload)
+	if err != nil {
+		return err
+	}
+
+	data, err := env.Marshal()
+	if err != nil {
+		return err
+	}
+
+	if cm.spool == nil {
+		return cm.send(subject, env.MessageID, data)
+	}
+
+	if !cm.natsConnected() || cm.spool.Len() > 0 {
+		return cm.spoolMessage(priority, subject, env.MessageID, data)
+	}
+
+	if err := cm.send(subject, env.MessageID, data); err != nil {
+		if err := cm.classifyPublishError(err); errors.Is(err, spool.ErrUndeliverable) {
+			// Spooling it would only hold up the messages behind it
+			return err
+		}
+		cm.logger.Warn("Publish failed, spooling message",
+			zap.String("subject", subject),
+			zap.Error(err))
+		return cm.spoolMessage(priority, subject, env.MessageID, data)
+	}
+
+	return nil
+}
+
+// send publishes an encoded envelope. With JetStream enabled the call waits for
+// the stream to persist the message, and the envelope message ID is used as
+// Nats-Msg-Id so retried publishes are de-duplicated by the server.
+func (cm *CommunicationManager) send(subject, messageID string, data []byte) error {
+	nc, js := cm.conn.conn()
+	if nc == nil {
+		return errNotConnected
+	}
+
+	start := time.Now()
+
+	var err error
+	if js == nil {
+		err = nc.Publish(subject, data)
+	} else {
+		msg := nats.NewMsg(subject)
+		msg.Data = data
+		_, err = js.PublishMsg(msg, nats.MsgId(messageID))
+	}
+	cm.metrics.observePublish(subject, time.Since(start), err)
+
+	if err != nil {
+		cm.health.recordError(err)
+		return err
+	}
+	cm.health.recordSuccess()
+	return nil
+}
+
+// spoolMessage appends an encoded envelope to the on-disk spool
+func (cm *CommunicationManager) spoolMessage(priority spool.Priority, subject, messageID string, data []byte) error {
+	if err := cm.spool.Append(priority, &spool.Record{
+		Subject:   subject,
+		MessageID: messageID,
+		Timestamp: time.Now(),
+		Data:      data,
+	}); err != nil {
+		return fmt.Errorf("failed to spool message: %w", err)
+	}
+
+	cm.logger.Debug("Message spooled",
+		zap.String("subject", subject),
+		zap.String("priority", priority.String()))
+	return nil
+}
+
+// SpoolEvent writes an event straight to the spool, used when the event queue
+// is full. It returns false if the spool is disabled or the write failed.
+func (cm *CommunicationManager) SpoolEvent(event *types.Event) bool {
+	if cm.spool == nil {
+		return false
+	}
+
+	event.ClusterID = cm.clusterID
+	event.ReportedAt = time.Now()
+
+	env, err := protocol.NewEnvelope(protocol.MessageTypeEvent, cm.sender(), cm.clusterID, event)
+	if err != nil {
+		cm.logger.Error("Failed to encode event", zap.Error(err), zap.String("event_id", event.ID))
+		return false
+	}
+
+	data, err := env.Marshal()
+	if err != nil {
+		cm.logger.Error("Failed to encode event", zap.Error(err), zap.String("event_id", event.ID))
+		return false
+	}
+
+	if err := cm.spoolMessage(eventPriority(event), protocol.EventSubject(cm.clusterID), env.MessageID, data); err != nil {
+		cm.logger.Error("Failed to spool event", zap.Error(err), zap.String("event_id", event.ID))
+		return false
+	}
+
+	return true
+}
+
+// drainSpool publishes spooled messages once the connection is available
+func (cm *CommunicationManager) drainSpool(ctx context.Context) {
+	defer cm.wg.Done()
+
+	ticker := time.NewTicker(spoolDrainInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-cm.stopCh:
+			return
+		case <-ticker.C:
+		case <-cm.drainCh:
+		}
+
+		if !cm.natsConnected() || cm.spool.Len() == 0 {
+			continue
+		}
+
+		drained, err := cm.spool.Drain(func(rec *spool.Record) error {
+			if err := cm.send(rec.Subject, rec.MessageID, rec.Data); err != nil {
+				return cm.classifyPublishError(err)
+			}
+			return nil
+		})
+		if drained > 0 {
+			cm.logger.Info("Drained spooled messages",
+				zap.Int("count", drained),
+				zap.Int64("remaining", cm.spool.Len()))
+		}
+		if err != nil {
+			cm.logger.Warn("Spool drain interrupted", zap.Error(err))
+		}
+	}
+}
+
+// classifyPublishError wraps publish errors retrying cannot fix, such as a
+// message over the max payload or a subject no stream is bound to, with
+// spool.ErrUndeliverable. Errors while the connection is down are transient.
+func (cm *CommunicationManager) classifyPublishError(err error) error {
+	if !cm.natsConnected() {
+		return err
+	}
+	return markUndeliverable(err)
+}
+
+// markUndeliverable wraps publish errors other than the transient ones
+// with spool.ErrUndeliverable
+func markUndeliverable(err error) error {
+	for _, transient := range transientPublishErrors {
+		if errors.Is(err, transient) {
+			return err
+		}
+	}
+
+	// The JetStream API reports server-side trouble such as a stream leader
+	// election with 5xx codes
+	var apiErr *nats.APIError
+	if errors.As(err, &apiErr) && apiErr.Code >= 500 {
+		return err
+	}
+
+	return fmt.Errorf("%w: %v", spool.ErrUndeliverable, err)
+}
+
+// triggerDrain wakes drainSpool without waiting for the next tick
+func (cm *CommunicationManager) triggerDrain() {
+	select {
+	case cm.drainCh <- struct{}{}:
+	default:
+	}
+}
+
+// SpoolStats returns the spool statistics and whether the spool is enabled
+func (cm *CommunicationManager) SpoolStats() (spool.Stats, bool) {
+	if cm.spool == nil {
+		return spool.Stats{}, false
+	}
+	return cm.spool.Stats(), true
+}
+
+// eventPriority returns the spool priority of an event
+func eventPriority(event *types.Event) spool.Priority {
+	if event.Severity == "critical" {
+		return spool.PriorityCritical
+	}
+	return spool.PriorityNormal
+}
+
+// sendHeartbeat sends a heartbeat message carrying the current agent status
+func (cm *CommunicationManager) sendHeartbeat(subject string) {
+	cm.agentIDMu.RLock()
+	agentID := cm.agentID
+	cm.agentIDMu.RUnlock()
+
+	var heartbeat types.Heartbeat
+	if cm.statusProvider != nil {
+		heartbeat = newHeartbeat(cm.statusProvider())
+	} else {
+		heartbeat = types.Heartbeat{
+			Status:     types.HeartbeatStatusHealthy,
+			Components: map[string]types.ComponentHealth{componentCommunication: cm.Health()},
+		}
+	}
+	heartbeat.AgentID = agentID
+	heartbeat.ClusterID = cm.clusterID
+	heartbeat.Timestamp = time.Now()
+
+	data, err := protocol.Encode(protocol.MessageTypeHeartbeat, cm.sender(), cm.clusterID, heartbeat)
+	if err != nil {
+		cm.logger.Error("Failed to encode heartbeat", zap.Error(err))
+		return
+	}
+
+	nc, _ := cm.conn.conn()
+	if nc == nil {
+		return
+	}
+
+	if err := nc.Publish(subject, data); err != nil {
+		cm.health.recordError(err)
 		cm.logger.Error("Failed to publish heartbeat", zap.Error(err))
 		return
 	}
 
-	cm.logger.Debug("Heartbeat sent", zap.String("cluster_id", cm.clusterID))
+	cm.logger.Debug("Heartbeat sent",
+		zap.String("cluster_id", cm.clusterID),
+		zap.String("status", heartbeat.Status))
+}
+
+// newHeartbeat builds the heartbeat payload from the agent status
+func newHeartbeat(status AgentStatus) types.Heartbeat {
+	heartbeat := types.Heartbeat{
+		Status: status.Status,
+		Metrics: types.HeartbeatMetrics{
+			EventQueueSize:   status.EventQueueSize,
+			MetricsQueueSize: status.MetricsQueueSize,
+			CommandQueueSize: status.CommandQueueSize,
+			CommandsRunning:  status.CommandsRunning,
+			ResultQueueSize:  status.ResultQueueSize,
+			UptimeSeconds:    int(status.Uptime.Seconds()),
+			EventsDropped:    status.EventsDropped,
+			MetricsDropped:   status.MetricsDropped,
+			CommandsDropped:  status.CommandsDropped,
+			ResultsDropped:   status.ResultsDropped,
+			Reconnects:       status.Reconnects,
+		},
+		Components: status.Components,
+		Commands:   status.Commands,
+	}
+
+	if status.Spool != nil {
+		heartbeat.Metrics.SpoolDepth = status.Spool.Records
+		heartbeat.Metrics.SpoolBytes = status.Spool.Bytes
+	}
+
+	return heartbeat
+}
+
+// Health returns the communication health, unhealthy while disconnected
+func (cm *CommunicationManager) Health() types.ComponentHealth {
+	health := cm.health.snapshot()
+	health.Healthy = health.Healthy && cm.natsConnected()
+	return health
 }
 
-// IsConnected returns true if connected to NATS
+// Reconnects returns the number of NATS reconnections since start
+func (cm *CommunicationManager) Reconnects() int64 {
+	return cm.conn.Reconnects()
+}
+
+// IsConnected returns true if started and connected to NATS
 func (cm *CommunicationManager) IsConnected() bool {
 	cm.mu.RLock()
 	defer cm.mu.RUnlock()
-	return cm.connected && cm.natsConn != nil && cm.natsConn.IsConnected()
-}
\ No newline at end of file
+	return cm.started && cm.conn.IsConnected()
+}
+
+// natsConnected reports the state of the NATS connection alone: unlike
+// IsConnected it holds while stopping, when Stop flushes the events and
+// results queued
+func (cm *CommunicationManager) natsConnected() bool {
+	return cm.conn.IsConnected()
+}
+
+// sender returns the identity used as envelope sender
+func (cm *CommunicationManager) sender() string {
+	return fmt.Sprintf("agent-%s", cm.clusterID)
+}
@@ -0,0 +1,261 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+
+	"github.com/kart-io/k8s-agent/protocol"
+
+	"github.com/kart/k8s-agent/collect-agent/internal/spool"
+	"github.com/kart/k8s-agent/collect-agent/internal/types"
+)
+
+func newSpooledCommunicationManager(t *testing.T) *CommunicationManager {
+	t.Helper()
+
+	s, err := spool.Open(spool.Options{
+		Dir:             t.TempDir(),
+		MaxSegmentBytes: 64 * 1024,
+		MaxTotalBytes:   1024 * 1024,
+		MaxAge:          time.Hour,
+	}, zap.NewNop())
+	if err != nil {
+		t.Fatalf("spool.Open failed: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	return NewCommunicationManager(types.DefaultConfig(), "test-cluster", nil, nil, nil, nil, nil, s, zap.NewNop())
+}
+
+func TestPublishWhileDisconnectedSpools(t *testing.T) {
+	cm := newSpooledCommunicationManager(t)
+
+	events := []*types.Event{
+		{ID: "event-normal", Severity: "medium"},
+		{ID: "event-critical", Severity: "critical"},
+	}
+	for _, event := range events {
+		if err := cm.publishEvent(protocol.EventSubject(cm.clusterID), event); err != nil {
+			t.Fatalf("publishEvent(%s) failed: %v", event.ID, err)
+		}
+	}
+	if err := cm.publishMetrics(protocol.MetricsSubject(cm.clusterID), &types.Metrics{}); err != nil {
+		t.Fatalf("publishMetrics failed: %v", err)
+	}
+
+	stats, ok := cm.SpoolStats()
+	if !ok {
+		t.Fatal("SpoolStats reported spool disabled")
+	}
+	if stats.Records != 3 {
+		t.Errorf("spooled records = %v, want 3", stats.Records)
+	}
+
+	var drained []string
+	cm.spool.Drain(func(rec *spool.Record) error {
+		env, err := protocol.Decode(rec.Data)
+		if err != nil {
+			t.Fatalf("Decode failed: %v", err)
+		}
+		if env.Type == protocol.MessageTypeEvent {
+			var event types.Event
+			env.DecodePayload(protocol.MessageTypeEvent, &event)
+			drained = append(drained, event.ID)
+		} else {
+			drained = append(drained, string(env.Type))
+		}
+		if env.MessageID != rec.MessageID {
+			t.Errorf("record MessageID = %v, want envelope MessageID %v", rec.MessageID, env.MessageID)
+		}
+		return nil
+	})
+
+	want := []string{"event-critical", "event-normal", "metrics"}
+	if len(drained) != len(want) {
+		t.Fatalf("drained = %v, want %v", drained, want)
+	}
+	for i := range want {
+		if drained[i] != want[i] {
+			t.Errorf("drained[%d] = %v, want %v", i, drained[i], want[i])
+		}
+	}
+}
+
+func TestMarkUndeliverable(t *testing.T) {
+	tests := []struct {
+		name          string
+		err           error
+		undeliverable bool
+	}{
+		{"not connected", errNotConnected, false},
+		{"timeout", nats.ErrTimeout, false},
+		{"deadline", fmt.Errorf("publish: %w", context.DeadlineExceeded), false},
+		{"reconnecting", nats.ErrConnectionReconnecting, false},
+		{"stream unavailable", &nats.APIError{Code: 503, Description: "JetStream system temporarily unavailable"}, false},
+		{"max payload", nats.ErrMaxPayload, true},
+		{"no stream", nats.ErrNoStreamResponse, true},
+		{"stream rejected", &nats.APIError{Code: 400, Description: "message size exceeds maximum allowed"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := markUndeliverable(tt.err)
+			if got := errors.Is(err, spool.ErrUndeliverable); got != tt.undeliverable {
+				t.Errorf("undeliverable = %v, want %v", got, tt.undeliverable)
+			}
+			if !errors.Is(err, tt.err) && !tt.undeliverable {
+				t.Errorf("error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestPublishResultFitsMaxPayload(t *testing.T) {
+	s, err := spool.Open(spool.Options{
+		Dir:             t.TempDir(),
+		MaxSegmentBytes: 8 * 1024 * 1024,
+		MaxTotalBytes:   16 * 1024 * 1024,
+	}, zap.NewNop())
+	if err != nil {
+		t.Fatalf("spool.Open failed: %v", err)
+	}
+	defer s.Close()
+	cm := NewCommunicationManager(types.DefaultConfig(), "test-cluster", nil, nil, nil, nil, nil, s, zap.NewNop())
+
+	// Control characters take six bytes each once JSON encoded
+	var result types.CommandResult
+	streamer := newOutputStreamer("cmd-1", nil)
+	streamer.write(protocol.OutputStreamStdout, []byte(strings.Repeat("\x01", 600*1024)))
+	streamer.write(protocol.OutputStreamStderr, []byte(strings.Repeat("e", 600*1024)))
+	streamer.close(&result)
+	result.CommandID = "cmd-1"
+	result.Status = protocol.CommandStatusSuccess
+
+	if err := cm.publishResult(protocol.ResultSubject(cm.clusterID), &result); err != nil {
+		t.Fatalf("publishResult failed: %v", err)
+	}
+
+	s.Drain(func(rec *spool.Record) error {
+		if len(rec.Data) > defaultMaxPayload-resultPayloadMargin {
+			t.Errorf("result message has %d bytes, more than %d", len(rec.Data), defaultMaxPayload-resultPayloadMargin)
+		}
+		env, err := protocol.Decode(rec.Data)
+		if err != nil {
+			t.Fatalf("Decode failed: %v", err)
+		}
+		var published types.CommandResult
+		if err := env.DecodePayload(protocol.MessageTypeResult, &published); err != nil {
+			t.Fatalf("DecodePayload failed: %v", err)
+		}
+		if !published.StdoutTruncated || published.Stderr == "" {
+			t.Errorf("published stdout truncated %v, %d bytes of stderr, want stdout cut and stderr kept",
+				published.StdoutTruncated, len(published.Stderr))
+		}
+		return nil
+	})
+}
+
+func TestSpoolEvent(t *testing.T) {
+	cm := newSpooledCommunicationManager(t)
+
+	if !cm.SpoolEvent(&types.Event{ID: "overflow"}) {
+		t.Fatal("SpoolEvent returned false")
+	}
+	if got := cm.spool.Len(); got != 1 {
+		t.Errorf("spool length = %v, want 1", got)
+	}
+
+	disabled := NewCommunicationManager(types.DefaultConfig(), "test-cluster", nil, nil, nil, nil, nil, nil, zap.NewNop())
+	if disabled.SpoolEvent(&types.Event{ID: "overflow"}) {
+		t.Error("SpoolEvent should return false without a spool")
+	}
+	if _, ok := disabled.SpoolStats(); ok {
+		t.Error("SpoolStats should report the spool as disabled")
+	}
+}
+
+func TestNewHeartbeat(t *testing.T) {
+	status := AgentStatus{
+		Status:          types.HeartbeatStatusDegraded,
+		Uptime:          90 * time.Second,
+		EventQueueSize:  7,
+		ResultQueueSize: 2,
+		EventsDropped:   3,
+		Reconnects:      1,
+		Spool:           &spool.Stats{Records: 5, Bytes: 512},
+		Components: map[string]types.ComponentHealth{
+			componentCommunication: {Healthy: false, LastError: "nats: no servers available"},
+		},
+	}
+
+	heartbeat := newHeartbeat(status)
+
+	tests := []struct {
+		name     string
+		got      interface{}
+		expected interface{}
+	}{
+		{"Status", heartbeat.Status, types.HeartbeatStatusDegraded},
+		{"UptimeSeconds", heartbeat.Metrics.UptimeSeconds, 90},
+		{"EventQueueSize", heartbeat.Metrics.EventQueueSize, 7},
+		{"ResultQueueSize", heartbeat.Metrics.ResultQueueSize, 2},
+		{"EventsDropped", heartbeat.Metrics.EventsDropped, int64(3)},
+		{"Reconnects", heartbeat.Metrics.Reconnects, int64(1)},
+		{"SpoolDepth", heartbeat.Metrics.SpoolDepth, int64(5)},
+		{"SpoolBytes", heartbeat.Metrics.SpoolBytes, int64(512)},
+		{"LastError", heartbeat.Components[componentCommunication].LastError, "nats: no servers available"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.got != tt.expected {
+				t.Errorf("%s = %v, want %v", tt.name, tt.got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestPublishCommandAckPrecedesResult(t *testing.T) {
+	cm := newSpooledCommunicationManager(t)
+
+	if err := cm.PublishCommandAck("cmd-1"); err != nil {
+		t.Fatalf("PublishCommandAck failed: %v", err)
+	}
+	if err := cm.publishResult(protocol.ResultSubject(cm.clusterID), &types.CommandResult{CommandID: "cmd-1", Status: "success"}); err != nil {
+		t.Fatalf("publishResult failed: %v", err)
+	}
+
+	var kinds []protocol.MessageType
+	cm.spool.Drain(func(rec *spool.Record) error {
+		if rec.Subject != protocol.ResultSubject(cm.clusterID) {
+			t.Errorf("Subject = %v, want %v", rec.Subject, protocol.ResultSubject(cm.clusterID))
+		}
+		env, err := protocol.Decode(rec.Data)
+		if err != nil {
+			t.Fatalf("Decode failed: %v", err)
+		}
+		kinds = append(kinds, env.Type)
+
+		if env.Type == protocol.MessageTypeCommandAck {
+			var ack types.CommandAck
+			if err := env.DecodePayload(protocol.MessageTypeCommandAck, &ack); err != nil {
+				t.Fatalf("DecodePayload failed: %v", err)
+			}
+			if ack.CommandID != "cmd-1" || ack.Status != protocol.CommandStatusExecuting {
+				t.Errorf("ack = %+v", ack)
+			}
+		}
+		return nil
+	})
+
+	if len(kinds) != 2 || kinds[0] != protocol.MessageTypeCommandAck || kinds[1] != protocol.MessageTypeResult {
+		t.Errorf("published = %v, want [command_ack result]", kinds)
+	}
+}
@@ -0,0 +1,68 @@
+package agent
+
+import (
+	"sync"
+	"time"
+
+	"github.com/kart/k8s-agent/collect-agent/internal/types"
+)
+
+// Component names reported in heartbeats and the status endpoint
+const (
+	componentEventWatcher     = "event_watcher"
+	componentStateWatcher     = "state_watcher"
+	componentMetricsCollector = "metrics_collector"
+	componentCommandExecutor  = "command_executor"
+	componentCommunication    = "communication"
+)
+
+// componentHealth records the errors reported by an agent component. A
+// component is unhealthy from a failed operation until the next success.
+type componentHealth struct {
+	mu          sync.RWMutex
+	failing     bool
+	lastError   string
+	lastErrorAt time.Time
+	errorCount  int64
+}
+
+// recordError marks the component as failing with err
+func (h *componentHealth) recordError(err error) {
+	if err == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.failing = true
+	h.lastError = err.Error()
+	h.lastErrorAt = time.Now()
+	h.errorCount++
+}
+
+// recordSuccess clears the failing state, keeping the last error for reference
+func (h *componentHealth) recordSuccess() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.failing = false
+}
+
+// snapshot returns the health as reported in heartbeats
+func (h *componentHealth) snapshot() types.ComponentHealth {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	health := types.ComponentHealth{
+		Healthy:    !h.failing,
+		LastError:  h.lastError,
+		ErrorCount: h.errorCount,
+	}
+	if !h.lastErrorAt.IsZero() {
+		lastErrorAt := h.lastErrorAt
+		health.LastErrorTime = &lastErrorAt
+	}
+
+	return health
+}
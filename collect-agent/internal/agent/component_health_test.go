@@ -0,0 +1,85 @@
+package agent
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/kart/k8s-agent/collect-agent/internal/types"
+)
+
+func TestComponentHealth(t *testing.T) {
+	var h componentHealth
+
+	if got := h.snapshot(); !got.Healthy || got.LastErrorTime != nil {
+		t.Errorf("initial snapshot = %+v, want healthy without error", got)
+	}
+
+	h.recordError(errors.New("connection refused"))
+	got := h.snapshot()
+	if got.Healthy {
+		t.Error("Healthy = true after error, want false")
+	}
+	if got.LastError != "connection refused" || got.ErrorCount != 1 || got.LastErrorTime == nil {
+		t.Errorf("snapshot after error = %+v", got)
+	}
+
+	h.recordSuccess()
+	got = h.snapshot()
+	if !got.Healthy {
+		t.Error("Healthy = false after success, want true")
+	}
+	if got.LastError != "connection refused" {
+		t.Errorf("LastError = %v, want last error to be kept", got.LastError)
+	}
+}
+
+func TestEventWatcherHealthBeforeSync(t *testing.T) {
+	watcher := NewEventWatcher(fake.NewSimpleClientset(), "test-cluster", make(chan *types.Event, 1), zap.NewNop())
+
+	health := watcher.Health()
+	if health.Synced == nil || *health.Synced {
+		t.Errorf("Synced = %v, want false", health.Synced)
+	}
+	if health.Healthy {
+		t.Error("Healthy = true before the informer synced, want false")
+	}
+}
+
+func TestEventWatcherCountsDroppedEvents(t *testing.T) {
+	watcher := NewEventWatcher(fake.NewSimpleClientset(), "test-cluster", make(chan *types.Event), zap.NewNop())
+
+	watcher.handleEvent(newTestEvent("e1", "BackOff"), "ADDED")
+	if got := watcher.Dropped(); got != 1 {
+		t.Errorf("Dropped = %v, want 1", got)
+	}
+
+	watcher.SetOverflowHandler(func(*types.Event) bool { return true })
+	watcher.handleEvent(newTestEvent("e2", "BackOff"), "ADDED")
+	if got := watcher.Dropped(); got != 1 {
+		t.Errorf("Dropped = %v, want 1 when the overflow handler keeps the event", got)
+	}
+}
+
+func newTestEvent(name, reason string) *corev1.Event {
+	return &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+		},
+		Type:    corev1.EventTypeWarning,
+		Reason:  reason,
+		Message: "Back-off restarting failed container",
+		InvolvedObject: corev1.ObjectReference{
+			Kind:      "Pod",
+			Name:      "test-pod",
+			Namespace: "default",
+		},
+		LastTimestamp: metav1.Time{Time: time.Now()},
+	}
+}
@@ -0,0 +1,176 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+
+	"github.com/kart/k8s-agent/collect-agent/internal/types"
+)
+
+// connectionListener is notified of connection state changes
+type connectionListener interface {
+	onDisconnect(err error)
+	onReconnect()
+}
+
+// Connection is the NATS connection shared by the communication managers of
+// every cluster served by the agent process
+type Connection struct {
+	config *types.AgentConfig
+	logger *zap.Logger
+
+	mu        sync.RWMutex
+	nc        *nats.Conn
+	js        nats.JetStreamContext
+	listeners map[connectionListener]struct{}
+
+	reconnects atomic.Int64
+}
+
+// NewConnection creates an unconnected NATS connection
+func NewConnection(config *types.AgentConfig, logger *zap.Logger) *Connection {
+	return &Connection{
+		config:    config,
+		logger:    logger.With(zap.String("component", "nats-connection")),
+		listeners: make(map[connectionListener]struct{}),
+	}
+}
+
+// Connect establishes the connection to the central NATS endpoint, using name
+// as the client connection name
+func (c *Connection) Connect(name string) error {
+	c.logger.Info("Connecting to NATS",
+		zap.String("endpoint", c.config.CentralEndpoint),
+		zap.String("name", name))
+
+	opts := []nats.Option{
+		nats.Name(name),
+		nats.ReconnectWait(c.config.ReconnectDelay),
+		nats.MaxReconnects(c.config.MaxRetries),
+		nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
+			if err == nil {
+				err = errors.New("disconnected from NATS")
+			}
+			c.logger.Warn("Disconnected from NATS", zap.Error(err))
+			for _, l := range c.snapshotListeners() {
+				l.onDisconnect(err)
+			}
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			c.reconnects.Add(1)
+			c.logger.Info("Reconnected to NATS", zap.String("url", nc.ConnectedUrl()))
+			for _, l := range c.snapshotListeners() {
+				go l.onReconnect()
+			}
+		}),
+		nats.ClosedHandler(func(nc *nats.Conn) {
+			c.logger.Warn("NATS connection closed")
+		}),
+		nats.ErrorHandler(func(nc *nats.Conn, sub *nats.Subscription, err error) {
+			subject := ""
+			if sub != nil {
+				subject = sub.Subject
+			}
+			c.logger.Error("NATS error",
+				zap.String("subject", subject),
+				zap.Error(err))
+		}),
+	}
+
+	if c.config.Spool.Enabled {
+		// Fail publishes while disconnected so messages go to the on-disk
+		// spool instead of the client's in-memory reconnect buffer
+		opts = append(opts, nats.ReconnectBufSize(-1))
+	}
+
+	nc, err := nats.Connect(c.config.CentralEndpoint, opts...)
+	if err != nil {
+		return fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+
+	var js nats.JetStreamContext
+	if c.config.EnableJetStream {
+		js, err = nc.JetStream()
+		if err != nil {
+			nc.Close()
+			return fmt.Errorf("failed to create JetStream context: %w", err)
+		}
+	}
+
+	c.mu.Lock()
+	c.nc = nc
+	c.js = js
+	c.mu.Unlock()
+
+	c.logger.Info("Connected to NATS",
+		zap.String("url", nc.ConnectedUrl()),
+		zap.Bool("jetstream", c.config.EnableJetStream))
+
+	return nil
+}
+
+// Close closes the connection
+func (c *Connection) Close() {
+	c.mu.RLock()
+	nc := c.nc
+	c.mu.RUnlock()
+
+	if nc != nil {
+		nc.Close()
+	}
+}
+
+// conn returns the underlying NATS connection and JetStream context, nil before Connect
+func (c *Connection) conn() (*nats.Conn, nats.JetStreamContext) {
+	if c == nil {
+		return nil, nil
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.nc, c.js
+}
+
+// IsConnected returns true while the connection is established
+func (c *Connection) IsConnected() bool {
+	nc, _ := c.conn()
+	return nc != nil && nc.IsConnected()
+}
+
+// Reconnects returns the number of reconnections since Connect
+func (c *Connection) Reconnects() int64 {
+	if c == nil {
+		return 0
+	}
+	return c.reconnects.Load()
+}
+
+// addListener registers a listener for connection state changes
+func (c *Connection) addListener(l connectionListener) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.listeners[l] = struct{}{}
+}
+
+// removeListener unregisters a listener
+func (c *Connection) removeListener(l connectionListener) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.listeners, l)
+}
+
+// snapshotListeners returns the registered listeners
+func (c *Connection) snapshotListeners() []connectionListener {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	listeners := make([]connectionListener, 0, len(c.listeners))
+	for l := range c.listeners {
+		listeners = append(listeners, l)
+	}
+	return listeners
+}
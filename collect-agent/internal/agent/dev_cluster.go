@@ -0,0 +1,513 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	eventsv1 "k8s.io/api/events/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	k8stesting "k8s.io/client-go/testing"
+	statsv1alpha1 "k8s.io/kubelet/pkg/apis/stats/v1alpha1"
+	metricsv1beta1 "k8s.io/metrics/pkg/apis/metrics/v1beta1"
+	metricsfake "k8s.io/metrics/pkg/client/clientset/versioned/fake"
+)
+
+// Dev mode cluster layout
+const (
+	devNamespace   = "demo"
+	devSystemUID   = "de7c1a57-0000-4000-8000-000000000000"
+	devEventPeriod = 15 * time.Second
+)
+
+// devEventTemplate describes a synthetic event emitted in dev mode
+type devEventTemplate struct {
+	kind      string
+	namespace string
+	name      string
+	eventType string
+	reason    string
+	message   string
+}
+
+// devEvents are emitted in turn by the dev event generator
+var devEvents = []devEventTemplate{
+	{"Pod", devNamespace, "worker-5d8f7c9b4-xk2lp", corev1.EventTypeWarning, "BackOff", "Back-off restarting failed container worker in pod worker-5d8f7c9b4-xk2lp"},
+	{"Pod", devNamespace, "api-7c6d5f8b9-q4w8n", corev1.EventTypeWarning, "Unhealthy", "Readiness probe failed: HTTP probe failed with statuscode: 503"},
+	{"Pod", devNamespace, "batch-job-9gk2m", corev1.EventTypeWarning, "FailedScheduling", "0/3 nodes are available: 1 node(s) were unschedulable, 2 Insufficient memory."},
+	{"Node", "", "dev-node-3", corev1.EventTypeNormal, "NodeNotReady", "Node dev-node-3 status is now: NodeNotReady"},
+	{"Pod", devNamespace, "worker-5d8f7c9b4-xk2lp", corev1.EventTypeWarning, "OOMKilling", "Memory cgroup out of memory: Killed process 4242 (worker)"},
+}
+
+// newDevClientset returns a fake clientset holding a small cluster with a few
+// healthy and failing workloads, so the whole agent pipeline has data to work on
+func newDevClientset() *fake.Clientset {
+	objects := []runtime.Object{
+		devNamespaceObject("kube-system", devSystemUID),
+		devNamespaceObject("default", ""),
+		devNamespaceObject(devNamespace, ""),
+
+		devNode("dev-node-1", true, false),
+		devNode("dev-node-2", true, false),
+		devNode("dev-node-3", false, true),
+
+		devPod("web-6b7f9d8c5-2mzpt", "dev-node-1", corev1.PodRunning, 0, ""),
+		devPod("web-6b7f9d8c5-8rtvx", "dev-node-2", corev1.PodRunning, 0, ""),
+		devPod("api-7c6d5f8b9-q4w8n", "dev-node-1", corev1.PodRunning, 2, ""),
+		devPod("worker-5d8f7c9b4-xk2lp", "dev-node-2", corev1.PodRunning, 17, "CrashLoopBackOff"),
+		devPod("batch-job-9gk2m", "", corev1.PodPending, 0, ""),
+
+		devClaim("batch-data", "standard"),
+
+		&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: devNamespace}},
+		&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: devNamespace}},
+		&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "web-config", Namespace: devNamespace}},
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "api-credentials", Namespace: devNamespace}},
+	}
+
+	clientset := fake.NewClientset(objects...)
+	clientset.Resources = devAPIResources
+	return clientset
+}
+
+// devAPIResources are the resources the dev cluster serves through discovery
+var devAPIResources = []*metav1.APIResourceList{
+	{
+		GroupVersion: "v1",
+		APIResources: []metav1.APIResource{
+			{Name: "namespaces", SingularName: "namespace", Kind: "Namespace", ShortNames: []string{"ns"}},
+			{Name: "nodes", SingularName: "node", Kind: "Node", ShortNames: []string{"no"}},
+			{Name: "pods", SingularName: "pod", Namespaced: true, Kind: "Pod", ShortNames: []string{"po"}},
+			{Name: "services", SingularName: "service", Namespaced: true, Kind: "Service", ShortNames: []string{"svc"}},
+			{Name: "configmaps", SingularName: "configmap", Namespaced: true, Kind: "ConfigMap", ShortNames: []string{"cm"}},
+			{Name: "secrets", SingularName: "secret", Namespaced: true, Kind: "Secret"},
+			{Name: "events", SingularName: "event", Namespaced: true, Kind: "Event", ShortNames: []string{"ev"}},
+			{Name: "persistentvolumeclaims", SingularName: "persistentvolumeclaim", Namespaced: true, Kind: "PersistentVolumeClaim", ShortNames: []string{"pvc"}},
+		},
+	},
+	{
+		GroupVersion: "apps/v1",
+		APIResources: []metav1.APIResource{
+			{Name: "deployments", SingularName: "deployment", Namespaced: true, Kind: "Deployment", ShortNames: []string{"deploy"}},
+			{Name: "replicasets", SingularName: "replicaset", Namespaced: true, Kind: "ReplicaSet", ShortNames: []string{"rs"}},
+			{Name: "statefulsets", SingularName: "statefulset", Namespaced: true, Kind: "StatefulSet", ShortNames: []string{"sts"}},
+			{Name: "daemonsets", SingularName: "daemonset", Namespaced: true, Kind: "DaemonSet", ShortNames: []string{"ds"}},
+		},
+	},
+	{
+		GroupVersion: "batch/v1",
+		APIResources: []metav1.APIResource{
+			{Name: "jobs", SingularName: "job", Namespaced: true, Kind: "Job"},
+			{Name: "cronjobs", SingularName: "cronjob", Namespaced: true, Kind: "CronJob", ShortNames: []string{"cj"}},
+		},
+	},
+}
+
+// newDevDynamicClient returns a dynamic client reading the objects of
+// clientset, so that both clients see the same dev cluster
+func newDevDynamicClient(clientset *fake.Clientset) *dynamicfake.FakeDynamicClient {
+	client := dynamicfake.NewSimpleDynamicClient(scheme.Scheme)
+	react := k8stesting.ObjectReaction(clientset.Tracker())
+
+	// The typed objects of the tracker are returned as unstructured ones,
+	// which is what the dynamic client expects
+	client.PrependReactor("*", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		handled, obj, err := react(action)
+		if err != nil || obj == nil {
+			return handled, obj, err
+		}
+		converted, err := devUnstructured(obj)
+		return true, converted, err
+	})
+	return client
+}
+
+// devUnstructured converts a typed object or list into an unstructured one
+// carrying its kind, as the API server returns them
+func devUnstructured(obj runtime.Object) (*unstructured.Unstructured, error) {
+	gvks, _, err := scheme.Scheme.ObjectKinds(obj)
+	if err != nil {
+		return nil, err
+	}
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	converted := &unstructured.Unstructured{Object: content}
+	converted.SetGroupVersionKind(gvks[0])
+	if items, ok := content["items"].([]interface{}); ok {
+		itemGVK := gvks[0]
+		itemGVK.Kind = strings.TrimSuffix(itemGVK.Kind, "List")
+		for _, item := range items {
+			if fields, ok := item.(map[string]interface{}); ok {
+				(&unstructured.Unstructured{Object: fields}).SetGroupVersionKind(itemGVK)
+			}
+		}
+	}
+	return converted, nil
+}
+
+// devUsage is the resource usage metrics-server reports in dev mode, of the
+// ready nodes and the running pods
+var devUsage = map[string][2]string{
+	"node/dev-node-1":            {"1200m", "6Gi"},
+	"node/dev-node-2":            {"2600m", "11Gi"},
+	"pod/web-6b7f9d8c5-2mzpt":    {"120m", "180Mi"},
+	"pod/web-6b7f9d8c5-8rtvx":    {"95m", "175Mi"},
+	"pod/api-7c6d5f8b9-q4w8n":    {"310m", "240Mi"},
+	"pod/worker-5d8f7c9b4-xk2lp": {"20m", "250Mi"},
+}
+
+// newDevMetricsClient returns a fake metrics.k8s.io client reporting the
+// usage of the dev cluster
+func newDevMetricsClient() *metricsfake.Clientset {
+	client := metricsfake.NewSimpleClientset()
+
+	// The fake client lists metrics by the resource names of the API, which
+	// the object tracker cannot guess from the kinds
+	nodes := metricsv1beta1.SchemeGroupVersion.WithResource("nodes")
+	pods := metricsv1beta1.SchemeGroupVersion.WithResource("pods")
+	now := metav1.Now()
+
+	for key, usage := range devUsage {
+		kind, name, _ := strings.Cut(key, "/")
+		resources := corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse(usage[0]),
+			corev1.ResourceMemory: resource.MustParse(usage[1]),
+		}
+
+		var err error
+		if kind == "node" {
+			err = client.Tracker().Create(nodes, &metricsv1beta1.NodeMetrics{
+				ObjectMeta: metav1.ObjectMeta{Name: name},
+				Timestamp:  now,
+				Window:     metav1.Duration{Duration: 30 * time.Second},
+				Usage:      resources,
+			}, "")
+		} else {
+			err = client.Tracker().Create(pods, &metricsv1beta1.PodMetrics{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: devNamespace},
+				Timestamp:  now,
+				Window:     metav1.Duration{Duration: 30 * time.Second},
+				Containers: []metricsv1beta1.ContainerMetrics{{Name: "main", Usage: resources}},
+			}, devNamespace)
+		}
+		if err != nil {
+			panic(fmt.Sprintf("failed to seed dev metrics: %v", err))
+		}
+	}
+
+	return client
+}
+
+// devKubeletClient serves the kubelet endpoints of the dev cluster nodes,
+// with stats built from the dev usage of their pods. The worker pod is
+// throttled more with every scrape of its node.
+type devKubeletClient struct {
+	clientset kubernetes.Interface
+
+	mu      sync.Mutex
+	scrapes map[string]int64
+}
+
+// newDevKubeletClient returns a kubelet client for the nodes of clientset
+func newDevKubeletClient(clientset kubernetes.Interface) *devKubeletClient {
+	return &devKubeletClient{clientset: clientset, scrapes: make(map[string]int64)}
+}
+
+// get returns the stats summary or the cAdvisor metrics of a node
+func (c *devKubeletClient) get(ctx context.Context, node, path string) ([]byte, error) {
+	if _, err := c.clientset.CoreV1().Nodes().Get(ctx, node, metav1.GetOptions{}); err != nil {
+		return nil, err
+	}
+	pods, err := c.clientset.CoreV1().Pods(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var running []corev1.Pod
+	for _, pod := range pods.Items {
+		if pod.Spec.NodeName == node && pod.Status.Phase == corev1.PodRunning {
+			running = append(running, pod)
+		}
+	}
+
+	switch path {
+	case kubeletSummaryPath:
+		return json.Marshal(devSummary(node, running))
+	case kubeletCAdvisorPath:
+		return []byte(c.devCAdvisor(node, running)), nil
+	default:
+		return nil, fmt.Errorf("the server could not find the requested resource %q", path)
+	}
+}
+
+// devSummary returns the stats summary of a dev node running pods
+func devSummary(node string, pods []corev1.Pod) *statsv1alpha1.Summary {
+	summary := &statsv1alpha1.Summary{Node: statsv1alpha1.NodeStats{NodeName: node}}
+	for _, pod := range pods {
+		usage := devUsage["pod/"+pod.Name]
+		cpuUsage, memoryUsage := resource.MustParse(usage[0]), resource.MustParse(usage[1])
+		cpu := uint64(cpuUsage.MilliValue()) * 1e6
+		memory := uint64(memoryUsage.Value())
+		rss := memory * 3 / 4
+		rx, tx, errs := memory/16, memory/32, uint64(0)
+		rootfs, logs := uint64(48<<20), uint64(2<<20)
+		ephemeral := rootfs + logs
+
+		summary.Pods = append(summary.Pods, statsv1alpha1.PodStats{
+			PodRef: statsv1alpha1.PodReference{Name: pod.Name, Namespace: pod.Namespace, UID: string(pod.UID)},
+			Containers: []statsv1alpha1.ContainerStats{{
+				Name:   "main",
+				CPU:    &statsv1alpha1.CPUStats{UsageNanoCores: &cpu},
+				Memory: &statsv1alpha1.MemoryStats{WorkingSetBytes: &memory, RSSBytes: &rss, UsageBytes: &memory},
+				Rootfs: &statsv1alpha1.FsStats{UsedBytes: &rootfs},
+				Logs:   &statsv1alpha1.FsStats{UsedBytes: &logs},
+			}},
+			Network: &statsv1alpha1.NetworkStats{
+				InterfaceStats: statsv1alpha1.InterfaceStats{Name: "eth0", RxBytes: &rx, TxBytes: &tx, RxErrors: &errs, TxErrors: &errs},
+			},
+			EphemeralStorage: &statsv1alpha1.FsStats{UsedBytes: &ephemeral},
+		})
+	}
+	return summary
+}
+
+// devCAdvisor returns the CFS counters cAdvisor of node reports for pods
+func (c *devKubeletClient) devCAdvisor(node string, pods []corev1.Pod) string {
+	c.mu.Lock()
+	c.scrapes[node]++
+	scrape := c.scrapes[node]
+	c.mu.Unlock()
+
+	var b strings.Builder
+	b.WriteString("# TYPE " + cadvisorCFSPeriods + " counter\n")
+	b.WriteString("# TYPE " + cadvisorCFSThrottledPeriods + " counter\n")
+	for _, pod := range pods {
+		labels := fmt.Sprintf(`{container="main",namespace=%q,pod=%q}`, pod.Namespace, pod.Name)
+		periods := 600 * scrape
+		throttled := scrape
+		if strings.HasPrefix(pod.Name, "worker-") {
+			throttled = 240 * scrape
+		}
+		fmt.Fprintf(&b, "%s%s %d\n", cadvisorCFSPeriods, labels, periods)
+		fmt.Fprintf(&b, "%s%s %d\n", cadvisorCFSThrottledPeriods, labels, throttled)
+	}
+	return b.String()
+}
+
+// devNamespaceObject builds a namespace with an optional fixed UID
+func devNamespaceObject(name, uid string) *corev1.Namespace {
+	return &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: name, UID: k8stypes.UID(uid)},
+		Status:     corev1.NamespaceStatus{Phase: corev1.NamespaceActive},
+	}
+}
+
+// devNode builds a node with typical capacity and the given readiness
+func devNode(name string, ready, unschedulable bool) *corev1.Node {
+	status := corev1.ConditionTrue
+	if !ready {
+		status = corev1.ConditionUnknown
+	}
+
+	capacity := corev1.ResourceList{
+		corev1.ResourceCPU:              resource.MustParse("4"),
+		corev1.ResourceMemory:           resource.MustParse("16Gi"),
+		corev1.ResourcePods:             resource.MustParse("110"),
+		corev1.ResourceEphemeralStorage: resource.MustParse("100Gi"),
+	}
+
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{"kubernetes.io/hostname": name},
+		},
+		Spec: corev1.NodeSpec{Unschedulable: unschedulable},
+		Status: corev1.NodeStatus{
+			Capacity:    capacity,
+			Allocatable: capacity,
+			Conditions: []corev1.NodeCondition{
+				{Type: corev1.NodeReady, Status: status},
+			},
+			NodeInfo: corev1.NodeSystemInfo{
+				KubeletVersion:          "v1.34.1",
+				ContainerRuntimeVersion: "containerd://2.1.4",
+				OSImage:                 "Dev Linux",
+			},
+		},
+	}
+}
+
+// devPod builds a single-container pod in the dev namespace
+func devPod(name, node string, phase corev1.PodPhase, restarts int32, waitingReason string) *corev1.Pod {
+	container := corev1.ContainerStatus{
+		Name:         "main",
+		Ready:        phase == corev1.PodRunning && waitingReason == "",
+		RestartCount: restarts,
+	}
+	if waitingReason != "" {
+		container.State.Waiting = &corev1.ContainerStateWaiting{Reason: waitingReason}
+	}
+
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: devNamespace, CreationTimestamp: metav1.Now()},
+		Spec: corev1.PodSpec{
+			NodeName: node,
+			Containers: []corev1.Container{{
+				Name:  "main",
+				Image: "registry.local/demo/" + name,
+				Resources: corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{
+						corev1.ResourceCPU:    resource.MustParse("250m"),
+						corev1.ResourceMemory: resource.MustParse("256Mi"),
+					},
+				},
+			}},
+		},
+		Status: corev1.PodStatus{
+			Phase:             phase,
+			ContainerStatuses: []corev1.ContainerStatus{container},
+		},
+	}
+}
+
+// devClaim builds a PVC in the dev namespace that is never bound
+func devClaim(name, storageClass string) *corev1.PersistentVolumeClaim {
+	return &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: devNamespace, CreationTimestamp: metav1.Now()},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes:      []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			StorageClassName: &storageClass,
+			Resources: corev1.VolumeResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("10Gi")},
+			},
+		},
+		Status: corev1.PersistentVolumeClaimStatus{Phase: corev1.ClaimPending},
+	}
+}
+
+// runDevEvents creates a synthetic event in the dev cluster every period until stopped
+func runDevEvents(ctx context.Context, clientset kubernetes.Interface, period time.Duration, stopCh <-chan struct{}, logger *zap.Logger) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for i := 0; ; i++ {
+		tmpl := devEvents[i%len(devEvents)]
+		if err := createDevEvent(ctx, clientset, tmpl); err != nil {
+			logger.Warn("Failed to create dev event", zap.Error(err))
+		}
+
+		// Back-offs come with a restart of the crash-looping container
+		if tmpl.reason == "BackOff" {
+			if err := restartDevPod(ctx, clientset, tmpl.name); err != nil {
+				logger.Warn("Failed to restart dev pod", zap.Error(err))
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// restartDevPod records a restart of the container of a dev pod, which last
+// terminated with an error
+func restartDevPod(ctx context.Context, clientset kubernetes.Interface, name string) error {
+	pods := clientset.CoreV1().Pods(devNamespace)
+	pod, err := pods.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	now := metav1.Now()
+	for i := range pod.Status.ContainerStatuses {
+		status := &pod.Status.ContainerStatuses[i]
+		status.RestartCount++
+		status.LastTerminationState.Terminated = &corev1.ContainerStateTerminated{
+			ExitCode:   1,
+			Reason:     "Error",
+			StartedAt:  metav1.NewTime(now.Add(-10 * time.Second)),
+			FinishedAt: now,
+		}
+	}
+
+	_, err = pods.UpdateStatus(ctx, pod, metav1.UpdateOptions{})
+	return err
+}
+
+// createDevEvent creates an event from a template. The API server serves
+// every event through both event APIs while the fake clientset keeps them
+// apart, so the event is created through both.
+func createDevEvent(ctx context.Context, clientset kubernetes.Interface, tmpl devEventTemplate) error {
+	now := metav1.Now()
+
+	namespace := tmpl.namespace
+	if namespace == "" {
+		namespace = metav1.NamespaceDefault
+	}
+
+	objectMeta := metav1.ObjectMeta{
+		Name:              fmt.Sprintf("%s.%x", tmpl.name, now.UnixNano()),
+		Namespace:         namespace,
+		UID:               uuid.NewUUID(),
+		CreationTimestamp: now,
+	}
+	regarding := corev1.ObjectReference{
+		Kind:      tmpl.kind,
+		Namespace: tmpl.namespace,
+		Name:      tmpl.name,
+	}
+
+	event := &eventsv1.Event{
+		ObjectMeta:          objectMeta,
+		EventTime:           metav1.NewMicroTime(now.Time),
+		ReportingController: "aetherius.io/dev-mode",
+		ReportingInstance:   "dev-mode",
+		Action:              "Observe",
+		Regarding:           regarding,
+		Type:                tmpl.eventType,
+		Reason:              tmpl.reason,
+		Note:                tmpl.message,
+	}
+	if _, err := clientset.EventsV1().Events(namespace).Create(ctx, event, metav1.CreateOptions{}); err != nil {
+		return err
+	}
+
+	legacy := &corev1.Event{
+		ObjectMeta:          objectMeta,
+		InvolvedObject:      regarding,
+		Type:                tmpl.eventType,
+		Reason:              tmpl.reason,
+		Message:             tmpl.message,
+		Source:              corev1.EventSource{Component: "dev-mode"},
+		FirstTimestamp:      now,
+		LastTimestamp:       now,
+		Count:               1,
+		EventTime:           event.EventTime,
+		ReportingController: event.ReportingController,
+		ReportingInstance:   event.ReportingInstance,
+		Action:              event.Action,
+	}
+	_, err := clientset.CoreV1().Events(namespace).Create(ctx, legacy, metav1.CreateOptions{})
+	return err
+}
@@ -0,0 +1,281 @@
+package agent
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// messageNumbers matches the numbers and durations in event messages, such as
+// back-off delays and restart counts, which change between occurrences of the
+// same problem
+var messageNumbers = regexp.MustCompile(`([0-9]+(\.[0-9]+)?(ns|us|µs|ms|h|m|s)?)+`)
+
+// dedupReport is an event occurrence, or a summary of repeated occurrences, to publish
+type dedupReport struct {
+	event     *corev1.Event
+	eventType string
+	severity  string
+
+	fingerprint string
+	summary     bool  // false for the first occurrence
+	occurrences int64 // occurrences since the previous report
+	total       int64 // occurrences since the first report
+	firstSeen   time.Time
+	lastSeen    time.Time
+}
+
+// dedupEntry tracks the occurrences of one problem within the window
+type dedupEntry struct {
+	key         string
+	fingerprint string
+
+	// Latest Kubernetes event of the problem and its count, used to turn
+	// count updates of the same event object into occurrences
+	event     *corev1.Event
+	eventType string
+	severity  string
+	eventObj  string
+	lastCount int32
+
+	firstSeen    time.Time
+	lastSeen     time.Time
+	lastReported time.Time
+	total        int64
+	pending      int64 // occurrences not yet reported
+
+	elem *list.Element
+}
+
+// eventDeduplicator compresses repeated events. Events are keyed on the
+// involved object UID, the reason and a fingerprint of the message; the first
+// occurrence of a key is reported immediately and later occurrences are
+// reported as one summary per window. Keys without occurrences for a window
+// are forgotten, and the least recently seen keys are evicted beyond maxEntries.
+type eventDeduplicator struct {
+	window     time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*dedupEntry
+	lru     *list.List // front is the most recently seen entry
+}
+
+// newEventDeduplicator creates a deduplicator
+func newEventDeduplicator(window time.Duration, maxEntries int) *eventDeduplicator {
+	return &eventDeduplicator{
+		window:     window,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*dedupEntry),
+		lru:        list.New(),
+	}
+}
+
+// dedupKey returns the deduplication key and message fingerprint of an event
+func dedupKey(event *corev1.Event) (string, string) {
+	object := string(event.InvolvedObject.UID)
+	if object == "" {
+		object = event.InvolvedObject.Kind + "/" + event.InvolvedObject.Namespace + "/" + event.InvolvedObject.Name
+	}
+
+	sum := sha256.Sum256([]byte(messageNumbers.ReplaceAllString(event.Message, "#")))
+	fingerprint := hex.EncodeToString(sum[:8])
+
+	return object + "|" + event.Reason + "|" + fingerprint, fingerprint
+}
+
+// observe records an event and returns the reports to publish: the event
+// itself for a first occurrence, and summaries of entries evicted to make room
+func (d *eventDeduplicator) observe(event *corev1.Event, eventType, severity string, now time.Time) []*dedupReport {
+	key, fingerprint := dedupKey(event)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if entry, ok := d.entries[key]; ok {
+		if entry.pending > 0 || now.Sub(entry.lastSeen) < d.window {
+			n := entry.occurrences(event, eventType)
+			if n == 0 {
+				return nil
+			}
+
+			entry.event = event
+			entry.eventType = eventType
+			entry.severity = severity
+			entry.lastSeen = now
+			entry.total += n
+			entry.pending += n
+			d.lru.MoveToFront(entry.elem)
+			return nil
+		}
+
+		// Quiet for a whole window: start over
+		d.remove(entry)
+	}
+
+	// Deletions of unknown events are expired events, not occurrences
+	if eventType == "DELETED" {
+		return nil
+	}
+
+	entry := &dedupEntry{
+		key:          key,
+		fingerprint:  fingerprint,
+		event:        event,
+		eventType:    eventType,
+		severity:     severity,
+		eventObj:     eventObjectID(event),
+		lastCount:    event.Count,
+		firstSeen:    now,
+		lastSeen:     now,
+		lastReported: now,
+		total:        countOrOne(event.Count),
+	}
+	entry.elem = d.lru.PushFront(entry)
+	d.entries[key] = entry
+
+	// An added event brings its whole count; an update of an event whose
+	// entry was forgotten brings one occurrence on top of those reported before
+	occurrences := entry.total
+	if eventType != "ADDED" {
+		occurrences = 1
+	}
+	reports := []*dedupReport{entry.report(occurrences, false)}
+
+	for d.lru.Len() > d.maxEntries {
+		oldest := d.lru.Back().Value.(*dedupEntry)
+		if oldest.pending > 0 {
+			reports = append(reports, oldest.report(oldest.pending, true))
+		}
+		d.remove(oldest)
+	}
+
+	return reports
+}
+
+// forget removes the entry of an event whose first occurrence could not be
+// published, so that the next occurrence is reported in full again
+func (d *eventDeduplicator) forget(event *corev1.Event) {
+	key, _ := dedupKey(event)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if entry, ok := d.entries[key]; ok && entry.pending == 0 {
+		d.remove(entry)
+	}
+}
+
+// flush returns summaries of the entries with occurrences reported more than
+// a window ago, and forgets entries without occurrences for a window
+func (d *eventDeduplicator) flush(now time.Time) []*dedupReport {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var reports []*dedupReport
+	for elem := d.lru.Back(); elem != nil; {
+		entry := elem.Value.(*dedupEntry)
+		elem = elem.Prev()
+
+		switch {
+		case entry.pending > 0 && now.Sub(entry.lastReported) >= d.window:
+			reports = append(reports, entry.report(entry.pending, true))
+			entry.pending = 0
+			entry.lastReported = now
+		case entry.pending == 0 && now.Sub(entry.lastSeen) >= d.window:
+			d.remove(entry)
+		}
+	}
+
+	return reports
+}
+
+// drain returns summaries of all entries with unreported occurrences
+func (d *eventDeduplicator) drain() []*dedupReport {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var reports []*dedupReport
+	for elem := d.lru.Back(); elem != nil; elem = elem.Prev() {
+		entry := elem.Value.(*dedupEntry)
+		if entry.pending > 0 {
+			reports = append(reports, entry.report(entry.pending, true))
+			entry.pending = 0
+		}
+	}
+	return reports
+}
+
+// len returns the number of tracked keys
+func (d *eventDeduplicator) len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.entries)
+}
+
+// remove forgets an entry
+func (d *eventDeduplicator) remove(entry *dedupEntry) {
+	d.lru.Remove(entry.elem)
+	delete(d.entries, entry.key)
+}
+
+// occurrences returns the number of new occurrences an update of the entry
+// carries and records its count. Kubernetes bumps the count of an existing
+// event object on repeats, so only the increase is new; other event objects
+// for the same problem bring their whole count.
+func (e *dedupEntry) occurrences(event *corev1.Event, eventType string) int64 {
+	if eventType == "DELETED" {
+		return 0
+	}
+
+	id := eventObjectID(event)
+	if id == e.eventObj {
+		n := int64(event.Count) - int64(e.lastCount)
+		if n <= 0 {
+			return 0
+		}
+		e.lastCount = event.Count
+		return n
+	}
+
+	e.eventObj = id
+	e.lastCount = event.Count
+	return countOrOne(event.Count)
+}
+
+// report creates a report of the entry
+func (e *dedupEntry) report(occurrences int64, summary bool) *dedupReport {
+	return &dedupReport{
+		event:       e.event,
+		eventType:   e.eventType,
+		severity:    e.severity,
+		fingerprint: e.fingerprint,
+		summary:     summary,
+		occurrences: occurrences,
+		total:       e.total,
+		firstSeen:   e.firstSeen,
+		lastSeen:    e.lastSeen,
+	}
+}
+
+// eventObjectID identifies an event object by its UID, or by its name when
+// the UID is not set
+func eventObjectID(event *corev1.Event) string {
+	if event.UID != "" {
+		return string(event.UID)
+	}
+	return event.Namespace + "/" + event.Name
+}
+
+// countOrOne returns the count of an event, which is zero for events that do not set it
+func countOrOne(count int32) int64 {
+	if count < 1 {
+		return 1
+	}
+	return int64(count)
+}
@@ -0,0 +1,161 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/kart/k8s-agent/collect-agent/internal/types"
+)
+
+func newCountedEvent(uid, message string, count int32) *corev1.Event {
+	event := newTestEvent("web-1.17a", "BackOff")
+	event.UID = k8stypes.UID(uid)
+	event.InvolvedObject.UID = "pod-uid-1"
+	event.Message = message
+	event.Count = count
+	return event
+}
+
+func TestDedupKey(t *testing.T) {
+	base := newCountedEvent("e1", "Back-off 10s restarting failed container", 1)
+	key, _ := dedupKey(base)
+
+	sameProblem := newCountedEvent("e2", "Back-off 2m40s restarting failed container", 1)
+	if got, _ := dedupKey(sameProblem); got != key {
+		t.Errorf("messages differing in numbers get different keys: %v, %v", got, key)
+	}
+
+	otherReason := newCountedEvent("e1", base.Message, 1)
+	otherReason.Reason = "Unhealthy"
+	otherMessage := newCountedEvent("e1", "Readiness probe failed", 1)
+	otherObject := newCountedEvent("e1", base.Message, 1)
+	otherObject.InvolvedObject.UID = "pod-uid-2"
+
+	for name, event := range map[string]*corev1.Event{
+		"reason":  otherReason,
+		"message": otherMessage,
+		"object":  otherObject,
+	} {
+		if got, _ := dedupKey(event); got == key {
+			t.Errorf("events with a different %s share the key %v", name, key)
+		}
+	}
+}
+
+func TestEventDeduplicator(t *testing.T) {
+	d := newEventDeduplicator(time.Minute, 100)
+	start := time.Now()
+	message := "Back-off restarting failed container"
+
+	// The first occurrence is reported immediately with its count
+	reports := d.observe(newCountedEvent("e1", message, 3), "ADDED", "high", start)
+	if len(reports) != 1 || reports[0].summary || reports[0].occurrences != 3 {
+		t.Fatalf("first reports = %+v, want one first report of 3 occurrences", reports)
+	}
+
+	// Count updates of the same event object and other objects are counted, not reported
+	if reports := d.observe(newCountedEvent("e1", message, 5), "MODIFIED", "high", start.Add(time.Second)); reports != nil {
+		t.Errorf("count update reported: %+v", reports)
+	}
+	if reports := d.observe(newCountedEvent("e1", message, 5), "MODIFIED", "high", start.Add(2*time.Second)); reports != nil {
+		t.Errorf("unchanged count reported: %+v", reports)
+	}
+	if reports := d.observe(newCountedEvent("e2", message, 1), "ADDED", "critical", start.Add(3*time.Second)); reports != nil {
+		t.Errorf("new event object reported: %+v", reports)
+	}
+	if reports := d.observe(newCountedEvent("e1", message, 5), "DELETED", "high", start.Add(4*time.Second)); reports != nil {
+		t.Errorf("deletion reported: %+v", reports)
+	}
+
+	// Nothing is summarized before the window ends
+	if reports := d.flush(start.Add(30 * time.Second)); len(reports) != 0 {
+		t.Errorf("flush within the window = %+v, want none", reports)
+	}
+
+	reports = d.flush(start.Add(time.Minute))
+	if len(reports) != 1 {
+		t.Fatalf("flush after the window = %+v, want one summary", reports)
+	}
+	summary := reports[0]
+	if !summary.summary || summary.occurrences != 3 || summary.total != 6 {
+		t.Errorf("summary = %+v, want 3 occurrences of 6 in total", summary)
+	}
+	if summary.severity != "critical" {
+		t.Errorf("summary severity = %v, want the latest severity", summary.severity)
+	}
+
+	// Keys without occurrences for a window are forgotten and reported again
+	if reports := d.flush(start.Add(2 * time.Minute)); len(reports) != 0 {
+		t.Errorf("flush without occurrences = %+v, want none", reports)
+	}
+	if d.len() != 0 {
+		t.Errorf("len = %v, want 0 after a quiet window", d.len())
+	}
+	reports = d.observe(newCountedEvent("e1", message, 7), "MODIFIED", "high", start.Add(3*time.Minute))
+	if len(reports) != 1 || reports[0].summary || reports[0].occurrences != 1 {
+		t.Errorf("reports after a quiet window = %+v, want one first report", reports)
+	}
+}
+
+func TestEventDeduplicatorEviction(t *testing.T) {
+	d := newEventDeduplicator(time.Minute, 2)
+	now := time.Now()
+
+	first := newCountedEvent("e1", "first", 1)
+	d.observe(first, "ADDED", "high", now)
+	d.observe(newCountedEvent("e1", "first", 2), "MODIFIED", "high", now)
+	d.observe(newCountedEvent("e2", "second", 1), "ADDED", "high", now)
+
+	// Evicting an entry with unreported occurrences summarizes it
+	reports := d.observe(newCountedEvent("e3", "third", 1), "ADDED", "high", now)
+	if len(reports) != 2 || !reports[1].summary || reports[1].event.Message != "first" {
+		t.Fatalf("reports = %+v, want the new event and a summary of the evicted one", reports)
+	}
+	if d.len() != 2 {
+		t.Errorf("len = %v, want 2", d.len())
+	}
+
+	// Entries of lost first reports are forgotten
+	d.forget(newCountedEvent("e3", "third", 1))
+	if reports := d.observe(newCountedEvent("e3", "third", 1), "ADDED", "high", now); len(reports) != 1 {
+		t.Errorf("reports after forget = %+v, want the event again", reports)
+	}
+
+	if reports := d.drain(); len(reports) != 0 {
+		t.Errorf("drain = %+v, want nothing pending", reports)
+	}
+}
+
+func TestEventWatcherDeduplication(t *testing.T) {
+	eventChan := make(chan *types.Event, 10)
+	watcher := NewEventWatcher(fake.NewSimpleClientset(), "test-cluster", eventChan, zap.NewNop())
+	watcher.SetDeduplication(time.Minute, 100)
+
+	message := "Back-off restarting failed container"
+	watcher.handleEvent(newCountedEvent("e1", message, 1), "ADDED")
+	for count := int32(2); count <= 10; count++ {
+		watcher.handleEvent(newCountedEvent("e1", message, count), "MODIFIED")
+	}
+
+	if len(eventChan) != 1 {
+		t.Fatalf("events sent = %v, want 1", len(eventChan))
+	}
+	first := <-eventChan
+	if first.Labels["dedup"] != "first" || first.RawData["occurrences"] != int64(1) {
+		t.Errorf("first event labels = %v, raw data = %v", first.Labels, first.RawData)
+	}
+
+	watcher.publishReports(watcher.dedup.drain())
+	if len(eventChan) != 1 {
+		t.Fatalf("summaries sent = %v, want 1", len(eventChan))
+	}
+	summary := <-eventChan
+	if summary.Labels["dedup"] != "summary" || summary.RawData["occurrences"] != int64(9) || summary.RawData["total_occurrences"] != int64(10) {
+		t.Errorf("summary labels = %v, raw data = %v", summary.Labels, summary.RawData)
+	}
+}
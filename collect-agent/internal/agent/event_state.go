@@ -0,0 +1,63 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// eventStateSaveInterval is how often the event watch position is saved
+const eventStateSaveInterval = 5 * time.Second
+
+// eventWatchState is the event watch position kept across restarts
+type eventWatchState struct {
+	API             string    `json:"api"`
+	ResourceVersion string    `json:"resource_version"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// eventStateFile returns the state file of a cluster in dir
+func eventStateFile(dir, clusterID string) string {
+	return filepath.Join(dir, "events-"+clusterID+".json")
+}
+
+// loadEventWatchState reads a saved watch position; a missing file returns nil
+func loadEventWatchState(path string) (*eventWatchState, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read event watch state: %w", err)
+	}
+
+	var state eventWatchState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse event watch state %s: %w", path, err)
+	}
+	return &state, nil
+}
+
+// saveEventWatchState writes the watch position, replacing the file atomically
+func saveEventWatchState(path string, state *eventWatchState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event watch state: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create event state directory: %w", err)
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write event watch state: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write event watch state: %w", err)
+	}
+	return nil
+}
@@ -2,33 +2,59 @@ package agent
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
 	corev1 "k8s.io/api/core/v1"
+	eventsv1 "k8s.io/api/events/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/fields"
-	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
 
+	"github.com/kart/k8s-agent/collect-agent/internal/rules"
 	"github.com/kart/k8s-agent/collect-agent/internal/types"
 )
 
 // EventWatcher watches Kubernetes events and sends them to the event channel
 type EventWatcher struct {
-	clientset   kubernetes.Interface
-	clusterID   string
-	eventChan   chan<- *types.Event
-	stopCh      chan struct{}
-	wg          sync.WaitGroup
-	running     bool
-	mu          sync.RWMutex
-	lastEventID string
-	logger      *zap.Logger
+	clientset kubernetes.Interface
+	clusterID string
+	eventChan chan<- *types.Event
+	stopCh    chan struct{}
+	wg        sync.WaitGroup
+	running   bool
+	mu        sync.RWMutex
+	logger    *zap.Logger
+
+	// api is the event API watched, types.EventAPIEventsV1 or types.EventAPICoreV1
+	api string
+
+	// stateFile keeps the resourceVersion of the last handled event so that
+	// watching resumes there after a restart; empty disables resuming
+	stateFile       string
+	resourceVersion atomic.Value // string
+
+	// rules decide which events are forwarded and their severity; nil uses the built-in rules
+	rules *rules.Store
+
+	// dedup compresses repeated events; nil forwards every event
+	dedup *eventDeduplicator
+
+	// overflow receives events that do not fit in eventChan, returning true if it kept them
+	overflow func(*types.Event) bool
+
+	controller cache.Controller
+	health     componentHealth
+	dropped    atomic.Int64
+	metrics    *agentMetrics
 }
 
 // NewEventWatcher creates a new event watcher
@@ -39,9 +65,44 @@ func NewEventWatcher(clientset kubernetes.Interface, clusterID string, eventChan
 		eventChan: eventChan,
 		stopCh:    make(chan struct{}),
 		logger:    logger.With(zap.String("component", "event-watcher")),
+		api:       types.EventAPIEventsV1,
 	}
 }
 
+// SetAPI sets the event API to watch, types.EventAPIEventsV1 or
+// types.EventAPICoreV1; empty keeps events.k8s.io/v1
+func (ew *EventWatcher) SetAPI(api string) {
+	if api != "" {
+		ew.api = api
+	}
+}
+
+// SetStateFile sets the file keeping the watch position across restarts
+func (ew *EventWatcher) SetStateFile(path string) {
+	ew.stateFile = path
+}
+
+// SetRules sets the store holding the event filter rules
+func (ew *EventWatcher) SetRules(store *rules.Store) {
+	ew.rules = store
+}
+
+// SetDeduplication compresses events repeated within window into periodic
+// summaries, tracking at most maxEntries distinct events. A zero window
+// forwards every event.
+func (ew *EventWatcher) SetDeduplication(window time.Duration, maxEntries int) {
+	if window <= 0 {
+		ew.dedup = nil
+		return
+	}
+	ew.dedup = newEventDeduplicator(window, maxEntries)
+}
+
+// SetOverflowHandler sets the handler for events that do not fit in the event channel
+func (ew *EventWatcher) SetOverflowHandler(handler func(*types.Event) bool) {
+	ew.overflow = handler
+}
+
 // Start begins watching for Kubernetes events
 func (ew *EventWatcher) Start(ctx context.Context) error {
 	ew.mu.Lock()
@@ -52,24 +113,27 @@ func (ew *EventWatcher) Start(ctx context.Context) error {
 	ew.running = true
 	ew.mu.Unlock()
 
-	ew.logger.Info("Starting event watcher", zap.String("cluster_id", ew.clusterID))
+	ew.logger.Info("Starting event watcher",
+		zap.String("cluster_id", ew.clusterID),
+		zap.String("api", ew.api))
 
-	watchlist := cache.NewListWatchFromClient(
-		ew.clientset.CoreV1().RESTClient(),
-		"events",
-		metav1.NamespaceAll,
-		fields.Everything(),
-	)
+	watchlist, objType := ew.listWatch(ew.resumeVersion())
 
+	// Events do not change once handled, so the informer does not resync
 	_, controller := cache.NewInformer(
 		watchlist,
-		&corev1.Event{},
-		time.Second*10,
+		objType,
+		0,
 		cache.ResourceEventHandlerFuncs{
 			AddFunc: func(obj interface{}) {
 				ew.handleEvent(obj, "ADDED")
 			},
 			UpdateFunc: func(oldObj, newObj interface{}) {
+				// Resyncs redeliver events that were already handled
+				if isResync(oldObj, newObj) {
+					ew.metrics.informerResync(informerEvents)
+					return
+				}
 				ew.handleEvent(newObj, "MODIFIED")
 			},
 			DeleteFunc: func(obj interface{}) {
@@ -78,12 +142,26 @@ func (ew *EventWatcher) Start(ctx context.Context) error {
 		},
 	)
 
+	ew.mu.Lock()
+	ew.controller = controller
+	ew.mu.Unlock()
+
 	ew.wg.Add(1)
 	go func() {
 		defer ew.wg.Done()
 		controller.Run(ew.stopCh)
 	}()
 
+	if ew.dedup != nil {
+		ew.wg.Add(1)
+		go ew.summarize()
+	}
+
+	if ew.stateFile != "" {
+		ew.wg.Add(1)
+		go ew.saveState()
+	}
+
 	ew.logger.Info("Event watcher started")
 	return nil
 }
@@ -104,100 +182,333 @@ func (ew *EventWatcher) Stop() {
 	ew.logger.Info("Event watcher stopped")
 }
 
+// listWatch returns the list and watch functions of the configured event API,
+// going through the typed clients, which fake clientsets also implement, and
+// tracking API server errors. Given a resourceVersion to resume from, the
+// first list returns no events so that the informer watches from there; if
+// the API server no longer has that version, the informer lists again.
+func (ew *EventWatcher) listWatch(resumeFrom string) (cache.ListerWatcher, runtime.Object) {
+	var (
+		list      func(context.Context, metav1.ListOptions) (runtime.Object, error)
+		watchFunc func(context.Context, metav1.ListOptions) (watch.Interface, error)
+		objType   runtime.Object
+		emptyList runtime.Object
+	)
+
+	switch ew.api {
+	case types.EventAPICoreV1:
+		events := ew.clientset.CoreV1().Events(metav1.NamespaceAll)
+		list = func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error) {
+			return events.List(ctx, options)
+		}
+		watchFunc = events.Watch
+		objType = &corev1.Event{}
+		emptyList = &corev1.EventList{ListMeta: metav1.ListMeta{ResourceVersion: resumeFrom}}
+	default:
+		events := ew.clientset.EventsV1().Events(metav1.NamespaceAll)
+		list = func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error) {
+			return events.List(ctx, options)
+		}
+		watchFunc = events.Watch
+		objType = &eventsv1.Event{}
+		emptyList = &eventsv1.EventList{ListMeta: metav1.ListMeta{ResourceVersion: resumeFrom}}
+	}
+
+	return &cache.ListWatch{
+		ListWithContextFunc: func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error) {
+			if resumeFrom != "" {
+				resumeFrom = ""
+				return emptyList, nil
+			}
+			obj, err := list(ctx, options)
+			ew.recordAPIResult(err)
+			return obj, err
+		},
+		WatchFuncWithContext: func(ctx context.Context, options metav1.ListOptions) (watch.Interface, error) {
+			w, err := watchFunc(ctx, options)
+			ew.recordAPIResult(err)
+			return w, err
+		},
+	}, objType
+}
+
+// resumeVersion returns the saved resourceVersion to resume watching from,
+// or an empty string to list all events
+func (ew *EventWatcher) resumeVersion() string {
+	if ew.stateFile == "" {
+		return ""
+	}
+
+	state, err := loadEventWatchState(ew.stateFile)
+	if err != nil {
+		ew.logger.Warn("Failed to load event watch state, listing all events", zap.Error(err))
+		return ""
+	}
+	if state == nil || state.API != ew.api || state.ResourceVersion == "" {
+		return ""
+	}
+
+	ew.logger.Info("Resuming event watch",
+		zap.String("resource_version", state.ResourceVersion),
+		zap.Time("saved_at", state.UpdatedAt))
+	return state.ResourceVersion
+}
+
+// saveState saves the watch position periodically and when the watcher stops
+func (ew *EventWatcher) saveState() {
+	defer ew.wg.Done()
+
+	ticker := time.NewTicker(eventStateSaveInterval)
+	defer ticker.Stop()
+
+	saved := ""
+	for {
+		select {
+		case <-ew.stopCh:
+			ew.persistState(&saved)
+			return
+		case <-ticker.C:
+			ew.persistState(&saved)
+		}
+	}
+}
+
+// persistState writes the resourceVersion of the last handled event if it changed
+func (ew *EventWatcher) persistState(saved *string) {
+	rv, _ := ew.resourceVersion.Load().(string)
+	if rv == "" || rv == *saved {
+		return
+	}
+
+	state := &eventWatchState{API: ew.api, ResourceVersion: rv, UpdatedAt: time.Now()}
+	if err := saveEventWatchState(ew.stateFile, state); err != nil {
+		ew.logger.Warn("Failed to save event watch state", zap.Error(err))
+		return
+	}
+	*saved = rv
+}
+
 // handleEvent processes a Kubernetes event and converts it to our Event type
 func (ew *EventWatcher) handleEvent(obj interface{}, eventType string) {
-	event, ok := obj.(*corev1.Event)
+	event, ok := kubernetesEvent(obj)
 	if !ok {
 		ew.logger.Warn("Failed to cast object to Event")
 		return
 	}
 
-	// Filter events based on importance
-	if !ew.shouldProcessEvent(event) {
+	// Deleted events carry the version of their last update, which would
+	// move the saved watch position backwards
+	if eventType != "DELETED" {
+		defer ew.resourceVersion.Store(event.ResourceVersion)
+	}
+
+	ew.metrics.eventSeen(event.Reason)
+
+	// Filter events and assign their severity with the event rules
+	decision := ew.rules.RuleSet().Evaluate(rules.FromKubernetes(event))
+	if !decision.Include {
+		ew.metrics.eventFiltered(eventFilterIrrelevant)
 		return
 	}
 
-	// Convert Kubernetes event to our Event type
-	agentEvent := ew.convertEvent(event, eventType)
+	if ew.dedup == nil {
+		ew.publish(ew.convertEvent(event, eventType, decision.Severity))
+		return
+	}
 
-	// Avoid duplicate events
-	if ew.isDuplicateEvent(agentEvent) {
+	// Repeats of a recently reported event are only counted, and reported
+	// in the next summary
+	reports := ew.dedup.observe(event, eventType, decision.Severity, time.Now())
+	if len(reports) == 0 {
+		ew.metrics.eventFiltered(eventFilterDuplicate)
 		return
 	}
 
+	// The first report is the event itself; let its next occurrence be
+	// reported in full if it is lost
+	if !ew.publish(ew.convertReport(reports[0])) {
+		ew.dedup.forget(event)
+	}
+	ew.publishReports(reports[1:])
+}
+
+// publish sends an event to the event channel, or to the overflow handler
+// when the channel is full, and reports whether the event was kept
+func (ew *EventWatcher) publish(agentEvent *types.Event) bool {
 	select {
 	case ew.eventChan <- agentEvent:
 		ew.logger.Debug("Event sent",
 			zap.String("event_id", agentEvent.ID),
 			zap.String("reason", agentEvent.Reason),
 			zap.String("namespace", agentEvent.Namespace))
-		ew.lastEventID = agentEvent.ID
+		return true
 	default:
+		if ew.overflow != nil && ew.overflow(agentEvent) {
+			ew.logger.Debug("Event channel full, event spooled",
+				zap.String("event_id", agentEvent.ID))
+			return true
+		}
+		ew.dropped.Add(1)
+		ew.metrics.eventDropped(eventDropQueueFull)
 		ew.logger.Warn("Event channel full, dropping event",
 			zap.String("event_id", agentEvent.ID))
+		return false
 	}
 }
 
-// shouldProcessEvent determines if an event should be processed based on its importance
-func (ew *EventWatcher) shouldProcessEvent(event *corev1.Event) bool {
-	// Focus on critical events that indicate problems
-	criticalReasons := map[string]bool{
-		"Failed":                   true,
-		"FailedMount":              true,
-		"FailedSync":               true,
-		"FailedCreatePodSandBox":   true,
-		"FailedKillPod":            true,
-		"FailedPodSandBoxStatus":   true,
-		"FailedScheduling":         true,
-		"InspectFailed":            true,
-		"Killing":                  true,
-		"NodeNotReady":             true,
-		"NodeNotSchedulable":       true,
-		"Preempting":               true,
-		"Pulling":                  true,
-		"Rebooted":                 true,
-		"Starting":                 true,
-		"Unhealthy":                true,
-		"BackOff":                  true,
-		"CrashLoopBackOff":         true,
-		"ImagePullBackOff":         true,
-		"InvalidImageName":         true,
-		"ErrImagePull":             true,
-		"ImageInspectError":        true,
-		"ErrImageNeverPull":        true,
-		"RegistryUnavailable":      true,
-		"OOMKilling":               true,
-		"ProbeWarning":             true,
-		"ExceededGracePeriod":      true,
-		"FailedPostStartHook":      true,
-		"FailedPreStopHook":        true,
-		"UnexpectedAdmissionError": true,
-		"DNSConfigForming":         true,
-		"ContainerGCFailed":        true,
-		"ImageGCFailed":            true,
-		"FailedNodeAllocatableEnforcement": true,
-		"FailedAttachVolume":               true,
-		"FailedDetachVolume":               true,
-		"VolumeResizeFailed":               true,
-		"FileSystemResizeFailed":           true,
-		"FailedMapVolume":                  true,
-		"FailedUnmapDevice":                true,
-	}
-
-	// Also include Warning and Error type events
-	if event.Type == corev1.EventTypeWarning || event.Type == corev1.EventTypeNormal {
-		return criticalReasons[event.Reason]
-	}
-
-	return false
+// publishReports publishes deduplication reports
+func (ew *EventWatcher) publishReports(reports []*dedupReport) {
+	for _, report := range reports {
+		ew.publish(ew.convertReport(report))
+	}
+}
+
+// summarize publishes the summaries of repeated events every window, and the
+// pending summaries when the watcher stops
+func (ew *EventWatcher) summarize() {
+	defer ew.wg.Done()
+
+	ticker := time.NewTicker(dedupFlushInterval(ew.dedup.window))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ew.stopCh:
+			ew.publishReports(ew.dedup.drain())
+			return
+		case now := <-ticker.C:
+			ew.publishReports(ew.dedup.flush(now))
+		}
+	}
+}
+
+// dedupFlushInterval returns how often summaries are checked, a fraction of
+// the window so that summaries go out close to the end of their window
+func dedupFlushInterval(window time.Duration) time.Duration {
+	interval := window / 5
+	if interval < time.Second {
+		interval = time.Second
+	}
+	return interval
+}
+
+// isResync reports whether an informer update redelivers an unchanged object.
+// Objects without a resourceVersion, as kept by fake clientsets, never are.
+func isResync(oldObj, newObj interface{}) bool {
+	oldMeta, err := meta.Accessor(oldObj)
+	if err != nil {
+		return false
+	}
+	newMeta, err := meta.Accessor(newObj)
+	if err != nil {
+		return false
+	}
+	return oldMeta.GetResourceVersion() != "" && oldMeta.GetResourceVersion() == newMeta.GetResourceVersion()
+}
+
+// kubernetesEvent returns the core/v1 form of an event delivered by the informer
+func kubernetesEvent(obj interface{}) (*corev1.Event, bool) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	switch event := obj.(type) {
+	case *corev1.Event:
+		return event, true
+	case *eventsv1.Event:
+		return eventFromEventsV1(event), true
+	default:
+		return nil, false
+	}
+}
+
+// eventFromEventsV1 converts an events.k8s.io/v1 event to its core/v1 form,
+// which the API server serves for the same event. Events recorded through
+// events.k8s.io/v1 count their repeats in a series and leave the deprecated
+// count unset; the count is taken from the series, or one without a series.
+func eventFromEventsV1(e *eventsv1.Event) *corev1.Event {
+	event := &corev1.Event{
+		ObjectMeta:          e.ObjectMeta,
+		InvolvedObject:      e.Regarding,
+		Related:             e.Related,
+		Reason:              e.Reason,
+		Message:             e.Note,
+		Type:                e.Type,
+		Action:              e.Action,
+		EventTime:           e.EventTime,
+		ReportingController: e.ReportingController,
+		ReportingInstance:   e.ReportingInstance,
+		Source:              e.DeprecatedSource,
+		FirstTimestamp:      e.DeprecatedFirstTimestamp,
+		LastTimestamp:       e.DeprecatedLastTimestamp,
+		Count:               e.DeprecatedCount,
+	}
+
+	if e.Series != nil {
+		event.Series = &corev1.EventSeries{
+			Count:            e.Series.Count,
+			LastObservedTime: e.Series.LastObservedTime,
+		}
+		if e.Series.Count > event.Count {
+			event.Count = e.Series.Count
+		}
+	}
+	if event.Count == 0 {
+		event.Count = 1
+	}
+
+	return event
+}
+
+// recordAPIResult updates the component health after a list or watch call
+func (ew *EventWatcher) recordAPIResult(err error) {
+	if err != nil {
+		ew.health.recordError(err)
+		return
+	}
+	ew.health.recordSuccess()
+}
+
+// HasSynced returns true once the event informer has completed its initial list
+func (ew *EventWatcher) HasSynced() bool {
+	ew.mu.RLock()
+	defer ew.mu.RUnlock()
+	return ew.controller != nil && ew.controller.HasSynced()
+}
+
+// Dropped returns the number of events dropped because the event channel was full
+func (ew *EventWatcher) Dropped() int64 {
+	return ew.dropped.Load()
+}
+
+// Health returns the event watcher health including the informer sync state
+func (ew *EventWatcher) Health() types.ComponentHealth {
+	synced := ew.HasSynced()
+
+	health := ew.health.snapshot()
+	health.Synced = &synced
+	health.Healthy = health.Healthy && synced
+	return health
 }
 
 // convertEvent converts a Kubernetes event to our Event type
-func (ew *EventWatcher) convertEvent(k8sEvent *corev1.Event, eventType string) *types.Event {
-	severity := ew.determineSeverity(k8sEvent)
+func (ew *EventWatcher) convertEvent(k8sEvent *corev1.Event, eventType, severity string) *types.Event {
+	reportingComponent := k8sEvent.ReportingController
+	if reportingComponent == "" {
+		reportingComponent = k8sEvent.Source.Component
+	}
+	reportingInstance := k8sEvent.ReportingInstance
+	if reportingInstance == "" {
+		reportingInstance = k8sEvent.Source.Host
+	}
+
+	lastTimestamp := k8sEvent.LastTimestamp.Time
+	if k8sEvent.Series != nil && k8sEvent.Series.LastObservedTime.After(lastTimestamp) {
+		lastTimestamp = k8sEvent.Series.LastObservedTime.Time
+	}
 
-	return &types.Event{
-		ID:         string(uuid.NewUUID()),
+	event := &types.Event{
+		ID:         ew.eventID(k8sEvent),
 		ClusterID:  ew.clusterID,
 		Type:       "k8s_event",
 		Source:     "kubernetes",
@@ -205,97 +516,92 @@ func (ew *EventWatcher) convertEvent(k8sEvent *corev1.Event, eventType string) *
 		Severity:   severity,
 		Reason:     k8sEvent.Reason,
 		Message:    k8sEvent.Message,
-		Timestamp:  k8sEvent.FirstTimestamp.Time,
+		Timestamp:  eventTimestamp(k8sEvent),
 		ReportedAt: time.Now(),
 		Labels: map[string]string{
-			"kind":             k8sEvent.InvolvedObject.Kind,
-			"name":             k8sEvent.InvolvedObject.Name,
-			"uid":              string(k8sEvent.InvolvedObject.UID),
-			"event_type":       eventType,
-			"k8s_event_type":   k8sEvent.Type,
-			"reporting_component": k8sEvent.Source.Component,
-			"reporting_instance":  k8sEvent.Source.Host,
+			"kind":                k8sEvent.InvolvedObject.Kind,
+			"name":                k8sEvent.InvolvedObject.Name,
+			"uid":                 string(k8sEvent.InvolvedObject.UID),
+			"event_type":          eventType,
+			"k8s_event_type":      k8sEvent.Type,
+			"reporting_component": reportingComponent,
+			"reporting_instance":  reportingInstance,
 		},
 		RawData: map[string]interface{}{
-			"count":          k8sEvent.Count,
-			"first_timestamp": k8sEvent.FirstTimestamp,
-			"last_timestamp":  k8sEvent.LastTimestamp,
-			"involved_object": map[string]interface{}{
-				"kind":       k8sEvent.InvolvedObject.Kind,
-				"namespace":  k8sEvent.InvolvedObject.Namespace,
-				"name":       k8sEvent.InvolvedObject.Name,
-				"uid":        k8sEvent.InvolvedObject.UID,
-				"api_version": k8sEvent.InvolvedObject.APIVersion,
-			},
+			"event_uid":        string(k8sEvent.UID),
+			"event_name":       k8sEvent.Name,
+			"resource_version": k8sEvent.ResourceVersion,
+			"count":            k8sEvent.Count,
+			"first_timestamp":  k8sEvent.FirstTimestamp,
+			"last_timestamp":   metav1.NewTime(lastTimestamp),
+			"action":           k8sEvent.Action,
+			"involved_object":  objectReference(k8sEvent.InvolvedObject),
 		},
 	}
-}
 
-// determineSeverity determines the severity level based on the event
-func (ew *EventWatcher) determineSeverity(event *corev1.Event) string {
-	// Critical events that indicate immediate attention needed
-	criticalPatterns := []string{
-		"CrashLoopBackOff",
-		"OOMKilling",
-		"Failed",
-		"NodeNotReady",
-		"FailedScheduling",
-	}
-
-	// High priority events
-	highPatterns := []string{
-		"BackOff",
-		"ImagePullBackOff",
-		"ErrImagePull",
-		"Unhealthy",
-		"Killing",
-		"Preempting",
-	}
-
-	// Medium priority events
-	mediumPatterns := []string{
-		"Pulling",
-		"Starting",
-		"Rebooted",
-		"ProbeWarning",
-	}
-
-	reason := event.Reason
-	eventType := event.Type
-
-	// Check for critical patterns
-	for _, pattern := range criticalPatterns {
-		if strings.Contains(reason, pattern) {
-			return "critical"
+	if k8sEvent.Related != nil {
+		event.RawData["related"] = objectReference(*k8sEvent.Related)
+	}
+	if k8sEvent.Series != nil {
+		event.RawData["series"] = map[string]interface{}{
+			"count":              k8sEvent.Series.Count,
+			"last_observed_time": k8sEvent.Series.LastObservedTime,
 		}
 	}
 
-	// Warning events are generally high priority
-	if eventType == corev1.EventTypeWarning {
-		// Check for high patterns in warning events
-		for _, pattern := range highPatterns {
-			if strings.Contains(reason, pattern) {
-				return "high"
-			}
-		}
-		// Other warnings are medium priority
-		return "medium"
+	return event
+}
+
+// eventID returns the stable ID of a Kubernetes event, its UID, so that every
+// report of the same event object carries the same ID. Events without a UID
+// get an ID derived from the cluster, namespace and name.
+func (ew *EventWatcher) eventID(k8sEvent *corev1.Event) string {
+	if k8sEvent.UID != "" {
+		return string(k8sEvent.UID)
 	}
 
-	// Check for medium patterns in normal events
-	for _, pattern := range mediumPatterns {
-		if strings.Contains(reason, pattern) {
-			return "medium"
-		}
+	sum := sha256.Sum256([]byte(ew.clusterID + "/" + k8sEvent.Namespace + "/" + k8sEvent.Name))
+	return hex.EncodeToString(sum[:16])
+}
+
+// eventTimestamp returns when an event first occurred: the first timestamp of
+// core/v1 events, the event time of events.k8s.io/v1 events
+func eventTimestamp(k8sEvent *corev1.Event) time.Time {
+	switch {
+	case !k8sEvent.FirstTimestamp.IsZero():
+		return k8sEvent.FirstTimestamp.Time
+	case !k8sEvent.EventTime.IsZero():
+		return k8sEvent.EventTime.Time
+	default:
+		return k8sEvent.CreationTimestamp.Time
 	}
+}
 
-	// Default to low priority
-	return "low"
+// objectReference returns the raw data form of an object reference
+func objectReference(ref corev1.ObjectReference) map[string]interface{} {
+	return map[string]interface{}{
+		"kind":        ref.Kind,
+		"namespace":   ref.Namespace,
+		"name":        ref.Name,
+		"uid":         ref.UID,
+		"api_version": ref.APIVersion,
+	}
 }
 
-// isDuplicateEvent checks if this event has already been processed recently
-func (ew *EventWatcher) isDuplicateEvent(event *types.Event) bool {
-	// Simple duplicate check - in production, you might want a more sophisticated approach
-	// using a time-based cache or hash of event content
-	return event.ID == ew.lastEventID
-}
\ No newline at end of file
+// convertReport converts a deduplication report to our Event type, adding the
+// occurrence counts to the raw data
+func (ew *EventWatcher) convertReport(report *dedupReport) *types.Event {
+	agentEvent := ew.convertEvent(report.event, report.eventType, report.severity)
+
+	agentEvent.Labels["dedup"] = "first"
+	if report.summary {
+		agentEvent.Labels["dedup"] = "summary"
+	}
+	agentEvent.RawData["fingerprint"] = report.fingerprint
+	agentEvent.RawData["occurrences"] = report.occurrences
+	agentEvent.RawData["total_occurrences"] = report.total
+	agentEvent.RawData["first_seen"] = report.firstSeen
+	agentEvent.RawData["last_seen"] = report.lastSeen
+
+	return agentEvent
+}
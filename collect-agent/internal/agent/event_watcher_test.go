@@ -0,0 +1,167 @@
+package agent
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	eventsv1 "k8s.io/api/events/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/kart/k8s-agent/collect-agent/internal/types"
+)
+
+func TestEventFromEventsV1(t *testing.T) {
+	observed := metav1.NewMicroTime(time.Now())
+	event := &eventsv1.Event{
+		ObjectMeta:          metav1.ObjectMeta{Name: "web-1.17a", Namespace: "demo", UID: "event-uid"},
+		EventTime:           metav1.NewMicroTime(observed.Add(-time.Minute)),
+		ReportingController: "kubelet",
+		ReportingInstance:   "node-1",
+		Action:              "Restarting",
+		Regarding:           corev1.ObjectReference{Kind: "Pod", Name: "web-1", UID: "pod-uid"},
+		Related:             &corev1.ObjectReference{Kind: "Node", Name: "node-1"},
+		Reason:              "BackOff",
+		Note:                "Back-off restarting failed container",
+		Type:                corev1.EventTypeWarning,
+		Series:              &eventsv1.EventSeries{Count: 4, LastObservedTime: observed},
+	}
+
+	got := eventFromEventsV1(event)
+	if got.Message != event.Note || got.InvolvedObject.UID != "pod-uid" || got.Related.Name != "node-1" {
+		t.Errorf("eventFromEventsV1 = %+v", got)
+	}
+	if got.Count != 4 {
+		t.Errorf("Count = %v, want the series count 4", got.Count)
+	}
+
+	event.Series = nil
+	if got := eventFromEventsV1(event); got.Count != 1 {
+		t.Errorf("Count = %v, want 1 without a series", got.Count)
+	}
+
+	watcher := NewEventWatcher(fake.NewSimpleClientset(), "test-cluster", nil, zap.NewNop())
+	converted := watcher.convertEvent(got, "ADDED", "high")
+	if converted.ID != "event-uid" {
+		t.Errorf("ID = %v, want the event UID", converted.ID)
+	}
+	if !converted.Timestamp.Equal(event.EventTime.Time) {
+		t.Errorf("Timestamp = %v, want the event time %v", converted.Timestamp, event.EventTime.Time)
+	}
+	if converted.Labels["reporting_component"] != "kubelet" || converted.Labels["reporting_instance"] != "node-1" {
+		t.Errorf("Labels = %v, want the reporting controller and instance", converted.Labels)
+	}
+}
+
+func TestEventIDIsStable(t *testing.T) {
+	watcher := NewEventWatcher(fake.NewSimpleClientset(), "test-cluster", nil, zap.NewNop())
+
+	event := newTestEvent("web-1.17a", "BackOff")
+	first := watcher.convertEvent(event, "ADDED", "high")
+	second := watcher.convertEvent(event, "MODIFIED", "high")
+	if first.ID != second.ID {
+		t.Errorf("IDs of the same event differ: %v, %v", first.ID, second.ID)
+	}
+
+	other := watcher.convertEvent(newTestEvent("web-1.17b", "BackOff"), "ADDED", "high")
+	if other.ID == first.ID {
+		t.Errorf("different events share the ID %v", first.ID)
+	}
+}
+
+func TestDevEventsReachEventWatcherThroughBothAPIs(t *testing.T) {
+	for _, api := range []string{types.EventAPIEventsV1, types.EventAPICoreV1} {
+		t.Run(api, func(t *testing.T) {
+			clientset := newDevClientset()
+
+			eventChan := make(chan *types.Event, 10)
+			watcher := NewEventWatcher(clientset, "dev", eventChan, zap.NewNop())
+			watcher.SetAPI(api)
+			if err := watcher.Start(context.Background()); err != nil {
+				t.Fatalf("Start failed: %v", err)
+			}
+			defer watcher.Stop()
+
+			deadline := time.Now().Add(5 * time.Second)
+			for !watcher.HasSynced() {
+				if time.Now().After(deadline) {
+					t.Fatal("event watcher did not sync")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			if err := createDevEvent(context.Background(), clientset, devEvents[0]); err != nil {
+				t.Fatalf("createDevEvent failed: %v", err)
+			}
+
+			select {
+			case event := <-eventChan:
+				if event.Reason != devEvents[0].reason || event.Message != devEvents[0].message {
+					t.Errorf("event = %v %q, want %v %q", event.Reason, event.Message, devEvents[0].reason, devEvents[0].message)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("dev event was not delivered by the event watcher")
+			}
+		})
+	}
+}
+
+func TestEventWatcherResume(t *testing.T) {
+	path := eventStateFile(t.TempDir(), "test-cluster")
+	if filepath.Base(path) != "events-test-cluster.json" {
+		t.Errorf("eventStateFile = %v", path)
+	}
+
+	watcher := NewEventWatcher(fake.NewSimpleClientset(), "test-cluster", nil, zap.NewNop())
+	watcher.SetStateFile(path)
+
+	if rv := watcher.resumeVersion(); rv != "" {
+		t.Errorf("resumeVersion without state = %q, want empty", rv)
+	}
+
+	// The resourceVersion of the last handled event is saved
+	event := newTestEvent("e1", "Scheduled")
+	event.ResourceVersion = "4711"
+	watcher.handleEvent(event, "ADDED")
+
+	saved := ""
+	watcher.persistState(&saved)
+	if saved != "4711" {
+		t.Fatalf("saved resourceVersion = %q, want 4711", saved)
+	}
+	if rv := watcher.resumeVersion(); rv != "4711" {
+		t.Errorf("resumeVersion = %q, want 4711", rv)
+	}
+
+	// The first list is skipped when resuming, later lists are not
+	lw, _ := watcher.listWatch("4711")
+	list, err := lw.List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	listMeta, err := meta.ListAccessor(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if listMeta.GetResourceVersion() != "4711" || meta.LenList(list) != 0 {
+		t.Errorf("resumed list = version %q with %d items, want version 4711 and no items",
+			listMeta.GetResourceVersion(), meta.LenList(list))
+	}
+	if list, err = lw.List(metav1.ListOptions{}); err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if _, ok := list.(*eventsv1.EventList); !ok {
+		t.Errorf("second list = %T, want *eventsv1.EventList from the API", list)
+	}
+
+	// A position saved for the other API is not used
+	watcher.SetAPI(types.EventAPICoreV1)
+	if rv := watcher.resumeVersion(); rv != "" {
+		t.Errorf("resumeVersion for another API = %q, want empty", rv)
+	}
+}
@@ -6,22 +6,24 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
 )
 
 // HealthServer provides HTTP health check endpoints
 type HealthServer struct {
-	agent  *Agent
-	server *http.Server
-	logger *zap.Logger
+	supervisor *Supervisor
+	server     *http.Server
+	logger     *zap.Logger
 }
 
 // NewHealthServer creates a new health server
-func NewHealthServer(agent *Agent, port int, logger *zap.Logger) *HealthServer {
+func NewHealthServer(supervisor *Supervisor, port int, logger *zap.Logger) *HealthServer {
 	mux := http.NewServeMux()
 	hs := &HealthServer{
-		agent:  agent,
-		logger: logger.With(zap.String("component", "health-server")),
+		supervisor: supervisor,
+		logger:     logger.With(zap.String("component", "health-server")),
 		server: &http.Server{
 			Addr:         fmt.Sprintf(":%d", port),
 			Handler:      mux,
@@ -34,7 +36,9 @@ func NewHealthServer(agent *Agent, port int, logger *zap.Logger) *HealthServer {
 	mux.HandleFunc("/health/live", hs.handleLiveness)
 	mux.HandleFunc("/health/ready", hs.handleReadiness)
 	mux.HandleFunc("/health/status", hs.handleStatus)
-	mux.HandleFunc("/metrics", hs.handleMetrics)
+	mux.Handle("/metrics", promhttp.HandlerFor(supervisor.registry, promhttp.HandlerOpts{
+		ErrorLog: zap.NewStdLog(hs.logger),
+	}))
 
 	return hs
 }
@@ -60,7 +64,7 @@ func (hs *HealthServer) Stop() error {
 
 // handleLiveness handles liveness probe requests
 func (hs *HealthServer) handleLiveness(w http.ResponseWriter, r *http.Request) {
-	if hs.agent.IsHealthy() {
+	if hs.supervisor.IsHealthy() {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
 	} else {
@@ -71,7 +75,7 @@ func (hs *HealthServer) handleLiveness(w http.ResponseWriter, r *http.Request) {
 
 // handleReadiness handles readiness probe requests
 func (hs *HealthServer) handleReadiness(w http.ResponseWriter, r *http.Request) {
-	if hs.agent.IsReady() {
+	if hs.supervisor.IsReady() {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("Ready"))
 	} else {
@@ -82,7 +86,7 @@ func (hs *HealthServer) handleReadiness(w http.ResponseWriter, r *http.Request)
 
 // handleStatus handles detailed status requests
 func (hs *HealthServer) handleStatus(w http.ResponseWriter, r *http.Request) {
-	status := hs.agent.GetStatus()
+	status := hs.supervisor.GetStatus()
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(status); err != nil {
@@ -92,50 +96,84 @@ func (hs *HealthServer) handleStatus(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// handleMetrics handles metrics endpoint for Prometheus scraping
-func (hs *HealthServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
-	status := hs.agent.GetStatus()
-
-	// Generate Prometheus metrics format
-	metrics := fmt.Sprintf(`# HELP agent_running Agent running status (1 = running, 0 = not running)
-# TYPE agent_running gauge
-agent_running{cluster_id="%s"} %d
-
-# HELP agent_connected Agent connection status (1 = connected, 0 = not connected)
-# TYPE agent_connected gauge
-agent_connected{cluster_id="%s"} %d
-
-# HELP agent_uptime_seconds Agent uptime in seconds
-# TYPE agent_uptime_seconds gauge
-agent_uptime_seconds{cluster_id="%s"} %f
-
-# HELP agent_event_queue_size Number of events in queue
-# TYPE agent_event_queue_size gauge
-agent_event_queue_size{cluster_id="%s"} %d
-
-# HELP agent_metrics_queue_size Number of metrics in queue
-# TYPE agent_metrics_queue_size gauge
-agent_metrics_queue_size{cluster_id="%s"} %d
-
-# HELP agent_command_queue_size Number of commands in queue
-# TYPE agent_command_queue_size gauge
-agent_command_queue_size{cluster_id="%s"} %d
-
-# HELP agent_result_queue_size Number of results in queue
-# TYPE agent_result_queue_size gauge
-agent_result_queue_size{cluster_id="%s"} %d
-`,
-		status.ClusterID, boolToInt(status.Running),
-		status.ClusterID, boolToInt(status.Connected),
-		status.ClusterID, status.Uptime.Seconds(),
-		status.ClusterID, status.EventQueueSize,
-		status.ClusterID, status.MetricsQueueSize,
-		status.ClusterID, status.CommandQueueSize,
-		status.ClusterID, status.ResultQueueSize,
-	)
-
-	w.Header().Set("Content-Type", "text/plain")
-	w.Write([]byte(metrics))
+// statusCollector exports the agent status reported by GetStatus as gauges and counters
+type statusCollector struct {
+	agent *Agent
+}
+
+var (
+	runningDesc = prometheus.NewDesc("agent_running",
+		"Agent running status (1 = running, 0 = not running)", nil, nil)
+	connectedDesc = prometheus.NewDesc("agent_connected",
+		"Agent connection status (1 = connected, 0 = not connected)", nil, nil)
+	uptimeDesc = prometheus.NewDesc("agent_uptime_seconds",
+		"Agent uptime in seconds", nil, nil)
+	eventQueueDesc = prometheus.NewDesc("agent_event_queue_size",
+		"Number of events in queue", nil, nil)
+	metricsQueueDesc = prometheus.NewDesc("agent_metrics_queue_size",
+		"Number of metrics in queue", nil, nil)
+	commandQueueDesc = prometheus.NewDesc("agent_command_queue_size",
+		"Number of commands waiting for a worker", nil, nil)
+	commandsRunningDesc = prometheus.NewDesc("agent_commands_running",
+		"Number of commands running", nil, nil)
+	resultQueueDesc = prometheus.NewDesc("agent_result_queue_size",
+		"Number of results in queue", nil, nil)
+	componentHealthyDesc = prometheus.NewDesc("agent_component_healthy",
+		"Component health (1 = healthy, 0 = failing)", []string{"component"}, nil)
+	messagesDroppedDesc = prometheus.NewDesc("agent_messages_dropped_total",
+		"Messages dropped because a queue was full", []string{"type"}, nil)
+	reconnectsDesc = prometheus.NewDesc("agent_nats_reconnects_total",
+		"NATS reconnections since start", nil, nil)
+	spoolRecordsDesc = prometheus.NewDesc("agent_spool_records",
+		"Number of messages buffered in the on-disk spool", []string{"priority"}, nil)
+	spoolBytesDesc = prometheus.NewDesc("agent_spool_bytes",
+		"Size of the messages buffered in the on-disk spool", nil, nil)
+	spoolDroppedDesc = prometheus.NewDesc("agent_spool_dropped_total",
+		"Spooled messages discarded by the size or age limit", nil, nil)
+)
+
+// Describe implements prometheus.Collector
+func (c *statusCollector) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(c, ch)
+}
+
+// Collect implements prometheus.Collector
+func (c *statusCollector) Collect(ch chan<- prometheus.Metric) {
+	status := c.agent.GetStatus()
+
+	gauge := func(desc *prometheus.Desc, value float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, labels...)
+	}
+	counter := func(desc *prometheus.Desc, value float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, value, labels...)
+	}
+
+	gauge(runningDesc, float64(boolToInt(status.Running)))
+	gauge(connectedDesc, float64(boolToInt(status.Connected)))
+	gauge(uptimeDesc, status.Uptime.Seconds())
+	gauge(eventQueueDesc, float64(status.EventQueueSize))
+	gauge(metricsQueueDesc, float64(status.MetricsQueueSize))
+	gauge(commandQueueDesc, float64(status.CommandQueueSize))
+	gauge(commandsRunningDesc, float64(status.CommandsRunning))
+	gauge(resultQueueDesc, float64(status.ResultQueueSize))
+
+	for name, health := range status.Components {
+		gauge(componentHealthyDesc, float64(boolToInt(health.Healthy)), name)
+	}
+
+	counter(messagesDroppedDesc, float64(status.EventsDropped), "event")
+	counter(messagesDroppedDesc, float64(status.MetricsDropped), "metrics")
+	counter(messagesDroppedDesc, float64(status.CommandsDropped), "command")
+	counter(messagesDroppedDesc, float64(status.ResultsDropped), "result")
+	counter(reconnectsDesc, float64(status.Reconnects))
+
+	if status.Spool != nil {
+		for priority, records := range status.Spool.ByPriority {
+			gauge(spoolRecordsDesc, float64(records), priority)
+		}
+		gauge(spoolBytesDesc, float64(status.Spool.Bytes))
+		counter(spoolDroppedDesc, float64(status.Spool.Dropped))
+	}
 }
 
 // boolToInt converts boolean to int for metrics
@@ -144,4 +182,4 @@ func boolToInt(b bool) int {
 		return 1
 	}
 	return 0
-}
\ No newline at end of file
+}
@@ -0,0 +1,69 @@
+package agent
+
+import (
+	"context"
+	"sync"
+
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// sharedInformers is the informer factory shared by the components of an
+// agent, so that each resource is listed and watched once however many
+// components read it. Components register their handlers before the agent
+// starts the factory.
+type sharedInformers struct {
+	factory informers.SharedInformerFactory
+
+	mu            sync.Mutex
+	errorHandlers map[cache.SharedIndexInformer][]func(error)
+}
+
+// newSharedInformers creates the shared informers of a cluster. Components
+// find changes by comparing updates, so the informers do not resync.
+func newSharedInformers(clientset kubernetes.Interface) *sharedInformers {
+	return &sharedInformers{
+		factory:       informers.NewSharedInformerFactory(clientset, 0),
+		errorHandlers: make(map[cache.SharedIndexInformer][]func(error)),
+	}
+}
+
+// watch registers handler on informer and onError for its list and watch
+// errors. An informer has a single error handler, which calls those of all
+// the components watching it.
+func (s *sharedInformers) watch(informer cache.SharedIndexInformer, handler cache.ResourceEventHandler, onError func(error)) error {
+	s.mu.Lock()
+	handlers, registered := s.errorHandlers[informer]
+	s.errorHandlers[informer] = append(handlers, onError)
+	s.mu.Unlock()
+
+	if !registered {
+		err := informer.SetWatchErrorHandlerWithContext(func(ctx context.Context, r *cache.Reflector, err error) {
+			s.mu.Lock()
+			handlers := s.errorHandlers[informer]
+			s.mu.Unlock()
+
+			for _, handle := range handlers {
+				handle(err)
+			}
+			cache.DefaultWatchErrorHandler(ctx, r, err)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := informer.AddEventHandler(handler)
+	return err
+}
+
+// Start starts the informers registered so far until stopCh is closed
+func (s *sharedInformers) Start(stopCh <-chan struct{}) {
+	s.factory.Start(stopCh)
+}
+
+// Shutdown waits for the informers to stop once stopCh is closed
+func (s *sharedInformers) Shutdown() {
+	s.factory.Shutdown()
+}
@@ -0,0 +1,196 @@
+package agent
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// Reasons an event is filtered or dropped before it is published
+const (
+	eventFilterIrrelevant = "irrelevant"
+	eventFilterDuplicate  = "duplicate"
+	eventDropQueueFull    = "queue_full"
+)
+
+// informerEvents labels the resyncs of the core/v1 event informer
+const informerEvents = "events"
+
+// commandToolOther labels commands for tools outside the allow list, keeping label values bounded
+const commandToolOther = "other"
+
+// agentMetrics holds the Prometheus collectors updated by the agent components.
+// All recording methods are safe to call on a nil receiver, so components work
+// without instrumentation in tests.
+type agentMetrics struct {
+	eventsSeen         *prometheus.CounterVec
+	eventsFiltered     *prometheus.CounterVec
+	eventsDropped      *prometheus.CounterVec
+	informerResyncs    *prometheus.CounterVec
+	publishDuration    *prometheus.HistogramVec
+	publishFailures    *prometheus.CounterVec
+	commandsExecuted   *prometheus.CounterVec
+	commandDuration    *prometheus.HistogramVec
+	collectionDuration prometheus.Histogram
+	collectionErrors   prometheus.Counter
+}
+
+// newAgentMetrics creates the agent collectors
+func newAgentMetrics() *agentMetrics {
+	return &agentMetrics{
+		eventsSeen: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "agent_events_seen_total",
+			Help: "Kubernetes events received from the informer, by event reason",
+		}, []string{"reason"}),
+		eventsFiltered: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "agent_events_filtered_total",
+			Help: "Kubernetes events discarded by a filter, by filter reason",
+		}, []string{"reason"}),
+		eventsDropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "agent_events_dropped_total",
+			Help: "Events lost before publishing, by drop reason",
+		}, []string{"reason"}),
+		informerResyncs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "agent_informer_resyncs_total",
+			Help: "Objects redelivered by a periodic informer resync",
+		}, []string{"informer"}),
+		publishDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "agent_publish_duration_seconds",
+			Help:    "Time taken to publish a message to NATS, by subject",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 13),
+		}, []string{"subject"}),
+		publishFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "agent_publish_failures_total",
+			Help: "Failed NATS publishes, by subject",
+		}, []string{"subject"}),
+		commandsExecuted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "agent_command_executions_total",
+			Help: "Commands executed, by tool and result status",
+		}, []string{"tool", "status"}),
+		commandDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "agent_command_duration_seconds",
+			Help:    "Command execution time, by tool and result status",
+			Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+		}, []string{"tool", "status"}),
+		collectionDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "agent_metrics_collection_duration_seconds",
+			Help:    "Time taken by a cluster metrics collection cycle",
+			Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+		}),
+		collectionErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "agent_metrics_collection_errors_total",
+			Help: "Metrics collection cycles with at least one failed API call",
+		}),
+	}
+}
+
+// register registers the collectors with reg
+func (m *agentMetrics) register(reg prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{
+		m.eventsSeen,
+		m.eventsFiltered,
+		m.eventsDropped,
+		m.informerResyncs,
+		m.publishDuration,
+		m.publishFailures,
+		m.commandsExecuted,
+		m.commandDuration,
+		m.collectionDuration,
+		m.collectionErrors,
+	} {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// eventSeen counts an event received from the informer
+func (m *agentMetrics) eventSeen(reason string) {
+	if m == nil {
+		return
+	}
+	m.eventsSeen.WithLabelValues(reason).Inc()
+}
+
+// eventFiltered counts an event discarded by a filter
+func (m *agentMetrics) eventFiltered(reason string) {
+	if m == nil {
+		return
+	}
+	m.eventsFiltered.WithLabelValues(reason).Inc()
+}
+
+// eventDropped counts an event lost before publishing
+func (m *agentMetrics) eventDropped(reason string) {
+	if m == nil {
+		return
+	}
+	m.eventsDropped.WithLabelValues(reason).Inc()
+}
+
+// informerResync counts an object redelivered by an informer resync
+func (m *agentMetrics) informerResync(informer string) {
+	if m == nil {
+		return
+	}
+	m.informerResyncs.WithLabelValues(informer).Inc()
+}
+
+// observePublish records the latency and outcome of a NATS publish
+func (m *agentMetrics) observePublish(subject string, duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.publishDuration.WithLabelValues(subject).Observe(duration.Seconds())
+	if err != nil {
+		m.publishFailures.WithLabelValues(subject).Inc()
+	}
+}
+
+// observeCommand records a command execution
+func (m *agentMetrics) observeCommand(tool, status string, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.commandsExecuted.WithLabelValues(tool, status).Inc()
+	m.commandDuration.WithLabelValues(tool, status).Observe(duration.Seconds())
+}
+
+// observeCollection records a metrics collection cycle
+func (m *agentMetrics) observeCollection(duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.collectionDuration.Observe(duration.Seconds())
+	if err != nil {
+		m.collectionErrors.Inc()
+	}
+}
+
+// newMetricsRegistry creates the registry served on /metrics: the component
+// collectors and status gauges of every agent labelled with its cluster ID,
+// plus Go runtime and process metrics
+func newMetricsRegistry(agents ...*Agent) (*prometheus.Registry, error) {
+	reg := prometheus.NewRegistry()
+
+	for _, a := range agents {
+		clusterReg := prometheus.WrapRegistererWith(prometheus.Labels{"cluster_id": a.clusterID}, reg)
+		if err := a.metrics.register(clusterReg); err != nil {
+			return nil, err
+		}
+		if err := clusterReg.Register(&statusCollector{agent: a}); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := reg.Register(collectors.NewGoCollector()); err != nil {
+		return nil, err
+	}
+	if err := reg.Register(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{})); err != nil {
+		return nil, err
+	}
+
+	return reg, nil
+}
@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/kart/k8s-agent/collect-agent/internal/types"
+)
+
+func TestNilAgentMetrics(t *testing.T) {
+	var m *agentMetrics
+
+	// Components without instrumentation must not panic
+	m.eventSeen("BackOff")
+	m.eventFiltered(eventFilterDuplicate)
+	m.eventDropped(eventDropQueueFull)
+	m.informerResync(informerEvents)
+	m.observePublish("subject", time.Millisecond, nil)
+	m.observeCommand("kubectl", "success", time.Second)
+	m.observeCollection(time.Second, nil)
+}
+
+func TestMetricsRegistry(t *testing.T) {
+	a := &Agent{
+		clusterID:   "test-cluster",
+		startTime:   time.Now(),
+		eventChan:   make(chan *types.Event, 1),
+		metricsChan: make(chan *types.Metrics, 1),
+		resultChan:  make(chan *types.CommandResult, 1),
+		metrics:     newAgentMetrics(),
+	}
+
+	registry, err := newMetricsRegistry(a)
+	if err != nil {
+		t.Fatalf("newMetricsRegistry failed: %v", err)
+	}
+
+	a.metrics.eventSeen("BackOff")
+	a.metrics.eventFiltered(eventFilterIrrelevant)
+	a.metrics.observePublish("agent.event.test-cluster", 5*time.Millisecond, nil)
+	a.metrics.observeCommand("kubectl", "success", 2*time.Second)
+	a.metrics.observeCollection(time.Second, nil)
+
+	expected := `
+# HELP agent_events_seen_total Kubernetes events received from the informer, by event reason
+# TYPE agent_events_seen_total counter
+agent_events_seen_total{cluster_id="test-cluster",reason="BackOff"} 1
+# HELP agent_event_queue_size Number of events in queue
+# TYPE agent_event_queue_size gauge
+agent_event_queue_size{cluster_id="test-cluster"} 0
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		"agent_events_seen_total", "agent_event_queue_size"); err != nil {
+		t.Error(err)
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Gather failed: %v", err)
+	}
+	names := make(map[string]bool)
+	for _, family := range families {
+		names[family.GetName()] = true
+	}
+	for _, name := range []string{
+		"agent_events_filtered_total",
+		"agent_publish_duration_seconds",
+		"agent_command_executions_total",
+		"agent_command_duration_seconds",
+		"agent_metrics_collection_duration_seconds",
+		"agent_running",
+		"agent_nats_reconnects_total",
+		"go_goroutines",
+	} {
+		if !names[name] {
+			t.Errorf("metric %s not registered", name)
+		}
+	}
+}
+
+func TestCommandMetricsToolLabel(t *testing.T) {
+	executor := NewCommandExecutor(fake.NewSimpleClientset(), "test-cluster", zap.NewNop())
+	executor.metrics = newAgentMetrics()
+
+	executor.Execute(t.Context(), types.Command{ID: "cmd-1", Type: "diagnostic", Tool: "rm", Action: "-rf"})
+
+	if got := testutil.ToFloat64(executor.metrics.commandsExecuted.WithLabelValues(commandToolOther, "failed")); got != 1 {
+		t.Errorf("executions{tool=%q} = %v, want 1", commandToolOther, got)
+	}
+	if got := testutil.CollectAndCount(executor.metrics.commandsExecuted); got != 1 {
+		t.Errorf("execution series = %v, want 1", got)
+	}
+}
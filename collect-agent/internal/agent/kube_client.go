@@ -0,0 +1,104 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	metricsclient "k8s.io/metrics/pkg/client/clientset/versioned"
+
+	"github.com/kart/k8s-agent/collect-agent/internal/types"
+)
+
+// Sources of the Kubernetes client, reported in logs and the status endpoint
+const (
+	kubeSourceInCluster  = "in-cluster"
+	kubeSourceKubeconfig = "kubeconfig"
+	kubeSourceDev        = "dev"
+)
+
+// kubeClients are the clients of a cluster, created from the same configuration
+type kubeClients struct {
+	clientset kubernetes.Interface
+	dynamic   dynamic.Interface       // objects of any resource, for commands
+	metrics   metricsclient.Interface // metrics.k8s.io, served by metrics-server if installed
+	kubelet   kubeletClient           // kubelet endpoints, through the API server proxy
+	source    string
+}
+
+// newKubeClient creates the clients the agent works with and reports where their
+// configuration came from. Dev mode returns fake clients seeded with a small
+// cluster. An explicit kubeconfig or context is loaded with the usual kubeconfig
+// rules; otherwise the in-cluster service account is used, falling back to the
+// default kubeconfig ($KUBECONFIG or ~/.kube/config) when not running in a pod.
+func newKubeClient(config *types.AgentConfig) (*kubeClients, error) {
+	if config.DevMode {
+		clientset := newDevClientset()
+		return &kubeClients{
+			clientset: clientset,
+			dynamic:   newDevDynamicClient(clientset),
+			metrics:   newDevMetricsClient(),
+			kubelet:   newDevKubeletClient(clientset),
+			source:    kubeSourceDev,
+		}, nil
+	}
+
+	kubeConfig, source, err := loadRESTConfig(config.Kubernetes)
+	if err != nil {
+		return nil, err
+	}
+
+	clientset, err := kubernetes.NewForConfig(kubeConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kubernetes clientset: %w", err)
+	}
+
+	dynamicClient, err := dynamic.NewForConfig(kubeConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create dynamic client: %w", err)
+	}
+
+	metrics, err := metricsclient.NewForConfig(kubeConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metrics clientset: %w", err)
+	}
+
+	return &kubeClients{
+		clientset: clientset,
+		dynamic:   dynamicClient,
+		metrics:   metrics,
+		kubelet:   proxyKubeletClient{client: clientset.CoreV1().RESTClient()},
+		source:    source,
+	}, nil
+}
+
+// loadRESTConfig resolves the REST config for the configured cluster
+func loadRESTConfig(config types.KubernetesConfig) (*rest.Config, string, error) {
+	if config.Kubeconfig == "" && config.Context == "" {
+		kubeConfig, err := rest.InClusterConfig()
+		if err == nil {
+			return kubeConfig, kubeSourceInCluster, nil
+		}
+		if !errors.Is(err, rest.ErrNotInCluster) {
+			return nil, "", fmt.Errorf("failed to create in-cluster config: %w", err)
+		}
+	}
+
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = config.Kubeconfig
+
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: config.Context}
+
+	kubeConfig, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+	if err != nil {
+		if config.Kubeconfig == "" && config.Context == "" {
+			return nil, "", fmt.Errorf("not running in a cluster and no usable kubeconfig found: %w", err)
+		}
+		return nil, "", fmt.Errorf("failed to load kubeconfig: %w", err)
+	}
+
+	return kubeConfig, kubeSourceKubeconfig, nil
+}
@@ -0,0 +1,164 @@
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/kart/k8s-agent/collect-agent/internal/types"
+	"github.com/kart/k8s-agent/collect-agent/internal/utils"
+)
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+current-context: prod
+clusters:
+- name: prod
+  cluster:
+    server: https://prod.example.com:6443
+- name: staging
+  cluster:
+    server: https://staging.example.com:6443
+users:
+- name: dev
+  user:
+    token: secret
+contexts:
+- name: prod
+  context:
+    cluster: prod
+    user: dev
+- name: staging
+  context:
+    cluster: staging
+    user: dev
+`
+
+func TestLoadRESTConfigKubeconfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(path, []byte(testKubeconfig), 0o600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		context    string
+		wantServer string
+		wantErr    bool
+	}{
+		{"CurrentContext", "", "https://prod.example.com:6443", false},
+		{"SelectedContext", "staging", "https://staging.example.com:6443", false},
+		{"UnknownContext", "missing", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, source, err := loadRESTConfig(types.KubernetesConfig{Kubeconfig: path, Context: tt.context})
+			if tt.wantErr {
+				if err == nil {
+					t.Error("loadRESTConfig should fail for an unknown context")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadRESTConfig failed: %v", err)
+			}
+
+			if config.Host != tt.wantServer {
+				t.Errorf("Host = %v, want %v", config.Host, tt.wantServer)
+			}
+			if source != kubeSourceKubeconfig {
+				t.Errorf("source = %v, want %v", source, kubeSourceKubeconfig)
+			}
+		})
+	}
+}
+
+func TestLoadRESTConfigMissingKubeconfig(t *testing.T) {
+	_, _, err := loadRESTConfig(types.KubernetesConfig{Kubeconfig: filepath.Join(t.TempDir(), "missing")})
+	if err == nil {
+		t.Error("loadRESTConfig should fail for a missing kubeconfig")
+	}
+}
+
+func TestDevModeClient(t *testing.T) {
+	config := types.DefaultConfig()
+	config.DevMode = true
+
+	clients, err := newKubeClient(config)
+	if err != nil {
+		t.Fatalf("newKubeClient failed: %v", err)
+	}
+	if clients.source != kubeSourceDev {
+		t.Errorf("source = %v, want %v", clients.source, kubeSourceDev)
+	}
+	clientset := clients.clientset
+
+	clusterID, err := utils.NewClusterIDDetector(clientset, zap.NewNop()).DetectClusterID(context.Background())
+	if err != nil {
+		t.Fatalf("DetectClusterID failed: %v", err)
+	}
+	if clusterID != "k8s-de7c1a57" {
+		t.Errorf("clusterID = %v, want %v", clusterID, "k8s-de7c1a57")
+	}
+
+	collector, metricsChan := newTestMetricsCollector(t, clientset)
+	collector.SetMetricsClient(clients.metrics)
+	collector.collectAndSendMetrics()
+
+	select {
+	case metrics := <-metricsChan:
+		nodes, _ := metrics.Data["node_details"].(map[string]interface{})
+		if len(nodes) != 3 {
+			t.Errorf("node_details = %v entries, want 3", len(nodes))
+		}
+		usage, _ := metrics.Data["usage"].(map[string]interface{})
+		if usageNodes, _ := usage["nodes"].(map[string]interface{}); len(usageNodes) != 2 {
+			t.Errorf("usage nodes = %v entries, want the 2 ready nodes", len(usageNodes))
+		}
+		if !collector.Capabilities()[capabilityMetricsServer] {
+			t.Error("metrics server capability not reported in dev mode")
+		}
+	default:
+		t.Fatal("no metrics collected from the dev cluster")
+	}
+}
+
+func TestDevEventsReachEventWatcher(t *testing.T) {
+	clientset := newDevClientset()
+
+	eventChan := make(chan *types.Event, 10)
+	watcher := NewEventWatcher(clientset, "dev", eventChan, zap.NewNop())
+	if err := watcher.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer watcher.Stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !watcher.HasSynced() {
+		if time.Now().After(deadline) {
+			t.Fatal("event watcher did not sync")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := createDevEvent(context.Background(), clientset, devEvents[0]); err != nil {
+		t.Fatalf("createDevEvent failed: %v", err)
+	}
+
+	select {
+	case event := <-eventChan:
+		if event.Reason != devEvents[0].reason {
+			t.Errorf("Reason = %v, want %v", event.Reason, devEvents[0].reason)
+		}
+		if event.Namespace != devNamespace {
+			t.Errorf("Namespace = %v, want %v", event.Namespace, devNamespace)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("dev event was not delivered by the event watcher")
+	}
+}
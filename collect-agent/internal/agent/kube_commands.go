@@ -0,0 +1,680 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/duration"
+	"k8s.io/client-go/dynamic"
+
+	"github.com/kart-io/k8s-agent/protocol"
+
+	"github.com/kart/k8s-agent/collect-agent/internal/types"
+)
+
+// kubeTool is the tool of the commands run through the Kubernetes API. It
+// keeps the name of the kubectl binary it replaced so that callers work
+// unchanged, but takes named params instead of command line arguments.
+const kubeTool = "kubectl"
+
+// maxKubeListItems is the largest number of objects a command lists
+const maxKubeListItems = 500
+
+// noResourcesFound is the output of a listing without objects
+const noResourcesFound = "No resources found\n"
+
+// kubeQuery holds the validated params of a kubectl command
+type kubeQuery struct {
+	resource      string
+	name          string
+	namespace     string
+	allNamespaces bool
+	selector      string
+	container     string
+	tailLines     *int64
+	sinceSeconds  *int64
+	previous      bool
+}
+
+// parseKubeQuery validates the params of a kubectl action against its
+// schema, which checks every value against the syntax of its field, then
+// parses the label selector, whose grammar the schema only approximates.
+func parseKubeQuery(action string, params map[string]string) (kubeQuery, error) {
+	if err := protocol.ValidateCommand(kubeTool, action, nil, params, nil); err != nil {
+		return kubeQuery{}, err
+	}
+
+	q := kubeQuery{
+		resource:  params[protocol.CommandParamResource],
+		name:      params[protocol.CommandParamName],
+		namespace: params[protocol.CommandParamNamespace],
+		selector:  params[protocol.CommandParamLabelSelector],
+		container: params[protocol.CommandParamContainer],
+	}
+	if q.selector != "" {
+		if _, err := labels.Parse(q.selector); err != nil {
+			return q, fmt.Errorf("invalid label_selector: %w", err)
+		}
+	}
+
+	// The schema validated the values, so they parse
+	q.allNamespaces, _ = strconv.ParseBool(params[protocol.CommandParamAllNamespaces])
+	q.previous, _ = strconv.ParseBool(params[protocol.CommandParamPrevious])
+	if value := params[protocol.CommandParamTailLines]; value != "" {
+		lines, _ := strconv.ParseInt(value, 10, 64)
+		q.tailLines = &lines
+	}
+	if value := params[protocol.CommandParamSince]; value != "" {
+		since, _ := time.ParseDuration(value)
+		seconds := int64(since / time.Second)
+		q.sinceSeconds = &seconds
+	}
+	return q, nil
+}
+
+// namespaceOrDefault returns the namespace to read, or "" for all namespaces
+func (q kubeQuery) namespaceOrDefault() string {
+	if q.allNamespaces {
+		return metav1.NamespaceAll
+	}
+	if q.namespace == "" {
+		return metav1.NamespaceDefault
+	}
+	return q.namespace
+}
+
+// executeKubeCommand runs a kubectl command through the Kubernetes API,
+// setting the structured output as the result data and its text rendering as
+// the output. Errors of the API, such as a missing object, fail the command
+// with the API status as the result data, without making the executor
+// unhealthy.
+func (ce *CommandExecutor) executeKubeCommand(ctx context.Context, cmd types.Command, result *types.CommandResult) {
+	ce.health.recordSuccess()
+
+	data, text, err := ce.runKubeCommand(ctx, cmd)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			result.Status = protocol.CommandStatusTimeout
+			result.Error = "Command execution timed out"
+		} else {
+			result.Status = protocol.CommandStatusFailed
+			result.Error = err.Error()
+			result.ExitCode = kubectlExitCode(1)
+			result.Data = kubeAPIStatus(err)
+		}
+		return
+	}
+
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		ce.health.recordError(fmt.Errorf("failed to encode kubectl %s output: %w", cmd.Action, err))
+		result.Status = protocol.CommandStatusFailed
+		result.Error = fmt.Sprintf("failed to encode output: %v", err)
+		return
+	}
+	// Like kubectl, report an empty listing on stderr and succeed
+	stream := protocol.OutputStreamStdout
+	if text == noResourcesFound {
+		stream = protocol.OutputStreamStderr
+	}
+	streamText(cmd.ID, stream, text, ce.outputPublisherFor(cmd), result)
+	result.ExitCode = kubectlExitCode(0)
+	if len(encoded) > maxCommandOutput {
+		result.Output += "\n... (structured output omitted, too large)"
+		return
+	}
+	result.Data = encoded
+}
+
+// kubeAPIStatus returns the encoded protocol.KubeAPIStatus of an error of the
+// Kubernetes API, or nil for other errors
+func kubeAPIStatus(err error) json.RawMessage {
+	var apiStatus apierrors.APIStatus
+	if !errors.As(err, &apiStatus) {
+		return nil
+	}
+	status := apiStatus.Status()
+	encoded, err := json.Marshal(protocol.KubeAPIStatus{
+		Reason:  string(status.Reason),
+		Code:    status.Code,
+		Message: status.Message,
+	})
+	if err != nil {
+		return nil
+	}
+	return encoded
+}
+
+// kubectlExitCode returns code as the exit status of a kubectl command, which
+// kubectl sets to 1 on any error
+func kubectlExitCode(code int) *int {
+	return &code
+}
+
+// runKubeCommand returns the structured output of a kubectl command and its
+// text rendering
+func (ce *CommandExecutor) runKubeCommand(ctx context.Context, cmd types.Command) (interface{}, string, error) {
+	q, err := parseKubeQuery(cmd.Action, cmd.Params)
+	if err != nil {
+		return nil, "", err
+	}
+
+	switch cmd.Action {
+	case "get":
+		return ce.kubeGet(ctx, q)
+	case "describe":
+		return ce.kubeDescribe(ctx, q)
+	case "logs":
+		return ce.kubeLogs(ctx, q)
+	case "top":
+		return ce.kubeTop(ctx, q)
+	case "events":
+		return ce.kubeEvents(ctx, q)
+	default:
+		return nil, "", fmt.Errorf("kubectl action '%s' is not supported", cmd.Action)
+	}
+}
+
+// kubeResource is a resource type resolved through API discovery
+type kubeResource struct {
+	gvr        schema.GroupVersionResource
+	kind       string
+	namespaced bool
+}
+
+// resolveResource maps a resource type, short name or kind to the resource
+// served by the cluster. Discovery is cached, and refreshed once when a
+// resource is not found, as for a CRD installed since.
+func (ce *CommandExecutor) resolveResource(resource string) (kubeResource, error) {
+	mapping, err := ce.restMapping(resource)
+	if meta.IsNoMatchError(err) {
+		ce.discovery.Reset()
+		mapping, err = ce.restMapping(resource)
+	}
+	if err != nil {
+		return kubeResource{}, fmt.Errorf("unknown resource '%s': %w", resource, err)
+	}
+
+	if mapping.Resource.Group == "" && mapping.Resource.Resource == "secrets" {
+		return kubeResource{}, fmt.Errorf("secrets cannot be read through commands")
+	}
+
+	return kubeResource{
+		gvr:        mapping.Resource,
+		kind:       mapping.GroupVersionKind.Kind,
+		namespaced: mapping.Scope.Name() == meta.RESTScopeNameNamespace,
+	}, nil
+}
+
+// restMapping returns the preferred mapping of a resource
+func (ce *CommandExecutor) restMapping(resource string) (*meta.RESTMapping, error) {
+	gvk, err := ce.mapper.KindFor(schema.ParseGroupResource(resource).WithVersion(""))
+	if err != nil {
+		return nil, err
+	}
+	return ce.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+}
+
+// resourceClient returns the dynamic client of a resource in the namespace
+// of the query
+func (ce *CommandExecutor) resourceClient(r kubeResource, q kubeQuery) (dynamic.ResourceInterface, error) {
+	if ce.dynamic == nil {
+		return nil, fmt.Errorf("no dynamic client configured")
+	}
+	if !r.namespaced {
+		return ce.dynamic.Resource(r.gvr), nil
+	}
+	return ce.dynamic.Resource(r.gvr).Namespace(q.namespaceOrDefault()), nil
+}
+
+// kubeGet returns an object, or the objects of a resource matching the
+// label selector, at most maxKubeListItems of them
+func (ce *CommandExecutor) kubeGet(ctx context.Context, q kubeQuery) (interface{}, string, error) {
+	r, err := ce.resolveResource(q.resource)
+	if err != nil {
+		return nil, "", err
+	}
+	client, err := ce.resourceClient(r, q)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if q.name != "" {
+		obj, err := client.Get(ctx, q.name, metav1.GetOptions{})
+		if err != nil {
+			return nil, "", err
+		}
+		stripManagedFields(obj)
+		return obj.Object, renderObjects(r, []unstructured.Unstructured{*obj}), nil
+	}
+
+	list, err := client.List(ctx, metav1.ListOptions{LabelSelector: q.selector, Limit: maxKubeListItems})
+	if err != nil {
+		return nil, "", err
+	}
+
+	items := make([]interface{}, 0, len(list.Items))
+	for i := range list.Items {
+		stripManagedFields(&list.Items[i])
+		items = append(items, list.Items[i].Object)
+	}
+	data := map[string]interface{}{
+		"kind":  r.kind + "List",
+		"items": items,
+		"more":  list.GetContinue() != "",
+	}
+
+	text := renderObjects(r, list.Items)
+	if list.GetContinue() != "" {
+		text += fmt.Sprintf("... (only the first %d shown)\n", maxKubeListItems)
+	}
+	return data, text, nil
+}
+
+// kubeDescribe returns an object with the events about it
+func (ce *CommandExecutor) kubeDescribe(ctx context.Context, q kubeQuery) (interface{}, string, error) {
+	r, err := ce.resolveResource(q.resource)
+	if err != nil {
+		return nil, "", err
+	}
+	client, err := ce.resourceClient(r, q)
+	if err != nil {
+		return nil, "", err
+	}
+
+	obj, err := client.Get(ctx, q.name, metav1.GetOptions{})
+	if err != nil {
+		return nil, "", err
+	}
+	stripManagedFields(obj)
+
+	events, err := ce.listEvents(ctx, obj.GetNamespace(), r.kind, obj.GetName(), string(obj.GetUID()))
+	if err != nil {
+		return nil, "", err
+	}
+
+	data := map[string]interface{}{
+		"object": obj.Object,
+		"events": events,
+	}
+	return data, renderDescription(r, obj, events), nil
+}
+
+// kubeLogs returns the log lines of a pod container, at most
+// maxCommandOutput bytes of them
+func (ce *CommandExecutor) kubeLogs(ctx context.Context, q kubeQuery) (interface{}, string, error) {
+	limit := int64(maxCommandOutput)
+	namespace := q.namespaceOrDefault()
+	raw, err := ce.clientset.CoreV1().Pods(namespace).GetLogs(q.name, &corev1.PodLogOptions{
+		Container:    q.container,
+		TailLines:    q.tailLines,
+		SinceSeconds: q.sinceSeconds,
+		Previous:     q.previous,
+		LimitBytes:   &limit,
+	}).DoRaw(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	text := string(raw)
+	lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	if text == "" {
+		lines = []string{}
+	}
+	data := map[string]interface{}{
+		"namespace": namespace,
+		"pod":       q.name,
+		"container": q.container,
+		"lines":     lines,
+		"truncated": int64(len(raw)) >= limit,
+	}
+	return data, text, nil
+}
+
+// topEntry is the resource usage of a node or pod
+type topEntry struct {
+	Namespace     string `json:"namespace,omitempty"`
+	Name          string `json:"name"`
+	CPUMillicores int64  `json:"cpu_millicores"`
+	MemoryBytes   int64  `json:"memory_bytes"`
+}
+
+// kubeTop returns the resource usage of nodes or pods from metrics-server
+func (ce *CommandExecutor) kubeTop(ctx context.Context, q kubeQuery) (interface{}, string, error) {
+	if ce.metricsClient == nil {
+		return nil, "", fmt.Errorf("no metrics.k8s.io client configured")
+	}
+
+	opts := metav1.ListOptions{LabelSelector: q.selector}
+	var entries []topEntry
+	if q.resource == "nodes" {
+		list, err := ce.metricsClient.MetricsV1beta1().NodeMetricses().List(ctx, opts)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to list node metrics: %w", err)
+		}
+		for _, item := range list.Items {
+			entries = append(entries, topEntry{
+				Name:          item.Name,
+				CPUMillicores: item.Usage.Cpu().MilliValue(),
+				MemoryBytes:   item.Usage.Memory().Value(),
+			})
+		}
+	} else {
+		list, err := ce.metricsClient.MetricsV1beta1().PodMetricses(q.namespaceOrDefault()).List(ctx, opts)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to list pod metrics: %w", err)
+		}
+		for _, item := range list.Items {
+			entry := topEntry{Namespace: item.Namespace, Name: item.Name}
+			for _, container := range item.Containers {
+				entry.CPUMillicores += container.Usage.Cpu().MilliValue()
+				entry.MemoryBytes += container.Usage.Memory().Value()
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Namespace != entries[j].Namespace {
+			return entries[i].Namespace < entries[j].Namespace
+		}
+		return entries[i].Name < entries[j].Name
+	})
+
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 8, 3, ' ', 0)
+	if q.resource == "pods" {
+		fmt.Fprintln(w, "NAMESPACE\tNAME\tCPU(cores)\tMEMORY(bytes)")
+	} else {
+		fmt.Fprintln(w, "NAME\tCPU(cores)\tMEMORY(bytes)")
+	}
+	for _, e := range entries {
+		if q.resource == "pods" {
+			fmt.Fprintf(w, "%s\t", e.Namespace)
+		}
+		fmt.Fprintf(w, "%s\t%dm\t%dMi\n", e.Name, e.CPUMillicores, e.MemoryBytes/(1<<20))
+	}
+	w.Flush()
+
+	return map[string]interface{}{"resource": q.resource, "items": entries}, b.String(), nil
+}
+
+// kubeEvent is an event as reported by the events and describe commands
+type kubeEvent struct {
+	Namespace string    `json:"namespace,omitempty"`
+	Type      string    `json:"type"`
+	Reason    string    `json:"reason"`
+	Object    string    `json:"object"`
+	Message   string    `json:"message"`
+	Count     int32     `json:"count"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// kubeEvents returns the events of a namespace, optionally only those about
+// the objects of a resource or an object
+func (ce *CommandExecutor) kubeEvents(ctx context.Context, q kubeQuery) (interface{}, string, error) {
+	kind := ""
+	if q.resource != "" {
+		r, err := ce.resolveResource(q.resource)
+		if err != nil {
+			return nil, "", err
+		}
+		kind = r.kind
+	}
+
+	events, err := ce.listEvents(ctx, q.namespaceOrDefault(), kind, q.name, "")
+	if err != nil {
+		return nil, "", err
+	}
+
+	var b strings.Builder
+	renderEvents(&b, events, q.allNamespaces)
+	return map[string]interface{}{"items": events}, b.String(), nil
+}
+
+// listEvents returns the latest events about the objects matching kind, name
+// and uid when set, oldest first. The fields are also matched here, since
+// not every event source supports field selectors.
+func (ce *CommandExecutor) listEvents(ctx context.Context, namespace, kind, name, uid string) ([]kubeEvent, error) {
+	selector := fields.Set{}
+	if kind != "" {
+		selector["involvedObject.kind"] = kind
+	}
+	if name != "" {
+		selector["involvedObject.name"] = name
+	}
+	if uid != "" {
+		selector["involvedObject.uid"] = uid
+	}
+
+	list, err := ce.clientset.CoreV1().Events(namespace).List(ctx, metav1.ListOptions{
+		FieldSelector: selector.AsSelector().String(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list events: %w", err)
+	}
+
+	events := make([]kubeEvent, 0, len(list.Items))
+	for _, e := range list.Items {
+		involved := e.InvolvedObject
+		if (kind != "" && involved.Kind != kind) || (name != "" && involved.Name != name) || (uid != "" && string(involved.UID) != uid) {
+			continue
+		}
+		events = append(events, kubeEventOf(&e))
+	}
+
+	sort.SliceStable(events, func(i, j int) bool { return events[i].LastSeen.Before(events[j].LastSeen) })
+	if len(events) > maxKubeListItems {
+		events = events[len(events)-maxKubeListItems:]
+	}
+	return events, nil
+}
+
+// kubeEventOf converts a core event, taking its times from whichever of the
+// legacy and the events.k8s.io fields its source set
+func kubeEventOf(e *corev1.Event) kubeEvent {
+	first := e.FirstTimestamp.Time
+	if first.IsZero() {
+		first = e.EventTime.Time
+	}
+	if first.IsZero() {
+		first = e.CreationTimestamp.Time
+	}
+	last := e.LastTimestamp.Time
+	if e.Series != nil {
+		last = e.Series.LastObservedTime.Time
+	}
+	if last.IsZero() {
+		last = first
+	}
+
+	count := e.Count
+	if e.Series != nil {
+		count = e.Series.Count
+	}
+	if count == 0 {
+		count = 1
+	}
+
+	return kubeEvent{
+		Namespace: e.Namespace,
+		Type:      e.Type,
+		Reason:    e.Reason,
+		Object:    strings.ToLower(e.InvolvedObject.Kind) + "/" + e.InvolvedObject.Name,
+		Message:   e.Message,
+		Count:     count,
+		FirstSeen: first,
+		LastSeen:  last,
+	}
+}
+
+// stripManagedFields drops the field manager bookkeeping, which is of no
+// use for diagnostics
+func stripManagedFields(obj *unstructured.Unstructured) {
+	unstructured.RemoveNestedField(obj.Object, "metadata", "managedFields")
+}
+
+// renderObjects renders objects as a table with their status and age
+func renderObjects(r kubeResource, objects []unstructured.Unstructured) string {
+	if len(objects) == 0 {
+		return noResourcesFound
+	}
+
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 8, 3, ' ', 0)
+	if r.namespaced {
+		fmt.Fprint(w, "NAMESPACE\t")
+	}
+	fmt.Fprintln(w, "NAME\tSTATUS\tAGE")
+	for i := range objects {
+		obj := &objects[i]
+		if r.namespaced {
+			fmt.Fprintf(w, "%s\t", obj.GetNamespace())
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", obj.GetName(), objectStatus(obj), age(obj.GetCreationTimestamp().Time))
+	}
+	w.Flush()
+	return b.String()
+}
+
+// objectStatus summarizes the status of an object from its phase, ready
+// replicas or Ready condition, whichever it has
+func objectStatus(obj *unstructured.Unstructured) string {
+	if phase, ok, _ := unstructured.NestedString(obj.Object, "status", "phase"); ok && phase != "" {
+		return phase
+	}
+	if replicas, ok, _ := unstructured.NestedInt64(obj.Object, "spec", "replicas"); ok {
+		ready, _, _ := unstructured.NestedInt64(obj.Object, "status", "readyReplicas")
+		return fmt.Sprintf("%d/%d ready", ready, replicas)
+	}
+	for _, condition := range objectConditions(obj) {
+		if condition["type"] == "Ready" {
+			if condition["status"] == "True" {
+				return "Ready"
+			}
+			return "NotReady"
+		}
+	}
+	return "<none>"
+}
+
+// objectConditions returns the status conditions of an object
+func objectConditions(obj *unstructured.Unstructured) []map[string]string {
+	items, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+
+	var conditions []map[string]string
+	for _, item := range items {
+		fields, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		condition := make(map[string]string, 4)
+		for _, key := range []string{"type", "status", "reason", "message"} {
+			condition[key], _ = fields[key].(string)
+		}
+		conditions = append(conditions, condition)
+	}
+	return conditions
+}
+
+// renderDescription renders an object and the events about it the way
+// kubectl describe lays them out
+func renderDescription(r kubeResource, obj *unstructured.Unstructured, events []kubeEvent) string {
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintf(w, "Name:\t%s\n", obj.GetName())
+	if r.namespaced {
+		fmt.Fprintf(w, "Namespace:\t%s\n", obj.GetNamespace())
+	}
+	fmt.Fprintf(w, "Kind:\t%s\n", r.kind)
+	fmt.Fprintf(w, "Labels:\t%s\n", renderMap(obj.GetLabels()))
+	annotations := obj.GetAnnotations()
+	delete(annotations, corev1.LastAppliedConfigAnnotation)
+	fmt.Fprintf(w, "Annotations:\t%s\n", renderMap(annotations))
+	fmt.Fprintf(w, "Created:\t%s (%s ago)\n", obj.GetCreationTimestamp().UTC().Format(time.RFC3339), age(obj.GetCreationTimestamp().Time))
+	fmt.Fprintf(w, "Status:\t%s\n", objectStatus(obj))
+	w.Flush()
+
+	if conditions := objectConditions(obj); len(conditions) > 0 {
+		b.WriteString("Conditions:\n")
+		w = tabwriter.NewWriter(&b, 0, 8, 3, ' ', 0)
+		fmt.Fprintln(w, "  TYPE\tSTATUS\tREASON\tMESSAGE")
+		for _, c := range conditions {
+			fmt.Fprintf(w, "  %s\t%s\t%s\t%s\n", c["type"], c["status"], c["reason"], c["message"])
+		}
+		w.Flush()
+	}
+
+	b.WriteString("Events:")
+	if len(events) == 0 {
+		b.WriteString("\t<none>\n")
+		return b.String()
+	}
+	b.WriteString("\n")
+	renderEvents(&b, events, false)
+	return b.String()
+}
+
+// renderEvents renders events as a table, newest last
+func renderEvents(b *strings.Builder, events []kubeEvent, withNamespace bool) {
+	if len(events) == 0 {
+		b.WriteString("No events found\n")
+		return
+	}
+
+	w := tabwriter.NewWriter(b, 0, 8, 3, ' ', 0)
+	if withNamespace {
+		fmt.Fprint(w, "NAMESPACE\t")
+	}
+	fmt.Fprintln(w, "LAST SEEN\tTYPE\tREASON\tOBJECT\tCOUNT\tMESSAGE")
+	for _, e := range events {
+		if withNamespace {
+			fmt.Fprintf(w, "%s\t", e.Namespace)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\n", age(e.LastSeen), e.Type, e.Reason, e.Object, e.Count, e.Message)
+	}
+	w.Flush()
+}
+
+// renderMap renders labels or annotations as key=value pairs in order
+func renderMap(m map[string]string) string {
+	if len(m) == 0 {
+		return "<none>"
+	}
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, key+"="+m[key])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// age renders the time since t the way kubectl does
+func age(t time.Time) string {
+	if t.IsZero() {
+		return "<unknown>"
+	}
+	return duration.HumanDuration(time.Since(t))
+}
@@ -0,0 +1,215 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/kart-io/k8s-agent/protocol"
+
+	"github.com/kart/k8s-agent/collect-agent/internal/types"
+)
+
+// newTestKubeExecutor returns a command executor reading the dev cluster
+func newTestKubeExecutor(t *testing.T) *CommandExecutor {
+	t.Helper()
+
+	clientset := newDevClientset()
+	executor := NewCommandExecutor(clientset, "test-cluster", zap.NewNop())
+	executor.SetDynamicClient(newDevDynamicClient(clientset))
+	executor.SetMetricsClient(newDevMetricsClient())
+
+	ctx := context.Background()
+	for _, tmpl := range devEvents[:2] {
+		if err := createDevEvent(ctx, clientset, tmpl); err != nil {
+			t.Fatalf("createDevEvent failed: %v", err)
+		}
+	}
+	return executor
+}
+
+// runKube executes a kubectl command and decodes its structured output
+func runKube(t *testing.T, executor *CommandExecutor, action string, params map[string]string) (*types.CommandResult, map[string]interface{}) {
+	t.Helper()
+
+	result := executor.Execute(context.Background(), types.Command{
+		ID:      "cmd-" + action,
+		Type:    "diagnostic",
+		Tool:    "kubectl",
+		Action:  action,
+		Params:  params,
+		Timeout: 5 * time.Second,
+	})
+
+	var data map[string]interface{}
+	if result.Status == protocol.CommandStatusSuccess {
+		if err := json.Unmarshal(result.Data, &data); err != nil {
+			t.Fatalf("kubectl %s data is not JSON: %v", action, err)
+		}
+	}
+	return result, data
+}
+
+func TestParseKubeQuery(t *testing.T) {
+	tests := []struct {
+		name    string
+		action  string
+		params  map[string]string
+		wantErr bool
+	}{
+		{"get pods", "get", map[string]string{"resource": "pods", "namespace": "demo"}, false},
+		{"get with group", "get", map[string]string{"resource": "deployments.apps", "label_selector": "app=web,tier!=db"}, false},
+		{"get all namespaces", "get", map[string]string{"resource": "po", "all_namespaces": "true"}, false},
+		{"get without resource", "get", map[string]string{"namespace": "demo"}, true},
+		{"resource with flags", "get", map[string]string{"resource": "pods --all-namespaces"}, true},
+		{"name with path", "get", map[string]string{"resource": "pods", "name": "../secrets/x"}, true},
+		{"namespace with shell", "get", map[string]string{"resource": "pods", "namespace": "demo;rm"}, true},
+		{"bad label selector", "get", map[string]string{"resource": "pods", "label_selector": "app in (web"}, true},
+		{"namespace and all namespaces", "get", map[string]string{"resource": "pods", "namespace": "demo", "all_namespaces": "true"}, true},
+		{"unknown param", "get", map[string]string{"resource": "pods", "output": "yaml"}, true},
+		{"describe without name", "describe", map[string]string{"resource": "pods"}, true},
+		{"logs", "logs", map[string]string{"name": "web-1", "container": "main", "tail_lines": "100", "since": "10m", "previous": "true"}, false},
+		{"logs tail too long", "logs", map[string]string{"name": "web-1", "tail_lines": "1000000"}, true},
+		{"logs bad since", "logs", map[string]string{"name": "web-1", "since": "yesterday"}, true},
+		{"logs label selector", "logs", map[string]string{"name": "web-1", "label_selector": "app=web"}, true},
+		{"top pods", "top", map[string]string{"resource": "pods", "namespace": "demo"}, false},
+		{"top deployments", "top", map[string]string{"resource": "deployments"}, true},
+		{"events", "events", map[string]string{"resource": "pods", "name": "web-1"}, false},
+		{"unknown action", "exec", map[string]string{"name": "web-1"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseKubeQuery(tt.action, tt.params)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseKubeQuery() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestKubeGet(t *testing.T) {
+	executor := newTestKubeExecutor(t)
+
+	result, data := runKube(t, executor, "get", map[string]string{"resource": "po", "namespace": devNamespace})
+	if result.Status != protocol.CommandStatusSuccess {
+		t.Fatalf("get pods = %v: %v", result.Status, result.Error)
+	}
+	if items := data["items"].([]interface{}); len(items) != 5 || data["kind"] != "PodList" {
+		t.Errorf("get pods = %v items of %v, want 5 of PodList", len(items), data["kind"])
+	}
+	if !strings.Contains(result.Output, "web-6b7f9d8c5-2mzpt") || !strings.Contains(result.Output, "Running") {
+		t.Errorf("Output = %q, want the pods and their phase", result.Output)
+	}
+	if result.ExitCode == nil || *result.ExitCode != 0 || result.Stdout != result.Output || result.Stderr != "" {
+		t.Errorf("get pods exit code %v, stdout %q, stderr %q, want 0 and the output on stdout",
+			result.ExitCode, result.Stdout, result.Stderr)
+	}
+
+	// An empty listing succeeds with its notice on stderr, as with kubectl
+	result, _ = runKube(t, executor, "get", map[string]string{"resource": "pods", "namespace": "empty"})
+	if result.Status != protocol.CommandStatusSuccess || result.Stdout != "" || result.Stderr != noResourcesFound {
+		t.Errorf("get pods of an empty namespace = %v, stdout %q, stderr %q, want the notice on stderr",
+			result.Status, result.Stdout, result.Stderr)
+	}
+
+	result, data = runKube(t, executor, "get", map[string]string{"resource": "nodes", "name": "dev-node-3"})
+	if result.Status != protocol.CommandStatusSuccess {
+		t.Fatalf("get node = %v: %v", result.Status, result.Error)
+	}
+	if data["kind"] != "Node" || !strings.Contains(result.Output, "NotReady") {
+		t.Errorf("get node = %v, output %q, want the NotReady node", data["kind"], result.Output)
+	}
+
+	result, _ = runKube(t, executor, "get", map[string]string{"resource": "pods", "name": "missing", "namespace": devNamespace})
+	if result.Status != protocol.CommandStatusFailed || !strings.Contains(result.Error, "not found") {
+		t.Errorf("get missing pod = %v: %v, want not found", result.Status, result.Error)
+	}
+	if result.ExitCode == nil || *result.ExitCode != 1 {
+		t.Errorf("get missing pod exit code = %v, want 1", result.ExitCode)
+	}
+	var status protocol.KubeAPIStatus
+	if err := json.Unmarshal(result.Data, &status); err != nil || status.Reason != protocol.KubeAPIStatusNotFound || status.Code != 404 {
+		t.Errorf("get missing pod data = %s, want the NotFound API status", result.Data)
+	}
+	if !executor.Health().Healthy {
+		t.Error("a missing object made the executor unhealthy")
+	}
+
+	result, _ = runKube(t, executor, "get", map[string]string{"resource": "secrets", "namespace": devNamespace})
+	if result.Status != protocol.CommandStatusFailed || result.Data != nil {
+		t.Errorf("get secrets = %v, want refused", result.Status)
+	}
+
+	result, _ = runKube(t, executor, "get", map[string]string{"resource": "widgets"})
+	if result.Status != protocol.CommandStatusFailed || !strings.Contains(result.Error, "unknown resource") {
+		t.Errorf("get widgets = %v: %v, want unknown resource", result.Status, result.Error)
+	}
+}
+
+func TestKubeDescribe(t *testing.T) {
+	executor := newTestKubeExecutor(t)
+
+	result, data := runKube(t, executor, "describe", map[string]string{
+		"resource": "pods", "name": "api-7c6d5f8b9-q4w8n", "namespace": devNamespace,
+	})
+	if result.Status != protocol.CommandStatusSuccess {
+		t.Fatalf("describe = %v: %v", result.Status, result.Error)
+	}
+	events := data["events"].([]interface{})
+	if len(events) != 1 || events[0].(map[string]interface{})["reason"] != "Unhealthy" {
+		t.Errorf("events = %v, want the Unhealthy event of the pod", events)
+	}
+	for _, want := range []string{"Name:", "api-7c6d5f8b9-q4w8n", "Namespace:", "Events:", "Readiness probe failed"} {
+		if !strings.Contains(result.Output, want) {
+			t.Errorf("Output = %q, want %q", result.Output, want)
+		}
+	}
+}
+
+func TestKubeLogsTopEvents(t *testing.T) {
+	executor := newTestKubeExecutor(t)
+
+	result, data := runKube(t, executor, "logs", map[string]string{
+		"name": "web-6b7f9d8c5-2mzpt", "namespace": devNamespace, "tail_lines": "10",
+	})
+	if result.Status != protocol.CommandStatusSuccess || data["pod"] != "web-6b7f9d8c5-2mzpt" {
+		t.Errorf("logs = %v: %v, data %v", result.Status, result.Error, data)
+	}
+
+	result, data = runKube(t, executor, "top", map[string]string{"resource": "pods", "namespace": devNamespace})
+	if result.Status != protocol.CommandStatusSuccess {
+		t.Fatalf("top pods = %v: %v", result.Status, result.Error)
+	}
+	items := data["items"].([]interface{})
+	if len(items) != 4 {
+		t.Fatalf("top pods = %v items, want 4", len(items))
+	}
+	if first := items[0].(map[string]interface{}); first["name"] != "api-7c6d5f8b9-q4w8n" || first["cpu_millicores"] != 310.0 {
+		t.Errorf("first pod = %v, want api at 310m", first)
+	}
+	if !strings.Contains(result.Output, "310m") {
+		t.Errorf("Output = %q, want the CPU usage", result.Output)
+	}
+
+	result, data = runKube(t, executor, "events", map[string]string{"resource": "pods", "namespace": devNamespace})
+	if result.Status != protocol.CommandStatusSuccess {
+		t.Fatalf("events = %v: %v", result.Status, result.Error)
+	}
+	if items := data["items"].([]interface{}); len(items) != 2 {
+		t.Errorf("events = %v items, want 2", len(items))
+	}
+	if !strings.Contains(result.Output, "BackOff") {
+		t.Errorf("Output = %q, want the BackOff event", result.Output)
+	}
+
+	executor.SetMetricsClient(nil)
+	result, _ = runKube(t, executor, "top", map[string]string{"resource": "nodes"})
+	if result.Status != protocol.CommandStatusFailed {
+		t.Errorf("top without metrics-server = %v, want failed", result.Status)
+	}
+}
@@ -0,0 +1,397 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/rest"
+	statsv1alpha1 "k8s.io/kubelet/pkg/apis/stats/v1alpha1"
+
+	"github.com/kart/k8s-agent/collect-agent/internal/types"
+)
+
+// capabilityKubeletStats is the capability reporting whether the kubelet of
+// any node served container stats in the last collection
+const capabilityKubeletStats = "kubelet_stats"
+
+// Kubelet endpoints read through the API server proxy
+const (
+	kubeletSummaryPath  = "stats/summary"
+	kubeletCAdvisorPath = "metrics/cadvisor"
+)
+
+// cAdvisor counters of the CFS quota of a container
+const (
+	cadvisorCFSPeriods          = "container_cpu_cfs_periods_total"
+	cadvisorCFSThrottledPeriods = "container_cpu_cfs_throttled_periods_total"
+	cadvisorCFSThrottledSeconds = "container_cpu_cfs_throttled_seconds_total"
+)
+
+// kubeletClient reads an endpoint of the kubelet of a node
+type kubeletClient interface {
+	get(ctx context.Context, node, path string) ([]byte, error)
+}
+
+// proxyKubeletClient reaches kubelets through the nodes/proxy subresource,
+// so the agent needs no network access to the nodes
+type proxyKubeletClient struct {
+	client rest.Interface
+}
+
+// get returns the response of the kubelet of node to path
+func (c proxyKubeletClient) get(ctx context.Context, node, path string) ([]byte, error) {
+	return c.client.Get().Resource("nodes").Name(node).SubResource("proxy").Suffix(path).Do(ctx).Raw()
+}
+
+// cfsCounters are the cumulative CFS counters of a container
+type cfsCounters struct {
+	periods          float64
+	throttledPeriods float64
+	throttledSeconds float64
+}
+
+// kubeletScraper collects per-container stats the kubelets of a sample of
+// nodes report, which metrics-server does not: the memory working set,
+// filesystem and network usage, and CPU throttling from cAdvisor
+type kubeletScraper struct {
+	client kubeletClient
+	config types.KubeletStatsConfig
+	logger *zap.Logger
+
+	// next is the position of the first node of the next sample, so that
+	// samples go round all nodes; only used by the collection
+	next int
+
+	// throttling holds the CFS counters of the previous scrape of each
+	// container, to report throttling over the time between scrapes
+	mu         sync.Mutex
+	throttling map[string]cfsCounters
+
+	state atomic.Int32
+}
+
+// newKubeletScraper creates a scraper reading kubelets with client
+func newKubeletScraper(client kubeletClient, config types.KubeletStatsConfig, logger *zap.Logger) *kubeletScraper {
+	return &kubeletScraper{
+		client:     client,
+		config:     config,
+		logger:     logger,
+		throttling: make(map[string]cfsCounters),
+	}
+}
+
+// sample returns the ready nodes to scrape, at most MaxNodes of them taken in
+// turn, sorted by name
+func (s *kubeletScraper) sample(nodes []*corev1.Node) []*corev1.Node {
+	var ready []*corev1.Node
+	for _, node := range nodes {
+		if nodeReady(node) {
+			ready = append(ready, node)
+		}
+	}
+	sort.Slice(ready, func(i, j int) bool { return ready[i].Name < ready[j].Name })
+
+	if s.config.MaxNodes <= 0 || len(ready) <= s.config.MaxNodes {
+		return ready
+	}
+
+	start := s.next % len(ready)
+	s.next = start + s.config.MaxNodes
+	sample := make([]*corev1.Node, 0, s.config.MaxNodes)
+	for i := 0; i < s.config.MaxNodes; i++ {
+		sample = append(sample, ready[(start+i)%len(ready)])
+	}
+	return sample
+}
+
+// nodeReady reports whether the Ready condition of a node is true
+func nodeReady(node *corev1.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == corev1.NodeReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// scrape collects the stats of the sampled nodes, at most Concurrency at a
+// time, and returns the kubelet section of the metrics payload with the
+// number of nodes scraped successfully
+func (s *kubeletScraper) scrape(ctx context.Context, nodes []*corev1.Node) (map[string]interface{}, int) {
+	ctx, cancel := context.WithTimeout(ctx, s.config.Timeout)
+	defer cancel()
+
+	sample := s.sample(nodes)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	nodeData := make(map[string]interface{}, len(sample))
+	podData := make(map[string]interface{})
+	scraped := 0
+
+	slots := make(chan struct{}, s.config.Concurrency)
+	for _, node := range sample {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(name string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			pods, status := s.scrapeNode(ctx, name)
+
+			mu.Lock()
+			defer mu.Unlock()
+			nodeData[name] = status
+			for key, pod := range pods {
+				podData[key] = pod
+			}
+			if _, failed := status["error"]; !failed {
+				scraped++
+			}
+		}(node.Name)
+	}
+	wg.Wait()
+
+	return map[string]interface{}{
+		"sampled_nodes": len(sample),
+		"total_nodes":   len(nodes),
+		"nodes":         nodeData,
+		"pods":          podData,
+	}, scraped
+}
+
+// scrapeNode returns the stats of the pods on a node, and the status of the
+// scrape. Failing to read cAdvisor only leaves out the CPU throttling.
+func (s *kubeletScraper) scrapeNode(ctx context.Context, node string) (map[string]interface{}, map[string]interface{}) {
+	raw, err := s.client.get(ctx, node, kubeletSummaryPath)
+	if err != nil {
+		s.logger.Debug("Failed to read kubelet stats", zap.String("node", node), zap.Error(err))
+		return nil, map[string]interface{}{"error": fmt.Sprintf("failed to read %s: %v", kubeletSummaryPath, err)}
+	}
+
+	var summary statsv1alpha1.Summary
+	if err := json.Unmarshal(raw, &summary); err != nil {
+		return nil, map[string]interface{}{"error": fmt.Sprintf("failed to decode %s: %v", kubeletSummaryPath, err)}
+	}
+
+	status := map[string]interface{}{"pods": len(summary.Pods)}
+
+	var throttling map[string]map[string]interface{}
+	if s.config.CAdvisor {
+		throttling, err = s.scrapeThrottling(ctx, node)
+		if err != nil {
+			s.logger.Debug("Failed to read cAdvisor metrics", zap.String("node", node), zap.Error(err))
+			status["cadvisor_error"] = err.Error()
+		}
+	}
+
+	pods := make(map[string]interface{}, len(summary.Pods))
+	for i := range summary.Pods {
+		pod := &summary.Pods[i]
+		key := pod.PodRef.Namespace + "/" + pod.PodRef.Name
+		pods[key] = podStatsData(node, pod, throttling)
+	}
+	return pods, status
+}
+
+// podStatsData returns the stats of a pod and its containers as reported in
+// the metrics payload
+func podStatsData(node string, pod *statsv1alpha1.PodStats, throttling map[string]map[string]interface{}) map[string]interface{} {
+	data := map[string]interface{}{"node": node}
+	if pod.Network != nil {
+		interfaces := pod.Network.Interfaces
+		if len(interfaces) == 0 {
+			interfaces = []statsv1alpha1.InterfaceStats{pod.Network.InterfaceStats}
+		}
+		var rxBytes, txBytes, rxErrors, txErrors uint64
+		for _, iface := range interfaces {
+			rxBytes += value(iface.RxBytes)
+			txBytes += value(iface.TxBytes)
+			rxErrors += value(iface.RxErrors)
+			txErrors += value(iface.TxErrors)
+		}
+		data["network_rx_bytes"] = rxBytes
+		data["network_tx_bytes"] = txBytes
+		data["network_rx_errors"] = rxErrors
+		data["network_tx_errors"] = txErrors
+	}
+	if pod.EphemeralStorage != nil {
+		setUint(data, "ephemeral_storage_used_bytes", pod.EphemeralStorage.UsedBytes)
+	}
+
+	containers := make(map[string]interface{}, len(pod.Containers))
+	for _, container := range pod.Containers {
+		stats := make(map[string]interface{})
+		if container.CPU != nil && container.CPU.UsageNanoCores != nil {
+			stats["cpu_usage_millicores"] = int64(*container.CPU.UsageNanoCores / 1e6)
+		}
+		if container.Memory != nil {
+			setUint(stats, "memory_working_set_bytes", container.Memory.WorkingSetBytes)
+			setUint(stats, "memory_rss_bytes", container.Memory.RSSBytes)
+			setUint(stats, "memory_usage_bytes", container.Memory.UsageBytes)
+			setUint(stats, "memory_major_page_faults", container.Memory.MajorPageFaults)
+		}
+		if container.Rootfs != nil {
+			setUint(stats, "rootfs_used_bytes", container.Rootfs.UsedBytes)
+		}
+		if container.Logs != nil {
+			setUint(stats, "logs_used_bytes", container.Logs.UsedBytes)
+		}
+		for k, v := range throttling[pod.PodRef.Namespace+"/"+pod.PodRef.Name+"/"+container.Name] {
+			stats[k] = v
+		}
+		containers[container.Name] = stats
+	}
+	data["containers"] = containers
+	return data
+}
+
+// value returns the value of an optional counter, or zero
+func value(v *uint64) uint64 {
+	if v == nil {
+		return 0
+	}
+	return *v
+}
+
+// setUint sets key to an optional value when it is set
+func setUint(data map[string]interface{}, key string, v *uint64) {
+	if v != nil {
+		data[key] = *v
+	}
+}
+
+// scrapeThrottling returns the CPU throttling of the containers on a node,
+// keyed by namespace, pod and container. Only containers with a CPU limit
+// have a CFS quota to be throttled by.
+func (s *kubeletScraper) scrapeThrottling(ctx context.Context, node string) (map[string]map[string]interface{}, error) {
+	raw, err := s.client.get(ctx, node, kubeletCAdvisorPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", kubeletCAdvisorPath, err)
+	}
+
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", kubeletCAdvisorPath, err)
+	}
+
+	counters := make(map[string]cfsCounters)
+	collect := func(name string, set func(*cfsCounters, float64)) {
+		family, ok := families[name]
+		if !ok {
+			return
+		}
+		for _, metric := range family.GetMetric() {
+			key, ok := cadvisorContainerKey(metric)
+			if !ok || metric.GetCounter() == nil {
+				continue
+			}
+			c := counters[key]
+			set(&c, metric.GetCounter().GetValue())
+			counters[key] = c
+		}
+	}
+	collect(cadvisorCFSPeriods, func(c *cfsCounters, v float64) { c.periods = v })
+	collect(cadvisorCFSThrottledPeriods, func(c *cfsCounters, v float64) { c.throttledPeriods = v })
+	collect(cadvisorCFSThrottledSeconds, func(c *cfsCounters, v float64) { c.throttledSeconds = v })
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	throttling := make(map[string]map[string]interface{}, len(counters))
+	for key, current := range counters {
+		data := map[string]interface{}{
+			"cpu_cfs_periods":           uint64(current.periods),
+			"cpu_cfs_throttled_periods": uint64(current.throttledPeriods),
+			"cpu_throttled_seconds":     current.throttledSeconds,
+		}
+
+		// Throttling since the previous scrape, or since the container
+		// started when it is seen for the first time or restarted
+		periods, throttled := current.periods, current.throttledPeriods
+		if previous, ok := s.throttling[key]; ok && current.periods > previous.periods {
+			periods -= previous.periods
+			throttled -= previous.throttledPeriods
+		}
+		if periods > 0 {
+			data["cpu_throttled_percent"] = math.Round(throttled*1000/periods) / 10
+		}
+
+		s.throttling[key] = current
+		throttling[key] = data
+	}
+	return throttling, nil
+}
+
+// cadvisorContainerKey returns the namespace, pod and container of a
+// cAdvisor metric, skipping the pod-level cgroups
+func cadvisorContainerKey(metric *dto.Metric) (string, bool) {
+	var namespace, pod, container string
+	for _, label := range metric.GetLabel() {
+		switch label.GetName() {
+		case "namespace":
+			namespace = label.GetValue()
+		case "pod":
+			pod = label.GetValue()
+		case "container":
+			container = label.GetValue()
+		}
+	}
+	if namespace == "" || pod == "" || container == "" || container == "POD" {
+		return "", false
+	}
+	return namespace + "/" + pod + "/" + container, true
+}
+
+// collectKubeletStats scrapes the kubelets of a sample of the nodes when
+// enabled. Like metrics-server, kubelets that cannot be read only lose their
+// stats: the capability is reported as unavailable when no node could be
+// scraped, and the collector stays healthy.
+func (mc *MetricsCollector) collectKubeletStats(metrics *types.Metrics) error {
+	if mc.kubelet == nil {
+		return nil
+	}
+
+	nodes, err := mc.nodes.List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("failed to list cached nodes: %w", err)
+	}
+
+	section, scraped := mc.kubelet.scrape(context.Background(), nodes)
+	metrics.Data["kubelet"] = section
+
+	available := scraped > 0
+	capabilities(metrics)[capabilityKubeletStats] = available
+
+	state := metricsServerUnavailable
+	if available {
+		state = metricsServerAvailable
+	}
+	if mc.kubelet.state.Swap(state) != state {
+		if available {
+			mc.logger.Info("Kubelet stats available, reporting container stats",
+				zap.Int("sampled_nodes", section["sampled_nodes"].(int)))
+		} else {
+			mc.logger.Warn("Kubelet stats unavailable, no node could be scraped",
+				zap.Int("sampled_nodes", section["sampled_nodes"].(int)))
+		}
+	}
+	return nil
+}
+
+// SetKubeletStats enables scraping container stats from kubelets with client
+func (mc *MetricsCollector) SetKubeletStats(client kubeletClient, config types.KubeletStatsConfig) {
+	mc.kubelet = newKubeletScraper(client, config, mc.logger)
+}
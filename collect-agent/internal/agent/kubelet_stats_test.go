@@ -0,0 +1,134 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/kart/k8s-agent/collect-agent/internal/types"
+)
+
+// testKubeletStatsConfig scrapes all nodes, two at a time
+var testKubeletStatsConfig = types.KubeletStatsConfig{
+	Enabled:     true,
+	Concurrency: 2,
+	Timeout:     5 * time.Second,
+	CAdvisor:    true,
+}
+
+// failingKubeletClient fails every request
+type failingKubeletClient struct{}
+
+func (failingKubeletClient) get(ctx context.Context, node, path string) ([]byte, error) {
+	return nil, fmt.Errorf("nodes %q is forbidden: cannot get resource \"nodes/proxy\"", node)
+}
+
+func TestKubeletScraperSample(t *testing.T) {
+	var nodes []*corev1.Node
+	for _, name := range []string{"node-d", "node-a", "node-c", "node-b", "node-e"} {
+		nodes = append(nodes, devNode(name, true, false))
+	}
+	nodes = append(nodes, devNode("node-down", false, false))
+
+	config := testKubeletStatsConfig
+	config.MaxNodes = 2
+	scraper := newKubeletScraper(failingKubeletClient{}, config, zap.NewNop())
+
+	tests := [][]string{
+		{"node-a", "node-b"},
+		{"node-c", "node-d"},
+		{"node-e", "node-a"},
+		{"node-b", "node-c"},
+	}
+	for i, want := range tests {
+		var got []string
+		for _, node := range scraper.sample(nodes) {
+			got = append(got, node.Name)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("sample %d = %v, want %v", i, got, want)
+		}
+	}
+
+	config.MaxNodes = 0
+	scraper = newKubeletScraper(failingKubeletClient{}, config, zap.NewNop())
+	if got := scraper.sample(nodes); len(got) != 5 {
+		t.Errorf("unlimited sample = %d nodes, want the 5 ready nodes", len(got))
+	}
+}
+
+func TestKubeletScraperScrape(t *testing.T) {
+	clientset := newDevClientset()
+	collector, metricsChan := newTestMetricsCollector(t, clientset)
+	collector.SetKubeletStats(newDevKubeletClient(clientset), testKubeletStatsConfig)
+
+	metrics := collectTestMetrics(t, collector, metricsChan)
+	kubelet := metrics.Data["kubelet"].(map[string]interface{})
+	if kubelet["sampled_nodes"] != 2 || kubelet["total_nodes"] != 3 {
+		t.Errorf("sampled %v of %v nodes, want the 2 ready of 3", kubelet["sampled_nodes"], kubelet["total_nodes"])
+	}
+	if capabilities := metrics.Data["capabilities"].(map[string]interface{}); capabilities[capabilityKubeletStats] != true {
+		t.Errorf("capabilities = %v, want kubelet_stats", capabilities)
+	}
+
+	pods := kubelet["pods"].(map[string]interface{})
+	if len(pods) != 4 {
+		t.Fatalf("pods = %v, want the 4 running pods", len(pods))
+	}
+	pod := pods[devNamespace+"/api-7c6d5f8b9-q4w8n"].(map[string]interface{})
+	if pod["node"] != "dev-node-1" {
+		t.Errorf("node = %v, want dev-node-1", pod["node"])
+	}
+	container := pod["containers"].(map[string]interface{})["main"].(map[string]interface{})
+	if container["cpu_usage_millicores"] != int64(310) {
+		t.Errorf("cpu_usage_millicores = %v, want 310", container["cpu_usage_millicores"])
+	}
+	if container["memory_working_set_bytes"] != uint64(240<<20) {
+		t.Errorf("memory_working_set_bytes = %v, want %v", container["memory_working_set_bytes"], 240<<20)
+	}
+	if container["cpu_throttled_percent"] != 0.2 {
+		t.Errorf("first cpu_throttled_percent = %v, want 0.2 since the start", container["cpu_throttled_percent"])
+	}
+
+	// Later scrapes report throttling since the previous one
+	metrics = collectTestMetrics(t, collector, metricsChan)
+	pods = metrics.Data["kubelet"].(map[string]interface{})["pods"].(map[string]interface{})
+	worker := pods[devNamespace+"/worker-5d8f7c9b4-xk2lp"].(map[string]interface{})
+	container = worker["containers"].(map[string]interface{})["main"].(map[string]interface{})
+	if container["cpu_cfs_periods"] != uint64(1200) || container["cpu_throttled_percent"] != 40.0 {
+		t.Errorf("worker throttling = %v periods, %v%%, want 1200 and 40%%", container["cpu_cfs_periods"], container["cpu_throttled_percent"])
+	}
+
+	if got := collector.Capabilities(); !got[capabilityKubeletStats] {
+		t.Errorf("Capabilities = %v, want kubelet_stats", got)
+	}
+}
+
+func TestKubeletScraperUnavailable(t *testing.T) {
+	clientset := fake.NewClientset(devNode("node-1", true, false))
+	collector, metricsChan := newTestMetricsCollector(t, clientset)
+	collector.SetKubeletStats(failingKubeletClient{}, testKubeletStatsConfig)
+
+	metrics := collectTestMetrics(t, collector, metricsChan)
+	nodes := metrics.Data["kubelet"].(map[string]interface{})["nodes"].(map[string]interface{})
+	if status := nodes["node-1"].(map[string]interface{}); status["error"] == nil {
+		t.Errorf("node status = %v, want the error", status)
+	}
+
+	capabilities := metrics.Data["capabilities"].(map[string]interface{})
+	if capabilities[capabilityKubeletStats] != false {
+		t.Errorf("capabilities = %v, want kubelet_stats unavailable", capabilities)
+	}
+	if _, ok := capabilities[capabilityMetricsServer]; !ok {
+		t.Errorf("capabilities = %v, want metrics_server kept", capabilities)
+	}
+	if !collector.Health().Healthy {
+		t.Error("unreachable kubelets made the collector unhealthy")
+	}
+}
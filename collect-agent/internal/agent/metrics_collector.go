@@ -2,48 +2,154 @@ package agent
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"reflect"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
 	corev1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes"
-	metricsv1beta1 "k8s.io/metrics/pkg/client/clientset/versioned"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	metricsclient "k8s.io/metrics/pkg/client/clientset/versioned"
 
 	"github.com/kart/k8s-agent/collect-agent/internal/types"
 )
 
-// MetricsCollector collects cluster metrics and sends them to the metrics channel
+// MetricsCollector collects cluster metrics from the shared informer caches
+// and sends them to the metrics channel. The cluster statistics are kept up
+// to date by the informer handlers, so a report needs no API call besides
+// the server version of full snapshots, the usage from metrics-server and,
+// when enabled, the container stats of kubelets.
+// Between full snapshots, reports are deltas holding only the nodes and
+// namespaces that changed.
 type MetricsCollector struct {
-	clientset       kubernetes.Interface
-	metricsClientset *metricsv1beta1.Clientset
-	clusterID       string
-	metricsChan     chan<- *types.Metrics
-	stopCh          chan struct{}
-	running         bool
-	mu              sync.RWMutex
-	logger          *zap.Logger
+	clientset   kubernetes.Interface
+	clusterID   string
+	metricsChan chan<- *types.Metrics
+	stopCh      chan struct{}
+	running     bool
+	mu          sync.RWMutex
+	logger      *zap.Logger
+	health      componentHealth
+	dropped     atomic.Int64
+	metrics     *agentMetrics
+
+	// metricsClient reads resource usage from metrics-server; nil reports no usage
+	metricsClient      metricsclient.Interface
+	metricsServerState atomic.Int32
+
+	// kubelet scrapes container stats from kubelets; nil when disabled
+	kubelet *kubeletScraper
+
+	synced     []cache.InformerSynced
+	nodes      corelisters.NodeLister
+	pods       corelisters.PodLister
+	namespaces corelisters.NamespaceLister
+	stats      *clusterStats
+
+	// fullSnapshotInterval is the interval between full snapshots; zero
+	// makes every report a full snapshot
+	fullSnapshotInterval time.Duration
+
+	// lastFull and the entries last reported are only used by the collection
+	lastFull       time.Time
+	sentNodes      reportedEntries
+	sentNamespaces reportedEntries
 }
 
-// NewMetricsCollector creates a new metrics collector
-func NewMetricsCollector(clientset kubernetes.Interface, clusterID string, metricsChan chan<- *types.Metrics, logger *zap.Logger) *MetricsCollector {
-	// Try to create metrics clientset, but don't fail if metrics server is not available
-	var metricsClientset *metricsv1beta1.Clientset
-	// Note: In production, you would get this from the same config as the main clientset
-	// For now, we'll collect basic metrics without the metrics server
-
-	return &MetricsCollector{
-		clientset:       clientset,
-		metricsClientset: metricsClientset,
-		clusterID:       clusterID,
-		metricsChan:     metricsChan,
-		stopCh:          make(chan struct{}),
-		logger:          logger.With(zap.String("component", "metrics-collector")),
+// NewMetricsCollector creates a new metrics collector reading the caches of
+// informers, whose handlers it registers
+func NewMetricsCollector(clientset kubernetes.Interface, informers *sharedInformers, clusterID string, metricsChan chan<- *types.Metrics, logger *zap.Logger) *MetricsCollector {
+	mc := &MetricsCollector{
+		clientset:      clientset,
+		clusterID:      clusterID,
+		metricsChan:    metricsChan,
+		stopCh:         make(chan struct{}),
+		logger:         logger.With(zap.String("component", "metrics-collector")),
+		stats:          newClusterStats(),
+		sentNodes:      make(reportedEntries),
+		sentNamespaces: make(reportedEntries),
 	}
+
+	// A failed registration leaves the collector unsynced, and so unhealthy
+	if err := mc.watch(informers); err != nil {
+		mc.logger.Error("Failed to watch the informer caches", zap.Error(err))
+		mc.health.recordError(fmt.Errorf("failed to watch the informer caches: %w", err))
+	}
+	return mc
 }
 
-// Start begins collecting metrics at the specified interval
+// watch registers the handlers keeping the cluster statistics up to date
+func (mc *MetricsCollector) watch(informers *sharedInformers) error {
+	core := informers.factory.Core().V1()
+	stats := mc.stats
+
+	// Configmaps and secrets are only counted, so their contents are not cached
+	configMaps := core.ConfigMaps().Informer()
+	secrets := core.Secrets().Informer()
+	for _, informer := range []cache.SharedIndexInformer{configMaps, secrets} {
+		if err := informer.SetTransform(stripData); err != nil {
+			return err
+		}
+	}
+
+	watched := []struct {
+		informer cache.SharedIndexInformer
+		apply    func(obj interface{}, sign int)
+	}{
+		{core.Nodes().Informer(), stats.applyNode},
+		{core.Pods().Informer(), stats.applyPod},
+		{core.Namespaces().Informer(), stats.applyNamespace},
+		{core.Services().Informer(), stats.counter(func(c *namespaceCounts) *int { return &c.services })},
+		{configMaps, stats.counter(func(c *namespaceCounts) *int { return &c.configMaps })},
+		{secrets, stats.counter(func(c *namespaceCounts) *int { return &c.secrets })},
+	}
+
+	synced := make([]cache.InformerSynced, 0, len(watched))
+	for _, w := range watched {
+		if err := informers.watch(w.informer, stats.handler(w.apply, mc.health.recordSuccess), mc.health.recordError); err != nil {
+			return err
+		}
+		synced = append(synced, w.informer.HasSynced)
+	}
+
+	mc.nodes = core.Nodes().Lister()
+	mc.pods = core.Pods().Lister()
+	mc.namespaces = core.Namespaces().Lister()
+
+	mc.mu.Lock()
+	mc.synced = synced
+	mc.mu.Unlock()
+	return nil
+}
+
+// stripData drops the contents of configmaps and secrets before they are cached
+func stripData(obj interface{}) (interface{}, error) {
+	switch o := obj.(type) {
+	case *corev1.ConfigMap:
+		o.Data = nil
+		o.BinaryData = nil
+		o.ManagedFields = nil
+	case *corev1.Secret:
+		o.Data = nil
+		o.StringData = nil
+		o.ManagedFields = nil
+	}
+	return obj, nil
+}
+
+// SetFullSnapshotInterval sets the interval between full snapshots; zero makes every report a full snapshot
+func (mc *MetricsCollector) SetFullSnapshotInterval(interval time.Duration) {
+	mc.fullSnapshotInterval = interval
+}
+
+// Start begins collecting metrics at the specified interval, once the
+// informer caches have synced
 func (mc *MetricsCollector) Start(ctx context.Context, interval time.Duration) {
 	mc.mu.Lock()
 	if mc.running {
@@ -51,11 +157,17 @@ func (mc *MetricsCollector) Start(ctx context.Context, interval time.Duration) {
 		return
 	}
 	mc.running = true
+	synced := mc.synced
 	mc.mu.Unlock()
 
 	mc.logger.Info("Starting metrics collector",
 		zap.String("cluster_id", mc.clusterID),
-		zap.Duration("interval", interval))
+		zap.Duration("interval", interval),
+		zap.Duration("full_snapshot_interval", mc.fullSnapshotInterval))
+
+	if len(synced) == 0 || !cache.WaitForCacheSync(mc.stopCh, synced...) {
+		return
+	}
 
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
@@ -91,178 +203,166 @@ func (mc *MetricsCollector) Stop() {
 	mc.logger.Info("Metrics collector stopped")
 }
 
-// collectAndSendMetrics collects various cluster metrics and sends them
+// collectAndSendMetrics builds a report from the informer caches and sends
+// it. Changes of a report that cannot be sent are reported with the next one.
 func (mc *MetricsCollector) collectAndSendMetrics() {
+	now := time.Now()
+	full := mc.fullSnapshotDue(now)
+
 	metrics := &types.Metrics{
 		ClusterID: mc.clusterID,
-		Timestamp: time.Now(),
+		Timestamp: now,
+		Snapshot:  types.MetricsSnapshotDelta,
 		Data:      make(map[string]interface{}),
 	}
+	if full {
+		metrics.Snapshot = types.MetricsSnapshotFull
+	}
 
-	// Collect cluster-level metrics
-	mc.collectClusterMetrics(metrics)
-
-	// Collect node metrics
-	mc.collectNodeMetrics(metrics)
-
-	// Collect pod metrics
-	mc.collectPodMetrics(metrics)
+	changedNodes, changedNamespaces := mc.stats.takeChanges()
+	nodes := mc.nodeReport(full, changedNodes)
+	namespaces := mc.namespaceReport(full, changedNamespaces)
+	metrics.Data["node_details"] = nodes.entries
+	metrics.Data["namespaces"] = namespaces.entries
+	if !full {
+		metrics.Removed = removedEntries(map[string]sectionReport{
+			"node_details": nodes,
+			"namespaces":   namespaces,
+		})
+	}
 
-	// Collect namespace metrics
-	mc.collectNamespaceMetrics(metrics)
+	// Collect the summaries, version and usage; a failing call marks the
+	// collector unhealthy until a later cycle succeeds
+	start := time.Now()
+	metrics.Data["nodes"] = mc.stats.nodeSummary()
+	metrics.Data["pods"] = mc.stats.podSummary()
+	err := errors.Join(
+		mc.collectClusterMetrics(metrics, full),
+		mc.collectUsageMetrics(metrics, full),
+		mc.collectKubeletStats(metrics),
+	)
+	mc.metrics.observeCollection(time.Since(start), err)
+	mc.recordResult(err)
 
 	// Send metrics
 	select {
 	case mc.metricsChan <- metrics:
-		mc.logger.Debug("Metrics sent", zap.String("cluster_id", mc.clusterID))
+		mc.sentNodes.apply(nodes)
+		mc.sentNamespaces.apply(namespaces)
+		if full {
+			mc.lastFull = now
+		}
+		mc.logger.Debug("Metrics sent",
+			zap.String("cluster_id", mc.clusterID),
+			zap.String("snapshot", metrics.Snapshot),
+			zap.Int("nodes", len(nodes.entries)),
+			zap.Int("namespaces", len(namespaces.entries)))
 	default:
+		mc.stats.markChanged(changedNodes, changedNamespaces)
+		mc.dropped.Add(1)
 		mc.logger.Warn("Metrics channel full, dropping metrics")
 	}
 }
 
-// collectClusterMetrics collects cluster-level metrics
-func (mc *MetricsCollector) collectClusterMetrics(metrics *types.Metrics) {
-	ctx := context.Background()
-
-	// Get cluster version
-	version, err := mc.clientset.Discovery().ServerVersion()
-	if err != nil {
-		mc.logger.Warn("Failed to get server version", zap.Error(err))
-	} else {
-		metrics.Data["cluster"] = map[string]interface{}{
-			"version":    version.String(),
-			"git_version": version.GitVersion,
-			"platform":  version.Platform,
-		}
-	}
-
-	// Count total nodes
-	nodes, err := mc.clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
-	if err != nil {
-		mc.logger.Warn("Failed to list nodes", zap.Error(err))
-		return
-	}
-
-	nodeStats := mc.analyzeNodes(nodes.Items)
-	metrics.Data["nodes"] = nodeStats
+// fullSnapshotDue reports whether the next report must be a full snapshot
+func (mc *MetricsCollector) fullSnapshotDue(now time.Time) bool {
+	return mc.fullSnapshotInterval <= 0 || mc.lastFull.IsZero() || now.Sub(mc.lastFull) >= mc.fullSnapshotInterval
 }
 
-// collectNodeMetrics collects metrics for each node
-func (mc *MetricsCollector) collectNodeMetrics(metrics *types.Metrics) {
-	ctx := context.Background()
-
-	nodes, err := mc.clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+// recordResult updates the component health after a collection cycle
+func (mc *MetricsCollector) recordResult(err error) {
 	if err != nil {
-		mc.logger.Warn("Failed to list nodes for metrics", zap.Error(err))
+		mc.health.recordError(err)
 		return
 	}
-
-	nodeMetrics := make(map[string]interface{})
-	for _, node := range nodes.Items {
-		nodeMetrics[node.Name] = mc.getNodeMetrics(&node)
-	}
-
-	metrics.Data["node_details"] = nodeMetrics
+	mc.health.recordSuccess()
 }
 
-// collectPodMetrics collects pod-level metrics
-func (mc *MetricsCollector) collectPodMetrics(metrics *types.Metrics) {
-	ctx := context.Background()
+// Dropped returns the number of metrics snapshots dropped because the metrics channel was full
+func (mc *MetricsCollector) Dropped() int64 {
+	return mc.dropped.Load()
+}
 
-	pods, err := mc.clientset.CoreV1().Pods("").List(ctx, metav1.ListOptions{})
-	if err != nil {
-		mc.logger.Warn("Failed to list pods", zap.Error(err))
-		return
-	}
+// Health returns the metrics collector health including the informer sync state
+func (mc *MetricsCollector) Health() types.ComponentHealth {
+	synced := mc.HasSynced()
 
-	podStats := mc.analyzePods(pods.Items)
-	metrics.Data["pods"] = podStats
+	health := mc.health.snapshot()
+	health.Synced = &synced
+	health.Healthy = health.Healthy && synced
+	return health
 }
 
-// collectNamespaceMetrics collects namespace-level metrics
-func (mc *MetricsCollector) collectNamespaceMetrics(metrics *types.Metrics) {
-	ctx := context.Background()
+// collectClusterMetrics collects the server version, which only full
+// snapshots carry since it rarely changes
+func (mc *MetricsCollector) collectClusterMetrics(metrics *types.Metrics, full bool) error {
+	if !full {
+		return nil
+	}
 
-	namespaces, err := mc.clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+	version, err := mc.clientset.Discovery().ServerVersion()
 	if err != nil {
-		mc.logger.Warn("Failed to list namespaces", zap.Error(err))
-		return
+		mc.logger.Warn("Failed to get server version", zap.Error(err))
+		return fmt.Errorf("failed to get server version: %w", err)
 	}
 
-	nsStats := make(map[string]interface{})
-	for _, ns := range namespaces.Items {
-		nsStats[ns.Name] = mc.getNamespaceMetrics(&ns)
+	metrics.Data["cluster"] = map[string]interface{}{
+		"version":     version.String(),
+		"git_version": version.GitVersion,
+		"platform":    version.Platform,
 	}
-
-	metrics.Data["namespaces"] = nsStats
+	return nil
 }
 
-// analyzeNodes analyzes the list of nodes and returns statistics
-func (mc *MetricsCollector) analyzeNodes(nodes []corev1.Node) map[string]interface{} {
-	total := len(nodes)
-	ready := 0
-	notReady := 0
-	schedulable := 0
-
-	capacityStats := map[string]int64{
-		"cpu_cores":       0,
-		"memory_bytes":    0,
-		"pods":           0,
-		"ephemeral_storage": 0,
-	}
-
-	for _, node := range nodes {
-		// Check node conditions
-		for _, condition := range node.Status.Conditions {
-			if condition.Type == corev1.NodeReady {
-				if condition.Status == corev1.ConditionTrue {
-					ready++
-				} else {
-					notReady++
-				}
-				break
-			}
+// nodeReport returns the details of every node for a full snapshot, or of
+// the changed nodes for a delta
+func (mc *MetricsCollector) nodeReport(full bool, changed []string) sectionReport {
+	if full {
+		nodes, _ := mc.nodes.List(labels.Everything())
+		report := sectionReport{full: true, entries: make(map[string]interface{}, len(nodes))}
+		for _, node := range nodes {
+			report.entries[node.Name] = mc.getNodeMetrics(node)
 		}
+		return report
+	}
 
-		// Check if node is schedulable
-		if !node.Spec.Unschedulable {
-			schedulable++
+	return mc.sentNodes.diff(changed, func(name string) map[string]interface{} {
+		node, err := mc.nodes.Get(name)
+		if err != nil {
+			return nil
 		}
+		return mc.getNodeMetrics(node)
+	})
+}
 
-		// Aggregate capacity
-		if cpu := node.Status.Capacity.Cpu(); cpu != nil {
-			capacityStats["cpu_cores"] += cpu.MilliValue()
-		}
-		if memory := node.Status.Capacity.Memory(); memory != nil {
-			capacityStats["memory_bytes"] += memory.Value()
-		}
-		if pods := node.Status.Capacity.Pods(); pods != nil {
-			capacityStats["pods"] += pods.Value()
-		}
-		if storage := node.Status.Capacity.StorageEphemeral(); storage != nil {
-			capacityStats["ephemeral_storage"] += storage.Value()
+// namespaceReport returns the details of every namespace for a full
+// snapshot, or of the changed namespaces for a delta
+func (mc *MetricsCollector) namespaceReport(full bool, changed []string) sectionReport {
+	if full {
+		namespaces, _ := mc.namespaces.List(labels.Everything())
+		report := sectionReport{full: true, entries: make(map[string]interface{}, len(namespaces))}
+		for _, namespace := range namespaces {
+			report.entries[namespace.Name] = mc.getNamespaceMetrics(namespace)
 		}
+		return report
 	}
 
-	// Convert CPU from milli-cores to cores
-	capacityStats["cpu_cores"] = capacityStats["cpu_cores"] / 1000
-
-	return map[string]interface{}{
-		"total":       total,
-		"ready":       ready,
-		"not_ready":   notReady,
-		"schedulable": schedulable,
-		"capacity":    capacityStats,
-	}
+	return mc.sentNamespaces.diff(changed, func(name string) map[string]interface{} {
+		namespace, err := mc.namespaces.Get(name)
+		if err != nil {
+			return nil
+		}
+		return mc.getNamespaceMetrics(namespace)
+	})
 }
 
 // getNodeMetrics gets detailed metrics for a specific node
 func (mc *MetricsCollector) getNodeMetrics(node *corev1.Node) map[string]interface{} {
 	nodeMetrics := map[string]interface{}{
-		"name":      node.Name,
-		"ready":     false,
+		"name":        node.Name,
+		"ready":       false,
 		"schedulable": !node.Spec.Unschedulable,
-		"labels":    node.Labels,
+		"labels":      node.Labels,
 		"annotations": node.Annotations,
 	}
 
@@ -310,78 +410,90 @@ func (mc *MetricsCollector) getNodeMetrics(node *corev1.Node) map[string]interfa
 	return nodeMetrics
 }
 
-// analyzePods analyzes the list of pods and returns statistics
-func (mc *MetricsCollector) analyzePods(pods []corev1.Pod) map[string]interface{} {
-	total := len(pods)
-	phaseCount := make(map[string]int)
-	namespaceCount := make(map[string]int)
-	restartCount := 0
-
-	for _, pod := range pods {
-		// Count by phase
-		phase := string(pod.Status.Phase)
-		phaseCount[phase]++
+// getNamespaceMetrics gets detailed metrics for a specific namespace
+func (mc *MetricsCollector) getNamespaceMetrics(namespace *corev1.Namespace) map[string]interface{} {
+	return map[string]interface{}{
+		"name":        namespace.Name,
+		"status":      string(namespace.Status.Phase),
+		"created":     namespace.CreationTimestamp.Time,
+		"labels":      namespace.Labels,
+		"annotations": namespace.Annotations,
+		"resources":   mc.stats.namespaceResources(namespace.Name),
+	}
+}
 
-		// Count by namespace
-		namespaceCount[pod.Namespace]++
+// HasSynced returns true once the informer caches hold the cluster
+func (mc *MetricsCollector) HasSynced() bool {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
 
-		// Count restarts
-		for _, containerStatus := range pod.Status.ContainerStatuses {
-			restartCount += int(containerStatus.RestartCount)
-		}
+	if len(mc.synced) == 0 {
+		return false
 	}
-
-	return map[string]interface{}{
-		"total":           total,
-		"by_phase":        phaseCount,
-		"by_namespace":    namespaceCount,
-		"total_restarts":  restartCount,
+	for _, synced := range mc.synced {
+		if !synced() {
+			return false
+		}
 	}
+	return true
 }
 
-// getNamespaceMetrics gets detailed metrics for a specific namespace
-func (mc *MetricsCollector) getNamespaceMetrics(namespace *corev1.Namespace) map[string]interface{} {
-	ctx := context.Background()
+// sectionReport is the part of a report covering a keyed section of the
+// payload, such as the node details
+type sectionReport struct {
+	full    bool
+	entries map[string]interface{}
+	removed []string
+}
 
-	// Count pods in this namespace
-	pods, err := mc.clientset.CoreV1().Pods(namespace.Name).List(ctx, metav1.ListOptions{})
-	podCount := 0
-	if err == nil {
-		podCount = len(pods.Items)
+// removedEntries returns the removed entries of the sections of a delta, or
+// nil if nothing was removed
+func removedEntries(sections map[string]sectionReport) map[string][]string {
+	var removed map[string][]string
+	for name, section := range sections {
+		if len(section.removed) == 0 {
+			continue
+		}
+		if removed == nil {
+			removed = make(map[string][]string)
+		}
+		removed[name] = section.removed
 	}
+	return removed
+}
 
-	// Count services
-	services, err := mc.clientset.CoreV1().Services(namespace.Name).List(ctx, metav1.ListOptions{})
-	serviceCount := 0
-	if err == nil {
-		serviceCount = len(services.Items)
+// reportedEntries are the entries of a keyed section as last reported
+type reportedEntries map[string]interface{}
+
+// diff returns the report of the changed names whose entries differ from
+// those last reported. build returns nil for names that no longer exist,
+// which are reported as removed if they were reported before.
+func (r reportedEntries) diff(changed []string, build func(name string) map[string]interface{}) sectionReport {
+	report := sectionReport{entries: make(map[string]interface{})}
+	for _, name := range changed {
+		entry := build(name)
+		sent, wasSent := r[name]
+		switch {
+		case entry == nil:
+			if wasSent {
+				report.removed = append(report.removed, name)
+			}
+		case !wasSent || !reflect.DeepEqual(sent, entry):
+			report.entries[name] = entry
+		}
 	}
+	return report
+}
 
-	// Count configmaps
-	configMaps, err := mc.clientset.CoreV1().ConfigMaps(namespace.Name).List(ctx, metav1.ListOptions{})
-	configMapCount := 0
-	if err == nil {
-		configMapCount = len(configMaps.Items)
+// apply records a report as sent
+func (r reportedEntries) apply(report sectionReport) {
+	if report.full {
+		clear(r)
 	}
-
-	// Count secrets
-	secrets, err := mc.clientset.CoreV1().Secrets(namespace.Name).List(ctx, metav1.ListOptions{})
-	secretCount := 0
-	if err == nil {
-		secretCount = len(secrets.Items)
+	for name, entry := range report.entries {
+		r[name] = entry
 	}
-
-	return map[string]interface{}{
-		"name":        namespace.Name,
-		"status":      string(namespace.Status.Phase),
-		"created":     namespace.CreationTimestamp.Time,
-		"labels":      namespace.Labels,
-		"annotations": namespace.Annotations,
-		"resources": map[string]int{
-			"pods":        podCount,
-			"services":    serviceCount,
-			"configmaps":  configMapCount,
-			"secrets":     secretCount,
-		},
-	}
-}
\ No newline at end of file
+	for _, name := range report.removed {
+		delete(r, name)
+	}
+}
@@ -0,0 +1,196 @@
+package agent
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/kart/k8s-agent/collect-agent/internal/types"
+)
+
+// newTestMetricsCollector returns a metrics collector whose informer caches
+// hold the objects of clientset
+func newTestMetricsCollector(tb testing.TB, clientset kubernetes.Interface) (*MetricsCollector, chan *types.Metrics) {
+	tb.Helper()
+
+	informers := newSharedInformers(clientset)
+	metricsChan := make(chan *types.Metrics, 10)
+	collector := NewMetricsCollector(clientset, informers, "test-cluster", metricsChan, zap.NewNop())
+
+	stopCh := make(chan struct{})
+	informers.Start(stopCh)
+	tb.Cleanup(func() {
+		close(stopCh)
+		informers.Shutdown()
+	})
+
+	waitFor(tb, "metrics collector sync", collector.HasSynced)
+	return collector, metricsChan
+}
+
+// waitFor waits for condition to hold, failing after 5 seconds
+func waitFor(tb testing.TB, what string, condition func() bool) {
+	tb.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			tb.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// collectTestMetrics collects and returns one report
+func collectTestMetrics(t *testing.T, collector *MetricsCollector, metricsChan chan *types.Metrics) *types.Metrics {
+	t.Helper()
+
+	collector.collectAndSendMetrics()
+	select {
+	case metrics := <-metricsChan:
+		return metrics
+	default:
+		t.Fatal("no metrics collected")
+		return nil
+	}
+}
+
+func TestMetricsCollectorDeltas(t *testing.T) {
+	clientset := fake.NewClientset(
+		devNamespaceObject(devNamespace, "ns-uid"),
+		devNode("node-1", true, false),
+		devNode("node-2", true, false),
+		devPod("web-1", "node-1", corev1.PodRunning, 0, ""),
+	)
+	collector, metricsChan := newTestMetricsCollector(t, clientset)
+	collector.SetFullSnapshotInterval(time.Hour)
+
+	metrics := collectTestMetrics(t, collector, metricsChan)
+	if metrics.Snapshot != types.MetricsSnapshotFull {
+		t.Fatalf("first report = %v, want a full snapshot", metrics.Snapshot)
+	}
+	if nodes := metrics.Data["node_details"].(map[string]interface{}); len(nodes) != 2 {
+		t.Errorf("node_details = %v entries, want 2", len(nodes))
+	}
+	if _, ok := metrics.Data["cluster"]; !ok {
+		t.Error("full snapshot without the cluster version")
+	}
+
+	// An unchanged cluster is reported from the caches without any API call
+	clientset.ClearActions()
+	metrics = collectTestMetrics(t, collector, metricsChan)
+	if metrics.Snapshot != types.MetricsSnapshotDelta {
+		t.Fatalf("second report = %v, want a delta", metrics.Snapshot)
+	}
+	if nodes := metrics.Data["node_details"].(map[string]interface{}); len(nodes) != 0 {
+		t.Errorf("delta node_details = %v, want none", nodes)
+	}
+	if namespaces := metrics.Data["namespaces"].(map[string]interface{}); len(namespaces) != 0 {
+		t.Errorf("delta namespaces = %v, want none", namespaces)
+	}
+	if _, ok := metrics.Data["cluster"]; ok {
+		t.Error("delta carries the cluster version")
+	}
+	if actions := clientset.Actions(); len(actions) != 0 {
+		t.Errorf("delta made %d API calls, want none", len(actions))
+	}
+
+	// Changes that leave the reported entries as they were are not reported
+	ctx := context.Background()
+	pod, err := clientset.CoreV1().Pods(devNamespace).Get(ctx, "web-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Get pod failed: %v", err)
+	}
+	pod.Labels = map[string]string{"app": "web"}
+	pod.ResourceVersion = "2"
+	if _, err := clientset.CoreV1().Pods(devNamespace).Update(ctx, pod, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Update pod failed: %v", err)
+	}
+	waitFor(t, "the pod update", func() bool {
+		cached, err := collector.pods.Pods(devNamespace).Get("web-1")
+		return err == nil && cached.Labels["app"] == "web"
+	})
+	metrics = collectTestMetrics(t, collector, metricsChan)
+	if namespaces := metrics.Data["namespaces"].(map[string]interface{}); len(namespaces) != 0 {
+		t.Errorf("delta namespaces = %v after a label change, want none", namespaces)
+	}
+
+	// New objects update their namespace, deleted nodes are removed
+	if _, err := clientset.CoreV1().Pods(devNamespace).Create(ctx, devPod("web-2", "node-1", corev1.PodPending, 0, ""), metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Create pod failed: %v", err)
+	}
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "settings", Namespace: devNamespace},
+		Data:       map[string]string{"key": "value"},
+	}
+	if _, err := clientset.CoreV1().ConfigMaps(devNamespace).Create(ctx, configMap, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Create configmap failed: %v", err)
+	}
+	if err := clientset.CoreV1().Nodes().Delete(ctx, "node-2", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("Delete node failed: %v", err)
+	}
+	waitFor(t, "the new objects", func() bool {
+		resources := collector.stats.namespaceResources(devNamespace)
+		nodes, _ := collector.nodes.List(labels.Everything())
+		return resources["pods"] == 2 && resources["configmaps"] == 1 && len(nodes) == 1
+	})
+
+	metrics = collectTestMetrics(t, collector, metricsChan)
+	namespaces := metrics.Data["namespaces"].(map[string]interface{})
+	namespace, ok := namespaces[devNamespace].(map[string]interface{})
+	if !ok || len(namespaces) != 1 {
+		t.Fatalf("delta namespaces = %v, want only %v", namespaces, devNamespace)
+	}
+	if resources := namespace["resources"].(map[string]int); resources["pods"] != 2 || resources["configmaps"] != 1 {
+		t.Errorf("namespace resources = %v, want 2 pods and 1 configmap", resources)
+	}
+	if removed := metrics.Removed["node_details"]; len(removed) != 1 || removed[0] != "node-2" {
+		t.Errorf("Removed = %v, want node_details [node-2]", metrics.Removed)
+	}
+	summary := metrics.Data["nodes"].(map[string]interface{})
+	if summary["total"] != 1 || summary["ready"] != 1 {
+		t.Errorf("node summary = %v, want 1 ready node", summary)
+	}
+	if pods := metrics.Data["pods"].(map[string]interface{}); pods["total"] != 2 {
+		t.Errorf("pod summary = %v, want 2 pods", pods)
+	}
+}
+
+func TestMetricsCollectorDroppedDelta(t *testing.T) {
+	clientset := fake.NewClientset(devNamespaceObject(devNamespace, "ns-uid"))
+	collector, metricsChan := newTestMetricsCollector(t, clientset)
+	collector.SetFullSnapshotInterval(time.Hour)
+	collectTestMetrics(t, collector, metricsChan)
+
+	ctx := context.Background()
+	if _, err := clientset.CoreV1().Pods(devNamespace).Create(ctx, devPod("web-1", "", corev1.PodPending, 0, ""), metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Create pod failed: %v", err)
+	}
+	waitFor(t, "the new pod", func() bool {
+		return collector.stats.namespaceResources(devNamespace)["pods"] == 1
+	})
+
+	// A delta dropped on a full channel is reported with the next one
+	for len(metricsChan) < cap(metricsChan) {
+		metricsChan <- &types.Metrics{}
+	}
+	collector.collectAndSendMetrics()
+	if collector.Dropped() != 1 {
+		t.Fatalf("Dropped = %v, want 1", collector.Dropped())
+	}
+	for len(metricsChan) > 0 {
+		<-metricsChan
+	}
+
+	metrics := collectTestMetrics(t, collector, metricsChan)
+	if _, ok := metrics.Data["namespaces"].(map[string]interface{})[devNamespace]; !ok {
+		t.Errorf("namespaces = %v, want the change of the dropped delta", metrics.Data["namespaces"])
+	}
+}
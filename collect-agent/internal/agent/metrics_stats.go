@@ -0,0 +1,314 @@
+package agent
+
+import (
+	"sort"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/tools/cache"
+)
+
+// nodeStats are the node counts and capacity of the cluster summary
+type nodeStats struct {
+	total            int
+	ready            int
+	notReady         int
+	schedulable      int
+	cpuMillis        int64
+	memory           int64
+	pods             int64
+	ephemeralStorage int64
+}
+
+// nodeStatsOf returns the contribution of a node to the cluster summary
+func nodeStatsOf(node *corev1.Node) nodeStats {
+	stats := nodeStats{total: 1}
+
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == corev1.NodeReady {
+			if condition.Status == corev1.ConditionTrue {
+				stats.ready = 1
+			} else {
+				stats.notReady = 1
+			}
+			break
+		}
+	}
+
+	if !node.Spec.Unschedulable {
+		stats.schedulable = 1
+	}
+
+	if cpu := node.Status.Capacity.Cpu(); cpu != nil {
+		stats.cpuMillis = cpu.MilliValue()
+	}
+	if memory := node.Status.Capacity.Memory(); memory != nil {
+		stats.memory = memory.Value()
+	}
+	if pods := node.Status.Capacity.Pods(); pods != nil {
+		stats.pods = pods.Value()
+	}
+	if storage := node.Status.Capacity.StorageEphemeral(); storage != nil {
+		stats.ephemeralStorage = storage.Value()
+	}
+	return stats
+}
+
+// add adds other to s, or subtracts it when sign is negative
+func (s *nodeStats) add(other nodeStats, sign int) {
+	s.total += sign * other.total
+	s.ready += sign * other.ready
+	s.notReady += sign * other.notReady
+	s.schedulable += sign * other.schedulable
+	s.cpuMillis += int64(sign) * other.cpuMillis
+	s.memory += int64(sign) * other.memory
+	s.pods += int64(sign) * other.pods
+	s.ephemeralStorage += int64(sign) * other.ephemeralStorage
+}
+
+// namespaceCounts are the objects counted in a namespace
+type namespaceCounts struct {
+	pods       int
+	services   int
+	configMaps int
+	secrets    int
+}
+
+// empty reports whether no object is counted
+func (c *namespaceCounts) empty() bool {
+	return c.pods == 0 && c.services == 0 && c.configMaps == 0 && c.secrets == 0
+}
+
+// clusterStats are the cluster statistics kept up to date by the informer
+// handlers, so that reporting them needs no API call. An update subtracts the
+// contribution of the old object and adds that of the new one. The nodes and
+// namespaces touched since the last report are tracked, so that deltas only
+// rebuild those.
+type clusterStats struct {
+	mu sync.Mutex
+
+	nodes       nodeStats
+	pods        int
+	podPhases   map[string]int
+	podRestarts int
+	namespaces  map[string]*namespaceCounts
+
+	changedNodes      map[string]bool
+	changedNamespaces map[string]bool
+}
+
+// newClusterStats creates empty cluster statistics
+func newClusterStats() *clusterStats {
+	return &clusterStats{
+		podPhases:         make(map[string]int),
+		namespaces:        make(map[string]*namespaceCounts),
+		changedNodes:      make(map[string]bool),
+		changedNamespaces: make(map[string]bool),
+	}
+}
+
+// handler returns the informer handler applying the objects of a resource
+// with apply, which adds an object or subtracts it when sign is negative
+func (s *clusterStats) handler(apply func(obj interface{}, sign int), onChange func()) cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			apply(obj, 1)
+			onChange()
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			apply(oldObj, -1)
+			apply(newObj, 1)
+			onChange()
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			apply(obj, -1)
+			onChange()
+		},
+	}
+}
+
+// applyNode adds or subtracts a node
+func (s *clusterStats) applyNode(obj interface{}, sign int) {
+	node, ok := obj.(*corev1.Node)
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nodes.add(nodeStatsOf(node), sign)
+	s.changedNodes[node.Name] = true
+}
+
+// applyPod adds or subtracts a pod
+func (s *clusterStats) applyPod(obj interface{}, sign int) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return
+	}
+
+	restarts := 0
+	for _, status := range pod.Status.ContainerStatuses {
+		restarts += int(status.RestartCount)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pods += sign
+	s.podRestarts += sign * restarts
+
+	phase := string(pod.Status.Phase)
+	s.podPhases[phase] += sign
+	if s.podPhases[phase] == 0 {
+		delete(s.podPhases, phase)
+	}
+
+	s.countLocked(pod.Namespace, sign, func(c *namespaceCounts) *int { return &c.pods })
+}
+
+// applyNamespace marks a namespace as changed; its objects are counted by
+// the handlers of their own resources
+func (s *clusterStats) applyNamespace(obj interface{}, _ int) {
+	namespace, ok := obj.(*corev1.Namespace)
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.changedNamespaces[namespace.Name] = true
+}
+
+// counter returns the apply function counting the objects of a namespaced
+// resource in the field of the namespace counts returned by field
+func (s *clusterStats) counter(field func(*namespaceCounts) *int) func(obj interface{}, sign int) {
+	return func(obj interface{}, sign int) {
+		accessor, err := meta.Accessor(obj)
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		s.countLocked(accessor.GetNamespace(), sign, field)
+	}
+}
+
+// countLocked adds sign to a count of a namespace and marks it as changed.
+// Counts are dropped once a namespace holds no counted object.
+func (s *clusterStats) countLocked(namespace string, sign int, field func(*namespaceCounts) *int) {
+	counts := s.namespaces[namespace]
+	if counts == nil {
+		counts = &namespaceCounts{}
+		s.namespaces[namespace] = counts
+	}
+	*field(counts) += sign
+	if counts.empty() {
+		delete(s.namespaces, namespace)
+	}
+	s.changedNamespaces[namespace] = true
+}
+
+// nodeSummary returns the node counts and capacity of the cluster
+func (s *clusterStats) nodeSummary() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return map[string]interface{}{
+		"total":       s.nodes.total,
+		"ready":       s.nodes.ready,
+		"not_ready":   s.nodes.notReady,
+		"schedulable": s.nodes.schedulable,
+		"capacity": map[string]int64{
+			"cpu_cores":         s.nodes.cpuMillis / 1000,
+			"memory_bytes":      s.nodes.memory,
+			"pods":              s.nodes.pods,
+			"ephemeral_storage": s.nodes.ephemeralStorage,
+		},
+	}
+}
+
+// podSummary returns the pod counts of the cluster
+func (s *clusterStats) podSummary() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	phases := make(map[string]int, len(s.podPhases))
+	for phase, count := range s.podPhases {
+		phases[phase] = count
+	}
+	byNamespace := make(map[string]int, len(s.namespaces))
+	for name, counts := range s.namespaces {
+		if counts.pods > 0 {
+			byNamespace[name] = counts.pods
+		}
+	}
+
+	return map[string]interface{}{
+		"total":          s.pods,
+		"by_phase":       phases,
+		"by_namespace":   byNamespace,
+		"total_restarts": s.podRestarts,
+	}
+}
+
+// namespaceResources returns the objects counted in a namespace
+func (s *clusterStats) namespaceResources(namespace string) map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var counts namespaceCounts
+	if c := s.namespaces[namespace]; c != nil {
+		counts = *c
+	}
+	return map[string]int{
+		"pods":       counts.pods,
+		"services":   counts.services,
+		"configmaps": counts.configMaps,
+		"secrets":    counts.secrets,
+	}
+}
+
+// takeChanges returns the nodes and namespaces changed since the last call
+func (s *clusterStats) takeChanges() (nodes, namespaces []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	nodes = sortedNames(s.changedNodes)
+	namespaces = sortedNames(s.changedNamespaces)
+	s.changedNodes = make(map[string]bool)
+	s.changedNamespaces = make(map[string]bool)
+	return nodes, namespaces
+}
+
+// markChanged marks nodes and namespaces as changed again, for changes that
+// were taken but could not be reported
+func (s *clusterStats) markChanged(nodes, namespaces []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, name := range nodes {
+		s.changedNodes[name] = true
+	}
+	for _, name := range namespaces {
+		s.changedNamespaces[name] = true
+	}
+}
+
+// sortedNames returns the keys of a set in order
+func sortedNames(set map[string]bool) []string {
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
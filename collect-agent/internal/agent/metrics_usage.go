@@ -0,0 +1,315 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	metricsv1beta1 "k8s.io/metrics/pkg/apis/metrics/v1beta1"
+	metricsclient "k8s.io/metrics/pkg/client/clientset/versioned"
+
+	"github.com/kart/k8s-agent/collect-agent/internal/types"
+)
+
+// capabilityMetricsServer is the capability reporting whether metrics.k8s.io
+// served resource usage in the last collection
+const capabilityMetricsServer = "metrics_server"
+
+// States of metrics-server as seen by the last collection
+const (
+	metricsServerUnknown int32 = iota
+	metricsServerAvailable
+	metricsServerUnavailable
+)
+
+// resourceAmounts are an amount of CPU in millicores and of memory in bytes
+type resourceAmounts struct {
+	cpu    int64
+	memory int64
+}
+
+// add adds other to r
+func (r *resourceAmounts) add(other resourceAmounts) {
+	r.cpu += other.cpu
+	r.memory += other.memory
+}
+
+// amountsOf returns the CPU and memory of a resource list
+func amountsOf(list corev1.ResourceList) resourceAmounts {
+	var amounts resourceAmounts
+	if cpu, ok := list[corev1.ResourceCPU]; ok {
+		amounts.cpu = cpu.MilliValue()
+	}
+	if memory, ok := list[corev1.ResourceMemory]; ok {
+		amounts.memory = memory.Value()
+	}
+	return amounts
+}
+
+// resourceUsage is the usage of a pod, namespace, node or the cluster with
+// the requests and limits of the pods counted in it
+type resourceUsage struct {
+	usage    resourceAmounts
+	requests resourceAmounts
+	limits   resourceAmounts
+}
+
+// add adds other to u
+func (u *resourceUsage) add(other resourceUsage) {
+	u.usage.add(other.usage)
+	u.requests.add(other.requests)
+	u.limits.add(other.limits)
+}
+
+// data returns the usage as reported in the metrics payload. Utilization is
+// the usage as a percentage of the requests and limits, and is left out when
+// nothing is requested or limited.
+func (u resourceUsage) data() map[string]interface{} {
+	data := map[string]interface{}{
+		"cpu_usage_millicores":    u.usage.cpu,
+		"memory_usage_bytes":      u.usage.memory,
+		"cpu_requests_millicores": u.requests.cpu,
+		"memory_requests_bytes":   u.requests.memory,
+		"cpu_limits_millicores":   u.limits.cpu,
+		"memory_limits_bytes":     u.limits.memory,
+	}
+	setPercent(data, "cpu_request_utilization", u.usage.cpu, u.requests.cpu)
+	setPercent(data, "memory_request_utilization", u.usage.memory, u.requests.memory)
+	setPercent(data, "cpu_limit_utilization", u.usage.cpu, u.limits.cpu)
+	setPercent(data, "memory_limit_utilization", u.usage.memory, u.limits.memory)
+	return data
+}
+
+// setPercent sets key to value as a percentage of total, rounded to one
+// decimal, unless total is zero
+func setPercent(data map[string]interface{}, key string, value, total int64) {
+	if total <= 0 {
+		return
+	}
+	data[key] = math.Round(float64(value)*1000/float64(total)) / 10
+}
+
+// podSpecResources returns the summed container requests and limits of a
+// pod. A pod limit is only set if every container sets it, since a single
+// unlimited container leaves the pod unlimited.
+func podSpecResources(pod *corev1.Pod) (requests, limits resourceAmounts) {
+	cpuLimited, memoryLimited := len(pod.Spec.Containers) > 0, len(pod.Spec.Containers) > 0
+
+	for _, container := range pod.Spec.Containers {
+		requests.add(amountsOf(container.Resources.Requests))
+
+		containerLimits := amountsOf(container.Resources.Limits)
+		limits.add(containerLimits)
+		cpuLimited = cpuLimited && containerLimits.cpu > 0
+		memoryLimited = memoryLimited && containerLimits.memory > 0
+	}
+	requests.add(amountsOf(pod.Spec.Overhead))
+
+	if !cpuLimited {
+		limits.cpu = 0
+	}
+	if !memoryLimited {
+		limits.memory = 0
+	}
+	return requests, limits
+}
+
+// podTerminated reports whether a pod no longer holds resources on its node
+func podTerminated(pod *corev1.Pod) bool {
+	return pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed
+}
+
+// computeUsage combines the usage reported by metrics-server with the
+// requests and limits of the pods and the allocatable resources of the nodes
+func computeUsage(nodes []*corev1.Node, pods []*corev1.Pod, nodeMetrics []metricsv1beta1.NodeMetrics, podMetrics []metricsv1beta1.PodMetrics) map[string]interface{} {
+	podUsage := make(map[string]resourceAmounts, len(podMetrics))
+	for i := range podMetrics {
+		var usage resourceAmounts
+		for _, container := range podMetrics[i].Containers {
+			usage.add(amountsOf(container.Usage))
+		}
+		podUsage[podMetrics[i].Namespace+"/"+podMetrics[i].Name] = usage
+	}
+
+	// Requests count against the node a pod is scheduled to, usage against
+	// the pod and its namespace
+	nodeRequests := make(map[string]resourceUsage)
+	namespaces := make(map[string]*resourceUsage)
+	podData := make(map[string]interface{})
+
+	for _, pod := range pods {
+		if podTerminated(pod) {
+			continue
+		}
+
+		var usage resourceUsage
+		usage.requests, usage.limits = podSpecResources(pod)
+
+		if pod.Spec.NodeName != "" {
+			node := nodeRequests[pod.Spec.NodeName]
+			node.requests.add(usage.requests)
+			node.limits.add(usage.limits)
+			nodeRequests[pod.Spec.NodeName] = node
+		}
+
+		key := pod.Namespace + "/" + pod.Name
+		measured, ok := podUsage[key]
+		if !ok {
+			continue
+		}
+		usage.usage = measured
+		podData[key] = usage.data()
+
+		namespace := namespaces[pod.Namespace]
+		if namespace == nil {
+			namespace = &resourceUsage{}
+			namespaces[pod.Namespace] = namespace
+		}
+		namespace.add(usage)
+	}
+
+	nodeUsage := make(map[string]resourceAmounts, len(nodeMetrics))
+	for i := range nodeMetrics {
+		nodeUsage[nodeMetrics[i].Name] = amountsOf(nodeMetrics[i].Usage)
+	}
+
+	// The cluster is measured by its nodes, whose usage includes system
+	// overhead outside of pods
+	nodeData := make(map[string]interface{})
+	var cluster resourceUsage
+	var clusterAllocatable resourceAmounts
+	for _, node := range nodes {
+		usage, ok := nodeUsage[node.Name]
+		if !ok {
+			continue
+		}
+
+		allocatable := amountsOf(node.Status.Allocatable)
+		resources := nodeRequests[node.Name]
+		resources.usage = usage
+		nodeData[node.Name] = allocatableData(resources, allocatable)
+
+		cluster.add(resources)
+		clusterAllocatable.add(allocatable)
+	}
+
+	namespaceData := make(map[string]interface{}, len(namespaces))
+	for name, usage := range namespaces {
+		namespaceData[name] = usage.data()
+	}
+
+	return map[string]interface{}{
+		"cluster":    allocatableData(cluster, clusterAllocatable),
+		"nodes":      nodeData,
+		"namespaces": namespaceData,
+		"pods":       podData,
+	}
+}
+
+// allocatableData returns the usage data of a node or the cluster, adding the
+// allocatable resources and the usage as a percentage of them
+func allocatableData(usage resourceUsage, allocatable resourceAmounts) map[string]interface{} {
+	data := usage.data()
+	data["cpu_allocatable_millicores"] = allocatable.cpu
+	data["memory_allocatable_bytes"] = allocatable.memory
+	setPercent(data, "cpu_utilization", usage.usage.cpu, allocatable.cpu)
+	setPercent(data, "memory_utilization", usage.usage.memory, allocatable.memory)
+	return data
+}
+
+// collectUsageMetrics collects node and pod resource usage from metrics-server.
+// Usage changes all the time, so every report carries that of the cluster,
+// nodes and namespaces; the usage of each pod is left to full snapshots.
+// Clusters without metrics-server only lose the usage: the capability is
+// reported as unavailable with the reason, and the collector stays healthy.
+func (mc *MetricsCollector) collectUsageMetrics(metrics *types.Metrics, full bool) error {
+	if mc.metricsClient == nil {
+		mc.setMetricsServer(metrics, fmt.Errorf("no metrics.k8s.io client configured"))
+		return nil
+	}
+
+	ctx := context.Background()
+
+	nodeMetrics, err := mc.metricsClient.MetricsV1beta1().NodeMetricses().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		mc.setMetricsServer(metrics, fmt.Errorf("failed to list node metrics: %w", err))
+		return nil
+	}
+
+	podMetrics, err := mc.metricsClient.MetricsV1beta1().PodMetricses(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		mc.setMetricsServer(metrics, fmt.Errorf("failed to list pod metrics: %w", err))
+		return nil
+	}
+	mc.setMetricsServer(metrics, nil)
+
+	// Requests, limits and allocatable resources come from the informer caches
+	nodes, err := mc.nodes.List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("failed to list cached nodes: %w", err)
+	}
+	pods, err := mc.pods.List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("failed to list cached pods: %w", err)
+	}
+
+	usage := computeUsage(nodes, pods, nodeMetrics.Items, podMetrics.Items)
+	if !full {
+		delete(usage, "pods")
+	}
+	metrics.Data["usage"] = usage
+	return nil
+}
+
+// setMetricsServer records whether metrics-server answered, logging changes,
+// and reports the capability in the metrics payload
+func (mc *MetricsCollector) setMetricsServer(metrics *types.Metrics, err error) {
+	available := err == nil
+	capabilities := capabilities(metrics)
+	capabilities[capabilityMetricsServer] = available
+	if err != nil {
+		capabilities[capabilityMetricsServer+"_error"] = err.Error()
+	}
+
+	state := metricsServerUnavailable
+	if available {
+		state = metricsServerAvailable
+	}
+	if mc.metricsServerState.Swap(state) == state {
+		return
+	}
+	if available {
+		mc.logger.Info("Metrics server available, reporting resource usage")
+	} else {
+		mc.logger.Warn("Metrics server unavailable, resource usage not reported", zap.Error(err))
+	}
+}
+
+// capabilities returns the capabilities section of the metrics payload
+func capabilities(metrics *types.Metrics) map[string]interface{} {
+	section, ok := metrics.Data["capabilities"].(map[string]interface{})
+	if !ok {
+		section = make(map[string]interface{})
+		metrics.Data["capabilities"] = section
+	}
+	return section
+}
+
+// Capabilities returns the optional cluster features the collector found.
+// Kubelet stats are only reported when enabled.
+func (mc *MetricsCollector) Capabilities() map[string]bool {
+	found := map[string]bool{capabilityMetricsServer: mc.metricsServerState.Load() == metricsServerAvailable}
+	if mc.kubelet != nil {
+		found[capabilityKubeletStats] = mc.kubelet.state.Load() == metricsServerAvailable
+	}
+	return found
+}
+
+// SetMetricsClient sets the metrics.k8s.io client used to collect resource usage
+func (mc *MetricsCollector) SetMetricsClient(client metricsclient.Interface) {
+	mc.metricsClient = client
+}
@@ -0,0 +1,129 @@
+package agent
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8stesting "k8s.io/client-go/testing"
+	metricsv1beta1 "k8s.io/metrics/pkg/apis/metrics/v1beta1"
+	metricsfake "k8s.io/metrics/pkg/client/clientset/versioned/fake"
+)
+
+// testResources builds a resource list of CPU and memory
+func testResources(cpu, memory string) corev1.ResourceList {
+	list := corev1.ResourceList{}
+	if cpu != "" {
+		list[corev1.ResourceCPU] = resource.MustParse(cpu)
+	}
+	if memory != "" {
+		list[corev1.ResourceMemory] = resource.MustParse(memory)
+	}
+	return list
+}
+
+// testUsagePod builds a single-container pod on node-1
+func testUsagePod(name string, phase corev1.PodPhase, requests, limits corev1.ResourceList) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "demo"},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+			Containers: []corev1.Container{{
+				Name:      "main",
+				Resources: corev1.ResourceRequirements{Requests: requests, Limits: limits},
+			}},
+		},
+		Status: corev1.PodStatus{Phase: phase},
+	}
+}
+
+// testPodMetrics builds the metrics of a single-container pod
+func testPodMetrics(name string, usage corev1.ResourceList) metricsv1beta1.PodMetrics {
+	return metricsv1beta1.PodMetrics{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "demo"},
+		Containers: []metricsv1beta1.ContainerMetrics{{Name: "main", Usage: usage}},
+	}
+}
+
+func TestComputeUsage(t *testing.T) {
+	nodes := []*corev1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}, Status: corev1.NodeStatus{Allocatable: testResources("4", "16Gi")}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-2"}, Status: corev1.NodeStatus{Allocatable: testResources("4", "16Gi")}},
+	}
+	pods := []*corev1.Pod{
+		testUsagePod("limited", corev1.PodRunning, testResources("500m", "512Mi"), testResources("1", "1Gi")),
+		testUsagePod("unlimited", corev1.PodRunning, testResources("250m", ""), nil),
+		testUsagePod("done", corev1.PodSucceeded, testResources("2", "8Gi"), nil),
+	}
+	nodeMetrics := []metricsv1beta1.NodeMetrics{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}, Usage: testResources("1", "4Gi")},
+	}
+	podMetrics := []metricsv1beta1.PodMetrics{
+		testPodMetrics("limited", testResources("250m", "512Mi")),
+		testPodMetrics("unlimited", testResources("100m", "128Mi")),
+	}
+
+	usage := computeUsage(nodes, pods, nodeMetrics, podMetrics)
+
+	podData := usage["pods"].(map[string]interface{})
+	limited := podData["demo/limited"].(map[string]interface{})
+	if limited["cpu_request_utilization"] != 50.0 || limited["memory_limit_utilization"] != 50.0 {
+		t.Errorf("limited pod = %v, want 50%% of the CPU request and memory limit", limited)
+	}
+	unlimited := podData["demo/unlimited"].(map[string]interface{})
+	if _, ok := unlimited["cpu_limit_utilization"]; ok {
+		t.Errorf("unlimited pod = %v, want no limit utilization", unlimited)
+	}
+	if _, ok := podData["demo/done"]; ok {
+		t.Error("terminated pod reported")
+	}
+
+	nodeData := usage["nodes"].(map[string]interface{})
+	if len(nodeData) != 1 {
+		t.Fatalf("nodes = %v, want only the measured node", nodeData)
+	}
+	node := nodeData["node-1"].(map[string]interface{})
+	if node["cpu_requests_millicores"] != int64(750) || node["cpu_utilization"] != 25.0 {
+		t.Errorf("node = %v, want 750m requested and 25%% CPU utilization", node)
+	}
+
+	namespace := usage["namespaces"].(map[string]interface{})["demo"].(map[string]interface{})
+	if namespace["cpu_usage_millicores"] != int64(350) {
+		t.Errorf("namespace CPU usage = %v, want 350", namespace["cpu_usage_millicores"])
+	}
+
+	cluster := usage["cluster"].(map[string]interface{})
+	if cluster["cpu_allocatable_millicores"] != int64(4000) || cluster["memory_utilization"] != 25.0 {
+		t.Errorf("cluster = %v, want the allocatable and utilization of the measured node", cluster)
+	}
+}
+
+func TestMetricsServerUnavailable(t *testing.T) {
+	metricsClient := metricsfake.NewSimpleClientset()
+	metricsClient.PrependReactor("list", "*", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewNotFound(schema.GroupResource{Group: "metrics.k8s.io", Resource: "nodes"}, "")
+	})
+
+	collector, metricsChan := newTestMetricsCollector(t, newDevClientset())
+	collector.SetMetricsClient(metricsClient)
+	collector.collectAndSendMetrics()
+
+	metrics := <-metricsChan
+	if _, ok := metrics.Data["usage"]; ok {
+		t.Error("usage reported without metrics-server")
+	}
+	capabilities := metrics.Data["capabilities"].(map[string]interface{})
+	if capabilities[capabilityMetricsServer] != false || capabilities[capabilityMetricsServer+"_error"] == nil {
+		t.Errorf("capabilities = %v, want metrics_server false with the error", capabilities)
+	}
+	if collector.Capabilities()[capabilityMetricsServer] {
+		t.Error("Capabilities reports metrics-server as available")
+	}
+	if !collector.Health().Healthy {
+		t.Error("collector unhealthy without metrics-server")
+	}
+}
@@ -0,0 +1,506 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+
+	"github.com/kart-io/k8s-agent/protocol"
+
+	"github.com/kart/k8s-agent/collect-agent/internal/remediation"
+	"github.com/kart/k8s-agent/collect-agent/internal/types"
+)
+
+// remediationFieldManager owns the fields remediations set
+const remediationFieldManager = "aetherius-agent"
+
+// restartedAtAnnotation is set on pod templates to restart them, as by
+// kubectl rollout restart
+const restartedAtAnnotation = "kubectl.kubernetes.io/restartedAt"
+
+// errRemediationDisabled is returned for remediations on agents without a policy
+var errRemediationDisabled = errors.New("remediation is disabled on this agent")
+
+// executeRemediation runs a remediation command once the local policy allows
+// it, setting the result data to a report with the object as it was before,
+// and the remediation undoing the change when there is one. Refusals and
+// errors of the API fail the command without making the executor unhealthy;
+// a policy file that cannot be read does.
+func (ce *CommandExecutor) executeRemediation(ctx context.Context, cmd types.Command, result *types.CommandResult) {
+	rule, err := ce.checkRemediationPolicy(cmd)
+	if err != nil {
+		result.Status = protocol.CommandStatusFailed
+		result.Error = fmt.Sprintf("Remediation refused: %v", err)
+		ce.logger.Warn("Remediation refused",
+			zap.String("command_id", cmd.ID),
+			zap.String("action", cmd.Action),
+			zap.Error(err))
+		return
+	}
+
+	timeout := cmd.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	execCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	dryRun, _ := strconv.ParseBool(cmd.Params[protocol.CommandParamDryRun])
+	report, text, err := ce.runRemediation(execCtx, cmd.Action, cmd.Params, dryRun)
+	if err != nil {
+		if execCtx.Err() == context.DeadlineExceeded {
+			result.Status = protocol.CommandStatusTimeout
+			result.Error = "Command execution timed out"
+		} else {
+			result.Status = protocol.CommandStatusFailed
+			result.Error = err.Error()
+			result.ExitCode = kubectlExitCode(1)
+		}
+		return
+	}
+	report.Action = cmd.Action
+	report.DryRun = dryRun
+	report.Rule = rule
+
+	encoded, err := json.Marshal(report)
+	if err != nil {
+		result.Status = protocol.CommandStatusFailed
+		result.Error = fmt.Sprintf("failed to encode remediation report: %v", err)
+		return
+	}
+	if dryRun {
+		text = strings.TrimSuffix(text, "\n") + " (server dry run)\n"
+	}
+	streamText(cmd.ID, protocol.OutputStreamStdout, text, ce.outputPublisherFor(cmd), result)
+	result.ExitCode = kubectlExitCode(0)
+	result.Data = encoded
+
+	ce.logger.Info("Remediation applied",
+		zap.String("command_id", cmd.ID),
+		zap.String("action", cmd.Action),
+		zap.String("kind", report.Target.Kind),
+		zap.String("namespace", report.Target.Namespace),
+		zap.String("name", report.Target.Name),
+		zap.Bool("dry_run", dryRun),
+		zap.Bool("changed", report.Changed),
+		zap.String("rule", rule))
+}
+
+// checkRemediationPolicy returns the policy rule allowing a remediation
+func (ce *CommandExecutor) checkRemediationPolicy(cmd types.Command) (string, error) {
+	ce.mu.RLock()
+	file := ce.remediationPolicy
+	ce.mu.RUnlock()
+	if file == "" {
+		return "", errRemediationDisabled
+	}
+
+	policy, err := remediation.Load(file)
+	if err != nil {
+		ce.health.recordError(err)
+		return "", err
+	}
+	ce.health.recordSuccess()
+
+	req := remediation.Request{Action: cmd.Action, Namespace: cmd.Params[protocol.CommandParamNamespace]}
+	if cmd.Action == protocol.RemediationScale {
+		req.Replicas, _ = strconv.Atoi(cmd.Params[protocol.CommandParamReplicas])
+	}
+	return policy.Allow(req)
+}
+
+// runRemediation makes the change of a remediation, or has the API server
+// check it when dryRun is set, and returns its report and text output
+func (ce *CommandExecutor) runRemediation(ctx context.Context, action string, params map[string]string, dryRun bool) (*protocol.RemediationReport, string, error) {
+	var opts []string
+	if dryRun {
+		opts = []string{metav1.DryRunAll}
+	}
+
+	switch action {
+	case protocol.RemediationRolloutRestart:
+		return ce.rolloutRestart(ctx, params, opts)
+	case protocol.RemediationScale:
+		return ce.scaleWorkload(ctx, params, opts)
+	case protocol.RemediationDeletePod:
+		return ce.deletePod(ctx, params, opts)
+	case protocol.RemediationCordon:
+		return ce.setUnschedulable(ctx, params, true, opts)
+	case protocol.RemediationUncordon:
+		return ce.setUnschedulable(ctx, params, false, opts)
+	case protocol.RemediationPatchResources:
+		return ce.patchResources(ctx, params, opts)
+	default:
+		return nil, "", fmt.Errorf("remediation action '%s' is not supported", action)
+	}
+}
+
+// rolloutRestart restarts the pods of a workload by annotating its template
+func (ce *CommandExecutor) rolloutRestart(ctx context.Context, params map[string]string, dryRun []string) (*protocol.RemediationReport, string, error) {
+	w, err := ce.getWorkload(ctx, params)
+	if err != nil {
+		return nil, "", err
+	}
+	report, err := w.report()
+	if err != nil {
+		return nil, "", err
+	}
+
+	patch, _ := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"annotations": map[string]string{restartedAtAnnotation: time.Now().Format(time.RFC3339)},
+				},
+			},
+		},
+	})
+	if err := ce.patchWorkload(ctx, w, k8stypes.StrategicMergePatchType, patch, dryRun); err != nil {
+		return nil, "", err
+	}
+
+	report.Changed = true
+	return report, fmt.Sprintf("%s/%s restarted\n", w.resource, w.name), nil
+}
+
+// scaleWorkload sets the replicas of a deployment or statefulset
+func (ce *CommandExecutor) scaleWorkload(ctx context.Context, params map[string]string, dryRun []string) (*protocol.RemediationReport, string, error) {
+	w, err := ce.getWorkload(ctx, params)
+	if err != nil {
+		return nil, "", err
+	}
+	report, err := w.report()
+	if err != nil {
+		return nil, "", err
+	}
+
+	replicas, _ := strconv.Atoi(params[protocol.CommandParamReplicas])
+	previous := 1
+	if w.replicas != nil {
+		previous = int(*w.replicas)
+	}
+	if replicas == previous {
+		return report, fmt.Sprintf("%s/%s already has %d replicas\n", w.resource, w.name, replicas), nil
+	}
+
+	patch, _ := json.Marshal(map[string]interface{}{"spec": map[string]int{"replicas": replicas}})
+	if err := ce.patchWorkload(ctx, w, k8stypes.MergePatchType, patch, dryRun); err != nil {
+		return nil, "", err
+	}
+
+	report.Changed = true
+	report.Rollback = &protocol.RemediationRollback{
+		Action: protocol.RemediationScale,
+		Params: w.params(map[string]string{protocol.CommandParamReplicas: strconv.Itoa(previous)}),
+	}
+	return report, fmt.Sprintf("%s/%s scaled from %d to %d replicas\n", w.resource, w.name, previous, replicas), nil
+}
+
+// deletePod deletes a pod, for its controller to replace
+func (ce *CommandExecutor) deletePod(ctx context.Context, params map[string]string, dryRun []string) (*protocol.RemediationReport, string, error) {
+	namespace, name := params[protocol.CommandParamNamespace], params[protocol.CommandParamName]
+	pods := ce.clientset.CoreV1().Pods(namespace)
+
+	pod, err := pods.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, "", err
+	}
+	snapshot, err := objectSnapshot(pod, "v1", "Pod")
+	if err != nil {
+		return nil, "", err
+	}
+
+	opts := metav1.DeleteOptions{DryRun: dryRun, Preconditions: &metav1.Preconditions{UID: &pod.UID}}
+	if value := params[protocol.CommandParamGracePeriod]; value != "" {
+		seconds, _ := strconv.ParseInt(value, 10, 64)
+		opts.GracePeriodSeconds = &seconds
+	}
+	if err := pods.Delete(ctx, name, opts); err != nil {
+		return nil, "", err
+	}
+
+	return &protocol.RemediationReport{
+		Target:   protocol.RemediationTarget{Kind: "Pod", Namespace: namespace, Name: name},
+		Changed:  true,
+		Snapshot: snapshot,
+	}, fmt.Sprintf("pod \"%s\" deleted\n", name), nil
+}
+
+// setUnschedulable cordons or uncordons a node
+func (ce *CommandExecutor) setUnschedulable(ctx context.Context, params map[string]string, unschedulable bool, dryRun []string) (*protocol.RemediationReport, string, error) {
+	name := params[protocol.CommandParamName]
+	nodes := ce.clientset.CoreV1().Nodes()
+
+	node, err := nodes.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, "", err
+	}
+	snapshot, err := objectSnapshot(node, "v1", "Node")
+	if err != nil {
+		return nil, "", err
+	}
+	report := &protocol.RemediationReport{
+		Target:   protocol.RemediationTarget{Kind: "Node", Name: name},
+		Snapshot: snapshot,
+	}
+
+	done, undo := "cordoned", protocol.RemediationUncordon
+	if !unschedulable {
+		done, undo = "uncordoned", protocol.RemediationCordon
+	}
+	if node.Spec.Unschedulable == unschedulable {
+		return report, fmt.Sprintf("node/%s already %s\n", name, done), nil
+	}
+
+	// Like kubectl uncordon, remove the field rather than set it to false
+	var value interface{}
+	if unschedulable {
+		value = true
+	}
+	patch, _ := json.Marshal(map[string]interface{}{"spec": map[string]interface{}{"unschedulable": value}})
+	opts := metav1.PatchOptions{DryRun: dryRun, FieldManager: remediationFieldManager}
+	if _, err := nodes.Patch(ctx, name, k8stypes.StrategicMergePatchType, patch, opts); err != nil {
+		return nil, "", err
+	}
+
+	report.Changed = true
+	report.Rollback = &protocol.RemediationRollback{
+		Action: undo,
+		Params: map[string]string{protocol.CommandParamName: name},
+	}
+	return report, fmt.Sprintf("node/%s %s\n", name, done), nil
+}
+
+// resourceParams maps the params of patch-resources to the requirements they set
+var resourceParams = []struct {
+	param    string
+	limit    bool
+	resource corev1.ResourceName
+}{
+	{protocol.CommandParamCPULimit, true, corev1.ResourceCPU},
+	{protocol.CommandParamMemoryLimit, true, corev1.ResourceMemory},
+	{protocol.CommandParamCPURequest, false, corev1.ResourceCPU},
+	{protocol.CommandParamMemoryRequest, false, corev1.ResourceMemory},
+}
+
+// patchResources sets the requests and limits of a container of a workload
+func (ce *CommandExecutor) patchResources(ctx context.Context, params map[string]string, dryRun []string) (*protocol.RemediationReport, string, error) {
+	w, err := ce.getWorkload(ctx, params)
+	if err != nil {
+		return nil, "", err
+	}
+	container, err := templateContainer(w.template, params[protocol.CommandParamContainer])
+	if err != nil {
+		return nil, "", err
+	}
+	report, err := w.report()
+	if err != nil {
+		return nil, "", err
+	}
+
+	limits := make(map[string]interface{})
+	requests := make(map[string]interface{})
+	undo := map[string]string{protocol.CommandParamContainer: container.Name}
+	for _, p := range resourceParams {
+		value, ok := params[p.param]
+		if !ok {
+			continue
+		}
+
+		current := container.Resources.Requests
+		patch := requests
+		if p.limit {
+			current, patch = container.Resources.Limits, limits
+		}
+
+		previous := protocol.RemediationQuantityNone
+		if q, ok := current[p.resource]; ok {
+			previous = q.String()
+		}
+		undo[p.param] = previous
+
+		if value == protocol.RemediationQuantityNone {
+			if previous != protocol.RemediationQuantityNone {
+				patch[string(p.resource)] = nil
+			}
+			continue
+		}
+		q, err := resource.ParseQuantity(value)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid %s: %w", p.param, err)
+		}
+		if previous == protocol.RemediationQuantityNone || q.Cmp(current[p.resource]) != 0 {
+			patch[string(p.resource)] = q.String()
+		}
+	}
+
+	if len(limits) == 0 && len(requests) == 0 {
+		return report, fmt.Sprintf("%s/%s resource requirements unchanged\n", w.resource, w.name), nil
+	}
+
+	resources := make(map[string]interface{})
+	if len(limits) > 0 {
+		resources["limits"] = limits
+	}
+	if len(requests) > 0 {
+		resources["requests"] = requests
+	}
+	patch, _ := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"containers": []map[string]interface{}{{"name": container.Name, "resources": resources}},
+				},
+			},
+		},
+	})
+	if err := ce.patchWorkload(ctx, w, k8stypes.StrategicMergePatchType, patch, dryRun); err != nil {
+		return nil, "", err
+	}
+
+	report.Changed = true
+	report.Rollback = &protocol.RemediationRollback{
+		Action: protocol.RemediationPatchResources,
+		Params: w.params(undo),
+	}
+	return report, fmt.Sprintf("%s/%s resource requirements updated\n", w.resource, w.name), nil
+}
+
+// templateContainer returns the named container of a pod template, or its
+// only container when no name is given
+func templateContainer(template *corev1.PodTemplateSpec, name string) (*corev1.Container, error) {
+	containers := template.Spec.Containers
+	if name == "" {
+		if len(containers) == 1 {
+			return &containers[0], nil
+		}
+		names := make([]string, 0, len(containers))
+		for _, c := range containers {
+			names = append(names, c.Name)
+		}
+		return nil, fmt.Errorf("a container must be chosen, one of: %s", strings.Join(names, ", "))
+	}
+
+	for i := range containers {
+		if containers[i].Name == name {
+			return &containers[i], nil
+		}
+	}
+	return nil, fmt.Errorf("container %s not found", name)
+}
+
+// workload is a deployment, statefulset or daemonset changed by a remediation
+type workload struct {
+	object    runtime.Object
+	kind      string // workload kind of the params, e.g. deployment
+	apiKind   string // Kubernetes kind, e.g. Deployment
+	resource  string // type as kubectl prints it, e.g. deployment.apps
+	namespace string
+	name      string
+	replicas  *int32
+	template  *corev1.PodTemplateSpec
+}
+
+// getWorkload reads the workload named by the params of a remediation
+func (ce *CommandExecutor) getWorkload(ctx context.Context, params map[string]string) (*workload, error) {
+	w := &workload{
+		kind:      params[protocol.CommandParamKind],
+		namespace: params[protocol.CommandParamNamespace],
+		name:      params[protocol.CommandParamName],
+	}
+	apps := ce.clientset.AppsV1()
+
+	switch w.kind {
+	case protocol.WorkloadDeployment:
+		d, err := apps.Deployments(w.namespace).Get(ctx, w.name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		w.object, w.apiKind, w.replicas, w.template = d, "Deployment", d.Spec.Replicas, &d.Spec.Template
+	case protocol.WorkloadStatefulSet:
+		s, err := apps.StatefulSets(w.namespace).Get(ctx, w.name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		w.object, w.apiKind, w.replicas, w.template = s, "StatefulSet", s.Spec.Replicas, &s.Spec.Template
+	case protocol.WorkloadDaemonSet:
+		d, err := apps.DaemonSets(w.namespace).Get(ctx, w.name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		w.object, w.apiKind, w.template = d, "DaemonSet", &d.Spec.Template
+	default:
+		return nil, fmt.Errorf("unsupported workload kind %q", w.kind)
+	}
+
+	w.resource = w.kind + ".apps"
+	return w, nil
+}
+
+// patchWorkload patches a workload read by getWorkload
+func (ce *CommandExecutor) patchWorkload(ctx context.Context, w *workload, patchType k8stypes.PatchType, patch []byte, dryRun []string) error {
+	apps := ce.clientset.AppsV1()
+	opts := metav1.PatchOptions{DryRun: dryRun, FieldManager: remediationFieldManager}
+
+	var err error
+	switch w.kind {
+	case protocol.WorkloadDeployment:
+		_, err = apps.Deployments(w.namespace).Patch(ctx, w.name, patchType, patch, opts)
+	case protocol.WorkloadStatefulSet:
+		_, err = apps.StatefulSets(w.namespace).Patch(ctx, w.name, patchType, patch, opts)
+	case protocol.WorkloadDaemonSet:
+		_, err = apps.DaemonSets(w.namespace).Patch(ctx, w.name, patchType, patch, opts)
+	}
+	return err
+}
+
+// report starts the report of a remediation of the workload, with its snapshot
+func (w *workload) report() (*protocol.RemediationReport, error) {
+	snapshot, err := objectSnapshot(w.object, "apps/v1", w.apiKind)
+	if err != nil {
+		return nil, err
+	}
+	return &protocol.RemediationReport{
+		Target:   protocol.RemediationTarget{Kind: w.apiKind, Namespace: w.namespace, Name: w.name},
+		Snapshot: snapshot,
+	}, nil
+}
+
+// params returns the params naming the workload, with extra
+func (w *workload) params(extra map[string]string) map[string]string {
+	params := map[string]string{
+		protocol.CommandParamKind:      w.kind,
+		protocol.CommandParamNamespace: w.namespace,
+		protocol.CommandParamName:      w.name,
+	}
+	for k, v := range extra {
+		params[k] = v
+	}
+	return params
+}
+
+// objectSnapshot returns an object as it would be read from the API, without
+// its managed fields
+func objectSnapshot(obj runtime.Object, apiVersion, kind string) (map[string]interface{}, error) {
+	snapshot, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return nil, fmt.Errorf("failed to snapshot %s: %w", kind, err)
+	}
+	snapshot["apiVersion"] = apiVersion
+	snapshot["kind"] = kind
+	if metadata, ok := snapshot["metadata"].(map[string]interface{}); ok {
+		delete(metadata, "managedFields")
+	}
+	return snapshot, nil
+}
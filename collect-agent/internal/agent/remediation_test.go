@@ -0,0 +1,307 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/kart-io/k8s-agent/protocol"
+
+	"github.com/kart/k8s-agent/collect-agent/internal/types"
+)
+
+const testRemediationPolicy = `
+rules:
+  - name: web
+    actions: ["*"]
+    namespaces: [web]
+    max_replicas: 10
+  - name: nodes
+    actions: [cordon, uncordon]
+`
+
+// newTestRemediationExecutor returns a command executor remediating a web
+// deployment, its pod and a node, under testRemediationPolicy
+func newTestRemediationExecutor(t *testing.T) (*CommandExecutor, *fake.Clientset) {
+	t.Helper()
+
+	replicas := int32(2)
+	clientset := fake.NewSimpleClientset(
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "web"},
+			Spec: appsv1.DeploymentSpec{
+				Replicas: &replicas,
+				Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{Containers: []corev1.Container{{
+					Name:  "app",
+					Image: "nginx",
+					Resources: corev1.ResourceRequirements{
+						Limits: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("500m")},
+					},
+				}}}},
+			},
+		},
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "web-1", Namespace: "web"}},
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "coredns-1", Namespace: "kube-system"}},
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+	)
+
+	file := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(file, []byte(testRemediationPolicy), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	executor := NewCommandExecutor(clientset, "test-cluster", zap.NewNop())
+	executor.SetRemediationPolicy(file)
+	return executor, clientset
+}
+
+// runRemediationCommand executes a remediation and decodes its report
+func runRemediationCommand(t *testing.T, executor *CommandExecutor, action string, params map[string]string) (*types.CommandResult, *protocol.RemediationReport) {
+	t.Helper()
+
+	result := executor.Execute(context.Background(), types.Command{
+		ID:      "cmd-" + action,
+		Type:    protocol.CommandTypeRemediation,
+		Tool:    protocol.RemediationTool,
+		Action:  action,
+		Params:  params,
+		Timeout: 5 * time.Second,
+	})
+	if result.Status != protocol.CommandStatusSuccess {
+		return result, nil
+	}
+
+	var report protocol.RemediationReport
+	if err := json.Unmarshal(result.Data, &report); err != nil {
+		t.Fatalf("%s report is not JSON: %v", action, err)
+	}
+	if result.ExitCode == nil || *result.ExitCode != 0 {
+		t.Errorf("%s exit code = %v, want 0", action, result.ExitCode)
+	}
+	return result, &report
+}
+
+func TestRemediationRefused(t *testing.T) {
+	executor, clientset := newTestRemediationExecutor(t)
+
+	tests := []struct {
+		name    string
+		action  string
+		params  map[string]string
+		wantErr string
+	}{
+		{"namespace not allowed", protocol.RemediationDeletePod,
+			map[string]string{"name": "coredns-1", "namespace": "kube-system"}, "Remediation refused"},
+		{"too many replicas", protocol.RemediationScale,
+			map[string]string{"kind": "deployment", "name": "web", "namespace": "web", "replicas": "11"}, "at most 10 replicas"},
+		{"invalid params", protocol.RemediationScale,
+			map[string]string{"kind": "daemonset", "name": "web", "namespace": "web", "replicas": "3"}, "Command validation failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, _ := runRemediationCommand(t, executor, tt.action, tt.params)
+			if result.Status != protocol.CommandStatusFailed || !strings.Contains(result.Error, tt.wantErr) {
+				t.Errorf("result = %s %q, want failed with %q", result.Status, result.Error, tt.wantErr)
+			}
+		})
+	}
+
+	// Remediations need the remediation type, and other types cannot use the tool
+	result := executor.Execute(context.Background(), types.Command{
+		ID: "cmd-1", Type: "diagnostic", Tool: protocol.RemediationTool,
+		Action: protocol.RemediationCordon, Params: map[string]string{"name": "node-1"},
+	})
+	if result.Status != protocol.CommandStatusFailed || !strings.Contains(result.Error, "cannot run remediation actions") {
+		t.Errorf("diagnostic remediation = %s %q, want failed", result.Status, result.Error)
+	}
+
+	executor.SetRemediationPolicy("")
+	result, _ = runRemediationCommand(t, executor, protocol.RemediationCordon, map[string]string{"name": "node-1"})
+	if result.Status != protocol.CommandStatusFailed || !strings.Contains(result.Error, errRemediationDisabled.Error()) {
+		t.Errorf("remediation without policy = %s %q, want disabled", result.Status, result.Error)
+	}
+
+	for _, action := range clientset.Actions() {
+		if action.GetVerb() != "get" && action.GetVerb() != "list" && action.GetVerb() != "watch" {
+			t.Errorf("refused remediations made a %s of %s", action.GetVerb(), action.GetResource().Resource)
+		}
+	}
+}
+
+func TestRemediationScale(t *testing.T) {
+	executor, clientset := newTestRemediationExecutor(t)
+
+	params := map[string]string{"kind": "deployment", "name": "web", "namespace": "web", "replicas": "4"}
+	result, report := runRemediationCommand(t, executor, protocol.RemediationScale, params)
+	if report == nil {
+		t.Fatalf("scale = %s: %s", result.Status, result.Error)
+	}
+	if !report.Changed || report.Rule != "web" || report.Target != (protocol.RemediationTarget{Kind: "Deployment", Namespace: "web", Name: "web"}) {
+		t.Errorf("report = %+v, want a change of deployment web/web by rule web", report)
+	}
+	if result.Output != "deployment.apps/web scaled from 2 to 4 replicas\n" {
+		t.Errorf("Output = %q", result.Output)
+	}
+
+	// The snapshot is the deployment before the change, the rollback restores it
+	spec := report.Snapshot["spec"].(map[string]interface{})
+	if report.Snapshot["kind"] != "Deployment" || spec["replicas"] != 2.0 {
+		t.Errorf("snapshot = %v, want the deployment with 2 replicas", report.Snapshot)
+	}
+	if report.Rollback == nil || report.Rollback.Action != protocol.RemediationScale || report.Rollback.Params["replicas"] != "2" {
+		t.Errorf("rollback = %+v, want scale to 2", report.Rollback)
+	}
+
+	d, _ := clientset.AppsV1().Deployments("web").Get(context.Background(), "web", metav1.GetOptions{})
+	if *d.Spec.Replicas != 4 {
+		t.Errorf("replicas = %d, want 4", *d.Spec.Replicas)
+	}
+
+	// The rollback is itself a valid remediation
+	rollback := report.Rollback
+	if _, report = runRemediationCommand(t, executor, rollback.Action, rollback.Params); report == nil || !report.Changed {
+		t.Fatalf("rollback report = %+v, want a change", report)
+	}
+	_, report = runRemediationCommand(t, executor, rollback.Action, rollback.Params)
+	if report == nil || report.Changed || report.Rollback != nil {
+		t.Errorf("report = %+v, want no change when the replicas are as requested", report)
+	}
+}
+
+func TestRemediationDryRun(t *testing.T) {
+	executor, clientset := newTestRemediationExecutor(t)
+
+	// The fake clientset applies dry runs, so check the options it was given
+	result, report := runRemediationCommand(t, executor, protocol.RemediationCordon,
+		map[string]string{"name": "node-1", "dry_run": "true"})
+	if report == nil || !report.DryRun || !report.Changed || report.Rule != "nodes" {
+		t.Fatalf("cordon = %s %q, report %+v", result.Status, result.Error, report)
+	}
+	if !strings.HasSuffix(result.Output, "node/node-1 cordoned (server dry run)\n") {
+		t.Errorf("Output = %q, want a dry run", result.Output)
+	}
+
+	result, _ = runRemediationCommand(t, executor, protocol.RemediationDeletePod,
+		map[string]string{"name": "web-1", "namespace": "web", "grace_period": "5", "dry_run": "true"})
+	if result.Status != protocol.CommandStatusSuccess {
+		t.Fatalf("delete-pod = %s %q", result.Status, result.Error)
+	}
+
+	var patched, deleted bool
+	for _, action := range clientset.Actions() {
+		switch a := action.(type) {
+		case k8stesting.PatchActionImpl:
+			patched = true
+			if len(a.PatchOptions.DryRun) != 1 || a.PatchOptions.DryRun[0] != metav1.DryRunAll {
+				t.Errorf("patch of %s dry run = %v, want All", a.Name, a.PatchOptions.DryRun)
+			}
+		case k8stesting.DeleteActionImpl:
+			deleted = true
+			opts := a.DeleteOptions
+			if len(opts.DryRun) != 1 || opts.GracePeriodSeconds == nil || *opts.GracePeriodSeconds != 5 {
+				t.Errorf("delete of %s options = %+v, want a dry run with 5s grace", a.Name, opts)
+			}
+		}
+	}
+	if !patched || !deleted {
+		t.Errorf("patched %v, deleted %v, want both", patched, deleted)
+	}
+}
+
+func TestRemediationNodesAndPods(t *testing.T) {
+	executor, clientset := newTestRemediationExecutor(t)
+	ctx := context.Background()
+
+	_, report := runRemediationCommand(t, executor, protocol.RemediationCordon, map[string]string{"name": "node-1"})
+	if report == nil || report.Rollback == nil || report.Rollback.Action != protocol.RemediationUncordon {
+		t.Fatalf("cordon report = %+v, want an uncordon rollback", report)
+	}
+	node, _ := clientset.CoreV1().Nodes().Get(ctx, "node-1", metav1.GetOptions{})
+	if !node.Spec.Unschedulable {
+		t.Error("node-1 is schedulable after cordon")
+	}
+
+	result, report := runRemediationCommand(t, executor, protocol.RemediationCordon, map[string]string{"name": "node-1"})
+	if report == nil || report.Changed || report.Rollback != nil || result.Output != "node/node-1 already cordoned\n" {
+		t.Errorf("second cordon = %q, report %+v, want no change", result.Output, report)
+	}
+
+	_, report = runRemediationCommand(t, executor, protocol.RemediationRolloutRestart,
+		map[string]string{"kind": "deployment", "name": "web", "namespace": "web"})
+	if report == nil || !report.Changed || report.Rollback != nil {
+		t.Errorf("rollout-restart report = %+v, want a change without rollback", report)
+	}
+	d, _ := clientset.AppsV1().Deployments("web").Get(ctx, "web", metav1.GetOptions{})
+	if d.Spec.Template.Annotations[restartedAtAnnotation] == "" {
+		t.Error("rollout-restart did not annotate the pod template")
+	}
+
+	_, report = runRemediationCommand(t, executor, protocol.RemediationDeletePod,
+		map[string]string{"name": "web-1", "namespace": "web"})
+	if report == nil || report.Snapshot["kind"] != "Pod" {
+		t.Errorf("delete-pod report = %+v, want the pod snapshot", report)
+	}
+	if _, err := clientset.CoreV1().Pods("web").Get(ctx, "web-1", metav1.GetOptions{}); err == nil {
+		t.Error("web-1 still exists after delete-pod")
+	}
+
+	result, _ = runRemediationCommand(t, executor, protocol.RemediationDeletePod,
+		map[string]string{"name": "web-1", "namespace": "web"})
+	if result.Status != protocol.CommandStatusFailed || result.ExitCode == nil || *result.ExitCode != 1 {
+		t.Errorf("delete of a missing pod = %s exit %v, want failed with exit 1", result.Status, result.ExitCode)
+	}
+}
+
+func TestRemediationPatchResources(t *testing.T) {
+	executor, clientset := newTestRemediationExecutor(t)
+
+	_, report := runRemediationCommand(t, executor, protocol.RemediationPatchResources, map[string]string{
+		"kind": "deployment", "name": "web", "namespace": "web", "cpu_limit": "1", "memory_limit": "256Mi",
+	})
+	if report == nil || !report.Changed || report.Rollback == nil {
+		t.Fatalf("patch-resources report = %+v, want a change with rollback", report)
+	}
+	want := map[string]string{
+		"kind": "deployment", "name": "web", "namespace": "web",
+		"container": "app", "cpu_limit": "500m", "memory_limit": "none",
+	}
+	for k, v := range want {
+		if report.Rollback.Params[k] != v {
+			t.Errorf("rollback param %s = %q, want %q", k, report.Rollback.Params[k], v)
+		}
+	}
+
+	d, _ := clientset.AppsV1().Deployments("web").Get(context.Background(), "web", metav1.GetOptions{})
+	limits := d.Spec.Template.Spec.Containers[0].Resources.Limits
+	if cpu, memory := limits[corev1.ResourceCPU], limits[corev1.ResourceMemory]; cpu.String() != "1" || memory.String() != "256Mi" {
+		t.Errorf("limits = %v, want 1 CPU and 256Mi", limits)
+	}
+
+	// Rolling back removes the memory limit again
+	if _, report = runRemediationCommand(t, executor, report.Rollback.Action, report.Rollback.Params); report == nil || !report.Changed {
+		t.Fatalf("rollback report = %+v, want a change", report)
+	}
+	d, _ = clientset.AppsV1().Deployments("web").Get(context.Background(), "web", metav1.GetOptions{})
+	limits = d.Spec.Template.Spec.Containers[0].Resources.Limits
+	if _, ok := limits[corev1.ResourceMemory]; ok || limits.Cpu().String() != "500m" {
+		t.Errorf("limits after rollback = %v, want only 500m CPU", limits)
+	}
+
+	result, _ := runRemediationCommand(t, executor, protocol.RemediationPatchResources, map[string]string{
+		"kind": "deployment", "name": "web", "namespace": "web", "container": "sidecar", "cpu_limit": "1",
+	})
+	if result.Status != protocol.CommandStatusFailed || !strings.Contains(result.Error, "container sidecar not found") {
+		t.Errorf("patch of a missing container = %s %q, want failed", result.Status, result.Error)
+	}
+}
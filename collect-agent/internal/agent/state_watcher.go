@@ -0,0 +1,726 @@
+package agent
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/kart/k8s-agent/collect-agent/internal/rules"
+	"github.com/kart/k8s-agent/collect-agent/internal/types"
+)
+
+// Event types of the state transitions reported by the state watcher
+const (
+	stateEventContainerRestart      = "container_restart"
+	stateEventNodeCondition         = "node_condition"
+	stateEventRolloutStalled        = "rollout_stalled"
+	stateEventDeploymentUnavailable = "deployment_unavailable"
+	stateEventPodPending            = "pod_pending"
+	stateEventPVCPending            = "pvc_pending"
+	stateEventJobFailed             = "job_failed"
+)
+
+// stateEventSource is the source of the events reported by the state watcher
+const stateEventSource = "state-watcher"
+
+// crashLoopRestarts is the restart count from which container restarts are reported with high severity
+const crashLoopRestarts = 5
+
+// annSelectedNode is set on claims of WaitForFirstConsumer storage classes
+// once a pod using them has been scheduled
+const annSelectedNode = "volume.kubernetes.io/selected-node"
+
+// StateWatcher watches pods, nodes, deployments, PVCs and jobs through the
+// shared informers of the agent and reports their state transitions as
+// events. Unlike Kubernetes events these do not expire, and cover states no
+// event is recorded for, such as a pod or PVC stuck in Pending.
+type StateWatcher struct {
+	informers        *sharedInformers
+	clusterID        string
+	eventChan        chan<- *types.Event
+	pendingThreshold time.Duration
+	stopCh           chan struct{}
+	wg               sync.WaitGroup
+	running          bool
+	mu               sync.RWMutex
+	logger           *zap.Logger
+
+	synced         []cache.InformerSynced
+	pods           corelisters.PodLister
+	claims         corelisters.PersistentVolumeClaimLister
+	storageClasses storagelisters.StorageClassLister
+
+	// pending holds the pods and PVCs reported stuck in Pending, so that
+	// each is reported once; only used by the pending check
+	pending map[string]bool
+
+	// overflow receives events that do not fit in eventChan, returning true if it kept them
+	overflow func(*types.Event) bool
+
+	health  componentHealth
+	dropped atomic.Int64
+	metrics *agentMetrics
+}
+
+// NewStateWatcher creates a new state watcher reporting pods and PVCs that
+// stay Pending for longer than pendingThreshold
+func NewStateWatcher(informers *sharedInformers, clusterID string, eventChan chan<- *types.Event, pendingThreshold time.Duration, logger *zap.Logger) *StateWatcher {
+	return &StateWatcher{
+		informers:        informers,
+		clusterID:        clusterID,
+		eventChan:        eventChan,
+		pendingThreshold: pendingThreshold,
+		stopCh:           make(chan struct{}),
+		logger:           logger.With(zap.String("component", "state-watcher")),
+		pending:          make(map[string]bool),
+	}
+}
+
+// SetOverflowHandler sets the handler for events that do not fit in the event channel
+func (sw *StateWatcher) SetOverflowHandler(handler func(*types.Event) bool) {
+	sw.overflow = handler
+}
+
+// Start begins watching resource state. The shared informers deliver
+// changes once the agent starts them.
+func (sw *StateWatcher) Start(ctx context.Context) error {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	if sw.running {
+		return fmt.Errorf("state watcher already running")
+	}
+
+	sw.logger.Info("Starting state watcher",
+		zap.String("cluster_id", sw.clusterID),
+		zap.Duration("pending_threshold", sw.pendingThreshold))
+
+	factory := sw.informers.factory
+
+	watched := []struct {
+		informer cache.SharedIndexInformer
+		updated  func(oldObj, newObj interface{})
+	}{
+		{factory.Core().V1().Pods().Informer(), sw.podUpdated},
+		{factory.Core().V1().Nodes().Informer(), sw.nodeUpdated},
+		{factory.Apps().V1().Deployments().Informer(), sw.deploymentUpdated},
+		{factory.Batch().V1().Jobs().Informer(), sw.jobUpdated},
+		{factory.Core().V1().PersistentVolumeClaims().Informer(), nil},
+		{factory.Storage().V1().StorageClasses().Informer(), nil},
+	}
+
+	synced := make([]cache.InformerSynced, 0, len(watched))
+	for _, w := range watched {
+		if err := sw.watch(w.informer, w.updated); err != nil {
+			return fmt.Errorf("failed to watch resource state: %w", err)
+		}
+		synced = append(synced, w.informer.HasSynced)
+	}
+
+	sw.pods = factory.Core().V1().Pods().Lister()
+	sw.claims = factory.Core().V1().PersistentVolumeClaims().Lister()
+	sw.storageClasses = factory.Storage().V1().StorageClasses().Lister()
+	sw.synced = synced
+	sw.running = true
+
+	sw.wg.Add(1)
+	go sw.checkPendingLoop()
+
+	sw.logger.Info("State watcher started")
+	return nil
+}
+
+// Stop stops the state watcher. The lock is released before waiting because
+// the pending check reads the sync state.
+func (sw *StateWatcher) Stop() {
+	sw.mu.Lock()
+	if !sw.running {
+		sw.mu.Unlock()
+		return
+	}
+	sw.running = false
+	sw.mu.Unlock()
+
+	sw.logger.Info("Stopping state watcher")
+	close(sw.stopCh)
+	sw.wg.Wait()
+	sw.logger.Info("State watcher stopped")
+}
+
+// watch registers the update handler of an informer, tracking its list and
+// watch errors in the component health
+func (sw *StateWatcher) watch(informer cache.SharedIndexInformer, updated func(oldObj, newObj interface{})) error {
+	return sw.informers.watch(informer, cache.ResourceEventHandlerFuncs{
+		AddFunc: func(interface{}) {
+			sw.health.recordSuccess()
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			sw.health.recordSuccess()
+			if updated != nil && !isResync(oldObj, newObj) {
+				updated(oldObj, newObj)
+			}
+		},
+	}, sw.health.recordError)
+}
+
+// podUpdated reports the containers of a pod that restarted
+func (sw *StateWatcher) podUpdated(oldObj, newObj interface{}) {
+	oldPod, ok := oldObj.(*corev1.Pod)
+	if !ok {
+		return
+	}
+	pod, ok := newObj.(*corev1.Pod)
+	if !ok {
+		return
+	}
+
+	restarts := make(map[string]int32)
+	for _, statuses := range [][]corev1.ContainerStatus{oldPod.Status.InitContainerStatuses, oldPod.Status.ContainerStatuses} {
+		for _, status := range statuses {
+			restarts[status.Name] = status.RestartCount
+		}
+	}
+
+	for _, statuses := range [][]corev1.ContainerStatus{pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses} {
+		for i := range statuses {
+			previous, ok := restarts[statuses[i].Name]
+			if ok && statuses[i].RestartCount > previous {
+				sw.publish(sw.containerRestartEvent(pod, &statuses[i]))
+			}
+		}
+	}
+}
+
+// containerRestartEvent reports a container restart with the reason of its
+// last termination
+func (sw *StateWatcher) containerRestartEvent(pod *corev1.Pod, status *corev1.ContainerStatus) *types.Event {
+	reason := "ContainerRestarted"
+	message := fmt.Sprintf("Container %s of pod %s restarted (%d restarts)", status.Name, pod.Name, status.RestartCount)
+	at := time.Now()
+
+	rawData := map[string]interface{}{
+		"container":     status.Name,
+		"restart_count": status.RestartCount,
+		"node":          pod.Spec.NodeName,
+	}
+
+	if terminated := status.LastTerminationState.Terminated; terminated != nil {
+		if terminated.Reason != "" {
+			reason = terminated.Reason
+		}
+		message = fmt.Sprintf("Container %s of pod %s restarted (%d restarts) after it terminated with %s, exit code %d",
+			status.Name, pod.Name, status.RestartCount, reason, terminated.ExitCode)
+		if !terminated.FinishedAt.IsZero() {
+			at = terminated.FinishedAt.Time
+		}
+
+		rawData["exit_code"] = terminated.ExitCode
+		rawData["signal"] = terminated.Signal
+		rawData["termination_message"] = terminated.Message
+		rawData["started_at"] = terminated.StartedAt
+		rawData["finished_at"] = terminated.FinishedAt
+	}
+	if waiting := status.State.Waiting; waiting != nil {
+		rawData["waiting_reason"] = waiting.Reason
+	}
+
+	severity := rules.SeverityMedium
+	switch {
+	case reason == "OOMKilled":
+		severity = rules.SeverityCritical
+	case status.RestartCount >= crashLoopRestarts:
+		severity = rules.SeverityHigh
+	}
+
+	transition := fmt.Sprintf("%s/%d", status.Name, status.RestartCount)
+	event := sw.newEvent("Pod", pod, stateEventContainerRestart, transition, severity, reason, message, at)
+	for key, value := range rawData {
+		event.RawData[key] = value
+	}
+	return event
+}
+
+// nodeUpdated reports node conditions that became unhealthy or recovered
+func (sw *StateWatcher) nodeUpdated(oldObj, newObj interface{}) {
+	oldNode, ok := oldObj.(*corev1.Node)
+	if !ok {
+		return
+	}
+	node, ok := newObj.(*corev1.Node)
+	if !ok {
+		return
+	}
+
+	previous := make(map[corev1.NodeConditionType]corev1.ConditionStatus, len(oldNode.Status.Conditions))
+	for _, condition := range oldNode.Status.Conditions {
+		previous[condition.Type] = condition.Status
+	}
+
+	for i := range node.Status.Conditions {
+		condition := &node.Status.Conditions[i]
+		before, ok := previous[condition.Type]
+		if !ok || before == condition.Status {
+			continue
+		}
+		if nodeConditionHealthy(condition.Type, before) == nodeConditionHealthy(condition.Type, condition.Status) {
+			continue
+		}
+		sw.publish(sw.nodeConditionEvent(node, condition, before))
+	}
+}
+
+// nodeConditionHealthy reports whether a node condition status is healthy:
+// Ready must be True, any other condition, such as MemoryPressure or the
+// conditions of the node problem detector, must not be True
+func nodeConditionHealthy(conditionType corev1.NodeConditionType, status corev1.ConditionStatus) bool {
+	if conditionType == corev1.NodeReady {
+		return status == corev1.ConditionTrue
+	}
+	return status != corev1.ConditionTrue
+}
+
+// nodeConditionEvent reports a node condition that became unhealthy or recovered
+func (sw *StateWatcher) nodeConditionEvent(node *corev1.Node, condition *corev1.NodeCondition, before corev1.ConditionStatus) *types.Event {
+	healthy := nodeConditionHealthy(condition.Type, condition.Status)
+
+	var reason, severity string
+	switch {
+	case condition.Type == corev1.NodeReady && healthy:
+		reason, severity = "NodeReady", rules.SeverityLow
+	case condition.Type == corev1.NodeReady:
+		reason, severity = "NodeNotReady", rules.SeverityCritical
+	case healthy:
+		reason, severity = string(condition.Type)+"Resolved", rules.SeverityLow
+	case condition.Type == corev1.NodeNetworkUnavailable:
+		reason, severity = string(condition.Type), rules.SeverityCritical
+	default:
+		reason, severity = string(condition.Type), rules.SeverityHigh
+	}
+
+	message := fmt.Sprintf("Node %s condition %s changed from %s to %s", node.Name, condition.Type, before, condition.Status)
+	if condition.Message != "" {
+		message += ": " + condition.Message
+	}
+
+	at := time.Now()
+	if !condition.LastTransitionTime.IsZero() {
+		at = condition.LastTransitionTime.Time
+	}
+
+	transition := fmt.Sprintf("%s/%s/%d", condition.Type, condition.Status, at.Unix())
+	event := sw.newEvent("Node", node, stateEventNodeCondition, transition, severity, reason, message, at)
+	event.RawData["condition"] = string(condition.Type)
+	event.RawData["status"] = string(condition.Status)
+	event.RawData["previous_status"] = string(before)
+	event.RawData["condition_reason"] = condition.Reason
+	event.RawData["condition_message"] = condition.Message
+	return event
+}
+
+// deploymentUpdated reports rollouts that exceeded their progress deadline
+// and deployments that lost their minimum availability
+func (sw *StateWatcher) deploymentUpdated(oldObj, newObj interface{}) {
+	oldDeployment, ok := oldObj.(*appsv1.Deployment)
+	if !ok {
+		return
+	}
+	deployment, ok := newObj.(*appsv1.Deployment)
+	if !ok {
+		return
+	}
+
+	if condition := rolloutStalled(deployment); condition != nil && rolloutStalled(oldDeployment) == nil {
+		message := fmt.Sprintf("Rollout of deployment %s stalled", deployment.Name)
+		if condition.Message != "" {
+			message += ": " + condition.Message
+		}
+		transition := fmt.Sprintf("%d/%s", deployment.Generation, condition.Reason)
+		sw.publish(sw.deploymentEvent(deployment, condition, stateEventRolloutStalled, transition, message))
+	}
+
+	if condition := deploymentUnavailable(deployment); condition != nil && deploymentUnavailable(oldDeployment) == nil {
+		message := fmt.Sprintf("Deployment %s has %d of %d replicas available",
+			deployment.Name, deployment.Status.AvailableReplicas, deploymentReplicas(deployment))
+		if condition.Message != "" {
+			message += ": " + condition.Message
+		}
+		transition := fmt.Sprintf("%d", condition.LastTransitionTime.Unix())
+		sw.publish(sw.deploymentEvent(deployment, condition, stateEventDeploymentUnavailable, transition, message))
+	}
+}
+
+// rolloutStalled returns the Progressing condition of a deployment whose
+// rollout exceeded its progress deadline, or nil
+func rolloutStalled(deployment *appsv1.Deployment) *appsv1.DeploymentCondition {
+	condition := deploymentCondition(deployment, appsv1.DeploymentProgressing)
+	if condition == nil || condition.Status != corev1.ConditionFalse || condition.Reason != "ProgressDeadlineExceeded" {
+		return nil
+	}
+	return condition
+}
+
+// deploymentUnavailable returns the Available condition of a deployment
+// without its minimum availability, or nil
+func deploymentUnavailable(deployment *appsv1.Deployment) *appsv1.DeploymentCondition {
+	condition := deploymentCondition(deployment, appsv1.DeploymentAvailable)
+	if condition == nil || condition.Status != corev1.ConditionFalse {
+		return nil
+	}
+	return condition
+}
+
+// deploymentCondition returns the condition of the given type, or nil
+func deploymentCondition(deployment *appsv1.Deployment, conditionType appsv1.DeploymentConditionType) *appsv1.DeploymentCondition {
+	for i := range deployment.Status.Conditions {
+		if deployment.Status.Conditions[i].Type == conditionType {
+			return &deployment.Status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// deploymentReplicas returns the desired replicas of a deployment
+func deploymentReplicas(deployment *appsv1.Deployment) int32 {
+	if deployment.Spec.Replicas == nil {
+		return 1
+	}
+	return *deployment.Spec.Replicas
+}
+
+// deploymentEvent reports a deployment condition with the replica counts
+func (sw *StateWatcher) deploymentEvent(deployment *appsv1.Deployment, condition *appsv1.DeploymentCondition, eventType, transition, message string) *types.Event {
+	at := time.Now()
+	if !condition.LastUpdateTime.IsZero() {
+		at = condition.LastUpdateTime.Time
+	}
+
+	event := sw.newEvent("Deployment", deployment, eventType, transition, rules.SeverityHigh, condition.Reason, message, at)
+	event.RawData["replicas"] = deploymentReplicas(deployment)
+	event.RawData["updated_replicas"] = deployment.Status.UpdatedReplicas
+	event.RawData["ready_replicas"] = deployment.Status.ReadyReplicas
+	event.RawData["available_replicas"] = deployment.Status.AvailableReplicas
+	event.RawData["unavailable_replicas"] = deployment.Status.UnavailableReplicas
+	event.RawData["generation"] = deployment.Generation
+	event.RawData["observed_generation"] = deployment.Status.ObservedGeneration
+	event.RawData["condition_message"] = condition.Message
+	return event
+}
+
+// jobUpdated reports jobs that failed
+func (sw *StateWatcher) jobUpdated(oldObj, newObj interface{}) {
+	oldJob, ok := oldObj.(*batchv1.Job)
+	if !ok {
+		return
+	}
+	job, ok := newObj.(*batchv1.Job)
+	if !ok {
+		return
+	}
+
+	condition := jobFailed(job)
+	if condition == nil || jobFailed(oldJob) != nil {
+		return
+	}
+
+	reason := condition.Reason
+	if reason == "" {
+		reason = "JobFailed"
+	}
+	message := fmt.Sprintf("Job %s failed with %d failed pods", job.Name, job.Status.Failed)
+	if condition.Message != "" {
+		message += ": " + condition.Message
+	}
+
+	at := time.Now()
+	if !condition.LastTransitionTime.IsZero() {
+		at = condition.LastTransitionTime.Time
+	}
+
+	event := sw.newEvent("Job", job, stateEventJobFailed, "failed", rules.SeverityHigh, reason, message, at)
+	event.RawData["active"] = job.Status.Active
+	event.RawData["succeeded"] = job.Status.Succeeded
+	event.RawData["failed"] = job.Status.Failed
+	event.RawData["condition_message"] = condition.Message
+	if job.Spec.BackoffLimit != nil {
+		event.RawData["backoff_limit"] = *job.Spec.BackoffLimit
+	}
+	if owner := metav1.GetControllerOf(job); owner != nil {
+		event.RawData["owner"] = map[string]interface{}{"kind": owner.Kind, "name": owner.Name}
+	}
+	sw.publish(event)
+}
+
+// jobFailed returns the Failed condition of a failed job, or nil
+func jobFailed(job *batchv1.Job) *batchv1.JobCondition {
+	for i := range job.Status.Conditions {
+		condition := &job.Status.Conditions[i]
+		if condition.Type == batchv1.JobFailed && condition.Status == corev1.ConditionTrue {
+			return condition
+		}
+	}
+	return nil
+}
+
+// checkPendingLoop checks for pods and PVCs stuck in Pending until the watcher stops
+func (sw *StateWatcher) checkPendingLoop() {
+	defer sw.wg.Done()
+
+	ticker := time.NewTicker(pendingCheckInterval(sw.pendingThreshold))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sw.stopCh:
+			return
+		case now := <-ticker.C:
+			if sw.HasSynced() {
+				sw.checkPending(now)
+			}
+		}
+	}
+}
+
+// pendingCheckInterval returns how often pods and PVCs are checked for being
+// stuck in Pending, at most every 30 seconds
+func pendingCheckInterval(threshold time.Duration) time.Duration {
+	interval := threshold / 2
+	if interval > 30*time.Second {
+		interval = 30 * time.Second
+	}
+	if interval < time.Second {
+		interval = time.Second
+	}
+	return interval
+}
+
+// checkPending reports the pods and PVCs that have been Pending for longer
+// than the pending threshold and were not reported yet
+func (sw *StateWatcher) checkPending(now time.Time) {
+	stillPending := make(map[string]bool)
+
+	pods, _ := sw.pods.List(labels.Everything())
+	for _, pod := range pods {
+		if pod.Status.Phase != corev1.PodPending || pod.DeletionTimestamp != nil {
+			continue
+		}
+		key := stateObjectKey("Pod", pod)
+		stillPending[key] = true
+		if sw.pending[key] || now.Sub(pod.CreationTimestamp.Time) < sw.pendingThreshold {
+			continue
+		}
+		if sw.publish(sw.podPendingEvent(pod, now)) {
+			sw.pending[key] = true
+		}
+	}
+
+	claims, _ := sw.claims.List(labels.Everything())
+	for _, claim := range claims {
+		if claim.Status.Phase != corev1.ClaimPending || claim.DeletionTimestamp != nil || sw.waitsForConsumer(claim) {
+			continue
+		}
+		key := stateObjectKey("PersistentVolumeClaim", claim)
+		stillPending[key] = true
+		if sw.pending[key] || now.Sub(claim.CreationTimestamp.Time) < sw.pendingThreshold {
+			continue
+		}
+		if sw.publish(sw.claimPendingEvent(claim, now)) {
+			sw.pending[key] = true
+		}
+	}
+
+	// Forget objects that left Pending or were deleted
+	for key := range sw.pending {
+		if !stillPending[key] {
+			delete(sw.pending, key)
+		}
+	}
+}
+
+// waitsForConsumer reports whether a claim is Pending by design because its
+// storage class binds volumes only once a pod using the claim is scheduled
+func (sw *StateWatcher) waitsForConsumer(claim *corev1.PersistentVolumeClaim) bool {
+	if claim.Spec.StorageClassName == nil || claim.Annotations[annSelectedNode] != "" {
+		return false
+	}
+
+	class, err := sw.storageClasses.Get(*claim.Spec.StorageClassName)
+	if err != nil {
+		return false
+	}
+	return class.VolumeBindingMode != nil && *class.VolumeBindingMode == storagev1.VolumeBindingWaitForFirstConsumer
+}
+
+// podPendingEvent reports a pod stuck in Pending with the reason it is not
+// scheduled, or the reason its containers are not starting
+func (sw *StateWatcher) podPendingEvent(pod *corev1.Pod, now time.Time) *types.Event {
+	reason := "PodPending"
+	detail := ""
+	severity := rules.SeverityMedium
+
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodScheduled && condition.Status == corev1.ConditionFalse {
+			reason, detail = condition.Reason, condition.Message
+			severity = rules.SeverityHigh
+		}
+	}
+	if detail == "" {
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.State.Waiting != nil && status.State.Waiting.Reason != "" {
+				reason, detail = status.State.Waiting.Reason, status.State.Waiting.Message
+				break
+			}
+		}
+	}
+	if reason == "" {
+		reason = "PodPending"
+	}
+
+	pendingFor := now.Sub(pod.CreationTimestamp.Time).Round(time.Second)
+	message := fmt.Sprintf("Pod %s has been Pending for %s", pod.Name, pendingFor)
+	if detail != "" {
+		message += ": " + detail
+	}
+
+	event := sw.newEvent("Pod", pod, stateEventPodPending, "pending", severity, reason, message, now)
+	event.RawData["pending_seconds"] = int64(pendingFor.Seconds())
+	event.RawData["node"] = pod.Spec.NodeName
+	return event
+}
+
+// claimPendingEvent reports a PVC stuck in Pending
+func (sw *StateWatcher) claimPendingEvent(claim *corev1.PersistentVolumeClaim, now time.Time) *types.Event {
+	storageClass := ""
+	if claim.Spec.StorageClassName != nil {
+		storageClass = *claim.Spec.StorageClassName
+	}
+
+	pendingFor := now.Sub(claim.CreationTimestamp.Time).Round(time.Second)
+	message := fmt.Sprintf("PersistentVolumeClaim %s has been Pending for %s", claim.Name, pendingFor)
+	if storageClass != "" {
+		message += fmt.Sprintf(" (storage class %s)", storageClass)
+	}
+
+	accessModes := make([]string, 0, len(claim.Spec.AccessModes))
+	for _, mode := range claim.Spec.AccessModes {
+		accessModes = append(accessModes, string(mode))
+	}
+
+	event := sw.newEvent("PersistentVolumeClaim", claim, stateEventPVCPending, "pending", rules.SeverityMedium, "ClaimPending", message, now)
+	event.RawData["pending_seconds"] = int64(pendingFor.Seconds())
+	event.RawData["storage_class"] = storageClass
+	event.RawData["access_modes"] = accessModes
+	event.RawData["volume_name"] = claim.Spec.VolumeName
+	if storage, ok := claim.Spec.Resources.Requests[corev1.ResourceStorage]; ok {
+		event.RawData["requested_storage"] = storage.String()
+	}
+	return event
+}
+
+// newEvent builds the event reporting a state transition of obj. The ID is
+// derived from the object and the transition, so that the same transition
+// always has the same ID.
+func (sw *StateWatcher) newEvent(kind string, obj metav1.Object, eventType, transition, severity, reason, message string, at time.Time) *types.Event {
+	sum := sha256.Sum256([]byte(sw.clusterID + "/" + stateObjectKey(kind, obj) + "/" + eventType + "/" + transition))
+
+	return &types.Event{
+		ID:         hex.EncodeToString(sum[:16]),
+		ClusterID:  sw.clusterID,
+		Type:       eventType,
+		Source:     stateEventSource,
+		Namespace:  obj.GetNamespace(),
+		Severity:   severity,
+		Reason:     reason,
+		Message:    message,
+		Timestamp:  at,
+		ReportedAt: time.Now(),
+		Labels: map[string]string{
+			"kind": kind,
+			"name": obj.GetName(),
+			"uid":  string(obj.GetUID()),
+		},
+		RawData: map[string]interface{}{
+			"resource_version": obj.GetResourceVersion(),
+		},
+	}
+}
+
+// stateObjectKey identifies an object by its UID, or by kind, namespace and
+// name for objects without one
+func stateObjectKey(kind string, obj metav1.Object) string {
+	if obj.GetUID() != "" {
+		return string(obj.GetUID())
+	}
+	return kind + "/" + obj.GetNamespace() + "/" + obj.GetName()
+}
+
+// publish sends an event to the event channel, or to the overflow handler
+// when the channel is full, and reports whether the event was kept
+func (sw *StateWatcher) publish(agentEvent *types.Event) bool {
+	select {
+	case sw.eventChan <- agentEvent:
+		sw.logger.Debug("State event sent",
+			zap.String("event_id", agentEvent.ID),
+			zap.String("type", agentEvent.Type),
+			zap.String("reason", agentEvent.Reason),
+			zap.String("namespace", agentEvent.Namespace))
+		return true
+	default:
+		if sw.overflow != nil && sw.overflow(agentEvent) {
+			sw.logger.Debug("Event channel full, state event spooled",
+				zap.String("event_id", agentEvent.ID))
+			return true
+		}
+		sw.dropped.Add(1)
+		sw.metrics.eventDropped(eventDropQueueFull)
+		sw.logger.Warn("Event channel full, dropping state event",
+			zap.String("event_id", agentEvent.ID),
+			zap.String("type", agentEvent.Type))
+		return false
+	}
+}
+
+// HasSynced returns true once all informers have completed their initial list
+func (sw *StateWatcher) HasSynced() bool {
+	sw.mu.RLock()
+	defer sw.mu.RUnlock()
+
+	if len(sw.synced) == 0 {
+		return false
+	}
+	for _, synced := range sw.synced {
+		if !synced() {
+			return false
+		}
+	}
+	return true
+}
+
+// Dropped returns the number of events dropped because the event channel was full
+func (sw *StateWatcher) Dropped() int64 {
+	return sw.dropped.Load()
+}
+
+// Health returns the state watcher health including the informer sync state
+func (sw *StateWatcher) Health() types.ComponentHealth {
+	synced := sw.HasSynced()
+
+	health := sw.health.snapshot()
+	health.Synced = &synced
+	health.Healthy = health.Healthy && synced
+	return health
+}
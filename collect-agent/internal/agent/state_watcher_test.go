@@ -0,0 +1,246 @@
+package agent
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/kart/k8s-agent/collect-agent/internal/rules"
+	"github.com/kart/k8s-agent/collect-agent/internal/types"
+)
+
+// newTestStateWatcher returns a state watcher of a fake cluster holding
+// objects, with the informers to start once it is started
+func newTestStateWatcher(objects ...runtime.Object) (*StateWatcher, *sharedInformers, *fake.Clientset, chan *types.Event) {
+	clientset := fake.NewClientset(objects...)
+	informers := newSharedInformers(clientset)
+	eventChan := make(chan *types.Event, 10)
+	return NewStateWatcher(informers, "test-cluster", eventChan, 5*time.Minute, zap.NewNop()), informers, clientset, eventChan
+}
+
+// receivedEvents returns the events waiting in eventChan
+func receivedEvents(eventChan chan *types.Event) []*types.Event {
+	var events []*types.Event
+	for {
+		select {
+		case event := <-eventChan:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func TestContainerRestartEvent(t *testing.T) {
+	watcher, _, _, eventChan := newTestStateWatcher()
+
+	oldPod := devPod("worker-1", "node-1", corev1.PodRunning, 1, "")
+	pod := oldPod.DeepCopy()
+	pod.Status.ContainerStatuses[0].RestartCount = 2
+	pod.Status.ContainerStatuses[0].LastTerminationState.Terminated = &corev1.ContainerStateTerminated{
+		ExitCode: 137,
+		Reason:   "OOMKilled",
+	}
+
+	watcher.podUpdated(oldPod, oldPod.DeepCopy())
+	if events := receivedEvents(eventChan); len(events) != 0 {
+		t.Fatalf("got %d events for an unchanged restart count, want none", len(events))
+	}
+
+	watcher.podUpdated(oldPod, pod)
+	watcher.podUpdated(oldPod, pod)
+	events := receivedEvents(eventChan)
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want 2", len(events))
+	}
+
+	event := events[0]
+	if event.Type != stateEventContainerRestart || event.Reason != "OOMKilled" || event.Severity != rules.SeverityCritical {
+		t.Errorf("event = %v %v %v, want %v OOMKilled critical", event.Type, event.Reason, event.Severity, stateEventContainerRestart)
+	}
+	if event.Source != stateEventSource || event.Labels["kind"] != "Pod" || event.Labels["name"] != "worker-1" {
+		t.Errorf("event source and labels = %v %v", event.Source, event.Labels)
+	}
+	if event.RawData["exit_code"] != int32(137) || event.RawData["restart_count"] != int32(2) {
+		t.Errorf("RawData = %v, want exit code 137 and 2 restarts", event.RawData)
+	}
+	if events[1].ID != event.ID {
+		t.Errorf("IDs of the same restart differ: %v, %v", event.ID, events[1].ID)
+	}
+}
+
+func TestNodeConditionEvents(t *testing.T) {
+	tests := []struct {
+		name      string
+		condition corev1.NodeConditionType
+		before    corev1.ConditionStatus
+		after     corev1.ConditionStatus
+		reason    string
+		severity  string
+	}{
+		{"not ready", corev1.NodeReady, corev1.ConditionTrue, corev1.ConditionFalse, "NodeNotReady", rules.SeverityCritical},
+		{"ready", corev1.NodeReady, corev1.ConditionUnknown, corev1.ConditionTrue, "NodeReady", rules.SeverityLow},
+		{"still not ready", corev1.NodeReady, corev1.ConditionFalse, corev1.ConditionUnknown, "", ""},
+		{"pressure", corev1.NodeMemoryPressure, corev1.ConditionFalse, corev1.ConditionTrue, "MemoryPressure", rules.SeverityHigh},
+		{"pressure resolved", corev1.NodeMemoryPressure, corev1.ConditionTrue, corev1.ConditionFalse, "MemoryPressureResolved", rules.SeverityLow},
+		{"network", corev1.NodeNetworkUnavailable, corev1.ConditionFalse, corev1.ConditionTrue, "NetworkUnavailable", rules.SeverityCritical},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			watcher, _, _, eventChan := newTestStateWatcher()
+
+			oldNode := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}}
+			oldNode.Status.Conditions = []corev1.NodeCondition{{Type: tt.condition, Status: tt.before}}
+			node := oldNode.DeepCopy()
+			node.Status.Conditions[0].Status = tt.after
+
+			watcher.nodeUpdated(oldNode, node)
+			events := receivedEvents(eventChan)
+			if tt.reason == "" {
+				if len(events) != 0 {
+					t.Errorf("got %d events, want none", len(events))
+				}
+				return
+			}
+			if len(events) != 1 {
+				t.Fatalf("got %d events, want 1", len(events))
+			}
+			if events[0].Type != stateEventNodeCondition || events[0].Reason != tt.reason || events[0].Severity != tt.severity {
+				t.Errorf("event = %v %v %v, want %v %v %v", events[0].Type, events[0].Reason, events[0].Severity,
+					stateEventNodeCondition, tt.reason, tt.severity)
+			}
+		})
+	}
+}
+
+func TestDeploymentEvents(t *testing.T) {
+	watcher, _, _, eventChan := newTestStateWatcher()
+
+	oldDeployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "demo", Generation: 3}}
+	oldDeployment.Status.Conditions = []appsv1.DeploymentCondition{
+		{Type: appsv1.DeploymentAvailable, Status: corev1.ConditionTrue, Reason: "MinimumReplicasAvailable"},
+		{Type: appsv1.DeploymentProgressing, Status: corev1.ConditionTrue, Reason: "ReplicaSetUpdated"},
+	}
+
+	deployment := oldDeployment.DeepCopy()
+	deployment.Status.Conditions = []appsv1.DeploymentCondition{
+		{Type: appsv1.DeploymentAvailable, Status: corev1.ConditionFalse, Reason: "MinimumReplicasUnavailable"},
+		{Type: appsv1.DeploymentProgressing, Status: corev1.ConditionFalse, Reason: "ProgressDeadlineExceeded"},
+	}
+
+	watcher.deploymentUpdated(oldDeployment, deployment)
+	events := receivedEvents(eventChan)
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want 2", len(events))
+	}
+	if events[0].Type != stateEventRolloutStalled || events[0].Reason != "ProgressDeadlineExceeded" {
+		t.Errorf("first event = %v %v, want %v ProgressDeadlineExceeded", events[0].Type, events[0].Reason, stateEventRolloutStalled)
+	}
+	if events[1].Type != stateEventDeploymentUnavailable || events[1].Reason != "MinimumReplicasUnavailable" {
+		t.Errorf("second event = %v %v, want %v MinimumReplicasUnavailable", events[1].Type, events[1].Reason, stateEventDeploymentUnavailable)
+	}
+
+	// A deployment that stays stalled is reported once
+	watcher.deploymentUpdated(deployment, deployment.DeepCopy())
+	if events := receivedEvents(eventChan); len(events) != 0 {
+		t.Errorf("got %d events for an unchanged deployment, want none", len(events))
+	}
+}
+
+func TestJobFailedEvent(t *testing.T) {
+	watcher, _, _, eventChan := newTestStateWatcher()
+
+	oldJob := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: "backup", Namespace: "demo"}}
+	job := oldJob.DeepCopy()
+	job.Status.Failed = 6
+	job.Status.Conditions = []batchv1.JobCondition{
+		{Type: batchv1.JobFailed, Status: corev1.ConditionTrue, Reason: "BackoffLimitExceeded", Message: "Job has reached the specified backoff limit"},
+	}
+
+	watcher.jobUpdated(oldJob, job)
+	watcher.jobUpdated(job, job.DeepCopy())
+	events := receivedEvents(eventChan)
+	if len(events) != 1 {
+		t.Fatalf("got %d events, want 1", len(events))
+	}
+	if events[0].Type != stateEventJobFailed || events[0].Reason != "BackoffLimitExceeded" || events[0].Severity != rules.SeverityHigh {
+		t.Errorf("event = %v %v %v, want %v BackoffLimitExceeded high", events[0].Type, events[0].Reason, events[0].Severity, stateEventJobFailed)
+	}
+}
+
+func TestStateWatcherPending(t *testing.T) {
+	old := metav1.NewTime(time.Now().Add(-time.Hour))
+
+	unschedulable := devPod("batch-1", "", corev1.PodPending, 0, "")
+	unschedulable.CreationTimestamp = old
+	unschedulable.Status.Conditions = []corev1.PodCondition{
+		{Type: corev1.PodScheduled, Status: corev1.ConditionFalse, Reason: "Unschedulable", Message: "0/3 nodes are available"},
+	}
+	recent := devPod("batch-2", "", corev1.PodPending, 0, "")
+
+	claim := devClaim("data", "standard")
+	claim.CreationTimestamp = old
+	waiting := devClaim("scratch", "local")
+	waiting.CreationTimestamp = old
+	bindingMode := storagev1.VolumeBindingWaitForFirstConsumer
+	local := &storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "local"}, VolumeBindingMode: &bindingMode}
+
+	restarting := devPod("worker-1", "node-1", corev1.PodRunning, 0, "")
+
+	watcher, informers, clientset, eventChan := newTestStateWatcher(unschedulable, recent, claim, waiting, local, restarting)
+	if err := watcher.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer watcher.Stop()
+
+	stopCh := make(chan struct{})
+	informers.Start(stopCh)
+	defer informers.Shutdown()
+	defer close(stopCh)
+
+	waitFor(t, "state watcher sync", watcher.HasSynced)
+
+	watcher.checkPending(time.Now())
+	watcher.checkPending(time.Now())
+
+	got := make(map[string]*types.Event)
+	for _, event := range receivedEvents(eventChan) {
+		got[event.Labels["name"]] = event
+	}
+	if len(got) != 2 {
+		t.Fatalf("reported %v, want only the old pod and PVC reported once", got)
+	}
+	if event := got["batch-1"]; event == nil || event.Type != stateEventPodPending || event.Reason != "Unschedulable" {
+		t.Errorf("pod event = %+v, want %v Unschedulable", event, stateEventPodPending)
+	}
+	if event := got["data"]; event == nil || event.Type != stateEventPVCPending || event.RawData["storage_class"] != "standard" {
+		t.Errorf("PVC event = %+v, want %v of storage class standard", event, stateEventPVCPending)
+	}
+
+	// Updates reach the handlers through the informers
+	if err := restartDevPod(context.Background(), clientset, "worker-1"); err != nil {
+		t.Fatalf("restartDevPod failed: %v", err)
+	}
+	select {
+	case event := <-eventChan:
+		if event.Type != stateEventContainerRestart || event.Reason != "Error" {
+			t.Errorf("event = %v %v, want %v Error", event.Type, event.Reason, stateEventContainerRestart)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("container restart was not reported")
+	}
+
+	if health := watcher.Health(); !health.Healthy {
+		t.Errorf("Health = %+v, want healthy", health)
+	}
+}
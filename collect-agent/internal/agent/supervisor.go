@@ -0,0 +1,205 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/kart/k8s-agent/collect-agent/internal/rules"
+	"github.com/kart/k8s-agent/collect-agent/internal/types"
+)
+
+// Supervisor runs the agents of every configured cluster over a single NATS connection
+type Supervisor struct {
+	config   *types.AgentConfig
+	conn     *Connection
+	rules    *rules.Store
+	agents   []*Agent
+	registry *prometheus.Registry
+	logger   *zap.Logger
+
+	mu        sync.RWMutex
+	running   bool
+	startTime time.Time
+}
+
+// NewSupervisor creates an agent for each cluster target in the configuration
+func NewSupervisor(config *types.AgentConfig, logger *zap.Logger) (*Supervisor, error) {
+	s := &Supervisor{
+		config:    config,
+		conn:      NewConnection(config, logger),
+		logger:    logger.With(zap.String("component", "supervisor")),
+		startTime: time.Now(),
+	}
+
+	// The event rules are shared by the event watchers of all clusters
+	store, err := rules.NewStore(config.EventRules.File, config.EventRules.ReloadInterval, logger)
+	if err != nil {
+		return nil, err
+	}
+	s.rules = store
+
+	clusterIDs := make(map[string]int)
+	for i, target := range config.ClusterTargets() {
+		// Each agent gets its own copy of the configuration with its cluster filled in
+		clusterConfig := *config
+		clusterConfig.ClusterID = target.ClusterID
+		clusterConfig.Kubernetes = target.Kubernetes
+
+		agent, err := New(&clusterConfig, s.conn, logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create agent for cluster %d (kubeconfig %q, context %q): %w",
+				i, target.Kubernetes.Kubeconfig, target.Kubernetes.Context, err)
+		}
+
+		if j, ok := clusterIDs[agent.clusterID]; ok {
+			return nil, fmt.Errorf("clusters %d and %d resolve to the same cluster ID %s", j, i, agent.clusterID)
+		}
+		clusterIDs[agent.clusterID] = i
+
+		if agent.eventWatcher != nil {
+			agent.eventWatcher.SetRules(s.rules)
+		}
+		s.agents = append(s.agents, agent)
+	}
+
+	registry, err := newMetricsRegistry(s.agents...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register metrics: %w", err)
+	}
+	s.registry = registry
+
+	return s, nil
+}
+
+// Start connects to NATS, starts every agent and blocks until ctx is cancelled
+func (s *Supervisor) Start(ctx context.Context) error {
+	s.mu.Lock()
+	if s.running {
+		s.mu.Unlock()
+		return fmt.Errorf("supervisor already running")
+	}
+	s.running = true
+	s.mu.Unlock()
+
+	s.logger.Info("Starting agents", zap.Strings("clusters", s.ClusterIDs()))
+
+	if err := s.conn.Connect(s.connectionName()); err != nil {
+		s.Stop()
+		return err
+	}
+
+	for _, agent := range s.agents {
+		if err := agent.Start(ctx); err != nil {
+			s.Stop()
+			return fmt.Errorf("failed to start agent for cluster %s: %w", agent.clusterID, err)
+		}
+	}
+
+	s.rules.Start()
+
+	s.logger.Info("All agents started", zap.Int("clusters", len(s.agents)))
+
+	// Wait for context cancellation
+	<-ctx.Done()
+	return s.Stop()
+}
+
+// Stop stops every agent and closes the NATS connection
+func (s *Supervisor) Stop() error {
+	s.mu.Lock()
+	if !s.running {
+		s.mu.Unlock()
+		return nil
+	}
+	s.running = false
+	s.mu.Unlock()
+
+	s.rules.Stop()
+
+	for _, agent := range s.agents {
+		if err := agent.Stop(); err != nil {
+			s.logger.Error("Failed to stop agent",
+				zap.String("cluster_id", agent.clusterID),
+				zap.Error(err))
+		}
+	}
+
+	s.conn.Close()
+
+	s.logger.Info("All agents stopped")
+	return nil
+}
+
+// ClusterIDs returns the IDs of the served clusters
+func (s *Supervisor) ClusterIDs() []string {
+	ids := make([]string, 0, len(s.agents))
+	for _, agent := range s.agents {
+		ids = append(ids, agent.clusterID)
+	}
+	return ids
+}
+
+// connectionName returns the NATS client name, which keeps the single-cluster
+// form agent-<cluster ID> and lists every cluster otherwise
+func (s *Supervisor) connectionName() string {
+	return "agent-" + strings.Join(s.ClusterIDs(), ",")
+}
+
+// GetStatus returns the status of the process and each of its clusters
+func (s *Supervisor) GetStatus() SupervisorStatus {
+	s.mu.RLock()
+	running := s.running
+	s.mu.RUnlock()
+
+	status := SupervisorStatus{
+		Status:     types.HeartbeatStatusHealthy,
+		Running:    running,
+		Connected:  s.conn.IsConnected(),
+		Reconnects: s.conn.Reconnects(),
+		StartTime:  s.startTime,
+		Uptime:     time.Since(s.startTime),
+		EventRules: s.rules.GetStatistics(),
+		Clusters:   make(map[string]AgentStatus, len(s.agents)),
+	}
+
+	for _, agent := range s.agents {
+		clusterStatus := agent.GetStatus()
+		if clusterStatus.Status != types.HeartbeatStatusHealthy {
+			status.Status = types.HeartbeatStatusDegraded
+		}
+		status.Clusters[agent.clusterID] = clusterStatus
+	}
+
+	return status
+}
+
+// SupervisorStatus is the status of the agent process and of each cluster it serves
+type SupervisorStatus struct {
+	Status     string                 `json:"status"` // healthy, degraded when any cluster is degraded
+	Running    bool                   `json:"running"`
+	Connected  bool                   `json:"connected"`
+	Reconnects int64                  `json:"reconnects"`
+	StartTime  time.Time              `json:"start_time"`
+	Uptime     time.Duration          `json:"uptime"`
+	EventRules map[string]interface{} `json:"event_rules"`
+	Clusters   map[string]AgentStatus `json:"clusters"`
+}
+
+// IsHealthy returns true while running and connected to NATS
+func (s *Supervisor) IsHealthy() bool {
+	s.mu.RLock()
+	running := s.running
+	s.mu.RUnlock()
+	return running && s.conn.IsConnected()
+}
+
+// IsReady returns true if the agents are ready to serve
+func (s *Supervisor) IsReady() bool {
+	return s.IsHealthy()
+}
@@ -0,0 +1,124 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/kart/k8s-agent/collect-agent/internal/types"
+)
+
+func newDevMultiClusterConfig(t *testing.T, clusterIDs ...string) *types.AgentConfig {
+	t.Helper()
+
+	config := types.DefaultConfig()
+	config.DevMode = true
+	config.Spool.Dir = t.TempDir()
+	for _, id := range clusterIDs {
+		config.Clusters = append(config.Clusters, types.ClusterConfig{ClusterID: id})
+	}
+	return config
+}
+
+func TestSupervisorMultiCluster(t *testing.T) {
+	config := newDevMultiClusterConfig(t, "edge-1", "edge-2")
+
+	supervisor, err := NewSupervisor(config, zap.NewNop())
+	if err != nil {
+		t.Fatalf("NewSupervisor failed: %v", err)
+	}
+
+	ids := supervisor.ClusterIDs()
+	if len(ids) != 2 || ids[0] != "edge-1" || ids[1] != "edge-2" {
+		t.Errorf("ClusterIDs = %v, want [edge-1 edge-2]", ids)
+	}
+	if name := supervisor.connectionName(); name != "agent-edge-1,edge-2" {
+		t.Errorf("connectionName = %v, want %v", name, "agent-edge-1,edge-2")
+	}
+
+	// The agents share the connection but not their configuration or spool
+	for _, agent := range supervisor.agents {
+		if agent.communicationManager.conn != supervisor.conn {
+			t.Errorf("agent %s does not use the shared connection", agent.clusterID)
+		}
+		if agent.config.ClusterID != agent.clusterID {
+			t.Errorf("agent config ClusterID = %v, want %v", agent.config.ClusterID, agent.clusterID)
+		}
+		if _, err := os.Stat(filepath.Join(config.Spool.Dir, agent.clusterID)); err != nil {
+			t.Errorf("spool directory of %s: %v", agent.clusterID, err)
+		}
+	}
+
+	status := supervisor.GetStatus()
+	if len(status.Clusters) != 2 {
+		t.Fatalf("status clusters = %v, want 2", len(status.Clusters))
+	}
+	for _, id := range ids {
+		clusterStatus, ok := status.Clusters[id]
+		if !ok {
+			t.Errorf("status of cluster %s missing", id)
+			continue
+		}
+		if clusterStatus.ClusterID != id {
+			t.Errorf("status ClusterID = %v, want %v", clusterStatus.ClusterID, id)
+		}
+	}
+	if status.Connected || supervisor.IsHealthy() {
+		t.Error("supervisor reports connected before Start")
+	}
+
+	families, err := supervisor.registry.Gather()
+	if err != nil {
+		t.Fatalf("Gather failed: %v", err)
+	}
+	clusters := make(map[string]bool)
+	for _, family := range families {
+		if family.GetName() != "agent_event_queue_size" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "cluster_id" {
+					clusters[label.GetValue()] = true
+				}
+			}
+		}
+	}
+	if len(clusters) != 2 {
+		t.Errorf("agent_event_queue_size clusters = %v, want 2", clusters)
+	}
+}
+
+func TestSupervisorDuplicateClusterID(t *testing.T) {
+	// Both dev clusters detect the same cluster ID
+	config := newDevMultiClusterConfig(t, "", "")
+
+	if _, err := NewSupervisor(config, zap.NewNop()); err == nil {
+		t.Error("NewSupervisor should fail when clusters resolve to the same cluster ID")
+	}
+}
+
+func TestSupervisorSingleCluster(t *testing.T) {
+	config := types.DefaultConfig()
+	config.DevMode = true
+	config.ClusterID = "dev"
+	config.Spool.Dir = t.TempDir()
+
+	supervisor, err := NewSupervisor(config, zap.NewNop())
+	if err != nil {
+		t.Fatalf("NewSupervisor failed: %v", err)
+	}
+
+	if name := supervisor.connectionName(); name != "agent-dev" {
+		t.Errorf("connectionName = %v, want %v", name, "agent-dev")
+	}
+	// A single cluster keeps spooling to the configured directory
+	if supervisor.agents[0].spool == nil {
+		t.Fatal("spool not opened")
+	}
+	if _, err := os.Stat(filepath.Join(config.Spool.Dir, "dev")); !os.IsNotExist(err) {
+		t.Errorf("single-cluster spool uses a subdirectory: %v", err)
+	}
+}
@@ -4,10 +4,14 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v2"
 
+	"github.com/kart-io/k8s-agent/protocol"
+
 	"github.com/kart/k8s-agent/collect-agent/internal/types"
 )
 
@@ -76,6 +80,12 @@ func overrideWithEnv(config *types.AgentConfig) {
 		}
 	}
 
+	if val := os.Getenv("METRICS_FULL_SNAPSHOT_INTERVAL"); val != "" {
+		if duration, err := time.ParseDuration(val); err == nil {
+			config.FullSnapshotEvery = duration
+		}
+	}
+
 	if val := os.Getenv("ENABLE_METRICS"); val != "" {
 		config.EnableMetrics = val == "true" || val == "1"
 	}
@@ -83,6 +93,94 @@ func overrideWithEnv(config *types.AgentConfig) {
 	if val := os.Getenv("ENABLE_EVENTS"); val != "" {
 		config.EnableEvents = val == "true" || val == "1"
 	}
+
+	if val := os.Getenv("ENABLE_JETSTREAM"); val != "" {
+		config.EnableJetStream = val == "true" || val == "1"
+	}
+
+	if val := os.Getenv("KUBE_CONTEXT"); val != "" {
+		config.Kubernetes.Context = val
+	}
+
+	if val := os.Getenv("DEV_MODE"); val != "" {
+		config.DevMode = val == "true" || val == "1"
+	}
+
+	if val := os.Getenv("EVENT_API"); val != "" {
+		config.EventWatch.API = val
+	}
+
+	if val := os.Getenv("EVENT_STATE_DIR"); val != "" {
+		config.EventWatch.StateDir = val
+	}
+
+	if val := os.Getenv("EVENT_RULES_FILE"); val != "" {
+		config.EventRules.File = val
+	}
+
+	if val := os.Getenv("EVENT_DEDUP_WINDOW"); val != "" {
+		if duration, err := time.ParseDuration(val); err == nil {
+			config.EventDedup.Window = duration
+		}
+	}
+
+	if val := os.Getenv("ENABLE_STATE_WATCH"); val != "" {
+		config.StateWatch.Enabled = val == "true" || val == "1"
+	}
+
+	if val := os.Getenv("ENABLE_KUBELET_STATS"); val != "" {
+		config.KubeletStats.Enabled = val == "true" || val == "1"
+	}
+
+	if val := os.Getenv("COMMAND_SIGNING_ENABLED"); val != "" {
+		config.CommandSigning.Enabled = val == "true" || val == "1"
+	}
+
+	// Public keys as comma-separated key-id=base64 pairs
+	if val := os.Getenv("COMMAND_SIGNING_PUBLIC_KEYS"); val != "" {
+		config.CommandSigning.PublicKeys = make(map[string]string)
+		for _, pair := range strings.Split(val, ",") {
+			if keyID, key, ok := strings.Cut(strings.TrimSpace(pair), "="); ok {
+				config.CommandSigning.PublicKeys[keyID] = key
+			}
+		}
+	}
+
+	if val := os.Getenv("COMMAND_WORKERS"); val != "" {
+		if workers, err := strconv.Atoi(val); err == nil {
+			config.CommandPool.Workers = workers
+		}
+	}
+
+	if val := os.Getenv("COMMAND_QUEUE_SIZE"); val != "" {
+		if size, err := strconv.Atoi(val); err == nil {
+			config.CommandPool.QueueSize = size
+		}
+	}
+
+	if val := os.Getenv("REMEDIATION_ENABLED"); val != "" {
+		config.Remediation.Enabled = val == "true" || val == "1"
+	}
+
+	if val := os.Getenv("REMEDIATION_POLICY_FILE"); val != "" {
+		config.Remediation.PolicyFile = val
+	}
+
+	if val := os.Getenv("SPOOL_ENABLED"); val != "" {
+		config.Spool.Enabled = val == "true" || val == "1"
+	}
+
+	if val := os.Getenv("SPOOL_DIR"); val != "" {
+		config.Spool.Dir = val
+	}
+}
+
+// Validate validates a configuration changed after loading, e.g. by command-line flags
+func Validate(config *types.AgentConfig) error {
+	if err := validateConfig(config); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	return nil
 }
 
 // validateConfig validates the configuration values
@@ -91,6 +189,14 @@ func validateConfig(config *types.AgentConfig) error {
 		return fmt.Errorf("central_endpoint is required")
 	}
 
+	if config.DevMode && (config.Kubernetes.Kubeconfig != "" || config.Kubernetes.Context != "") {
+		return fmt.Errorf("dev_mode cannot be combined with kubernetes.kubeconfig or kubernetes.context")
+	}
+
+	if err := validateClusters(config); err != nil {
+		return err
+	}
+
 	if config.ReconnectDelay < time.Second {
 		return fmt.Errorf("reconnect_delay must be at least 1 second")
 	}
@@ -103,6 +209,10 @@ func validateConfig(config *types.AgentConfig) error {
 		return fmt.Errorf("metrics_interval must be at least 30 seconds")
 	}
 
+	if config.FullSnapshotEvery != 0 && config.FullSnapshotEvery < config.MetricsInterval {
+		return fmt.Errorf("metrics_full_snapshot_interval must be zero or at least metrics_interval")
+	}
+
 	if config.BufferSize < 10 {
 		return fmt.Errorf("buffer_size must be at least 10")
 	}
@@ -111,6 +221,96 @@ func validateConfig(config *types.AgentConfig) error {
 		return fmt.Errorf("max_retries must be at least 1")
 	}
 
+	switch config.EventWatch.API {
+	case "", types.EventAPIEventsV1, types.EventAPICoreV1:
+	default:
+		return fmt.Errorf("event_watch.api must be %q or %q", types.EventAPIEventsV1, types.EventAPICoreV1)
+	}
+
+	if config.EventRules.File != "" && config.EventRules.ReloadInterval < time.Second {
+		return fmt.Errorf("event_rules.reload_interval must be at least 1 second")
+	}
+
+	if config.EventDedup.Window < 0 {
+		return fmt.Errorf("event_dedup.window must not be negative")
+	}
+
+	if config.EventDedup.Window > 0 {
+		if config.EventDedup.Window < time.Second {
+			return fmt.Errorf("event_dedup.window must be at least 1 second")
+		}
+		if config.EventDedup.MaxEntries < 1 {
+			return fmt.Errorf("event_dedup.max_entries must be at least 1")
+		}
+	}
+
+	if config.StateWatch.Enabled && config.StateWatch.PendingThreshold < 10*time.Second {
+		return fmt.Errorf("state_watch.pending_threshold must be at least 10 seconds")
+	}
+
+	if config.KubeletStats.Enabled {
+		if config.KubeletStats.MaxNodes < 0 {
+			return fmt.Errorf("kubelet_stats.max_nodes must not be negative")
+		}
+		if config.KubeletStats.Concurrency < 1 {
+			return fmt.Errorf("kubelet_stats.concurrency must be at least 1")
+		}
+		if config.KubeletStats.Timeout < time.Second || config.KubeletStats.Timeout > config.MetricsInterval {
+			return fmt.Errorf("kubelet_stats.timeout must be between 1 second and metrics_interval")
+		}
+	}
+
+	if config.CommandSigning.Enabled {
+		if len(config.CommandSigning.PublicKeys) == 0 {
+			return fmt.Errorf("command_signing.public_keys is required when command signing is enabled")
+		}
+		for keyID, key := range config.CommandSigning.PublicKeys {
+			if _, err := protocol.ParsePublicKey(key); err != nil {
+				return fmt.Errorf("command_signing.public_keys[%s]: %w", keyID, err)
+			}
+		}
+		if config.CommandSigning.MaxClockSkew < 0 {
+			return fmt.Errorf("command_signing.max_clock_skew must not be negative")
+		}
+		if config.CommandSigning.MaxLifetime < time.Second {
+			return fmt.Errorf("command_signing.max_lifetime must be at least 1 second")
+		}
+	}
+
+	if config.CommandPool.Workers < 0 {
+		return fmt.Errorf("command_pool.workers must not be negative")
+	}
+	if config.CommandPool.QueueSize < 0 {
+		return fmt.Errorf("command_pool.queue_size must not be negative")
+	}
+	tools := protocol.CommandTools()
+	for tool, limit := range config.CommandPool.ToolLimits {
+		if _, ok := tools[tool]; !ok && tool != protocol.RemediationTool {
+			return fmt.Errorf("command_pool.tool_limits: unknown tool %q", tool)
+		}
+		if limit < 1 {
+			return fmt.Errorf("command_pool.tool_limits[%s] must be at least 1", tool)
+		}
+	}
+
+	if config.Remediation.Enabled && config.Remediation.PolicyFile == "" {
+		return fmt.Errorf("remediation.policy_file is required when remediation is enabled")
+	}
+
+	if config.Spool.Enabled {
+		if config.Spool.Dir == "" {
+			return fmt.Errorf("spool.dir is required when the spool is enabled")
+		}
+
+		if config.Spool.MaxSegmentBytes < 64*1024 {
+			return fmt.Errorf("spool.max_segment_bytes must be at least 64KiB")
+		}
+
+		if config.Spool.MaxTotalBytes < 2*config.Spool.MaxSegmentBytes {
+			return fmt.Errorf("spool.max_total_bytes must be at least twice spool.max_segment_bytes")
+		}
+	}
+
 	// Validate log level
 	validLogLevels := map[string]bool{
 		"debug": true,
@@ -127,6 +327,45 @@ func validateConfig(config *types.AgentConfig) error {
 	return nil
 }
 
+// validateClusters validates the cluster list of a multi-cluster agent
+func validateClusters(config *types.AgentConfig) error {
+	if len(config.Clusters) == 0 {
+		return nil
+	}
+
+	if config.ClusterID != "" || config.Kubernetes.Kubeconfig != "" || config.Kubernetes.Context != "" {
+		return fmt.Errorf("cluster_id and kubernetes cannot be combined with clusters")
+	}
+
+	clusterIDs := make(map[string]bool)
+	targets := make(map[types.KubernetesConfig]bool)
+	for i, cluster := range config.Clusters {
+		if config.DevMode {
+			if cluster.ClusterID == "" {
+				return fmt.Errorf("clusters[%d].cluster_id is required in dev mode", i)
+			}
+			if cluster.Kubernetes.Kubeconfig != "" || cluster.Kubernetes.Context != "" {
+				return fmt.Errorf("clusters[%d]: dev_mode cannot be combined with kubeconfig or context", i)
+			}
+		} else {
+			if targets[cluster.Kubernetes] {
+				return fmt.Errorf("clusters[%d]: kubeconfig %q and context %q are already used by another cluster",
+					i, cluster.Kubernetes.Kubeconfig, cluster.Kubernetes.Context)
+			}
+			targets[cluster.Kubernetes] = true
+		}
+
+		if cluster.ClusterID != "" {
+			if clusterIDs[cluster.ClusterID] {
+				return fmt.Errorf("clusters[%d]: duplicate cluster_id %s", i, cluster.ClusterID)
+			}
+			clusterIDs[cluster.ClusterID] = true
+		}
+	}
+
+	return nil
+}
+
 // SaveConfig saves the configuration to a file
 func SaveConfig(config *types.AgentConfig, configPath string) error {
 	data, err := yaml.Marshal(config)
@@ -153,4 +392,4 @@ func GetDefaultConfigYAML() string {
 	config := types.DefaultConfig()
 	data, _ := yaml.Marshal(config)
 	return string(data)
-}
\ No newline at end of file
+}
@@ -55,8 +55,8 @@ func TestValidateConfig_MissingEndpoint(t *testing.T) {
 
 func TestValidateConfig_InvalidReconnectDelay(t *testing.T) {
 	config := &types.AgentConfig{
-		CentralEndpoint: "nats://localhost:4222",
-		ReconnectDelay:  500 * time.Millisecond, // Less than 1 second
+		CentralEndpoint:   "nats://localhost:4222",
+		ReconnectDelay:    500 * time.Millisecond, // Less than 1 second
 		HeartbeatInterval: 30 * time.Second,
 		MetricsInterval:   60 * time.Second,
 		BufferSize:        100,
@@ -155,6 +155,308 @@ func TestValidateConfig_InvalidLogLevel(t *testing.T) {
 	}
 }
 
+func TestValidateConfig_InvalidSpool(t *testing.T) {
+	tests := []struct {
+		name  string
+		spool types.SpoolConfig
+	}{
+		{"MissingDir", types.SpoolConfig{Enabled: true, MaxSegmentBytes: 1 << 20, MaxTotalBytes: 4 << 20}},
+		{"SmallSegment", types.SpoolConfig{Enabled: true, Dir: "/tmp/spool", MaxSegmentBytes: 1024, MaxTotalBytes: 4 << 20}},
+		{"SmallTotal", types.SpoolConfig{Enabled: true, Dir: "/tmp/spool", MaxSegmentBytes: 1 << 20, MaxTotalBytes: 1 << 20}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := types.DefaultConfig()
+			config.Spool = tt.spool
+
+			if err := validateConfig(config); err == nil {
+				t.Error("validateConfig should fail for invalid spool settings")
+			}
+		})
+	}
+}
+
+func TestValidateConfig_EventRulesReloadInterval(t *testing.T) {
+	config := types.DefaultConfig()
+	config.EventRules.File = "/etc/aetherius-rules/rules.yaml"
+	config.EventRules.ReloadInterval = 100 * time.Millisecond
+
+	if err := validateConfig(config); err == nil {
+		t.Error("validateConfig should fail for a reload interval below one second")
+	}
+
+	config.EventRules.ReloadInterval = 30 * time.Second
+	if err := validateConfig(config); err != nil {
+		t.Errorf("validateConfig failed: %v", err)
+	}
+}
+
+func TestValidateConfig_InvalidEventAPI(t *testing.T) {
+	config := types.DefaultConfig()
+	config.EventWatch.API = "events.k8s.io/v1beta1"
+
+	if err := validateConfig(config); err == nil {
+		t.Error("validateConfig should fail for an unsupported event API")
+	}
+}
+
+func TestValidateConfig_InvalidEventDedup(t *testing.T) {
+	tests := []struct {
+		name  string
+		dedup types.EventDedupConfig
+	}{
+		{"NegativeWindow", types.EventDedupConfig{Window: -time.Minute, MaxEntries: 100}},
+		{"ShortWindow", types.EventDedupConfig{Window: 100 * time.Millisecond, MaxEntries: 100}},
+		{"NoEntries", types.EventDedupConfig{Window: time.Minute}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := types.DefaultConfig()
+			config.EventDedup = tt.dedup
+
+			if err := validateConfig(config); err == nil {
+				t.Error("validateConfig should fail for invalid event_dedup settings")
+			}
+		})
+	}
+
+	// A zero window disables deduplication
+	config := types.DefaultConfig()
+	config.EventDedup = types.EventDedupConfig{}
+	if err := validateConfig(config); err != nil {
+		t.Errorf("validateConfig failed with deduplication disabled: %v", err)
+	}
+}
+
+func TestValidateConfig_StateWatchPendingThreshold(t *testing.T) {
+	config := types.DefaultConfig()
+	config.StateWatch.PendingThreshold = time.Second
+	if err := validateConfig(config); err == nil {
+		t.Error("validateConfig should fail for a pending threshold under 10 seconds")
+	}
+
+	// The threshold is not used while the state watchers are disabled
+	config.StateWatch.Enabled = false
+	if err := validateConfig(config); err != nil {
+		t.Errorf("validateConfig failed with the state watchers disabled: %v", err)
+	}
+}
+
+func TestValidateConfig_FullSnapshotInterval(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+		valid    bool
+	}{
+		{"default", 10 * time.Minute, true},
+		{"every report", 0, true},
+		{"shorter than the metrics interval", 30 * time.Second, false},
+		{"negative", -time.Minute, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := types.DefaultConfig()
+			config.FullSnapshotEvery = tt.interval
+
+			err := validateConfig(config)
+			if (err == nil) != tt.valid {
+				t.Errorf("validateConfig error = %v, want valid = %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestValidateConfig_KubeletStats(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*types.KubeletStatsConfig)
+		valid  bool
+	}{
+		{"defaults", func(*types.KubeletStatsConfig) {}, true},
+		{"every node", func(c *types.KubeletStatsConfig) { c.MaxNodes = 0 }, true},
+		{"negative max nodes", func(c *types.KubeletStatsConfig) { c.MaxNodes = -1 }, false},
+		{"no concurrency", func(c *types.KubeletStatsConfig) { c.Concurrency = 0 }, false},
+		{"short timeout", func(c *types.KubeletStatsConfig) { c.Timeout = time.Millisecond }, false},
+		{"timeout beyond the metrics interval", func(c *types.KubeletStatsConfig) { c.Timeout = 2 * time.Minute }, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := types.DefaultConfig()
+			config.KubeletStats.Enabled = true
+			tt.modify(&config.KubeletStats)
+
+			err := validateConfig(config)
+			if (err == nil) != tt.valid {
+				t.Errorf("validateConfig error = %v, want valid = %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestValidateConfig_CommandSigning(t *testing.T) {
+	const publicKey = "O2onvM62pC1io6jQKm8Nc2UyFXcd4kOmOsBIoYtZ2ik="
+
+	tests := []struct {
+		name   string
+		modify func(*types.CommandSigningConfig)
+		valid  bool
+	}{
+		{"valid", func(*types.CommandSigningConfig) {}, true},
+		{"no keys", func(c *types.CommandSigningConfig) { c.PublicKeys = nil }, false},
+		{"malformed key", func(c *types.CommandSigningConfig) { c.PublicKeys["k2"] = "c2hvcnQ=" }, false},
+		{"negative skew", func(c *types.CommandSigningConfig) { c.MaxClockSkew = -time.Second }, false},
+		{"no lifetime", func(c *types.CommandSigningConfig) { c.MaxLifetime = 0 }, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := types.DefaultConfig()
+			config.CommandSigning.Enabled = true
+			config.CommandSigning.PublicKeys = map[string]string{"k1": publicKey}
+			tt.modify(&config.CommandSigning)
+
+			err := validateConfig(config)
+			if (err == nil) != tt.valid {
+				t.Errorf("validateConfig error = %v, want valid = %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestValidateConfig_CommandPool(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*types.CommandPoolConfig)
+		valid  bool
+	}{
+		{"default", func(*types.CommandPoolConfig) {}, true},
+		{"default sizes", func(c *types.CommandPoolConfig) { *c = types.CommandPoolConfig{} }, true},
+		{"negative workers", func(c *types.CommandPoolConfig) { c.Workers = -1 }, false},
+		{"negative queue", func(c *types.CommandPoolConfig) { c.QueueSize = -1 }, false},
+		{"unknown tool", func(c *types.CommandPoolConfig) { c.ToolLimits["kubeclt"] = 1 }, false},
+		{"zero tool limit", func(c *types.CommandPoolConfig) { c.ToolLimits["kubectl"] = 0 }, false},
+		{"remediation limit", func(c *types.CommandPoolConfig) { c.ToolLimits["remediation"] = 2 }, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := types.DefaultConfig()
+			tt.modify(&config.CommandPool)
+
+			err := validateConfig(config)
+			if (err == nil) != tt.valid {
+				t.Errorf("validateConfig error = %v, want valid = %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestValidateConfig_Remediation(t *testing.T) {
+	config := types.DefaultConfig()
+	config.Remediation.Enabled = true
+	if err := validateConfig(config); err != nil {
+		t.Errorf("validateConfig error = %v, want nil", err)
+	}
+
+	config.Remediation.PolicyFile = ""
+	if err := validateConfig(config); err == nil {
+		t.Error("validateConfig accepted remediation without a policy file")
+	}
+}
+
+func TestValidateConfig_DevModeWithKubeconfig(t *testing.T) {
+	tests := []struct {
+		name       string
+		kubernetes types.KubernetesConfig
+	}{
+		{"Kubeconfig", types.KubernetesConfig{Kubeconfig: "/home/dev/.kube/config"}},
+		{"Context", types.KubernetesConfig{Context: "staging"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := types.DefaultConfig()
+			config.DevMode = true
+			config.Kubernetes = tt.kubernetes
+
+			if err := validateConfig(config); err == nil {
+				t.Error("validateConfig should fail when dev_mode is combined with a kubeconfig")
+			}
+		})
+	}
+}
+
+func TestValidateConfig_Clusters(t *testing.T) {
+	tests := []struct {
+		name     string
+		modify   func(*types.AgentConfig)
+		clusters []types.ClusterConfig
+		wantErr  bool
+	}{
+		{
+			name: "Valid",
+			clusters: []types.ClusterConfig{
+				{ClusterID: "edge-1", Kubernetes: types.KubernetesConfig{Context: "edge-1"}},
+				{Kubernetes: types.KubernetesConfig{Context: "edge-2"}},
+			},
+		},
+		{
+			name:   "TopLevelClusterID",
+			modify: func(c *types.AgentConfig) { c.ClusterID = "edge" },
+			clusters: []types.ClusterConfig{
+				{Kubernetes: types.KubernetesConfig{Context: "edge-1"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "DuplicateTarget",
+			clusters: []types.ClusterConfig{
+				{ClusterID: "edge-1", Kubernetes: types.KubernetesConfig{Context: "edge-1"}},
+				{ClusterID: "edge-2", Kubernetes: types.KubernetesConfig{Context: "edge-1"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "DuplicateClusterID",
+			clusters: []types.ClusterConfig{
+				{ClusterID: "edge", Kubernetes: types.KubernetesConfig{Context: "edge-1"}},
+				{ClusterID: "edge", Kubernetes: types.KubernetesConfig{Context: "edge-2"}},
+			},
+			wantErr: true,
+		},
+		{
+			name:     "DevModeWithClusterIDs",
+			modify:   func(c *types.AgentConfig) { c.DevMode = true },
+			clusters: []types.ClusterConfig{{ClusterID: "dev-1"}, {ClusterID: "dev-2"}},
+		},
+		{
+			name:     "DevModeWithoutClusterID",
+			modify:   func(c *types.AgentConfig) { c.DevMode = true },
+			clusters: []types.ClusterConfig{{ClusterID: "dev-1"}, {}},
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := types.DefaultConfig()
+			config.Clusters = tt.clusters
+			if tt.modify != nil {
+				tt.modify(config)
+			}
+
+			err := validateConfig(config)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
 func TestOverrideWithEnv(t *testing.T) {
 	// Set environment variables
 	os.Setenv("CLUSTER_ID", "env-cluster")
@@ -162,12 +464,20 @@ func TestOverrideWithEnv(t *testing.T) {
 	os.Setenv("LOG_LEVEL", "debug")
 	os.Setenv("RECONNECT_DELAY", "10s")
 	os.Setenv("ENABLE_METRICS", "false")
+	os.Setenv("ENABLE_JETSTREAM", "true")
+	os.Setenv("SPOOL_DIR", "/data/spool")
+	os.Setenv("KUBE_CONTEXT", "staging")
+	os.Setenv("DEV_MODE", "true")
 	defer func() {
 		os.Unsetenv("CLUSTER_ID")
 		os.Unsetenv("CENTRAL_ENDPOINT")
 		os.Unsetenv("LOG_LEVEL")
 		os.Unsetenv("RECONNECT_DELAY")
 		os.Unsetenv("ENABLE_METRICS")
+		os.Unsetenv("ENABLE_JETSTREAM")
+		os.Unsetenv("SPOOL_DIR")
+		os.Unsetenv("KUBE_CONTEXT")
+		os.Unsetenv("DEV_MODE")
 	}()
 
 	config := types.DefaultConfig()
@@ -192,6 +502,22 @@ func TestOverrideWithEnv(t *testing.T) {
 	if config.EnableMetrics != false {
 		t.Errorf("EnableMetrics = %v, want %v", config.EnableMetrics, false)
 	}
+
+	if config.EnableJetStream != true {
+		t.Errorf("EnableJetStream = %v, want %v", config.EnableJetStream, true)
+	}
+
+	if config.Spool.Dir != "/data/spool" {
+		t.Errorf("Spool.Dir = %v, want %v", config.Spool.Dir, "/data/spool")
+	}
+
+	if config.Kubernetes.Context != "staging" {
+		t.Errorf("Kubernetes.Context = %v, want %v", config.Kubernetes.Context, "staging")
+	}
+
+	if config.DevMode != true {
+		t.Errorf("DevMode = %v, want %v", config.DevMode, true)
+	}
 }
 
 func TestGetDefaultConfigYAML(t *testing.T) {
@@ -222,4 +548,4 @@ func TestGetDefaultConfigYAML(t *testing.T) {
 func contains(s, substr string) bool {
 	return len(s) > 0 && len(substr) > 0 && s != substr && (len(s) >= len(substr)) &&
 		(s[:len(substr)] == substr || contains(s[1:], substr))
-}
\ No newline at end of file
+}
@@ -0,0 +1,143 @@
+// Package remediation implements the local policy deciding which remediation
+// actions agent-manager may have the agent run, and where.
+//
+// A policy is a list of rules, each allowing some actions in some namespaces.
+// Namespaces are glob patterns as understood by path.Match. The node actions,
+// cordon and uncordon, are allowed by rules listing no namespaces. Anything
+// no rule allows is refused, so an empty policy refuses every remediation.
+package remediation
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/kart-io/k8s-agent/protocol"
+)
+
+// AnyAction stands for every remediation action in the actions of a rule
+const AnyAction = "*"
+
+// ErrInvalidPolicy is returned for policy files that cannot be used
+var ErrInvalidPolicy = errors.New("invalid remediation policy")
+
+// ErrNotAllowed is returned for remediations no rule of the policy allows
+var ErrNotAllowed = errors.New("not allowed by the remediation policy")
+
+// Policy lists the remediations the agent may run
+type Policy struct {
+	Rules []Rule `yaml:"rules" json:"rules"`
+}
+
+// Rule allows actions in namespaces
+type Rule struct {
+	Name       string   `yaml:"name" json:"name"`
+	Actions    []string `yaml:"actions" json:"actions"`
+	Namespaces []string `yaml:"namespaces,omitempty" json:"namespaces,omitempty"`
+
+	// MaxReplicas bounds the replicas scale may set; 0 leaves them unbounded
+	MaxReplicas int `yaml:"max_replicas,omitempty" json:"max_replicas,omitempty"`
+}
+
+// Request is a remediation checked against the policy
+type Request struct {
+	Action    string
+	Namespace string // empty for node actions
+	Replicas  int    // replicas set by scale
+}
+
+// Load reads and parses a policy file
+func Load(file string) (*Policy, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read remediation policy: %w", err)
+	}
+	return Parse(data)
+}
+
+// Parse decodes and validates a YAML policy
+func Parse(data []byte) (*Policy, error) {
+	var p Policy
+	if err := yaml.UnmarshalStrict(data, &p); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPolicy, err)
+	}
+	if err := p.validate(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPolicy, err)
+	}
+	return &p, nil
+}
+
+// validate checks the actions and namespace patterns of the rules
+func (p *Policy) validate() error {
+	actions := protocol.RemediationActions()
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i)
+		}
+
+		if len(rule.Actions) == 0 {
+			return fmt.Errorf("rule %q: actions are required", rule.Name)
+		}
+		for _, action := range rule.Actions {
+			if action != AnyAction && !slices.Contains(actions, action) {
+				return fmt.Errorf("rule %q: unknown action %q", rule.Name, action)
+			}
+		}
+		for _, pattern := range rule.Namespaces {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("rule %q: invalid namespace pattern %q: %w", rule.Name, pattern, err)
+			}
+		}
+		if rule.MaxReplicas < 0 {
+			return fmt.Errorf("rule %q: max_replicas must not be negative", rule.Name)
+		}
+	}
+	return nil
+}
+
+// Allow returns the name of the first rule allowing a remediation, or an
+// error wrapping ErrNotAllowed with why none does
+func (p *Policy) Allow(req Request) (string, error) {
+	var tooMany *Rule
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if !rule.allows(req) {
+			continue
+		}
+		if req.Action == protocol.RemediationScale && rule.MaxReplicas > 0 && req.Replicas > rule.MaxReplicas {
+			tooMany = rule
+			continue
+		}
+		return rule.Name, nil
+	}
+
+	switch {
+	case tooMany != nil:
+		return "", fmt.Errorf("%w: rule %q allows scaling to at most %d replicas", ErrNotAllowed, tooMany.Name, tooMany.MaxReplicas)
+	case protocol.RemediationClusterScoped(req.Action):
+		return "", fmt.Errorf("%w: %s of nodes", ErrNotAllowed, req.Action)
+	default:
+		return "", fmt.Errorf("%w: %s in namespace %q", ErrNotAllowed, req.Action, req.Namespace)
+	}
+}
+
+// allows reports whether the rule covers the action in the namespace of a request
+func (r *Rule) allows(req Request) bool {
+	if !slices.Contains(r.Actions, AnyAction) && !slices.Contains(r.Actions, req.Action) {
+		return false
+	}
+	if protocol.RemediationClusterScoped(req.Action) {
+		return len(r.Namespaces) == 0
+	}
+	for _, pattern := range r.Namespaces {
+		if ok, _ := path.Match(pattern, req.Namespace); ok {
+			return true
+		}
+	}
+	return false
+}
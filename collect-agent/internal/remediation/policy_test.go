@@ -0,0 +1,118 @@
+package remediation
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPolicyAllow(t *testing.T) {
+	p, err := Parse([]byte(`
+rules:
+  - name: web-restarts
+    actions: [rollout-restart, delete-pod, scale]
+    namespaces: [web, "team-*"]
+    max_replicas: 5
+  - name: batch-scaling
+    actions: [scale]
+    namespaces: [team-batch]
+  - name: nodes
+    actions: [cordon, uncordon]
+  - name: staging
+    actions: ["*"]
+    namespaces: [staging]
+`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		req      Request
+		wantRule string
+		wantErr  string
+	}{
+		{"listed namespace", Request{Action: "rollout-restart", Namespace: "web"}, "web-restarts", ""},
+		{"namespace pattern", Request{Action: "delete-pod", Namespace: "team-a"}, "web-restarts", ""},
+		{"action not listed", Request{Action: "patch-resources", Namespace: "web"}, "", `patch-resources in namespace "web"`},
+		{"namespace not listed", Request{Action: "delete-pod", Namespace: "kube-system"}, "", `delete-pod in namespace "kube-system"`},
+		{"replicas within bound", Request{Action: "scale", Namespace: "web", Replicas: 5}, "web-restarts", ""},
+		{"replicas above bound", Request{Action: "scale", Namespace: "web", Replicas: 6}, "", `rule "web-restarts" allows scaling to at most 5 replicas`},
+		{"replicas allowed by a later rule", Request{Action: "scale", Namespace: "team-batch", Replicas: 50}, "batch-scaling", ""},
+		{"node action", Request{Action: "cordon"}, "nodes", ""},
+		{"any action", Request{Action: "patch-resources", Namespace: "staging"}, "staging", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, err := p.Allow(tt.req)
+			if tt.wantErr != "" {
+				if !errors.Is(err, ErrNotAllowed) || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Allow() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || rule != tt.wantRule {
+				t.Errorf("Allow() = %q, %v, want %q", rule, err, tt.wantRule)
+			}
+		})
+	}
+}
+
+func TestPolicyNodeActions(t *testing.T) {
+	// Rules with namespaces do not reach nodes, even for every action
+	p, err := Parse([]byte(`
+rules:
+  - actions: ["*"]
+    namespaces: ["*"]
+`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if _, err := p.Allow(Request{Action: "uncordon"}); !errors.Is(err, ErrNotAllowed) {
+		t.Errorf("Allow(uncordon) error = %v, want %v", err, ErrNotAllowed)
+	}
+
+	empty, _ := Parse(nil)
+	if _, err := empty.Allow(Request{Action: "delete-pod", Namespace: "web"}); !errors.Is(err, ErrNotAllowed) {
+		t.Errorf("Allow() of an empty policy error = %v, want %v", err, ErrNotAllowed)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	tests := map[string]string{
+		"unknown action":   "rules:\n  - actions: [drain]\n",
+		"no actions":       "rules:\n  - namespaces: [web]\n",
+		"bad pattern":      "rules:\n  - actions: [scale]\n    namespaces: [\"[\"]\n",
+		"negative replica": "rules:\n  - actions: [scale]\n    namespaces: [web]\n    max_replicas: -1\n",
+		"unknown field":    "rules:\n  - actions: [scale]\n    namespace: web\n",
+	}
+
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := Parse([]byte(data)); !errors.Is(err, ErrInvalidPolicy) {
+				t.Errorf("Parse() error = %v, want %v", err, ErrInvalidPolicy)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "policy.yaml")
+	if _, err := Load(file); err == nil {
+		t.Error("Load() of a missing file succeeded")
+	}
+
+	if err := os.WriteFile(file, []byte("rules:\n  - actions: [cordon]\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := Load(file)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if rule, err := p.Allow(Request{Action: "cordon"}); err != nil || rule != "rule-0" {
+		t.Errorf("Allow() = %q, %v, want rule-0", rule, err)
+	}
+}
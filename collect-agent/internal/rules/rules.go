@@ -0,0 +1,286 @@
+// Package rules implements the declarative filter rules that decide which
+// Kubernetes events the agent forwards and with which severity.
+//
+// A rule set is an ordered list of rules. The first rule whose match block
+// matches an event decides whether the event is included or excluded; events
+// matching no rule get the default action. All fields of a match block must
+// match, and a list field matches if any of its entries does. String entries
+// are glob patterns as understood by path.Match.
+package rules
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+	corev1 "k8s.io/api/core/v1"
+	eventsv1 "k8s.io/api/events/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Rule actions
+const (
+	ActionInclude = "include"
+	ActionExclude = "exclude"
+)
+
+// Severity levels assigned to included events
+const (
+	SeverityCritical = "critical"
+	SeverityHigh     = "high"
+	SeverityMedium   = "medium"
+	SeverityLow      = "low"
+)
+
+// defaultRulesYAML holds the built-in rules
+//
+//go:embed default_rules.yaml
+var defaultRulesYAML []byte
+
+// ErrInvalidRules is returned for rule files that cannot be used
+var ErrInvalidRules = errors.New("invalid event rules")
+
+// RuleSet is an ordered list of event filter rules
+type RuleSet struct {
+	DefaultAction string `yaml:"default_action" json:"default_action"`
+	Rules         []Rule `yaml:"rules" json:"rules"`
+}
+
+// Rule includes or excludes the events it matches
+type Rule struct {
+	Name     string `yaml:"name" json:"name"`
+	Match    Match  `yaml:"match" json:"match"`
+	Action   string `yaml:"action" json:"action"`
+	Severity string `yaml:"severity,omitempty" json:"severity,omitempty"`
+}
+
+// Match selects events. Empty fields match every event.
+type Match struct {
+	Reasons    []string `yaml:"reasons,omitempty" json:"reasons,omitempty"`
+	Types      []string `yaml:"types,omitempty" json:"types,omitempty"`
+	Kinds      []string `yaml:"kinds,omitempty" json:"kinds,omitempty"`
+	Namespaces []string `yaml:"namespaces,omitempty" json:"namespaces,omitempty"`
+	Message    string   `yaml:"message,omitempty" json:"message,omitempty"` // regular expression
+	Labels     string   `yaml:"labels,omitempty" json:"labels,omitempty"`   // label selector, e.g. "app=web,tier!=db"
+
+	message  *regexp.Regexp
+	selector labels.Selector
+}
+
+// Event holds the event fields rules match on
+type Event struct {
+	Reason    string
+	Type      string
+	Kind      string
+	Namespace string
+	Message   string
+	Labels    map[string]string
+}
+
+// Decision is the outcome of evaluating a rule set against an event
+type Decision struct {
+	Include  bool   `json:"include"`
+	Severity string `json:"severity,omitempty"`
+	Rule     string `json:"rule"` // name of the matching rule, empty for the default action
+}
+
+// FromKubernetes extracts the matched fields of a Kubernetes event. Labels
+// are the labels of the event object itself.
+func FromKubernetes(event *corev1.Event) Event {
+	namespace := event.InvolvedObject.Namespace
+	if namespace == "" {
+		namespace = event.Namespace
+	}
+
+	return Event{
+		Reason:    event.Reason,
+		Type:      event.Type,
+		Kind:      event.InvolvedObject.Kind,
+		Namespace: namespace,
+		Message:   event.Message,
+		Labels:    event.Labels,
+	}
+}
+
+// FromEventsV1 extracts the matched fields of an events.k8s.io/v1 event
+func FromEventsV1(event *eventsv1.Event) Event {
+	namespace := event.Regarding.Namespace
+	if namespace == "" {
+		namespace = event.Namespace
+	}
+
+	return Event{
+		Reason:    event.Reason,
+		Type:      event.Type,
+		Kind:      event.Regarding.Kind,
+		Namespace: namespace,
+		Message:   event.Note,
+		Labels:    event.Labels,
+	}
+}
+
+// Default returns the built-in rule set
+func Default() *RuleSet {
+	rs, err := Parse(defaultRulesYAML)
+	if err != nil {
+		panic(fmt.Sprintf("built-in event rules are invalid: %v", err))
+	}
+	return rs
+}
+
+// DefaultYAML returns the source of the built-in rule set
+func DefaultYAML() []byte {
+	return append([]byte(nil), defaultRulesYAML...)
+}
+
+// Parse decodes and validates a YAML rule set
+func Parse(data []byte) (*RuleSet, error) {
+	var rs RuleSet
+	if err := yaml.UnmarshalStrict(data, &rs); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRules, err)
+	}
+	if err := rs.compile(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRules, err)
+	}
+	return &rs, nil
+}
+
+// compile validates the rule set and prepares its regular expressions and selectors
+func (rs *RuleSet) compile() error {
+	if rs.DefaultAction == "" {
+		rs.DefaultAction = ActionExclude
+	}
+	if rs.DefaultAction != ActionInclude && rs.DefaultAction != ActionExclude {
+		return fmt.Errorf("default_action must be %q or %q", ActionInclude, ActionExclude)
+	}
+
+	names := make(map[string]bool)
+	for i := range rs.Rules {
+		rule := &rs.Rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i)
+		}
+		if names[rule.Name] {
+			return fmt.Errorf("duplicate rule name %q", rule.Name)
+		}
+		names[rule.Name] = true
+
+		if err := rule.compile(); err != nil {
+			return fmt.Errorf("rule %q: %w", rule.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// compile validates a rule
+func (r *Rule) compile() error {
+	switch r.Action {
+	case ActionInclude, ActionExclude:
+	default:
+		return fmt.Errorf("action must be %q or %q", ActionInclude, ActionExclude)
+	}
+
+	switch r.Severity {
+	case "", SeverityCritical, SeverityHigh, SeverityMedium, SeverityLow:
+	default:
+		return fmt.Errorf("severity must be one of %s, %s, %s, %s",
+			SeverityCritical, SeverityHigh, SeverityMedium, SeverityLow)
+	}
+	if r.Severity != "" && r.Action == ActionExclude {
+		return fmt.Errorf("severity cannot be set on an exclude rule")
+	}
+
+	for _, patterns := range [][]string{r.Match.Reasons, r.Match.Types, r.Match.Kinds, r.Match.Namespaces} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+			}
+		}
+	}
+
+	if r.Match.Message != "" {
+		re, err := regexp.Compile(r.Match.Message)
+		if err != nil {
+			return fmt.Errorf("invalid message expression: %w", err)
+		}
+		r.Match.message = re
+	}
+
+	if r.Match.Labels != "" {
+		selector, err := labels.Parse(r.Match.Labels)
+		if err != nil {
+			return fmt.Errorf("invalid label selector: %w", err)
+		}
+		r.Match.selector = selector
+	}
+
+	return nil
+}
+
+// Evaluate returns the decision of the first rule matching the event
+func (rs *RuleSet) Evaluate(event Event) Decision {
+	for _, rule := range rs.Rules {
+		if !rule.Match.matches(event) {
+			continue
+		}
+
+		if rule.Action == ActionExclude {
+			return Decision{Rule: rule.Name}
+		}
+		return Decision{Include: true, Severity: severity(rule.Severity, event), Rule: rule.Name}
+	}
+
+	if rs.DefaultAction == ActionInclude {
+		return Decision{Include: true, Severity: severity("", event)}
+	}
+	return Decision{}
+}
+
+// matches reports whether every field of the match block matches the event
+func (m *Match) matches(event Event) bool {
+	if !matchAny(m.Reasons, event.Reason) ||
+		!matchAny(m.Types, event.Type) ||
+		!matchAny(m.Kinds, event.Kind) ||
+		!matchAny(m.Namespaces, event.Namespace) {
+		return false
+	}
+
+	if m.message != nil && !m.message.MatchString(event.Message) {
+		return false
+	}
+
+	if m.selector != nil && !m.selector.Matches(labels.Set(event.Labels)) {
+		return false
+	}
+
+	return true
+}
+
+// matchAny reports whether value matches one of the glob patterns, or patterns is empty
+func matchAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// severity returns the rule severity, or the default for the event type
+func severity(ruleSeverity string, event Event) string {
+	if ruleSeverity != "" {
+		return ruleSeverity
+	}
+	if strings.EqualFold(event.Type, corev1.EventTypeWarning) {
+		return SeverityMedium
+	}
+	return SeverityLow
+}
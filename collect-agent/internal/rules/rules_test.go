@@ -0,0 +1,270 @@
+package rules
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	eventsv1 "k8s.io/api/events/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestDefaultRules(t *testing.T) {
+	rs := Default()
+
+	tests := []struct {
+		reason    string
+		eventType string
+		include   bool
+		severity  string
+	}{
+		{"CrashLoopBackOff", "Warning", true, SeverityCritical},
+		{"OOMKilling", "Warning", true, SeverityCritical},
+		{"FailedScheduling", "Warning", true, SeverityCritical},
+		{"FailedMount", "Normal", true, SeverityCritical},
+		{"ContainerGCFailed", "Warning", true, SeverityCritical},
+		{"NodeNotReady", "Normal", true, SeverityCritical},
+		{"BackOff", "Warning", true, SeverityHigh},
+		{"ImagePullBackOff", "Warning", true, SeverityHigh},
+		{"Unhealthy", "Warning", true, SeverityHigh},
+		{"BackOff", "Normal", true, SeverityLow},
+		{"NodeNotSchedulable", "Warning", true, SeverityMedium},
+		{"Pulling", "Normal", true, SeverityMedium},
+		{"Pulling", "Warning", true, SeverityMedium},
+		{"Starting", "Normal", true, SeverityMedium},
+		{"DNSConfigForming", "Normal", true, SeverityLow},
+		{"Scheduled", "Normal", false, ""},
+		{"Evicted", "Warning", false, ""},
+		{"Failed", "Error", false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.eventType+"/"+tt.reason, func(t *testing.T) {
+			decision := rs.Evaluate(Event{Reason: tt.reason, Type: tt.eventType})
+			if decision.Include != tt.include {
+				t.Errorf("Include = %v, want %v", decision.Include, tt.include)
+			}
+			if decision.Severity != tt.severity {
+				t.Errorf("Severity = %v, want %v", decision.Severity, tt.severity)
+			}
+		})
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	rs, err := Parse([]byte(`
+default_action: include
+rules:
+  - name: drop-kube-system-pulls
+    match:
+      reasons: [Pull*]
+      namespaces: [kube-*]
+    action: exclude
+  - name: evictions
+    match:
+      reasons: [Evicted]
+      kinds: [Pod]
+      message: "memory|ephemeral-storage"
+    action: include
+    severity: critical
+  - name: web-warnings
+    match:
+      types: [Warning]
+      labels: "app=web,tier!=db"
+    action: include
+    severity: high
+`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		event    Event
+		include  bool
+		severity string
+		rule     string
+	}{
+		{
+			name:  "glob exclude",
+			event: Event{Reason: "Pulling", Type: "Normal", Namespace: "kube-system"},
+			rule:  "drop-kube-system-pulls",
+		},
+		{
+			name:     "glob does not match other namespaces",
+			event:    Event{Reason: "Pulling", Type: "Normal", Namespace: "demo"},
+			include:  true,
+			severity: SeverityLow,
+		},
+		{
+			name:     "message expression",
+			event:    Event{Reason: "Evicted", Type: "Warning", Kind: "Pod", Message: "The node was low on resource: memory."},
+			include:  true,
+			severity: SeverityCritical,
+			rule:     "evictions",
+		},
+		{
+			name:     "message expression mismatch",
+			event:    Event{Reason: "Evicted", Type: "Warning", Kind: "Pod", Message: "Preempted"},
+			include:  true,
+			severity: SeverityMedium,
+		},
+		{
+			name:     "label selector",
+			event:    Event{Reason: "Unhealthy", Type: "Warning", Labels: map[string]string{"app": "web"}},
+			include:  true,
+			severity: SeverityHigh,
+			rule:     "web-warnings",
+		},
+		{
+			name:     "label selector mismatch",
+			event:    Event{Reason: "Unhealthy", Type: "Warning", Labels: map[string]string{"app": "web", "tier": "db"}},
+			include:  true,
+			severity: SeverityMedium,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision := rs.Evaluate(tt.event)
+			if decision.Include != tt.include {
+				t.Errorf("Include = %v, want %v", decision.Include, tt.include)
+			}
+			if decision.Severity != tt.severity {
+				t.Errorf("Severity = %v, want %v", decision.Severity, tt.severity)
+			}
+			if decision.Rule != tt.rule {
+				t.Errorf("Rule = %v, want %v", decision.Rule, tt.rule)
+			}
+		})
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+	}{
+		{"bad default action", "default_action: drop\n"},
+		{"bad action", "rules:\n  - match: {reasons: [Failed]}\n    action: keep\n"},
+		{"bad severity", "rules:\n  - action: include\n    severity: urgent\n"},
+		{"severity on exclude", "rules:\n  - action: exclude\n    severity: high\n"},
+		{"bad pattern", "rules:\n  - match: {reasons: ['[']}\n    action: include\n"},
+		{"bad message expression", "rules:\n  - match: {message: '('}\n    action: include\n"},
+		{"bad label selector", "rules:\n  - match: {labels: 'app in (web'}\n    action: include\n"},
+		{"duplicate name", "rules:\n  - name: a\n    action: include\n  - name: a\n    action: exclude\n"},
+		{"unknown field", "rules:\n  - action: include\n    match: {reason: Failed}\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.yaml))
+			if !errors.Is(err, ErrInvalidRules) {
+				t.Errorf("Parse error = %v, want %v", err, ErrInvalidRules)
+			}
+		})
+	}
+}
+
+func TestFromKubernetes(t *testing.T) {
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web-1.17a",
+			Namespace: "demo",
+			Labels:    map[string]string{"app": "web"},
+		},
+		InvolvedObject: corev1.ObjectReference{Kind: "Pod", Name: "web-1"},
+		Reason:         "BackOff",
+		Type:           corev1.EventTypeWarning,
+		Message:        "Back-off restarting failed container",
+	}
+
+	got := FromKubernetes(event)
+	if got.Namespace != "demo" {
+		t.Errorf("Namespace = %v, want %v", got.Namespace, "demo")
+	}
+	if got.Kind != "Pod" || got.Reason != "BackOff" || got.Type != "Warning" {
+		t.Errorf("FromKubernetes = %+v", got)
+	}
+	if got.Labels["app"] != "web" {
+		t.Errorf("Labels = %v, want app=web", got.Labels)
+	}
+}
+
+func TestFromEventsV1(t *testing.T) {
+	event := &eventsv1.Event{
+		ObjectMeta: metav1.ObjectMeta{Name: "web-1.17a", Namespace: "demo"},
+		Regarding:  corev1.ObjectReference{Kind: "Pod", Name: "web-1"},
+		Reason:     "BackOff",
+		Type:       corev1.EventTypeWarning,
+		Note:       "Back-off restarting failed container",
+	}
+
+	got := FromEventsV1(event)
+	if got.Namespace != "demo" || got.Kind != "Pod" || got.Message != event.Note {
+		t.Errorf("FromEventsV1 = %+v", got)
+	}
+}
+
+func TestStoreReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	write := func(data string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("rules:\n  - reasons: [Evicted]\n")
+	if _, err := NewStore(path, time.Second, zap.NewNop()); err == nil {
+		t.Fatal("NewStore should fail on an invalid rules file")
+	}
+
+	write("rules:\n  - match: {reasons: [Evicted]}\n    action: include\n")
+	store, err := NewStore(path, time.Second, zap.NewNop())
+	if err != nil {
+		t.Fatalf("NewStore failed: %v", err)
+	}
+	evicted := Event{Reason: "Evicted", Type: "Warning"}
+	if !store.RuleSet().Evaluate(evicted).Include {
+		t.Error("Evicted should be included")
+	}
+
+	// Unchanged files are not reparsed
+	if changed, err := store.Reload(); changed || err != nil {
+		t.Errorf("Reload = %v, %v, want false, nil", changed, err)
+	}
+
+	// Invalid changes keep the previous rules
+	write("rules:\n  - match: {reasons: [Evicted]}\n    action: drop\n")
+	if _, err := store.Reload(); err == nil {
+		t.Error("Reload should fail on an invalid rules file")
+	}
+	if !store.RuleSet().Evaluate(evicted).Include {
+		t.Error("previous rules not kept after an invalid reload")
+	}
+
+	write("rules:\n  - match: {reasons: [Evicted]}\n    action: exclude\n")
+	if changed, err := store.Reload(); !changed || err != nil {
+		t.Errorf("Reload = %v, %v, want true, nil", changed, err)
+	}
+	if store.RuleSet().Evaluate(evicted).Include {
+		t.Error("Evicted should be excluded after reload")
+	}
+
+	stats := store.GetStatistics()
+	if stats["reloads"] != int64(1) || stats["reload_errors"] != int64(1) {
+		t.Errorf("statistics = %v, want 1 reload and 1 reload error", stats)
+	}
+}
+
+func TestNilStore(t *testing.T) {
+	var store *Store
+	if store.RuleSet() == nil {
+		t.Fatal("nil store should return the built-in rules")
+	}
+}
@@ -0,0 +1,192 @@
+package rules
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// builtin is the parsed built-in rule set, shared by every user of the defaults
+var builtin = sync.OnceValue(Default)
+
+// Store holds the active rule set. When backed by a file, for example a
+// mounted ConfigMap, the file is polled and valid changes replace the rules
+// without a restart; invalid changes are logged and the previous rules kept.
+type Store struct {
+	path     string
+	interval time.Duration
+	logger   *zap.Logger
+
+	current atomic.Pointer[RuleSet]
+	source  []byte
+
+	stopCh   chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+
+	// Metrics
+	mu           sync.RWMutex
+	reloads      int64
+	reloadErrors int64
+	lastReload   time.Time
+	lastError    string
+}
+
+// NewStore creates a store holding the rules of path, or the built-in rules when path is empty
+func NewStore(path string, interval time.Duration, logger *zap.Logger) (*Store, error) {
+	s := &Store{
+		path:     path,
+		interval: interval,
+		logger:   logger.With(zap.String("component", "event-rules")),
+		stopCh:   make(chan struct{}),
+	}
+
+	if path == "" {
+		s.current.Store(builtin())
+		return s, nil
+	}
+
+	data, rs, err := LoadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s.source = data
+	s.current.Store(rs)
+	s.lastReload = time.Now()
+
+	s.logger.Info("Event rules loaded",
+		zap.String("path", path),
+		zap.Int("rules", len(rs.Rules)))
+
+	return s, nil
+}
+
+// LoadFile reads and parses a rule file
+func LoadFile(path string) ([]byte, *RuleSet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read event rules: %w", err)
+	}
+
+	rs, err := Parse(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse event rules %s: %w", path, err)
+	}
+
+	return data, rs, nil
+}
+
+// RuleSet returns the active rules; a nil store returns the built-in rules
+func (s *Store) RuleSet() *RuleSet {
+	if s == nil {
+		return builtin()
+	}
+	return s.current.Load()
+}
+
+// Start starts polling the rule file for changes
+func (s *Store) Start() {
+	if s.path == "" || s.interval <= 0 {
+		return
+	}
+
+	s.wg.Add(1)
+	go s.watch()
+}
+
+// Stop stops polling the rule file
+func (s *Store) Stop() {
+	s.stopOnce.Do(func() { close(s.stopCh) })
+	s.wg.Wait()
+}
+
+// watch reloads the rule file every interval
+func (s *Store) watch() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case <-ticker.C:
+			if _, err := s.Reload(); err != nil {
+				s.logger.Error("Failed to reload event rules, keeping previous rules",
+					zap.String("path", s.path),
+					zap.Error(err))
+			}
+		}
+	}
+}
+
+// Reload re-reads the rule file and reports whether the rules changed
+func (s *Store) Reload() (bool, error) {
+	if s.path == "" {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		s.recordError(err)
+		return false, fmt.Errorf("failed to read event rules: %w", err)
+	}
+	if bytes.Equal(data, s.source) {
+		return false, nil
+	}
+
+	rs, err := Parse(data)
+	if err != nil {
+		s.recordError(err)
+		return false, err
+	}
+
+	s.source = data
+	s.current.Store(rs)
+
+	s.mu.Lock()
+	s.reloads++
+	s.lastReload = time.Now()
+	s.lastError = ""
+	s.mu.Unlock()
+
+	s.logger.Info("Event rules reloaded",
+		zap.String("path", s.path),
+		zap.Int("rules", len(rs.Rules)))
+
+	return true, nil
+}
+
+// recordError counts a failed reload
+func (s *Store) recordError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reloadErrors++
+	s.lastError = err.Error()
+}
+
+// GetStatistics returns rule store statistics
+func (s *Store) GetStatistics() map[string]interface{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	source := s.path
+	if source == "" {
+		source = "built-in"
+	}
+
+	return map[string]interface{}{
+		"source":        source,
+		"rules":         len(s.RuleSet().Rules),
+		"reloads":       s.reloads,
+		"reload_errors": s.reloadErrors,
+		"last_reload":   s.lastReload,
+		"last_error":    s.lastError,
+	}
+}
@@ -0,0 +1,857 @@
+// Package spool implements a bounded, crash-safe on-disk queue used to buffer
+// outgoing messages while the agent cannot reach NATS.
+//
+// Records are appended to segment files, one directory per priority. Each
+// record is framed with its length and a CRC32 checksum so that a torn write
+// left behind by a crash is detected and truncated when the spool is reopened.
+// The read position of every queue is persisted in a cursor file, which makes
+// delivery at-least-once: records drained but not yet checkpointed before a
+// crash are delivered again and de-duplicated downstream by their message ID.
+package spool
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// frameHeaderSize is the size of the length and checksum prefix of a record
+	frameHeaderSize = 8
+
+	// segmentExt is the file extension of segment files
+	segmentExt = ".seg"
+
+	// cursorFile stores the read position of a queue
+	cursorFile = "cursor"
+
+	// checkpointEvery is the number of drained records between cursor writes
+	checkpointEvery = 100
+)
+
+// ErrRecordTooLarge is returned when a record does not fit in a single segment
+var ErrRecordTooLarge = errors.New("record exceeds maximum segment size")
+
+// ErrClosed is returned when the spool is used after Close
+var ErrClosed = errors.New("spool is closed")
+
+// ErrUndeliverable is wrapped by publish errors that retrying cannot fix, for
+// example a record larger than the server accepts. Drain drops such records.
+var ErrUndeliverable = errors.New("record cannot be delivered")
+
+// Priority determines the order in which spooled records are drained
+type Priority int
+
+const (
+	PriorityCritical Priority = iota
+	PriorityNormal
+	PriorityLow
+)
+
+// priorities lists all priorities in drain order
+var priorities = []Priority{PriorityCritical, PriorityNormal, PriorityLow}
+
+// String returns the name of the priority
+func (p Priority) String() string {
+	switch p {
+	case PriorityCritical:
+		return "critical"
+	case PriorityNormal:
+		return "normal"
+	case PriorityLow:
+		return "low"
+	default:
+		return "unknown"
+	}
+}
+
+// Options configures a Spool
+type Options struct {
+	// Dir is the directory holding the segment files
+	Dir string
+	// MaxSegmentBytes is the size at which a new segment file is started
+	MaxSegmentBytes int64
+	// MaxTotalBytes caps the disk usage of the spool; the oldest segments of
+	// the lowest priority are discarded first when it is exceeded
+	MaxTotalBytes int64
+	// MaxAge discards segments whose last write is older than this, 0 disables it
+	MaxAge time.Duration
+	// Sync fsyncs every appended record
+	Sync bool
+}
+
+// Record is a message waiting to be published
+type Record struct {
+	Subject   string
+	MessageID string
+	Timestamp time.Time
+	Data      []byte
+}
+
+// Stats describes the current content of the spool
+type Stats struct {
+	Records    int64            `json:"records"`
+	Bytes      int64            `json:"bytes"`
+	Dropped    int64            `json:"dropped"`
+	ByPriority map[string]int64 `json:"by_priority"`
+}
+
+// segment is a single append-only file of records
+type segment struct {
+	seq     uint64
+	path    string
+	size    int64
+	records int64
+	modTime time.Time
+}
+
+// cursor is the persisted read position of a queue
+type cursor struct {
+	Segment uint64 `json:"segment"`
+	Offset  int64  `json:"offset"`
+	Records int64  `json:"records"`
+}
+
+// queue holds the segments of a single priority
+type queue struct {
+	priority Priority
+	dir      string
+	segments []*segment
+	nextSeq  uint64
+
+	// writer appends to the last segment, nil until the next append
+	writer *os.File
+	// reader reads from the first segment
+	reader    *os.File
+	readerSeq uint64
+
+	// read position within the first segment
+	readOffset  int64
+	readRecords int64
+	uncommitted int
+}
+
+// Spool is a set of on-disk priority queues
+type Spool struct {
+	opts    Options
+	logger  *zap.Logger
+	mu      sync.Mutex
+	drainMu sync.Mutex
+	queues  []*queue
+	dropped int64
+	closed  bool
+}
+
+// Open opens the spool in opts.Dir, recovering any records left by a previous run
+func Open(opts Options, logger *zap.Logger) (*Spool, error) {
+	if opts.Dir == "" {
+		return nil, fmt.Errorf("spool directory is required")
+	}
+	if opts.MaxSegmentBytes <= frameHeaderSize {
+		return nil, fmt.Errorf("invalid max segment size %d", opts.MaxSegmentBytes)
+	}
+	if opts.MaxTotalBytes < opts.MaxSegmentBytes {
+		return nil, fmt.Errorf("max total size %d is smaller than max segment size %d",
+			opts.MaxTotalBytes, opts.MaxSegmentBytes)
+	}
+
+	s := &Spool{
+		opts:   opts,
+		logger: logger.With(zap.String("component", "spool")),
+	}
+
+	for _, p := range priorities {
+		q, err := s.openQueue(p)
+		if err != nil {
+			s.closeFiles()
+			return nil, err
+		}
+		s.queues = append(s.queues, q)
+	}
+
+	s.mu.Lock()
+	s.enforceLimits()
+	s.mu.Unlock()
+
+	stats := s.Stats()
+	s.logger.Info("Spool opened",
+		zap.String("dir", opts.Dir),
+		zap.Int64("records", stats.Records),
+		zap.Int64("bytes", stats.Bytes))
+
+	return s, nil
+}
+
+// Append writes a record to the queue of the given priority
+func (s *Spool) Append(p Priority, rec *Record) error {
+	frame := encodeRecord(rec)
+	if int64(len(frame)) > s.opts.MaxSegmentBytes {
+		return fmt.Errorf("%w: %d bytes", ErrRecordTooLarge, len(frame))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+
+	q, err := s.queue(p)
+	if err != nil {
+		return err
+	}
+
+	active := q.active()
+	if q.writer == nil || active.size+int64(len(frame)) > s.opts.MaxSegmentBytes {
+		if err := s.rotate(q); err != nil {
+			return err
+		}
+		active = q.active()
+	}
+
+	n, err := q.writer.Write(frame)
+	if err != nil {
+		// Drop the partial frame so the segment stays readable
+		if truncErr := q.writer.Truncate(active.size); truncErr != nil {
+			s.logger.Error("Failed to truncate segment after write error",
+				zap.String("segment", active.path),
+				zap.Error(truncErr))
+			active.size += int64(n)
+			q.closeWriter()
+		}
+		return fmt.Errorf("failed to write spool record: %w", err)
+	}
+
+	if s.opts.Sync {
+		if err := q.writer.Sync(); err != nil {
+			return fmt.Errorf("failed to sync spool segment: %w", err)
+		}
+	}
+
+	active.size += int64(n)
+	active.records++
+	active.modTime = time.Now()
+
+	s.enforceLimits()
+	return nil
+}
+
+// Drain passes spooled records to publish, highest priority first and in
+// append order within a priority. Records publish rejects with an error
+// wrapping ErrUndeliverable are dropped; any other error stops the drain,
+// leaving that record at the head of its queue. It returns the number of
+// records drained.
+func (s *Spool) Drain(publish func(*Record) error) (int, error) {
+	s.drainMu.Lock()
+	defer s.drainMu.Unlock()
+
+	drained := 0
+	defer s.checkpoint()
+
+	for {
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			return drained, ErrClosed
+		}
+		q, seq, rec, next, err := s.peek()
+		s.mu.Unlock()
+
+		if err != nil {
+			return drained, err
+		}
+		if rec == nil {
+			return drained, nil
+		}
+
+		if err := publish(rec); err != nil {
+			if !errors.Is(err, ErrUndeliverable) {
+				return drained, err
+			}
+			s.logger.Error("Dropping undeliverable spool record",
+				zap.String("subject", rec.Subject),
+				zap.String("message_id", rec.MessageID),
+				zap.Error(err))
+			s.mu.Lock()
+			if len(q.segments) > 0 && q.segments[0].seq == seq {
+				// Not already counted by the size or age limit
+				s.dropped++
+			}
+			s.advance(q, seq, next)
+			s.mu.Unlock()
+			continue
+		}
+
+		s.mu.Lock()
+		s.advance(q, seq, next)
+		s.mu.Unlock()
+		drained++
+	}
+}
+
+// Len returns the number of records waiting in the spool
+func (s *Spool) Len() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var records int64
+	for _, q := range s.queues {
+		records += q.pendingRecords()
+	}
+	return records
+}
+
+// Stats returns the number of pending records and bytes per priority
+func (s *Spool) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := Stats{
+		Dropped:    s.dropped,
+		ByPriority: make(map[string]int64, len(s.queues)),
+	}
+	for _, q := range s.queues {
+		records := q.pendingRecords()
+		stats.Records += records
+		stats.Bytes += q.pendingBytes()
+		stats.ByPriority[q.priority.String()] = records
+	}
+	return stats
+}
+
+// Close checkpoints all queues and closes the segment files
+func (s *Spool) Close() error {
+	s.drainMu.Lock()
+	defer s.drainMu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	var firstErr error
+	for _, q := range s.queues {
+		if err := q.writeCursor(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	s.closeFiles()
+	return firstErr
+}
+
+// openQueue loads the segments and cursor of a priority queue from disk
+func (s *Spool) openQueue(p Priority) (*queue, error) {
+	q := &queue{
+		priority: p,
+		dir:      filepath.Join(s.opts.Dir, p.String()),
+		nextSeq:  1,
+	}
+
+	if err := os.MkdirAll(q.dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory %s: %w", q.dir, err)
+	}
+
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spool directory %s: %w", q.dir, err)
+	}
+
+	var seqs []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			s.logger.Warn("Ignoring unexpected file in spool", zap.String("file", name))
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	cur, err := q.readCursor()
+	if err != nil {
+		s.logger.Warn("Ignoring unreadable spool cursor",
+			zap.String("queue", p.String()),
+			zap.Error(err))
+		cur = cursor{}
+	}
+	if cur.Segment > q.nextSeq {
+		// Never reuse the sequence numbers of drained segments
+		q.nextSeq = cur.Segment
+	}
+
+	for _, seq := range seqs {
+		path := q.segmentPath(seq)
+		if seq < cur.Segment {
+			// Fully drained before the last shutdown
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return nil, fmt.Errorf("failed to remove drained segment %s: %w", path, err)
+			}
+			continue
+		}
+
+		seg, err := s.recoverSegment(seq, path)
+		if err != nil {
+			return nil, err
+		}
+		q.segments = append(q.segments, seg)
+		q.nextSeq = seq + 1
+	}
+
+	if len(q.segments) > 0 && q.segments[0].seq == cur.Segment && cur.Offset <= q.segments[0].size {
+		q.readOffset = cur.Offset
+		q.readRecords = cur.Records
+	}
+
+	return q, nil
+}
+
+// recoverSegment scans a segment, truncating any torn or corrupt tail
+func (s *Spool) recoverSegment(seq uint64, path string) (*segment, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open segment %s: %w", path, err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat segment %s: %w", path, err)
+	}
+
+	seg := &segment{seq: seq, path: path, modTime: info.ModTime()}
+	for seg.size < info.Size() {
+		_, next, err := readRecord(f, seg.size, info.Size(), s.opts.MaxSegmentBytes)
+		if err != nil {
+			s.logger.Warn("Truncating corrupt spool segment",
+				zap.String("segment", path),
+				zap.Int64("offset", seg.size),
+				zap.Error(err))
+			if err := f.Truncate(seg.size); err != nil {
+				return nil, fmt.Errorf("failed to truncate segment %s: %w", path, err)
+			}
+			break
+		}
+		seg.size = next
+		seg.records++
+	}
+
+	return seg, nil
+}
+
+// queue returns the queue of the given priority
+func (s *Spool) queue(p Priority) (*queue, error) {
+	if p < 0 || int(p) >= len(s.queues) {
+		return nil, fmt.Errorf("unknown spool priority %d", p)
+	}
+	return s.queues[p], nil
+}
+
+// rotate closes the active segment of q and starts a new one
+func (s *Spool) rotate(q *queue) error {
+	q.closeWriter()
+
+	seq := q.nextSeq
+	path := q.segmentPath(seq)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return fmt.Errorf("failed to create spool segment %s: %w", path, err)
+	}
+
+	q.writer = f
+	q.nextSeq++
+	q.segments = append(q.segments, &segment{seq: seq, path: path, modTime: time.Now()})
+	return nil
+}
+
+// peek returns the next record to drain together with its position
+func (s *Spool) peek() (*queue, uint64, *Record, int64, error) {
+	for _, q := range s.queues {
+		for len(q.segments) > 0 {
+			head := q.segments[0]
+			if q.readOffset >= head.size {
+				if head == q.active() && q.writer != nil {
+					// Caught up with the segment still being written
+					break
+				}
+				s.removeHead(q)
+				continue
+			}
+
+			if err := q.openReader(); err != nil {
+				return nil, 0, nil, 0, err
+			}
+
+			rec, next, err := readRecord(q.reader, q.readOffset, head.size, s.opts.MaxSegmentBytes)
+			if err != nil {
+				s.logger.Error("Discarding unreadable spool segment",
+					zap.String("segment", head.path),
+					zap.Int64("offset", q.readOffset),
+					zap.Error(err))
+				s.dropped += head.records - q.readRecords
+				if head == q.active() {
+					q.closeWriter()
+				}
+				s.removeHead(q)
+				continue
+			}
+
+			return q, head.seq, rec, next, nil
+		}
+	}
+
+	return nil, 0, nil, 0, nil
+}
+
+// advance moves the read position of q past a drained record
+func (s *Spool) advance(q *queue, seq uint64, next int64) {
+	if len(q.segments) == 0 || q.segments[0].seq != seq {
+		// The segment was discarded by the size or age limit while publishing
+		return
+	}
+
+	q.readOffset = next
+	q.readRecords++
+	q.uncommitted++
+
+	head := q.segments[0]
+	if q.readOffset >= head.size {
+		// Fully drained; the next append starts a fresh segment
+		if head == q.active() {
+			q.closeWriter()
+		}
+		s.removeHead(q)
+		return
+	}
+
+	if q.uncommitted >= checkpointEvery {
+		if err := q.writeCursor(); err != nil {
+			s.logger.Warn("Failed to write spool cursor", zap.Error(err))
+		}
+	}
+}
+
+// removeHead deletes the first segment of q and resets its read position
+func (s *Spool) removeHead(q *queue) {
+	head := q.segments[0]
+	q.closeReader()
+	if err := os.Remove(head.path); err != nil && !os.IsNotExist(err) {
+		s.logger.Warn("Failed to remove spool segment",
+			zap.String("segment", head.path),
+			zap.Error(err))
+	}
+
+	q.segments = q.segments[1:]
+	q.readOffset = 0
+	q.readRecords = 0
+	if err := q.writeCursor(); err != nil {
+		s.logger.Warn("Failed to write spool cursor", zap.Error(err))
+	}
+}
+
+// enforceLimits discards segments that are too old or exceed the size cap
+func (s *Spool) enforceLimits() {
+	if s.opts.MaxAge > 0 {
+		cutoff := time.Now().Add(-s.opts.MaxAge)
+		for _, q := range s.queues {
+			for len(q.segments) > 0 && q.segments[0].modTime.Before(cutoff) {
+				s.discardHead(q, "max_age")
+			}
+		}
+	}
+
+	for s.totalBytes() > s.opts.MaxTotalBytes {
+		victim := s.lowestPriorityQueue()
+		if victim == nil {
+			return
+		}
+		s.discardHead(victim, "max_total_bytes")
+	}
+}
+
+// discardHead drops the unread records of the first segment of q
+func (s *Spool) discardHead(q *queue, reason string) {
+	head := q.segments[0]
+	lost := head.records - q.readRecords
+	s.dropped += lost
+
+	s.logger.Warn("Discarding spool segment",
+		zap.String("queue", q.priority.String()),
+		zap.String("segment", head.path),
+		zap.String("reason", reason),
+		zap.Int64("records", lost))
+
+	if head == q.active() {
+		q.closeWriter()
+	}
+	s.removeHead(q)
+}
+
+// totalBytes returns the disk space used by all segments
+func (s *Spool) totalBytes() int64 {
+	var total int64
+	for _, q := range s.queues {
+		for _, seg := range q.segments {
+			total += seg.size
+		}
+	}
+	return total
+}
+
+// lowestPriorityQueue returns the lowest priority queue holding any segment
+func (s *Spool) lowestPriorityQueue() *queue {
+	for i := len(s.queues) - 1; i >= 0; i-- {
+		if len(s.queues[i].segments) > 0 {
+			return s.queues[i]
+		}
+	}
+	return nil
+}
+
+// checkpoint persists the read position of every queue with undrained progress
+func (s *Spool) checkpoint() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, q := range s.queues {
+		if q.uncommitted == 0 {
+			continue
+		}
+		if err := q.writeCursor(); err != nil {
+			s.logger.Warn("Failed to write spool cursor", zap.Error(err))
+		}
+	}
+}
+
+// closeFiles closes all open segment files
+func (s *Spool) closeFiles() {
+	for _, q := range s.queues {
+		q.closeWriter()
+		q.closeReader()
+	}
+}
+
+// active returns the segment currently being appended to, if any
+func (q *queue) active() *segment {
+	if len(q.segments) == 0 {
+		return nil
+	}
+	return q.segments[len(q.segments)-1]
+}
+
+// pendingRecords returns the number of undrained records
+func (q *queue) pendingRecords() int64 {
+	records := -q.readRecords
+	for _, seg := range q.segments {
+		records += seg.records
+	}
+	if records < 0 {
+		return 0
+	}
+	return records
+}
+
+// pendingBytes returns the size of the undrained records
+func (q *queue) pendingBytes() int64 {
+	bytes := -q.readOffset
+	for _, seg := range q.segments {
+		bytes += seg.size
+	}
+	if bytes < 0 {
+		return 0
+	}
+	return bytes
+}
+
+// segmentPath returns the file path of segment seq
+func (q *queue) segmentPath(seq uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", seq, segmentExt))
+}
+
+// openReader opens the first segment for reading if it is not open yet
+func (q *queue) openReader() error {
+	head := q.segments[0]
+	if q.reader != nil && q.readerSeq == head.seq {
+		return nil
+	}
+	q.closeReader()
+
+	f, err := os.Open(head.path)
+	if err != nil {
+		return fmt.Errorf("failed to open spool segment %s: %w", head.path, err)
+	}
+	q.reader = f
+	q.readerSeq = head.seq
+	return nil
+}
+
+// closeReader closes the read handle
+func (q *queue) closeReader() {
+	if q.reader != nil {
+		q.reader.Close()
+		q.reader = nil
+	}
+}
+
+// closeWriter closes the append handle so the next append starts a new segment
+func (q *queue) closeWriter() {
+	if q.writer != nil {
+		q.writer.Close()
+		q.writer = nil
+	}
+}
+
+// readCursor loads the persisted read position
+func (q *queue) readCursor() (cursor, error) {
+	var cur cursor
+
+	data, err := os.ReadFile(filepath.Join(q.dir, cursorFile))
+	if os.IsNotExist(err) {
+		return cur, nil
+	}
+	if err != nil {
+		return cur, fmt.Errorf("failed to read cursor: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &cur); err != nil {
+		return cur, fmt.Errorf("failed to parse cursor: %w", err)
+	}
+	return cur, nil
+}
+
+// writeCursor atomically persists the read position
+func (q *queue) writeCursor() error {
+	cur := cursor{Segment: q.nextSeq}
+	if len(q.segments) > 0 {
+		cur = cursor{Segment: q.segments[0].seq, Offset: q.readOffset, Records: q.readRecords}
+	}
+
+	data, err := json.Marshal(cur)
+	if err != nil {
+		return fmt.Errorf("failed to marshal cursor: %w", err)
+	}
+
+	path := filepath.Join(q.dir, cursorFile)
+	tmp := path + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o640)
+	if err != nil {
+		return fmt.Errorf("failed to create cursor: %w", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write cursor: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync cursor: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close cursor: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to replace cursor: %w", err)
+	}
+
+	q.uncommitted = 0
+	return nil
+}
+
+// encodeRecord frames a record as length, CRC32 and payload. The payload holds
+// the length-prefixed subject and message ID, the timestamp and the data.
+func encodeRecord(rec *Record) []byte {
+	payload := make([]byte, 0, 2*binary.MaxVarintLen64+len(rec.Subject)+len(rec.MessageID)+binary.MaxVarintLen64+len(rec.Data))
+	payload = binary.AppendUvarint(payload, uint64(len(rec.Subject)))
+	payload = append(payload, rec.Subject...)
+	payload = binary.AppendUvarint(payload, uint64(len(rec.MessageID)))
+	payload = append(payload, rec.MessageID...)
+	payload = binary.AppendVarint(payload, rec.Timestamp.UnixNano())
+	payload = append(payload, rec.Data...)
+
+	frame := make([]byte, frameHeaderSize, frameHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload))
+	return append(frame, payload...)
+}
+
+// readRecord reads the record framed at offset and returns the offset of the
+// next one. The length in the frame header is checked against the end of the
+// data and the maximum record size before anything is allocated for it.
+func readRecord(r io.ReaderAt, offset, end, maxLength int64) (*Record, int64, error) {
+	header := make([]byte, frameHeaderSize)
+	if _, err := r.ReadAt(header, offset); err != nil {
+		return nil, 0, fmt.Errorf("failed to read record header: %w", err)
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	checksum := binary.BigEndian.Uint32(header[4:8])
+	if int64(length) > maxLength || int64(length) > end-offset-frameHeaderSize {
+		return nil, 0, fmt.Errorf("invalid record length %d", length)
+	}
+
+	payload := make([]byte, length)
+	if _, err := r.ReadAt(payload, offset+frameHeaderSize); err != nil {
+		return nil, 0, fmt.Errorf("failed to read record payload: %w", err)
+	}
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return nil, 0, fmt.Errorf("record checksum mismatch")
+	}
+
+	rec, err := decodePayload(payload)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return rec, offset + frameHeaderSize + int64(length), nil
+}
+
+// decodePayload parses the payload written by encodeRecord
+func decodePayload(payload []byte) (*Record, error) {
+	subject, rest, err := readString(payload)
+	if err != nil {
+		return nil, err
+	}
+	messageID, rest, err := readString(rest)
+	if err != nil {
+		return nil, err
+	}
+	nanos, n := binary.Varint(rest)
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid record timestamp")
+	}
+
+	return &Record{
+		Subject:   subject,
+		MessageID: messageID,
+		Timestamp: time.Unix(0, nanos),
+		Data:      rest[n:],
+	}, nil
+}
+
+// readString reads a uvarint length-prefixed string
+func readString(b []byte) (string, []byte, error) {
+	length, n := binary.Uvarint(b)
+	if n <= 0 || uint64(len(b)-n) < length {
+		return "", nil, fmt.Errorf("invalid record field length")
+	}
+	end := n + int(length)
+	return string(b[n:end]), b[end:], nil
+}
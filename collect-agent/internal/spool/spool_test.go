@@ -0,0 +1,388 @@
+package spool
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func testOptions(dir string) Options {
+	return Options{
+		Dir:             dir,
+		MaxSegmentBytes: 1024,
+		MaxTotalBytes:   64 * 1024,
+		MaxAge:          time.Hour,
+	}
+}
+
+func openSpool(t *testing.T, opts Options) *Spool {
+	t.Helper()
+	s, err := Open(opts, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	return s
+}
+
+func appendRecord(t *testing.T, s *Spool, p Priority, id string) {
+	t.Helper()
+	rec := &Record{
+		Subject:   "aetherius.agent.c1.event",
+		MessageID: id,
+		Timestamp: time.Now(),
+		Data:      []byte(fmt.Sprintf(`{"id":%q}`, id)),
+	}
+	if err := s.Append(p, rec); err != nil {
+		t.Fatalf("Append(%s) failed: %v", id, err)
+	}
+}
+
+func drainIDs(t *testing.T, s *Spool) []string {
+	t.Helper()
+	var ids []string
+	if _, err := s.Drain(func(rec *Record) error {
+		ids = append(ids, rec.MessageID)
+		return nil
+	}); err != nil {
+		t.Fatalf("Drain failed: %v", err)
+	}
+	return ids
+}
+
+func assertIDs(t *testing.T, got, want []string) {
+	t.Helper()
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("drained = %v, want %v", got, want)
+	}
+}
+
+func TestDrainOrder(t *testing.T) {
+	s := openSpool(t, testOptions(t.TempDir()))
+	defer s.Close()
+
+	appendRecord(t, s, PriorityLow, "metrics-1")
+	appendRecord(t, s, PriorityNormal, "event-1")
+	appendRecord(t, s, PriorityCritical, "critical-1")
+	appendRecord(t, s, PriorityNormal, "event-2")
+	appendRecord(t, s, PriorityCritical, "critical-2")
+
+	if got := s.Len(); got != 5 {
+		t.Errorf("Len = %v, want 5", got)
+	}
+
+	assertIDs(t, drainIDs(t, s), []string{"critical-1", "critical-2", "event-1", "event-2", "metrics-1"})
+
+	if got := s.Len(); got != 0 {
+		t.Errorf("Len after drain = %v, want 0", got)
+	}
+}
+
+func TestRecordRoundTrip(t *testing.T) {
+	s := openSpool(t, testOptions(t.TempDir()))
+	defer s.Close()
+
+	ts := time.Unix(1700000000, 42)
+	want := &Record{Subject: "aetherius.agent.c1.result", MessageID: "abc", Timestamp: ts, Data: []byte("payload")}
+	if err := s.Append(PriorityCritical, want); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+
+	var got *Record
+	if _, err := s.Drain(func(rec *Record) error {
+		got = rec
+		return nil
+	}); err != nil {
+		t.Fatalf("Drain failed: %v", err)
+	}
+
+	if got == nil {
+		t.Fatal("no record drained")
+	}
+	if got.Subject != want.Subject || got.MessageID != want.MessageID ||
+		!got.Timestamp.Equal(ts) || string(got.Data) != "payload" {
+		t.Errorf("record = %+v, want %+v", got, want)
+	}
+}
+
+func TestDrainStopsOnError(t *testing.T) {
+	s := openSpool(t, testOptions(t.TempDir()))
+	defer s.Close()
+
+	for i := 1; i <= 3; i++ {
+		appendRecord(t, s, PriorityNormal, fmt.Sprintf("event-%d", i))
+	}
+
+	publishErr := errors.New("not connected")
+	calls := 0
+	drained, err := s.Drain(func(rec *Record) error {
+		calls++
+		if calls == 2 {
+			return publishErr
+		}
+		return nil
+	})
+
+	if !errors.Is(err, publishErr) {
+		t.Errorf("Drain error = %v, want %v", err, publishErr)
+	}
+	if drained != 1 {
+		t.Errorf("drained = %v, want 1", drained)
+	}
+
+	assertIDs(t, drainIDs(t, s), []string{"event-2", "event-3"})
+}
+
+func TestDrainDropsUndeliverable(t *testing.T) {
+	s := openSpool(t, testOptions(t.TempDir()))
+	defer s.Close()
+
+	for i := 1; i <= 3; i++ {
+		appendRecord(t, s, PriorityCritical, fmt.Sprintf("result-%d", i))
+	}
+
+	var published []string
+	drained, err := s.Drain(func(rec *Record) error {
+		if rec.MessageID == "result-1" {
+			return fmt.Errorf("%w: maximum payload exceeded", ErrUndeliverable)
+		}
+		published = append(published, rec.MessageID)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Drain failed: %v", err)
+	}
+	if drained != 2 {
+		t.Errorf("drained = %v, want 2", drained)
+	}
+	assertIDs(t, published, []string{"result-2", "result-3"})
+
+	if stats := s.Stats(); stats.Records != 0 || stats.Dropped != 1 {
+		t.Errorf("stats = %+v, want no records and 1 dropped", stats)
+	}
+}
+
+func TestReopenResumesFromCursor(t *testing.T) {
+	opts := testOptions(t.TempDir())
+	s := openSpool(t, opts)
+
+	for i := 1; i <= 5; i++ {
+		appendRecord(t, s, PriorityNormal, fmt.Sprintf("event-%d", i))
+	}
+
+	calls := 0
+	s.Drain(func(rec *Record) error {
+		calls++
+		if calls > 2 {
+			return errors.New("disconnected")
+		}
+		return nil
+	})
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	s = openSpool(t, opts)
+	defer s.Close()
+
+	if got := s.Len(); got != 3 {
+		t.Errorf("Len after reopen = %v, want 3", got)
+	}
+
+	appendRecord(t, s, PriorityNormal, "event-6")
+	assertIDs(t, drainIDs(t, s), []string{"event-3", "event-4", "event-5", "event-6"})
+}
+
+func TestReopenAfterFullDrain(t *testing.T) {
+	opts := testOptions(t.TempDir())
+	s := openSpool(t, opts)
+
+	appendRecord(t, s, PriorityNormal, "event-1")
+	drainIDs(t, s)
+	s.Close()
+
+	s = openSpool(t, opts)
+	appendRecord(t, s, PriorityNormal, "event-2")
+	s.Close()
+
+	s = openSpool(t, opts)
+	defer s.Close()
+
+	assertIDs(t, drainIDs(t, s), []string{"event-2"})
+}
+
+func TestRecoverTornWrite(t *testing.T) {
+	opts := testOptions(t.TempDir())
+	s := openSpool(t, opts)
+
+	appendRecord(t, s, PriorityNormal, "event-1")
+	appendRecord(t, s, PriorityNormal, "event-2")
+	s.Close()
+
+	segments, err := filepath.Glob(filepath.Join(opts.Dir, PriorityNormal.String(), "*"+segmentExt))
+	if err != nil || len(segments) != 1 {
+		t.Fatalf("segments = %v, err = %v, want one segment", segments, err)
+	}
+
+	// Simulate a crash in the middle of writing a third record
+	f, err := os.OpenFile(segments[0], os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("failed to open segment: %v", err)
+	}
+	f.Write([]byte{0, 0, 0, 100, 1, 2})
+	f.Close()
+
+	s = openSpool(t, opts)
+	defer s.Close()
+
+	appendRecord(t, s, PriorityNormal, "event-3")
+	assertIDs(t, drainIDs(t, s), []string{"event-1", "event-2", "event-3"})
+}
+
+func TestRecoverCorruptLength(t *testing.T) {
+	opts := testOptions(t.TempDir())
+	s := openSpool(t, opts)
+
+	appendRecord(t, s, PriorityNormal, "event-1")
+	s.Close()
+
+	segments, err := filepath.Glob(filepath.Join(opts.Dir, PriorityNormal.String(), "*"+segmentExt))
+	if err != nil || len(segments) != 1 {
+		t.Fatalf("segments = %v, err = %v, want one segment", segments, err)
+	}
+
+	// A header claiming a 4 GiB record must not be allocated
+	f, err := os.OpenFile(segments[0], os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("failed to open segment: %v", err)
+	}
+	f.Write([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 1, 2, 3})
+	f.Close()
+
+	s = openSpool(t, opts)
+	defer s.Close()
+
+	assertIDs(t, drainIDs(t, s), []string{"event-1"})
+}
+
+func TestSegmentRotation(t *testing.T) {
+	opts := testOptions(t.TempDir())
+	opts.MaxSegmentBytes = 256
+	s := openSpool(t, opts)
+	defer s.Close()
+
+	var want []string
+	for i := 0; i < 20; i++ {
+		id := fmt.Sprintf("event-%02d", i)
+		appendRecord(t, s, PriorityNormal, id)
+		want = append(want, id)
+	}
+
+	segments, _ := filepath.Glob(filepath.Join(opts.Dir, PriorityNormal.String(), "*"+segmentExt))
+	if len(segments) < 2 {
+		t.Errorf("segments = %v, want at least 2", len(segments))
+	}
+
+	assertIDs(t, drainIDs(t, s), want)
+
+	segments, _ = filepath.Glob(filepath.Join(opts.Dir, PriorityNormal.String(), "*"+segmentExt))
+	if len(segments) != 0 {
+		t.Errorf("segments after drain = %v, want 0", len(segments))
+	}
+}
+
+func TestMaxTotalBytesDropsLowestPriority(t *testing.T) {
+	opts := testOptions(t.TempDir())
+	opts.MaxSegmentBytes = 256
+	opts.MaxTotalBytes = 1024
+	s := openSpool(t, opts)
+	defer s.Close()
+
+	appendRecord(t, s, PriorityCritical, "critical-1")
+	for i := 0; i < 50; i++ {
+		appendRecord(t, s, PriorityLow, fmt.Sprintf("metrics-%02d", i))
+	}
+
+	stats := s.Stats()
+	if stats.Dropped == 0 {
+		t.Error("Dropped = 0, want records to be discarded")
+	}
+	if stats.ByPriority["critical"] != 1 {
+		t.Errorf("critical records = %v, want 1", stats.ByPriority["critical"])
+	}
+
+	ids := drainIDs(t, s)
+	if len(ids) == 0 || ids[0] != "critical-1" {
+		t.Fatalf("drained = %v, want critical-1 first", ids)
+	}
+	if last := ids[len(ids)-1]; last != "metrics-49" {
+		t.Errorf("last drained = %v, want newest record metrics-49", last)
+	}
+}
+
+func TestMaxAgeDiscardsOldSegments(t *testing.T) {
+	opts := testOptions(t.TempDir())
+	s := openSpool(t, opts)
+
+	appendRecord(t, s, PriorityNormal, "event-1")
+	s.Close()
+
+	segments, _ := filepath.Glob(filepath.Join(opts.Dir, PriorityNormal.String(), "*"+segmentExt))
+	old := time.Now().Add(-2 * opts.MaxAge)
+	for _, path := range segments {
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatalf("Chtimes failed: %v", err)
+		}
+	}
+
+	s = openSpool(t, opts)
+	defer s.Close()
+
+	stats := s.Stats()
+	if stats.Records != 0 || stats.Dropped != 1 {
+		t.Errorf("Stats = %+v, want 0 records and 1 dropped", stats)
+	}
+}
+
+func TestAppendRecordTooLarge(t *testing.T) {
+	s := openSpool(t, testOptions(t.TempDir()))
+	defer s.Close()
+
+	err := s.Append(PriorityNormal, &Record{Subject: "s", Data: make([]byte, 2048)})
+	if !errors.Is(err, ErrRecordTooLarge) {
+		t.Errorf("Append error = %v, want ErrRecordTooLarge", err)
+	}
+}
+
+func TestAppendAfterClose(t *testing.T) {
+	s := openSpool(t, testOptions(t.TempDir()))
+	s.Close()
+
+	if err := s.Append(PriorityNormal, &Record{Subject: "s"}); !errors.Is(err, ErrClosed) {
+		t.Errorf("Append error = %v, want ErrClosed", err)
+	}
+}
+
+func TestOpenValidatesOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{"MissingDir", Options{MaxSegmentBytes: 1024, MaxTotalBytes: 4096}},
+		{"TinySegment", Options{Dir: t.TempDir(), MaxSegmentBytes: 4, MaxTotalBytes: 4096}},
+		{"TotalBelowSegment", Options{Dir: t.TempDir(), MaxSegmentBytes: 4096, MaxTotalBytes: 1024}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Open(tt.opts, zap.NewNop()); err == nil {
+				t.Error("Open should fail")
+			}
+		})
+	}
+}
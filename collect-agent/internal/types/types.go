@@ -2,90 +2,169 @@ package types
 
 import (
 	"time"
+
+	"github.com/kart-io/k8s-agent/protocol"
+)
+
+// Wire payloads are defined by the shared protocol package so that the agent
+// and agent-manager always agree on their encoding.
+type (
+	AgentInfo        = protocol.Registration
+	Event            = protocol.Event
+	Metrics          = protocol.Metrics
+	Command          = protocol.Command
+	CommandAck       = protocol.CommandAck
+	CommandResult    = protocol.CommandResult
+	CommandOutput    = protocol.CommandOutput
+	CommandPoolState = protocol.CommandPoolState
+	CommandState     = protocol.CommandState
+	Heartbeat        = protocol.Heartbeat
+	HeartbeatMetrics = protocol.HeartbeatMetrics
+	ComponentHealth  = protocol.ComponentHealth
+)
+
+// Metrics snapshot kinds
+const (
+	MetricsSnapshotFull  = protocol.MetricsSnapshotFull
+	MetricsSnapshotDelta = protocol.MetricsSnapshotDelta
+)
+
+// Heartbeat status values
+const (
+	HeartbeatStatusHealthy  = protocol.HeartbeatStatusHealthy
+	HeartbeatStatusDegraded = protocol.HeartbeatStatusDegraded
 )
 
-// AgentInfo contains information about the agent registration
-type AgentInfo struct {
-	ClusterID    string    `json:"cluster_id"`
-	Version      string    `json:"version"`
-	StartTime    time.Time `json:"start_time"`
-	Capabilities []string  `json:"capabilities"`
+// Kubernetes event APIs the event watcher can use
+const (
+	EventAPIEventsV1 = "events.k8s.io/v1"
+	EventAPICoreV1   = "v1"
+)
+
+// AgentConfig represents the agent configuration
+type AgentConfig struct {
+	ClusterID         string               `yaml:"cluster_id"`
+	CentralEndpoint   string               `yaml:"central_endpoint"`
+	ReconnectDelay    time.Duration        `yaml:"reconnect_delay"`
+	HeartbeatInterval time.Duration        `yaml:"heartbeat_interval"`
+	MetricsInterval   time.Duration        `yaml:"metrics_interval"`
+	FullSnapshotEvery time.Duration        `yaml:"metrics_full_snapshot_interval"` // zero sends every node and namespace in each report
+	BufferSize        int                  `yaml:"buffer_size"`
+	MaxRetries        int                  `yaml:"max_retries"`
+	LogLevel          string               `yaml:"log_level"`
+	EnableMetrics     bool                 `yaml:"enable_metrics"`
+	EnableEvents      bool                 `yaml:"enable_events"`
+	EnableJetStream   bool                 `yaml:"enable_jetstream"`
+	DevMode           bool                 `yaml:"dev_mode"`
+	Kubernetes        KubernetesConfig     `yaml:"kubernetes"`
+	Clusters          []ClusterConfig      `yaml:"clusters"`
+	EventWatch        EventWatchConfig     `yaml:"event_watch"`
+	EventRules        EventRulesConfig     `yaml:"event_rules"`
+	EventDedup        EventDedupConfig     `yaml:"event_dedup"`
+	StateWatch        StateWatchConfig     `yaml:"state_watch"`
+	KubeletStats      KubeletStatsConfig   `yaml:"kubelet_stats"`
+	CommandSigning    CommandSigningConfig `yaml:"command_signing"`
+	CommandPool       CommandPoolConfig    `yaml:"command_pool"`
+	Remediation       RemediationConfig    `yaml:"remediation"`
+	Spool             SpoolConfig          `yaml:"spool"`
+}
+
+// KubernetesConfig selects the cluster the agent talks to. When neither field
+// is set the in-cluster service account is used.
+type KubernetesConfig struct {
+	Kubeconfig string `yaml:"kubeconfig"`
+	Context    string `yaml:"context"`
 }
 
-// Event represents a Kubernetes event that needs to be reported
-type Event struct {
-	ID         string                 `json:"id"`
-	ClusterID  string                 `json:"cluster_id"`
-	Type       string                 `json:"type"`
-	Source     string                 `json:"source"`
-	Namespace  string                 `json:"namespace"`
-	Severity   string                 `json:"severity"`
-	Reason     string                 `json:"reason"`
-	Message    string                 `json:"message"`
-	Timestamp  time.Time              `json:"timestamp"`
-	ReportedAt time.Time              `json:"reported_at"`
-	Labels     map[string]string      `json:"labels"`
-	RawData    map[string]interface{} `json:"raw_data"`
+// ClusterConfig is one of several clusters served by a single agent process
+type ClusterConfig struct {
+	ClusterID  string           `yaml:"cluster_id"`
+	Kubernetes KubernetesConfig `yaml:",inline"`
 }
 
-// Metrics represents collected metrics from the cluster
-type Metrics struct {
-	ClusterID string                 `json:"cluster_id"`
-	Timestamp time.Time              `json:"timestamp"`
-	Data      map[string]interface{} `json:"data"`
+// ClusterTargets returns the clusters the agent serves: the configured cluster
+// list, or the single cluster described by cluster_id and kubernetes
+func (c *AgentConfig) ClusterTargets() []ClusterConfig {
+	if len(c.Clusters) > 0 {
+		return c.Clusters
+	}
+	return []ClusterConfig{{ClusterID: c.ClusterID, Kubernetes: c.Kubernetes}}
 }
 
-// Command represents a command to be executed by the agent
-type Command struct {
-	ID        string            `json:"id"`
-	Type      string            `json:"type"`
-	Tool      string            `json:"tool"`
-	Action    string            `json:"action"`
-	Args      []string          `json:"args"`
-	Env       map[string]string `json:"env,omitempty"`
-	Timeout   time.Duration     `json:"timeout"`
-	CreatedAt time.Time         `json:"created_at"`
+// EventWatchConfig configures how Kubernetes events are watched
+type EventWatchConfig struct {
+	API string `yaml:"api"` // events.k8s.io/v1 (default) or the legacy v1
+
+	// StateDir keeps the last seen resourceVersion of each cluster so that a
+	// restarted agent resumes watching where it stopped; empty disables resuming
+	StateDir string `yaml:"state_dir"`
 }
 
-// CommandResult represents the result of a command execution
-type CommandResult struct {
-	CommandID string        `json:"command_id"`
-	ClusterID string        `json:"cluster_id"`
-	Status    string        `json:"status"` // success, failed, timeout
-	Output    string        `json:"output"`
-	Error     string        `json:"error,omitempty"`
-	Duration  time.Duration `json:"duration"`
-	Timestamp time.Time     `json:"timestamp"`
+// EventRulesConfig locates the event filter rules. The built-in rules are used
+// when no file is set; a file, typically a mounted ConfigMap, is reloaded when it changes.
+type EventRulesConfig struct {
+	File           string        `yaml:"file"`
+	ReloadInterval time.Duration `yaml:"reload_interval"`
 }
 
-// Heartbeat represents agent health status
-type Heartbeat struct {
-	ClusterID string            `json:"cluster_id"`
-	Timestamp time.Time         `json:"timestamp"`
-	Status    string            `json:"status"`
-	Metrics   HeartbeatMetrics  `json:"metrics"`
+// EventDedupConfig configures the compression of repeated events. The first
+// occurrence is forwarded at once, repeats within the window as one summary.
+type EventDedupConfig struct {
+	Window     time.Duration `yaml:"window"` // zero forwards every event
+	MaxEntries int           `yaml:"max_entries"`
 }
 
-// HeartbeatMetrics contains internal metrics for heartbeat
-type HeartbeatMetrics struct {
-	EventQueueSize   int `json:"event_queue_size"`
-	MetricsQueueSize int `json:"metrics_queue_size"`
-	CommandQueueSize int `json:"command_queue_size"`
-	UptimeSeconds    int `json:"uptime_seconds"`
+// StateWatchConfig configures the watchers reporting state transitions of
+// pods, nodes, deployments, PVCs and jobs as events
+type StateWatchConfig struct {
+	Enabled          bool          `yaml:"enabled"`
+	PendingThreshold time.Duration `yaml:"pending_threshold"` // how long pods and PVCs may be Pending before they are reported
 }
 
-// AgentConfig represents the agent configuration
-type AgentConfig struct {
-	ClusterID         string        `yaml:"cluster_id"`
-	CentralEndpoint   string        `yaml:"central_endpoint"`
-	ReconnectDelay    time.Duration `yaml:"reconnect_delay"`
-	HeartbeatInterval time.Duration `yaml:"heartbeat_interval"`
-	MetricsInterval   time.Duration `yaml:"metrics_interval"`
-	BufferSize        int           `yaml:"buffer_size"`
-	MaxRetries        int           `yaml:"max_retries"`
-	LogLevel          string        `yaml:"log_level"`
-	EnableMetrics     bool          `yaml:"enable_metrics"`
-	EnableEvents      bool          `yaml:"enable_events"`
+// KubeletStatsConfig configures the scraping of container stats from the kubelet
+// of each node through the API server proxy
+type KubeletStatsConfig struct {
+	Enabled     bool          `yaml:"enabled"`
+	MaxNodes    int           `yaml:"max_nodes"`   // nodes scraped per collection, in turn; zero scrapes every node
+	Concurrency int           `yaml:"concurrency"` // nodes scraped at the same time
+	Timeout     time.Duration `yaml:"timeout"`     // of the scrape of all sampled nodes
+	CAdvisor    bool          `yaml:"cadvisor"`    // also scrape /metrics/cadvisor for CPU throttling
+}
+
+// CommandSigningConfig configures the verification of the signatures
+// agent-manager sets on commands
+type CommandSigningConfig struct {
+	Enabled       bool              `yaml:"enabled"`
+	PublicKeys    map[string]string `yaml:"public_keys"`    // base64 Ed25519 public keys by key ID
+	AllowUnsigned bool              `yaml:"allow_unsigned"` // run unsigned commands, while agent-manager is switched to signing
+	MaxClockSkew  time.Duration     `yaml:"max_clock_skew"` // tolerated difference with the clock of agent-manager
+	MaxLifetime   time.Duration     `yaml:"max_lifetime"`   // longest validity accepted, bounding the nonces remembered
+}
+
+// CommandPoolConfig sizes the pool of workers running commands. Zero sizes
+// take the defaults.
+type CommandPoolConfig struct {
+	Workers    int            `yaml:"workers"`     // commands run at once
+	QueueSize  int            `yaml:"queue_size"`  // commands waiting for a worker, beyond which they are refused
+	ToolLimits map[string]int `yaml:"tool_limits"` // commands of a tool run at once; other tools are limited by workers only
+}
+
+// RemediationConfig enables the remediation commands, which change the
+// cluster. They are refused unless enabled, and then run only as far as the
+// policy file allows; the file is read for each command.
+type RemediationConfig struct {
+	Enabled    bool   `yaml:"enabled"`
+	PolicyFile string `yaml:"policy_file"`
+}
+
+// SpoolConfig configures the on-disk buffer used while NATS is unreachable
+type SpoolConfig struct {
+	Enabled         bool          `yaml:"enabled"`
+	Dir             string        `yaml:"dir"`
+	MaxSegmentBytes int64         `yaml:"max_segment_bytes"`
+	MaxTotalBytes   int64         `yaml:"max_total_bytes"`
+	MaxAge          time.Duration `yaml:"max_age"`
+	Sync            bool          `yaml:"sync"`
 }
 
 // DefaultConfig returns a default configuration
@@ -95,10 +174,57 @@ func DefaultConfig() *AgentConfig {
 		ReconnectDelay:    5 * time.Second,
 		HeartbeatInterval: 30 * time.Second,
 		MetricsInterval:   60 * time.Second,
+		FullSnapshotEvery: 10 * time.Minute,
 		BufferSize:        1000,
 		MaxRetries:        10,
 		LogLevel:          "info",
 		EnableMetrics:     true,
 		EnableEvents:      true,
+		EventWatch: EventWatchConfig{
+			API:      EventAPIEventsV1,
+			StateDir: "/var/lib/aetherius/state",
+		},
+		EventRules: EventRulesConfig{
+			ReloadInterval: 30 * time.Second,
+		},
+		EventDedup: EventDedupConfig{
+			Window:     5 * time.Minute,
+			MaxEntries: 10000,
+		},
+		StateWatch: StateWatchConfig{
+			Enabled:          true,
+			PendingThreshold: 5 * time.Minute,
+		},
+		KubeletStats: KubeletStatsConfig{
+			MaxNodes:    20,
+			Concurrency: 5,
+			Timeout:     20 * time.Second,
+			CAdvisor:    true,
+		},
+		CommandSigning: CommandSigningConfig{
+			MaxClockSkew: 30 * time.Second,
+			MaxLifetime:  10 * time.Minute,
+		},
+		CommandPool: CommandPoolConfig{
+			Workers:   4,
+			QueueSize: 100,
+			ToolLimits: map[string]int{
+				"kubectl":     2,
+				"ping":        1,
+				"curl":        1,
+				"wget":        1,
+				"remediation": 1,
+			},
+		},
+		Remediation: RemediationConfig{
+			PolicyFile: "/etc/aetherius-remediation/policy.yaml",
+		},
+		Spool: SpoolConfig{
+			Enabled:         true,
+			Dir:             "/var/lib/aetherius/spool",
+			MaxSegmentBytes: 8 * 1024 * 1024,
+			MaxTotalBytes:   256 * 1024 * 1024,
+			MaxAge:          24 * time.Hour,
+		},
 	}
-}
\ No newline at end of file
+}
@@ -27,6 +27,8 @@ func TestDefaultConfig(t *testing.T) {
 		{"LogLevel", config.LogLevel, "info"},
 		{"EnableMetrics", config.EnableMetrics, true},
 		{"EnableEvents", config.EnableEvents, true},
+		{"SpoolEnabled", config.Spool.Enabled, true},
+		{"SpoolMaxTotalBytes", config.Spool.MaxTotalBytes, int64(256 * 1024 * 1024)},
 	}
 
 	for _, tt := range tests {
@@ -177,4 +179,27 @@ func TestHeartbeatStructure(t *testing.T) {
 	if hb.Metrics.EventQueueSize != 10 {
 		t.Errorf("Heartbeat.Metrics.EventQueueSize = %v, want %v", hb.Metrics.EventQueueSize, 10)
 	}
-}
\ No newline at end of file
+}
+
+func TestClusterTargets(t *testing.T) {
+	config := DefaultConfig()
+	config.ClusterID = "prod"
+	config.Kubernetes = KubernetesConfig{Context: "prod"}
+
+	targets := config.ClusterTargets()
+	if len(targets) != 1 || targets[0].ClusterID != "prod" || targets[0].Kubernetes.Context != "prod" {
+		t.Errorf("ClusterTargets() = %+v, want the single configured cluster", targets)
+	}
+
+	config.ClusterID = ""
+	config.Kubernetes = KubernetesConfig{}
+	config.Clusters = []ClusterConfig{
+		{ClusterID: "edge-1", Kubernetes: KubernetesConfig{Context: "edge-1"}},
+		{ClusterID: "edge-2", Kubernetes: KubernetesConfig{Context: "edge-2"}},
+	}
+
+	targets = config.ClusterTargets()
+	if len(targets) != 2 || targets[1].ClusterID != "edge-2" {
+		t.Errorf("ClusterTargets() = %+v, want the cluster list", targets)
+	}
+}
@@ -19,6 +19,9 @@ var (
 	configPath = flag.String("config", "/etc/aetherius/config.yaml", "path to configuration file")
 	version    = flag.Bool("version", false, "print version information")
 	healthPort = flag.Int("health-port", 8080, "port for health checks")
+	kubeconfig = flag.String("kubeconfig", "", "path to a kubeconfig file; in-cluster config is used when empty")
+	kubeCtx    = flag.String("context", "", "kubeconfig context to use instead of the current context")
+	devMode    = flag.Bool("dev", false, "run against an in-memory fake cluster for local development")
 )
 
 const (
@@ -27,6 +30,10 @@ const (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "rules" {
+		os.Exit(runRulesCommand(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
 	flag.Parse()
 
 	if *version {
@@ -41,6 +48,21 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Command-line flags take precedence over the file and environment
+	if *kubeconfig != "" {
+		cfg.Kubernetes.Kubeconfig = *kubeconfig
+	}
+	if *kubeCtx != "" {
+		cfg.Kubernetes.Context = *kubeCtx
+	}
+	if *devMode {
+		cfg.DevMode = true
+	}
+	if err := config.Validate(cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+		os.Exit(1)
+	}
+
 	// Initialize logger
 	logger, err := initLogger(cfg.LogLevel)
 	if err != nil {
@@ -53,7 +75,8 @@ func main() {
 		zap.String("version", AppVersion),
 		zap.String("config_path", *configPath),
 		zap.String("cluster_id", cfg.ClusterID),
-		zap.String("central_endpoint", cfg.CentralEndpoint))
+		zap.String("central_endpoint", cfg.CentralEndpoint),
+		zap.Bool("dev_mode", cfg.DevMode))
 
 	// Create context for graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
@@ -69,14 +92,14 @@ func main() {
 		cancel()
 	}()
 
-	// Create and start agent
-	agentInstance, err := agent.New(cfg, logger)
+	// Create an agent for every configured cluster
+	supervisor, err := agent.NewSupervisor(cfg, logger)
 	if err != nil {
 		logger.Fatal("Failed to create agent", zap.Error(err))
 	}
 
 	// Start health server
-	healthServer := agent.NewHealthServer(agentInstance, *healthPort, logger)
+	healthServer := agent.NewHealthServer(supervisor, *healthPort, logger)
 	if err := healthServer.Start(); err != nil {
 		logger.Fatal("Failed to start health server", zap.Error(err))
 	}
@@ -84,7 +107,7 @@ func main() {
 
 	// Start agent
 	logger.Info("Starting agent services...")
-	if err := agentInstance.Start(ctx); err != nil {
+	if err := supervisor.Start(ctx); err != nil {
 		logger.Fatal("Failed to start agent", zap.Error(err))
 	}
 
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	corev1 "k8s.io/api/core/v1"
+	eventsv1 "k8s.io/api/events/v1"
+
+	"github.com/kart/k8s-agent/collect-agent/internal/rules"
+)
+
+// runRulesCommand runs the "rules" subcommand and returns the process exit code
+func runRulesCommand(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] != "test" {
+		fmt.Fprintf(stderr, "Usage: %s rules test [-rules file] <event.json>...\n", os.Args[0])
+		return 2
+	}
+
+	fs := flag.NewFlagSet("rules test", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	rulesFile := fs.String("rules", "", "path to a rules file; the built-in rules are used when empty")
+	showDefault := fs.Bool("print-default", false, "print the built-in rules and exit")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	if *showDefault {
+		stdout.Write(rules.DefaultYAML())
+		return 0
+	}
+
+	if fs.NArg() == 0 {
+		fmt.Fprintf(stderr, "Usage: %s rules test [-rules file] <event.json>...\n", os.Args[0])
+		return 2
+	}
+
+	ruleSet := rules.Default()
+	if *rulesFile != "" {
+		_, rs, err := rules.LoadFile(*rulesFile)
+		if err != nil {
+			fmt.Fprintf(stderr, "%v\n", err)
+			return 1
+		}
+		ruleSet = rs
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tKIND\tTYPE\tREASON\tDECISION\tSEVERITY\tRULE")
+
+	for _, path := range fs.Args() {
+		events, err := readEvents(path)
+		if err != nil {
+			w.Flush()
+			fmt.Fprintf(stderr, "%v\n", err)
+			return 1
+		}
+
+		for _, event := range events {
+			decision := ruleSet.Evaluate(event)
+
+			action := rules.ActionExclude
+			if decision.Include {
+				action = rules.ActionInclude
+			}
+			rule := decision.Rule
+			if rule == "" {
+				rule = "(default)"
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				event.Namespace, event.Kind, event.Type, event.Reason,
+				action, valueOrDash(decision.Severity), rule)
+		}
+	}
+
+	w.Flush()
+	return 0
+}
+
+// readEvents reads a saved core/v1 or events.k8s.io/v1 event, or an event
+// list as printed by "kubectl get events -o json"
+func readEvents(path string) ([]rules.Event, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read events: %w", err)
+	}
+
+	var items []json.RawMessage
+	var header struct {
+		Kind  string            `json:"kind"`
+		Items []json.RawMessage `json:"items"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, fmt.Errorf("failed to parse events %s: %w", path, err)
+	}
+	if header.Kind == "List" || header.Kind == "EventList" {
+		items = header.Items
+	} else {
+		items = []json.RawMessage{data}
+	}
+
+	events := make([]rules.Event, 0, len(items))
+	for _, item := range items {
+		event, err := decodeEvent(item)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse event %s: %w", path, err)
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// decodeEvent decodes an event of either event API
+func decodeEvent(data []byte) (rules.Event, error) {
+	var typeMeta struct {
+		APIVersion string `json:"apiVersion"`
+	}
+	if err := json.Unmarshal(data, &typeMeta); err != nil {
+		return rules.Event{}, err
+	}
+
+	if typeMeta.APIVersion == eventsv1.SchemeGroupVersion.String() {
+		var event eventsv1.Event
+		if err := json.Unmarshal(data, &event); err != nil {
+			return rules.Event{}, err
+		}
+		return rules.FromEventsV1(&event), nil
+	}
+
+	var event corev1.Event
+	if err := json.Unmarshal(data, &event); err != nil {
+		return rules.Event{}, err
+	}
+	return rules.FromKubernetes(&event), nil
+}
+
+// valueOrDash returns s, or "-" when s is empty
+func valueOrDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -13,6 +13,7 @@ import (
 	"go.uber.org/zap/zapcore"
 	"gopkg.in/yaml.v3"
 
+	"github.com/kart-io/k8s-agent/orchestrator-service/internal/api"
 	"github.com/kart-io/k8s-agent/orchestrator-service/internal/storage"
 	"github.com/kart-io/k8s-agent/orchestrator-service/internal/strategy"
 	"github.com/kart-io/k8s-agent/orchestrator-service/internal/subscriber"
@@ -85,12 +86,19 @@ func run(config *types.Config, logger *zap.Logger) error {
 	// Initialize workflow components
 	logger.Info("Initializing workflow engine")
 	executor := workflow.NewExecutor(
+		pgStore,
 		"http://agent-manager:8080",
 		config.AI.ReasoningServiceURL,
+		config.Remediation,
 		logger)
 
 	engine := workflow.NewEngine(pgStore, redisStore, executor, logger)
 
+	// Remediations cut short by a previous run cannot be resumed
+	if err := engine.FailStaleRemediations(ctx); err != nil {
+		return fmt.Errorf("failed to recover remediations: %w", err)
+	}
+
 	// Initialize strategy manager
 	logger.Info("Initializing strategy manager")
 	strategyManager := strategy.NewManager(pgStore, engine, logger)
@@ -103,14 +111,35 @@ func run(config *types.Config, logger *zap.Logger) error {
 	}
 	defer eventSubscriber.Stop()
 
+	// Initialize API server
+	logger.Info("Initializing API server")
+	apiServer := api.NewServer(config.Server, engine, pgStore, redisStore, logger)
+
+	// Start API server in goroutine
+	errChan := make(chan error, 1)
+	go func() {
+		if err := apiServer.Start(); err != nil {
+			errChan <- fmt.Errorf("API server error: %w", err)
+		}
+	}()
+
 	logger.Info("Orchestrator Service started successfully")
 
-	// Wait for interrupt signal
+	// Wait for interrupt signal or error
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
-	<-sigCh
+
+	select {
+	case err := <-errChan:
+		return err
+	case <-sigCh:
+	}
 
 	logger.Info("Shutting down gracefully")
+	if err := apiServer.Stop(); err != nil {
+		logger.Error("Error stopping API server", zap.Error(err))
+	}
+	engine.Stop()
 	return nil
 }
 
@@ -0,0 +1,335 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/kart-io/k8s-agent/orchestrator-service/internal/storage"
+	"github.com/kart-io/k8s-agent/orchestrator-service/internal/workflow"
+	"github.com/kart-io/k8s-agent/orchestrator-service/pkg/types"
+)
+
+// Server represents the API server
+type Server struct {
+	config     types.ServerConfig
+	router     *gin.Engine
+	httpServer *http.Server
+	logger     *zap.Logger
+
+	// Components
+	engine *workflow.Engine
+	store  *storage.PostgresStore
+	cache  *storage.RedisStore
+}
+
+// NewServer creates a new API server
+func NewServer(
+	config types.ServerConfig,
+	engine *workflow.Engine,
+	store *storage.PostgresStore,
+	cache *storage.RedisStore,
+	logger *zap.Logger,
+) *Server {
+	// Set gin mode
+	if logger.Core().Enabled(zap.DebugLevel) {
+		gin.SetMode(gin.DebugMode)
+	} else {
+		gin.SetMode(gin.ReleaseMode)
+	}
+
+	return &Server{
+		config: config,
+		router: gin.New(),
+		logger: logger.With(zap.String("component", "api-server")),
+		engine: engine,
+		store:  store,
+		cache:  cache,
+	}
+}
+
+// Start starts the API server
+func (s *Server) Start() error {
+	// Setup middlewares
+	s.router.Use(gin.Recovery())
+	s.router.Use(s.loggingMiddleware())
+
+	// Setup routes
+	s.setupRoutes()
+
+	// Create HTTP server
+	addr := fmt.Sprintf("%s:%d", s.config.Host, s.config.Port)
+	s.httpServer = &http.Server{
+		Addr:         addr,
+		Handler:      s.router,
+		ReadTimeout:  s.config.ReadTimeout,
+		WriteTimeout: s.config.WriteTimeout,
+	}
+
+	s.logger.Info("Starting API server", zap.String("addr", addr))
+
+	// Start server
+	if err := s.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return fmt.Errorf("failed to start server: %w", err)
+	}
+
+	return nil
+}
+
+// Stop stops the API server gracefully
+func (s *Server) Stop() error {
+	s.logger.Info("Stopping API server")
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.GracefulStop)
+	defer cancel()
+
+	if err := s.httpServer.Shutdown(ctx); err != nil {
+		return fmt.Errorf("server forced to shutdown: %w", err)
+	}
+
+	s.logger.Info("API server stopped")
+
+	return nil
+}
+
+// setupRoutes sets up API routes
+func (s *Server) setupRoutes() {
+	// Health endpoints
+	health := s.router.Group("/health")
+	{
+		health.GET("/live", s.handleLiveness)
+		health.GET("/ready", s.handleReadiness)
+		health.GET("/status", s.handleStatus)
+	}
+
+	// API v1
+	v1 := s.router.Group("/api/v1")
+	{
+		// Workflow executions
+		executions := v1.Group("/executions")
+		{
+			executions.GET("/:id", s.handleGetExecution)
+			executions.POST("/:id/cancel", s.handleCancelExecution)
+		}
+
+		// Remediation executions
+		remediations := v1.Group("/remediations")
+		{
+			remediations.GET("", s.handleListRemediations)
+			remediations.GET("/:id", s.handleGetRemediation)
+			remediations.POST("/:id/approve", s.handleApproveRemediation)
+			remediations.POST("/:id/reject", s.handleRejectRemediation)
+			remediations.POST("/:id/rollback", s.handleRollbackRemediation)
+		}
+	}
+}
+
+// Health handlers
+
+func (s *Server) handleLiveness(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status": "alive",
+	})
+}
+
+func (s *Server) handleReadiness(c *gin.Context) {
+	// Check database
+	if err := s.store.Health(c.Request.Context()); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status": "not ready",
+			"reason": "database unavailable",
+		})
+		return
+	}
+
+	// Check Redis
+	if err := s.cache.Health(c.Request.Context()); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status": "not ready",
+			"reason": "redis unavailable",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ready",
+	})
+}
+
+func (s *Server) handleStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status":    "healthy",
+		"engine":    s.engine.GetStatistics(),
+		"timestamp": time.Now(),
+	})
+}
+
+// Execution handlers
+
+func (s *Server) handleGetExecution(c *gin.Context) {
+	execution, err := s.engine.GetExecution(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "execution not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, execution)
+}
+
+func (s *Server) handleCancelExecution(c *gin.Context) {
+	executionID := c.Param("id")
+
+	if err := s.engine.CancelExecution(c.Request.Context(), executionID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"execution_id": executionID,
+		"message":      "execution cancelled",
+	})
+}
+
+// Remediation handlers
+
+// reviewRequest is the body of the approve and reject requests
+type reviewRequest struct {
+	User    string `json:"user" binding:"required"`
+	Comment string `json:"comment"`
+}
+
+func (s *Server) handleListRemediations(c *gin.Context) {
+	limit := 100
+	if limitStr := c.Query("limit"); limitStr != "" {
+		var err error
+		if limit, err = strconv.Atoi(limitStr); err != nil || limit <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+	}
+
+	remediations, err := s.engine.ListRemediations(c.Request.Context(), types.ExecutionStatus(c.Query("status")), limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"remediations": remediations,
+		"count":        len(remediations),
+	})
+}
+
+func (s *Server) handleGetRemediation(c *gin.Context) {
+	remediation, err := s.engine.GetRemediation(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		s.remediationError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, remediation)
+}
+
+// handleApproveRemediation approves a remediation awaiting approval, which
+// then runs in its workflow execution
+func (s *Server) handleApproveRemediation(c *gin.Context) {
+	var req reviewRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	remediationID := c.Param("id")
+	if err := s.engine.ApproveRemediation(c.Request.Context(), remediationID, req.User, req.Comment); err != nil {
+		s.remediationError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"remediation_id": remediationID,
+		"message":        "remediation approved",
+	})
+}
+
+// handleRejectRemediation rejects a remediation awaiting approval, failing
+// its step
+func (s *Server) handleRejectRemediation(c *gin.Context) {
+	var req reviewRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	remediationID := c.Param("id")
+	if err := s.engine.RejectRemediation(c.Request.Context(), remediationID, req.User, req.Comment); err != nil {
+		s.remediationError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"remediation_id": remediationID,
+		"message":        "remediation rejected",
+	})
+}
+
+// handleRollbackRemediation starts rolling back a finished remediation; the
+// outcome is recorded on the remediation execution
+func (s *Server) handleRollbackRemediation(c *gin.Context) {
+	var req struct {
+		User string `json:"user" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	remediationID := c.Param("id")
+	if err := s.engine.RollbackRemediation(c.Request.Context(), remediationID, req.User); err != nil {
+		s.remediationError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"remediation_id": remediationID,
+		"message":        "rollback requested",
+	})
+}
+
+// remediationError writes the response for an error of the remediation handlers
+func (s *Server) remediationError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, workflow.ErrRemediationNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, workflow.ErrNotAwaitingApproval), errors.Is(err, workflow.ErrRollbackUnavailable):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, workflow.ErrEngineStopped):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// Middlewares
+
+func (s *Server) loggingMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		c.Next()
+
+		duration := time.Since(start)
+
+		s.logger.Info("HTTP request",
+			zap.String("method", c.Request.Method),
+			zap.String("path", c.Request.URL.Path),
+			zap.Int("status", c.Writer.Status()),
+			zap.Duration("duration", duration),
+			zap.String("client_ip", c.ClientIP()))
+	}
+}
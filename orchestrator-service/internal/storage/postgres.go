@@ -3,7 +3,6 @@ package storage
 import (
 	"context"
 	"fmt"
-	"time"
 
 	"go.uber.org/zap"
 	"gorm.io/driver/postgres"
@@ -129,6 +128,45 @@ func (s *PostgresStore) ListStrategies(ctx context.Context, enabledOnly bool) ([
 	return strategies, nil
 }
 
+// RemediationAction operations
+func (s *PostgresStore) GetRemediationAction(ctx context.Context, id string) (*types.RemediationAction, error) {
+	var action types.RemediationAction
+	if err := s.db.WithContext(ctx).First(&action, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &action, nil
+}
+
+// RemediationExecution operations
+func (s *PostgresStore) SaveRemediationExecution(ctx context.Context, execution *types.RemediationExecution) error {
+	return s.db.WithContext(ctx).Save(execution).Error
+}
+
+func (s *PostgresStore) GetRemediationExecution(ctx context.Context, id string) (*types.RemediationExecution, error) {
+	var execution types.RemediationExecution
+	if err := s.db.WithContext(ctx).First(&execution, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &execution, nil
+}
+
+// ListRemediationExecutions lists remediation executions, newest first,
+// with the given status unless it is empty
+func (s *PostgresStore) ListRemediationExecutions(ctx context.Context, status types.ExecutionStatus, limit int) ([]*types.RemediationExecution, error) {
+	var executions []*types.RemediationExecution
+	query := s.db.WithContext(ctx)
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	if err := query.Order("started_at DESC").Find(&executions).Error; err != nil {
+		return nil, err
+	}
+	return executions, nil
+}
+
 func (s *PostgresStore) Close() error {
 	sqlDB, err := s.db.DB()
 	if err != nil {
@@ -13,9 +13,23 @@ import (
 	"github.com/kart-io/k8s-agent/orchestrator-service/pkg/types"
 )
 
+// Store persists workflows and their executions, implemented by
+// storage.PostgresStore
+type Store interface {
+	GetWorkflow(ctx context.Context, id string) (*types.Workflow, error)
+	SaveWorkflowExecution(ctx context.Context, execution *types.WorkflowExecution) error
+	GetWorkflowExecution(ctx context.Context, id string) (*types.WorkflowExecution, error)
+	UpdateWorkflowExecutionStatus(ctx context.Context, id string, status types.ExecutionStatus) error
+
+	GetRemediationAction(ctx context.Context, id string) (*types.RemediationAction, error)
+	SaveRemediationExecution(ctx context.Context, execution *types.RemediationExecution) error
+	GetRemediationExecution(ctx context.Context, id string) (*types.RemediationExecution, error)
+	ListRemediationExecutions(ctx context.Context, status types.ExecutionStatus, limit int) ([]*types.RemediationExecution, error)
+}
+
 // Engine manages workflow execution
 type Engine struct {
-	store    *storage.PostgresStore
+	store    Store
 	cache    *storage.RedisStore
 	executor *Executor
 	logger   *zap.Logger
@@ -24,6 +38,11 @@ type Engine struct {
 	mu         sync.RWMutex
 	executions map[string]*types.WorkflowExecution
 
+	// Rollbacks running in the background, cancelled by Stop
+	ctx       context.Context
+	cancel    context.CancelFunc
+	rollbacks sync.WaitGroup
+
 	// Metrics
 	executionsStarted   int64
 	executionsCompleted int64
@@ -32,20 +51,36 @@ type Engine struct {
 
 // NewEngine creates a new workflow engine
 func NewEngine(
-	store *storage.PostgresStore,
+	store Store,
 	cache *storage.RedisStore,
 	executor *Executor,
 	logger *zap.Logger,
 ) *Engine {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Engine{
 		store:      store,
 		cache:      cache,
 		executor:   executor,
 		logger:     logger.With(zap.String("component", "workflow-engine")),
 		executions: make(map[string]*types.WorkflowExecution),
+		ctx:        ctx,
+		cancel:     cancel,
 	}
 }
 
+// Stop cancels the rollbacks running in the background and waits for them
+// to record their outcome
+func (e *Engine) Stop() {
+	e.logger.Info("Stopping workflow engine")
+
+	e.mu.Lock()
+	e.cancel()
+	e.mu.Unlock()
+	e.rollbacks.Wait()
+
+	e.logger.Info("Workflow engine stopped")
+}
+
 // StartWorkflow starts a new workflow execution
 func (e *Engine) StartWorkflow(ctx context.Context, workflowID string, triggerEvent map[string]interface{}) (*types.WorkflowExecution, error) {
 	// Load workflow definition
@@ -117,6 +152,7 @@ func (e *Engine) executeWorkflow(ctx context.Context, workflow *types.Workflow,
 		}
 
 		// Execute step
+		execution.CurrentStepID = step.ID
 		stepExec, err := e.executeStep(ctx, execution, step)
 		if err != nil {
 			e.handleStepFailure(ctx, execution, step, err)
@@ -127,11 +163,7 @@ func (e *Engine) executeWorkflow(ctx context.Context, workflow *types.Workflow,
 		execution.StepExecutions = append(execution.StepExecutions, *stepExec)
 
 		// Update context with step output
-		if stepExec.Output != nil {
-			for k, v := range stepExec.Output {
-				execution.Context[fmt.Sprintf("step_%s_%s", step.ID, k)] = v
-			}
-		}
+		recordStepOutput(execution, step, stepExec.Output)
 
 		// Save progress
 		e.store.SaveWorkflowExecution(ctx, execution)
@@ -268,6 +300,14 @@ func (e *Engine) evaluateCondition(execution *types.WorkflowExecution, condition
 	return false
 }
 
+// recordStepOutput adds the output of a step to the execution context, as
+// step_<step ID>_<key>, where step conditions can read it
+func recordStepOutput(execution *types.WorkflowExecution, step types.WorkflowStep, output map[string]interface{}) {
+	for k, v := range output {
+		execution.Context[fmt.Sprintf("step_%s_%s", step.ID, k)] = v
+	}
+}
+
 // prepareStepInput prepares input for step execution
 func (e *Engine) prepareStepInput(execution *types.WorkflowExecution, step types.WorkflowStep) map[string]interface{} {
 	input := make(map[string]interface{})
@@ -356,6 +396,9 @@ func (e *Engine) CancelExecution(ctx context.Context, executionID string) error
 		return fmt.Errorf("execution not found")
 	}
 
+	// Remediations awaiting approval are rejected, failing their step
+	e.executor.approvals.rejectExecution(executionID, "execution cancelled")
+
 	execution.Status = types.ExecutionStatusCancelled
 	completedAt := time.Now()
 	execution.CompletedAt = &completedAt
@@ -388,6 +431,7 @@ func (e *Engine) GetStatistics() map[string]interface{} {
 		"executions_started":    e.executionsStarted,
 		"executions_completed":  e.executionsCompleted,
 		"executions_failed":     e.executionsFailed,
+		"remediations_awaiting_approval": e.executor.approvals.count(),
 	}
 }
 
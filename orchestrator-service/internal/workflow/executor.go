@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sync"
 	"time"
 
 	"go.uber.org/zap"
@@ -19,14 +20,37 @@ type Executor struct {
 	agentManagerURL   string
 	reasoningServiceURL string
 	httpClient        *http.Client
+	pollInterval      time.Duration // between polls of a command result
+
+	// Remediation steps resolve their actions from store and record their
+	// executions there; those requiring approval wait in approvals
+	store     Store
+	config    types.RemediationConfig
+	approvals *approvalGate
+
+	// rollbacks holds the remediation executions being rolled back
+	mu        sync.Mutex
+	rollbacks map[string]bool
 }
 
 // NewExecutor creates a new executor
 func NewExecutor(
+	store Store,
 	agentManagerURL string,
 	reasoningServiceURL string,
+	config types.RemediationConfig,
 	logger *zap.Logger,
 ) *Executor {
+	if config.ApprovalTimeout <= 0 {
+		config.ApprovalTimeout = defaultApprovalTimeout
+	}
+	if config.VerifyTimeout <= 0 {
+		config.VerifyTimeout = defaultVerifyTimeout
+	}
+	if config.VerifyInterval <= 0 {
+		config.VerifyInterval = defaultVerifyInterval
+	}
+
 	return &Executor{
 		logger:              logger.With(zap.String("component", "workflow-executor")),
 		agentManagerURL:     agentManagerURL,
@@ -34,6 +58,12 @@ func NewExecutor(
 		httpClient: &http.Client{
 			Timeout: 30 * time.Second,
 		},
+		pollInterval: 2 * time.Second,
+
+		store:     store,
+		config:    config,
+		approvals: newApprovalGate(),
+		rollbacks: make(map[string]bool),
 	}
 }
 
@@ -44,28 +74,32 @@ func (ex *Executor) ExecuteCommand(ctx context.Context, execution *types.Workflo
 		zap.String("step_id", step.ID))
 
 	// Extract command parameters from config
-	clusterID, _ := step.Config["cluster_id"].(string)
+	clusterID := stepClusterID(execution, step)
 	tool, _ := step.Config["tool"].(string)
 	action, _ := step.Config["action"].(string)
 	args, _ := step.Config["args"].([]interface{})
 
-	if clusterID == "" {
-		// Try to get from trigger event
-		if payload, ok := execution.TriggerEvent["payload"].(map[string]interface{}); ok {
-			if cid, ok := payload["cluster_id"].(string); ok {
-				clusterID = cid
-			}
-		}
+	// kubectl takes named params, e.g. name and tail_lines; the other tools
+	// take args
+	params, err := stringParams(step.Config["params"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid command params: %w", err)
 	}
 
-	// Prepare command request
+	timeout := step.Timeout
+	if timeout <= 0 {
+		timeout = defaultCommandTimeout
+	}
+
+	// Prepare command request; agent-manager takes the timeout in nanoseconds
 	cmdReq := map[string]interface{}{
 		"cluster_id": clusterID,
 		"type":       "diagnostic",
 		"tool":       tool,
 		"action":     action,
 		"args":       args,
-		"timeout":    "30s",
+		"params":     params,
+		"timeout":    timeout,
 		"issued_by":  "orchestrator-service",
 		"correlation_id": execution.ID,
 	}
@@ -79,15 +113,23 @@ func (ex *Executor) ExecuteCommand(ctx context.Context, execution *types.Workflo
 	commandID, _ := resp["id"].(string)
 
 	// Wait for result (polling)
-	result, err := ex.waitForCommandResult(ctx, commandID, 60*time.Second)
+	result, err := ex.waitForCommandResult(ctx, commandID, timeout+resultGracePeriod)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get command result: %w", err)
 	}
 
-	return map[string]interface{}{
+	// Surface the outcome at the top level, so that step conditions such as
+	// step_<id>_exit_code can branch on it
+	output := map[string]interface{}{
 		"command_id": commandID,
 		"result":     result,
-	}, nil
+	}
+	for _, key := range []string{"status", "exit_code", "stdout", "stderr", "stdout_truncated", "stderr_truncated"} {
+		if value, ok := result[key]; ok {
+			output[key] = value
+		}
+	}
+	return output, nil
 }
 
 // ExecuteAIAnalysis executes an AI analysis step
@@ -166,29 +208,6 @@ func (ex *Executor) ExecuteDecision(ctx context.Context, execution *types.Workfl
 	}, nil
 }
 
-// ExecuteRemediation executes a remediation step
-func (ex *Executor) ExecuteRemediation(ctx context.Context, execution *types.WorkflowExecution, step types.WorkflowStep) (map[string]interface{}, error) {
-	ex.logger.Info("Executing remediation step",
-		zap.String("execution_id", execution.ID),
-		zap.String("step_id", step.ID))
-
-	actionType, _ := step.Config["action_type"].(string)
-	action, _ := step.Config["action"].(string)
-
-	ex.logger.Info("Executing remediation action",
-		zap.String("action_type", actionType),
-		zap.String("action", action))
-
-	// For now, just log the action
-	// In production, this would execute actual remediation
-	return map[string]interface{}{
-		"action_type": actionType,
-		"action":      action,
-		"status":      "completed",
-		"message":     fmt.Sprintf("Remediation action %s executed", action),
-	}, nil
-}
-
 // ExecuteNotification executes a notification step
 func (ex *Executor) ExecuteNotification(ctx context.Context, execution *types.WorkflowExecution, step types.WorkflowStep) (map[string]interface{}, error) {
 	ex.logger.Info("Executing notification step",
@@ -240,6 +259,25 @@ func (ex *Executor) ExecuteWait(ctx context.Context, execution *types.WorkflowEx
 
 // Helper functions
 
+// stepClusterID returns the cluster a step runs against: the cluster_id of
+// its config, or else the cluster of the event that triggered the execution
+func stepClusterID(execution *types.WorkflowExecution, step types.WorkflowStep) string {
+	if clusterID, _ := step.Config["cluster_id"].(string); clusterID != "" {
+		return clusterID
+	}
+
+	// Try to get from trigger event
+	if payload, ok := execution.TriggerEvent["payload"].(map[string]interface{}); ok {
+		if cid, ok := payload["cluster_id"].(string); ok {
+			return cid
+		}
+	}
+	if event, ok := execution.TriggerEvent["event"].(types.InternalEvent); ok {
+		return event.ClusterID
+	}
+	return ""
+}
+
 // sendHTTPRequest sends an HTTP request
 func (ex *Executor) sendHTTPRequest(ctx context.Context, method, url string, body interface{}) (map[string]interface{}, error) {
 	var reqBody []byte
@@ -280,7 +318,7 @@ func (ex *Executor) sendHTTPRequest(ctx context.Context, method, url string, bod
 // waitForCommandResult waits for command execution result
 func (ex *Executor) waitForCommandResult(ctx context.Context, commandID string, timeout time.Duration) (map[string]interface{}, error) {
 	deadline := time.Now().Add(timeout)
-	ticker := time.NewTicker(2 * time.Second)
+	ticker := time.NewTicker(ex.pollInterval)
 	defer ticker.Stop()
 
 	for {
@@ -289,7 +327,7 @@ func (ex *Executor) waitForCommandResult(ctx context.Context, commandID string,
 			return nil, ctx.Err()
 		case <-ticker.C:
 			if time.Now().After(deadline) {
-				return nil, fmt.Errorf("timeout waiting for command result")
+				return nil, errResultTimeout
 			}
 
 			// Poll for result
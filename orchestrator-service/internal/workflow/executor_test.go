@@ -0,0 +1,82 @@
+package workflow
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/kart-io/k8s-agent/orchestrator-service/pkg/types"
+)
+
+func TestCommandStepExitCodeCondition(t *testing.T) {
+	stub := newStubAgentManager(t, func(cmd agentCommand, polls int) map[string]interface{} {
+		if polls < 2 {
+			return nil
+		}
+		return map[string]interface{}{
+			"command_id": "cmd-1",
+			"status":     "failed",
+			"exit_code":  1,
+			"stdout":     "",
+			"stderr":     "Error from server (NotFound): pods \"web-1\" not found\n",
+		}
+	})
+	ex := newTestExecutor(stub.URL, nil)
+
+	var step types.WorkflowStep
+	if err := json.Unmarshal([]byte(`{
+		"id": "collect_logs",
+		"type": "command",
+		"config": {
+			"cluster_id": "prod-1",
+			"tool": "kubectl",
+			"action": "logs",
+			"params": {"namespace": "shop", "name": "web-1", "tail_lines": 100, "previous": true}
+		},
+		"timeout": 45000000000
+	}`), &step); err != nil {
+		t.Fatalf("failed to decode step: %v", err)
+	}
+	execution := &types.WorkflowExecution{ID: "exec-1", Context: make(map[string]interface{})}
+
+	output, err := ex.ExecuteCommand(context.Background(), execution, step)
+	if err != nil {
+		t.Fatalf("ExecuteCommand failed: %v", err)
+	}
+
+	sent := stub.sent()
+	if len(sent) != 1 {
+		t.Fatalf("sent %d commands, want 1", len(sent))
+	}
+	if sent[0].Timeout != 45*time.Second {
+		t.Errorf("timeout = %v, want 45s", sent[0].Timeout)
+	}
+	want := map[string]string{"namespace": "shop", "name": "web-1", "tail_lines": "100", "previous": "true"}
+	if fmt.Sprint(sent[0].Params) != fmt.Sprint(want) {
+		t.Errorf("params = %v, want %v", sent[0].Params, want)
+	}
+
+	recordStepOutput(execution, step, output)
+
+	e := &Engine{}
+	tests := []struct {
+		condition string
+		want      bool
+	}{
+		{`{"field": "step_collect_logs_exit_code", "operator": "eq", "value": 1}`, true},
+		{`{"field": "step_collect_logs_exit_code", "operator": "eq", "value": 0}`, false},
+		{`{"field": "step_collect_logs_exit_code", "operator": "gt", "value": 0}`, true},
+		{`{"field": "step_collect_logs_stderr", "operator": "contains", "value": "Error from server"}`, true},
+	}
+	for _, tt := range tests {
+		var condition types.Condition
+		if err := json.Unmarshal([]byte(tt.condition), &condition); err != nil {
+			t.Fatalf("failed to decode condition: %v", err)
+		}
+		if got := e.evaluateCondition(execution, condition); got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.condition, got, tt.want)
+		}
+	}
+}
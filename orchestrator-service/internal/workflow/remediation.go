@@ -0,0 +1,1023 @@
+package workflow
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+
+	"github.com/kart-io/k8s-agent/protocol"
+
+	"github.com/kart-io/k8s-agent/orchestrator-service/pkg/types"
+)
+
+// Remediation defaults, for settings left out of the config
+const (
+	defaultApprovalTimeout    = time.Hour
+	defaultVerifyTimeout      = 5 * time.Minute
+	defaultVerifyInterval     = 10 * time.Second
+	defaultRemediationTimeout = time.Minute
+	defaultCommandTimeout     = 30 * time.Second
+
+	// verifyCommandTimeout bounds the kubectl get verifying a remediation
+	verifyCommandTimeout = 30 * time.Second
+)
+
+// resultGracePeriod is how long past its timeout the result of a command is
+// waited for, covering the time it waits on the agent
+var resultGracePeriod = 30 * time.Second
+
+// issuer is the issued_by of the commands sent to agent-manager
+const issuer = "orchestrator-service"
+
+var (
+	// ErrRemediationNotFound is returned for unknown remediation executions
+	ErrRemediationNotFound = errors.New("remediation execution not found")
+
+	// ErrNotAwaitingApproval is returned when reviewing a remediation
+	// execution that is not waiting for approval
+	ErrNotAwaitingApproval = errors.New("remediation execution is not awaiting approval")
+
+	// ErrRollbackUnavailable is returned for remediations that cannot be rolled back
+	ErrRollbackUnavailable = errors.New("remediation cannot be rolled back")
+
+	// ErrEngineStopped is returned for rollbacks requested once the engine
+	// is stopping
+	ErrEngineStopped = errors.New("workflow engine stopped")
+)
+
+var (
+	// errApprovalTimeout is returned when nobody reviews a remediation in time
+	errApprovalTimeout = errors.New("approval timed out")
+
+	// errVerifyTimeout is returned when the target of a remediation does not
+	// reach the state asked for in time
+	errVerifyTimeout = errors.New("timed out verifying the remediation")
+
+	// errResultTimeout is returned when the result of a command does not
+	// come in time
+	errResultTimeout = errors.New("timeout waiting for command result")
+)
+
+// riskRanks orders the risk levels; unknown levels rank lowest
+var riskRanks = map[types.RiskLevel]int{
+	types.RiskLevelLow:      1,
+	types.RiskLevelMedium:   2,
+	types.RiskLevelHigh:     3,
+	types.RiskLevelCritical: 4,
+}
+
+// remediationRequest is the agent remediation a step asks for
+type remediationRequest struct {
+	ClusterID string            `json:"cluster_id"`
+	Action    string            `json:"action"`
+	Params    map[string]string `json:"params"`
+	DryRun    bool              `json:"dry_run"`
+	Timeout   time.Duration     `json:"timeout"`
+	Verify    bool              `json:"verify"`
+}
+
+// agentCommand is a command sent to an agent through agent-manager
+type agentCommand struct {
+	ClusterID     string            `json:"cluster_id"`
+	Type          string            `json:"type"`
+	Tool          string            `json:"tool"`
+	Action        string            `json:"action"`
+	Params        map[string]string `json:"params,omitempty"`
+	Timeout       time.Duration     `json:"timeout"`
+	IssuedBy      string            `json:"issued_by"`
+	CorrelationID string            `json:"correlation_id"`
+}
+
+// commandResult is the part of the command results of agent-manager
+// remediations read
+type commandResult struct {
+	Status   string          `json:"status"`
+	ExitCode *int            `json:"exit_code"`
+	Output   string          `json:"output"`
+	Error    string          `json:"error"`
+	Data     json.RawMessage `json:"data"`
+}
+
+// ExecuteRemediation executes a remediation step. It runs the remediation
+// action named by the action_id of the step on the agent of the cluster,
+// once approved if the action needs it, verifies the outcome, and runs the
+// rollback of the action when the remediation fails or times out.
+func (ex *Executor) ExecuteRemediation(ctx context.Context, execution *types.WorkflowExecution, step types.WorkflowStep) (map[string]interface{}, error) {
+	ex.logger.Info("Executing remediation step",
+		zap.String("execution_id", execution.ID),
+		zap.String("step_id", step.ID))
+
+	actionID, _ := step.Config["action_id"].(string)
+	if actionID == "" {
+		return nil, fmt.Errorf("remediation step requires an action_id")
+	}
+	action, err := ex.store.GetRemediationAction(ctx, actionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load remediation action %s: %w", actionID, err)
+	}
+
+	req, err := newRemediationRequest(execution, step, action)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remediation action %s: %w", action.ID, err)
+	}
+
+	rem := &types.RemediationExecution{
+		ID:          uuid.New().String(),
+		ActionID:    action.ID,
+		ExecutionID: execution.ID,
+		StepID:      step.ID,
+		ClusterID:   req.ClusterID,
+		RiskLevel:   action.RiskLevel,
+		Status:      types.ExecutionStatusPending,
+		Input:       toMap(req),
+		StartedAt:   time.Now(),
+	}
+	if err := ex.store.SaveRemediationExecution(ctx, rem); err != nil {
+		return nil, fmt.Errorf("failed to save remediation execution: %w", err)
+	}
+
+	if ex.requiresApproval(action, req) && !ex.awaitApproval(ctx, execution, action, rem) {
+		return remediationOutput(rem), fmt.Errorf("remediation %s %s: %s", action.Name, rem.Status, rem.Error)
+	}
+
+	ex.runRemediation(ctx, action, req, rem)
+	if rem.Status != types.ExecutionStatusCompleted {
+		return remediationOutput(rem), fmt.Errorf("remediation %s %s: %s", action.Name, rem.Status, rem.Error)
+	}
+	return remediationOutput(rem), nil
+}
+
+// newRemediationRequest resolves the remediation a step asks for: the agent
+// action and params of the remediation action, with the params of the step
+// taking precedence
+func newRemediationRequest(execution *types.WorkflowExecution, step types.WorkflowStep, action *types.RemediationAction) (*remediationRequest, error) {
+	if action.ActionType != types.ActionTypeRemediation {
+		return nil, fmt.Errorf("action type %q is not supported", action.ActionType)
+	}
+
+	req := &remediationRequest{
+		ClusterID: stepClusterID(execution, step),
+		Timeout:   defaultRemediationTimeout,
+		Verify:    true,
+	}
+	if req.ClusterID == "" {
+		return nil, fmt.Errorf("no cluster_id in the step config or trigger event")
+	}
+	req.Action, _ = action.Config["action"].(string)
+
+	params, err := stringParams(action.Config["params"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid action params: %w", err)
+	}
+	stepParams, err := stringParams(step.Config["params"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid step params: %w", err)
+	}
+	for k, v := range stepParams {
+		params[k] = v
+	}
+	req.Params = params
+
+	if value, ok := action.Config["timeout"].(string); ok {
+		if req.Timeout, err = time.ParseDuration(value); err != nil {
+			return nil, fmt.Errorf("invalid timeout: %w", err)
+		}
+	} else if step.Timeout > 0 {
+		req.Timeout = step.Timeout
+	}
+	if verify, ok := action.Config["verify"].(bool); ok {
+		req.Verify = verify
+	}
+	if dryRun, _ := step.Config["dry_run"].(bool); dryRun {
+		req.DryRun = true
+		req.Params[protocol.CommandParamDryRun] = "true"
+	}
+
+	if err := protocol.ValidateCommand(protocol.RemediationTool, req.Action, nil, req.Params, nil); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// requiresApproval reports whether a remediation waits for approval: when
+// its action requires it, or is at least as risky as the approval risk level
+// of the config. Dry runs change nothing and never wait.
+func (ex *Executor) requiresApproval(action *types.RemediationAction, req *remediationRequest) bool {
+	if req.DryRun {
+		return false
+	}
+	if action.RequireApproval {
+		return true
+	}
+	threshold := riskRanks[ex.config.ApprovalRiskLevel]
+	return threshold > 0 && riskRanks[action.RiskLevel] >= threshold
+}
+
+// awaitApproval pauses the execution until the remediation is reviewed, and
+// reports whether it was approved. Remediations rejected, or not reviewed in
+// time, are finished.
+func (ex *Executor) awaitApproval(ctx context.Context, execution *types.WorkflowExecution, action *types.RemediationAction, rem *types.RemediationExecution) bool {
+	rem.ApprovalRequired = true
+	rem.Status = types.ExecutionStatusWaitingApproval
+	ex.saveRemediation(ctx, rem)
+	ex.setExecutionStatus(ctx, execution, types.ExecutionStatusWaitingApproval)
+
+	ex.logger.Info("Remediation awaiting approval",
+		zap.String("remediation_id", rem.ID),
+		zap.String("execution_id", execution.ID),
+		zap.String("action_id", action.ID),
+		zap.String("risk_level", string(action.RiskLevel)))
+
+	decision, err := ex.approvals.wait(ctx, rem.ID, execution.ID, ex.config.ApprovalTimeout)
+	ex.setExecutionStatus(ctx, execution, types.ExecutionStatusRunning)
+
+	switch {
+	case errors.Is(err, errApprovalTimeout):
+		rem.Status = types.ExecutionStatusTimeout
+		rem.Error = fmt.Sprintf("not approved within %s", ex.config.ApprovalTimeout)
+	case err != nil:
+		rem.Status = types.ExecutionStatusCancelled
+		rem.Error = fmt.Sprintf("stopped awaiting approval: %v", err)
+	case !decision.approved:
+		rem.Status = types.ExecutionStatusRejected
+		rem.RejectedBy = decision.user
+		rem.ReviewComment = decision.comment
+		rem.Error = fmt.Sprintf("rejected by %s", decision.user)
+	default:
+		approvedAt := time.Now()
+		rem.ApprovedBy = decision.user
+		rem.ApprovedAt = &approvedAt
+		rem.ReviewComment = decision.comment
+		ex.logger.Info("Remediation approved",
+			zap.String("remediation_id", rem.ID),
+			zap.String("approved_by", decision.user))
+		return true
+	}
+
+	ex.finishRemediation(ctx, rem)
+	return false
+}
+
+// runRemediation runs a remediation on the agent and verifies its outcome,
+// rolling it back when it fails or times out and the rollback config of the
+// action covers it. Remediations stopped by ctx are cancelled, not rolled
+// back: whether they took effect is not known.
+func (ex *Executor) runRemediation(ctx context.Context, action *types.RemediationAction, req *remediationRequest, rem *types.RemediationExecution) {
+	rem.Status = types.ExecutionStatusRunning
+	ex.saveRemediation(ctx, rem)
+
+	commandID, result, err := ex.runAgentCommand(ctx, agentCommand{
+		ClusterID:     req.ClusterID,
+		Type:          protocol.CommandTypeRemediation,
+		Tool:          protocol.RemediationTool,
+		Action:        req.Action,
+		Params:        req.Params,
+		Timeout:       req.Timeout,
+		CorrelationID: rem.ID,
+	})
+	rem.CommandID = commandID
+	rem.Output = make(map[string]interface{})
+
+	var report *protocol.RemediationReport
+	var trigger string
+	switch {
+	case err != nil && ctx.Err() != nil:
+		rem.Status = types.ExecutionStatusCancelled
+		rem.Error = fmt.Sprintf("stopped awaiting the result: %v", ctx.Err())
+	case err != nil && commandID == "":
+		// Never reached the agent, so there is nothing to roll back
+		rem.Status = types.ExecutionStatusFailed
+		rem.Error = err.Error()
+	case errors.Is(err, errResultTimeout):
+		rem.Status = types.ExecutionStatusTimeout
+		rem.Error = err.Error()
+		trigger = types.RollbackOnTimeout
+	case err != nil:
+		// The agent answered, but not with a result that can be read
+		rem.Status = types.ExecutionStatusFailed
+		rem.Error = err.Error()
+		trigger = types.RollbackOnFailure
+	case result.Status == protocol.CommandStatusSuccess:
+		rem.Output["output"] = result.Output
+		report = &protocol.RemediationReport{}
+		if err := json.Unmarshal(result.Data, report); err != nil {
+			report = nil
+			ex.logger.Warn("Failed to decode remediation report",
+				zap.String("remediation_id", rem.ID),
+				zap.Error(err))
+		} else {
+			rem.Output["report"] = toMap(report)
+		}
+		rem.Status = types.ExecutionStatusCompleted
+		if !req.DryRun && req.Verify {
+			if err := ex.verifyRemediation(ctx, rem, req, report); err != nil {
+				rem.Error = err.Error()
+				switch {
+				case ctx.Err() != nil:
+					rem.Status = types.ExecutionStatusCancelled
+					rem.Error = fmt.Sprintf("stopped verifying: %v", ctx.Err())
+				case errors.Is(err, errVerifyTimeout):
+					rem.Status = types.ExecutionStatusTimeout
+					trigger = types.RollbackOnTimeout
+				default:
+					rem.Status = types.ExecutionStatusFailed
+					trigger = types.RollbackOnFailure
+				}
+			} else {
+				rem.Verified = true
+			}
+		}
+	case result.Status == protocol.CommandStatusTimeout:
+		rem.Status = types.ExecutionStatusTimeout
+		rem.Error = result.Error
+		trigger = types.RollbackOnTimeout
+	default:
+		rem.Status = types.ExecutionStatusFailed
+		rem.Error = result.Error
+		if rem.Error == "" {
+			rem.Error = fmt.Sprintf("command %s", result.Status)
+		}
+		trigger = types.RollbackOnFailure
+	}
+	rem.Output["command_status"] = commandStatus(result)
+	ex.finishRemediation(ctx, rem)
+
+	if trigger == "" || req.DryRun || !rollbackTriggered(action.Rollback, trigger) {
+		return
+	}
+	rollback, err := rollbackRequest(action.Rollback, req, report)
+	if err != nil {
+		rem.RollbackError = err.Error()
+		ex.saveRemediation(ctx, rem)
+		ex.logger.Warn("Remediation cannot be rolled back",
+			zap.String("remediation_id", rem.ID),
+			zap.Error(err))
+		return
+	}
+	ex.runRollback(ctx, rem, rollback, trigger)
+}
+
+// verifyRemediation polls the target of a remediation through agent-manager
+// until it reaches the state asked for: a workload rolled out, a node
+// cordoned or uncordoned, a pod gone or replaced
+func (ex *Executor) verifyRemediation(ctx context.Context, rem *types.RemediationExecution, req *remediationRequest, report *protocol.RemediationReport) error {
+	params := map[string]string{protocol.CommandParamName: req.Params[protocol.CommandParamName]}
+	switch req.Action {
+	case protocol.RemediationDeletePod:
+		params[protocol.CommandParamResource] = "pods"
+	case protocol.RemediationCordon, protocol.RemediationUncordon:
+		params[protocol.CommandParamResource] = "nodes"
+	default:
+		params[protocol.CommandParamResource] = req.Params[protocol.CommandParamKind]
+	}
+	if namespace := req.Params[protocol.CommandParamNamespace]; namespace != "" {
+		params[protocol.CommandParamNamespace] = namespace
+	}
+
+	deadline := time.Now().Add(ex.config.VerifyTimeout)
+	for {
+		var reason string
+		_, result, err := ex.runAgentCommand(ctx, agentCommand{
+			ClusterID:     req.ClusterID,
+			Type:          "diagnostic",
+			Tool:          "kubectl",
+			Action:        "get",
+			Params:        params,
+			Timeout:       verifyCommandTimeout,
+			CorrelationID: rem.ID,
+		})
+		if err != nil {
+			reason = err.Error()
+		} else {
+			var done bool
+			if done, reason = remediationDone(req, report, result); done {
+				return nil
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w: %s", errVerifyTimeout, reason)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(ex.config.VerifyInterval):
+		}
+	}
+}
+
+// remediationDone reports whether the target of a remediation, as read by a
+// kubectl get, is in the state asked for, and if not why
+func remediationDone(req *remediationRequest, report *protocol.RemediationReport, result *commandResult) (bool, string) {
+	var obj map[string]interface{}
+	if result.Status == protocol.CommandStatusSuccess {
+		if err := json.Unmarshal(result.Data, &obj); err != nil {
+			return false, fmt.Sprintf("failed to decode %s: %v", req.Params[protocol.CommandParamName], err)
+		}
+	}
+
+	switch req.Action {
+	case protocol.RemediationDeletePod:
+		if obj == nil {
+			if targetNotFound(result) {
+				return true, ""
+			}
+			return false, result.Error
+		}
+		// Pods of a statefulset come back under the same name
+		if report != nil {
+			before, _ := nestedString(report.Snapshot, "metadata", "uid")
+			if uid, _ := nestedString(obj, "metadata", "uid"); uid != before {
+				return true, ""
+			}
+		}
+		return false, "pod still terminating"
+	case protocol.RemediationCordon, protocol.RemediationUncordon:
+		if obj == nil {
+			return false, result.Error
+		}
+		want := req.Action == protocol.RemediationCordon
+		if unschedulable, _ := nestedBool(obj, "spec", "unschedulable"); unschedulable != want {
+			return false, fmt.Sprintf("node not yet %sed", req.Action)
+		}
+		return true, ""
+	default:
+		if obj == nil {
+			return false, result.Error
+		}
+		return workloadRolledOut(req.Params[protocol.CommandParamKind], obj)
+	}
+}
+
+// targetNotFound reports whether a kubectl get failed because the Kubernetes
+// API did not find the object
+func targetNotFound(result *commandResult) bool {
+	if result.Status != protocol.CommandStatusFailed || len(result.Data) == 0 {
+		return false
+	}
+	var status protocol.KubeAPIStatus
+	if err := json.Unmarshal(result.Data, &status); err != nil {
+		return false
+	}
+	return status.Reason == protocol.KubeAPIStatusNotFound
+}
+
+// workloadRolledOut reports whether a workload has rolled out, as kubectl
+// rollout status does, and if not why
+func workloadRolledOut(kind string, obj map[string]interface{}) (bool, string) {
+	generation, _ := nestedInt(obj, "metadata", "generation")
+	if observed, _ := nestedInt(obj, "status", "observedGeneration"); observed < generation {
+		return false, "waiting for the controller to observe the change"
+	}
+
+	replicas, ok := nestedInt(obj, "spec", "replicas")
+	if !ok {
+		replicas = 1
+	}
+	switch kind {
+	case protocol.WorkloadDeployment:
+		updated, _ := nestedInt(obj, "status", "updatedReplicas")
+		total, _ := nestedInt(obj, "status", "replicas")
+		available, _ := nestedInt(obj, "status", "availableReplicas")
+		switch {
+		case updated < replicas:
+			return false, fmt.Sprintf("%d of %d replicas updated", updated, replicas)
+		case total > updated:
+			return false, fmt.Sprintf("%d old replicas pending termination", total-updated)
+		case available < updated:
+			return false, fmt.Sprintf("%d of %d updated replicas available", available, updated)
+		}
+	case protocol.WorkloadStatefulSet:
+		updated, _ := nestedInt(obj, "status", "updatedReplicas")
+		ready, _ := nestedInt(obj, "status", "readyReplicas")
+		switch {
+		case updated < replicas:
+			return false, fmt.Sprintf("%d of %d replicas updated", updated, replicas)
+		case ready < replicas:
+			return false, fmt.Sprintf("%d of %d replicas ready", ready, replicas)
+		}
+	case protocol.WorkloadDaemonSet:
+		desired, _ := nestedInt(obj, "status", "desiredNumberScheduled")
+		updated, _ := nestedInt(obj, "status", "updatedNumberScheduled")
+		available, _ := nestedInt(obj, "status", "numberAvailable")
+		switch {
+		case updated < desired:
+			return false, fmt.Sprintf("%d of %d pods updated", updated, desired)
+		case available < desired:
+			return false, fmt.Sprintf("%d of %d pods available", available, desired)
+		}
+	}
+	return true, ""
+}
+
+// rollbackTriggered reports whether the rollback config covers a trigger;
+// configs without triggers cover them all
+func rollbackTriggered(config *types.RollbackConfig, trigger string) bool {
+	if config == nil || !config.Enabled {
+		return false
+	}
+	return len(config.TriggerOn) == 0 || slices.Contains(config.TriggerOn, trigger)
+}
+
+// rollbackRequest returns the remediation undoing another: the action of the
+// rollback config, on the same target unless its params name another, or
+// else the rollback the agent reported
+func rollbackRequest(config *types.RollbackConfig, req *remediationRequest, report *protocol.RemediationReport) (*remediationRequest, error) {
+	if config.ActionType != "" && config.ActionType != types.ActionTypeRemediation {
+		return nil, fmt.Errorf("%w: rollback action type %q is not supported", ErrRollbackUnavailable, config.ActionType)
+	}
+
+	rollback := &remediationRequest{ClusterID: req.ClusterID, Timeout: req.Timeout}
+	if action, _ := config.Config["action"].(string); action != "" {
+		rollback.Action = action
+		rollback.Params = make(map[string]string)
+		if schema, err := protocol.LookupCommandSchema(protocol.RemediationTool, action); err == nil {
+			for _, key := range []string{protocol.CommandParamKind, protocol.CommandParamName, protocol.CommandParamNamespace} {
+				if _, ok := schema.Params[key]; ok && req.Params[key] != "" {
+					rollback.Params[key] = req.Params[key]
+				}
+			}
+		}
+		params, err := stringParams(config.Config["params"])
+		if err != nil {
+			return nil, fmt.Errorf("invalid rollback params: %w", err)
+		}
+		for k, v := range params {
+			rollback.Params[k] = v
+		}
+	} else if report != nil && report.Rollback != nil {
+		rollback.Action = report.Rollback.Action
+		rollback.Params = report.Rollback.Params
+	} else {
+		return nil, fmt.Errorf("%w: the rollback config names no action and the agent reported no rollback", ErrRollbackUnavailable)
+	}
+
+	if err := protocol.ValidateCommand(protocol.RemediationTool, rollback.Action, nil, rollback.Params, nil); err != nil {
+		return nil, fmt.Errorf("invalid rollback: %w", err)
+	}
+	return rollback, nil
+}
+
+// runRollback runs the rollback of a remediation on the agent
+func (ex *Executor) runRollback(ctx context.Context, rem *types.RemediationExecution, rollback *remediationRequest, trigger string) {
+	ex.mu.Lock()
+	if ex.rollbacks[rem.ID] {
+		ex.mu.Unlock()
+		return
+	}
+	ex.rollbacks[rem.ID] = true
+	ex.mu.Unlock()
+	defer func() {
+		ex.mu.Lock()
+		delete(ex.rollbacks, rem.ID)
+		ex.mu.Unlock()
+	}()
+
+	ex.logger.Warn("Rolling back remediation",
+		zap.String("remediation_id", rem.ID),
+		zap.String("trigger", trigger),
+		zap.String("action", rollback.Action))
+
+	commandID, result, err := ex.runAgentCommand(ctx, agentCommand{
+		ClusterID:     rollback.ClusterID,
+		Type:          protocol.CommandTypeRemediation,
+		Tool:          protocol.RemediationTool,
+		Action:        rollback.Action,
+		Params:        rollback.Params,
+		Timeout:       rollback.Timeout,
+		CorrelationID: rem.ID,
+	})
+	rem.RollbackCommandID = commandID
+
+	switch {
+	case err != nil && ctx.Err() != nil:
+		rem.RollbackError = fmt.Sprintf("rollback interrupted: %v", ctx.Err())
+	case err != nil:
+		rem.RollbackError = err.Error()
+	case result.Status != protocol.CommandStatusSuccess:
+		rem.RollbackError = fmt.Sprintf("command %s: %s", result.Status, result.Error)
+	default:
+		rollbackAt := time.Now()
+		rem.RolledBack = true
+		rem.RollbackAt = &rollbackAt
+		rem.RollbackError = ""
+	}
+	// The outcome is recorded even when the rollback was interrupted
+	ex.saveRemediation(context.WithoutCancel(ctx), rem)
+
+	if rem.RolledBack {
+		ex.logger.Info("Remediation rolled back",
+			zap.String("remediation_id", rem.ID),
+			zap.String("command_id", commandID))
+	} else {
+		ex.logger.Error("Remediation rollback failed",
+			zap.String("remediation_id", rem.ID),
+			zap.String("error", rem.RollbackError))
+	}
+}
+
+// runAgentCommand sends a command through agent-manager and waits for its
+// result. Commands whose result does not come in time are cancelled.
+func (ex *Executor) runAgentCommand(ctx context.Context, cmd agentCommand) (string, *commandResult, error) {
+	cmd.IssuedBy = issuer
+	resp, err := ex.sendHTTPRequest(ctx, "POST", ex.agentManagerURL+"/api/v1/commands", cmd)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to send command: %w", err)
+	}
+	commandID, _ := resp["id"].(string)
+
+	raw, err := ex.waitForCommandResult(ctx, commandID, cmd.Timeout+resultGracePeriod)
+	if err != nil {
+		ex.cancelCommand(commandID, "orchestrator-service stopped waiting for the result")
+		return commandID, nil, fmt.Errorf("failed to get command result: %w", err)
+	}
+
+	var result commandResult
+	if err := fromMap(raw, &result); err != nil {
+		return commandID, nil, fmt.Errorf("failed to decode command result: %w", err)
+	}
+	return commandID, &result, nil
+}
+
+// cancelCommand asks agent-manager to cancel a command, on a best-effort basis
+func (ex *Executor) cancelCommand(commandID, reason string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	url := fmt.Sprintf("%s/api/v1/commands/%s/cancel", ex.agentManagerURL, commandID)
+	if _, err := ex.sendHTTPRequest(ctx, "POST", url, map[string]string{"reason": reason}); err != nil {
+		ex.logger.Warn("Failed to cancel command",
+			zap.String("command_id", commandID),
+			zap.Error(err))
+	}
+}
+
+// finishRemediation records the end of a remediation execution, even one
+// stopped by ctx
+func (ex *Executor) finishRemediation(ctx context.Context, rem *types.RemediationExecution) {
+	completedAt := time.Now()
+	rem.CompletedAt = &completedAt
+	ex.saveRemediation(context.WithoutCancel(ctx), rem)
+
+	ex.logger.Info("Remediation finished",
+		zap.String("remediation_id", rem.ID),
+		zap.String("status", string(rem.Status)),
+		zap.Bool("verified", rem.Verified),
+		zap.String("error", rem.Error))
+}
+
+// saveRemediation saves a remediation execution, logging failures: the
+// remediation goes on regardless
+func (ex *Executor) saveRemediation(ctx context.Context, rem *types.RemediationExecution) {
+	if err := ex.store.SaveRemediationExecution(ctx, rem); err != nil {
+		ex.logger.Warn("Failed to save remediation execution",
+			zap.String("remediation_id", rem.ID),
+			zap.Error(err))
+	}
+}
+
+// setExecutionStatus sets the status of a workflow execution
+func (ex *Executor) setExecutionStatus(ctx context.Context, execution *types.WorkflowExecution, status types.ExecutionStatus) {
+	execution.Status = status
+	if err := ex.store.UpdateWorkflowExecutionStatus(ctx, execution.ID, status); err != nil {
+		ex.logger.Warn("Failed to update execution status",
+			zap.String("execution_id", execution.ID),
+			zap.Error(err))
+	}
+}
+
+// remediationOutput returns the step output of a remediation execution
+func remediationOutput(rem *types.RemediationExecution) map[string]interface{} {
+	output := map[string]interface{}{
+		"remediation_id": rem.ID,
+		"status":         string(rem.Status),
+		"command_id":     rem.CommandID,
+		"approved_by":    rem.ApprovedBy,
+		"verified":       rem.Verified,
+		"rolled_back":    rem.RolledBack,
+	}
+	if rem.Error != "" {
+		output["error"] = rem.Error
+	}
+	if report, ok := rem.Output["report"]; ok {
+		output["report"] = report
+	}
+	return output
+}
+
+// approvalDecision is the review of a remediation awaiting approval
+type approvalDecision struct {
+	approved bool
+	user     string
+	comment  string
+}
+
+// approvalGate holds the remediations awaiting approval, by ID of their
+// remediation execution, until they are reviewed. Approvals are kept in
+// memory: remediations awaiting approval when the service stops are failed
+// on the next start.
+type approvalGate struct {
+	mu      sync.Mutex
+	pending map[string]*pendingApproval
+}
+
+// pendingApproval is a remediation awaiting approval
+type pendingApproval struct {
+	executionID string // workflow execution
+	decision    chan approvalDecision
+}
+
+func newApprovalGate() *approvalGate {
+	return &approvalGate{pending: make(map[string]*pendingApproval)}
+}
+
+// wait blocks until the remediation is reviewed, the timeout passes or ctx ends
+func (g *approvalGate) wait(ctx context.Context, remediationID, executionID string, timeout time.Duration) (approvalDecision, error) {
+	p := &pendingApproval{executionID: executionID, decision: make(chan approvalDecision, 1)}
+	g.mu.Lock()
+	g.pending[remediationID] = p
+	g.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case d := <-p.decision:
+		return d, nil
+	case <-timer.C:
+		err = errApprovalTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	// A review may have come in at the same time
+	g.mu.Lock()
+	delete(g.pending, remediationID)
+	g.mu.Unlock()
+	select {
+	case d := <-p.decision:
+		return d, nil
+	default:
+		return approvalDecision{}, err
+	}
+}
+
+// decide reviews a remediation, returning false when it is not awaiting approval
+func (g *approvalGate) decide(remediationID string, d approvalDecision) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	p, ok := g.pending[remediationID]
+	if !ok {
+		return false
+	}
+	delete(g.pending, remediationID)
+	p.decision <- d
+	return true
+}
+
+// rejectExecution rejects the remediations of a workflow execution awaiting approval
+func (g *approvalGate) rejectExecution(executionID, reason string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for id, p := range g.pending {
+		if p.executionID == executionID {
+			delete(g.pending, id)
+			p.decision <- approvalDecision{user: issuer, comment: reason}
+		}
+	}
+}
+
+// count returns the number of remediations awaiting approval
+func (g *approvalGate) count() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.pending)
+}
+
+// GetRemediation returns a remediation execution
+func (e *Engine) GetRemediation(ctx context.Context, id string) (*types.RemediationExecution, error) {
+	rem, err := e.store.GetRemediationExecution(ctx, id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrRemediationNotFound
+	}
+	return rem, err
+}
+
+// ListRemediations lists remediation executions, newest first, with the
+// given status unless it is empty
+func (e *Engine) ListRemediations(ctx context.Context, status types.ExecutionStatus, limit int) ([]*types.RemediationExecution, error) {
+	return e.store.ListRemediationExecutions(ctx, status, limit)
+}
+
+// ApproveRemediation approves a remediation awaiting approval, which then runs
+func (e *Engine) ApproveRemediation(ctx context.Context, id, user, comment string) error {
+	return e.reviewRemediation(ctx, id, approvalDecision{approved: true, user: user, comment: comment})
+}
+
+// RejectRemediation rejects a remediation awaiting approval, failing its step
+func (e *Engine) RejectRemediation(ctx context.Context, id, user, comment string) error {
+	return e.reviewRemediation(ctx, id, approvalDecision{user: user, comment: comment})
+}
+
+// reviewRemediation passes a review to a remediation awaiting approval
+func (e *Engine) reviewRemediation(ctx context.Context, id string, d approvalDecision) error {
+	if !e.executor.approvals.decide(id, d) {
+		if _, err := e.GetRemediation(ctx, id); err != nil {
+			return err
+		}
+		return ErrNotAwaitingApproval
+	}
+
+	e.logger.Info("Remediation reviewed",
+		zap.String("remediation_id", id),
+		zap.Bool("approved", d.approved),
+		zap.String("user", d.user))
+	return nil
+}
+
+// RollbackRemediation starts rolling back a finished remediation, when the
+// rollback config of its action allows manual rollbacks. The rollback runs in
+// the background; its outcome is recorded on the remediation execution.
+func (e *Engine) RollbackRemediation(ctx context.Context, id, user string) error {
+	rem, err := e.GetRemediation(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	var req remediationRequest
+	if err := fromMap(rem.Input, &req); err != nil {
+		return fmt.Errorf("failed to decode remediation request: %w", err)
+	}
+	switch {
+	case rem.RolledBack:
+		return fmt.Errorf("%w: it was already rolled back", ErrRollbackUnavailable)
+	case rem.CommandID == "" || rem.CompletedAt == nil:
+		return fmt.Errorf("%w: it has not run", ErrRollbackUnavailable)
+	case req.DryRun:
+		return fmt.Errorf("%w: it was a dry run", ErrRollbackUnavailable)
+	}
+
+	action, err := e.store.GetRemediationAction(ctx, rem.ActionID)
+	if err != nil {
+		return fmt.Errorf("failed to load remediation action %s: %w", rem.ActionID, err)
+	}
+	if !rollbackTriggered(action.Rollback, types.RollbackOnManual) {
+		return fmt.Errorf("%w: action %s does not allow manual rollbacks", ErrRollbackUnavailable, action.ID)
+	}
+
+	var report *protocol.RemediationReport
+	if value, ok := rem.Output["report"].(map[string]interface{}); ok {
+		report = &protocol.RemediationReport{}
+		if err := fromMap(value, report); err != nil {
+			return fmt.Errorf("failed to decode remediation report: %w", err)
+		}
+	}
+	rollback, err := rollbackRequest(action.Rollback, &req, report)
+	if err != nil {
+		return err
+	}
+
+	e.logger.Info("Manual remediation rollback requested",
+		zap.String("remediation_id", id),
+		zap.String("user", user))
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.ctx.Err() != nil {
+		return ErrEngineStopped
+	}
+	e.rollbacks.Add(1)
+	go func() {
+		defer e.rollbacks.Done()
+		e.executor.runRollback(e.ctx, rem, rollback, types.RollbackOnManual)
+	}()
+	return nil
+}
+
+// FailStaleRemediations fails the remediations left awaiting approval or
+// running by a previous run of the service, whose outcome is unknown
+func (e *Engine) FailStaleRemediations(ctx context.Context) error {
+	for _, status := range []types.ExecutionStatus{types.ExecutionStatusWaitingApproval, types.ExecutionStatusRunning} {
+		stale, err := e.store.ListRemediationExecutions(ctx, status, 0)
+		if err != nil {
+			return fmt.Errorf("failed to list remediation executions: %w", err)
+		}
+		for _, rem := range stale {
+			rem.Status = types.ExecutionStatusFailed
+			rem.Error = fmt.Sprintf("orchestrator-service restarted while the remediation was %s", status)
+			e.executor.finishRemediation(ctx, rem)
+		}
+	}
+	return nil
+}
+
+// Helper functions
+
+// stringParams converts params decoded from JSON to command params
+func stringParams(value interface{}) (map[string]string, error) {
+	params := make(map[string]string)
+	switch v := value.(type) {
+	case nil:
+	case map[string]string:
+		for k, s := range v {
+			params[k] = s
+		}
+	case map[string]interface{}:
+		for k, raw := range v {
+			switch s := raw.(type) {
+			case string:
+				params[k] = s
+			case float64:
+				params[k] = strconv.FormatFloat(s, 'f', -1, 64)
+			case bool:
+				params[k] = strconv.FormatBool(s)
+			default:
+				return nil, fmt.Errorf("param %s must be a string, number or boolean", k)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("params must be an object")
+	}
+	return params, nil
+}
+
+// commandStatus returns the status of a command result, if any
+func commandStatus(result *commandResult) string {
+	if result == nil {
+		return ""
+	}
+	return result.Status
+}
+
+// toMap converts a value to its JSON object
+func toMap(v interface{}) map[string]interface{} {
+	data, _ := json.Marshal(v)
+	var m map[string]interface{}
+	json.Unmarshal(data, &m)
+	return m
+}
+
+// fromMap decodes a JSON object into v
+func fromMap(m map[string]interface{}, v interface{}) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// nestedInt returns the number at a path of a JSON object
+func nestedInt(obj map[string]interface{}, fields ...string) (int64, bool) {
+	value, ok := nestedValue(obj, fields...)
+	if !ok {
+		return 0, false
+	}
+	n, ok := value.(float64)
+	return int64(n), ok
+}
+
+// nestedString returns the string at a path of a JSON object
+func nestedString(obj map[string]interface{}, fields ...string) (string, bool) {
+	value, ok := nestedValue(obj, fields...)
+	if !ok {
+		return "", false
+	}
+	s, ok := value.(string)
+	return s, ok
+}
+
+// nestedBool returns the boolean at a path of a JSON object
+func nestedBool(obj map[string]interface{}, fields ...string) (bool, bool) {
+	value, ok := nestedValue(obj, fields...)
+	if !ok {
+		return false, false
+	}
+	b, ok := value.(bool)
+	return b, ok
+}
+
+// nestedValue returns the value at a path of a JSON object
+func nestedValue(obj map[string]interface{}, fields ...string) (interface{}, bool) {
+	var value interface{} = obj
+	for _, field := range fields {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = m[field]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
@@ -0,0 +1,947 @@
+package workflow
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+
+	"github.com/kart-io/k8s-agent/protocol"
+
+	"github.com/kart-io/k8s-agent/orchestrator-service/pkg/types"
+)
+
+// memoryStore is a Store keeping remediation actions and executions in memory
+type memoryStore struct {
+	mu           sync.Mutex
+	actions      map[string]*types.RemediationAction
+	remediations map[string]types.RemediationExecution
+	statuses     map[string]types.ExecutionStatus // of workflow executions
+}
+
+func newMemoryStore(actions ...*types.RemediationAction) *memoryStore {
+	s := &memoryStore{
+		actions:      make(map[string]*types.RemediationAction),
+		remediations: make(map[string]types.RemediationExecution),
+		statuses:     make(map[string]types.ExecutionStatus),
+	}
+	for _, action := range actions {
+		s.actions[action.ID] = action
+	}
+	return s
+}
+
+func (s *memoryStore) GetWorkflow(ctx context.Context, id string) (*types.Workflow, error) {
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (s *memoryStore) SaveWorkflowExecution(ctx context.Context, execution *types.WorkflowExecution) error {
+	return s.UpdateWorkflowExecutionStatus(ctx, execution.ID, execution.Status)
+}
+
+func (s *memoryStore) GetWorkflowExecution(ctx context.Context, id string) (*types.WorkflowExecution, error) {
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (s *memoryStore) UpdateWorkflowExecutionStatus(ctx context.Context, id string, status types.ExecutionStatus) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statuses[id] = status
+	return nil
+}
+
+func (s *memoryStore) GetRemediationAction(ctx context.Context, id string) (*types.RemediationAction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	action, ok := s.actions[id]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return action, nil
+}
+
+func (s *memoryStore) SaveRemediationExecution(ctx context.Context, execution *types.RemediationExecution) error {
+	// Like a database, refuse to write once ctx is done
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remediations[execution.ID] = *execution
+	return nil
+}
+
+func (s *memoryStore) GetRemediationExecution(ctx context.Context, id string) (*types.RemediationExecution, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rem, ok := s.remediations[id]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &rem, nil
+}
+
+func (s *memoryStore) ListRemediationExecutions(ctx context.Context, status types.ExecutionStatus, limit int) ([]*types.RemediationExecution, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var executions []*types.RemediationExecution
+	for _, rem := range s.remediations {
+		if status == "" || rem.Status == status {
+			rem := rem
+			executions = append(executions, &rem)
+		}
+	}
+	sort.Slice(executions, func(i, j int) bool { return executions[i].StartedAt.After(executions[j].StartedAt) })
+	if limit > 0 && len(executions) > limit {
+		executions = executions[:limit]
+	}
+	return executions, nil
+}
+
+// remediation returns the saved remediation execution, failing the test when
+// there is none
+func (s *memoryStore) remediation(t *testing.T, id string) types.RemediationExecution {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rem, ok := s.remediations[id]
+	if !ok {
+		t.Fatalf("remediation %s was not saved", id)
+	}
+	return rem
+}
+
+// stubAgentManager serves the command API of agent-manager, answering each
+// command with the result respond returns, or 404 while it returns nil
+type stubAgentManager struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	commands  []agentCommand
+	cancelled []string
+	respond   func(cmd agentCommand, polls int) map[string]interface{}
+	polls     map[string]int
+}
+
+func newStubAgentManager(t *testing.T, respond func(cmd agentCommand, polls int) map[string]interface{}) *stubAgentManager {
+	t.Helper()
+
+	s := &stubAgentManager{respond: respond, polls: make(map[string]int)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *stubAgentManager) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/v1/commands")
+	switch {
+	case r.Method == http.MethodPost && path == "":
+		// Like agent-manager, refuse a timeout that is not in nanoseconds
+		var cmd agentCommand
+		if err := json.NewDecoder(r.Body).Decode(&cmd); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		s.commands = append(s.commands, cmd)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"id": fmt.Sprintf("cmd-%d", len(s.commands))})
+	case r.Method == http.MethodGet && strings.HasSuffix(path, "/result"):
+		id := strings.TrimSuffix(strings.TrimPrefix(path, "/"), "/result")
+		var n int
+		if _, err := fmt.Sscanf(id, "cmd-%d", &n); err != nil || n < 1 || n > len(s.commands) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		s.polls[id]++
+		result := s.respond(s.commands[n-1], s.polls[id])
+		if result == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(result)
+	case r.Method == http.MethodPost && strings.HasSuffix(path, "/cancel"):
+		s.cancelled = append(s.cancelled, strings.TrimSuffix(strings.TrimPrefix(path, "/"), "/cancel"))
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"message": "cancel requested"})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// sent returns the commands received
+func (s *stubAgentManager) sent() []agentCommand {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]agentCommand(nil), s.commands...)
+}
+
+// newTestExecutor returns an executor polling the stub quickly
+func newTestExecutor(agentManagerURL string, store Store) *Executor {
+	ex := NewExecutor(store, agentManagerURL, "", types.RemediationConfig{
+		ApprovalTimeout: 5 * time.Second,
+		VerifyTimeout:   200 * time.Millisecond,
+		VerifyInterval:  10 * time.Millisecond,
+	}, zap.NewNop())
+	ex.pollInterval = 10 * time.Millisecond
+	return ex
+}
+
+// waitFor polls cond until it holds, failing the test after a few seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// decodeObject decodes a JSON object as agents return it
+func decodeObject(t *testing.T, s string) map[string]interface{} {
+	t.Helper()
+	var obj map[string]interface{}
+	if err := json.Unmarshal([]byte(s), &obj); err != nil {
+		t.Fatalf("failed to decode %s: %v", s, err)
+	}
+	return obj
+}
+
+// commandSuccess is the result of a command that succeeded with data
+func commandSuccess(data interface{}) map[string]interface{} {
+	return map[string]interface{}{"status": protocol.CommandStatusSuccess, "exit_code": 0, "data": data}
+}
+
+// commandFailure is the result of a command that failed
+func commandFailure(message string) map[string]interface{} {
+	return map[string]interface{}{"status": protocol.CommandStatusFailed, "exit_code": 1, "error": message}
+}
+
+const rolledOutDeployment = `{"kind": "Deployment",
+	"metadata": {"name": "web", "namespace": "shop", "generation": 2},
+	"spec": {"replicas": 2},
+	"status": {"observedGeneration": 2, "replicas": 2, "updatedReplicas": 2, "availableReplicas": 2}}`
+
+// rolloutAgent answers remediations of the web deployment, and reads of it
+// as rolled out
+func rolloutAgent(cmd agentCommand, polls int) map[string]interface{} {
+	if cmd.Tool == "kubectl" {
+		var obj map[string]interface{}
+		json.Unmarshal([]byte(rolledOutDeployment), &obj)
+		return commandSuccess(obj)
+	}
+	return commandSuccess(protocol.RemediationReport{
+		Action:  cmd.Action,
+		Target:  protocol.RemediationTarget{Kind: "Deployment", Namespace: "shop", Name: "web"},
+		Changed: true,
+	})
+}
+
+// webAction returns a remediation action on the web deployment
+func webAction(id, action string, params map[string]interface{}) *types.RemediationAction {
+	config := map[string]interface{}{"kind": "deployment", "name": "web", "namespace": "shop"}
+	for k, v := range params {
+		config[k] = v
+	}
+	return &types.RemediationAction{
+		ID:         id,
+		Name:       id,
+		ActionType: types.ActionTypeRemediation,
+		Config:     map[string]interface{}{"action": action, "params": config},
+		RiskLevel:  types.RiskLevelMedium,
+	}
+}
+
+// remediationStep returns a step running a remediation action on prod-1
+func remediationStep(actionID string) types.WorkflowStep {
+	return types.WorkflowStep{
+		ID:     "remediate",
+		Config: map[string]interface{}{"action_id": actionID, "cluster_id": "prod-1"},
+	}
+}
+
+func TestRemediationApprovalGate(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name         string
+		review       func(e *Engine, id string) error // nil lets the approval time out
+		wantStatus   types.ExecutionStatus
+		wantCommands int
+		check        func(t *testing.T, rem types.RemediationExecution)
+	}{
+		{
+			name:         "approved",
+			review:       func(e *Engine, id string) error { return e.ApproveRemediation(ctx, id, "alice", "go ahead") },
+			wantStatus:   types.ExecutionStatusCompleted,
+			wantCommands: 2, // the restart and the read verifying it
+			check: func(t *testing.T, rem types.RemediationExecution) {
+				if rem.ApprovedBy != "alice" || rem.ApprovedAt == nil || !rem.Verified {
+					t.Errorf("approved by %q at %v, verified %v, want alice, a time and verified", rem.ApprovedBy, rem.ApprovedAt, rem.Verified)
+				}
+			},
+		},
+		{
+			name:       "rejected",
+			review:     func(e *Engine, id string) error { return e.RejectRemediation(ctx, id, "bob", "peak hours") },
+			wantStatus: types.ExecutionStatusRejected,
+			check: func(t *testing.T, rem types.RemediationExecution) {
+				if rem.RejectedBy != "bob" || rem.ReviewComment != "peak hours" || rem.CompletedAt == nil {
+					t.Errorf("rejected by %q with %q, completed at %v, want bob, the comment and a time", rem.RejectedBy, rem.ReviewComment, rem.CompletedAt)
+				}
+			},
+		},
+		{
+			name:       "timed out",
+			wantStatus: types.ExecutionStatusTimeout,
+			check: func(t *testing.T, rem types.RemediationExecution) {
+				if !strings.Contains(rem.Error, "not approved within") {
+					t.Errorf("error = %q, want not approved", rem.Error)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			action := webAction("restart-web", protocol.RemediationRolloutRestart, nil)
+			action.RequireApproval = true
+			store := newMemoryStore(action)
+			stub := newStubAgentManager(t, rolloutAgent)
+			ex := newTestExecutor(stub.URL, store)
+			if tt.review == nil {
+				ex.config.ApprovalTimeout = 50 * time.Millisecond
+			}
+			e := NewEngine(store, nil, ex, zap.NewNop())
+			defer e.Stop()
+
+			execution := &types.WorkflowExecution{ID: "exec-1", Context: make(map[string]interface{})}
+			done := make(chan error, 1)
+			go func() {
+				_, err := ex.ExecuteRemediation(ctx, execution, remediationStep(action.ID))
+				done <- err
+			}()
+
+			var id string
+			if tt.review != nil {
+				waitFor(t, "the remediation to await approval", func() bool {
+					waiting, _ := store.ListRemediationExecutions(ctx, types.ExecutionStatusWaitingApproval, 0)
+					if len(waiting) == 1 {
+						id = waiting[0].ID
+					}
+					return id != "" && ex.approvals.count() == 1
+				})
+				if err := tt.review(e, id); err != nil {
+					t.Fatalf("review failed: %v", err)
+				}
+			}
+
+			var err error
+			select {
+			case err = <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("remediation did not finish")
+			}
+			if (err == nil) != (tt.wantStatus == types.ExecutionStatusCompleted) {
+				t.Errorf("ExecuteRemediation error = %v, want one unless completed", err)
+			}
+			if remediations, _ := store.ListRemediationExecutions(ctx, "", 0); len(remediations) == 1 {
+				id = remediations[0].ID
+			}
+
+			rem := store.remediation(t, id)
+			if rem.Status != tt.wantStatus || !rem.ApprovalRequired {
+				t.Errorf("status = %v, approval required %v, want %v and required", rem.Status, rem.ApprovalRequired, tt.wantStatus)
+			}
+			if sent := stub.sent(); len(sent) != tt.wantCommands {
+				t.Errorf("sent %d commands, want %d", len(sent), tt.wantCommands)
+			}
+			store.mu.Lock()
+			status := store.statuses[execution.ID]
+			store.mu.Unlock()
+			if status != types.ExecutionStatusRunning {
+				t.Errorf("execution status = %v, want running again", status)
+			}
+			if ex.approvals.count() != 0 {
+				t.Errorf("%d remediations still awaiting approval", ex.approvals.count())
+			}
+			if err := e.ApproveRemediation(ctx, id, "alice", ""); !errors.Is(err, ErrNotAwaitingApproval) {
+				t.Errorf("approving again = %v, want ErrNotAwaitingApproval", err)
+			}
+			tt.check(t, rem)
+		})
+	}
+}
+
+func TestRemediationRollbackOnFailure(t *testing.T) {
+	tests := []struct {
+		name         string
+		agent        func(cmd agentCommand, polls int) map[string]interface{}
+		wantStatus   types.ExecutionStatus
+		wantRollback bool
+	}{
+		{
+			name: "command failed",
+			agent: func(cmd agentCommand, polls int) map[string]interface{} {
+				if cmd.Params[protocol.CommandParamReplicas] == "5" {
+					return commandFailure("scale denied by policy")
+				}
+				return rolloutAgent(cmd, polls)
+			},
+			wantStatus:   types.ExecutionStatusFailed,
+			wantRollback: true,
+		},
+		{
+			name: "verification timed out",
+			agent: func(cmd agentCommand, polls int) map[string]interface{} {
+				if cmd.Tool == "kubectl" {
+					return commandSuccess(map[string]interface{}{
+						"metadata": map[string]interface{}{"generation": 2},
+						"spec":     map[string]interface{}{"replicas": 5},
+						"status":   map[string]interface{}{"observedGeneration": 2, "replicas": 2, "updatedReplicas": 2},
+					})
+				}
+				return rolloutAgent(cmd, polls)
+			},
+			// The rollback only covers failures
+			wantStatus: types.ExecutionStatusTimeout,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			action := webAction("scale-web", protocol.RemediationScale, map[string]interface{}{"replicas": 5.0})
+			action.Rollback = &types.RollbackConfig{
+				Enabled:   true,
+				TriggerOn: []string{types.RollbackOnFailure},
+				Config:    map[string]interface{}{"action": protocol.RemediationScale, "params": map[string]interface{}{"replicas": 2.0}},
+			}
+			store := newMemoryStore(action)
+			stub := newStubAgentManager(t, tt.agent)
+			ex := newTestExecutor(stub.URL, store)
+
+			execution := &types.WorkflowExecution{ID: "exec-1", Context: make(map[string]interface{})}
+			output, err := ex.ExecuteRemediation(context.Background(), execution, remediationStep(action.ID))
+			if err == nil {
+				t.Fatal("ExecuteRemediation succeeded, want an error")
+			}
+
+			rem := store.remediation(t, output["remediation_id"].(string))
+			if rem.Status != tt.wantStatus || rem.RolledBack != tt.wantRollback {
+				t.Errorf("status %v, rolled back %v, want %v and %v (rollback error %q)",
+					rem.Status, rem.RolledBack, tt.wantStatus, tt.wantRollback, rem.RollbackError)
+			}
+
+			var scales []agentCommand
+			for _, cmd := range stub.sent() {
+				if cmd.Action == protocol.RemediationScale {
+					scales = append(scales, cmd)
+				}
+			}
+			if !tt.wantRollback {
+				if len(scales) != 1 {
+					t.Errorf("sent %d scale commands, want only the remediation", len(scales))
+				}
+				return
+			}
+			want := map[string]string{"kind": "deployment", "name": "web", "namespace": "shop", "replicas": "2"}
+			if len(scales) != 2 || !reflect.DeepEqual(scales[1].Params, want) {
+				t.Fatalf("scale commands = %+v, want the rollback to 2 replicas", scales)
+			}
+			if rem.RollbackCommandID != "cmd-2" || rem.RollbackAt == nil {
+				t.Errorf("rollback command %q at %v, want cmd-2 and a time", rem.RollbackCommandID, rem.RollbackAt)
+			}
+		})
+	}
+}
+
+func TestRemediationStoppedOrTimedOut(t *testing.T) {
+	defer func(period time.Duration) { resultGracePeriod = period }(resultGracePeriod)
+	resultGracePeriod = 50 * time.Millisecond
+
+	notRolledOut := commandSuccess(map[string]interface{}{
+		"metadata": map[string]interface{}{"generation": 2},
+		"spec":     map[string]interface{}{"replicas": 5},
+		"status":   map[string]interface{}{"observedGeneration": 2, "replicas": 2, "updatedReplicas": 2},
+	})
+
+	tests := []struct {
+		name         string
+		agent        func(cmd agentCommand, polls int) map[string]interface{}
+		cancelAfter  int // scale or kubectl get polls before ctx is cancelled, if any
+		wantStatus   types.ExecutionStatus
+		wantRollback bool
+	}{
+		{
+			name: "result timed out",
+			agent: func(cmd agentCommand, polls int) map[string]interface{} {
+				if cmd.Params[protocol.CommandParamReplicas] == "5" {
+					return nil
+				}
+				return rolloutAgent(cmd, polls)
+			},
+			wantStatus:   types.ExecutionStatusTimeout,
+			wantRollback: true,
+		},
+		{
+			name: "result not decodable",
+			agent: func(cmd agentCommand, polls int) map[string]interface{} {
+				if cmd.Params[protocol.CommandParamReplicas] == "5" {
+					return map[string]interface{}{"status": protocol.CommandStatusSuccess, "exit_code": "zero"}
+				}
+				return rolloutAgent(cmd, polls)
+			},
+			wantStatus:   types.ExecutionStatusFailed,
+			wantRollback: true,
+		},
+		{
+			name:        "cancelled awaiting the result",
+			agent:       func(cmd agentCommand, polls int) map[string]interface{} { return nil },
+			cancelAfter: 2,
+			wantStatus:  types.ExecutionStatusCancelled,
+		},
+		{
+			name: "cancelled verifying",
+			agent: func(cmd agentCommand, polls int) map[string]interface{} {
+				if cmd.Tool == "kubectl" {
+					return notRolledOut
+				}
+				return rolloutAgent(cmd, polls)
+			},
+			cancelAfter: 3,
+			wantStatus:  types.ExecutionStatusCancelled,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			action := webAction("scale-web", protocol.RemediationScale, map[string]interface{}{"replicas": 5.0})
+			action.Config["timeout"] = "10ms"
+			action.Rollback = &types.RollbackConfig{
+				Enabled: true,
+				Config:  map[string]interface{}{"action": protocol.RemediationScale, "params": map[string]interface{}{"replicas": 2.0}},
+			}
+			store := newMemoryStore(action)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			var polls int
+			stub := newStubAgentManager(t, func(cmd agentCommand, n int) map[string]interface{} {
+				if polls++; tt.cancelAfter > 0 && polls >= tt.cancelAfter {
+					cancel()
+				}
+				return tt.agent(cmd, n)
+			})
+			ex := newTestExecutor(stub.URL, store)
+
+			execution := &types.WorkflowExecution{ID: "exec-1", Context: make(map[string]interface{})}
+			output, err := ex.ExecuteRemediation(ctx, execution, remediationStep(action.ID))
+			if err == nil {
+				t.Fatal("ExecuteRemediation succeeded, want an error")
+			}
+
+			rem := store.remediation(t, output["remediation_id"].(string))
+			if rem.Status != tt.wantStatus || rem.RolledBack != tt.wantRollback || rem.CompletedAt == nil {
+				t.Errorf("status %v, rolled back %v, completed at %v, want %v, %v and a time (error %q, rollback error %q)",
+					rem.Status, rem.RolledBack, rem.CompletedAt, tt.wantStatus, tt.wantRollback, rem.Error, rem.RollbackError)
+			}
+
+			var scales int
+			for _, cmd := range stub.sent() {
+				if cmd.Action == protocol.RemediationScale {
+					scales++
+				}
+			}
+			if want := map[bool]int{false: 1, true: 2}[tt.wantRollback]; scales != want {
+				t.Errorf("sent %d scale commands, want %d", scales, want)
+			}
+		})
+	}
+}
+
+// finishedScale returns a scale of the web deployment to 5 replicas that
+// completed, which the agent reported it would roll back to 3
+func finishedScale(id string) *types.RemediationExecution {
+	completedAt := time.Now()
+	req := remediationRequest{
+		ClusterID: "prod-1",
+		Action:    protocol.RemediationScale,
+		Params:    map[string]string{"kind": "deployment", "name": "web", "namespace": "shop", "replicas": "5"},
+		Timeout:   time.Minute,
+		Verify:    true,
+	}
+	report := protocol.RemediationReport{
+		Action:   protocol.RemediationScale,
+		Target:   protocol.RemediationTarget{Kind: "Deployment", Namespace: "shop", Name: "web"},
+		Changed:  true,
+		Rollback: &protocol.RemediationRollback{Action: protocol.RemediationScale, Params: map[string]string{"kind": "deployment", "name": "web", "namespace": "shop", "replicas": "3"}},
+	}
+	return &types.RemediationExecution{
+		ID:          id,
+		ActionID:    "scale-web",
+		ClusterID:   "prod-1",
+		Status:      types.ExecutionStatusCompleted,
+		Input:       toMap(req),
+		Output:      map[string]interface{}{"report": toMap(report)},
+		CommandID:   "cmd-0",
+		StartedAt:   completedAt.Add(-time.Minute),
+		CompletedAt: &completedAt,
+	}
+}
+
+func TestRollbackRemediation(t *testing.T) {
+	ctx := context.Background()
+	manual := &types.RollbackConfig{Enabled: true, TriggerOn: []string{types.RollbackOnManual}}
+
+	t.Run("rolled back", func(t *testing.T) {
+		action := webAction("scale-web", protocol.RemediationScale, map[string]interface{}{"replicas": 5.0})
+		action.Rollback = manual
+		store := newMemoryStore(action)
+		store.SaveRemediationExecution(ctx, finishedScale("rem-1"))
+		stub := newStubAgentManager(t, rolloutAgent)
+		e := NewEngine(store, nil, newTestExecutor(stub.URL, store), zap.NewNop())
+		defer e.Stop()
+
+		if err := e.RollbackRemediation(ctx, "rem-1", "alice"); err != nil {
+			t.Fatalf("RollbackRemediation failed: %v", err)
+		}
+		waitFor(t, "the rollback", func() bool {
+			rem := store.remediation(t, "rem-1")
+			return rem.RolledBack || rem.RollbackError != ""
+		})
+
+		rem := store.remediation(t, "rem-1")
+		if !rem.RolledBack || rem.RollbackCommandID != "cmd-1" {
+			t.Errorf("rolled back %v by %q (%s), want by cmd-1", rem.RolledBack, rem.RollbackCommandID, rem.RollbackError)
+		}
+		if sent := stub.sent(); len(sent) != 1 || sent[0].Params[protocol.CommandParamReplicas] != "3" {
+			t.Errorf("sent %+v, want the rollback the agent reported", sent)
+		}
+		if err := e.RollbackRemediation(ctx, "rem-1", "alice"); !errors.Is(err, ErrRollbackUnavailable) {
+			t.Errorf("rolling back again = %v, want ErrRollbackUnavailable", err)
+		}
+	})
+
+	t.Run("interrupted by stop", func(t *testing.T) {
+		action := webAction("scale-web", protocol.RemediationScale, map[string]interface{}{"replicas": 5.0})
+		action.Rollback = manual
+		store := newMemoryStore(action)
+		store.SaveRemediationExecution(ctx, finishedScale("rem-1"))
+		stub := newStubAgentManager(t, func(cmd agentCommand, polls int) map[string]interface{} { return nil })
+		e := NewEngine(store, nil, newTestExecutor(stub.URL, store), zap.NewNop())
+
+		if err := e.RollbackRemediation(ctx, "rem-1", "alice"); err != nil {
+			t.Fatalf("RollbackRemediation failed: %v", err)
+		}
+		waitFor(t, "the rollback command", func() bool { return len(stub.sent()) == 1 })
+		e.Stop()
+
+		rem := store.remediation(t, "rem-1")
+		if rem.RolledBack || !strings.Contains(rem.RollbackError, "rollback interrupted") {
+			t.Errorf("rolled back %v with error %q, want interrupted", rem.RolledBack, rem.RollbackError)
+		}
+		stub.mu.Lock()
+		cancelled := stub.cancelled
+		stub.mu.Unlock()
+		if !reflect.DeepEqual(cancelled, []string{"cmd-1"}) {
+			t.Errorf("cancelled %v, want the rollback command", cancelled)
+		}
+		if err := e.RollbackRemediation(ctx, "rem-1", "alice"); !errors.Is(err, ErrEngineStopped) {
+			t.Errorf("rolling back once stopped = %v, want ErrEngineStopped", err)
+		}
+	})
+
+	unavailable := []struct {
+		name     string
+		rem      func() *types.RemediationExecution
+		rollback *types.RollbackConfig
+		wantErr  error
+	}{
+		{"unknown", func() *types.RemediationExecution { return nil }, manual, ErrRemediationNotFound},
+		{"already rolled back", func() *types.RemediationExecution {
+			rem := finishedScale("rem-1")
+			rem.RolledBack = true
+			return rem
+		}, manual, ErrRollbackUnavailable},
+		{"not run", func() *types.RemediationExecution {
+			rem := finishedScale("rem-1")
+			rem.CommandID = ""
+			return rem
+		}, manual, ErrRollbackUnavailable},
+		{"no manual trigger", func() *types.RemediationExecution { return finishedScale("rem-1") },
+			&types.RollbackConfig{Enabled: true, TriggerOn: []string{types.RollbackOnFailure}}, ErrRollbackUnavailable},
+	}
+	for _, tt := range unavailable {
+		t.Run(tt.name, func(t *testing.T) {
+			action := webAction("scale-web", protocol.RemediationScale, map[string]interface{}{"replicas": 5.0})
+			action.Rollback = tt.rollback
+			store := newMemoryStore(action)
+			if rem := tt.rem(); rem != nil {
+				store.SaveRemediationExecution(ctx, rem)
+			}
+			stub := newStubAgentManager(t, rolloutAgent)
+			e := NewEngine(store, nil, newTestExecutor(stub.URL, store), zap.NewNop())
+			defer e.Stop()
+
+			if err := e.RollbackRemediation(ctx, "rem-1", "alice"); !errors.Is(err, tt.wantErr) {
+				t.Errorf("RollbackRemediation = %v, want %v", err, tt.wantErr)
+			}
+			if len(stub.sent()) != 0 {
+				t.Error("a rollback command was sent")
+			}
+		})
+	}
+}
+
+func TestFailStaleRemediations(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		status types.ExecutionStatus
+		want   types.ExecutionStatus
+	}{
+		{types.ExecutionStatusWaitingApproval, types.ExecutionStatusFailed},
+		{types.ExecutionStatusRunning, types.ExecutionStatusFailed},
+		{types.ExecutionStatusCompleted, types.ExecutionStatusCompleted},
+		{types.ExecutionStatusRejected, types.ExecutionStatusRejected},
+	}
+
+	store := newMemoryStore()
+	for _, tt := range tests {
+		store.SaveRemediationExecution(ctx, &types.RemediationExecution{ID: string(tt.status), Status: tt.status, StartedAt: time.Now()})
+	}
+	e := NewEngine(store, nil, newTestExecutor("http://127.0.0.1:0", store), zap.NewNop())
+	defer e.Stop()
+
+	if err := e.FailStaleRemediations(ctx); err != nil {
+		t.Fatalf("FailStaleRemediations failed: %v", err)
+	}
+	for _, tt := range tests {
+		rem := store.remediation(t, string(tt.status))
+		if rem.Status != tt.want {
+			t.Errorf("%s remediation = %v, want %v", tt.status, rem.Status, tt.want)
+		}
+		stale := tt.want != tt.status
+		if stale && (rem.CompletedAt == nil || !strings.Contains(rem.Error, "restarted while the remediation was "+string(tt.status))) {
+			t.Errorf("%s remediation completed at %v with %q, want failed as restarted", tt.status, rem.CompletedAt, rem.Error)
+		}
+		if !stale && rem.CompletedAt != nil {
+			t.Errorf("%s remediation was finished", tt.status)
+		}
+	}
+}
+
+func TestRemediationDone(t *testing.T) {
+	notFound, _ := json.Marshal(protocol.KubeAPIStatus{Reason: protocol.KubeAPIStatusNotFound, Code: 404})
+	forbidden, _ := json.Marshal(protocol.KubeAPIStatus{Reason: "Forbidden", Code: 403})
+	pod := func(uid string) json.RawMessage {
+		return json.RawMessage(`{"kind": "Pod", "metadata": {"name": "web-1", "uid": "` + uid + `"}}`)
+	}
+	node := func(unschedulable bool) json.RawMessage {
+		data, _ := json.Marshal(map[string]interface{}{"spec": map[string]interface{}{"unschedulable": unschedulable}})
+		return data
+	}
+	deletePod := &remediationRequest{Action: protocol.RemediationDeletePod, Params: map[string]string{"name": "web-1", "namespace": "shop"}}
+	deleted := &protocol.RemediationReport{Snapshot: map[string]interface{}{"metadata": map[string]interface{}{"uid": "uid-1"}}}
+
+	tests := []struct {
+		name   string
+		req    *remediationRequest
+		report *protocol.RemediationReport
+		result commandResult
+		want   bool
+	}{
+		{"pod gone", deletePod, deleted, commandResult{Status: protocol.CommandStatusFailed, Error: `pods "web-1" not found`, Data: notFound}, true},
+		{"pod replaced", deletePod, deleted, commandResult{Status: protocol.CommandStatusSuccess, Data: pod("uid-2")}, true},
+		{"pod terminating", deletePod, deleted, commandResult{Status: protocol.CommandStatusSuccess, Data: pod("uid-1")}, false},
+		{"pod unreadable", deletePod, deleted, commandResult{Status: protocol.CommandStatusFailed, Error: "forbidden", Data: forbidden}, false},
+		// Only the API status tells a missing pod, not the error text
+		{"not found without status", deletePod, deleted, commandResult{Status: protocol.CommandStatusFailed, Error: `pods "web-1" not found`}, false},
+		{"node cordoned", &remediationRequest{Action: protocol.RemediationCordon}, nil, commandResult{Status: protocol.CommandStatusSuccess, Data: node(true)}, true},
+		{"node not yet uncordoned", &remediationRequest{Action: protocol.RemediationUncordon}, nil, commandResult{Status: protocol.CommandStatusSuccess, Data: node(true)}, false},
+		{"workload rolled out", &remediationRequest{Action: protocol.RemediationRolloutRestart, Params: map[string]string{"kind": "deployment"}}, nil,
+			commandResult{Status: protocol.CommandStatusSuccess, Data: json.RawMessage(rolledOutDeployment)}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			done, reason := remediationDone(tt.req, tt.report, &tt.result)
+			if done != tt.want {
+				t.Errorf("remediationDone = %v (%s), want %v", done, reason, tt.want)
+			}
+			if !done && reason == "" {
+				t.Error("no reason given")
+			}
+		})
+	}
+}
+
+func TestWorkloadRolledOut(t *testing.T) {
+	tests := []struct {
+		name   string
+		kind   string
+		obj    string
+		want   bool
+		reason string
+	}{
+		{"deployment rolled out", protocol.WorkloadDeployment, rolledOutDeployment, true, ""},
+		{"change not observed", protocol.WorkloadDeployment,
+			`{"metadata": {"generation": 3}, "status": {"observedGeneration": 2}}`, false, "waiting for the controller"},
+		{"replicas not updated", protocol.WorkloadDeployment,
+			`{"spec": {"replicas": 3}, "status": {"replicas": 3, "updatedReplicas": 1, "availableReplicas": 3}}`, false, "1 of 3 replicas updated"},
+		{"old replicas terminating", protocol.WorkloadDeployment,
+			`{"spec": {"replicas": 3}, "status": {"replicas": 4, "updatedReplicas": 3, "availableReplicas": 3}}`, false, "1 old replicas pending termination"},
+		{"replicas unavailable", protocol.WorkloadDeployment,
+			`{"spec": {"replicas": 3}, "status": {"replicas": 3, "updatedReplicas": 3, "availableReplicas": 2}}`, false, "2 of 3 updated replicas available"},
+		{"replicas default to one", protocol.WorkloadDeployment,
+			`{"status": {"replicas": 1, "updatedReplicas": 1, "availableReplicas": 1}}`, true, ""},
+		{"statefulset not ready", protocol.WorkloadStatefulSet,
+			`{"spec": {"replicas": 3}, "status": {"updatedReplicas": 3, "readyReplicas": 2}}`, false, "2 of 3 replicas ready"},
+		{"statefulset rolled out", protocol.WorkloadStatefulSet,
+			`{"spec": {"replicas": 3}, "status": {"updatedReplicas": 3, "readyReplicas": 3}}`, true, ""},
+		{"daemonset not updated", protocol.WorkloadDaemonSet,
+			`{"status": {"desiredNumberScheduled": 4, "updatedNumberScheduled": 2, "numberAvailable": 4}}`, false, "2 of 4 pods updated"},
+		{"daemonset rolled out", protocol.WorkloadDaemonSet,
+			`{"status": {"desiredNumberScheduled": 4, "updatedNumberScheduled": 4, "numberAvailable": 4}}`, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			done, reason := workloadRolledOut(tt.kind, decodeObject(t, tt.obj))
+			if done != tt.want || !strings.Contains(reason, tt.reason) {
+				t.Errorf("workloadRolledOut = %v, %q, want %v, %q", done, reason, tt.want, tt.reason)
+			}
+		})
+	}
+}
+
+func TestRollbackRequest(t *testing.T) {
+	scale := &remediationRequest{
+		ClusterID: "prod-1",
+		Action:    protocol.RemediationScale,
+		Params:    map[string]string{"kind": "deployment", "name": "web", "namespace": "shop", "replicas": "5"},
+		Timeout:   time.Minute,
+	}
+	reported := &protocol.RemediationReport{Rollback: &protocol.RemediationRollback{
+		Action: protocol.RemediationScale,
+		Params: map[string]string{"kind": "deployment", "name": "web", "namespace": "shop", "replicas": "3"},
+	}}
+
+	tests := []struct {
+		name       string
+		config     *types.RollbackConfig
+		req        *remediationRequest
+		report     *protocol.RemediationReport
+		wantAction string
+		wantParams map[string]string
+		wantErr    string
+	}{
+		{
+			name:       "configured action on the same target",
+			config:     &types.RollbackConfig{Config: map[string]interface{}{"action": "scale", "params": map[string]interface{}{"replicas": 2.0}}},
+			req:        scale,
+			report:     reported,
+			wantAction: protocol.RemediationScale,
+			wantParams: map[string]string{"kind": "deployment", "name": "web", "namespace": "shop", "replicas": "2"},
+		},
+		{
+			name:       "target params limited to the action",
+			config:     &types.RollbackConfig{Config: map[string]interface{}{"action": "uncordon"}},
+			req:        &remediationRequest{Action: protocol.RemediationCordon, Params: map[string]string{"name": "node-1"}},
+			wantAction: protocol.RemediationUncordon,
+			wantParams: map[string]string{"name": "node-1"},
+		},
+		{
+			name:       "reported by the agent",
+			config:     &types.RollbackConfig{},
+			req:        scale,
+			report:     reported,
+			wantAction: protocol.RemediationScale,
+			wantParams: reported.Rollback.Params,
+		},
+		{
+			name:    "nothing to roll back with",
+			config:  &types.RollbackConfig{},
+			req:     scale,
+			wantErr: ErrRollbackUnavailable.Error(),
+		},
+		{
+			name:    "unsupported action type",
+			config:  &types.RollbackConfig{ActionType: "script"},
+			req:     scale,
+			report:  reported,
+			wantErr: ErrRollbackUnavailable.Error(),
+		},
+		{
+			name:    "invalid params",
+			config:  &types.RollbackConfig{Config: map[string]interface{}{"action": "scale", "params": map[string]interface{}{"replicas": []interface{}{2.0}}}},
+			req:     scale,
+			wantErr: "invalid rollback params",
+		},
+		{
+			name:    "invalid rollback",
+			config:  &types.RollbackConfig{Config: map[string]interface{}{"action": "scale", "params": map[string]interface{}{"replicas": 5000.0}}},
+			req:     scale,
+			wantErr: "invalid rollback",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rollback, err := rollbackRequest(tt.config, tt.req, tt.report)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("rollbackRequest error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("rollbackRequest failed: %v", err)
+			}
+			if rollback.Action != tt.wantAction || !reflect.DeepEqual(rollback.Params, tt.wantParams) {
+				t.Errorf("rollback = %s %v, want %s %v", rollback.Action, rollback.Params, tt.wantAction, tt.wantParams)
+			}
+			if rollback.ClusterID != tt.req.ClusterID || rollback.Timeout != tt.req.Timeout {
+				t.Errorf("rollback on %q within %v, want the cluster and timeout of the remediation", rollback.ClusterID, rollback.Timeout)
+			}
+		})
+	}
+}
+
+func TestStringParams(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   interface{}
+		want    map[string]string
+		wantErr bool
+	}{
+		{"none", nil, map[string]string{}, false},
+		{"strings", map[string]string{"name": "web"}, map[string]string{"name": "web"}, false},
+		{"decoded from JSON", map[string]interface{}{"name": "web", "replicas": 3.0, "ratio": 0.5, "dry_run": true},
+			map[string]string{"name": "web", "replicas": "3", "ratio": "0.5", "dry_run": "true"}, false},
+		{"nested value", map[string]interface{}{"labels": map[string]interface{}{"app": "web"}}, nil, true},
+		{"not an object", []interface{}{"web"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params, err := stringParams(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("stringParams error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(params, tt.want) {
+				t.Errorf("stringParams = %v, want %v", params, tt.want)
+			}
+		})
+	}
+}
@@ -97,6 +97,11 @@ const (
 	ExecutionStatusFailed    ExecutionStatus = "failed"
 	ExecutionStatusCancelled ExecutionStatus = "cancelled"
 	ExecutionStatusTimeout   ExecutionStatus = "timeout"
+
+	// ExecutionStatusWaitingApproval marks executions paused until a
+	// remediation is approved or rejected
+	ExecutionStatusWaitingApproval ExecutionStatus = "waiting_approval"
+	ExecutionStatusRejected        ExecutionStatus = "rejected"
 )
 
 // StepExecution represents a step execution
@@ -179,7 +184,7 @@ type RemediationAction struct {
 	Name        string                 `json:"name" gorm:"index;not null"`
 	Category    string                 `json:"category" gorm:"index"`
 	Description string                 `json:"description"`
-	ActionType  string                 `json:"action_type"` // kubectl, api_call, script
+	ActionType  string                 `json:"action_type"` // remediation, kubectl, api_call, script
 	Config      map[string]interface{} `json:"config" gorm:"type:jsonb"`
 	RiskLevel   RiskLevel              `json:"risk_level" gorm:"index"`
 	RequireApproval bool               `json:"require_approval"`
@@ -189,6 +194,11 @@ type RemediationAction struct {
 	UpdatedAt   time.Time              `json:"updated_at"`
 }
 
+// ActionTypeRemediation is the action type of remediation actions run by
+// agents. Their config holds the agent action, e.g. scale, its params, and
+// optionally a timeout and whether to verify the outcome.
+const ActionTypeRemediation = "remediation"
+
 // RiskLevel represents risk level
 type RiskLevel string
 
@@ -207,21 +217,42 @@ type RollbackConfig struct {
 	TriggerOn     []string               `json:"trigger_on"` // failure, timeout, manual
 }
 
+// Rollback triggers
+const (
+	RollbackOnFailure = "failure"
+	RollbackOnTimeout = "timeout"
+	RollbackOnManual  = "manual"
+)
+
 // RemediationExecution represents a remediation execution
 type RemediationExecution struct {
 	ID          string                 `json:"id" gorm:"primaryKey"`
 	ActionID    string                 `json:"action_id" gorm:"index"`
 	ExecutionID string                 `json:"execution_id" gorm:"index"`
+	StepID      string                 `json:"step_id"`
+	ClusterID   string                 `json:"cluster_id" gorm:"index"`
+	RiskLevel   RiskLevel              `json:"risk_level"`
 	Status      ExecutionStatus        `json:"status" gorm:"index"`
 	Input       map[string]interface{} `json:"input" gorm:"type:jsonb"`
 	Output      map[string]interface{} `json:"output" gorm:"type:jsonb"`
 	Error       string                 `json:"error,omitempty"`
-	ApprovedBy  string                 `json:"approved_by,omitempty"`
-	ApprovedAt  *time.Time             `json:"approved_at,omitempty"`
-	StartedAt   time.Time              `json:"started_at"`
-	CompletedAt *time.Time             `json:"completed_at,omitempty"`
-	RolledBack  bool                   `json:"rolled_back"`
-	RollbackAt  *time.Time             `json:"rollback_at,omitempty"`
+	CommandID   string                 `json:"command_id,omitempty"` // agent-manager command running the action
+	Verified    bool                   `json:"verified"`             // the target reached the state asked for
+
+	// Approval, when the action requires it
+	ApprovalRequired bool       `json:"approval_required"`
+	ApprovedBy       string     `json:"approved_by,omitempty"`
+	ApprovedAt       *time.Time `json:"approved_at,omitempty"`
+	RejectedBy       string     `json:"rejected_by,omitempty"`
+	ReviewComment    string     `json:"review_comment,omitempty"`
+
+	StartedAt   time.Time  `json:"started_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+
+	RolledBack        bool       `json:"rolled_back"`
+	RollbackAt        *time.Time `json:"rollback_at,omitempty"`
+	RollbackCommandID string     `json:"rollback_command_id,omitempty"`
+	RollbackError     string     `json:"rollback_error,omitempty"`
 }
 
 // AIAnalysisRequest represents an AI analysis request
@@ -284,6 +315,8 @@ type Config struct {
 	Redis    RedisConfig    `yaml:"redis"`
 	AI       AIConfig       `yaml:"ai"`
 	Logging  LoggingConfig  `yaml:"logging"`
+
+	Remediation RemediationConfig `yaml:"remediation"`
 }
 
 // ServerConfig represents server configuration
@@ -339,6 +372,16 @@ type AIConfig struct {
 	MaxRetries          int           `yaml:"max_retries"`
 }
 
+// RemediationConfig represents remediation step configuration
+type RemediationConfig struct {
+	// ApprovalRiskLevel is the risk level from which actions wait for
+	// approval even without require_approval; empty leaves it to each action
+	ApprovalRiskLevel RiskLevel     `yaml:"approval_risk_level"`
+	ApprovalTimeout   time.Duration `yaml:"approval_timeout"` // how long a remediation waits for approval
+	VerifyTimeout     time.Duration `yaml:"verify_timeout"`   // how long the target may take to reach the state asked for
+	VerifyInterval    time.Duration `yaml:"verify_interval"`
+}
+
 // LoggingConfig represents logging configuration
 type LoggingConfig struct {
 	Level      string `yaml:"level"`
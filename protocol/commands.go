@@ -0,0 +1,386 @@
+package protocol
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Params of the kubectl tool, which agents run through the Kubernetes API
+const (
+	CommandParamResource      = "resource"       // resource type, e.g. pods or deployments.apps
+	CommandParamName          = "name"           // object name
+	CommandParamNamespace     = "namespace"      // namespace, "default" when not set
+	CommandParamAllNamespaces = "all_namespaces" // "true" to read every namespace
+	CommandParamLabelSelector = "label_selector" // label selector, e.g. app=web,tier!=db
+	CommandParamContainer     = "container"      // container of a pod for logs
+	CommandParamTailLines     = "tail_lines"     // number of log lines from the end
+	CommandParamSince         = "since"          // logs newer than a duration, e.g. 10m
+	CommandParamPrevious      = "previous"       // "true" for the logs of the previous container
+)
+
+// Params of cancel commands
+const (
+	CommandParamCommandID = "command_id" // command to cancel
+	CommandParamReason    = "reason"     // why it is cancelled, reported in its result
+)
+
+// ValueKind is the kind of value a param, flag or argument takes
+type ValueKind string
+
+// Value kinds of command schemas
+const (
+	ValueString   ValueKind = "string"   // matching the pattern of the spec
+	ValueInt      ValueKind = "int"      // between Min and Max
+	ValueBool     ValueKind = "bool"     // true or false
+	ValueDuration ValueKind = "duration" // between Min and Max nanoseconds, e.g. 10m
+	ValueEnum     ValueKind = "enum"     // one of Enum
+)
+
+// ValueSpec describes the values a param, flag or argument accepts
+type ValueSpec struct {
+	Kind    ValueKind
+	Pattern *regexp.Regexp
+	Hint    string // what Pattern matches, for rejection reasons
+	Enum    []string
+	Min     int64
+	Max     int64
+}
+
+// CommandSchema describes what an action of a tool accepts. Tools run through
+// the Kubernetes API take named Params; the others take Args, made of the
+// Flags listed and of positional arguments.
+type CommandSchema struct {
+	Params          map[string]ValueSpec
+	RequiredParams  []string
+	ExclusiveParams [][2]string
+	AnyOfParams     []string // at least one of them is required
+
+	// Flags maps the flags accepted to the spec of their value, or to nil
+	// for switches
+	Flags         map[string]*ValueSpec
+	RequiredFlags []string
+
+	// Args are the positional arguments in order, of which the first
+	// MinArgs are required
+	Args    []ValueSpec
+	MinArgs int
+}
+
+// Patterns of the string values of command schemas
+var (
+	patternResource  = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)*$`)
+	patternName      = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9._:-]{0,251}[A-Za-z0-9])?$`)
+	patternDNSLabel  = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?$`)
+	patternSelector  = regexp.MustCompile(`^[A-Za-z0-9_./!=,() -]{1,1000}$`)
+	patternHost      = regexp.MustCompile(`^([A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?)*\.?|[0-9A-Fa-f:.]{2,45})$`)
+	patternHTTPURL   = regexp.MustCompile(`^https?://[A-Za-z0-9.-]+(:[0-9]{1,5})?(/[A-Za-z0-9._~%/?=&+-]*)?$`)
+	valueResource    = ValueSpec{Kind: ValueString, Pattern: patternResource, Hint: "a resource type such as pods or deployments.apps"}
+	valueName        = ValueSpec{Kind: ValueString, Pattern: patternName, Hint: "an object name"}
+	valueNamespace   = ValueSpec{Kind: ValueString, Pattern: patternDNSLabel, Hint: "a namespace name"}
+	valueContainer   = ValueSpec{Kind: ValueString, Pattern: patternDNSLabel, Hint: "a container name"}
+	valueSelector    = ValueSpec{Kind: ValueString, Pattern: patternSelector, Hint: "a label selector"}
+	valueBool        = ValueSpec{Kind: ValueBool}
+	valueHost        = ValueSpec{Kind: ValueString, Pattern: patternHost, Hint: "a host name or IP address"}
+	valueHTTPURL     = ValueSpec{Kind: ValueString, Pattern: patternHTTPURL, Hint: "an http or https URL"}
+	valueSeconds     = func(max int64) *ValueSpec { return &ValueSpec{Kind: ValueInt, Min: 1, Max: max} }
+	noArgumentSchema = &CommandSchema{}
+)
+
+// commandSchemas are the tools agents run and, by action, what they accept.
+// An empty action stands for tools run without one.
+var commandSchemas = map[string]map[string]*CommandSchema{
+	"kubectl": {
+		"get": {
+			Params: map[string]ValueSpec{
+				CommandParamResource:      valueResource,
+				CommandParamName:          valueName,
+				CommandParamNamespace:     valueNamespace,
+				CommandParamAllNamespaces: valueBool,
+				CommandParamLabelSelector: valueSelector,
+			},
+			RequiredParams:  []string{CommandParamResource},
+			ExclusiveParams: [][2]string{{CommandParamNamespace, CommandParamAllNamespaces}, {CommandParamName, CommandParamLabelSelector}},
+		},
+		"describe": {
+			Params: map[string]ValueSpec{
+				CommandParamResource:  valueResource,
+				CommandParamName:      valueName,
+				CommandParamNamespace: valueNamespace,
+			},
+			RequiredParams: []string{CommandParamResource, CommandParamName},
+		},
+		"logs": {
+			Params: map[string]ValueSpec{
+				CommandParamName:      valueName,
+				CommandParamNamespace: valueNamespace,
+				CommandParamContainer: valueContainer,
+				CommandParamTailLines: {Kind: ValueInt, Min: 1, Max: 10000},
+				CommandParamSince:     {Kind: ValueDuration, Min: int64(time.Second), Max: int64(7 * 24 * time.Hour)},
+				CommandParamPrevious:  valueBool,
+			},
+			RequiredParams: []string{CommandParamName},
+		},
+		"top": {
+			Params: map[string]ValueSpec{
+				CommandParamResource:      {Kind: ValueEnum, Enum: []string{"nodes", "pods"}},
+				CommandParamNamespace:     valueNamespace,
+				CommandParamAllNamespaces: valueBool,
+				CommandParamLabelSelector: valueSelector,
+			},
+			RequiredParams:  []string{CommandParamResource},
+			ExclusiveParams: [][2]string{{CommandParamNamespace, CommandParamAllNamespaces}},
+		},
+		"events": {
+			Params: map[string]ValueSpec{
+				CommandParamResource:      valueResource,
+				CommandParamName:          valueName,
+				CommandParamNamespace:     valueNamespace,
+				CommandParamAllNamespaces: valueBool,
+			},
+			ExclusiveParams: [][2]string{{CommandParamNamespace, CommandParamAllNamespaces}},
+		},
+	},
+	"ps":     {"aux": noArgumentSchema, "-ef": noArgumentSchema},
+	"df":     {"-h": noArgumentSchema},
+	"free":   {"-h": noArgumentSchema},
+	"uptime": {"": noArgumentSchema},
+	"uname":  {"-a": noArgumentSchema},
+	"whoami": {"": noArgumentSchema},
+	"ping": {
+		"": {
+			Flags:         map[string]*ValueSpec{"-c": {Kind: ValueInt, Min: 1, Max: 10}, "-W": valueSeconds(10)},
+			RequiredFlags: []string{"-c"},
+			Args:          []ValueSpec{valueHost},
+			MinArgs:       1,
+		},
+	},
+	"nslookup": {
+		"": {Args: []ValueSpec{valueHost}, MinArgs: 1},
+	},
+	"dig": {
+		"": {
+			Flags: map[string]*ValueSpec{"+short": nil},
+			Args: []ValueSpec{
+				valueHost,
+				{Kind: ValueEnum, Enum: []string{"A", "AAAA", "CNAME", "MX", "NS", "PTR", "SOA", "SRV", "TXT"}},
+			},
+			MinArgs: 1,
+		},
+	},
+	"curl": {
+		"": {
+			Flags: map[string]*ValueSpec{
+				"-I": nil, "-s": nil,
+				"--connect-timeout": valueSeconds(10),
+				"--max-time":        valueSeconds(60),
+			},
+			Args:    []ValueSpec{valueHTTPURL},
+			MinArgs: 1,
+		},
+	},
+	"wget": {
+		"": {
+			Flags:         map[string]*ValueSpec{"--spider": nil, "-T": valueSeconds(30)},
+			RequiredFlags: []string{"--spider"},
+			Args:          []ValueSpec{valueHTTPURL},
+			MinArgs:       1,
+		},
+	},
+}
+
+// CommandValidationError is the precise reason a command was rejected
+type CommandValidationError struct {
+	Tool   string
+	Action string
+	Field  string // e.g. tool, action, param "namespace", flag "-c", argument 1
+	Reason string
+}
+
+// Error returns the reason with the command and field it concerns
+func (e *CommandValidationError) Error() string {
+	command := e.Tool
+	if e.Action != "" {
+		command += " " + e.Action
+	}
+	return fmt.Sprintf("%s: %s %s", command, e.Field, e.Reason)
+}
+
+// CommandTools returns the actions of each tool agents run
+func CommandTools() map[string][]string {
+	tools := make(map[string][]string, len(commandSchemas))
+	for tool, actions := range commandSchemas {
+		for action := range actions {
+			tools[tool] = append(tools[tool], action)
+		}
+		sort.Strings(tools[tool])
+	}
+	return tools
+}
+
+// LookupCommandSchema returns the schema of an action of a tool, including
+// the remediation actions of the remediation tool
+func LookupCommandSchema(tool, action string) (*CommandSchema, error) {
+	actions, ok := commandSchemas[tool]
+	if tool == RemediationTool {
+		actions, ok = remediationSchemas, true
+	}
+	if !ok {
+		return nil, &CommandValidationError{Tool: tool, Action: action, Field: "tool", Reason: "is not allowed"}
+	}
+	schema, ok := actions[action]
+	if !ok {
+		if action == "" {
+			return nil, &CommandValidationError{Tool: tool, Field: "action", Reason: "is required"}
+		}
+		return nil, &CommandValidationError{Tool: tool, Action: action, Field: "action", Reason: "is not allowed"}
+	}
+	return schema, nil
+}
+
+// ValidateCommand checks a command against the schema of its tool and
+// action, returning a *CommandValidationError with the first problem found.
+// No schema lets commands set environment variables of the tools they run,
+// so any env is refused.
+func ValidateCommand(tool, action string, args []string, params, env map[string]string) error {
+	schema, err := LookupCommandSchema(tool, action)
+	if err != nil {
+		return err
+	}
+
+	reject := func(field, reason string, a ...interface{}) error {
+		return &CommandValidationError{Tool: tool, Action: action, Field: field, Reason: fmt.Sprintf(reason, a...)}
+	}
+
+	if len(env) > 0 {
+		return reject("env", "is not allowed")
+	}
+
+	// Params, checked in order for stable reasons
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		spec, ok := schema.Params[name]
+		if !ok {
+			return reject(fmt.Sprintf("param %q", name), "is not allowed")
+		}
+		if reason := spec.check(params[name]); reason != "" {
+			return reject(fmt.Sprintf("param %q", name), "%s", reason)
+		}
+	}
+	for _, name := range schema.RequiredParams {
+		if params[name] == "" {
+			return reject(fmt.Sprintf("param %q", name), "is required")
+		}
+	}
+	for _, pair := range schema.ExclusiveParams {
+		if params[pair[0]] != "" && params[pair[1]] != "" {
+			return reject(fmt.Sprintf("param %q", pair[1]), "cannot be combined with %q", pair[0])
+		}
+	}
+	if len(schema.AnyOfParams) > 0 && !slices.ContainsFunc(schema.AnyOfParams, func(name string) bool { return params[name] != "" }) {
+		return reject("params "+strings.Join(schema.AnyOfParams, ", "), "need at least one value")
+	}
+
+	// Args: flags with their values, then positional arguments
+	var positional []string
+	seen := make(map[string]bool)
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if len(arg) < 2 || (arg[0] != '-' && arg[0] != '+') {
+			positional = append(positional, arg)
+			continue
+		}
+
+		flag, value, inline := strings.Cut(arg, "=")
+		spec, ok := schema.Flags[flag]
+		if !ok {
+			return reject(fmt.Sprintf("flag %q", flag), "is not allowed")
+		}
+		seen[flag] = true
+		if spec == nil {
+			if inline {
+				return reject(fmt.Sprintf("flag %q", flag), "takes no value")
+			}
+			continue
+		}
+		if !inline {
+			if i+1 >= len(args) {
+				return reject(fmt.Sprintf("flag %q", flag), "needs a value")
+			}
+			i++
+			value = args[i]
+		}
+		if reason := spec.check(value); reason != "" {
+			return reject(fmt.Sprintf("flag %q", flag), "%s", reason)
+		}
+	}
+	for _, flag := range schema.RequiredFlags {
+		if !seen[flag] {
+			return reject(fmt.Sprintf("flag %q", flag), "is required")
+		}
+	}
+
+	if len(positional) < schema.MinArgs || len(positional) > len(schema.Args) {
+		return reject("arguments", "%s, got %d", argumentCount(schema.MinArgs, len(schema.Args)), len(positional))
+	}
+	for i, arg := range positional {
+		if reason := schema.Args[i].check(arg); reason != "" {
+			return reject(fmt.Sprintf("argument %d (%q)", i+1, arg), "%s", reason)
+		}
+	}
+	return nil
+}
+
+// argumentCount describes how many positional arguments a schema takes
+func argumentCount(min, max int) string {
+	switch {
+	case max == 0:
+		return "take none"
+	case min == max:
+		return fmt.Sprintf("must be %d", max)
+	default:
+		return fmt.Sprintf("must be %d to %d", min, max)
+	}
+}
+
+// check returns why value does not match the spec, or "" when it does
+func (s ValueSpec) check(value string) string {
+	switch s.Kind {
+	case ValueString:
+		if s.Pattern == nil || !s.Pattern.MatchString(value) {
+			return "must be " + s.Hint
+		}
+	case ValueInt:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < s.Min || n > s.Max {
+			return fmt.Sprintf("must be an integer between %d and %d", s.Min, s.Max)
+		}
+	case ValueBool:
+		if _, err := strconv.ParseBool(value); err != nil {
+			return "must be true or false"
+		}
+	case ValueDuration:
+		d, err := time.ParseDuration(value)
+		if err != nil || int64(d) < s.Min || int64(d) > s.Max {
+			return fmt.Sprintf("must be a duration between %v and %v", time.Duration(s.Min), time.Duration(s.Max))
+		}
+	case ValueEnum:
+		for _, allowed := range s.Enum {
+			if value == allowed {
+				return ""
+			}
+		}
+		return "must be one of " + strings.Join(s.Enum, ", ")
+	default:
+		return "has an unknown kind"
+	}
+	return ""
+}
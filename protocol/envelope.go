@@ -0,0 +1,118 @@
+package protocol
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// MessageType identifies the payload carried by an envelope
+type MessageType string
+
+const (
+	MessageTypeRegister    MessageType = "register"
+	MessageTypeRegisterAck MessageType = "register_ack"
+	MessageTypeHeartbeat   MessageType = "heartbeat"
+	MessageTypeEvent       MessageType = "event"
+	MessageTypeMetrics     MessageType = "metrics"
+	MessageTypeCommand     MessageType = "command"
+	MessageTypeResult      MessageType = "result"
+	MessageTypeCommandAck  MessageType = "command_ack"
+	MessageTypeOutput      MessageType = "command_output"
+)
+
+// Envelope wraps every message exchanged between agents and agent-manager
+type Envelope struct {
+	SchemaVersion int             `json:"schema_version"`
+	MessageID     string          `json:"message_id"`
+	Type          MessageType     `json:"type"`
+	Sender        string          `json:"sender"`
+	ClusterID     string          `json:"cluster_id"`
+	Timestamp     time.Time       `json:"timestamp"`
+	Payload       json.RawMessage `json:"payload"`
+}
+
+// NewEnvelope creates an envelope for the given payload using the current schema version
+func NewEnvelope(msgType MessageType, sender, clusterID string, payload interface{}) (*Envelope, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal %s payload: %w", msgType, err)
+	}
+
+	return &Envelope{
+		SchemaVersion: Version,
+		MessageID:     NewMessageID(),
+		Type:          msgType,
+		Sender:        sender,
+		ClusterID:     clusterID,
+		Timestamp:     time.Now(),
+		Payload:       data,
+	}, nil
+}
+
+// Encode wraps payload in an envelope and returns its wire representation
+func Encode(msgType MessageType, sender, clusterID string, payload interface{}) ([]byte, error) {
+	env, err := NewEnvelope(msgType, sender, clusterID, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return env.Marshal()
+}
+
+// Marshal returns the wire representation of the envelope
+func (e *Envelope) Marshal() ([]byte, error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal envelope: %w", err)
+	}
+	return data, nil
+}
+
+// Unmarshal parses an envelope without checking its schema version
+func Unmarshal(data []byte) (*Envelope, error) {
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal envelope: %w", err)
+	}
+	return &env, nil
+}
+
+// Decode parses an envelope and verifies its schema version is supported
+func Decode(data []byte) (*Envelope, error) {
+	env, err := Unmarshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := CheckVersion(env.SchemaVersion); err != nil {
+		return nil, err
+	}
+
+	return env, nil
+}
+
+// DecodePayload unmarshals the envelope payload into v after checking the message type
+func (e *Envelope) DecodePayload(expected MessageType, v interface{}) error {
+	if e.Type != expected {
+		return fmt.Errorf("unexpected message type %q, want %q", e.Type, expected)
+	}
+
+	if err := json.Unmarshal(e.Payload, v); err != nil {
+		return fmt.Errorf("failed to unmarshal %s payload: %w", e.Type, err)
+	}
+
+	return nil
+}
+
+// NewMessageID returns a random 128-bit message identifier
+func NewMessageID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand never fails on supported platforms, fall back to a timestamp
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
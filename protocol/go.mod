@@ -0,0 +1,3 @@
+module github.com/kart-io/k8s-agent/protocol
+
+go 1.21
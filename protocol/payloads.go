@@ -0,0 +1,267 @@
+package protocol
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Registration is sent by an agent on the register subject when it starts
+type Registration struct {
+	ClusterID       string    `json:"cluster_id"`
+	Version         string    `json:"version"`
+	ProtocolVersion int       `json:"protocol_version"`
+	StartTime       time.Time `json:"start_time"`
+	Capabilities    []string  `json:"capabilities"`
+}
+
+// RegistrationAck is the reply agent-manager sends to a Registration
+type RegistrationAck struct {
+	Accepted        bool   `json:"accepted"`
+	AgentID         string `json:"agent_id,omitempty"`
+	ProtocolVersion int    `json:"protocol_version"`
+	Reason          string `json:"reason,omitempty"`
+}
+
+// Event represents a Kubernetes event reported by an agent
+type Event struct {
+	ID         string                 `json:"id"`
+	ClusterID  string                 `json:"cluster_id"`
+	Type       string                 `json:"type"`
+	Source     string                 `json:"source"`
+	Namespace  string                 `json:"namespace"`
+	Severity   string                 `json:"severity"`
+	Reason     string                 `json:"reason"`
+	Message    string                 `json:"message"`
+	Timestamp  time.Time              `json:"timestamp"`
+	ReportedAt time.Time              `json:"reported_at"`
+	Labels     map[string]string      `json:"labels"`
+	RawData    map[string]interface{} `json:"raw_data"`
+}
+
+// Metrics snapshot kinds
+const (
+	// MetricsSnapshotFull holds every node and namespace of the cluster
+	MetricsSnapshotFull = "full"
+
+	// MetricsSnapshotDelta only holds the nodes and namespaces changed since
+	// the previous report, which it replaces in the last full snapshot
+	MetricsSnapshotDelta = "delta"
+)
+
+// Metrics represents metrics collected from a cluster
+type Metrics struct {
+	ClusterID string    `json:"cluster_id"`
+	Timestamp time.Time `json:"timestamp"`
+
+	// Snapshot is MetricsSnapshotFull or MetricsSnapshotDelta; agents that
+	// predate deltas leave it empty and always send full snapshots
+	Snapshot string `json:"snapshot,omitempty"`
+
+	// Removed lists the entries of the keyed sections of a delta, such as
+	// "node_details" and "namespaces", deleted since the previous report
+	Removed map[string][]string `json:"removed,omitempty"`
+
+	Data map[string]interface{} `json:"data"`
+}
+
+// IsDelta reports whether the metrics only hold the changes since the previous report
+func (m *Metrics) IsDelta() bool {
+	return m.Snapshot == MetricsSnapshotDelta
+}
+
+// Command represents a command sent by agent-manager to an agent. Tools
+// run through the Kubernetes API take named Params instead of Args.
+type Command struct {
+	ID        string            `json:"id"`
+	Type      string            `json:"type"`
+	Tool      string            `json:"tool"`
+	Action    string            `json:"action"`
+	Args      []string          `json:"args"`
+	Params    map[string]string `json:"params,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+	Timeout   time.Duration     `json:"timeout"`
+	CreatedAt time.Time         `json:"created_at"`
+
+	// Priority orders the commands waiting on an agent: higher runs first,
+	// and equal priorities run in the order received
+	Priority int `json:"priority,omitempty"`
+
+	// Signature is set by agent-manager when it signs commands
+	Signature *CommandSignature `json:"signature,omitempty"`
+}
+
+// CommandTypeCancel is the type of the control command that cancels the
+// command named by its CommandParamCommandID param, killing it if it runs.
+// It travels, and is signed, like any command, but has no result of its own.
+const CommandTypeCancel = "cancel"
+
+// NewCancelCommand returns the control command cancelling commandID
+func NewCancelCommand(commandID, reason string) *Command {
+	params := map[string]string{CommandParamCommandID: commandID}
+	if reason != "" {
+		params[CommandParamReason] = reason
+	}
+	return &Command{
+		ID:        NewMessageID(),
+		Type:      CommandTypeCancel,
+		Params:    params,
+		CreatedAt: time.Now(),
+	}
+}
+
+// Command statuses reported by agents in acknowledgements and results
+const (
+	CommandStatusExecuting = "executing"
+	CommandStatusSuccess   = "success"
+	CommandStatusFailed    = "failed"
+	CommandStatusTimeout   = "timeout"
+
+	// CommandStatusRejected reports a command refused because its signature
+	// could not be verified; it was not run
+	CommandStatusRejected = "rejected"
+
+	// CommandStatusCancelled reports a command cancelled by agent-manager,
+	// while it waited or ran
+	CommandStatusCancelled = "cancelled"
+)
+
+// CommandAck is published on the result subject when an agent starts executing
+// a command, ahead of its CommandResult
+type CommandAck struct {
+	CommandID string    `json:"command_id"`
+	ClusterID string    `json:"cluster_id"`
+	Status    string    `json:"status"` // executing
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// CommandResult represents the outcome of a command executed by an agent
+type CommandResult struct {
+	CommandID string        `json:"command_id"`
+	ClusterID string        `json:"cluster_id"`
+	Status    string        `json:"status"` // success, failed, timeout, rejected
+	Output    string        `json:"output"` // stdout and stderr interleaved
+	Error     string        `json:"error,omitempty"`
+	Duration  time.Duration `json:"duration"`
+	Timestamp time.Time     `json:"timestamp"`
+
+	// Stdout and Stderr are the output of each stream, kept up to the same
+	// limit as Output. The byte counts are of all the output written, and
+	// the truncated flags report streams that did not fit.
+	Stdout          string `json:"stdout,omitempty"`
+	Stderr          string `json:"stderr,omitempty"`
+	StdoutBytes     int64  `json:"stdout_bytes,omitempty"`
+	StderrBytes     int64  `json:"stderr_bytes,omitempty"`
+	StdoutTruncated bool   `json:"stdout_truncated,omitempty"`
+	StderrTruncated bool   `json:"stderr_truncated,omitempty"`
+
+	// Data is the structured output of commands run through the Kubernetes
+	// API, of which Output is a text rendering. When the API failed such a
+	// command, Data is its KubeAPIStatus instead.
+	Data json.RawMessage `json:"data,omitempty"`
+
+	// ExitCode is the exit status of tools run as processes, or the one
+	// kubectl would exit with for commands run through the Kubernetes API. It
+	// is unset for commands that did not run, timed out or were killed.
+	ExitCode *int `json:"exit_code,omitempty"`
+
+	// OutputChunks is the number of CommandOutput chunks streamed before the
+	// result, so that receivers know when they have all of them
+	OutputChunks int64 `json:"output_chunks,omitempty"`
+}
+
+// KubeAPIStatus is the Data of a failed command run through the Kubernetes
+// API, the status the API failed it with
+type KubeAPIStatus struct {
+	Reason  string `json:"reason"` // e.g. NotFound, Forbidden
+	Code    int32  `json:"code"`   // HTTP status code
+	Message string `json:"message,omitempty"`
+}
+
+// KubeAPIStatusNotFound is the reason of a KubeAPIStatus for a missing object
+const KubeAPIStatusNotFound = "NotFound"
+
+// Streams of command output
+const (
+	OutputStreamStdout = "stdout"
+	OutputStreamStderr = "stderr"
+)
+
+// CommandOutput is a chunk of the output of a running command, published on
+// its output subject. Chunks of both streams are numbered from 1 in the order
+// they were read; the output of the command is their data in that order.
+type CommandOutput struct {
+	CommandID string    `json:"command_id"`
+	ClusterID string    `json:"cluster_id"`
+	Seq       int64     `json:"seq"`
+	Stream    string    `json:"stream"` // stdout, stderr
+	Data      string    `json:"data"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Heartbeat status values reported by agents
+const (
+	HeartbeatStatusHealthy  = "healthy"
+	HeartbeatStatusDegraded = "degraded"
+)
+
+// Heartbeat represents agent health status
+type Heartbeat struct {
+	AgentID    string                     `json:"agent_id,omitempty"`
+	ClusterID  string                     `json:"cluster_id"`
+	Timestamp  time.Time                  `json:"timestamp"`
+	Status     string                     `json:"status"` // healthy, degraded
+	Metrics    HeartbeatMetrics           `json:"metrics"`
+	Components map[string]ComponentHealth `json:"components,omitempty"`
+	Commands   *CommandPoolState          `json:"commands,omitempty"`
+}
+
+// CommandPoolState describes the commands an agent is running and those
+// waiting for a worker, in the order they will run
+type CommandPoolState struct {
+	Workers   int            `json:"workers"`
+	Running   []CommandState `json:"running,omitempty"`
+	Queued    []CommandState `json:"queued,omitempty"`
+	Cancelled int64          `json:"cancelled"` // commands cancelled since the agent started
+}
+
+// CommandState is a command waiting or running on an agent
+type CommandState struct {
+	CommandID string    `json:"command_id"`
+	Tool      string    `json:"tool"`
+	Action    string    `json:"action,omitempty"`
+	Priority  int       `json:"priority,omitempty"`
+	Since     time.Time `json:"since"` // when it was queued, or started running
+}
+
+// HeartbeatMetrics contains internal agent metrics reported with each heartbeat
+type HeartbeatMetrics struct {
+	EventQueueSize   int `json:"event_queue_size"`
+	MetricsQueueSize int `json:"metrics_queue_size"`
+	CommandQueueSize int `json:"command_queue_size"`
+	CommandsRunning  int `json:"commands_running"`
+	ResultQueueSize  int `json:"result_queue_size"`
+	UptimeSeconds    int `json:"uptime_seconds"`
+
+	// SpoolDepth and SpoolBytes describe messages buffered on disk while disconnected
+	SpoolDepth int64 `json:"spool_depth"`
+	SpoolBytes int64 `json:"spool_bytes"`
+
+	// Counters of messages dropped since the agent started
+	EventsDropped   int64 `json:"events_dropped"`
+	MetricsDropped  int64 `json:"metrics_dropped"`
+	CommandsDropped int64 `json:"commands_dropped"`
+	ResultsDropped  int64 `json:"results_dropped"`
+
+	// Reconnects counts NATS reconnections since the agent started
+	Reconnects int64 `json:"reconnects"`
+}
+
+// ComponentHealth describes the state of a single agent component
+type ComponentHealth struct {
+	Healthy bool `json:"healthy"`
+	// Synced reports the informer cache state, nil for components without informers
+	Synced        *bool      `json:"synced,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorTime *time.Time `json:"last_error_time,omitempty"`
+	ErrorCount    int64      `json:"error_count"`
+}
@@ -0,0 +1,451 @@
+package protocol
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSubjects(t *testing.T) {
+	tests := []struct {
+		name     string
+		got      string
+		expected string
+	}{
+		{"Register", RegisterSubject("c1"), "aetherius.agent.c1.register"},
+		{"Heartbeat", HeartbeatSubject("c1"), "aetherius.agent.c1.heartbeat"},
+		{"Event", EventSubject("c1"), "aetherius.agent.c1.event"},
+		{"Metrics", MetricsSubject("c1"), "aetherius.agent.c1.metrics"},
+		{"Result", ResultSubject("c1"), "aetherius.agent.c1.result"},
+		{"Command", CommandSubject("c1"), "aetherius.agent.c1.command"},
+		{"Wildcard", WildcardSubject(KindEvent), "aetherius.agent.*.event"},
+		{"CommandOutput", CommandOutputSubject("c1", "cmd-1"), "aetherius.agent.c1.output.cmd-1"},
+		{"CommandOutputWildcard", CommandOutputWildcard(), "aetherius.agent.*.output.*"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.got != tt.expected {
+				t.Errorf("%s = %v, want %v", tt.name, tt.got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestIsSubjectToken(t *testing.T) {
+	tests := map[string]bool{
+		"7f9c2ba4-e88f-4a3b-9d3c-2f1e8b6a5c4d": true,
+		"cmd-1":                                true,
+		"":                                     false,
+		"cmd.1":                                false,
+		"cmd-*":                                false,
+		">":                                    false,
+		"cmd 1":                                false,
+	}
+
+	for token, want := range tests {
+		if got := IsSubjectToken(token); got != want {
+			t.Errorf("IsSubjectToken(%q) = %v, want %v", token, got, want)
+		}
+	}
+}
+
+func TestParseSubject(t *testing.T) {
+	clusterID, kind, err := ParseSubject("aetherius.agent.prod-1.event")
+	if err != nil {
+		t.Fatalf("ParseSubject failed: %v", err)
+	}
+	if clusterID != "prod-1" || kind != KindEvent {
+		t.Errorf("ParseSubject = (%v, %v), want (prod-1, event)", clusterID, kind)
+	}
+
+	clusterID, kind, err = ParseSubject(CommandOutputSubject("prod-1", "cmd-1"))
+	if err != nil {
+		t.Fatalf("ParseSubject failed: %v", err)
+	}
+	if clusterID != "prod-1" || kind != KindOutput {
+		t.Errorf("ParseSubject = (%v, %v), want (prod-1, output)", clusterID, kind)
+	}
+
+	for _, subject := range []string{"agent.event.prod-1", "aetherius.agent.event", "aetherius.agent.prod-1.", "aetherius.agent..output.cmd-1"} {
+		if _, _, err := ParseSubject(subject); err == nil {
+			t.Errorf("ParseSubject(%q) should fail", subject)
+		}
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	event := Event{ID: "event-1", ClusterID: "c1", Reason: "BackOff"}
+
+	data, err := Encode(MessageTypeEvent, "agent-c1", "c1", event)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+
+	env, err := Decode(data)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+
+	if env.SchemaVersion != Version {
+		t.Errorf("SchemaVersion = %v, want %v", env.SchemaVersion, Version)
+	}
+	if env.MessageID == "" {
+		t.Error("MessageID is empty")
+	}
+	if env.Sender != "agent-c1" || env.ClusterID != "c1" {
+		t.Errorf("Sender/ClusterID = %v/%v, want agent-c1/c1", env.Sender, env.ClusterID)
+	}
+
+	var decoded Event
+	if err := env.DecodePayload(MessageTypeEvent, &decoded); err != nil {
+		t.Fatalf("DecodePayload failed: %v", err)
+	}
+	if decoded.ID != "event-1" || decoded.Reason != "BackOff" {
+		t.Errorf("decoded event = %+v", decoded)
+	}
+
+	if err := env.DecodePayload(MessageTypeCommand, &Command{}); err == nil {
+		t.Error("DecodePayload should fail for mismatched message type")
+	}
+}
+
+func TestDecodeRejectsUnsupportedVersion(t *testing.T) {
+	data := []byte(`{"schema_version":99,"type":"event","payload":{}}`)
+
+	_, err := Decode(data)
+	if !errors.Is(err, ErrIncompatibleVersion) {
+		t.Errorf("Decode error = %v, want ErrIncompatibleVersion", err)
+	}
+
+	env, err := Unmarshal(data)
+	if err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if env.SchemaVersion != 99 {
+		t.Errorf("SchemaVersion = %v, want 99", env.SchemaVersion)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	version, err := Negotiate(Version)
+	if err != nil {
+		t.Fatalf("Negotiate(%d) failed: %v", Version, err)
+	}
+	if version != Version {
+		t.Errorf("Negotiate(%d) = %v, want %v", Version, version, Version)
+	}
+
+	for _, v := range []int{0, Version + 1} {
+		if _, err := Negotiate(v); !errors.Is(err, ErrIncompatibleVersion) {
+			t.Errorf("Negotiate(%d) error = %v, want ErrIncompatibleVersion", v, err)
+		}
+	}
+}
+
+func TestStreamForKind(t *testing.T) {
+	tests := []struct {
+		kind     string
+		stream   string
+		expected bool
+	}{
+		{KindEvent, StreamEvents, true},
+		{KindMetrics, StreamMetrics, true},
+		{KindResult, StreamResults, true},
+		{KindHeartbeat, "", false},
+		{KindCommand, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.kind, func(t *testing.T) {
+			stream, ok := StreamForKind(tt.kind)
+			if stream != tt.stream || ok != tt.expected {
+				t.Errorf("StreamForKind(%s) = (%v, %v), want (%v, %v)", tt.kind, stream, ok, tt.stream, tt.expected)
+			}
+		})
+	}
+
+	if got := DeadLetterSubject("c1", KindEvent); got != "aetherius.deadletter.c1.event" {
+		t.Errorf("DeadLetterSubject = %v, want aetherius.deadletter.c1.event", got)
+	}
+}
+
+func TestHeartbeatComponents(t *testing.T) {
+	synced := true
+	heartbeat := Heartbeat{
+		ClusterID: "c1",
+		Status:    HeartbeatStatusDegraded,
+		Components: map[string]ComponentHealth{
+			"event_watcher": {Healthy: true, Synced: &synced},
+			"communication": {Healthy: false, LastError: "nats: timeout", ErrorCount: 3},
+		},
+	}
+
+	data, err := Encode(MessageTypeHeartbeat, "agent-c1", "c1", heartbeat)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	env, err := Decode(data)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+
+	var decoded Heartbeat
+	if err := env.DecodePayload(MessageTypeHeartbeat, &decoded); err != nil {
+		t.Fatalf("DecodePayload failed: %v", err)
+	}
+
+	watcher := decoded.Components["event_watcher"]
+	if watcher.Synced == nil || !*watcher.Synced {
+		t.Errorf("event_watcher synced = %v, want true", watcher.Synced)
+	}
+	comm := decoded.Components["communication"]
+	if comm.Synced != nil {
+		t.Errorf("communication synced = %v, want nil", *comm.Synced)
+	}
+	if comm.Healthy || comm.LastError != "nats: timeout" || comm.ErrorCount != 3 {
+		t.Errorf("communication = %+v", comm)
+	}
+}
+
+func TestMetricsDelta(t *testing.T) {
+	metrics := Metrics{
+		ClusterID: "c1",
+		Snapshot:  MetricsSnapshotDelta,
+		Removed:   map[string][]string{"namespaces": {"old"}},
+		Data:      map[string]interface{}{"namespaces": map[string]interface{}{"demo": map[string]interface{}{}}},
+	}
+
+	data, err := Encode(MessageTypeMetrics, "agent-c1", "c1", metrics)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	env, err := Decode(data)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+
+	var decoded Metrics
+	if err := env.DecodePayload(MessageTypeMetrics, &decoded); err != nil {
+		t.Fatalf("DecodePayload failed: %v", err)
+	}
+	if !decoded.IsDelta() {
+		t.Errorf("Snapshot = %v, want %v", decoded.Snapshot, MetricsSnapshotDelta)
+	}
+	if got := decoded.Removed["namespaces"]; len(got) != 1 || got[0] != "old" {
+		t.Errorf("Removed = %v, want namespaces [old]", decoded.Removed)
+	}
+
+	// Snapshots of agents that predate deltas are full
+	if (&Metrics{}).IsDelta() {
+		t.Error("metrics without a snapshot kind reported as a delta")
+	}
+}
+
+func TestValidateCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		tool    string
+		action  string
+		args    []string
+		params  map[string]string
+		wantErr string
+	}{
+		{"kubectl get", "kubectl", "get", nil, map[string]string{"resource": "deployments.apps", "namespace": "demo", "label_selector": "app=web"}, ""},
+		{"kubectl name with colon", "kubectl", "get", nil, map[string]string{"resource": "clusterroles", "name": "system:node"}, ""},
+		{"kubectl unknown tool", "rm", "-rf", nil, nil, `rm -rf: tool is not allowed`},
+		{"kubectl without action", "kubectl", "", nil, nil, `kubectl: action is required`},
+		{"kubectl exec", "kubectl", "exec", nil, nil, `kubectl exec: action is not allowed`},
+		{"kubectl args", "kubectl", "get", []string{"pods"}, map[string]string{"resource": "pods"}, `kubectl get: arguments take none, got 1`},
+		{"kubectl missing param", "kubectl", "describe", nil, map[string]string{"resource": "pods"}, `kubectl describe: param "name" is required`},
+		{"kubectl unknown param", "kubectl", "get", nil, map[string]string{"resource": "pods", "output": "yaml"}, `kubectl get: param "output" is not allowed`},
+		{"kubectl bad namespace", "kubectl", "get", nil, map[string]string{"resource": "pods", "namespace": "demo;rm"}, `kubectl get: param "namespace" must be a namespace name`},
+		{"kubectl name with path", "kubectl", "get", nil, map[string]string{"resource": "pods", "name": "../x"}, `kubectl get: param "name" must be an object name`},
+		{"kubectl exclusive", "kubectl", "get", nil, map[string]string{"resource": "pods", "namespace": "demo", "all_namespaces": "true"}, `kubectl get: param "all_namespaces" cannot be combined with "namespace"`},
+		{"kubectl tail lines", "kubectl", "logs", nil, map[string]string{"name": "web", "tail_lines": "0"}, `kubectl logs: param "tail_lines" must be an integer between 1 and 10000`},
+		{"kubectl since", "kubectl", "logs", nil, map[string]string{"name": "web", "since": "720h"}, `kubectl logs: param "since" must be a duration between 1s and 168h0m0s`},
+		{"kubectl top enum", "kubectl", "top", nil, map[string]string{"resource": "deployments"}, `kubectl top: param "resource" must be one of nodes, pods`},
+		{"ps", "ps", "aux", nil, nil, ""},
+		{"uptime", "uptime", "", nil, nil, ""},
+		{"uptime with args", "uptime", "", []string{"-p"}, nil, `uptime: flag "-p" is not allowed`},
+		{"df params", "df", "-h", nil, map[string]string{"namespace": "demo"}, `df -h: param "namespace" is not allowed`},
+		{"ping", "ping", "", []string{"-c", "3", "-W", "2", "10.0.0.1"}, nil, ""},
+		{"ping without count", "ping", "", []string{"kube-dns.kube-system"}, nil, `ping: flag "-c" is required`},
+		{"ping count too high", "ping", "", []string{"-c", "1000", "example.com"}, nil, `ping: flag "-c" must be an integer between 1 and 10`},
+		{"ping missing value", "ping", "", []string{"example.com", "-c"}, nil, `ping: flag "-c" needs a value`},
+		{"ping flood", "ping", "", []string{"-f", "-c", "3", "example.com"}, nil, `ping: flag "-f" is not allowed`},
+		{"ping two hosts", "ping", "", []string{"-c", "1", "a.example", "b.example"}, nil, `ping: arguments must be 1, got 2`},
+		{"nslookup shell", "nslookup", "", []string{"example.com;reboot"}, nil, `nslookup: argument 1 ("example.com;reboot") must be a host name or IP address`},
+		{"nslookup killer host", "nslookup", "", []string{"killer.example.com"}, nil, ""},
+		{"dig", "dig", "", []string{"+short", "example.com", "AAAA"}, nil, ""},
+		{"dig record type", "dig", "", []string{"example.com", "ANY"}, nil, `dig: argument 2 ("ANY") must be one of A, AAAA, CNAME, MX, NS, PTR, SOA, SRV, TXT`},
+		{"curl combined switches", "curl", "", []string{"-sI", "http://web.demo:8080/healthz"}, nil, `curl: flag "-sI" is not allowed`},
+		{"curl inline value", "curl", "", []string{"-s", "--max-time=5", "https://web.demo/healthz?full=1"}, nil, ""},
+		{"curl output file", "curl", "", []string{"-o", "/etc/passwd", "http://x"}, nil, `curl: flag "-o" is not allowed`},
+		{"curl file URL", "curl", "", []string{"file:///etc/shadow"}, nil, `curl: argument 1 ("file:///etc/shadow") must be an http or https URL`},
+		{"curl switch value", "curl", "", []string{"-s=1", "http://x"}, nil, `curl: flag "-s" takes no value`},
+		{"wget without spider", "wget", "", []string{"http://x"}, nil, `wget: flag "--spider" is required`},
+		{"remediation restart", "remediation", "rollout-restart", nil, map[string]string{"kind": "deployment", "name": "web", "namespace": "demo", "dry_run": "true"}, ""},
+		{"remediation scale daemonset", "remediation", "scale", nil, map[string]string{"kind": "daemonset", "name": "agent", "namespace": "demo", "replicas": "2"}, `remediation scale: param "kind" must be one of deployment, statefulset`},
+		{"remediation scale without namespace", "remediation", "scale", nil, map[string]string{"kind": "deployment", "name": "web", "replicas": "2"}, `remediation scale: param "namespace" is required`},
+		{"remediation cordon", "remediation", "cordon", nil, map[string]string{"name": "node-1"}, ""},
+		{"remediation unknown action", "remediation", "drain", nil, map[string]string{"name": "node-1"}, `remediation drain: action is not allowed`},
+		{"remediation patch resources", "remediation", "patch-resources", nil, map[string]string{"kind": "deployment", "name": "web", "namespace": "demo", "memory_limit": "512Mi", "cpu_limit": "none"}, ""},
+		{"remediation patch nothing", "remediation", "patch-resources", nil, map[string]string{"kind": "deployment", "name": "web", "namespace": "demo"}, `remediation patch-resources: params cpu_limit, memory_limit, cpu_request, memory_request need at least one value`},
+		{"remediation bad quantity", "remediation", "patch-resources", nil, map[string]string{"kind": "deployment", "name": "web", "namespace": "demo", "cpu_limit": "1 core"}, `remediation patch-resources: param "cpu_limit" must be a quantity such as 500m or 256Mi, or none`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateCommand(tt.tool, tt.action, tt.args, tt.params, nil)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("ValidateCommand() error = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("ValidateCommand() error = %v, want %q", err, tt.wantErr)
+			}
+			var validationErr *CommandValidationError
+			if !errors.As(err, &validationErr) {
+				t.Errorf("ValidateCommand() error = %T, want *CommandValidationError", err)
+			}
+		})
+	}
+}
+
+func TestValidateCommandEnv(t *testing.T) {
+	params := map[string]string{"resource": "pods"}
+
+	if err := ValidateCommand("kubectl", "get", nil, params, map[string]string{}); err != nil {
+		t.Errorf("empty env: error = %v, want nil", err)
+	}
+
+	err := ValidateCommand("kubectl", "get", nil, params, map[string]string{"KUBECONFIG": "/tmp/evil"})
+	var validationErr *CommandValidationError
+	if !errors.As(err, &validationErr) || err.Error() != "kubectl get: env is not allowed" {
+		t.Errorf("env: error = %v, want kubectl get: env is not allowed", err)
+	}
+}
+
+func TestCommandTools(t *testing.T) {
+	tools := CommandTools()
+	if got := tools["kubectl"]; len(got) != 5 || got[0] != "describe" {
+		t.Errorf("kubectl actions = %v, want the 5 sorted actions", got)
+	}
+	if got := tools["uptime"]; len(got) != 1 || got[0] != "" {
+		t.Errorf("uptime actions = %v, want the empty action", got)
+	}
+	if _, ok := tools[RemediationTool]; ok {
+		t.Error("remediation is listed among the read-only tools")
+	}
+	if got := RemediationActions(); len(got) != 6 || got[0] != RemediationCordon {
+		t.Errorf("remediation actions = %v, want the 6 sorted actions", got)
+	}
+}
+
+func TestValidateCommandType(t *testing.T) {
+	tests := []struct {
+		commandType string
+		tool        string
+		wantErr     string
+	}{
+		{"diagnostic", "kubectl", ""},
+		{"remediation", "remediation", ""},
+		{"remediation", "kubectl", `kubectl: type "remediation" requires the remediation tool`},
+		{"diagnostic", "remediation", `remediation: type "diagnostic" cannot run remediation actions`},
+	}
+
+	for _, tt := range tests {
+		err := ValidateCommandType(tt.commandType, tt.tool)
+		if (err == nil && tt.wantErr != "") || (err != nil && err.Error() != tt.wantErr) {
+			t.Errorf("ValidateCommandType(%q, %q) error = %v, want %q", tt.commandType, tt.tool, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCommandSignature(t *testing.T) {
+	seed := make([]byte, ed25519.SeedSize)
+	seed[0] = 1
+	key := ed25519.NewKeyFromSeed(seed)
+	keys := map[string]ed25519.PublicKey{"k1": key.Public().(ed25519.PublicKey)}
+
+	signed := func() *Command {
+		cmd := &Command{ID: "cmd-1", Type: "diagnostic", Tool: "kubectl", Action: "get",
+			Params: map[string]string{"resource": "pods"}, Timeout: time.Minute, CreatedAt: time.Now()}
+		if err := NewCommandSigner("k1", key, 5*time.Minute).Sign(cmd, "c1"); err != nil {
+			t.Fatalf("Sign failed: %v", err)
+		}
+
+		// Verify what the agent decodes from the wire
+		data, err := Encode(MessageTypeCommand, "agent-manager", "c1", cmd)
+		if err != nil {
+			t.Fatalf("Encode failed: %v", err)
+		}
+		env, err := Decode(data)
+		if err != nil {
+			t.Fatalf("Decode failed: %v", err)
+		}
+		var decoded Command
+		if err := env.DecodePayload(MessageTypeCommand, &decoded); err != nil {
+			t.Fatalf("DecodePayload failed: %v", err)
+		}
+		return &decoded
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(cmd *Command)
+		cluster string
+		at      time.Duration
+		wantErr error
+	}{
+		{"valid", func(cmd *Command) {}, "c1", 0, nil},
+		{"clock skew", func(cmd *Command) {}, "c1", 5*time.Minute + 20*time.Second, nil},
+		{"unsigned", func(cmd *Command) { cmd.Signature = nil }, "c1", 0, ErrCommandUnsigned},
+		{"unknown key", func(cmd *Command) { cmd.Signature.KeyID = "k2" }, "c1", 0, ErrCommandUnknownKey},
+		{"tampered params", func(cmd *Command) { cmd.Params["resource"] = "secrets" }, "c1", 0, ErrCommandBadSignature},
+		{"raised priority", func(cmd *Command) { cmd.Priority = 10 }, "c1", 0, ErrCommandBadSignature},
+		{"extended expiry", func(cmd *Command) { cmd.Signature.ExpiresAt = cmd.Signature.ExpiresAt.Add(time.Hour) }, "c1", 0, ErrCommandBadSignature},
+		{"other cluster", func(cmd *Command) {}, "c2", 0, ErrCommandBadSignature},
+		{"expired", func(cmd *Command) {}, "c1", 10 * time.Minute, ErrCommandExpired},
+		{"issued in the future", func(cmd *Command) {}, "c1", -time.Minute, ErrCommandNotYetValid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := signed()
+			tt.modify(cmd)
+			err := VerifyCommandSignature(cmd, tt.cluster, keys, time.Now().Add(tt.at), 30*time.Second)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("VerifyCommandSignature() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	seed := make([]byte, ed25519.SeedSize)
+	key := ed25519.NewKeyFromSeed(seed)
+
+	for _, encoded := range []string{base64.StdEncoding.EncodeToString(seed), base64.StdEncoding.EncodeToString(key)} {
+		parsed, err := ParsePrivateKey(encoded)
+		if err != nil || !parsed.Equal(key) {
+			t.Errorf("ParsePrivateKey(%q) = %v, want the key", encoded, err)
+		}
+	}
+	if _, err := ParsePrivateKey(base64.StdEncoding.EncodeToString(seed[:16])); err == nil {
+		t.Error("ParsePrivateKey accepted a 16-byte key")
+	}
+
+	public, err := ParsePublicKey(base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)))
+	if err != nil || !public.Equal(key.Public()) {
+		t.Errorf("ParsePublicKey = %v, want the public key", err)
+	}
+	if _, err := ParsePublicKey("not base64!"); err == nil {
+		t.Error("ParsePublicKey accepted invalid base64")
+	}
+}
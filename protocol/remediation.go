@@ -0,0 +1,164 @@
+package protocol
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+// CommandTypeRemediation is the type of the commands that change the cluster.
+// They use the RemediationTool, with one of the remediation actions as
+// action, and agents run them only as far as their local policy allows.
+const CommandTypeRemediation = "remediation"
+
+// RemediationTool is the tool of remediation commands
+const RemediationTool = "remediation"
+
+// Remediation actions
+const (
+	RemediationRolloutRestart = "rollout-restart" // restart the pods of a workload
+	RemediationScale          = "scale"           // set the replicas of a deployment or statefulset
+	RemediationDeletePod      = "delete-pod"      // delete a pod, for its controller to replace
+	RemediationCordon         = "cordon"          // mark a node unschedulable
+	RemediationUncordon       = "uncordon"        // mark a node schedulable
+	RemediationPatchResources = "patch-resources" // set the requests and limits of a container
+)
+
+// Params of remediation commands, besides name and namespace
+const (
+	CommandParamKind          = "kind"           // workload kind: deployment, statefulset or daemonset
+	CommandParamReplicas      = "replicas"       // replicas to scale to
+	CommandParamGracePeriod   = "grace_period"   // seconds a deleted pod has to terminate
+	CommandParamCPULimit      = "cpu_limit"      // quantity, or "none" to remove it
+	CommandParamMemoryLimit   = "memory_limit"   // quantity, or "none" to remove it
+	CommandParamCPURequest    = "cpu_request"    // quantity, or "none" to remove it
+	CommandParamMemoryRequest = "memory_request" // quantity, or "none" to remove it
+	CommandParamDryRun        = "dry_run"        // "true" to have the API server check the change without making it
+)
+
+// RemediationQuantityNone removes a request or limit in patch-resources
+const RemediationQuantityNone = "none"
+
+// Workload kinds of remediation commands
+const (
+	WorkloadDeployment  = "deployment"
+	WorkloadStatefulSet = "statefulset"
+	WorkloadDaemonSet   = "daemonset"
+)
+
+// Values of remediation params
+var (
+	patternQuantity = regexp.MustCompile(`^([0-9]+(\.[0-9]+)?(m|k|M|G|T|Ki|Mi|Gi|Ti)?|none)$`)
+	valueQuantity   = ValueSpec{Kind: ValueString, Pattern: patternQuantity, Hint: "a quantity such as 500m or 256Mi, or none"}
+	valueWorkload   = ValueSpec{Kind: ValueEnum, Enum: []string{WorkloadDeployment, WorkloadStatefulSet, WorkloadDaemonSet}}
+)
+
+// remediationSchemas are the remediation actions and what they accept. Every
+// action takes dry_run.
+var remediationSchemas = map[string]*CommandSchema{
+	RemediationRolloutRestart: {
+		Params: map[string]ValueSpec{
+			CommandParamKind:      valueWorkload,
+			CommandParamName:      valueName,
+			CommandParamNamespace: valueNamespace,
+			CommandParamDryRun:    valueBool,
+		},
+		RequiredParams: []string{CommandParamKind, CommandParamName, CommandParamNamespace},
+	},
+	RemediationScale: {
+		Params: map[string]ValueSpec{
+			CommandParamKind:      {Kind: ValueEnum, Enum: []string{WorkloadDeployment, WorkloadStatefulSet}},
+			CommandParamName:      valueName,
+			CommandParamNamespace: valueNamespace,
+			CommandParamReplicas:  {Kind: ValueInt, Min: 0, Max: 1000},
+			CommandParamDryRun:    valueBool,
+		},
+		RequiredParams: []string{CommandParamKind, CommandParamName, CommandParamNamespace, CommandParamReplicas},
+	},
+	RemediationDeletePod: {
+		Params: map[string]ValueSpec{
+			CommandParamName:        valueName,
+			CommandParamNamespace:   valueNamespace,
+			CommandParamGracePeriod: {Kind: ValueInt, Min: 0, Max: 3600},
+			CommandParamDryRun:      valueBool,
+		},
+		RequiredParams: []string{CommandParamName, CommandParamNamespace},
+	},
+	RemediationCordon: {
+		Params:         map[string]ValueSpec{CommandParamName: valueName, CommandParamDryRun: valueBool},
+		RequiredParams: []string{CommandParamName},
+	},
+	RemediationUncordon: {
+		Params:         map[string]ValueSpec{CommandParamName: valueName, CommandParamDryRun: valueBool},
+		RequiredParams: []string{CommandParamName},
+	},
+	RemediationPatchResources: {
+		Params: map[string]ValueSpec{
+			CommandParamKind:          valueWorkload,
+			CommandParamName:          valueName,
+			CommandParamNamespace:     valueNamespace,
+			CommandParamContainer:     valueContainer,
+			CommandParamCPULimit:      valueQuantity,
+			CommandParamMemoryLimit:   valueQuantity,
+			CommandParamCPURequest:    valueQuantity,
+			CommandParamMemoryRequest: valueQuantity,
+			CommandParamDryRun:        valueBool,
+		},
+		RequiredParams: []string{CommandParamKind, CommandParamName, CommandParamNamespace},
+		AnyOfParams:    []string{CommandParamCPULimit, CommandParamMemoryLimit, CommandParamCPURequest, CommandParamMemoryRequest},
+	},
+}
+
+// RemediationActions returns the catalogue of remediation actions
+func RemediationActions() []string {
+	actions := make([]string, 0, len(remediationSchemas))
+	for action := range remediationSchemas {
+		actions = append(actions, action)
+	}
+	sort.Strings(actions)
+	return actions
+}
+
+// RemediationClusterScoped reports whether a remediation action changes a
+// cluster-scoped object, a node, rather than one of a namespace
+func RemediationClusterScoped(action string) bool {
+	return action == RemediationCordon || action == RemediationUncordon
+}
+
+// ValidateCommandType checks that remediation commands use the remediation
+// tool, and that no other command does
+func ValidateCommandType(commandType, tool string) error {
+	switch {
+	case commandType == CommandTypeRemediation && tool != RemediationTool:
+		return &CommandValidationError{Tool: tool, Field: fmt.Sprintf("type %q", commandType), Reason: "requires the remediation tool"}
+	case commandType != CommandTypeRemediation && tool == RemediationTool:
+		return &CommandValidationError{Tool: tool, Field: fmt.Sprintf("type %q", commandType), Reason: "cannot run remediation actions"}
+	}
+	return nil
+}
+
+// RemediationReport is the data of the result of a remediation command. The
+// snapshot holds the object as it was before the change, and the rollback,
+// when the change can be undone, the remediation restoring it.
+type RemediationReport struct {
+	Action   string                 `json:"action"`
+	DryRun   bool                   `json:"dry_run"`
+	Target   RemediationTarget      `json:"target"`
+	Rule     string                 `json:"rule"`    // policy rule that allowed the action
+	Changed  bool                   `json:"changed"` // false when the object was already as requested
+	Snapshot map[string]interface{} `json:"snapshot,omitempty"`
+	Rollback *RemediationRollback   `json:"rollback,omitempty"`
+}
+
+// RemediationTarget is the object a remediation changes
+type RemediationTarget struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+}
+
+// RemediationRollback is the remediation undoing another
+type RemediationRollback struct {
+	Action string            `json:"action"`
+	Params map[string]string `json:"params"`
+}
@@ -0,0 +1,142 @@
+package protocol
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// CommandSignature authenticates a command as issued by agent-manager for
+// one cluster. The nonce is unique to the command, so that agents can refuse
+// one replayed before it expires.
+type CommandSignature struct {
+	KeyID     string    `json:"key_id"`
+	Nonce     string    `json:"nonce"`
+	IssuedAt  time.Time `json:"issued_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Value     []byte    `json:"value,omitempty"` // Ed25519 signature
+}
+
+// Reasons a command signature is refused
+var (
+	ErrCommandUnsigned     = errors.New("command is not signed")
+	ErrCommandUnknownKey   = errors.New("command is signed with an unknown key")
+	ErrCommandBadSignature = errors.New("command signature is invalid")
+	ErrCommandExpired      = errors.New("command has expired")
+	ErrCommandNotYetValid  = errors.New("command is not valid yet")
+	ErrCommandReplayed     = errors.New("command was already received")
+)
+
+// CommandSigner signs the commands agent-manager dispatches
+type CommandSigner struct {
+	keyID string
+	key   ed25519.PrivateKey
+	ttl   time.Duration
+}
+
+// NewCommandSigner creates a signer whose signatures expire after ttl
+func NewCommandSigner(keyID string, key ed25519.PrivateKey, ttl time.Duration) *CommandSigner {
+	return &CommandSigner{keyID: keyID, key: key, ttl: ttl}
+}
+
+// Sign sets the signature of a command bound for clusterID, with a new nonce
+func (s *CommandSigner) Sign(cmd *Command, clusterID string) error {
+	now := time.Now().UTC()
+	cmd.Signature = &CommandSignature{
+		KeyID:     s.keyID,
+		Nonce:     NewMessageID(),
+		IssuedAt:  now,
+		ExpiresAt: now.Add(s.ttl),
+	}
+
+	payload, err := commandSigningPayload(cmd, clusterID)
+	if err != nil {
+		cmd.Signature = nil
+		return err
+	}
+	cmd.Signature.Value = ed25519.Sign(s.key, payload)
+	return nil
+}
+
+// VerifyCommandSignature checks that a command bound for clusterID was
+// signed by one of keys and is valid at now, allowing skew between the
+// clocks of agent-manager and the agent. Replayed nonces are left to the
+// caller, which remembers them.
+func VerifyCommandSignature(cmd *Command, clusterID string, keys map[string]ed25519.PublicKey, now time.Time, skew time.Duration) error {
+	sig := cmd.Signature
+	if sig == nil || len(sig.Value) == 0 {
+		return ErrCommandUnsigned
+	}
+
+	key, ok := keys[sig.KeyID]
+	if !ok {
+		return fmt.Errorf("%w %q", ErrCommandUnknownKey, sig.KeyID)
+	}
+
+	payload, err := commandSigningPayload(cmd, clusterID)
+	if err != nil {
+		return err
+	}
+	if sig.Nonce == "" || !ed25519.Verify(key, payload, sig.Value) {
+		return ErrCommandBadSignature
+	}
+
+	if now.After(sig.ExpiresAt.Add(skew)) {
+		return fmt.Errorf("%w at %s", ErrCommandExpired, sig.ExpiresAt.Format(time.RFC3339))
+	}
+	if sig.IssuedAt.After(now.Add(skew)) {
+		return fmt.Errorf("%w until %s", ErrCommandNotYetValid, sig.IssuedAt.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// commandSigningPayload returns the bytes signed for a command: the command
+// with its signature but the signature value, and the cluster it is bound
+// for, so that it cannot be sent to another one
+func commandSigningPayload(cmd *Command, clusterID string) ([]byte, error) {
+	signed := *cmd
+	sig := *cmd.Signature
+	sig.Value = nil
+	signed.Signature = &sig
+
+	payload, err := json.Marshal(struct {
+		ClusterID string   `json:"cluster_id"`
+		Command   *Command `json:"command"`
+	}{clusterID, &signed})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal command for signing: %w", err)
+	}
+	return payload, nil
+}
+
+// ParsePublicKey decodes a base64 Ed25519 public key
+func ParsePublicKey(encoded string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode public key: %w", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key is %d bytes, want %d", len(key), ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// ParsePrivateKey decodes a base64 Ed25519 private key, given whole or as
+// its 32-byte seed
+func ParsePrivateKey(encoded string) (ed25519.PrivateKey, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode private key: %w", err)
+	}
+	switch len(key) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(key), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(key), nil
+	default:
+		return nil, fmt.Errorf("private key is %d bytes, want %d or %d", len(key), ed25519.SeedSize, ed25519.PrivateKeySize)
+	}
+}
@@ -0,0 +1,41 @@
+package protocol
+
+import "fmt"
+
+// JetStream stream names holding agent → manager traffic that must survive
+// an agent-manager restart
+const (
+	StreamEvents     = "AGENT_EVENTS"
+	StreamMetrics    = "AGENT_METRICS"
+	StreamResults    = "AGENT_RESULTS"
+	StreamDeadLetter = "AGENT_DEAD_LETTER"
+)
+
+// DeadLetterPrefix is the prefix of subjects receiving messages that could
+// not be processed after the maximum number of deliveries
+const DeadLetterPrefix = "aetherius.deadletter"
+
+// StreamForKind returns the stream that stores subjects of the given kind
+func StreamForKind(kind string) (string, bool) {
+	switch kind {
+	case KindEvent:
+		return StreamEvents, true
+	case KindMetrics:
+		return StreamMetrics, true
+	case KindResult:
+		return StreamResults, true
+	default:
+		return "", false
+	}
+}
+
+// DeadLetterSubject returns the dead-letter subject for a cluster and kind,
+// e.g. aetherius.deadletter.<cluster_id>.event
+func DeadLetterSubject(clusterID, kind string) string {
+	return fmt.Sprintf("%s.%s.%s", DeadLetterPrefix, clusterID, kind)
+}
+
+// DeadLetterWildcard matches every dead-letter subject
+func DeadLetterWildcard() string {
+	return DeadLetterPrefix + ".>"
+}
@@ -0,0 +1,104 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SubjectPrefix is the common prefix of every agent subject
+const SubjectPrefix = "aetherius.agent"
+
+// Subject kinds, used as the last token of an agent subject
+const (
+	KindRegister  = "register"
+	KindHeartbeat = "heartbeat"
+	KindEvent     = "event"
+	KindMetrics   = "metrics"
+	KindResult    = "result"
+	KindCommand   = "command"
+	KindOutput    = "output"
+)
+
+// Subject returns the subject for the given cluster and kind,
+// e.g. aetherius.agent.<cluster_id>.event
+func Subject(clusterID, kind string) string {
+	return fmt.Sprintf("%s.%s.%s", SubjectPrefix, clusterID, kind)
+}
+
+// WildcardSubject returns a subject matching the given kind for all clusters
+func WildcardSubject(kind string) string {
+	return Subject("*", kind)
+}
+
+// RegisterSubject returns the registration subject of a cluster (agent → manager, request/reply)
+func RegisterSubject(clusterID string) string {
+	return Subject(clusterID, KindRegister)
+}
+
+// HeartbeatSubject returns the heartbeat subject of a cluster (agent → manager)
+func HeartbeatSubject(clusterID string) string {
+	return Subject(clusterID, KindHeartbeat)
+}
+
+// EventSubject returns the event subject of a cluster (agent → manager)
+func EventSubject(clusterID string) string {
+	return Subject(clusterID, KindEvent)
+}
+
+// MetricsSubject returns the metrics subject of a cluster (agent → manager)
+func MetricsSubject(clusterID string) string {
+	return Subject(clusterID, KindMetrics)
+}
+
+// ResultSubject returns the command result subject of a cluster (agent → manager).
+// Command acknowledgements are published on the same subject so that they stay
+// ordered with the result of the command.
+func ResultSubject(clusterID string) string {
+	return Subject(clusterID, KindResult)
+}
+
+// CommandSubject returns the command subject of a cluster (manager → agent)
+func CommandSubject(clusterID string) string {
+	return Subject(clusterID, KindCommand)
+}
+
+// CommandOutputSubject returns the subject streaming the output of a command
+// (agent → manager), e.g. aetherius.agent.<cluster_id>.output.<command_id>
+func CommandOutputSubject(clusterID, commandID string) string {
+	return Subject(clusterID, KindOutput) + "." + commandID
+}
+
+// CommandOutputWildcard matches the output subjects of every command
+func CommandOutputWildcard() string {
+	return WildcardSubject(KindOutput) + ".*"
+}
+
+// IsSubjectToken reports whether s can be used as one token of a subject,
+// such as the command ID of an output subject
+func IsSubjectToken(s string) bool {
+	return s != "" && !strings.ContainsAny(s, ".*> \t\r\n")
+}
+
+// ParseSubject splits an agent subject into its cluster ID and kind. Output
+// subjects, which end with the command ID, are of kind output.
+func ParseSubject(subject string) (clusterID, kind string, err error) {
+	rest, ok := strings.CutPrefix(subject, SubjectPrefix+".")
+	if !ok {
+		return "", "", fmt.Errorf("subject %q is not an agent subject", subject)
+	}
+
+	idx := strings.LastIndex(rest, ".")
+	if idx <= 0 || idx == len(rest)-1 {
+		return "", "", fmt.Errorf("subject %q is malformed", subject)
+	}
+
+	clusterID, kind = rest[:idx], rest[idx+1:]
+	if cluster, ok := strings.CutSuffix(clusterID, "."+KindOutput); ok {
+		if cluster == "" {
+			return "", "", fmt.Errorf("subject %q is malformed", subject)
+		}
+		return cluster, KindOutput, nil
+	}
+
+	return clusterID, kind, nil
+}
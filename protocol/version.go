@@ -0,0 +1,37 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	// Version is the protocol version spoken by this build
+	Version = 1
+
+	// MinSupportedVersion is the oldest protocol version this build still accepts
+	MinSupportedVersion = 1
+)
+
+// ErrIncompatibleVersion is returned when a peer speaks an unsupported protocol version
+var ErrIncompatibleVersion = errors.New("incompatible protocol version")
+
+// CheckVersion verifies that version falls within the supported range
+func CheckVersion(version int) error {
+	if version < MinSupportedVersion || version > Version {
+		return fmt.Errorf("%w: got %d, supported %d..%d",
+			ErrIncompatibleVersion, version, MinSupportedVersion, Version)
+	}
+	return nil
+}
+
+// Negotiate returns the protocol version to use with a peer announcing version
+func Negotiate(version int) (int, error) {
+	if err := CheckVersion(version); err != nil {
+		return 0, err
+	}
+	if version < Version {
+		return version, nil
+	}
+	return Version, nil
+}